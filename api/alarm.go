@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Alarm defaults when the request leaves them out.
+const (
+	alarmVolume = 30
+	alarmFadeIn = "5m"
+)
+
+// CreateAlarmHandler creates an alarm: a schedule that wakes the device,
+// plays a preset (or URL) at volume 0 and fades it in. It is shorthand for
+// POST /api/schedules with a cron expression built from time and days.
+func (h *Handler) CreateAlarmHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string `json:"name"`
+		Time   string `json:"time"`    // "07:00"
+		Days   string `json:"days"`    // Cron day-of-week field, e.g. "mon-fri"; default every day
+		Preset string `json:"preset"`  // Preset to play, or
+		URL    string `json:"url"`     // a stream URL
+		Title  string `json:"title"`   // Optional, for url
+		USN    string `json:"usn"`     // Optional, default device
+		Volume int    `json:"volume"`  // Target volume, default 30
+		FadeIn string `json:"fade_in"` // Default "5m"
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var hour, minute int
+	if n, _ := fmt.Sscanf(req.Time, "%d:%d", &hour, &minute); n != 2 || hour > 23 || minute > 59 || hour < 0 || minute < 0 {
+		http.Error(w, fmt.Sprintf("Invalid time %q, expected HH:MM", req.Time), http.StatusBadRequest)
+		return
+	}
+	days := strings.TrimSpace(req.Days)
+	if days == "" {
+		days = "*"
+	}
+	if req.Volume == 0 {
+		req.Volume = alarmVolume
+	}
+	if req.FadeIn == "" {
+		req.FadeIn = alarmFadeIn
+	}
+	if req.Name == "" {
+		req.Name = "Alarm " + req.Time
+	}
+
+	sc := &Schedule{
+		Name:    req.Name,
+		Cron:    fmt.Sprintf("%d %d * * %s", minute, hour, days),
+		URL:     req.URL,
+		Title:   req.Title,
+		USN:     h.deviceByName(req.USN),
+		Preset:  req.Preset,
+		Volume:  req.Volume,
+		FadeIn:  req.FadeIn,
+		Enabled: true,
+	}
+	if err := h.validateSchedule(sc); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	h.createSchedule(w, sc)
+}
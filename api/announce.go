@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"dlna/tts"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// announcementTTL is how long renderers can fetch an announcement.
+	announcementTTL = 10 * time.Minute
+	// announcementMaxText bounds the text of one announcement.
+	announcementMaxText = 1000
+)
+
+// announcement is synthesized speech served to renderers at
+// /announce/{id}.
+type announcement struct {
+	audio    []byte
+	mimeType string
+	length   time.Duration // 0 if unknown
+	expires  time.Time
+}
+
+type announcements struct {
+	mu sync.Mutex
+	m  map[string]*announcement
+}
+
+func newAnnouncements() *announcements {
+	return &announcements{m: make(map[string]*announcement)}
+}
+
+// add stores a, dropping expired announcements, and returns its ID.
+func (s *announcements) add(a *announcement) string {
+	now := time.Now()
+	a.expires = now.Add(announcementTTL)
+	id := newID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, old := range s.m {
+		if now.After(old.expires) {
+			delete(s.m, id)
+		}
+	}
+	s.m[id] = a
+	return id
+}
+
+func (s *announcements) get(id string) *announcement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.m[id]
+	if a == nil || time.Now().After(a.expires) {
+		return nil
+	}
+	return a
+}
+
+// SetTTS sets the engine announcements are synthesized with, nil to
+// disable them, and the default language.
+func (h *Handler) SetTTS(engine tts.Engine, lang string) {
+	h.mu.Lock()
+	h.tts, h.ttsLang = engine, lang
+	h.mu.Unlock()
+}
+
+// AnnouncementHandler serves a synthesized announcement to renderers.
+func (h *Handler) AnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	a := h.announcements.get(r.PathValue("id"))
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", a.mimeType)
+	w.Header().Set("transferMode.dlna.org", "Streaming")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(a.audio))
+}
+
+// AnnounceHandler speaks text on devices: what they play is paused for
+// the announcement, then resumed where it was. It answers 202 with one
+// job per device.
+func (h *Handler) AnnounceHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Text   string   `json:"text"`
+		Lang   string   `json:"lang"`   // Optional, defaults to tts.lang
+		USNs   []string `json:"usns"`   // USNs or friendly names, default the default device
+		Volume int      `json:"volume"` // Optional, 1-100 while announcing
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	if v.required("text", req.Text) && utf8.RuneCountInString(req.Text) > announcementMaxText {
+		v.fail("text", "must be at most %d characters", announcementMaxText)
+	}
+	if req.Volume < 0 || req.Volume > 100 {
+		v.fail("volume", "must be 0-100")
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	h.mu.RLock()
+	engine, lang := h.tts, h.ttsLang
+	h.mu.RUnlock()
+	if engine == nil {
+		http.Error(w, "Text-to-speech is not configured", http.StatusNotImplemented)
+		return
+	}
+	if req.Lang != "" {
+		lang = req.Lang
+	}
+
+	usns := req.USNs
+	if len(usns) == 0 {
+		usns = []string{""}
+	}
+	var devices []*dlna.Device
+	for _, usn := range usns {
+		device := h.selectDevice(w, r, h.deviceByName(usn))
+		if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+			return
+		}
+		if h.interrupts.pending(device.USN) >= interruptMaxPending {
+			http.Error(w, fmt.Sprintf("%s: %v", device.FriendlyName, errInterruptBusy), http.StatusConflict)
+			return
+		}
+		if !slices.ContainsFunc(devices, func(d *dlna.Device) bool { return d.USN == device.USN }) {
+			devices = append(devices, device)
+		}
+	}
+
+	audio, mimeType, err := engine.Speak(r.Context(), req.Text, lang)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to synthesize speech: %v", err), http.StatusBadGateway)
+		return
+	}
+	a := &announcement{audio: audio, mimeType: mimeType, length: tts.WAVDuration(audio)}
+	id := h.announcements.add(a)
+
+	jobs := make([]*Job, 0, len(devices))
+	for _, device := range devices {
+		job := h.jobs.create(device.USN, "/announce/"+id, req.Text)
+		h.runJob(job, func(ctx context.Context) error {
+			base, err := h.agentURL(device)
+			if err != nil {
+				return err
+			}
+			meta := dlna.Metadata{Title: req.Text, Class: didl.ClassAudioItem, MimeType: a.mimeType}
+			return h.playOver(ctx, device, base+"/announce/"+id, meta, a.length, req.Volume)
+		})
+		jobs = append(jobs, job)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(jobs)
+}
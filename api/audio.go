@@ -0,0 +1,132 @@
+package api
+
+import (
+	"dlna/didl"
+	"dlna/dlna"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+)
+
+const audioStream = "audio"
+
+// audioCodec describes how a codec is encoded and announced to renderers.
+type audioCodec struct {
+	args     []string
+	ext      string
+	mimeType string
+}
+
+var audioCodecs = map[string]audioCodec{
+	"mp3":  {[]string{"-c:a", "libmp3lame", "-f", "mp3"}, ".mp3", "audio/mpeg"},
+	"aac":  {[]string{"-c:a", "aac", "-f", "adts"}, ".aac", "audio/aac"},
+	"flac": {[]string{"-c:a", "flac", "-f", "flac"}, ".flac", "audio/flac"},
+}
+
+// audioArgs builds the ffmpeg command line that captures the system audio
+// output. latency is the capture buffer in milliseconds; 0 keeps ffmpeg's
+// default.
+func audioArgs(source string, latency int, codec audioCodec, bitrate string) []string {
+	var args []string
+	switch runtime.GOOS {
+	case "windows":
+		// Needs a loopback device such as "Stereo Mix" or
+		// virtual-audio-capturer
+		if source == "" {
+			source = "audio=Stereo Mix"
+		}
+		args = []string{"-f", "dshow"}
+		if latency > 0 {
+			args = append(args, "-audio_buffer_size", strconv.Itoa(latency))
+		}
+		args = append(args, "-i", source)
+	case "darwin":
+		// Needs a loopback device such as BlackHole
+		if source == "" {
+			source = ":0"
+		}
+		args = []string{"-f", "avfoundation", "-i", source}
+	default:
+		// The monitor of the default PulseAudio/PipeWire sink is what
+		// the PC is playing
+		if source == "" {
+			source = "@DEFAULT_MONITOR@"
+		}
+		args = []string{"-f", "pulse"}
+		if latency > 0 {
+			// 44.1kHz, 16-bit stereo
+			args = append(args, "-fragment_size", strconv.Itoa(latency*44100*4/1000))
+		}
+		args = append(args, "-i", source)
+	}
+	if latency > 0 {
+		args = append(args, "-flush_packets", "1")
+	}
+	args = append(args, "-ac", "2", "-ar", "44100")
+	if bitrate != "" {
+		args = append(args, "-b:a", bitrate)
+	}
+	args = append(args, codec.args...)
+	return append(args, "pipe:1")
+}
+
+// StartAudioHandler captures what the host is playing and streams it to a
+// renderer, typically a DLNA speaker.
+func (h *Handler) StartAudioHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		USN     string `json:"usn"`     // Optional
+		Source  string `json:"source"`  // Optional ffmpeg input, e.g. a PulseAudio monitor
+		Codec   string `json:"codec"`   // Optional: mp3 (default), aac, flac
+		Bitrate string `json:"bitrate"` // Optional, default "192k" (ignored for flac)
+		Latency int    `json:"latency"` // Optional capture buffer in ms, e.g. 50
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	v.text("source", req.Source, maxNameLength)
+	v.text("bitrate", req.Bitrate, maxNameLength)
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if req.Codec == "" {
+		req.Codec = "mp3"
+	}
+	codec, ok := audioCodecs[req.Codec]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported codec %q", req.Codec), http.StatusBadRequest)
+		return
+	}
+	if req.Latency < 0 {
+		http.Error(w, fmt.Sprintf("Invalid latency %d", req.Latency), http.StatusBadRequest)
+		return
+	}
+	if req.Bitrate == "" && req.Codec != "flac" {
+		req.Bitrate = "192k"
+	}
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+		return
+	}
+
+	args := audioArgs(req.Source, req.Latency, codec, req.Bitrate)
+	meta := dlna.Metadata{Title: "PC Audio", Class: didl.ClassAudioBroadcast, MimeType: codec.mimeType}
+	h.castLive(w, r, device, audioStream, codec.ext, meta, args)
+}
+
+func (h *Handler) StopAudioHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.checkLive(w, r, audioStream) {
+		return
+	}
+	if !h.stopLive(audioStream) {
+		http.Error(w, "Audio cast is not running", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "Audio cast stopped")
+}
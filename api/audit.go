@@ -0,0 +1,224 @@
+package api
+
+import (
+	"context"
+	"dlna/dlna"
+	"dlna/store"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditKey   = "audit"
+	auditLimit = 1000
+
+	// auditResultLength bounds the error text kept per entry.
+	auditResultLength = 200
+)
+
+// AuditEntry records one device control request.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`           // IP address
+	Token      string    `json:"token,omitempty"`  // Name of the API token
+	Action     string    `json:"action"`           // e.g. "POST /api/cast"
+	Device     string    `json:"device,omitempty"` // USN
+	DeviceName string    `json:"device_name,omitempty"`
+	Status     int       `json:"status"`        // HTTP status of the response
+	Result     string    `json:"result"`        // "ok", the error, or the state of the job
+	Job        string    `json:"job,omitempty"` // Job ID of asynchronous casts
+}
+
+// audit keeps the most recent control requests, newest first.
+type audit struct {
+	mu      sync.Mutex
+	store   store.Store
+	jobs    *jobStore
+	entries []AuditEntry
+}
+
+type auditContextKey struct{}
+
+func newAudit(st store.Store, jobs *jobStore) *audit {
+	a := &audit{store: st, jobs: jobs}
+	if _, err := st.Get(auditKey, &a.entries); err != nil {
+		log.Printf("Failed to load audit log: %v", err)
+	}
+	return a
+}
+
+func (a *audit) add(e AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// The job may have finished before the request was recorded
+	if e.Job != "" {
+		if job := a.jobs.get(e.Job); job != nil {
+			e.Result = jobResult(job.State, job.Error)
+		}
+	}
+	a.entries = append([]AuditEntry{e}, a.entries...)
+	if len(a.entries) > auditLimit {
+		a.entries = a.entries[:auditLimit]
+	}
+	a.saveLocked()
+}
+
+// finishJob records the outcome of the job a request started.
+func (a *audit) finishJob(id string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.entries {
+		if a.entries[i].Job != id {
+			continue
+		}
+		if err != nil {
+			a.entries[i].Result = jobResult(JobFailed, err.Error())
+		} else {
+			a.entries[i].Result = jobResult(JobDone, "")
+		}
+		a.saveLocked()
+		return
+	}
+}
+
+func jobResult(state, errText string) string {
+	if errText == "" {
+		return state
+	}
+	return truncate(state+": "+errText, auditResultLength)
+}
+
+func (a *audit) saveLocked() {
+	if err := a.store.Set(auditKey, a.entries); err != nil {
+		log.Printf("Failed to save audit log: %v", err)
+	}
+}
+
+// auditWriter captures the status and error text of a response.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && len(w.body) < auditResultLength {
+		w.body = append(w.body, b...)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Audit records device control requests (see controlsDevice) with their
+// client, token, target device and result. It must run inside
+// Authenticate to see the token.
+func (h *Handler) Audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || !controlsDevice(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		e := &AuditEntry{Time: time.Now(), Client: clientIP(r), Action: r.Method + " " + r.URL.Path}
+		if t := requestTokenOf(r); t != nil {
+			e.Token = t.name
+		}
+		aw := &auditWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, e)))
+
+		e.Status = aw.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		switch {
+		case e.Status >= 400:
+			e.Result = truncate(strings.TrimSpace(string(aw.body)), auditResultLength)
+		case strings.HasPrefix(aw.Header().Get("Location"), basePath(r)+"/api/jobs/"):
+			e.Job = strings.TrimPrefix(aw.Header().Get("Location"), basePath(r)+"/api/jobs/")
+		default:
+			e.Result = "ok"
+		}
+		h.audit.add(*e)
+	})
+}
+
+// auditDevice notes the target device of an audited request.
+func auditDevice(r *http.Request, device *dlna.Device) {
+	if e, ok := r.Context().Value(auditContextKey{}).(*AuditEntry); ok {
+		e.Device, e.DeviceName = device.USN, device.FriendlyName
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
+
+// AuditHandler lists recorded control requests, newest first. Optional
+// query parameters filter by device (USN or friendly name), client, token
+// and since (RFC 3339); limit defaults to 100.
+func (h *Handler) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var v validator
+	v.text("device", q.Get("device"), maxUSNLength)
+	v.text("client", q.Get("client"), maxNameLength)
+	v.text("token", q.Get("token"), maxNameLength)
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			v.fail("since", "must be an RFC 3339 time")
+		}
+		since = t
+	}
+	limit := 100
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			v.fail("limit", "must be a positive number")
+		}
+		limit = n
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	h.audit.mu.Lock()
+	list := make([]AuditEntry, 0, min(limit, len(h.audit.entries)))
+	for _, e := range h.audit.entries {
+		if len(list) == limit || e.Time.Before(since) {
+			break
+		}
+		if d := q.Get("device"); d != "" && d != e.Device && !dlna.NameEqual(d, e.DeviceName) {
+			continue
+		}
+		if c := q.Get("client"); c != "" && c != e.Client {
+			continue
+		}
+		if t := q.Get("token"); t != "" && t != e.Token {
+			continue
+		}
+		list = append(list, e)
+	}
+	h.audit.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"dlna/config"
+	"dlna/dlna"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Token scopes. A request needs read for GET, control for device control
+// (see controlsDevice) and admin for everything else, e.g. schedules,
+// presets, settings, the config, API keys and the audit log.
+const (
+	scopeRead    = "read"
+	scopeControl = "control"
+	scopeAdmin   = "admin"
+)
+
+var allScopes = []string{scopeRead, scopeControl, scopeAdmin}
+
+// Token is an API token, optionally limited to some scopes and devices.
+type Token struct {
+	name    string
+	secret  string
+	scopes  map[string]bool
+	devices []string     // USNs or friendly names; empty is all
+	limiter *rateLimiter // Requests of an API key; nil is unlimited
+}
+
+type tokenContextKey struct{}
+
+// ParseTokens validates the tokens of the config file.
+func ParseTokens(cfg []config.Token) ([]*Token, error) {
+	out := make([]*Token, 0, len(cfg))
+	seen := make(map[string]bool)
+	for i, c := range cfg {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("token %d", i)
+		}
+		if len(c.Token) < 16 {
+			return nil, fmt.Errorf("%s: token must be at least 16 characters", name)
+		}
+		if seen[c.Token] {
+			return nil, fmt.Errorf("%s: duplicate token", name)
+		}
+		seen[c.Token] = true
+
+		scopes, err := parseScopes(c.Scopes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		out = append(out, &Token{name: name, secret: c.Token, scopes: scopes, devices: c.Devices})
+	}
+	return out, nil
+}
+
+// parseScopes validates scopes, all of them if empty.
+func parseScopes(scopes []string) (map[string]bool, error) {
+	if len(scopes) == 0 {
+		scopes = allScopes
+	}
+	m := make(map[string]bool, len(scopes))
+	for _, s := range scopes {
+		switch s {
+		case scopeRead, scopeControl, scopeAdmin:
+			m[s] = true
+		default:
+			return nil, fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	return m, nil
+}
+
+// SetTokens replaces the API tokens. Without tokens the API is open.
+func (h *Handler) SetTokens(tokens []*Token) {
+	h.mu.Lock()
+	h.tokens = tokens
+	h.mu.Unlock()
+}
+
+// Authenticate wraps the API with token checks once tokens are configured
+// or API keys created. The token is read from "Authorization: Bearer" or,
+// for WebSockets and userscripts, ?token=. Streams and media stay open for
+// renderers.
+func (h *Handler) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.RLock()
+		tokens := h.tokens
+		h.mu.RUnlock()
+		if (len(tokens) == 0 && h.keys.empty()) || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		secret := requestToken(r)
+		t := findToken(tokens, secret)
+		if t == nil {
+			t = h.keys.find(secret)
+		}
+		if t == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dlnagent"`)
+			http.Error(w, "Missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		if scope := requiredScope(r); !t.scopes[scope] {
+			http.Error(w, fmt.Sprintf("Token %s lacks the %s scope", t.name, scope), http.StatusForbidden)
+			return
+		}
+		if t.limiter != nil {
+			if ok, wait := t.limiter.allow(t.name); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, fmt.Sprintf("Too many requests for key %s", t.name), http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, t)))
+	})
+}
+
+func requestToken(r *http.Request) string {
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(auth)
+	}
+	return r.URL.Query().Get("token")
+}
+
+func findToken(tokens []*Token, secret string) *Token {
+	if secret == "" {
+		return nil
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t.secret), []byte(secret)) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+// requiredScope checks controlsDevice before the method, so that a GET to
+// a casting route needs the control scope too.
+func requiredScope(r *http.Request) string {
+	switch {
+	case r.URL.Path == "/api/audit", strings.HasPrefix(r.URL.Path, "/api/debug/"), strings.HasPrefix(r.URL.Path, "/api/keys"):
+		return scopeAdmin
+	case controlsDevice(r):
+		return scopeControl
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return scopeRead
+	default:
+		return scopeAdmin
+	}
+}
+
+// requestTokenOf returns the token the request was authenticated with, or
+// nil when the API is open.
+func requestTokenOf(r *http.Request) *Token {
+	t, _ := r.Context().Value(tokenContextKey{}).(*Token)
+	return t
+}
+
+// allows reports whether the token may use device. A nil token allows
+// everything.
+func (t *Token) allows(device *dlna.Device) bool {
+	if t == nil || len(t.devices) == 0 {
+		return true
+	}
+	for _, d := range t.devices {
+		if d == device.USN || dlna.NameEqual(d, device.FriendlyName) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDevice rejects the request with 403 if its token may not use
+// device. It is called for every device a control request targets, so it
+// also notes the device for the audit log.
+func checkDevice(w http.ResponseWriter, r *http.Request, device *dlna.Device) bool {
+	auditDevice(r, device)
+	if t := requestTokenOf(r); !t.allows(device) {
+		http.Error(w, fmt.Sprintf("Token %s may not use %s", t.name, device.FriendlyName), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// checkDeviceUSN is checkDevice for a device given by USN. Unknown devices
+// pass; the handler reports them.
+func (h *Handler) checkDeviceUSN(w http.ResponseWriter, r *http.Request, usn string) bool {
+	device := h.discovery.GetDevice(usn)
+	return device == nil || checkDevice(w, r, device)
+}
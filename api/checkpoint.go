@@ -0,0 +1,302 @@
+package api
+
+import (
+	"dlna/didl"
+	"dlna/dlna"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often a playing cast is polled and its progress
+// pushed to WebSocket subscribers. Tests shorten it.
+var progressInterval = 5 * time.Second
+
+const (
+	// checkpointInterval is how often the position is saved to the history.
+	checkpointInterval = 15 * time.Second
+
+	// A renderer that fails this many polls in a row (two minutes) is
+	// assumed gone; the last stored position is kept for resume.
+	checkpointMaxFailures = 24
+)
+
+// Reasons of a CastFinished event.
+const (
+	finishStopped     = "stopped"     // The renderer stopped or has no media
+	finishReplaced    = "replaced"    // Another cast or URI took over
+	finishUnreachable = "unreachable" // The renderer stopped answering
+)
+
+// CastFinished is the payload of cast-finished events.
+type CastFinished struct {
+	Device     string `json:"device"` // USN
+	DeviceName string `json:"device_name"`
+	URL        string `json:"url"`
+	Title      string `json:"title,omitempty"`
+	Position   string `json:"position,omitempty"` // Last known RelTime
+	Reason     string `json:"reason"`
+}
+
+// Progress is the playback state of a cast, pushed as "progress" events
+// and served by /api/status.
+type Progress struct {
+	Device     string     `json:"device"` // USN
+	DeviceName string     `json:"device_name"`
+	URL        string     `json:"url"`
+	Title      string     `json:"title,omitempty"`
+	State      string     `json:"state"`               // AVTransport state, e.g. PLAYING
+	Position   string     `json:"position,omitempty"`  // H:MM:SS
+	Duration   string     `json:"duration,omitempty"`  // H:MM:SS, if known
+	Percent    float64    `json:"percent,omitempty"`   // 0-100
+	Remaining  string     `json:"remaining,omitempty"` // H:MM:SS
+	ETA        *time.Time `json:"eta,omitempty"`       // When playback ends, while playing
+	UpdatedAt  time.Time  `json:"updated_at"`
+
+	// known is the duration in the cast's metadata, used when the
+	// renderer reports none.
+	known time.Duration
+}
+
+// update fills in the position fields from a poll.
+func (p *Progress) update(info *dlna.PositionInfo, state string, now time.Time) {
+	p.State = state
+	p.UpdatedAt = now
+	p.Position, p.Duration, p.Percent, p.Remaining, p.ETA = "", "", 0, "", nil
+
+	pos, err := didl.ParseDuration(info.RelTime)
+	if err != nil {
+		return
+	}
+	p.Position = didl.FormatDuration(pos)
+	dur, err := didl.ParseDuration(info.TrackDuration)
+	if err != nil || dur <= 0 {
+		dur = p.known
+	}
+	if dur <= 0 {
+		return
+	}
+	p.Duration = didl.FormatDuration(dur)
+	p.Percent = math.Round(math.Min(100, float64(pos)/float64(dur)*100)*10) / 10
+	if left := dur - pos; left > 0 {
+		p.Remaining = didl.FormatDuration(left)
+		if state == "PLAYING" {
+			eta := now.Add(left).Truncate(time.Second)
+			p.ETA = &eta
+		}
+	}
+}
+
+// checkpoints tracks one position-recording goroutine per device.
+type checkpoints struct {
+	mu          sync.Mutex
+	stops       map[string]chan struct{} // USN -> stop channel
+	progress    map[string]Progress      // USN -> latest progress
+	interrupted map[string]bool          // USNs playing a clip over their cast, see playOver
+}
+
+func newCheckpoints() *checkpoints {
+	return &checkpoints{stops: make(map[string]chan struct{}), progress: make(map[string]Progress), interrupted: make(map[string]bool)}
+}
+
+// setInterrupted pauses or resumes polling the cast on a device, so a clip
+// played over it does not end its session.
+func (c *checkpoints) setInterrupted(usn string, interrupted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if interrupted {
+		c.interrupted[usn] = true
+	} else {
+		delete(c.interrupted, usn)
+	}
+}
+
+// startCheckpoints polls the playback of url on device, publishing its
+// progress and periodically recording the position into the history. It
+// replaces any previous loop for the device, and ends the session and
+// sends a cast-finished event when the renderer stops, moves on to another
+// URI or stops responding. The duration in the cast's metadata stands in
+// for the renderer's if it reports none. On devices with the reconcile
+// setting, a cast the renderer drops is played again, see dropped, and
+// casts that stall are reported and, with restart_stalled, restarted.
+func (h *Handler) startCheckpoints(device *dlna.Device, url, title, metadata string, sessionID string) {
+	stop := make(chan struct{})
+
+	h.checkpoints.mu.Lock()
+	if prev, ok := h.checkpoints.stops[device.USN]; ok {
+		close(prev)
+	}
+	h.checkpoints.stops[device.USN] = stop
+	h.checkpoints.mu.Unlock()
+
+	ticker := time.NewTicker(progressInterval)
+	go func() {
+		defer func() {
+			h.checkpoints.mu.Lock()
+			if h.checkpoints.stops[device.USN] == stop {
+				delete(h.checkpoints.stops, device.USN)
+				delete(h.checkpoints.progress, device.USN)
+			}
+			h.checkpoints.mu.Unlock()
+		}()
+
+		defer ticker.Stop()
+
+		finished := CastFinished{Device: device.USN, DeviceName: device.FriendlyName, URL: url, Title: title}
+		defer func() {
+			h.endSession(device.USN, sessionID)
+			h.notify(EventCastFinished, finished)
+		}()
+
+		progress := Progress{Device: device.USN, DeviceName: device.FriendlyName, URL: url, Title: title, known: metadataDuration(metadata)}
+		avt := h.avTransport(device)
+		failures, stopped, retries, restarts := 0, 0, 0, 0
+		var saved, retried time.Time
+		var lastErr error // Of the last recovery
+		var stall stallDetector
+		for {
+			select {
+			case <-stop:
+				finished.Reason = finishReplaced
+				return
+			case <-ticker.C:
+			}
+			h.checkpoints.mu.Lock()
+			interrupted := h.checkpoints.interrupted[device.USN]
+			h.checkpoints.mu.Unlock()
+			if interrupted {
+				failures, stopped = 0, 0
+				stall.reset()
+				continue
+			}
+
+			info, err := avt.GetPositionInfo()
+			if err != nil {
+				failures++
+				if failures >= checkpointMaxFailures {
+					finished.Reason = finishUnreachable
+					return
+				}
+				continue
+			}
+			failures = 0
+
+			if info.TrackURI != "" && info.TrackURI != url {
+				finished.Reason = finishReplaced
+				return
+			}
+			now := time.Now()
+			if validPosition(info.RelTime) {
+				finished.Position = info.RelTime
+				if now.Sub(saved) >= checkpointInterval {
+					h.history.updatePosition(device.USN, url, info.RelTime)
+					saved = now
+				}
+			}
+
+			var state string
+			if ti, err := avt.GetTransportInfo(); err == nil {
+				state = ti.CurrentTransportState
+			}
+			progress.update(info, state, now)
+			h.checkpoints.mu.Lock()
+			if h.checkpoints.stops[device.USN] == stop {
+				h.checkpoints.progress[device.USN] = progress
+			}
+			h.checkpoints.mu.Unlock()
+			h.events.publish("progress", progress)
+
+			if stall.update(state, info.RelTime, now) {
+				stalled := CastStalled{Device: device.USN, DeviceName: device.FriendlyName, URL: url, Title: title, Position: info.RelTime}
+				restart := h.settings.get(device.USN).RestartStalled && restarts < stallMaxRestarts
+				if restart {
+					restarts++
+					stalled.Restart = restarts
+				}
+				log.Printf("%s stalled at %s playing %s", device.FriendlyName, info.RelTime, url)
+				h.notify(EventCastStalled, stalled)
+				if restart {
+					if err := h.restartStalled(device, avt, url, metadata, info.RelTime); err != nil {
+						log.Printf("Failed to restart %s: %v", device.FriendlyName, err)
+					}
+					stall.reset()
+					continue
+				}
+			}
+
+			// Some renderers pass through STOPPED between tracks, so it has
+			// to be seen twice in a row. Dropped casts are played again, a
+			// few times in a row at most.
+			switch state {
+			case "STOPPED", "NO_MEDIA_PRESENT":
+				if stopped++; stopped < 2 {
+					break
+				}
+				if h.dropped(device, sessionID, progress) {
+					if retries < reconcileMaxRetries {
+						stopped, retried = 0, now
+						retries++
+						log.Printf("%s dropped %s, playing it again (%d/%d)", device.FriendlyName, url, retries, reconcileMaxRetries)
+						h.events.publish("reconcile", map[string]any{"device": device.USN, "session": sessionID, "url": url, "retry": retries})
+						if lastErr = h.recoverCast(device, avt, url, metadata, finished.Position); lastErr != nil {
+							log.Printf("Failed to recover %s: %v", device.FriendlyName, lastErr)
+						}
+						stall.reset()
+						continue
+					}
+					failed := SessionFailed{Session: sessionID, Device: device.USN, DeviceName: device.FriendlyName, URL: url, Title: title, Position: finished.Position, Retries: retries}
+					if lastErr != nil {
+						failed.Error = lastErr.Error()
+					}
+					h.notify(EventSessionFailed, failed)
+					finished.Reason = finishDropped
+					return
+				}
+				if finished.Position != "" {
+					h.history.updatePosition(device.USN, url, finished.Position)
+				}
+				finished.Reason = finishStopped
+				h.startIdleOff(device)
+				return
+			case "PLAYING":
+				stopped = 0
+				if retries > 0 && now.Sub(retried) >= reconcileStable {
+					retries, lastErr = 0, nil
+				}
+			default:
+				stopped = 0
+			}
+		}
+	}()
+}
+
+// StatusHandler returns the progress of every cast being played, or with
+// ?usn= of that device's only.
+func (h *Handler) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	usn := r.URL.Query().Get("usn")
+
+	h.checkpoints.mu.Lock()
+	list := make([]Progress, 0, len(h.checkpoints.progress))
+	for _, p := range h.checkpoints.progress {
+		list = append(list, p)
+	}
+	h.checkpoints.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if usn != "" {
+		for _, p := range list {
+			if p.Device == usn {
+				json.NewEncoder(w).Encode(p)
+				return
+			}
+		}
+		http.Error(w, "Nothing playing on device", http.StatusNotFound)
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeviceName < list[j].DeviceName })
+	json.NewEncoder(w).Encode(list)
+}
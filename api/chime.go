@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"dlna/tts"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chimeFiles are the built-in sounds, 16 kHz mono WAV.
+//
+//go:embed chimes/*.wav
+var chimeFiles embed.FS
+
+// defaultChime is played without ?sound=.
+const defaultChime = "doorbell"
+
+// Chime is a built-in sound.
+type Chime struct {
+	Name     string `json:"name"`
+	Duration string `json:"duration"` // e.g. "1.9s"
+}
+
+// chimes lists the built-in sounds by name.
+func chimes() []Chime {
+	names, _ := fs.Glob(chimeFiles, "chimes/*.wav")
+	list := make([]Chime, 0, len(names))
+	for _, name := range names {
+		b, _ := chimeFiles.ReadFile(name)
+		list = append(list, Chime{
+			Name:     strings.TrimSuffix(path.Base(name), ".wav"),
+			Duration: tts.WAVDuration(b).Round(100 * time.Millisecond).String(),
+		})
+	}
+	return list
+}
+
+// ListChimesHandler lists the built-in sounds.
+func (h *Handler) ListChimesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chimes())
+}
+
+// ChimeFileHandler serves a built-in sound to renderers.
+func (h *Handler) ChimeFileHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, err := fs.Stat(chimeFiles, "chimes/"+name); err != nil || path.Ext(name) != ".wav" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("transferMode.dlna.org", "Streaming")
+	http.ServeFileFS(w, r, chimeFiles, "chimes/"+name)
+}
+
+// ChimeHandler plays a built-in sound on a device (?device=, USN or
+// friendly name), ?sound= one of ListChimesHandler's, and optionally at
+// ?volume=. What the device plays is resumed afterwards.
+func (h *Handler) ChimeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sound := q.Get("sound")
+	if sound == "" {
+		sound = defaultChime
+	}
+	var v validator
+	audio, err := chimeFiles.ReadFile("chimes/" + sound + ".wav")
+	if err != nil || strings.ContainsAny(sound, "/.") {
+		v.fail("sound", "unknown sound %q", sound)
+	}
+	var volume int
+	if s := q.Get("volume"); s != "" {
+		if volume, err = strconv.Atoi(s); err != nil || volume < 0 || volume > 100 {
+			v.fail("volume", "must be 0-100")
+		}
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	device := h.selectDevice(w, r, h.deviceByName(q.Get("device")))
+	if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+		return
+	}
+	if h.interrupts.pending(device.USN) >= interruptMaxPending {
+		http.Error(w, fmt.Sprintf("%s: %v", device.FriendlyName, errInterruptBusy), http.StatusConflict)
+		return
+	}
+	file := "/chimes/" + sound + ".wav"
+	job := h.jobs.create(device.USN, file, sound)
+	h.runJob(job, func(ctx context.Context) error {
+		base, err := h.agentURL(device)
+		if err != nil {
+			return err
+		}
+		meta := dlna.Metadata{Title: sound, Class: didl.ClassAudioItem, MimeType: "audio/wav"}
+		return h.playOver(ctx, device, base+file, meta, tts.WAVDuration(audio), volume)
+	})
+	writeJob(w, r, job)
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"dlna/config"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// runtimeConfig is the part of the configuration that can be read and
+// changed at runtime via /api/config.
+type runtimeConfig struct {
+	Discovery config.Discovery `json:"discovery"`
+}
+
+// SetReloader sets the function POST /api/reload calls to re-read the
+// config file.
+func (h *Handler) SetReloader(reload func() error) {
+	h.mu.Lock()
+	h.reload = reload
+	h.mu.Unlock()
+}
+
+func (h *Handler) runtimeConfig() runtimeConfig {
+	return runtimeConfig{Discovery: config.DiscoveryOf(h.discovery.Tuning())}
+}
+
+func (h *Handler) GetConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.runtimeConfig())
+}
+
+// PatchConfigHandler merges the request body into the current runtime
+// configuration; fields that are left out keep their value.
+func (h *Handler) PatchConfigHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := h.runtimeConfig()
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tuning, err := cfg.Discovery.Tuning()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.discovery.SetTuning(tuning)
+	log.Printf("Discovery tuning updated: %+v", cfg.Discovery)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.runtimeConfig())
+}
+
+// ReloadHandler re-reads the config file, like SIGHUP. Active casts and
+// streams are not interrupted.
+func (h *Handler) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	reload := h.reload
+	h.mu.RUnlock()
+	if reload == nil {
+		http.Error(w, "Reload not available", http.StatusNotImplemented)
+		return
+	}
+	if err := reload(); err != nil {
+		http.Error(w, fmt.Sprintf("Reload failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.runtimeConfig())
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"dlna/dlna"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// soapTraceState is the body of GET /api/debug/soap.
+type soapTraceState struct {
+	Enabled   bool                `json:"enabled"`
+	Hosts     []string            `json:"hosts"`
+	Exchanges []dlna.SOAPExchange `json:"exchanges,omitempty"`
+}
+
+// currentSOAPTrace returns what is traced, without the exchanges.
+func currentSOAPTrace() soapTraceState {
+	var st soapTraceState
+	st.Enabled, st.Hosts = dlna.SOAPTraceState()
+	if st.Hosts == nil {
+		st.Hosts = []string{}
+	}
+	sort.Strings(st.Hosts)
+	return st
+}
+
+// controlHost is the host:port of device's control URLs, as traced.
+func controlHost(device *dlna.Device) string {
+	u, err := url.Parse(device.AVTransportURL())
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// GetSOAPTraceHandler returns the traced SOAP exchanges, oldest first, with
+// the full request and response of each. ?usn= keeps those of one device.
+func (h *Handler) GetSOAPTraceHandler(w http.ResponseWriter, r *http.Request) {
+	st := currentSOAPTrace()
+	st.Exchanges = dlna.SOAPTraces()
+	if usn := r.URL.Query().Get("usn"); usn != "" {
+		device := h.selectDevice(w, r, usn)
+		if device == nil {
+			return
+		}
+		host := controlHost(device)
+		kept := st.Exchanges[:0]
+		for _, x := range st.Exchanges {
+			if u, err := url.Parse(x.URL); err == nil && u.Host == host {
+				kept = append(kept, x)
+			}
+		}
+		st.Exchanges = kept
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// SetSOAPTraceHandler turns SOAP tracing on or off, for every device or
+// with "usn" for one.
+func (h *Handler) SetSOAPTraceHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled bool   `json:"enabled"`
+		USN     string `json:"usn"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.USN == "" {
+		dlna.SetSOAPTrace(req.Enabled)
+		log.Printf("SOAP tracing %s", onOff(req.Enabled))
+	} else {
+		device := h.selectDevice(w, r, req.USN)
+		if device == nil {
+			return
+		}
+		host := controlHost(device)
+		if host == "" {
+			http.Error(w, "Device has no control URL", http.StatusBadRequest)
+			return
+		}
+		dlna.TraceSOAPHost(host, req.Enabled)
+		log.Printf("SOAP tracing %s for %s", onOff(req.Enabled), device.FriendlyName)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentSOAPTrace())
+}
+
+// ClearSOAPTraceHandler drops the traced exchanges.
+func (h *Handler) ClearSOAPTraceHandler(w http.ResponseWriter, r *http.Request) {
+	dlna.ClearSOAPTraces()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
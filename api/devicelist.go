@@ -0,0 +1,204 @@
+package api
+
+import (
+	"dlna/dlna"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Capabilities accepted by ?capability= besides AVTransport action names.
+const capabilityVolume = "volume"
+
+// deviceQuery is the filtering, sorting and paging of GET /api/devices.
+type deviceQuery struct {
+	name         string // Substring of friendly_name
+	model        string // Substring of manufacturer or model_name
+	capabilities []string
+	online       *bool
+	sort         string // "name" or "last_seen", "-" prefix for descending
+	offset       int
+	limit        int      // 0 is no limit
+	fields       []string // JSON fields to return; nil is all
+
+	tvs map[string]bool // USNs with a vendor adapter
+}
+
+// deviceFields are the JSON field names of dlna.Device, for ?fields=.
+var deviceFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	for _, t := range []reflect.Type{reflect.TypeOf(dlna.Device{}), reflect.TypeOf(dlna.LegacyURLs{})} {
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+func parseDeviceQuery(q url.Values) (deviceQuery, error) {
+	dq := deviceQuery{
+		name:  dlna.FoldName(q.Get("name")),
+		model: dlna.FoldName(q.Get("model")),
+		sort:  q.Get("sort"),
+	}
+	var v validator
+	v.text("name", dq.name, maxNameLength)
+	v.text("model", dq.model, maxNameLength)
+	if c := q.Get("capability"); c != "" {
+		dq.capabilities = strings.Split(c, ",")
+	}
+	if o := q.Get("online"); o != "" {
+		online, err := strconv.ParseBool(o)
+		if err != nil {
+			v.fail("online", "must be true or false")
+		}
+		dq.online = &online
+	}
+	switch strings.TrimPrefix(dq.sort, "-") {
+	case "", "name", "last_seen":
+	default:
+		v.fail("sort", "must be name or last_seen, optionally prefixed with -")
+	}
+	for _, p := range []struct {
+		field string
+		dst   *int
+	}{{"offset", &dq.offset}, {"limit", &dq.limit}} {
+		if s := q.Get(p.field); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				v.fail(p.field, "must be a non-negative integer")
+			}
+			*p.dst = n
+		}
+	}
+	if f := q.Get("fields"); f != "" {
+		for _, field := range strings.Split(f, ",") {
+			if !deviceFields[field] {
+				v.fail("fields", "unknown field %q", field)
+			}
+			dq.fields = append(dq.fields, field)
+		}
+	}
+	return dq, v.err()
+}
+
+func (dq deviceQuery) matches(d *dlna.Device) bool {
+	if dq.name != "" && !strings.Contains(dlna.FoldName(d.FriendlyName), dq.name) {
+		return false
+	}
+	if dq.model != "" && !strings.Contains(dlna.FoldName(d.Manufacturer+" "+d.ModelName), dq.model) {
+		return false
+	}
+	if dq.online != nil && d.Online != *dq.online {
+		return false
+	}
+	for _, c := range dq.capabilities {
+		switch strings.ToLower(c) {
+		case capabilityVolume:
+			if d.RenderingControlURL() == "" {
+				return false
+			}
+		case capabilityPower, capabilityInput:
+			if !dq.tvs[d.USN] {
+				return false
+			}
+		default:
+			if !d.Supports(c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// apply filters, sorts and pages devices, returning the page and the number
+// of matches before paging.
+func (dq deviceQuery) apply(devices []*dlna.Device) ([]*dlna.Device, int) {
+	matched := devices[:0:0]
+	for _, d := range devices {
+		if dq.matches(d) {
+			matched = append(matched, d)
+		}
+	}
+
+	desc := strings.HasPrefix(dq.sort, "-")
+	byLastSeen := strings.TrimPrefix(dq.sort, "-") == "last_seen"
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if desc {
+			a, b = b, a
+		}
+		if byLastSeen && !a.LastSeen.Equal(b.LastSeen) {
+			return a.LastSeen.Before(b.LastSeen)
+		}
+		if an, bn := dlna.FoldName(a.FriendlyName), dlna.FoldName(b.FriendlyName); an != bn {
+			return an < bn
+		}
+		return a.USN < b.USN
+	})
+
+	total := len(matched)
+	matched = matched[min(dq.offset, total):]
+	if dq.limit > 0 && dq.limit < len(matched) {
+		matched = matched[:dq.limit]
+	}
+	return matched, total
+}
+
+// project keeps only the requested fields of each device.
+func (dq deviceQuery) project(devices []*dlna.Device) any {
+	if dq.fields == nil {
+		return devices
+	}
+	out := make([]map[string]any, len(devices))
+	for i, d := range devices {
+		var full map[string]any
+		b, _ := json.Marshal(d)
+		json.Unmarshal(b, &full)
+		out[i] = make(map[string]any, len(dq.fields))
+		for _, f := range dq.fields {
+			if v, ok := full[f]; ok {
+				out[i][f] = v
+			}
+		}
+	}
+	return out
+}
+
+// ListDevicesHandler lists renderers, sorted by friendly name. Query
+// parameters filter (name, model, capability, online), sort (name,
+// last_seen, "-" for descending), page (offset, limit) and select fields;
+// X-Total-Count is the number of matches before paging. Tokens limited to
+// some devices only see those.
+func (h *Handler) ListDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	dq, err := parseDeviceQuery(r.URL.Query())
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	h.mu.RLock()
+	dq.tvs = make(map[string]bool, len(h.tvs))
+	for usn := range h.tvs {
+		dq.tvs[usn] = true
+	}
+	h.mu.RUnlock()
+	devices := h.discovery.GetDevices()
+	if t := requestTokenOf(r); t != nil {
+		allowed := devices[:0]
+		for _, d := range devices {
+			if t.allows(d) {
+				allowed = append(allowed, d)
+			}
+		}
+		devices = allowed
+	}
+	devices, total := dq.apply(devices)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	json.NewEncoder(w).Encode(dq.project(devices))
+}
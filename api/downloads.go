@@ -0,0 +1,470 @@
+package api
+
+import (
+	"context"
+	"dlna/dlna"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDownloads is how many downloads run at once; the rest queue.
+	maxDownloads = 2
+	// downloadEventInterval spaces the progress events of a download.
+	downloadEventInterval = time.Second
+	// downloadRetention is how long finished downloads stay listed.
+	downloadRetention = 24 * time.Hour
+)
+
+// Download states
+const (
+	DownloadQueued   = "queued"
+	DownloadRunning  = "running"
+	DownloadDone     = "done"
+	DownloadFailed   = "failed"
+	DownloadCanceled = "canceled"
+)
+
+// Download is a file being fetched into a media root, to be cast later or
+// once it is complete.
+type Download struct {
+	ID        string     `json:"id"`
+	URL       string     `json:"url"`
+	Root      string     `json:"root"`
+	Path      string     `json:"path,omitempty"` // In the root, once the name is known
+	State     string     `json:"state"`
+	Size      int64      `json:"size,omitempty"` // If the server said
+	Received  int64      `json:"received"`
+	Rate      float64    `json:"rate,omitempty"`    // Bytes per second
+	Percent   float64    `json:"percent,omitempty"` // 0-100, if the size is known
+	ETA       *time.Time `json:"eta,omitempty"`
+	Device    string     `json:"device,omitempty"` // USN to cast to when done
+	Job       string     `json:"job,omitempty"`    // ID of that cast job
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+
+	folder string
+	name   string
+	title  string
+	cancel context.CancelFunc
+}
+
+// downloads is the download queue.
+type downloads struct {
+	mu      sync.Mutex
+	m       map[string]*Download
+	running int
+}
+
+func newDownloads() *downloads {
+	return &downloads{m: make(map[string]*Download)}
+}
+
+// update changes d under the lock and returns a snapshot of it.
+func (s *downloads) update(d *Download, fn func(d *Download)) Download {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(d)
+	d.UpdatedAt = time.Now()
+	return *d
+}
+
+func (s *downloads) get(id string) (Download, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.m[id]
+	if !ok {
+		return Download{}, false
+	}
+	return *d, true
+}
+
+func (s *downloads) list() []Download {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Download, 0, len(s.m))
+	for _, d := range s.m {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// StartDownloadHandler queues a URL to be downloaded into a local media
+// root, and optionally cast when complete.
+func (h *Handler) StartDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL    string `json:"url"`
+		Root   string `json:"root"`   // Media root name
+		Folder string `json:"folder"` // Optional subfolder of the root
+		Name   string `json:"name"`   // Optional file name, default from the server
+		Title  string `json:"title"`  // Optional, for the cast
+		Cast   bool   `json:"cast"`   // Cast once complete
+		USN    string `json:"usn"`    // Optional, for the cast
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	if v.required("url", req.URL) {
+		v.url("url", req.URL)
+	}
+	if v.required("root", req.Root) {
+		v.text("root", req.Root, maxNameLength)
+	}
+	v.text("folder", req.Folder, maxTextLength)
+	if v.text("name", req.Name, maxNameLength) && (strings.ContainsAny(req.Name, `/\`) || req.Name == "." || req.Name == "..") {
+		v.fail("name", "must be a plain file name")
+	}
+	v.text("title", req.Title, maxTextLength)
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if h.mediaRootDir(req.Root) == "" {
+		http.Error(w, fmt.Sprintf("Unknown or remote media root %q; downloads go to local folders", req.Root), http.StatusBadRequest)
+		return
+	}
+
+	d := &Download{
+		ID:     newID(),
+		URL:    req.URL,
+		Root:   req.Root,
+		State:  DownloadQueued,
+		folder: path.Clean("/" + req.Folder)[1:],
+		name:   req.Name,
+		title:  req.Title,
+	}
+	if req.Cast {
+		device := h.selectDevice(w, r, req.USN)
+		if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+			return
+		}
+		d.Device = device.USN
+	}
+	d.CreatedAt = time.Now()
+	d.UpdatedAt = d.CreatedAt
+
+	s := h.downloads
+	s.mu.Lock()
+	for id, old := range s.m {
+		if time.Since(old.UpdatedAt) > downloadRetention && old.cancel == nil && old.State != DownloadQueued {
+			delete(s.m, id)
+		}
+	}
+	s.m[d.ID] = d
+	snapshot := *d
+	s.mu.Unlock()
+	h.events.publish("download", snapshot)
+	h.startDownloads()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", basePath(r)+"/api/downloads/"+d.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// mediaRootDir is the local folder of a media root, or "" for shares and
+// unknown roots.
+func (h *Handler) mediaRootDir(name string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.mediaRoots[name].Dir
+}
+
+// startDownloads starts queued downloads, oldest first, while fewer than
+// maxDownloads run.
+func (h *Handler) startDownloads() {
+	s := h.downloads
+	var started []Download
+	defer func() {
+		for _, d := range started {
+			h.events.publish("download", d)
+		}
+	}()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.running < maxDownloads {
+		var next *Download
+		for _, d := range s.m {
+			if d.State == DownloadQueued && (next == nil || d.CreatedAt.Before(next.CreatedAt)) {
+				next = d
+			}
+		}
+		if next == nil {
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		next.State, next.cancel, next.UpdatedAt = DownloadRunning, cancel, time.Now()
+		started = append(started, *next)
+		s.running++
+		go h.runDownload(ctx, next)
+	}
+}
+
+// runDownload fetches d into its media root, then casts it if asked to.
+func (h *Handler) runDownload(ctx context.Context, d *Download) {
+	s := h.downloads
+	err := h.fetch(ctx, d)
+	snapshot := s.update(d, func(d *Download) {
+		d.cancel = nil
+		d.Rate, d.ETA = 0, nil
+		switch {
+		case ctx.Err() != nil:
+			d.State = DownloadCanceled
+		case err != nil:
+			d.State, d.Error = DownloadFailed, err.Error()
+		default:
+			d.State = DownloadDone
+		}
+	})
+	s.mu.Lock()
+	s.running--
+	s.mu.Unlock()
+	h.startDownloads()
+	h.events.publish("download", snapshot)
+
+	switch snapshot.State {
+	case DownloadFailed:
+		log.Printf("Download %s of %s failed: %v", d.ID, d.URL, err)
+		return
+	case DownloadCanceled:
+		return
+	}
+	log.Printf("Downloaded %s to %s/%s", d.URL, d.Root, snapshot.Path)
+	h.mu.RLock()
+	root, ok := h.mediaRoots[d.Root]
+	h.mu.RUnlock()
+	if ok {
+		h.library.RefreshDir(context.Background(), d.Root, root, d.folder, false)
+	}
+	if snapshot.Device != "" {
+		h.castDownload(d, snapshot)
+	}
+}
+
+// fetch downloads d.URL, after the resolvers, into a .part file renamed
+// once complete, publishing progress events as it goes.
+func (h *Handler) fetch(ctx context.Context, d *Download) error {
+	src, err := h.resolveURL(d.URL)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+
+	dir := filepath.Join(h.mediaRootDir(d.Root), filepath.FromSlash(d.folder))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	name := downloadName(d.name, resp)
+	dest := uniqueFile(dir, name)
+	part := dest + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(part) // Left only on failure
+	rel := path.Join(d.folder, filepath.Base(dest))
+	h.events.publish("download", h.downloads.update(d, func(d *Download) {
+		d.Path = rel
+		d.Size = max(resp.ContentLength, 0)
+	}))
+
+	started, last := time.Now(), time.Now()
+	buf := make([]byte, 64<<10)
+	var received int64
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				f.Close()
+				return err
+			}
+			received += int64(n)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			f.Close()
+			return rerr
+		}
+		if now := time.Now(); now.Sub(last) >= downloadEventInterval {
+			last = now
+			h.events.publish("download", h.downloads.update(d, func(d *Download) {
+				d.progress(received, now.Sub(started), now)
+			}))
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if resp.ContentLength > 0 && received != resp.ContentLength {
+		return fmt.Errorf("got %d of %d bytes", received, resp.ContentLength)
+	}
+	h.downloads.update(d, func(d *Download) {
+		d.Received, d.Percent = received, 100
+	})
+	return os.Rename(part, dest)
+}
+
+// progress sets the received bytes after elapsed, and the rate and ETA
+// derived from them.
+func (d *Download) progress(received int64, elapsed time.Duration, now time.Time) {
+	d.Received = received
+	d.Rate = float64(received) / elapsed.Seconds()
+	if d.Size <= 0 || d.Rate <= 0 {
+		return
+	}
+	d.Percent = float64(received*1000/d.Size) / 10
+	eta := now.Add(time.Duration(float64(d.Size-received) / d.Rate * float64(time.Second))).Truncate(time.Second)
+	d.ETA = &eta
+}
+
+// downloadName picks the file name of a download: the one asked for, else
+// the server's Content-Disposition filename, else the last element of the
+// URL path, with an extension from the Content-Type if it has none.
+func downloadName(name string, resp *http.Response) string {
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+			name = params["filename"]
+		}
+	}
+	if name == "" {
+		name = path.Base(resp.Request.URL.Path)
+	}
+	name = filepath.Base(filepath.FromSlash(strings.ReplaceAll(name, `\`, "/")))
+	if name == "." || name == "/" || name == ".." {
+		name = "download"
+	}
+	if path.Ext(name) == "" {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return name
+}
+
+// uniqueFile returns dir/name, or dir/"name (n).ext" if it exists.
+func uniqueFile(dir, name string) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	p := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+			if _, err := os.Stat(p + ".part"); errors.Is(err, os.ErrNotExist) {
+				return p
+			}
+		}
+		p = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+	}
+}
+
+// castDownload casts a completed download to the device it was meant for,
+// with its library metadata if it has been indexed.
+func (h *Handler) castDownload(d *Download, snapshot Download) {
+	device := h.discovery.GetDevice(snapshot.Device)
+	if device == nil {
+		h.events.publish("download", h.downloads.update(d, func(d *Download) {
+			d.Error = "downloaded, but the device to cast to is gone"
+		}))
+		return
+	}
+	base, err := h.agentURL(device)
+	if err != nil {
+		h.events.publish("download", h.downloads.update(d, func(d *Download) {
+			d.Error = err.Error()
+		}))
+		return
+	}
+	url := mediaURL(base, snapshot.Root, snapshot.Path)
+	meta := dlna.Metadata{Title: d.title}
+	if it, ok := h.library.Get(snapshot.Root, snapshot.Path); ok {
+		meta = libraryMetadata(it)
+		if d.title != "" {
+			meta.Title = d.title
+		}
+		if hasThumbnail(it) {
+			meta.AlbumArtURL = base + "/thumb/" + it.ID
+		}
+	}
+	job := h.jobs.create(device.USN, url, meta.Title)
+	h.events.publish("download", h.downloads.update(d, func(d *Download) {
+		d.Job = job.ID
+	}))
+	h.runJob(job, func(ctx context.Context) error {
+		return h.castURL(ctx, device, dlna.CastRequest{URL: url, Metadata: meta}, nil)
+	})
+}
+
+// ListDownloadsHandler lists the queued, running and recent downloads,
+// oldest first.
+func (h *Handler) ListDownloadsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.downloads.list())
+}
+
+func (h *Handler) GetDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, ok := h.downloads.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Download not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// CancelDownloadHandler cancels a queued or running download, deleting
+// what it fetched so far, or forgets a finished one (keeping its file).
+func (h *Handler) CancelDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	s := h.downloads
+	s.mu.Lock()
+	d, ok := s.m[r.PathValue("id")]
+	var canceled *Download
+	switch {
+	case !ok:
+	case d.State == DownloadQueued:
+		d.State, d.UpdatedAt = DownloadCanceled, time.Now()
+		snapshot := *d
+		canceled = &snapshot
+	case d.cancel != nil:
+		d.cancel()
+	default:
+		delete(s.m, d.ID)
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "Download not found", http.StatusNotFound)
+		return
+	}
+	if canceled != nil {
+		h.events.publish("download", *canceled)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,417 @@
+package api
+
+import (
+	"bytes"
+	"dlna/dlna"
+	"dlna/renderer"
+	"dlna/store"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSSDP is a simulated SSDP network: it answers M-SEARCH for the devices
+// on it from a loopback socket, which discovery reaches as a unicast search
+// target, and delivers NOTIFYs to discovery as if they had been multicast.
+type fakeSSDP struct {
+	t    *testing.T
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	devices []fakeDevice
+}
+
+type fakeDevice struct {
+	uuid, deviceType, location string
+}
+
+func newFakeSSDP(t *testing.T) *fakeSSDP {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to open the fake SSDP socket: %v", err)
+	}
+	n := &fakeSSDP{t: t, conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	go n.serve()
+	return n
+}
+
+func (n *fakeSSDP) addr() *net.UDPAddr { return n.conn.LocalAddr().(*net.UDPAddr) }
+
+func (n *fakeSSDP) add(d fakeDevice) {
+	n.mu.Lock()
+	n.devices = append(n.devices, d)
+	n.mu.Unlock()
+}
+
+// serve answers M-SEARCH requests whose ST matches a device.
+func (n *fakeSSDP) serve() {
+	buf := make([]byte, 4096)
+	for {
+		size, src, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg := string(buf[:size])
+		if !strings.HasPrefix(msg, "M-SEARCH") {
+			continue
+		}
+		var st string
+		for _, line := range strings.Split(msg, "\r\n") {
+			if k, v, ok := strings.Cut(line, ":"); ok && strings.EqualFold(k, "ST") {
+				st = strings.TrimSpace(v)
+			}
+		}
+		n.mu.Lock()
+		for _, d := range n.devices {
+			if st == "ssdp:all" || st == "upnp:rootdevice" || st == d.deviceType || st == d.uuid {
+				resp := "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=1800\r\nEXT:\r\n" +
+					"LOCATION: " + d.location + "\r\nSERVER: Linux/1.0 UPnP/1.0 fake/1.0\r\n" +
+					"ST: " + d.deviceType + "\r\nUSN: " + d.uuid + "::" + d.deviceType + "\r\n\r\n"
+				n.conn.WriteToUDP([]byte(resp), src)
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// notify delivers an ssdp:alive or ssdp:byebye of d to discovery.
+func (n *fakeSSDP) notify(s *dlna.DiscoveryService, d fakeDevice, nts string) {
+	msg := "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: " + d.deviceType + "\r\nNTS: " + nts + "\r\n" +
+		"USN: " + d.uuid + "::" + d.deviceType + "\r\n"
+	if nts == "ssdp:alive" {
+		msg += "CACHE-CONTROL: max-age=1800\r\nLOCATION: " + d.location + "\r\n"
+	}
+	line, _ := json.Marshal(map[string]interface{}{"time": time.Now(), "src": n.addr().String(), "data": msg + "\r\n"})
+	if _, err := s.Replay(bytes.NewReader(line), false); err != nil {
+		n.t.Fatalf("Failed to deliver %s: %v", nts, err)
+	}
+}
+
+// eventLog collects the events POSTed to a webhook.
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (l *eventLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var ev Event
+	json.NewDecoder(r.Body).Decode(&ev)
+	l.mu.Lock()
+	l.events = append(l.events, ev)
+	l.mu.Unlock()
+}
+
+func (l *eventLog) has(typ string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, ev := range l.events {
+		if ev.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// eventually polls cond for up to five seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestHandler returns a handler with an in-memory store and a discovery
+// that is not started.
+func newTestHandler() *Handler {
+	st, _ := store.Open("")
+	return NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+}
+
+// livingRoomTV is the renderer most tests cast to.
+func livingRoomTV() dlna.Device {
+	return dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", DeviceType: dlna.DeviceTypeMediaRenderer,
+		Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}}
+}
+
+// onlineHandler returns a test handler whose discovery has devices online.
+// Devices without a Location get one that answers health checks.
+func onlineHandler(t *testing.T, devices ...dlna.Device) *Handler {
+	t.Helper()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	for i := range devices {
+		if devices[i].Location == "" {
+			devices[i].Location = srv.URL
+		}
+	}
+	h := newTestHandler()
+	restoreOnline(t, h.discovery, devices...)
+	return h
+}
+
+// restoreOnline adds devices to discovery and waits for the health check
+// to find them online, which needs each Location to answer.
+func restoreOnline(t *testing.T, discovery *dlna.DiscoveryService, devices ...dlna.Device) {
+	t.Helper()
+	discovery.Restore(dlna.Snapshot{Devices: devices})
+	eventually(t, "the devices to come online", func() bool {
+		for _, d := range discovery.Snapshot().Devices {
+			if !d.Online {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// loadedURI is the media of a SetAVTransportURI.
+type loadedURI struct {
+	URI      string `xml:"CurrentURI"`
+	Metadata string `xml:"CurrentURIMetaData"`
+}
+
+// loaded returns the media f was sent with SetAVTransportURI, oldest
+// first.
+func (f *fakeSOAP) loaded(t *testing.T) []loadedURI {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []loadedURI
+	for _, c := range f.calls {
+		if _, body, ok := strings.Cut(c, " SetAVTransportURI "); ok {
+			var l loadedURI
+			if err := xml.Unmarshal([]byte(body), &l); err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, l)
+		}
+	}
+	return list
+}
+
+// lastLoaded returns the media f was last sent, if any.
+func (f *fakeSOAP) lastLoaded(t *testing.T) loadedURI {
+	t.Helper()
+	list := f.loaded(t)
+	if len(list) == 0 {
+		return loadedURI{}
+	}
+	return list[len(list)-1]
+}
+
+// TestEndToEnd runs discovery against the fake SSDP network and a mock
+// renderer, then casts through the API and follows the cast to its end.
+func TestEndToEnd(t *testing.T) {
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+	progressInterval = 20 * time.Millisecond
+
+	tv := renderer.NewMock("E2E TV")
+	mux := http.NewServeMux()
+	tv.Register(mux)
+	tvServer := httptest.NewServer(mux)
+	defer tvServer.Close()
+
+	network := newFakeSSDP(t)
+	dev := fakeDevice{uuid: tv.UUID, deviceType: dlna.DeviceTypeMediaRenderer, location: tvServer.URL + "/renderer/description.xml"}
+	network.add(dev)
+
+	events := &eventLog{}
+	hookServer := httptest.NewServer(events)
+	defer hookServer.Close()
+
+	discovery := dlna.NewDiscoveryService("127.0.0.1", time.Hour)
+	discovery.SetSearchTargets([]*net.UDPAddr{network.addr()})
+	st, _ := store.Open("")
+	h := NewHandler(discovery, "", st)
+	h.SetHooks([]Hook{{url: hookServer.URL, timeout: time.Second}})
+	discovery.Start()
+
+	// Discovery and description parsing
+	eventually(t, "the renderer to be discovered", func() bool { return discovery.GetDevice(tv.UUID) != nil })
+	device := discovery.GetDevice(tv.UUID)
+	if device.FriendlyName != "E2E TV" || !device.Online || !device.Supports("SetAVTransportURI") || device.RenderingControlURL() == "" {
+		t.Fatalf("Unexpected device %+v", device)
+	}
+	eventually(t, "the device-added event", func() bool { return events.has(string(dlna.DeviceAdded)) })
+
+	cast := func(url, title, policy string) Job {
+		body := fmt.Sprintf(`{"url": %q, "usn": %q, "title": %q, "duration": "1:00:00", "policy": %q}`, url, tv.UUID, title, policy)
+		w := httptest.NewRecorder()
+		h.CastHandler(w, httptest.NewRequest("POST", "/api/cast", strings.NewReader(body)))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Cast of %s returned %d: %s", title, w.Code, w.Body)
+		}
+		var job Job
+		json.NewDecoder(w.Body).Decode(&job)
+		return job
+	}
+	transport := dlna.NewAVTransport(device.AVTransportURL())
+	playing := func(url string) func() bool {
+		return func() bool {
+			info, err := transport.GetPositionInfo()
+			ti, _ := transport.GetTransportInfo()
+			return err == nil && info.TrackURI == url && ti != nil && ti.CurrentTransportState == "PLAYING"
+		}
+	}
+
+	// Casting
+	cast("http://media.test/a.mp4", "A", "")
+	eventually(t, "A to play", playing("http://media.test/a.mp4"))
+	eventually(t, "the cast-started event", func() bool { return events.has(EventCastStarted) })
+	if s := h.activeSession(tv.UUID); s == nil || s.URL != "http://media.test/a.mp4" {
+		t.Fatalf("Expected a session for A, got %+v", s)
+	}
+
+	// Queue auto-advance: B waits for A to end, then plays
+	queued := cast("http://media.test/b.mp4", "B", policyQueue)
+	if queued.State != JobQueued {
+		t.Fatalf("Expected B to be queued, got %+v", queued)
+	}
+	time.Sleep(5 * progressInterval)
+	if !playing("http://media.test/a.mp4")() {
+		t.Fatal("Expected A to keep playing while B is queued")
+	}
+	tv.Finish()
+	eventually(t, "B to play after A ended", playing("http://media.test/b.mp4"))
+	eventually(t, "the cast-finished event", func() bool { return events.has(EventCastFinished) })
+	eventually(t, "the queued job to be done", func() bool { return h.jobs.get(queued.ID).State == JobDone })
+
+	// Eventing of presence
+	network.notify(discovery, dev, "ssdp:byebye")
+	if discovery.GetDevice(tv.UUID).Online {
+		t.Error("Expected the renderer to be offline after byebye")
+	}
+	network.notify(discovery, dev, "ssdp:alive")
+	if !discovery.GetDevice(tv.UUID).Online {
+		t.Error("Expected the renderer back online after alive")
+	}
+	eventually(t, "the device-offline event", func() bool { return events.has(string(dlna.DeviceOffline)) })
+	eventually(t, "the device-online event", func() bool { return events.has(string(dlna.DeviceOnline)) })
+
+	var actions []string
+	for _, c := range tv.Calls() {
+		if !strings.HasPrefix(c.Action, "Get") {
+			actions = append(actions, c.Action)
+		}
+	}
+	if got := strings.Join(actions, ","); !strings.Contains(got, "SetAVTransportURI,Play") || strings.Count(got, "SetAVTransportURI") != 2 {
+		t.Errorf("Unexpected actions on the renderer: %s", got)
+	}
+}
+
+// withMockRenderer serves a mock renderer named name and returns a
+// handler that knows it as a manual device.
+func withMockRenderer(t *testing.T, name string) (*Handler, *dlna.Device, *renderer.Renderer) {
+	tv := renderer.NewMock(name)
+	mux := http.NewServeMux()
+	tv.Register(mux)
+	tvServer := httptest.NewServer(mux)
+	t.Cleanup(tvServer.Close)
+
+	discovery := dlna.NewDiscoveryService("", time.Hour)
+	st, _ := store.Open("")
+	h := NewHandler(discovery, "", st)
+	device, err := discovery.AddManualDevice(tvServer.URL + "/renderer/description.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, device, tv
+}
+
+// TestNextPrevious skips through casts queued on a mock renderer.
+func TestNextPrevious(t *testing.T) {
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+	progressInterval = 20 * time.Millisecond
+
+	h, device, _ := withMockRenderer(t, "Skip TV")
+	post := func(handler http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return w
+	}
+	usn := fmt.Sprintf(`{"usn": %q}`, device.USN)
+	transport := dlna.NewAVTransport(device.AVTransportURL())
+	playing := func(url string) func() bool {
+		return func() bool {
+			info, err := transport.GetPositionInfo()
+			return err == nil && info.TrackURI == url && h.activeSession(device.USN) != nil && h.activeSession(device.USN).URL == url
+		}
+	}
+
+	// Without a queue, Next goes to the renderer, which has no playlist
+	if w := post(h.NextHandler, "/api/next", usn); w.Code != http.StatusNotImplemented {
+		t.Errorf("Next without a queue returned %d: %s", w.Code, w.Body)
+	}
+
+	for i, name := range []string{"a", "b", "c"} {
+		body := fmt.Sprintf(`{"url": "http://media.test/%s.mp4", "usn": %q, "duration": "1:00:00", "policy": "queue"}`, name, device.USN)
+		if w := post(h.CastHandler, "/api/cast", body); w.Code != http.StatusAccepted {
+			t.Fatalf("Cast of %s returned %d: %s", name, w.Code, w.Body)
+		}
+		if i == 0 {
+			eventually(t, "a to play", playing("http://media.test/a.mp4"))
+		}
+	}
+
+	if w := post(h.NextHandler, "/api/next", usn); w.Code != http.StatusAccepted {
+		t.Fatalf("Next returned %d: %s", w.Code, w.Body)
+	}
+	eventually(t, "b to play", playing("http://media.test/b.mp4"))
+
+	if w := post(h.PreviousHandler, "/api/previous", usn); w.Code != http.StatusAccepted {
+		t.Fatalf("Previous returned %d: %s", w.Code, w.Body)
+	}
+	eventually(t, "a to play again", playing("http://media.test/a.mp4"))
+	if s := h.activeSession(device.USN); s.Queued != 2 {
+		t.Errorf("Expected b and c queued behind a, got %d", s.Queued)
+	}
+
+	post(h.NextHandler, "/api/next", usn)
+	eventually(t, "b to play again", playing("http://media.test/b.mp4"))
+	post(h.NextHandler, "/api/next", usn)
+	eventually(t, "c to play", playing("http://media.test/c.mp4"))
+	if w := post(h.NextHandler, "/api/next", usn); w.Code != http.StatusNotImplemented {
+		t.Errorf("Next past the queue returned %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestPlayMode(t *testing.T) {
+	h, device, tv := withMockRenderer(t, "Mode TV")
+	set := func(mode string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"usn": %q, "mode": %q}`, device.USN, mode)
+		h.SetPlayModeHandler(w, httptest.NewRequest("PUT", "/api/playmode", strings.NewReader(body)))
+		return w
+	}
+
+	if w := set("REPEAT_ALL"); w.Code != http.StatusOK {
+		t.Fatalf("Set REPEAT_ALL returned %d: %s", w.Code, w.Body)
+	}
+	w := httptest.NewRecorder()
+	h.GetPlayModeHandler(w, httptest.NewRequest("GET", "/api/playmode?usn="+device.USN, nil))
+	if !strings.Contains(w.Body.String(), `"REPEAT_ALL"`) {
+		t.Errorf("Expected REPEAT_ALL, got %d: %s", w.Code, w.Body)
+	}
+	if w := set("LOOP"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown mode to be rejected, got %d", w.Code)
+	}
+	// The mock plays one track at a time and has no shuffle
+	if w := set("SHUFFLE"); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected the renderer to refuse SHUFFLE, got %d: %s", w.Code, w.Body)
+	}
+	if calls := tv.Calls(); len(calls) == 0 || calls[len(calls)-1].Action != "SetPlayMode" {
+		t.Errorf("Unexpected calls %+v", calls)
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is pushed to WebSocket subscribers.
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// eventHub fans events out to subscribers. Slow subscribers miss events
+// rather than blocking publishers.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan Event]struct{})}
+}
+
+func (e *eventHub) subscribe() chan Event {
+	ch := make(chan Event, 16)
+	e.mu.Lock()
+	e.subs[ch] = struct{}{}
+	e.mu.Unlock()
+	return ch
+}
+
+func (e *eventHub) unsubscribe(ch chan Event) {
+	e.mu.Lock()
+	delete(e.subs, ch)
+	e.mu.Unlock()
+}
+
+func (e *eventHub) publish(typ string, data interface{}) {
+	ev := Event{Type: typ, Time: time.Now(), Data: data}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"dlna/config"
+	"dlna/dlna"
+)
+
+// SetFailover sets whether, and to which devices, casts without a device
+// fail over when the default one is unavailable.
+func (h *Handler) SetFailover(f config.Failover) {
+	h.mu.Lock()
+	h.failover = f
+	h.mu.Unlock()
+}
+
+// available reports whether a cast can reach device: it is online or can
+// be woken.
+func available(device *dlna.Device) bool {
+	return device != nil && (device.Online || device.MAC != "")
+}
+
+// failoverDevice picks the device casts go to while the default one,
+// usn, is unavailable: the first available device of the failover list,
+// or without one, of those matching the default patterns. It returns nil
+// if failover is off or no device is available.
+func (h *Handler) failoverDevice(usn string, patterns []DevicePattern) *dlna.Device {
+	h.mu.RLock()
+	f := h.failover
+	h.mu.RUnlock()
+	if !f.Enabled {
+		return nil
+	}
+
+	var candidates []*dlna.Device
+	for _, name := range f.Devices {
+		if d := h.discovery.GetDevice(h.deviceByName(name)); d != nil {
+			candidates = append(candidates, d)
+		}
+	}
+	if len(f.Devices) == 0 {
+		var matching []*dlna.Device
+		for _, d := range h.discovery.GetDevices() {
+			if available(d) {
+				matching = append(matching, d)
+			}
+		}
+		if d := matchDevice(patterns, matching); d != nil {
+			candidates = append(candidates, d)
+		}
+	}
+	for _, d := range candidates {
+		if d.USN != usn && available(d) {
+			return d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// frameMaxFailures stops a photo frame after this many casts fail in a row.
+const frameMaxFailures = 5
+
+var imageExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".bmp": true, ".webp": true,
+}
+
+// PhotoFrame continuously casts the images of a media root folder to a
+// renderer.
+type PhotoFrame struct {
+	Device    string    `json:"device"` // USN
+	Root      string    `json:"root"`
+	Folder    string    `json:"folder,omitempty"`
+	Interval  string    `json:"interval"`
+	Shuffle   bool      `json:"shuffle"`
+	Current   string    `json:"current,omitempty"` // Image being shown
+	StartedAt time.Time `json:"started_at"`
+
+	every time.Duration
+	stop  chan struct{}
+}
+
+// frames holds at most one photo frame per device.
+type frames struct {
+	mu sync.Mutex
+	m  map[string]*PhotoFrame
+}
+
+func newFrames() *frames {
+	return &frames{m: make(map[string]*PhotoFrame)}
+}
+
+// remove stops and drops the device's frame, if f is still the current one
+// (or f is nil).
+func (fr *frames) remove(usn string, f *PhotoFrame) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	cur, ok := fr.m[usn]
+	if !ok || (f != nil && cur != f) {
+		return false
+	}
+	delete(fr.m, usn)
+	close(cur.stop)
+	return true
+}
+
+// scanImages lists the images under dir, recursively, in name order.
+func scanImages(fsys fs.FS, dir string) ([]string, error) {
+	var images []string
+	err := fs.WalkDir(fsys, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && imageExts[strings.ToLower(path.Ext(p))] {
+			images = append(images, p)
+		}
+		return nil
+	})
+	sort.Strings(images)
+	return images, err
+}
+
+func (h *Handler) StartFrameHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		USN      string `json:"usn"`      // Optional
+		Root     string `json:"root"`     // Media root name
+		Folder   string `json:"folder"`   // Optional subfolder of the root
+		Interval string `json:"interval"` // Optional, default "10s"
+		Shuffle  bool   `json:"shuffle"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Interval == "" {
+		req.Interval = "10s"
+	}
+	every, err := time.ParseDuration(req.Interval)
+	if err != nil || every < time.Second {
+		http.Error(w, fmt.Sprintf("Invalid interval %q", req.Interval), http.StatusBadRequest)
+		return
+	}
+	folder := path.Clean("/" + req.Folder)[1:]
+	if folder == "" {
+		folder = "."
+	}
+	fsys := h.mediaRoot(req.Root)
+	if fsys == nil {
+		http.Error(w, fmt.Sprintf("Unknown media root %q", req.Root), http.StatusBadRequest)
+		return
+	}
+	if images, err := scanImages(fsys, folder); err != nil || len(images) == 0 {
+		http.Error(w, fmt.Sprintf("No images in %s/%s", req.Root, folder), http.StatusBadRequest)
+		return
+	}
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+		return
+	}
+	base, err := h.agentURL(device)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f := &PhotoFrame{
+		Device:    device.USN,
+		Root:      req.Root,
+		Folder:    req.Folder,
+		Interval:  every.String(),
+		Shuffle:   req.Shuffle,
+		StartedAt: time.Now(),
+		every:     every,
+		stop:      make(chan struct{}),
+	}
+	h.frames.remove(device.USN, nil)
+	h.frames.mu.Lock()
+	h.frames.m[device.USN] = f
+	snapshot := *f
+	h.frames.mu.Unlock()
+	go h.runFrame(f, device, fsys, folder, base)
+
+	log.Printf("Photo frame started on %s: %s/%s every %s", device.FriendlyName, req.Root, folder, every)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// runFrame casts one image per interval, re-scanning the folder each time
+// it has shown every image so new ones are picked up.
+func (h *Handler) runFrame(f *PhotoFrame, device *dlna.Device, fsys fs.FS, folder, base string) {
+	defer h.frames.remove(device.USN, f)
+
+	if err := h.wake(device); err != nil {
+		log.Printf("Photo frame on %s: %v", device.FriendlyName, err)
+		return
+	}
+
+	var queue []string
+	failures := 0
+	for {
+		if len(queue) == 0 {
+			images, err := scanImages(fsys, folder)
+			if err != nil {
+				log.Printf("Photo frame: scanning %s: %v", folder, err)
+			}
+			if f.Shuffle {
+				rand.Shuffle(len(images), func(i, j int) { images[i], images[j] = images[j], images[i] })
+			}
+			queue = images
+		}
+
+		if len(queue) > 0 {
+			img := queue[0]
+			queue = queue[1:]
+			if err := h.castImage(context.Background(), device, mediaURL(base, f.Root, img), img, h.thumbnailURL(base, f.Root, img)); err != nil {
+				failures++
+				log.Printf("Photo frame on %s: %v", device.FriendlyName, err)
+				if failures >= frameMaxFailures {
+					log.Printf("Photo frame on %s stopped after %d failures", device.FriendlyName, failures)
+					return
+				}
+			} else {
+				failures = 0
+				h.frames.mu.Lock()
+				f.Current = img
+				h.frames.mu.Unlock()
+			}
+		}
+
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(f.every):
+		}
+	}
+}
+
+func (h *Handler) castImage(ctx context.Context, device *dlna.Device, url, name, thumbURL string) error {
+	meta := dlna.Metadata{
+		Title:       path.Base(name),
+		AlbumArtURL: thumbURL,
+		Class:       didl.ClassPhoto,
+		MimeType:    mime.TypeByExtension(path.Ext(name)),
+	}
+	metaData, err := h.metadataFor(device, meta).DIDL(url)
+	if err != nil {
+		return err
+	}
+	return h.load(ctx, device, h.avTransport(device), url, metaData)
+}
+
+func (h *Handler) ListFramesHandler(w http.ResponseWriter, r *http.Request) {
+	h.frames.mu.Lock()
+	list := make([]PhotoFrame, 0, len(h.frames.m))
+	for _, f := range h.frames.m {
+		list = append(list, *f)
+	}
+	h.frames.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// StopFrameHandler stops the photo frame on ?usn= (or the default device).
+func (h *Handler) StopFrameHandler(w http.ResponseWriter, r *http.Request) {
+	device := h.selectDevice(w, r, r.URL.Query().Get("usn"))
+	if device == nil {
+		return
+	}
+	if !h.frames.remove(device.USN, nil) {
+		http.Error(w, "No photo frame on this device", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Photo frame on %s stopped", device.FriendlyName)
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"dlna/dlna"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+// idlePrefix selects a device by group: "idle:kitchen" as the device of a
+// request is the first idle member of the group "kitchen".
+const idlePrefix = "idle:"
+
+var (
+	errUnknownGroup     = errors.New("Unknown group")
+	errNoIdleDevice     = errors.New("No device of the group is idle")
+	validName           = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`) // Of groups and profiles
+	idleTransportStates = []string{"STOPPED", "NO_MEDIA_PRESENT"}
+)
+
+// ParseGroups validates the groups of the config file: names to device
+// patterns, see DevicePattern.
+func ParseGroups(cfg map[string][]string) (map[string][]DevicePattern, error) {
+	groups := make(map[string][]DevicePattern, len(cfg))
+	for name, members := range cfg {
+		if !validName.MatchString(name) {
+			return nil, fmt.Errorf("group %q: names are letters, digits, '.', '_' and '-'", name)
+		}
+		if len(members) == 0 {
+			return nil, fmt.Errorf("group %s has no devices", name)
+		}
+		for _, s := range members {
+			p, err := ParseDevicePattern(s)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %w", name, err)
+			}
+			groups[name] = append(groups[name], p)
+		}
+	}
+	return groups, nil
+}
+
+// SetGroups replaces the device groups.
+func (h *Handler) SetGroups(groups map[string][]DevicePattern) {
+	h.mu.Lock()
+	h.groups = groups
+	h.mu.Unlock()
+}
+
+// groupDevices returns the members of a group in the order of its
+// patterns, by friendly name for a pattern matching several.
+func (h *Handler) groupDevices(name string) ([]*dlna.Device, error) {
+	h.mu.RLock()
+	patterns, ok := h.groups[name]
+	h.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownGroup, name)
+	}
+	devices := sortDevices(h.discovery.GetDevices())
+	var members []*dlna.Device
+	for _, p := range patterns {
+		for _, d := range devices {
+			if p.Matches(d) && !slices.Contains(members, d) {
+				members = append(members, d)
+			}
+		}
+	}
+	return members, nil
+}
+
+// transportState is the AVTransport state of device: that of the cast the
+// agent polls if there is one, else asked from the renderer. Devices
+// playing a clip over their cast are "INTERRUPTED"; offline ones and those
+// that do not answer have no state.
+func (h *Handler) transportState(device *dlna.Device) string {
+	if h.interrupts.pending(device.USN) > 0 {
+		return "INTERRUPTED"
+	}
+	h.checkpoints.mu.Lock()
+	p, ok := h.checkpoints.progress[device.USN]
+	h.checkpoints.mu.Unlock()
+	if ok && p.State != "" {
+		return p.State
+	}
+	if !device.Online {
+		return ""
+	}
+	info, err := h.avTransport(device).GetTransportInfo()
+	if err != nil {
+		return ""
+	}
+	return info.CurrentTransportState
+}
+
+// idleDevice returns the first member of a group that is online and
+// stopped, skipping those allows rejects (nil allows all).
+func (h *Handler) idleDevice(group string, allows func(*dlna.Device) bool) (*dlna.Device, error) {
+	members, err := h.groupDevices(group)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range members {
+		if allows != nil && !allows(d) {
+			continue
+		}
+		if slices.Contains(idleTransportStates, h.transportState(d)) {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errNoIdleDevice, group)
+}
+
+// GroupMember is a device of a group and its transport state.
+type GroupMember struct {
+	USN          string `json:"usn"`
+	FriendlyName string `json:"friendly_name"`
+	State        string `json:"state,omitempty"` // e.g. PLAYING, empty if unknown
+	Idle         bool   `json:"idle"`
+}
+
+// ListGroupsHandler lists the device groups with their members' state.
+func (h *Handler) ListGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	names := make([]string, 0, len(h.groups))
+	for name := range h.groups {
+		names = append(names, name)
+	}
+	h.mu.RUnlock()
+
+	out := make(map[string][]GroupMember, len(names))
+	for _, name := range names {
+		members, err := h.groupDevices(name)
+		if err != nil {
+			continue // Removed meanwhile
+		}
+		list := make([]GroupMember, 0, len(members))
+		for _, d := range members {
+			state := h.transportState(d)
+			list = append(list, GroupMember{USN: d.USN, FriendlyName: d.FriendlyName, State: state, Idle: slices.Contains(idleTransportStates, state)})
+		}
+		out[name] = list
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -1,33 +1,202 @@
 package api
 
 import (
+	"context"
+	"dlna/config"
+	"dlna/didl"
 	"dlna/dlna"
+	"dlna/library"
+	"dlna/resolver"
+	"dlna/share"
+	"dlna/store"
+	"dlna/stream"
+	"dlna/torrent"
+	"dlna/tts"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
+// wakeTimeout bounds how long a cast waits for a woken device to come online.
+const wakeTimeout = 30 * time.Second
+
 type Handler struct {
 	discovery      *dlna.DiscoveryService
 	defaultID      string
-	defaultPattern string
+	patterns       []DevicePattern // From -p
+	configPatterns []DevicePattern // From the config, replacing patterns
+	failover       config.Failover
+	profiles       map[string]Profile
+	hwAccel        stream.HWAccel // Of transcodes
+	hwDevice       string
+	groups         map[string][]DevicePattern // By name, see idleDevice
 	mu             sync.RWMutex
+	jobs           *jobStore
+	events         *eventHub
+	history        *history
+	checkpoints    *checkpoints
+	sessions       *sessions
+	timers         *timers
+	fades          *fades
+	schedules      *schedules
+	presets        *presets
+	settings       *deviceSettings
+	frames         *frames
+	downloads      *downloads
+	mediaRoots     map[string]library.Root
+	mediaDirs      map[string]string     // What mediaRoots were set from, see SetMediaRoots
+	shares         map[string]mediaShare // Root name -> share opened for mediaRoots
+	watching       library.WatchConfig   // Of the running library watch
+	shareOpts      map[string]share.Options
+	resolvers      resolver.Chain
+	streams        *stream.Manager
+	liveDevices    map[string]string // stream ID -> USN
+	torrents       *torrent.Client
+	torrentBuffer  int64 // Bytes downloaded before casting a torrent
+	baseURL        string
+	listenAddr     string
+	agentURLs      AgentURLs
+	reload         func() error
+	maxBody        int64
+	castLimiter    *rateLimiter
+	maxStreams     int
+	streamRate     float64 // Bytes per second, 0 is unlimited
+	activeStreams  int
+	hooks          []Hook
+	notifications  []Notification
+	idle           *idleTimers
+	tvs            map[string]TV // USN -> vendor adapter
+	tvKeys         *tvKeys
+	tuners         *tuners
+	tts            tts.Engine
+	ttsLang        string
+	announcements  *announcements
+	interrupts     *interrupts
+	store          store.Store
+	soap           dlna.SOAPClient // nil is dlna.HTTPSOAPClient
+	tokens         []*Token
+	proxy          ProxyConfig
+	keys           *apiKeys
+	audit          *audit
+	library        *library.Index
+	libraryWatch   library.WatchConfig
+	thumbs         *library.Thumbnails
+	stopWatch      context.CancelFunc
+	ffmpeg         string
+	prober         library.Prober // Probes media before casting, see probeMedia
 }
 
-func NewHandler(d *dlna.DiscoveryService, pattern string) *Handler {
-	return &Handler{
-		discovery:      d,
-		defaultPattern: pattern,
+// NewHandler creates the API handler. pattern is that of -p, see
+// ParseDevicePatterns; an invalid one is logged and ignored.
+func NewHandler(d *dlna.DiscoveryService, pattern string, st store.Store) *Handler {
+	patterns, err := ParseDevicePatterns(pattern)
+	if err != nil {
+		log.Printf("Ignoring default player pattern: %v", err)
+	}
+	jobs := newJobStore()
+	h := &Handler{
+		discovery:     d,
+		patterns:      patterns,
+		jobs:          jobs,
+		events:        newEventHub(),
+		history:       newHistory(st),
+		checkpoints:   newCheckpoints(),
+		sessions:      newSessions(),
+		timers:        newTimers(),
+		fades:         newFades(),
+		schedules:     newSchedules(st),
+		presets:       newPresets(st),
+		keys:          newAPIKeys(st),
+		settings:      newDeviceSettings(st),
+		frames:        newFrames(),
+		downloads:     newDownloads(),
+		streams:       stream.NewManager("ffmpeg"),
+		liveDevices:   make(map[string]string),
+		torrents:      torrent.NewClient(torrent.Config{}),
+		torrentBuffer: defaultTorrentBuffer,
+		idle:          newIdleTimers(),
+		tvKeys:        newTVKeys(st),
+		tuners:        &tuners{},
+		announcements: newAnnouncements(),
+		interrupts:    newInterrupts(),
+		store:         st,
+		audit:         newAudit(st, jobs),
+		library:       library.New(st, library.FFprobe("ffprobe")),
+		thumbs:        library.NewThumbnails(""),
+		ffmpeg:        "ffmpeg",
+		prober:        library.FFprobe("ffprobe"),
 	}
+	d.SetDeviceHook(h.deviceChanged)
+	go h.scheduleLoop()
+	return h
 }
 
-func (h *Handler) ListDevicesHandler(w http.ResponseWriter, r *http.Request) {
-	devices := h.discovery.GetDevices()
+// SetResolvers sets the chain that turns page URLs into media URLs before
+// casting.
+func (h *Handler) SetResolvers(r resolver.Chain) {
+	h.mu.Lock()
+	h.resolvers = r
+	h.mu.Unlock()
+}
+
+// SetSOAPClient replaces the client the SOAP actions to renderers and
+// servers go through, which tests fake. Set it before serving.
+func (h *Handler) SetSOAPClient(c dlna.SOAPClient) {
+	h.soap = c
+}
+
+// avTransport returns the AVTransport client for device.
+func (h *Handler) avTransport(device *dlna.Device) *dlna.AVTransport {
+	return &dlna.AVTransport{ControlURL: device.AVTransportURL(), Client: h.soap}
+}
+
+// contentDirectory returns the ContentDirectory client for server.
+func (h *Handler) contentDirectory(server *dlna.Device) *dlna.ContentDirectory {
+	return &dlna.ContentDirectory{ControlURL: server.ContentDirectoryURL(), Client: h.soap}
+}
+
+func (h *Handler) AddManualDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Location string `json:"location"` // Description URL
+		IP       string `json:"ip"`       // Used when location is empty
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var v validator
+	v.url("location", req.Location)
+	v.text("ip", req.IP, maxNameLength)
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	target := req.Location
+	if target == "" {
+		target = req.IP
+	}
+	if target == "" {
+		http.Error(w, "Please specify a location or ip.", http.StatusBadRequest)
+		return
+	}
+
+	device, err := h.discovery.AddManualDevice(target)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to add device: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	log.Printf("Manual device registered: %s (%s)", device.FriendlyName, device.Location)
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(devices)
+	json.NewEncoder(w).Encode(device)
 }
 
 func (h *Handler) SetDefaultDeviceHandler(w http.ResponseWriter, r *http.Request) {
@@ -38,6 +207,9 @@ func (h *Handler) SetDefaultDeviceHandler(w http.ResponseWriter, r *http.Request
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !checkUSN(w, req.USN) {
+		return
+	}
 
 	h.mu.Lock()
 	h.defaultID = req.USN
@@ -49,54 +221,400 @@ func (h *Handler) SetDefaultDeviceHandler(w http.ResponseWriter, r *http.Request
 
 func (h *Handler) CastHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		URL   string `json:"url"`
-		USN   string `json:"usn"`   // Optional
-		Title string `json:"title"` // Optional
+		URL         string `json:"url"`
+		USN         string `json:"usn"`           // Optional
+		Title       string `json:"title"`         // Optional
+		Artist      string `json:"artist"`        // Optional
+		Album       string `json:"album"`         // Optional
+		AlbumArtURL string `json:"album_art_url"` // Optional
+		Duration    string `json:"duration"`      // Optional, "1:23:45" or "83m"
+		// Optional protocolInfo for the media, e.g. with a DLNA.ORG_PN
+		ProtocolInfo string `json:"protocol_info"`
+		Subtitles    string `json:"subtitles"`  // Optional subtitle file URL
+		StopAfter    string `json:"stop_after"` // Optional sleep timer, e.g. "45m"
+		// LowLatency relays rtsp:// cameras with less delay but less
+		// buffering against network jitter.
+		LowLatency bool `json:"low_latency"`
+		// Policy is what to do if the device is playing a session:
+		// "preempt" (default), "reject" or "queue".
+		Policy string `json:"policy"`
+		// Optional AVTransport InstanceID; by default one is requested via
+		// PrepareForConnection, falling back to 0.
+		InstanceID *uint32 `json:"instance_id"`
+		// Profile is the casting profile, default the device's; "none"
+		// casts the media as is.
+		Profile string `json:"profile"`
+		// BurnSubtitles transcodes the media with the subtitles file burnt
+		// into the video, for renderers that cannot show subtitles.
+		BurnSubtitles bool `json:"burn_subtitles"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	var v validator
+	if v.required("url", req.URL) {
+		v.mediaURL("url", req.URL)
+	}
+	v.text("title", req.Title, maxTextLength)
+	v.text("artist", req.Artist, maxTextLength)
+	v.text("album", req.Album, maxTextLength)
+	v.url("album_art_url", req.AlbumArtURL)
+	v.url("subtitles", req.Subtitles)
+	if req.BurnSubtitles && req.Subtitles == "" {
+		v.fail("burn_subtitles", "needs subtitles")
+	}
+	if req.ProtocolInfo != "" && strings.Count(req.ProtocolInfo, ":") != 3 {
+		v.fail("protocol_info", "must be protocol:network:contentFormat:additionalInfo")
+	}
+	switch req.Policy {
+	case "", policyPreempt, policyReject, policyQueue:
+	default:
+		v.fail("policy", "must be preempt, reject or queue")
+	}
+	if req.Profile != "" && !h.hasProfile(req.Profile) {
+		v.fail("profile", "unknown profile %q", req.Profile)
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	var stopAfter time.Duration
+	if req.StopAfter != "" {
+		d, err := time.ParseDuration(req.StopAfter)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid stop_after %q", req.StopAfter), http.StatusBadRequest)
+			return
+		}
+		stopAfter = d
+	}
+
+	duration, err := parseMediaDuration(req.Duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cast := dlna.CastRequest{
+		URL: req.URL,
+		Metadata: dlna.Metadata{
+			Title:       req.Title,
+			Artist:      req.Artist,
+			Album:       req.Album,
+			AlbumArtURL: req.AlbumArtURL,
+			Duration:    duration,
+		},
+		ProtocolInfo: req.ProtocolInfo,
+		Subtitles:    req.Subtitles,
+	}
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+		return
+	}
+
+	if s := h.activeSession(device.USN); s != nil && req.Policy == policyReject {
+		http.Error(w, fmt.Sprintf("%s is playing %s (session %s)", device.FriendlyName, s.URL, s.ID), http.StatusConflict)
+		return
+	}
+
+	job := h.jobs.create(device.USN, req.URL, req.Title)
+	play := func(ctx context.Context) error {
+		if err := h.loadURL(ctx, device, cast, req.InstanceID, true, castOptions{lowLatency: req.LowLatency, profile: req.Profile, burnSubtitles: req.BurnSubtitles}); err != nil {
+			return err
+		}
+		if stopAfter > 0 {
+			h.setTimer(device, stopAfter, "stop", 0)
+		}
+		return nil
+	}
+	if req.Policy == policyQueue {
+		job = h.queueCast(device.USN, job, play)
+	} else {
+		h.runJob(job, play)
+	}
+
+	writeJob(w, r, job)
+}
+
+// castOptions are choices of a cast beyond what to play.
+type castOptions struct {
+	lowLatency    bool   // For relayed cameras, see relay
+	profile       string // Casting profile, default the device's, see Profile
+	burnSubtitles bool   // Transcode with req.Subtitles burnt in
+	audioTrack    *int   // Stream index of the audio to play, see library.Track
+	subtitleTrack *int   // Embedded subtitles to burn in, see transcodeSource
+}
+
+// castURL wakes the device if needed, casts req and records it in the
+// history. A nil instance lets the renderer allocate one.
+func (h *Handler) castURL(ctx context.Context, device *dlna.Device, req dlna.CastRequest, instance *uint32) error {
+	return h.loadURL(ctx, device, req, instance, true, castOptions{})
+}
+
+// loadURL casts req like castURL. Without prepare the device must already
+// be awake and, for TVs, on the right input.
+func (h *Handler) loadURL(ctx context.Context, device *dlna.Device, req dlna.CastRequest, instance *uint32, prepare bool, opts castOptions) error {
+	profile, ok := h.profile(device, opts.profile)
+	if !ok {
+		return fmt.Errorf("unknown profile %q", opts.profile)
+	}
+	live := stream.IsUDP(req.URL) || stream.IsRTSP(req.URL)
+	magnet := torrent.IsMagnet(req.URL)
+	if !live && !magnet {
+		url, err := h.resolveURL(req.URL)
+		if err != nil {
+			return err
+		}
+		req.URL = url
+	}
+	if req.Metadata.Title == "" {
+		req.Metadata.Title = req.Title
+	}
+	quirks := h.quirks(device)
+	req.Metadata = h.metadataFor(device, req.Metadata)
+	var burn string
+	if opts.burnSubtitles && req.Subtitles != "" {
+		burn, req.Subtitles = req.Subtitles, ""
+	}
+	if burn != "" || opts.audioTrack != nil || opts.subtitleTrack != nil {
+		if live {
+			return fmt.Errorf("cannot burn subtitles into or pick tracks of the live stream %s", req.URL)
+		}
+		// Burning needs the video encoded and picking the audio a remux at
+		// least, whatever the profile
+		burning := burn != "" || opts.subtitleTrack != nil
+		if !profile.Transcode {
+			profile.Transcode = true
+			if !burning {
+				profile.VideoCodec, profile.AudioCodec = "copy", "copy"
+			}
+		}
+		if burning && profile.VideoCodec == "copy" {
+			profile.VideoCodec = ""
+		}
+	}
+	if req.Subtitles != "" && !h.settings.get(device.USN).Subtitles {
+		log.Printf("Not sending subtitles to %s, which is not set to show them", device.FriendlyName)
+		req.Subtitles = ""
+	}
+	if prepare {
+		if err := h.wake(device); err != nil {
+			return err
+		}
+		h.prepareTV(device, "")
+	}
+	if live {
+		// Once the renderer is awake, so the relay does not time out
+		if _, err := h.relay(device, &req, opts.lowLatency); err != nil {
+			return err
+		}
+	}
+	if magnet {
+		if err := h.streamTorrent(device, &req); err != nil {
+			return err
+		}
+	}
+	if !live && h.settings.get(device.USN).Probe {
+		h.probeMedia(&req)
+	}
+	if profile.Transcode {
+		if live {
+			log.Printf("Not transcoding the live stream %s for %s", req.URL, device.FriendlyName)
+		} else if err := h.transcode(device, &req, profile, transcodeSource{url: req.URL, subtitles: burn, audio: opts.audioTrack, subtitle: opts.subtitleTrack}); err != nil {
+			return err
+		}
+	}
+	url := req.URL
+	metaData, err := req.DIDL()
+	if err != nil {
+		return err
+	}
+	h.checkpoint(device)
+
+	var instanceID uint32
+	if instance != nil {
+		instanceID = *instance
+	} else {
+		instanceID = h.prepareInstance(device)
+	}
+	avt := h.avTransport(device)
+	avt.InstanceID = instanceID
+	if len(quirks) > 0 {
+		log.Printf("Applying quirks for %s: %s", device.FriendlyName, quirks)
+	}
+	if err := h.load(ctx, device, avt, url, metaData); err != nil {
+		return fmt.Errorf("failed to cast: %w", err)
+	}
+	h.recordCast(device, url, req.Metadata.Title, metaData, "")
+	log.Printf("Casting to %s: URL=%s, Title=%s", device.FriendlyName, url, req.Metadata.Title)
+	return nil
+}
+
+// resolveTimeout bounds the whole resolver chain for one cast.
+const resolveTimeout = 2 * time.Minute
+
+// resolveURL passes url through the configured resolvers.
+func (h *Handler) resolveURL(url string) (string, error) {
+	h.mu.RLock()
+	resolvers := h.resolvers
+	h.mu.RUnlock()
 
-	targetUSN := req.USN
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	resolved, err := resolvers.Resolve(ctx, url)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve URL: %w", err)
+	}
+	if resolved != url {
+		log.Printf("Resolved %s to %s", url, resolved)
+	}
+	return resolved, nil
+}
+
+// parseMediaDuration normalizes a cast duration to the H:MM:SS form used in
+// DIDL-Lite. It accepts that form directly or a Go duration such as "83m".
+func parseMediaDuration(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return didl.FormatDuration(d), nil
+	}
+	var hh, mm int
+	var ss float64
+	if n, _ := fmt.Sscanf(s, "%d:%d:%f", &hh, &mm, &ss); n == 3 && mm < 60 && ss < 60 {
+		return s, nil
+	}
+	return "", fmt.Errorf("Invalid duration %q", s)
+}
+
+// prepareTimeout bounds the optional PrepareForConnection call.
+const prepareTimeout = 5 * time.Second
+
+// prepareInstance asks renderers that allocate AVTransport instances
+// dynamically for one. Most renderers don't implement PrepareForConnection,
+// so any failure falls back to instance 0.
+func (h *Handler) prepareInstance(device *dlna.Device) uint32 {
+	if device.ConnectionManagerURL() == "" {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), prepareTimeout)
+	defer cancel()
+	cm := &dlna.ConnectionManager{ControlURL: device.ConnectionManagerURL(), Client: h.soap}
+	conn, err := cm.PrepareForConnection(ctx, "http-get:*:*:*")
+	if err != nil {
+		return 0
+	}
+	log.Printf("Prepared connection %d on %s (AVTransport instance %d)", conn.ConnectionID, device.FriendlyName, conn.AVTransportID)
+	return conn.AVTransportID
+}
+
+var (
+	errNoDevice       = errors.New("Please specify a device or set a default device first.")
+	errDeviceNotFound = errors.New("Device not found")
+)
+
+// selectDevice picks the renderer for a control request, if the request's
+// token may use it. On failure it writes the HTTP error and returns nil.
+func (h *Handler) selectDevice(w http.ResponseWriter, r *http.Request, usn string) *dlna.Device {
+	if !checkUSN(w, usn) {
+		return nil
+	}
+	var device *dlna.Device
+	var err error
+	if group, ok := strings.CutPrefix(usn, idlePrefix); ok {
+		device, err = h.idleDevice(group, requestTokenOf(r).allows)
+	} else {
+		device, err = h.resolveDevice(usn)
+	}
+	switch {
+	case err == nil:
+		if !checkDevice(w, r, device) || !h.checkSession(w, r, device) {
+			return nil
+		}
+		return device
+	case err == errNoDevice:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errNoIdleDevice):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+	return nil
+}
+
+// resolveDevice picks the renderer: explicit USN, then the default device,
+// then the default patterns. Without an explicit USN, an unavailable
+// default device may fail over to another, see failoverDevice. "idle:"
+// and a group name picks an idle device of the group, see idleDevice.
+func (h *Handler) resolveDevice(usn string) (*dlna.Device, error) {
+	if group, ok := strings.CutPrefix(usn, idlePrefix); ok {
+		return h.idleDevice(group, nil)
+	}
+	targetUSN := usn
 
 	// 1. Try explicit USN
 	// 2. Try manually set defaultID
+	h.mu.RLock()
 	if targetUSN == "" {
-		h.mu.RLock()
 		targetUSN = h.defaultID
-		h.mu.RUnlock()
 	}
+	patterns := h.patterns
+	if len(h.configPatterns) > 0 {
+		patterns = h.configPatterns
+	}
+	h.mu.RUnlock()
 
-	// 3. Try pattern match if no default set
-	if targetUSN == "" && h.defaultPattern != "" {
-		devices := h.discovery.GetDevices()
-		for _, d := range devices {
-			if strings.Contains(d.USN, h.defaultPattern) || strings.Contains(d.FriendlyName, h.defaultPattern) {
-				targetUSN = d.USN
-				break
-			}
+	// 3. Try the patterns, in order, if no default set
+	if targetUSN == "" {
+		if d := matchDevice(patterns, h.discovery.GetDevices()); d != nil {
+			targetUSN = d.USN
 		}
 	}
 
 	if targetUSN == "" {
-		http.Error(w, "Please specify a device or set a default device first.", http.StatusBadRequest)
-		return
+		return nil, errNoDevice
 	}
 
 	device := h.discovery.GetDevice(targetUSN)
+	if usn == "" && !available(device) {
+		if alt := h.failoverDevice(targetUSN, patterns); alt != nil {
+			name := targetUSN
+			if device != nil {
+				name = device.FriendlyName
+			}
+			log.Printf("Default device %s is unavailable, failing over to %s", name, alt.FriendlyName)
+			return alt, nil
+		}
+	}
 	if device == nil {
-		http.Error(w, "Device not found", http.StatusNotFound)
-		return
+		return nil, errDeviceNotFound
 	}
 
-	if err := dlna.Play(device.ControlURL, req.URL, req.Title); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to cast: %v", err), http.StatusInternalServerError)
-		return
-	}
+	return device, nil
+}
 
-	log.Printf("Casting to %s: URL=%s, Title=%s", device.FriendlyName, req.URL, req.Title)
+// wake sends Wake-on-LAN to an offline device with a known MAC and waits
+// for it to come online.
+func (h *Handler) wake(device *dlna.Device) error {
+	if device.Online || device.MAC == "" {
+		return nil
+	}
+	if err := h.discovery.WakeDevice(device.USN, wakeTimeout); err != nil {
+		return fmt.Errorf("failed to wake device: %w", err)
+	}
+	return nil
+}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Casting to %s", device.FriendlyName)
+// requireActions rejects the request with 501 if the renderer's SCPD does not
+// declare one of actions.
+func requireActions(w http.ResponseWriter, device *dlna.Device, actions ...string) bool {
+	for _, action := range actions {
+		if !device.Supports(action) {
+			http.Error(w, fmt.Sprintf("%s does not support %s", device.FriendlyName, action), http.StatusNotImplemented)
+			return false
+		}
+	}
+	return true
 }
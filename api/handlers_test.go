@@ -1,19 +1,60 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"dlna/config"
 	"dlna/dlna"
+	"dlna/internal/websocket"
+	"dlna/library"
+	"dlna/share"
+	"dlna/store"
+	"dlna/stream"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestHandlers(t *testing.T) {
 	discovery := dlna.NewDiscoveryService("", 1*time.Second)
+	st, _ := store.Open("")
 	// Mock a device if possible, or just test empty state
-	handler := NewHandler(discovery, "")
+	handler := NewHandler(discovery, "", st)
+
+	// Fake renderer: serves the description and accepts any SOAP action
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			return
+		}
+		w.Write([]byte(`<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <UDN>uuid:manual-1</UDN>
+    <friendlyName>Remote TV</friendlyName>
+    <serviceList>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+        <controlURL>/upnp/control/AVTransport1</controlURL>
+      </service>
+    </serviceList>
+  </device>
+</root>`))
+	}))
+	defer srv.Close()
 
 	t.Run("ListDevices", func(t *testing.T) {
 		req := httptest.NewRequest("GET", "/api/devices", nil)
@@ -44,6 +85,93 @@ func TestHandlers(t *testing.T) {
 		}
 	})
 
+	t.Run("AddManualDevice", func(t *testing.T) {
+		body := []byte(`{"location": "` + srv.URL + `/description.xml"}`)
+		req := httptest.NewRequest("POST", "/api/devices/manual", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		handler.AddManualDeviceHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		device := discovery.GetDevice("uuid:manual-1")
+		if device == nil {
+			t.Fatalf("Expected manual device to be registered")
+		}
+		if device.AVTransportURL() != srv.URL+"/upnp/control/AVTransport1" {
+			t.Errorf("Unexpected control URL %s", device.AVTransportURL())
+		}
+	})
+
+	t.Run("DeviceSettings", func(t *testing.T) {
+		body := []byte(`{"seek_mode": "abs_time", "max_volume": 40}`)
+		req := httptest.NewRequest("PUT", "/api/devices/uuid:manual-1/settings", bytes.NewBuffer(body))
+		req.SetPathValue("usn", "uuid:manual-1")
+		w := httptest.NewRecorder()
+		handler.PutDeviceSettingsHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if s := handler.settings.get("uuid:manual-1"); s.SeekMode != "abs_time" || s.MaxVolume != 40 {
+			t.Errorf("Unexpected settings %+v", s)
+		}
+
+		body = []byte(`{"seek_mode": "sideways"}`)
+		req = httptest.NewRequest("PUT", "/api/devices/uuid:manual-1/settings", bytes.NewBuffer(body))
+		req.SetPathValue("usn", "uuid:manual-1")
+		w = httptest.NewRecorder()
+		handler.PutDeviceSettingsHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for an invalid seek_mode, got %d", w.Code)
+		}
+
+		body = []byte(`{"idle_off": "10s"}`)
+		req = httptest.NewRequest("PUT", "/api/devices/uuid:manual-1/settings", bytes.NewBuffer(body))
+		req.SetPathValue("usn", "uuid:manual-1")
+		w = httptest.NewRecorder()
+		handler.PutDeviceSettingsHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for an idle_off under a minute, got %d", w.Code)
+		}
+	})
+
+	t.Run("CastJob", func(t *testing.T) {
+		body := []byte(`{"url": "http://example.com/video.m3u8", "usn": "uuid:manual-1"}`)
+		req := httptest.NewRequest("POST", "/api/cast", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		handler.CastHandler(w, req)
+
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Expected status 202, got %d: %s", w.Code, w.Body.String())
+		}
+		var job Job
+		if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+			t.Fatalf("Failed to decode job: %v", err)
+		}
+
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			req := httptest.NewRequest("GET", "/api/jobs/"+job.ID, nil)
+			req.SetPathValue("id", job.ID)
+			w := httptest.NewRecorder()
+			handler.JobHandler(w, req)
+			if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+				t.Fatalf("Failed to decode job: %v", err)
+			}
+			if job.State == JobDone || job.State == JobFailed {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if job.State != JobDone {
+			t.Errorf("Expected job to be done, got %s (%s)", job.State, job.Error)
+		}
+		if entries := handler.history.list(); len(entries) != 1 || entries[0].Device != "uuid:manual-1" {
+			t.Errorf("Expected cast to be recorded in history, got %+v", entries)
+		}
+	})
+
 	t.Run("CastNoDevice", func(t *testing.T) {
 		body := []byte(`{"url": "http://example.com/video.m3u8"}`)
 		req := httptest.NewRequest("POST", "/api/cast", bytes.NewBuffer(body))
@@ -59,3 +187,2567 @@ func TestHandlers(t *testing.T) {
 		}
 	})
 }
+
+func TestParseMediaDuration(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "", true},
+		{"83m", "1:23:00", true},
+		{"1:23:45", "1:23:45", true},
+		{"0:00:12.500", "0:00:12.500", true},
+		{"1:75:00", "", false},
+		{"soon", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseMediaDuration(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseMediaDuration(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestMediaAndScanImages(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "2024", "summer"), 0o755)
+	os.WriteFile(filepath.Join(dir, "b.JPG"), []byte("b"), 0o644)
+	os.WriteFile(filepath.Join(dir, "2024", "summer", "a b.png"), []byte("a"), 0o644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0o644)
+
+	images, err := scanImages(os.DirFS(dir), ".")
+	if err != nil || len(images) != 2 || images[0] != "2024/summer/a b.png" || images[1] != "b.JPG" {
+		t.Fatalf("Unexpected images %v, %v", images, err)
+	}
+	if got := mediaURL("http://agent", "photos", images[0]); got != "http://agent/media/photos/2024/summer/a%20b.png" {
+		t.Errorf("Unexpected media URL %s", got)
+	}
+
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	h.SetMediaRoots(map[string]string{"photos": dir})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /media/{root}/{path...}", h.MediaHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/media/photos/2024/summer/a%20b.png")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %v %v", resp, err)
+	}
+	resp, _ = http.Get(srv.URL + "/media/photos/..%2f..%2fetc%2fpasswd")
+	if resp.StatusCode == http.StatusOK {
+		t.Error("Path traversal should be rejected")
+	}
+}
+
+func TestMediaDLNAHeaders(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "clip.ts"), bytes.Repeat([]byte{0x47}, 1000), 0o644)
+	os.WriteFile(filepath.Join(dir, "clip.mp4"), bytes.Repeat([]byte{0}, 1000), 0o644)
+	os.WriteFile(filepath.Join(dir, "photo.jpg"), []byte("jpeg"), 0o644)
+
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	h.mediaRoots = map[string]library.Root{"videos": library.DirRoot(dir)}
+	h.library.SetProber(func(ctx context.Context, path string) (*library.Metadata, error) {
+		return &library.Metadata{Duration: 100 * time.Second, Tags: map[string]string{}, CoverIndex: -1}, nil
+	})
+	h.library.Scan(context.Background(), h.mediaRoots)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /media/{root}/{path...}", h.MediaHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	get := func(name string, headers map[string]string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/media/videos/"+name, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("clip.mp4", map[string]string{"Range": "bytes=100-199"})
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != "bytes 100-199/1000" {
+		t.Errorf("Expected a byte range, got %d %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	if got := resp.Header.Get("contentFeatures.dlna.org"); !strings.HasPrefix(got, "DLNA.ORG_OP=01;") {
+		t.Errorf("Unexpected content features %q", got)
+	}
+	if resp.Header.Get("transferMode.dlna.org") != "Streaming" {
+		t.Errorf("Unexpected transfer mode %q", resp.Header.Get("transferMode.dlna.org"))
+	}
+	if resp := get("clip.mp4", map[string]string{"TimeSeekRange.dlna.org": "npt=10-"}); resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("Expected 406 for a time seek in MP4, got %d", resp.StatusCode)
+	}
+
+	resp = get("clip.ts", map[string]string{"TimeSeekRange.dlna.org": "npt=0:00:50-"})
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != "bytes 500-999/1000" {
+		t.Errorf("Expected the second half, got %d %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	if got := resp.Header.Get("TimeSeekRange.dlna.org"); got != "npt=0:00:50.000-0:01:40.000/0:01:40.000 bytes=500-999/1000" {
+		t.Errorf("Unexpected TimeSeekRange %q", got)
+	}
+	if got := resp.Header.Get("contentFeatures.dlna.org"); !strings.HasPrefix(got, "DLNA.ORG_OP=11;") {
+		t.Errorf("Unexpected content features %q", got)
+	}
+
+	resp = get("photo.jpg", nil)
+	if resp.Header.Get("transferMode.dlna.org") != "Interactive" || !strings.Contains(resp.Header.Get("contentFeatures.dlna.org"), "FLAGS=00D") {
+		t.Errorf("Unexpected image headers %v", resp.Header)
+	}
+}
+
+func TestFadeVolume(t *testing.T) {
+	var mu sync.Mutex
+	var volumes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Volume string `xml:"Body>SetVolume>DesiredVolume"`
+		}
+		xml.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		volumes = append(volumes, req.Volume)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	device := &dlna.Device{USN: "uuid:speaker", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:RenderingControl:1": {ControlURL: srv.URL}}}
+	h.settings.m[device.USN] = DeviceSettings{MaxVolume: 8}
+
+	if err := h.fadeVolume(device, 0, 10, 500*time.Millisecond); err != nil {
+		t.Fatalf("fadeVolume failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(volumes, ","); got != "0,4,8" {
+		t.Errorf("Expected capped two-step fade 0,4,8, got %s", got)
+	}
+}
+
+func TestCreateAlarm(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	h.presets.m["jazz"] = Preset{Name: "jazz", URL: "http://radio.example/jazz.mp3"}
+
+	body := []byte(`{"time": "06:45", "days": "mon-fri", "preset": "jazz"}`)
+	w := httptest.NewRecorder()
+	h.CreateAlarmHandler(w, httptest.NewRequest("POST", "/api/alarms", bytes.NewBuffer(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var sc Schedule
+	json.NewDecoder(w.Body).Decode(&sc)
+	if sc.Cron != "45 6 * * mon-fri" || sc.Volume != alarmVolume || sc.FadeIn != alarmFadeIn {
+		t.Errorf("Unexpected alarm schedule %+v", sc)
+	}
+
+	body = []byte(`{"time": "25:00", "preset": "jazz"}`)
+	w = httptest.NewRecorder()
+	h.CreateAlarmHandler(w, httptest.NewRequest("POST", "/api/alarms", bytes.NewBuffer(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid time, got %d", w.Code)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	h := &Handler{}
+	h.SetLimits(config.Limits{MaxBodyBytes: 16, CastRate: 0.001, CastBurst: 2})
+	srv := h.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("POST", "/api/cast", strings.NewReader(`{}`)))
+		if w.Code != want {
+			t.Errorf("Cast %d: expected status %d, got %d", i+1, want, w.Code)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Error("Expected Retry-After on 429")
+		}
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/api/devices", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected reads not to be rate limited, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "/api/presets", strings.NewReader(`{"name": "far too long"}`)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413 for a large body, got %d", w.Code)
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	h := &Handler{}
+	h.SetLimits(config.Limits{MaxStreams: 1, StreamMbps: 0.8}) // 100 kB/s
+	release := make(chan struct{})
+	started := make(chan struct{})
+	srv := h.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream/screen" {
+			close(started)
+			<-release
+			return
+		}
+		w.Write(make([]byte, 150_000))
+	}))
+
+	go srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stream/screen", nil))
+	<-started
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/media/videos/a.mp4", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After beyond max_streams, got %d", w.Code)
+	}
+	close(release)
+
+	// The slot is free again once the live stream ends
+	var start time.Time
+	for deadline := time.Now().Add(time.Second); ; {
+		w, start = httptest.NewRecorder(), time.Now()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/media/videos/a.mp4", nil))
+		if w.Code == http.StatusOK || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Code != http.StatusOK || w.Body.Len() != 150_000 {
+		t.Fatalf("Expected the whole file, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected the response to be throttled, took %s", elapsed)
+	}
+}
+
+func TestCastValidation(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+
+	body := []byte(`{"url": "file:///etc/passwd", "usn": "uuid:<x>", "title": "a\u0000b"}`)
+	w := httptest.NewRecorder()
+	h.CastHandler(w, httptest.NewRequest("POST", "/api/cast", bytes.NewBuffer(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Fields []FieldError `json:"fields"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode errors: %v", err)
+	}
+	var fields []string
+	for _, f := range resp.Fields {
+		fields = append(fields, f.Field)
+	}
+	if got := strings.Join(fields, ","); got != "url,title" {
+		t.Errorf("Expected url and title errors, got %+v", resp.Fields)
+	}
+
+	body = []byte(`{"url": "http://example.com/a.mp3", "usn": "uuid:<x>"}`)
+	w = httptest.NewRecorder()
+	h.CastHandler(w, httptest.NewRequest("POST", "/api/cast", bytes.NewBuffer(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"usn"`) {
+		t.Errorf("Expected a usn field error, got %d: %s", w.Code, w.Body.String())
+	}
+
+	body = []byte(`{"url": "magnet:?xt=urn:btih:1234", "usn": "uuid:<x>"}`)
+	w = httptest.NewRecorder()
+	h.CastHandler(w, httptest.NewRequest("POST", "/api/cast", bytes.NewBuffer(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "info hash") {
+		t.Errorf("Expected an info hash error, got %d: %s", w.Code, w.Body.String())
+	}
+
+	body = []byte(`{"url": "http://example.com/a.mp3", "policy": "steal"}`)
+	w = httptest.NewRecorder()
+	h.CastHandler(w, httptest.NewRequest("POST", "/api/cast", bytes.NewBuffer(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"policy"`) {
+		t.Errorf("Expected a policy field error, got %d: %s", w.Code, w.Body.String())
+	}
+
+	body = []byte(`{"url": "http://example.com/a.mp3", "volume": 150, "stop_after": "soon"}`)
+	w = httptest.NewRecorder()
+	h.SmartCastHandler(w, httptest.NewRequest("POST", "/api/smartcast", bytes.NewBuffer(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"volume"`) || !strings.Contains(w.Body.String(), `"stop_after"`) {
+		t.Errorf("Expected volume and stop_after errors, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/schedules/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.PathValue("id")))
+	})
+	srv := Versioned(mux)
+
+	for path, want := range map[string]int{
+		"/api/v1/schedules/abc": http.StatusOK,
+		"/api/schedules/abc":    http.StatusOK,
+		"/api/v2/schedules/abc": http.StatusNotFound,
+		"/api/v1x/schedules":    http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("%s: expected status %d, got %d", path, want, w.Code)
+		}
+		if want == http.StatusOK && (w.Body.String() != "abc" || w.Header().Get("API-Version") != APIVersion) {
+			t.Errorf("%s: unexpected response %q %v", path, w.Body.String(), w.Header())
+		}
+	}
+}
+
+func TestProxied(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	p, err := ParseProxy(config.Proxy{Trusted: []string{"10.0.0.1", "192.168.0.0/16"}, BasePath: "dlna/"})
+	if err != nil {
+		t.Fatalf("ParseProxy failed: %v", err)
+	}
+	h.SetProxy(p)
+	if _, err := ParseProxy(config.Proxy{Trusted: []string{"proxy.lan"}}); err == nil {
+		t.Error("Expected an error for a host name")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", basePath(r)+"/api/jobs/"+r.PathValue("id"))
+		w.Write([]byte(clientIP(r)))
+	})
+	srv := h.Proxied(mux)
+
+	tests := []struct {
+		path, peer, forwardedFor, prefix string
+		client, location                 string
+	}{
+		{"/dlna/api/jobs/a", "10.0.0.1", "203.0.113.5, 192.168.1.2", "", "203.0.113.5", "/dlna/api/jobs/a"},
+		{"/api/jobs/a", "198.51.100.7", "203.0.113.5", "/dlna", "198.51.100.7", "/api/jobs/a"},
+		{"/api/jobs/a", "10.0.0.1", "", "/dlna", "10.0.0.1", "/dlna/api/jobs/a"},
+		{"/api/jobs/a", "192.168.1.2", "bogus, 203.0.113.9", "", "203.0.113.9", "/api/jobs/a"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.RemoteAddr = tt.peer + ":4000"
+		if tt.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if tt.prefix != "" {
+			req.Header.Set("X-Forwarded-Prefix", tt.prefix)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Body.String() != tt.client || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s from %s: expected client %s at %s, got %d %q at %q", tt.path, tt.peer, tt.client, tt.location, w.Code, w.Body, w.Header().Get("Location"))
+		}
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/dlnax/api/jobs/a", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected only the base path to be stripped, got %d", w.Code)
+	}
+}
+
+func TestAgentURL(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	h.SetBaseURL("", ":9000")
+	tv := &dlna.Device{USN: "uuid:tv", FriendlyName: "TV", Location: "http://127.0.0.5:49152/description.xml"}
+	if base, err := h.agentURL(tv); err != nil || base != "http://127.0.0.1:9000" {
+		t.Errorf("Expected the loopback address, got %q, %v", base, err)
+	}
+
+	overrides, err := ParseAgentURLs(map[string]string{
+		"127.0.0.0/8":  "http://agent.lan:8072/",
+		"127.0.0.5":    "http://10.0.0.2:8072",
+		"uuid:special": "https://agent.example",
+	})
+	if err != nil {
+		t.Fatalf("ParseAgentURLs failed: %v", err)
+	}
+	h.SetAgentURLs(overrides)
+	h.SetBaseURL("http://192.0.2.1:8072", ":9000")
+	for _, tt := range []struct{ usn, location, want string }{
+		{"uuid:tv", "http://127.0.0.5:49152/description.xml", "http://10.0.0.2:8072"},
+		{"uuid:tv", "http://127.0.0.9/description.xml", "http://agent.lan:8072"},
+		{"uuid:special", "http://127.0.0.5/description.xml", "https://agent.example"},
+		{"uuid:tv", "http://[::1]/description.xml", "http://192.0.2.1:8072"},
+	} {
+		base, err := h.agentURL(&dlna.Device{USN: tt.usn, Location: tt.location})
+		if err != nil || base != tt.want {
+			t.Errorf("%s at %s: expected %s, got %q, %v", tt.usn, tt.location, tt.want, base, err)
+		}
+	}
+	for _, bad := range []map[string]string{{"kitchen": "http://a"}, {"10.0.0.0/8": "ftp://a"}} {
+		if _, err := ParseAgentURLs(bad); err == nil {
+			t.Errorf("Expected %v to fail", bad)
+		}
+	}
+}
+
+func TestDeviceQuery(t *testing.T) {
+	now := time.Now()
+	devices := []*dlna.Device{
+		{USN: "uuid:a", FriendlyName: "Kitchen Speaker", ModelName: "Sonos One", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:RenderingControl:1": {ControlURL: "http://a"}}, Online: true, LastSeen: now},
+		{USN: "uuid:b", FriendlyName: "bedroom TV", Manufacturer: "Samsung", Online: true, LastSeen: now.Add(-time.Hour)},
+		{USN: "uuid:c", FriendlyName: "Attic TV", Manufacturer: "LG Electronics", LastSeen: now.Add(-2 * time.Hour)},
+	}
+	usns := func(list []*dlna.Device) string {
+		var out []string
+		for _, d := range list {
+			out = append(out, d.USN)
+		}
+		return strings.Join(out, ",")
+	}
+
+	tests := []struct {
+		query string
+		want  string
+		total int
+	}{
+		{"", "uuid:c,uuid:b,uuid:a", 3},
+		{"name=tv&sort=-last_seen", "uuid:b,uuid:c", 2},
+		{"model=samsung", "uuid:b", 1},
+		{"capability=volume", "uuid:a", 1},
+		{"online=true&sort=last_seen", "uuid:b,uuid:a", 2},
+		{"offset=1&limit=1", "uuid:b", 3},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		dq, err := parseDeviceQuery(q)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		got, total := dq.apply(devices)
+		if usns(got) != tt.want || total != tt.total {
+			t.Errorf("%q: got %s (%d), want %s (%d)", tt.query, usns(got), total, tt.want, tt.total)
+		}
+	}
+
+	if _, err := parseDeviceQuery(url.Values{"sort": {"size"}, "fields": {"usn,colour"}}); err == nil {
+		t.Error("Expected errors for an unknown sort and field")
+	}
+	dq, _ := parseDeviceQuery(url.Values{"fields": {"usn,online"}})
+	b, _ := json.Marshal(dq.project(devices[:1]))
+	if string(b) != `[{"online":true,"usn":"uuid:a"}]` {
+		t.Errorf("Unexpected projection %s", b)
+	}
+
+	dq, _ = parseDeviceQuery(url.Values{"capability": {"power"}})
+	dq.tvs = map[string]bool{"uuid:c": true}
+	if got, _ := dq.apply(devices); usns(got) != "uuid:c" {
+		t.Errorf("Expected only the TV with an adapter, got %s", usns(got))
+	}
+}
+
+func TestParseTVs(t *testing.T) {
+	if _, err := ParseTVs([]config.TV{{USN: "uuid:c", Type: "webos", Input: "HDMI_1"}, {USN: "uuid:b", Type: "tizen"}}); err != nil {
+		t.Fatalf("ParseTVs failed: %v", err)
+	}
+	for _, bad := range []config.TV{{Type: "webos"}, {USN: "uuid:b", Type: "roku"}, {USN: "uuid:b", Type: "tizen", Input: "HDMI1"}} {
+		if _, err := ParseTVs([]config.TV{bad}); err == nil {
+			t.Errorf("Expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	if _, err := ParseHooks([]config.Hook{{URL: "http://ntfy.example/tv", Events: []string{"device-exploded"}}}); err == nil {
+		t.Error("Expected an error for an unknown event")
+	}
+	if _, err := ParseHooks([]config.Hook{{}}); err == nil {
+		t.Error("Expected an error for a hook without url or command")
+	}
+
+	received := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		json.NewDecoder(r.Body).Decode(&ev)
+		received <- ev
+	}))
+	defer srv.Close()
+
+	hooks, err := ParseHooks([]config.Hook{{URL: srv.URL, Events: []string{EventCastStarted}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{events: newEventHub()}
+	h.SetHooks(hooks)
+	h.notify(EventCastFinished, CastFinished{Reason: finishStopped}) // Not subscribed
+	h.notify(EventCastStarted, HistoryEntry{URL: "http://example.com/a.mp3"})
+
+	select {
+	case ev := <-received:
+		if ev.Type != EventCastStarted || ev.Data.(map[string]interface{})["url"] != "http://example.com/a.mp3" {
+			t.Errorf("Unexpected event %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Hook was not called")
+	}
+	select {
+	case ev := <-received:
+		t.Errorf("Unexpected second event %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotificationMessage(t *testing.T) {
+	if _, err := ParseNotifications([]config.Notification{{Type: "telegram", Token: "t"}}); err == nil {
+		t.Error("Expected an error for telegram without chat_id")
+	}
+	ns, err := ParseNotifications([]config.Notification{{Type: "ntfy", URL: "https://ntfy.sh/tv"}})
+	if err != nil || !ns[0].events[EventCastFinished] || ns[0].events[EventCastStarted] {
+		t.Errorf("Expected default events, got %+v, %v", ns, err)
+	}
+
+	m, ok := notificationMessage(EventCastFinished, CastFinished{DeviceName: "Kitchen", URL: "http://radio/jazz", Reason: finishStopped})
+	if !ok || m.Title != "Playback finished" || m.Body != "http://radio/jazz on Kitchen" {
+		t.Errorf("Unexpected message %+v", m)
+	}
+	if _, ok := notificationMessage(EventCastFinished, CastFinished{Reason: finishReplaced}); ok {
+		t.Error("Expected no message for a replaced cast")
+	}
+	m, _ = notificationMessage(string(dlna.DeviceOffline), dlna.Device{FriendlyName: "Bedroom TV"})
+	if m.Title != "Device offline" || m.Body != "Bedroom TV" {
+		t.Errorf("Unexpected message %+v", m)
+	}
+}
+
+func TestProgressUpdate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+	var p Progress
+	p.update(&dlna.PositionInfo{RelTime: "0:15:00", TrackDuration: "1:00:00"}, "PLAYING", now)
+	if p.Percent != 25 || p.Remaining != "0:45:00" || p.ETA == nil || !p.ETA.Equal(now.Add(45*time.Minute)) {
+		t.Errorf("Unexpected progress %+v", p)
+	}
+	p.update(&dlna.PositionInfo{RelTime: "0:15:00", TrackDuration: "NOT_IMPLEMENTED"}, "PAUSED_PLAYBACK", now)
+	if p.Position != "0:15:00" || p.Duration != "" || p.Percent != 0 || p.ETA != nil {
+		t.Errorf("Expected position only for a live stream, got %+v", p)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	tokens, err := ParseTokens([]config.Token{
+		{Name: "owner", Token: "owner-secret-0123"},
+		{Name: "guest", Token: "guest-secret-0123", Scopes: []string{"read", "control"}, Devices: []string{"living room tv"}},
+		{Name: "reader", Token: "reader-secret-0123", Scopes: []string{"read"}},
+	})
+	if err != nil {
+		t.Fatalf("ParseTokens failed: %v", err)
+	}
+	h.SetTokens(tokens)
+	if _, err := ParseTokens([]config.Token{{Token: "short"}}); err == nil {
+		t.Error("Expected an error for a short token")
+	}
+
+	livingRoom := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV"}
+	bedroom := &dlna.Device{USN: "uuid:br", FriendlyName: "Bedroom TV"}
+	api := h.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		device := livingRoom
+		if r.URL.Query().Get("usn") == bedroom.USN {
+			device = bedroom
+		}
+		if checkDevice(w, r, device) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	tests := []struct {
+		method, target, token string
+		want                  int
+	}{
+		{"GET", "/api/devices", "", http.StatusUnauthorized},
+		{"GET", "/api/devices", "wrong", http.StatusUnauthorized},
+		{"GET", "/stream/abc", "", http.StatusNoContent},
+		{"POST", "/api/cast?usn=uuid:lr", "guest-secret-0123", http.StatusNoContent},
+		{"POST", "/api/cast?usn=uuid:br", "guest-secret-0123", http.StatusForbidden},
+		{"POST", "/api/cast?usn=uuid:br", "owner-secret-0123", http.StatusNoContent},
+		{"POST", "/api/reload", "guest-secret-0123", http.StatusForbidden},
+		{"GET", "/api/ws?token=guest-secret-0123", "", http.StatusNoContent},
+		// Casting needs the control scope whatever the method
+		{"GET", "/api/devices", "reader-secret-0123", http.StatusNoContent},
+		{"GET", "/api/volume", "reader-secret-0123", http.StatusNoContent},
+		{"GET", "/api/cast?usn=uuid:lr", "reader-secret-0123", http.StatusForbidden},
+		{"GET", "/api/presets/x/play", "reader-secret-0123", http.StatusForbidden},
+		{"HEAD", "/api/resume", "reader-secret-0123", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %s with %q: expected %d, got %d", tt.method, tt.target, tt.token, tt.want, w.Code)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/keys", h.ListKeysHandler)
+	mux.HandleFunc("POST /api/keys", h.CreateKeyHandler)
+	mux.HandleFunc("DELETE /api/keys/{id}", h.RevokeKeyHandler)
+	mux.HandleFunc("GET /api/devices", func(w http.ResponseWriter, r *http.Request) {})
+	api := h.Authenticate(mux)
+	do := func(method, target, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("POST", "/api/keys", "", `{"name": "bad", "scopes": ["root"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown scope, got %d", w.Code)
+	}
+	var admin, reader struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	w := do("POST", "/api/keys", "", `{"name": "admin"}`)
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &admin) != nil || !strings.HasPrefix(admin.Key, keyPrefix) {
+		t.Fatalf("Create failed: %d %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/api/devices", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the API to need a key once one exists, got %d", w.Code)
+	}
+	w = do("POST", "/api/keys", admin.Key, `{"name": "tablet", "scopes": ["read"], "rate": 0.01, "burst": 1}`)
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &reader) != nil {
+		t.Fatalf("Create failed: %d %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/api/keys", reader.Key, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected /api/keys to need the admin scope, got %d", w.Code)
+	}
+	if w := do("GET", "/api/devices", reader.Key, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 within the burst, got %d", w.Code)
+	}
+	if w := do("GET", "/api/devices", reader.Key, ""); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 over the rate, got %d", w.Code)
+	}
+	if w := do("GET", "/api/keys", admin.Key, ""); strings.Contains(w.Body.String(), reader.Key) || strings.Contains(w.Body.String(), "hash") {
+		t.Errorf("Expected no secrets in the list, got %s", w.Body)
+	}
+
+	// Keys survive a restart
+	h2 := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	if tok := h2.keys.find(admin.Key); tok == nil || tok.name != "admin" {
+		t.Errorf("Expected the admin key to be reloaded, got %+v", tok)
+	}
+	if w := do("DELETE", "/api/keys/"+reader.ID, admin.Key, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Revoke failed: %d", w.Code)
+	}
+	if w := do("GET", "/api/devices", reader.Key, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked key to fail, got %d", w.Code)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV"}
+	// control checks "METHOD /path" (default /api/cast) from ip
+	control := func(request, ip string) int {
+		method, target, ok := strings.Cut(request, " ")
+		if !ok {
+			target = "/api/cast"
+		}
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = ip + ":5555"
+		w := httptest.NewRecorder()
+		if !h.checkSession(w, req, tv) {
+			return w.Code
+		}
+		return http.StatusOK
+	}
+
+	first := h.startSession(tv, "http://x/a.mp4", "A")
+	h.setSessionLock(first, "192.0.2.1")
+	if got := control("POST", "192.0.2.2"); got != http.StatusConflict {
+		t.Errorf("Expected another client to get 409, got %d", got)
+	}
+	if got := control("POST", "192.0.2.1"); got != http.StatusOK {
+		t.Errorf("Expected the lock holder to pass, got %d", got)
+	}
+	if got := control("GET", "192.0.2.2"); got != http.StatusConflict {
+		t.Errorf("Expected a GET cast to be held to the lock, got %d", got)
+	}
+	if got := control("GET /api/volume", "192.0.2.2"); got != http.StatusOK {
+		t.Errorf("Expected reads to pass a lock, got %d", got)
+	}
+
+	// The holder's next cast keeps the lock; the first session's timer goes
+	timer := h.setTimer(tv, time.Hour, "stop", 0)
+	h.sessions.m[tv.USN].timer = timer
+	second := h.startSession(tv, "http://x/b.mp4", "B")
+	if second.LockedBy != "192.0.2.1" {
+		t.Errorf("Expected the lock to carry over, got %q", second.LockedBy)
+	}
+	if h.timers.m[tv.USN] != nil {
+		t.Error("Expected the session timer to be cancelled with its session")
+	}
+
+	h.endSession(tv.USN, first.ID)
+	if list := h.listSessions(); len(list) != 1 || list[0].ID != second.ID {
+		t.Fatalf("Expected a stale end to keep the new session, got %+v", list)
+	}
+	h.endSession(tv.USN, second.ID)
+	if len(h.listSessions()) != 0 || control("POST", "192.0.2.2") != http.StatusOK {
+		t.Error("Expected the session and its lock to end")
+	}
+}
+
+func TestQueueCast(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV"}
+	played := make(chan string, 3)
+	cast := func(name string, err error) func(context.Context) error {
+		return func(context.Context) error {
+			played <- name
+			return err
+		}
+	}
+
+	playing := h.startSession(tv, "http://x/a.mp4", "A")
+	first := h.queueCast(tv.USN, h.jobs.create(tv.USN, "http://x/b.mp4", "B"), cast("b", errors.New("renderer refused")))
+	h.queueCast(tv.USN, h.jobs.create(tv.USN, "http://x/c.mp4", "C"), cast("c", nil))
+	if first.State != JobQueued || h.activeSession(tv.USN).Queued != 2 {
+		t.Fatalf("Expected two queued casts, got %+v", h.activeSession(tv.USN))
+	}
+	select {
+	case name := <-played:
+		t.Fatalf("Expected nothing to play before the session ends, %s did", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The first queued cast fails, so the next one plays right after it
+	h.endSession(tv.USN, playing.ID)
+	for _, want := range []string{"b", "c"} {
+		select {
+		case name := <-played:
+			if name != want {
+				t.Errorf("Expected %s to play, got %s", want, name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %s to play", want)
+		}
+	}
+
+	// Stopping drops what is queued
+	playing = h.startSession(tv, "http://x/d.mp4", "D")
+	dropped := h.queueCast(tv.USN, h.jobs.create(tv.USN, "http://x/e.mp4", "E"), cast("e", nil))
+	h.clearQueue(tv.USN)
+	h.endSession(tv.USN, playing.ID)
+	if job := h.jobs.get(dropped.ID); job.State != JobFailed {
+		t.Errorf("Expected the dropped cast to fail, got %+v", job)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/volume", func(w http.ResponseWriter, r *http.Request) {
+		checkDevice(w, r, tv)
+		http.Error(w, "SOAP fault 501", http.StatusBadGateway)
+	})
+	mux.HandleFunc("POST /api/cast", func(w http.ResponseWriter, r *http.Request) {
+		checkDevice(w, r, tv)
+		job := h.jobs.create(tv.USN, "http://x/a.mp4", "")
+		h.runJob(job, func(context.Context) error { return errors.New("renderer refused") })
+		writeJob(w, r, job)
+	})
+	api := h.Audit(mux)
+
+	for _, target := range []string{"/api/volume", "/api/cast"} {
+		req := httptest.NewRequest("POST", target, nil)
+		req.RemoteAddr = "192.0.2.7:5555"
+		api.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/volume", nil))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		h.audit.mu.Lock()
+		entries := append([]AuditEntry{}, h.audit.entries...)
+		h.audit.mu.Unlock()
+		if len(entries) != 2 {
+			t.Fatalf("Expected 2 audit entries, got %+v", entries)
+		}
+		cast, volume := entries[0], entries[1]
+		if volume.Client != "192.0.2.7" || volume.Device != "uuid:lr" || volume.Status != http.StatusBadGateway || volume.Result != "SOAP fault 501" {
+			t.Errorf("Unexpected volume entry %+v", volume)
+		}
+		if cast.Job != "" && cast.Result == "failed: renderer refused" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the failed job in the cast entry, got %+v", cast)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	h.AuditHandler(w, httptest.NewRequest("GET", "/api/audit?device=living+room+tv&limit=1", nil))
+	var list []AuditEntry
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list) != 1 || list[0].Action != "POST /api/cast" {
+		t.Errorf("Unexpected audit query result %+v", list)
+	}
+}
+
+// fakeSOAP answers every action with an empty response, except those in
+// faults, and records what it was sent.
+type fakeSOAP struct {
+	mu     sync.Mutex
+	calls  []string // "controlURL action body"
+	faults map[string]*dlna.SOAPError
+}
+
+func (f *fakeSOAP) Call(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, controlURL+" "+action+" "+string(body))
+	if fault := f.faults[action]; fault != nil {
+		return nil, fault
+	}
+	if action == "GetTransportInfo" {
+		return dlna.ResponseEnvelope(serviceType, action, []dlna.Arg{{Name: "CurrentTransportState", Value: "STOPPED"}}), nil
+	}
+	return dlna.ResponseEnvelope(serviceType, action, nil), nil
+}
+
+func (f *fakeSOAP) actions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var actions []string
+	for _, c := range f.calls {
+		actions = append(actions, strings.Fields(c)[1])
+	}
+	return actions
+}
+
+func TestFakeSOAPClient(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	soap := &fakeSOAP{}
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+
+	var instance uint32
+	if err := h.castURL(context.Background(), tv, dlna.CastRequest{URL: "http://x/a.mp4", Title: "A"}, &instance); err != nil {
+		t.Fatalf("Cast failed: %v", err)
+	}
+	if got := strings.Join(soap.actions(), ","); got != "GetPositionInfo,SetAVTransportURI,Play" {
+		t.Errorf("Unexpected actions %s", got)
+	}
+	if !strings.Contains(soap.calls[1], "http://tv.test/avt SetAVTransportURI") || !strings.Contains(soap.calls[1], "<CurrentURI>http://x/a.mp4</CurrentURI>") {
+		t.Errorf("Unexpected SetAVTransportURI %s", soap.calls[1])
+	}
+
+	soap.mu.Lock()
+	soap.faults = map[string]*dlna.SOAPError{"SetAVTransportURI": {Code: 714, Description: "Illegal MIME-type"}}
+	soap.mu.Unlock()
+	err := h.castURL(context.Background(), tv, dlna.CastRequest{URL: "http://x/b.mkv"}, &instance)
+	var fault *dlna.SOAPError
+	if !errors.As(err, &fault) || fault.Code != 714 {
+		t.Errorf("Expected the renderer's fault, got %v", err)
+	}
+}
+
+func TestCastSubtitles(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	soap := &fakeSOAP{}
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+	req := dlna.CastRequest{URL: "http://x/a.mkv", Title: "A", Subtitles: "http://x/a.srt"}
+	sentCaption := func() bool {
+		soap.mu.Lock()
+		defer soap.mu.Unlock()
+		for _, c := range soap.calls {
+			if strings.Contains(c, "SetAVTransportURI") {
+				return strings.Contains(c, "CaptionInfoEx")
+			}
+		}
+		t.Fatal("No SetAVTransportURI sent")
+		return false
+	}
+
+	var instance uint32
+	if err := h.castURL(context.Background(), tv, req, &instance); err != nil {
+		t.Fatalf("Cast failed: %v", err)
+	}
+	if sentCaption() {
+		t.Error("Expected no subtitles for a renderer not set to show them")
+	}
+
+	h.settings.mu.Lock()
+	h.settings.m[tv.USN] = DeviceSettings{Subtitles: true}
+	h.settings.mu.Unlock()
+	soap.mu.Lock()
+	soap.calls = nil
+	soap.mu.Unlock()
+	if err := h.castURL(context.Background(), tv, req, &instance); err != nil {
+		t.Fatalf("Cast failed: %v", err)
+	}
+	if !sentCaption() {
+		t.Error("Expected the subtitles in the metadata")
+	}
+}
+
+func TestProbeCast(t *testing.T) {
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", "12345")
+	}))
+	defer src.Close()
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	soap := &fakeSOAP{}
+	h.SetSOAPClient(soap)
+	h.prober = func(ctx context.Context, path string) (*library.Metadata, error) {
+		return &library.Metadata{Duration: 90 * time.Minute, Format: "matroska,webm", VideoCodec: "h264"}, nil
+	}
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+	h.settings.mu.Lock()
+	h.settings.m[tv.USN] = DeviceSettings{Probe: true}
+	h.settings.mu.Unlock()
+
+	var instance uint32
+	if err := h.castURL(context.Background(), tv, dlna.CastRequest{URL: src.URL + "/film", Title: "Film"}, &instance); err != nil {
+		t.Fatalf("Cast failed: %v", err)
+	}
+	var set string
+	for _, c := range soap.calls {
+		if strings.Contains(c, "SetAVTransportURI") {
+			set = c
+		}
+	}
+	for _, want := range []string{"1:30:00", "12345", "video/x-matroska"} {
+		if !strings.Contains(set, want) {
+			t.Errorf("Expected %s in the metadata, got %s", want, set)
+		}
+	}
+	if d := metadataDuration(h.history.last(tv.USN).Metadata); d != 90*time.Minute {
+		t.Errorf("Expected the duration in the history, got %v", d)
+	}
+
+	p := Progress{known: 90 * time.Minute}
+	p.update(&dlna.PositionInfo{RelTime: "0:45:00", TrackDuration: "0:00:00"}, "PLAYING", time.Now())
+	if p.Duration != "1:30:00" || p.Percent != 50 {
+		t.Errorf("Expected the known duration, got %+v", p)
+	}
+}
+
+func TestTVChannels(t *testing.T) {
+	var tuner *httptest.Server
+	tuner = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/discover.json":
+			fmt.Fprintf(w, `{"FriendlyName": "HDHomeRun", "DeviceID": "1050A1B2", "BaseURL": %q}`, tuner.URL)
+		case "/lineup.json":
+			fmt.Fprintf(w, `[{"GuideNumber": "9.1", "GuideName": "KQED", "URL": "%[1]s/auto/v9.1", "Favorite": 1}, {"GuideNumber": "5.1", "GuideName": "KPIX", "URL": "%[1]s/auto/v5.1", "HD": 1}, {"GuideNumber": "7.1", "GuideName": "Pay", "URL": "%[1]s/auto/v7.1", "DRM": 1}]`, tuner.URL)
+		}
+	}))
+	defer tuner.Close()
+
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	h.SetTuners([]string{tuner.URL})
+
+	w := httptest.NewRecorder()
+	h.ListTVChannelsHandler(w, httptest.NewRequest("GET", "/api/tv/channels", nil))
+	var channels []TVChannel
+	json.NewDecoder(w.Body).Decode(&channels)
+	if len(channels) != 3 || channels[0].Number != "5.1" || !channels[0].HD || channels[0].URL != tuner.URL+"/auto/v5.1" {
+		t.Fatalf("Unexpected channels %d %+v", w.Code, channels)
+	}
+	w = httptest.NewRecorder()
+	h.ListTVChannelsHandler(w, httptest.NewRequest("GET", "/api/tv/channels?favorites=true", nil))
+	if channels = nil; json.NewDecoder(w.Body).Decode(&channels) != nil || len(channels) != 1 || channels[0].Name != "KQED" {
+		t.Errorf("Expected only the favorite, got %+v", channels)
+	}
+
+	for body, want := range map[string]int{
+		`{"channel": "kqed", "usn": "uuid:none"}`: http.StatusNotFound, // No such device
+		`{"channel": "4.1"}`:                      http.StatusNotFound,
+		`{"channel": "7.1"}`:                      http.StatusBadRequest,
+		`{"channel": "5.1", "transcode": "x"}`:    http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		h.CastTVHandler(w, httptest.NewRequest("POST", "/api/tv/cast", strings.NewReader(body)))
+		if w.Code != want {
+			t.Errorf("%s: expected %d, got %d %s", body, want, w.Code, w.Body)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "film.mp4"), []byte("old"), 0o644)
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="film.mp4"`)
+		w.Write(bytes.Repeat([]byte("x"), 100000))
+	}))
+	defer src.Close()
+
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	h.SetMediaRoots(map[string]string{"films": dir})
+
+	body := []byte(`{"url": "` + src.URL + `/get?id=1", "root": "films", "folder": "../new"}`)
+	w := httptest.NewRecorder()
+	h.StartDownloadHandler(w, httptest.NewRequest("POST", "/api/download", bytes.NewBuffer(body)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+	var d Download
+	json.NewDecoder(w.Body).Decode(&d)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d.State != DownloadDone && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		d, _ = h.downloads.get(d.ID)
+	}
+	if d.State != DownloadDone || d.Path != "new/film.mp4" || d.Received != 100000 || d.Percent != 100 {
+		t.Fatalf("Unexpected download %+v", d)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "new", "film.mp4")); err != nil || len(data) != 100000 {
+		t.Errorf("Expected the downloaded file, got %d bytes, %v", len(data), err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "new")); len(entries) != 1 {
+		t.Errorf("Expected no leftover .part file, got %v", entries)
+	}
+	if got := uniqueFile(dir, "film.mp4"); got != filepath.Join(dir, "film (1).mp4") {
+		t.Errorf("Expected a numbered name next to an existing file, got %s", got)
+	}
+
+	body = []byte(`{"url": "` + src.URL + `/a.mp4", "root": "nope"}`)
+	w = httptest.NewRecorder()
+	h.StartDownloadHandler(w, httptest.NewRequest("POST", "/api/download", bytes.NewBuffer(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown root, got %d", w.Code)
+	}
+}
+
+// playingSOAP is a renderer paused at 0:10:00 into a film, which plays
+// whatever is loaded next once and then stops.
+type playingSOAP struct {
+	fakeSOAP
+	state string
+	uri   string
+	plays int // Polls a clip reports PLAYING for, default 1
+	polls int
+}
+
+func (p *playingSOAP) Call(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	p.fakeSOAP.Call(ctx, controlURL, serviceType, action, body)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var args []dlna.Arg
+	switch action {
+	case "GetMediaInfo":
+		args = []dlna.Arg{{Name: "CurrentURI", Value: p.uri}}
+	case "GetPositionInfo":
+		args = []dlna.Arg{{Name: "RelTime", Value: "0:10:00"}}
+	case "GetTransportInfo":
+		args = []dlna.Arg{{Name: "CurrentTransportState", Value: p.state}}
+		if p.state == "PLAYING" {
+			if p.polls++; p.polls >= max(p.plays, 1) {
+				p.state, p.polls = "STOPPED", 0
+			}
+		}
+	case "SetAVTransportURI":
+		b := string(body)
+		p.uri = b[strings.Index(b, "<CurrentURI>")+12 : strings.Index(b, "</CurrentURI>")]
+	case "Play":
+		p.state = "PLAYING"
+	case "Pause":
+		p.state = "PAUSED_PLAYBACK"
+	case "Stop":
+		p.state = "STOPPED"
+	}
+	return dlna.ResponseEnvelope(serviceType, action, args), nil
+}
+
+type speech string
+
+func (s speech) Speak(ctx context.Context, text, lang string) ([]byte, string, error) {
+	return []byte(string(s) + text + "/" + lang), "audio/mpeg", nil
+}
+
+func TestAnnounce(t *testing.T) {
+	defer func(poll, margin time.Duration) { interruptPoll, interruptMargin = poll, margin }(interruptPoll, interruptMargin)
+	interruptPoll, interruptMargin = 10*time.Millisecond, 10*time.Millisecond
+
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	w := httptest.NewRecorder()
+	h.AnnounceHandler(w, httptest.NewRequest("POST", "/api/announce", strings.NewReader(`{"text": "Dinner"}`)))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 without TTS, got %d", w.Code)
+	}
+	h.SetTTS(speech("ID3"), "en")
+	w = httptest.NewRecorder()
+	h.AnnounceHandler(w, httptest.NewRequest("POST", "/api/announce", strings.NewReader(`{"text": "", "volume": 101}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "volume") {
+		t.Errorf("Expected 400 for the text and volume, got %d %s", w.Code, w.Body)
+	}
+
+	id := h.announcements.add(&announcement{audio: []byte("ID3 speech"), mimeType: "audio/mpeg"})
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/announce/"+id, nil)
+	req.SetPathValue("id", id)
+	h.AnnouncementHandler(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "ID3 speech" || w.Header().Get("Content-Type") != "audio/mpeg" {
+		t.Errorf("Unexpected announcement %d %s %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+
+	soap := &playingSOAP{state: "PAUSED_PLAYBACK", uri: "http://x/film.mkv"}
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+	meta := dlna.Metadata{Title: "Dinner", MimeType: "audio/mpeg"}
+	if err := h.playOver(context.Background(), tv, "http://agent/announce/"+id, meta, 0, 0); err != nil {
+		t.Fatalf("Announcement failed: %v", err)
+	}
+	var uris []string
+	for _, c := range soap.calls {
+		if strings.Contains(c, "SetAVTransportURI") {
+			uris = append(uris, c[strings.Index(c, "<CurrentURI>")+12:strings.Index(c, "</CurrentURI>")])
+		}
+	}
+	if len(uris) != 2 || uris[0] != "http://agent/announce/"+id || uris[1] != "http://x/film.mkv" {
+		t.Errorf("Expected the announcement, then the film, got %v", uris)
+	}
+	actions := soap.actions()
+	if got := strings.Join(actions[len(actions)-2:], ","); got != "Seek,Pause" || soap.state != "PAUSED_PLAYBACK" {
+		t.Errorf("Expected the film paused at its position again, got %v", actions)
+	}
+	if h.checkpoints.interrupted[tv.USN] {
+		t.Error("Expected the cast to be polled again")
+	}
+}
+
+func TestChimes(t *testing.T) {
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	w := httptest.NewRecorder()
+	h.ListChimesHandler(w, httptest.NewRequest("GET", "/api/chimes", nil))
+	var list []Chime
+	json.NewDecoder(w.Body).Decode(&list)
+	i := slices.IndexFunc(list, func(c Chime) bool { return c.Name == defaultChime })
+	if len(list) < 4 || i < 0 || list[i].Duration == "0s" {
+		t.Errorf("Unexpected chimes %+v", list)
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/chimes/doorbell.wav", nil)
+	req.SetPathValue("name", "doorbell.wav")
+	h.ChimeFileHandler(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "audio/wav" || !bytes.HasPrefix(w.Body.Bytes(), []byte("RIFF")) {
+		t.Errorf("Unexpected chime file %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	for _, q := range []string{"sound=../chimes/doorbell", "sound=foghorn", "volume=200"} {
+		w = httptest.NewRecorder()
+		h.ChimeHandler(w, httptest.NewRequest("POST", "/api/chime?"+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", q, w.Code)
+		}
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	defer func(poll, margin time.Duration) { interruptPoll, interruptMargin = poll, margin }(interruptPoll, interruptMargin)
+	interruptPoll, interruptMargin = 10*time.Millisecond, 10*time.Millisecond
+
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	w := httptest.NewRecorder()
+	h.InterruptHandler(w, httptest.NewRequest("POST", "/api/interrupt", strings.NewReader(`{"url": "ftp://x/bell.mp3", "duration": "soon"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "duration") || !strings.Contains(w.Body.String(), "url") {
+		t.Errorf("Expected 400 for the URL and duration, got %d %s", w.Code, w.Body)
+	}
+
+	soap := &playingSOAP{state: "PLAYING", uri: "http://x/film.mkv", plays: 20}
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+
+	// A second clip arriving during the first waits for it and does not
+	// take it for the media to resume
+	errs := make(chan error, 2)
+	go func() {
+		errs <- h.playOver(context.Background(), tv, "http://x/bell.wav", dlna.Metadata{Title: "Bell"}, 0, 0)
+	}()
+	for h.interrupts.pending(tv.USN) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		errs <- h.playOver(context.Background(), tv, "http://x/knock.wav", dlna.Metadata{Title: "Knock"}, 0, 0)
+	}()
+	for h.interrupts.pending(tv.USN) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if list := h.interrupts.list(); len(list) != 1 || list[0].URI != "http://x/film.mkv" || list[0].Pending != 2 {
+		t.Errorf("Unexpected interruptions %+v", list)
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatalf("Interruption failed: %v", err)
+		}
+	}
+	var uris []string
+	for _, c := range soap.calls {
+		if strings.Contains(c, "SetAVTransportURI") {
+			uris = append(uris, c[strings.Index(c, "<CurrentURI>")+12:strings.Index(c, "</CurrentURI>")])
+		}
+	}
+	if strings.Join(uris, " ") != "http://x/bell.wav http://x/knock.wav http://x/film.mkv" {
+		t.Errorf("Expected both clips, then the film once, got %v", uris)
+	}
+	if h.interrupts.pending(tv.USN) != 0 || h.checkpoints.interrupted[tv.USN] {
+		t.Error("Expected the interruption to be over")
+	}
+}
+
+func TestDevicePatterns(t *testing.T) {
+	devices := []*dlna.Device{
+		{USN: "uuid:kitchen", FriendlyName: "Küche", Manufacturer: "Sonos", ModelName: "One"},
+		{USN: "uuid:bravia", FriendlyName: "Wohnzimmer", Manufacturer: "Sony", ModelName: "KD-55X85J"},
+		{USN: "uuid:lg", FriendlyName: "Schlafzimmer TV", Manufacturer: "LG Electronics", ModelName: "OLED55C1"},
+	}
+	tests := []struct{ patterns, want string }{
+		{"kuche", "uuid:kitchen"},                // Accents ignored
+		{"sony", "uuid:bravia"},                  // Manufacturer
+		{"glob:*zimmer", "uuid:bravia"},          // Whole name
+		{"glob:kd-55x8?j", "uuid:bravia"},        // Model
+		{`regex:^OLED\d+`, "uuid:lg"},            // Model
+		{"regex:^uuid:(lg|bravia)$", "uuid:lg"},  // First by name
+		{"Panasonic;glob:s*tv;sonos", "uuid:lg"}, // First pattern with a match
+		{"Panasonic", ""},
+	}
+	for _, tt := range tests {
+		patterns, err := ParseDevicePatterns(tt.patterns)
+		if err != nil {
+			t.Fatalf("ParseDevicePatterns(%q): %v", tt.patterns, err)
+		}
+		var got string
+		if d := matchDevice(patterns, devices); d != nil {
+			got = d.USN
+		}
+		if got != tt.want {
+			t.Errorf("%s picked %q, want %q", tt.patterns, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"regex:(", "a;;b"} {
+		if _, err := ParseDevicePatterns(bad); err == nil {
+			t.Errorf("Expected %q to be invalid", bad)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	st, _ := store.Open("")
+	discovery := dlna.NewDiscoveryService("", time.Second)
+	h := NewHandler(discovery, "tv", st)
+	avt := map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}
+	renderer := "urn:schemas-upnp-org:device:MediaRenderer:1"
+	// Restored devices are offline; those with a MAC can be woken
+	discovery.Restore(dlna.Snapshot{Devices: []dlna.Device{
+		{USN: "uuid:lr", FriendlyName: "Living Room TV", DeviceType: renderer, Services: avt},
+		{USN: "uuid:kitchen", FriendlyName: "Kitchen", DeviceType: renderer, Services: avt},
+		{USN: "uuid:bed", FriendlyName: "Bedroom TV", DeviceType: renderer, Services: avt, MAC: "aa:bb:cc:dd:ee:ff"},
+	}})
+	h.defaultID = "uuid:lr"
+
+	if d, err := h.resolveDevice(""); err != nil || d.USN != "uuid:lr" {
+		t.Errorf("Expected the default device without failover, got %v %v", d, err)
+	}
+
+	// Without a list, the default patterns pick an available device
+	h.SetFailover(config.Failover{Enabled: true})
+	if d, err := h.resolveDevice(""); err != nil || d.USN != "uuid:bed" {
+		t.Errorf("Expected the bedroom TV by pattern, got %v %v", d, err)
+	}
+
+	// The list is tried in order, skipping unavailable devices
+	h.SetFailover(config.Failover{Enabled: true, Devices: []string{"kitchen", "uuid:gone", "bedroom tv"}})
+	if d, err := h.resolveDevice(""); err != nil || d.USN != "uuid:bed" {
+		t.Errorf("Expected the bedroom TV from the list, got %v %v", d, err)
+	}
+
+	// A missing default fails over too, an explicit device never
+	h.defaultID = "uuid:gone"
+	if d, err := h.resolveDevice(""); err != nil || d.USN != "uuid:bed" {
+		t.Errorf("Expected the bedroom TV for a missing default, got %v %v", d, err)
+	}
+	if _, err := h.resolveDevice("uuid:gone"); err != errDeviceNotFound {
+		t.Errorf("Expected an explicit device not to fail over, got %v", err)
+	}
+}
+
+// statesSOAP answers GetTransportInfo with the state of each control URL.
+type statesSOAP map[string]string
+
+func (s statesSOAP) Call(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	state, ok := s[controlURL]
+	if !ok {
+		return nil, errors.New("unreachable")
+	}
+	return dlna.ResponseEnvelope(serviceType, action, []dlna.Arg{{Name: "CurrentTransportState", Value: state}}), nil
+}
+
+func TestIdleDevice(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	st, _ := store.Open("")
+	discovery := dlna.NewDiscoveryService("", time.Second)
+	h := NewHandler(discovery, "", st)
+	renderer := "urn:schemas-upnp-org:device:MediaRenderer:1"
+	var devices []dlna.Device
+	for _, name := range []string{"Kitchen", "Bathroom", "Office", "Living Room TV"} {
+		devices = append(devices, dlna.Device{
+			USN: "uuid:" + name, FriendlyName: name, DeviceType: renderer, Location: srv.URL,
+			Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://" + name + "/avt"}},
+		})
+	}
+	// Restored devices come online once they answer the health check
+	discovery.Restore(dlna.Snapshot{Devices: devices})
+	for online := false; !online; {
+		online = true
+		for _, d := range discovery.Snapshot().Devices {
+			online = online && d.Online
+		}
+		time.Sleep(time.Millisecond)
+	}
+	h.SetSOAPClient(statesSOAP{"http://Kitchen/avt": "PLAYING", "http://Bathroom/avt": "NO_MEDIA_PRESENT", "http://Office/avt": "STOPPED"})
+
+	groups, err := ParseGroups(map[string][]string{"speakers": {"kitchen", "glob:[bo]*"}, "tv": {"Living Room"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetGroups(groups)
+
+	// Kitchen plays, then by name
+	if d, err := h.resolveDevice("idle:speakers"); err != nil || d.USN != "uuid:Bathroom" {
+		t.Errorf("Expected the bathroom, got %v %v", d, err)
+	}
+	h.interrupts.begin("uuid:Bathroom")
+	if d, err := h.resolveDevice("idle:speakers"); err != nil || d.USN != "uuid:Office" {
+		t.Errorf("Expected the office while the bathroom plays a clip, got %v %v", d, err)
+	}
+	if _, err := h.resolveDevice("idle:tv"); !errors.Is(err, errNoIdleDevice) {
+		t.Errorf("Expected no idle TV, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	h.CastHandler(w, httptest.NewRequest("POST", "/api/cast", strings.NewReader(`{"url": "http://x/a.mp3", "usn": "idle:tv"}`)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 without an idle device, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.CastHandler(w, httptest.NewRequest("POST", "/api/cast", strings.NewReader(`{"url": "http://x/a.mp3", "usn": "idle:garden"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown group, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.ListGroupsHandler(w, httptest.NewRequest("GET", "/api/groups", nil))
+	var list map[string][]GroupMember
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list["speakers"]) != 3 || list["speakers"][0].State != "PLAYING" || list["speakers"][1].State != "INTERRUPTED" || !list["speakers"][2].Idle {
+		t.Errorf("Unexpected groups %+v", list)
+	}
+
+	for _, bad := range []map[string][]string{{"living room": {"tv"}}, {"empty": nil}, {"bad": {"regex:("}}} {
+		if _, err := ParseGroups(bad); err == nil {
+			t.Errorf("Expected %v to be invalid", bad)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+	progressInterval = 5 * time.Millisecond
+
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	soap := &playingSOAP{state: "PLAYING", uri: "http://x/film.mkv", plays: 2}
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+	h.settings.m[tv.USN] = DeviceSettings{Reconcile: true, SeekMode: seekNone}
+	events := h.events.subscribe()
+	defer h.events.unsubscribe(events)
+
+	// The renderer keeps dropping the film, which is played again three
+	// times before the session fails
+	h.recordCast(tv, "http://x/film.mkv", "Film", "", "")
+	retries := 0
+	var failed SessionFailed
+	var finished CastFinished
+	for timeout := time.After(5 * time.Second); finished.Reason == ""; {
+		select {
+		case ev := <-events:
+			switch ev.Type {
+			case "reconcile":
+				retries++
+			case EventSessionFailed:
+				failed = ev.Data.(SessionFailed)
+			case EventCastFinished:
+				finished = ev.Data.(CastFinished)
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for the session to fail")
+		}
+	}
+	plays := 0
+	soap.mu.Lock()
+	for _, c := range soap.calls {
+		if strings.Contains(c, " Play ") {
+			plays++
+		}
+	}
+	soap.mu.Unlock()
+	if retries != 3 || plays != 3 || failed.Retries != 3 || failed.Device != tv.USN || finished.Reason != finishDropped {
+		t.Errorf("Expected 3 retries, then a failed session, got %d retries, %d plays, %+v, %+v", retries, plays, failed, finished)
+	}
+	if h.activeSession(tv.USN) != nil {
+		t.Error("Expected the session to be over")
+	}
+
+	// Stops by the agent are not retried
+	soap.mu.Lock()
+	soap.state, soap.plays = "PLAYING", 1000
+	soap.mu.Unlock()
+	h.recordCast(tv, "http://x/film.mkv", "Film", "", "")
+	h.expectStop(tv.USN)
+	h.avTransport(tv).Stop()
+	soap.mu.Lock()
+	soap.state = "STOPPED"
+	soap.mu.Unlock()
+	for timeout, done := time.After(5*time.Second), false; !done; {
+		select {
+		case ev := <-events:
+			switch ev.Type {
+			case "reconcile":
+				t.Fatal("Expected no retry of a stop by the agent")
+			case EventCastFinished:
+				if reason := ev.Data.(CastFinished).Reason; reason != finishStopped {
+					t.Errorf("Expected the cast to finish as stopped, got %s", reason)
+				}
+				done = true
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for the cast to finish")
+		}
+	}
+}
+
+// stallingSOAP plays, advancing the position twice, then stands still.
+type stallingSOAP struct {
+	playingSOAP
+	positions int
+}
+
+func (s *stallingSOAP) Call(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	if action != "GetPositionInfo" {
+		return s.playingSOAP.Call(ctx, controlURL, serviceType, action, body)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.positions++
+	pos := fmt.Sprintf("0:00:%02d", min(s.positions, 3))
+	return dlna.ResponseEnvelope(serviceType, action, []dlna.Arg{{Name: "RelTime", Value: pos}}), nil
+}
+
+func TestStall(t *testing.T) {
+	var s stallDetector
+	start := time.Now()
+	polls := []struct {
+		state, position string
+		after           time.Duration
+		stalled         bool
+	}{
+		{"PLAYING", "0:00:00", 0, false},         // No position yet
+		{"PLAYING", "0:00:05", 0, false},         // First position
+		{"PLAYING", "0:00:05", time.Hour, false}, // Never advanced
+		{"PLAYING", "0:00:06", time.Hour, false}, // Advanced
+		{"PLAYING", "0:00:06", time.Hour + stallTimeout, true},
+		{"PLAYING", "0:00:06", 2 * time.Hour, false}, // Reported once
+		{"PAUSED_PLAYBACK", "0:00:06", 3 * time.Hour, false},
+		{"PLAYING", "0:00:06", 3 * time.Hour, false}, // Watched again from here
+		{"PLAYING", "0:00:06", 3*time.Hour + stallTimeout, true},
+	}
+	for i, p := range polls {
+		if got := s.update(p.state, p.position, start.Add(p.after)); got != p.stalled {
+			t.Errorf("Poll %d: stalled %v, want %v", i, got, p.stalled)
+		}
+	}
+
+	defer func(poll, stall time.Duration) { progressInterval, stallTimeout = poll, stall }(progressInterval, stallTimeout)
+	progressInterval, stallTimeout = 5*time.Millisecond, 20*time.Millisecond
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	soap := &stallingSOAP{playingSOAP: playingSOAP{state: "PLAYING", uri: "http://x/film.mkv", plays: 1000}}
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+	h.settings.m[tv.USN] = DeviceSettings{RestartStalled: true, SeekMode: seekNone}
+	events := h.events.subscribe()
+	defer h.events.unsubscribe(events)
+
+	h.recordCast(tv, "http://x/film.mkv", "Film", "", "")
+	defer h.expectStop(tv.USN)
+	var stalled CastStalled
+	for timeout := time.After(5 * time.Second); stalled.Restart == 0; {
+		select {
+		case ev := <-events:
+			if ev.Type == EventCastStalled {
+				stalled = ev.Data.(CastStalled)
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for the stall")
+		}
+	}
+	if stalled.Position != "0:00:03" || stalled.Restart != 1 {
+		t.Errorf("Unexpected stall %+v", stalled)
+	}
+	eventually(t, "the restart", func() bool {
+		soap.mu.Lock()
+		defer soap.mu.Unlock()
+		return strings.Count(strings.Join(soap.calls, "\n"), " SetAVTransportURI ") >= 1
+	})
+}
+
+func TestProfiles(t *testing.T) {
+	profiles, err := ParseProfiles(map[string]config.Profile{
+		"tv-4k":  {},
+		"old-tv": {Transcode: true, MaxHeight: 1080, VideoBitrate: "8M", AudioCodec: "ac3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(profiles["old-tv"].transcodeArgs(transcodeSource{url: "http://x/film.mkv"}, stream.HWNone, ""), " ")
+	for _, want := range []string{"-i http://x/film.mkv", "-c:v libx264 -preset veryfast", "-vf scale=-2:'min(1080,ih)',format=yuv420p", "-b:v 8M", "-c:a ac3", "-f mpegts pipe:1"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in %s", want, args)
+		}
+	}
+	args = strings.Join(profiles["old-tv"].transcodeArgs(transcodeSource{url: "http://x/film.mkv"}, stream.HWVAAPI, ""), " ")
+	for _, want := range []string{"-hwaccel vaapi -hwaccel_device /dev/dri/renderD128 -vaapi_device /dev/dri/renderD128 -i http://x/film.mkv", "-c:v h264_vaapi -vf scale=-2:'min(1080,ih)',format=nv12,hwupload"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in %s", want, args)
+		}
+	}
+	if strings.Contains(args, "-preset") {
+		t.Errorf("Unexpected software preset in %s", args)
+	}
+	for _, bad := range []map[string]config.Profile{
+		{"none": {}},
+		{"old tv": {}},
+		{"a": {VideoCodec: "vp9"}},
+		{"a": {VideoCodec: "copy", MaxHeight: 720}},
+		{"a": {AudioBitrate: "loud"}},
+	} {
+		if _, err := ParseProfiles(bad); err == nil {
+			t.Errorf("Expected %v to be invalid", bad)
+		}
+	}
+
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	h.SetFFmpeg("echo")
+	h.SetBaseURL("http://agent.test", "")
+	h.SetProfiles(profiles)
+	soap := &fakeSOAP{}
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+	castURI := func(profile string) string {
+		t.Helper()
+		var instance uint32
+		if err := h.loadURL(context.Background(), tv, dlna.CastRequest{URL: "http://x/film.mkv"}, &instance, true, castOptions{profile: profile}); err != nil {
+			t.Fatalf("Cast with profile %q failed: %v", profile, err)
+		}
+		soap.mu.Lock()
+		defer soap.mu.Unlock()
+		c := soap.calls[len(soap.calls)-2]
+		return c[strings.Index(c, "<CurrentURI>")+12 : strings.Index(c, "</CurrentURI>")]
+	}
+
+	// The device's profile applies unless the cast picks another
+	h.settings.m[tv.USN] = DeviceSettings{Profile: "old-tv"}
+	if uri := castURI(""); !strings.HasPrefix(uri, "http://agent.test/stream/transcode-") {
+		t.Errorf("Expected the transcode, got %s", uri)
+	}
+	for _, profile := range []string{"tv-4k", "none"} {
+		if uri := castURI(profile); uri != "http://x/film.mkv" {
+			t.Errorf("Expected the film as is with %s, got %s", profile, uri)
+		}
+	}
+	if err := h.loadURL(context.Background(), tv, dlna.CastRequest{URL: "http://x/film.mkv"}, nil, true, castOptions{profile: "vhs"}); err == nil {
+		t.Error("Expected an unknown profile to fail")
+	}
+
+	// Burning subtitles in transcodes even without a transcoding profile
+	var instance uint32
+	if err := h.loadURL(context.Background(), tv, dlna.CastRequest{URL: "http://x/film.mkv", Subtitles: "http://x/film, en.srt"}, &instance, true, castOptions{profile: "tv-4k", burnSubtitles: true}); err != nil {
+		t.Fatal(err)
+	}
+	soap.mu.Lock()
+	last := soap.calls[len(soap.calls)-2]
+	soap.mu.Unlock()
+	if !strings.Contains(last, "http://agent.test/stream/transcode-") || strings.Contains(last, ".srt") {
+		t.Errorf("Expected the transcode without sidecar subtitles, got %s", last)
+	}
+	args = strings.Join(profiles["tv-4k"].transcodeArgs(transcodeSource{url: "http://x/film.mkv", subtitles: "http://x/film, en.srt"}, stream.HWNone, ""), " ")
+	if want := `-vf subtitles=http\\://x/film\, en.srt,format=yuv420p`; !strings.Contains(args, want) {
+		t.Errorf("Expected %q in %s", want, args)
+	}
+
+	w := httptest.NewRecorder()
+	h.CastHandler(w, httptest.NewRequest("POST", "/api/cast", strings.NewReader(`{"url": "http://x/a.mp4", "profile": "vhs"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "profile") {
+		t.Errorf("Expected 400 for an unknown profile, got %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	h.CastHandler(w, httptest.NewRequest("POST", "/api/cast", strings.NewReader(`{"url": "http://x/a.mp4", "burn_subtitles": true}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "burn_subtitles") {
+		t.Errorf("Expected 400 for burning no subtitles, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestTracks(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "film.mkv"), []byte("mkv"), 0o644)
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	h.mediaRoots = map[string]library.Root{"films": library.DirRoot(dir)}
+	probe := func(ctx context.Context, path string) (*library.Metadata, error) {
+		return &library.Metadata{Tags: map[string]string{}, CoverIndex: -1, VideoCodec: "h264", Tracks: []library.Track{
+			{Index: 1, Type: "audio", Codec: "eac3", Language: "eng", Default: true},
+			{Index: 2, Type: "audio", Codec: "aac", Language: "fre"},
+			{Index: 3, Type: "subtitle", Codec: "hdmv_pgs_subtitle", Bitmap: true},
+			{Index: 4, Type: "subtitle", Codec: "subrip", Language: "fre"},
+		}}, nil
+	}
+	h.prober = probe
+	h.library.SetProber(probe)
+	h.library.Scan(context.Background(), h.mediaRoots)
+	id := library.ItemID("films", "film.mkv")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/library/"+id+"/tracks", nil)
+	r.SetPathValue("id", id)
+	h.LibraryTracksHandler(w, r)
+	var tracks struct{ Audio, Subtitles []library.Track }
+	json.NewDecoder(w.Body).Decode(&tracks)
+	if w.Code != http.StatusOK || len(tracks.Audio) != 2 || len(tracks.Subtitles) != 2 || tracks.Audio[1].Language != "fre" {
+		t.Fatalf("Unexpected tracks %d %+v", w.Code, tracks)
+	}
+
+	all := append(tracks.Audio, tracks.Subtitles...)
+	two, four := 2, 4
+	opts, err := trackOptions(all, &two, &four)
+	if err != nil || *opts.audioTrack != 2 || *opts.subtitleTrack != 1 {
+		t.Errorf("Unexpected options %+v, %v", opts, err)
+	}
+	for _, bad := range [][2]*int{{&four, nil}, {nil, &two}, {nil, new(int)}} {
+		if _, err := trackOptions(all, bad[0], bad[1]); err == nil {
+			t.Errorf("Expected audio %v and subtitles %v to be rejected", bad[0], bad[1])
+		}
+	}
+	three := 3
+	if _, err := trackOptions(all, nil, &three); err == nil || !strings.Contains(err.Error(), "images") {
+		t.Errorf("Expected bitmap subtitles to be rejected, got %v", err)
+	}
+
+	args := strings.Join(Profile{}.transcodeArgs(transcodeSource{url: "http://x/film.mkv", audio: opts.audioTrack, subtitle: opts.subtitleTrack}, stream.HWNone, ""), " ")
+	if want := `-map 0:v:0? -map 0:2 -c:v libx264 -preset veryfast -vf subtitles=http\\://x/film.mkv:si=1,format=yuv420p`; !strings.Contains(args, want) {
+		t.Errorf("Expected %q in %s", want, args)
+	}
+
+	// Picking the audio of media cast as is remuxes it, on the CPU
+	h.SetFFmpeg("echo")
+	h.prober = probe
+	h.SetBaseURL("http://agent.test", "")
+	soap := &fakeSOAP{}
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+	var instance uint32
+	if err := h.loadURL(context.Background(), tv, dlna.CastRequest{URL: "http://x/film.mkv"}, &instance, true, castOptions{audioTrack: &two}); err != nil {
+		t.Fatal(err)
+	}
+	soap.mu.Lock()
+	last := soap.calls[len(soap.calls)-2]
+	soap.mu.Unlock()
+	if !strings.Contains(last, "http://agent.test/stream/transcode-") {
+		t.Errorf("Expected the remux, got %s", last)
+	}
+	args = strings.Join(Profile{Profile: config.Profile{Transcode: true, VideoCodec: "copy", AudioCodec: "copy"}}.transcodeArgs(transcodeSource{url: "http://x/film.mkv", audio: &two}, stream.HWVAAPI, ""), " ")
+	if want := "-i http://x/film.mkv -map 0:v:0? -map 0:2 -c:v copy -c:a copy"; !strings.HasPrefix(args, want) {
+		t.Errorf("Expected %q, got %s", want, args)
+	}
+
+	w = httptest.NewRecorder()
+	h.CastLibraryHandler(w, httptest.NewRequest("POST", "/api/library/cast", strings.NewReader(`{"id": "`+id+`", "usn": "uuid:lr", "audio_track": 4}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "audio_track") {
+		t.Errorf("Expected 400 for a subtitle stream as audio, got %d %s", w.Code, w.Body)
+	}
+}
+
+// hangingSOAP is a renderer that accepts actions but never answers them.
+type hangingSOAP struct{ release chan struct{} }
+
+func (s hangingSOAP) Call(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	<-s.release
+	return nil, errors.New("released")
+}
+
+func TestJobTimeout(t *testing.T) {
+	defer func(d time.Duration) { jobTimeout = d }(jobTimeout)
+	jobTimeout = 50 * time.Millisecond
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	soap := hangingSOAP{make(chan struct{})}
+	defer close(soap.release)
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+
+	var instance uint32
+	job := h.jobs.create(tv.USN, "http://x/a.mp4", "")
+	h.runJob(job, func(ctx context.Context) error {
+		return h.castURL(ctx, tv, dlna.CastRequest{URL: "http://x/a.mp4"}, &instance)
+	})
+	eventually(t, "the job to fail", func() bool { return h.jobs.get(job.ID).State == JobFailed })
+	if j := h.jobs.get(job.ID); !strings.Contains(j.Error, "timed out") {
+		t.Errorf("Expected a timeout, got %+v", j)
+	}
+
+	// A cast that gets unstuck after its job failed does not load anything
+	h2 := newTestHandler()
+	blocking := &blockingSOAP{release: make(chan struct{})}
+	h2.SetSOAPClient(blocking)
+	job = h2.jobs.create(tv.USN, "http://x/b.mp4", "")
+	done := make(chan error, 1)
+	h2.runJob(job, func(ctx context.Context) error {
+		err := h2.castURL(ctx, tv, dlna.CastRequest{URL: "http://x/b.mp4"}, &instance)
+		done <- err
+		return err
+	})
+	eventually(t, "the job to fail", func() bool { return h2.jobs.get(job.ID).State == JobFailed })
+	close(blocking.release)
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the cast to give up, got %v", err)
+	}
+	if actions := blocking.actions(); slices.Contains(actions, "SetAVTransportURI") || slices.Contains(actions, "Play") {
+		t.Errorf("Expected nothing to be loaded after the timeout, got %v", actions)
+	}
+	if e := h2.history.last(tv.USN); e != nil {
+		t.Errorf("Expected no history entry, got %+v", e)
+	}
+}
+
+// blockingSOAP is a renderer whose calls, whatever their context, hang
+// until release is closed.
+type blockingSOAP struct {
+	fakeSOAP
+	release chan struct{}
+}
+
+func (b *blockingSOAP) Call(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	<-b.release
+	return b.fakeSOAP.Call(ctx, controlURL, serviceType, action, body)
+}
+
+// positionSOAP is a renderer playing uri at pos.
+type positionSOAP struct {
+	mu       sync.Mutex
+	uri, pos string
+}
+
+func (p *positionSOAP) set(uri, pos string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.uri, p.pos = uri, pos
+}
+
+func (p *positionSOAP) Call(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var args []dlna.Arg
+	switch action {
+	case "GetPositionInfo":
+		args = []dlna.Arg{{Name: "TrackURI", Value: p.uri}, {Name: "RelTime", Value: p.pos}}
+	case "GetTransportInfo":
+		args = []dlna.Arg{{Name: "CurrentTransportState", Value: "PLAYING"}}
+	}
+	return dlna.ResponseEnvelope(serviceType, action, args), nil
+}
+
+func TestCheckpoints(t *testing.T) {
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+	progressInterval = 10 * time.Millisecond
+	h := newTestHandler()
+	soap := &positionSOAP{uri: "http://x/film.mp4", pos: "0:42:00"}
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+	position := func() string { return h.history.last(tv.USN).Position }
+
+	h.history.add(HistoryEntry{ID: "1", URL: "http://x/film.mp4", Device: tv.USN})
+	h.startCheckpoints(tv, "http://x/film.mp4", "Film", "", "")
+	eventually(t, "the first checkpoint", func() bool { return position() == "0:42:00" })
+	// Later polls are only saved every checkpointInterval
+	soap.set("http://x/film.mp4", "0:43:00")
+	time.Sleep(5 * progressInterval)
+	if p := position(); p != "0:42:00" {
+		t.Errorf("Expected the position to be saved once per interval, got %s", p)
+	}
+	// Another URI ends the loop without touching the entry
+	soap.set("http://x/other.mp4", "0:01:00")
+	eventually(t, "the loop to end", func() bool {
+		h.checkpoints.mu.Lock()
+		defer h.checkpoints.mu.Unlock()
+		_, ok := h.checkpoints.stops[tv.USN]
+		return !ok
+	})
+	if p := position(); p != "0:42:00" {
+		t.Errorf("Expected another URI not to be recorded, got %s", p)
+	}
+
+	// checkpoint takes renderers that report no TrackURI to be playing the
+	// latest entry
+	h.checkpoint(tv)
+	if p := position(); p != "0:42:00" {
+		t.Errorf("Expected another TrackURI not to be recorded, got %s", p)
+	}
+	soap.set("", "1:05:00")
+	h.checkpoint(tv)
+	if p := position(); p != "1:05:00" {
+		t.Errorf("Expected an empty TrackURI to match the latest entry, got %s", p)
+	}
+}
+
+// browsingSOAP is a MediaServer that answers every Browse with didl, and a
+// renderer that accepts everything.
+type browsingSOAP struct {
+	fakeSOAP
+	didl string
+}
+
+func (b *browsingSOAP) Call(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	if action == "Browse" {
+		return dlna.ResponseEnvelope(serviceType, action, []dlna.Arg{{Name: "Result", Value: b.didl}, {Name: "NumberReturned", Value: "1"}, {Name: "TotalMatches", Value: "1"}}), nil
+	}
+	return b.fakeSOAP.Call(ctx, controlURL, serviceType, action, body)
+}
+
+func TestCastFromServer(t *testing.T) {
+	h := onlineHandler(t, livingRoomTV(), dlna.Device{USN: "uuid:nas", FriendlyName: "NAS", DeviceType: dlna.DeviceTypeMediaServer,
+		Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:ContentDirectory:1": {ControlURL: "http://nas.test/cd"}}})
+	didl := `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">` +
+		`<item id="64$1" parentID="64" restricted="1"><dc:title>Film &amp; Co</dc:title><upnp:class>object.item.videoItem</upnp:class>` +
+		`<res protocolInfo="http-get:*:video/mp4:DLNA.ORG_PN=AVC_MP4_HP_HD_AAC" duration="1:30:00.000">http://nas.test:8200/MediaItems/1.mp4</res></item></DIDL-Lite>`
+	soap := &browsingSOAP{didl: didl}
+	h.SetSOAPClient(soap)
+	cast := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.CastFromServerHandler(w, httptest.NewRequest("POST", "/api/servers/cast", strings.NewReader(body)))
+		return w
+	}
+
+	w := cast(`{"server": "uuid:nas", "object_id": "64$1", "usn": "uuid:lr"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d %s", w.Code, w.Body)
+	}
+	var job Job
+	json.NewDecoder(w.Body).Decode(&job)
+	eventually(t, "the cast", func() bool { return h.jobs.get(job.ID).State == JobDone })
+
+	sent := soap.lastLoaded(t)
+	if sent.URI != "http://nas.test:8200/MediaItems/1.mp4" {
+		t.Errorf("Expected the res URL to be cast, got %q", sent.URI)
+	}
+	if sent.Metadata != didl {
+		t.Errorf("Expected the server's DIDL-Lite as is, got %q", sent.Metadata)
+	}
+	if e := h.history.last("uuid:lr"); e == nil || e.Title != "Film & Co" || e.Metadata != didl {
+		t.Errorf("Unexpected history entry %+v", e)
+	}
+
+	if w := cast(`{"server": "uuid:gone", "object_id": "64$1"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown server, got %d", w.Code)
+	}
+	if w := cast(`{"object_id": "64$1"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a server, got %d", w.Code)
+	}
+	soap.didl = `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"><container id="64" parentID="0"/></DIDL-Lite>`
+	if w := cast(`{"server": "uuid:nas", "object_id": "64"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an item without resources, got %d", w.Code)
+	}
+}
+
+func TestSleepTimer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+	}))
+	defer srv.Close()
+	h := onlineHandler(t, livingRoomTV())
+	soap := &fakeSOAP{}
+	h.SetSOAPClient(soap)
+	setTimer := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.SetTimerHandler(w, httptest.NewRequest("POST", "/api/timer", strings.NewReader(body)))
+		return w
+	}
+	timers := func() []SleepTimer {
+		w := httptest.NewRecorder()
+		h.ListTimersHandler(w, httptest.NewRequest("GET", "/api/timer", nil))
+		var list []SleepTimer
+		json.NewDecoder(w.Body).Decode(&list)
+		return list
+	}
+	sent := func(action string) bool { return slices.Contains(soap.actions(), action) }
+
+	for _, body := range []string{`{"usn": "uuid:lr"}`, `{"usn": "uuid:lr", "after": "-1m"}`, `{"usn": "uuid:lr", "after": "1m", "action": "rewind"}`, `{"usn": "uuid:lr", "after": "1m", "fade": "2m"}`} {
+		if w := setTimer(body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+
+	w := setTimer(`{"usn": "uuid:lr", "after": "50ms", "action": "pause"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", w.Code, w.Body)
+	}
+	if list := timers(); len(list) != 1 || list[0].Device != "uuid:lr" || list[0].Action != "pause" {
+		t.Errorf("Expected the pause timer to be listed, got %+v", list)
+	}
+	eventually(t, "the timer to pause", func() bool { return sent("Pause") })
+	if sent("Stop") || len(timers()) != 0 {
+		t.Errorf("Expected only a pause and the timer gone, got %v %+v", soap.actions(), timers())
+	}
+
+	soap.mu.Lock()
+	soap.calls = nil
+	soap.mu.Unlock()
+	setTimer(`{"usn": "uuid:lr", "after": "50ms"}`)
+	eventually(t, "the timer to stop", func() bool { return sent("Stop") })
+
+	// Cancelled timers do not fire
+	soap.mu.Lock()
+	soap.calls = nil
+	soap.mu.Unlock()
+	setTimer(`{"usn": "uuid:lr", "after": "50ms"}`)
+	w = httptest.NewRecorder()
+	h.CancelTimerHandler(w, httptest.NewRequest("DELETE", "/api/timer?usn=uuid:lr", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 cancelling the timer, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.CancelTimerHandler(w, httptest.NewRequest("DELETE", "/api/timer?usn=uuid:lr", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without a timer, got %d", w.Code)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if sent("Stop") {
+		t.Error("Expected a cancelled timer not to stop")
+	}
+
+	// stop_after sets a timer once the cast plays
+	cast := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.CastHandler(w, httptest.NewRequest("POST", "/api/cast", strings.NewReader(body)))
+		return w
+	}
+	if w := cast(`{"usn": "uuid:lr", "url": "` + srv.URL + `/a.mp4", "stop_after": "soon"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid stop_after, got %d", w.Code)
+	}
+	if w := cast(`{"usn": "uuid:lr", "url": "` + srv.URL + `/a.mp4", "stop_after": "100ms"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d %s", w.Code, w.Body)
+	}
+	eventually(t, "the stop_after timer to stop", func() bool {
+		actions := soap.actions()
+		play := slices.Index(actions, "Play")
+		return play >= 0 && slices.Contains(actions[play:], "Stop")
+	})
+}
+
+// preparingSOAP is a renderer that allocates AVTransport instance 3 on
+// PrepareForConnection, unless faults says otherwise.
+type preparingSOAP struct {
+	fakeSOAP
+}
+
+func (p *preparingSOAP) Call(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	out, err := p.fakeSOAP.Call(ctx, controlURL, serviceType, action, body)
+	if err == nil && action == "PrepareForConnection" {
+		return dlna.ResponseEnvelope(serviceType, action, []dlna.Arg{{Name: "ConnectionID", Value: "7"}, {Name: "AVTransportID", Value: "3"}, {Name: "RcsID", Value: "3"}}), nil
+	}
+	return out, err
+}
+
+func TestPrepareInstance(t *testing.T) {
+	h := newTestHandler()
+	soap := &preparingSOAP{}
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{
+		"urn:schemas-upnp-org:service:AVTransport:1":       {ControlURL: "http://tv.test/avt"},
+		"urn:schemas-upnp-org:service:ConnectionManager:1": {ControlURL: "http://tv.test/cm"},
+	}, Online: true}
+	// instances returns the InstanceID of each AVTransport call to the
+	// renderer, and clears the calls.
+	instances := func() []string {
+		soap.mu.Lock()
+		defer soap.mu.Unlock()
+		var ids []string
+		for _, c := range soap.calls {
+			if strings.HasPrefix(c, "http://tv.test/avt ") {
+				_, id, _ := strings.Cut(c, "<InstanceID>")
+				id, _, _ = strings.Cut(id, "</InstanceID>")
+				ids = append(ids, strings.Fields(c)[1]+"="+id)
+			}
+		}
+		soap.calls = nil
+		return ids
+	}
+	cast := func(instance *uint32) {
+		t.Helper()
+		if err := h.castURL(context.Background(), tv, dlna.CastRequest{URL: "http://x/a.mp4", Title: "A"}, instance); err != nil {
+			t.Fatalf("Cast failed: %v", err)
+		}
+	}
+
+	cast(nil)
+	if got := strings.Join(instances(), ","); got != "GetPositionInfo=0,SetAVTransportURI=3,Play=3" {
+		t.Errorf("Expected the prepared instance to be cast to, got %s", got)
+	}
+	// An explicit instance_id skips PrepareForConnection
+	five := uint32(5)
+	cast(&five)
+	if got := strings.Join(instances(), ","); got != "GetPositionInfo=0,SetAVTransportURI=5,Play=5" {
+		t.Errorf("Expected instance 5, got %s", got)
+	}
+	if slices.Contains(soap.actions(), "PrepareForConnection") {
+		t.Error("Expected no PrepareForConnection with an instance_id")
+	}
+
+	// Renderers without the action get instance 0
+	soap.mu.Lock()
+	soap.faults = map[string]*dlna.SOAPError{"PrepareForConnection": {Code: 401, Description: "Invalid Action"}}
+	soap.mu.Unlock()
+	cast(nil)
+	if got := strings.Join(instances(), ","); got != "GetPositionInfo=0,SetAVTransportURI=0,Play=0" {
+		t.Errorf("Expected the fallback to instance 0, got %s", got)
+	}
+
+	// The instance_id of /api/cast reaches the renderer
+	tv.DeviceType, tv.Online = dlna.DeviceTypeMediaRenderer, false
+	h = onlineHandler(t, *tv)
+	h.SetSOAPClient(soap)
+	w := httptest.NewRecorder()
+	h.CastHandler(w, httptest.NewRequest("POST", "/api/cast", strings.NewReader(`{"usn": "uuid:lr", "url": "http://x/a.mp4", "instance_id": 2}`)))
+	var job Job
+	json.NewDecoder(w.Body).Decode(&job)
+	eventually(t, "the cast", func() bool { return h.jobs.get(job.ID).State == JobDone })
+	if got := strings.Join(instances(), ","); !strings.Contains(got, "SetAVTransportURI=2,Play=2") {
+		t.Errorf("Expected instance_id 2 to be cast to, got %s", got)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	h := onlineHandler(t, livingRoomTV())
+	soap := &fakeSOAP{}
+	h.SetSOAPClient(soap)
+	save := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.SavePresetHandler(w, httptest.NewRequest("POST", "/api/presets", strings.NewReader(body)))
+		return w
+	}
+	list := func(h *Handler) []Preset {
+		w := httptest.NewRecorder()
+		h.ListPresetsHandler(w, httptest.NewRequest("GET", "/api/presets", nil))
+		var list []Preset
+		json.NewDecoder(w.Body).Decode(&list)
+		return list
+	}
+	withName := func(r *http.Request, name string) *http.Request {
+		r.SetPathValue("name", name)
+		return r
+	}
+
+	for _, body := range []string{`{"url": "http://radio.test/jazz.mp3"}`, `{"name": "Jazz"}`, `{"name": " ", "url": "http://radio.test/jazz.mp3"}`, `{"name": "Jazz", "url": "file:///etc/passwd"}`} {
+		if w := save(body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, w.Code)
+		}
+	}
+	if w := save(`{"name": " Jazz ", "url": "http://radio.test/jazz.mp3"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", w.Code, w.Body)
+	}
+	save(`{"name": "Concert", "url": "http://radio.test/concert.mp4", "video": true}`)
+	// The same name in any case updates the preset
+	save(`{"name": "jazz", "url": "http://radio.test/jazz.aac", "title": "Jazz FM"}`)
+	want := []Preset{{Name: "Concert", URL: "http://radio.test/concert.mp4", Video: true}, {Name: "jazz", URL: "http://radio.test/jazz.aac", Title: "Jazz FM"}}
+	if got := list(h); !slices.Equal(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if got := list(NewHandler(h.discovery, "", h.store)); !slices.Equal(got, want) {
+		t.Errorf("Expected the presets to be stored, got %+v", got)
+	}
+
+	play := func(name, device string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.PlayPresetHandler(w, withName(httptest.NewRequest("POST", "/api/presets/"+name+"/play?device="+url.QueryEscape(device), nil), name))
+		return w
+	}
+	if w := play("Rock", "Living Room TV"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown preset, got %d", w.Code)
+	}
+	w := play("JAZZ", "Living Room TV")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d %s", w.Code, w.Body)
+	}
+	var job Job
+	json.NewDecoder(w.Body).Decode(&job)
+	eventually(t, "the preset to play", func() bool { return h.jobs.get(job.ID).State == JobDone })
+	sent := soap.lastLoaded(t)
+	if sent.URI != "http://radio.test/jazz.aac" || !strings.Contains(sent.Metadata, "<dc:title>Jazz FM</dc:title>") || !strings.Contains(sent.Metadata, "object.item.audioItem.audioBroadcast") {
+		t.Errorf("Expected the preset as a titled broadcast, got %+v", sent)
+	}
+
+	w = httptest.NewRecorder()
+	h.DeletePresetHandler(w, withName(httptest.NewRequest("DELETE", "/api/presets/Jazz", nil), "Jazz"))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 deleting, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.DeletePresetHandler(w, withName(httptest.NewRequest("DELETE", "/api/presets/Jazz", nil), "Jazz"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting again, got %d", w.Code)
+	}
+	if got := list(h); len(got) != 1 || got[0].Name != "Concert" {
+		t.Errorf("Expected only Concert left, got %+v", got)
+	}
+}
+
+func TestAudioCast(t *testing.T) {
+	speaker := livingRoomTV()
+	speaker.FriendlyName = "Kitchen Speaker"
+	h := onlineHandler(t, speaker)
+	soap := &fakeSOAP{}
+	h.SetSOAPClient(soap)
+	h.SetBaseURL("http://agent.test:8072", "")
+	// A fake ffmpeg that records its arguments and captures until killed
+	dir := t.TempDir()
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte("#!/bin/sh\necho \"$@\" > \"$0.args\"\nexec sleep 10\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	h.SetFFmpeg(ffmpeg)
+	start := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.StartAudioHandler(w, httptest.NewRequest("POST", "/api/audio", strings.NewReader(body)))
+		return w
+	}
+	stop := func() int {
+		w := httptest.NewRecorder()
+		h.StopAudioHandler(w, httptest.NewRequest("DELETE", "/api/audio", nil))
+		return w.Code
+	}
+
+	for _, body := range []string{`{"usn": "uuid:lr", "codec": "ogg"}`, `{"usn": "uuid:lr", "latency": -1}`, `{"usn": "uuid:lr", "bitrate": "` + strings.Repeat("9", 300) + `"}`, `{"usn": "uuid:gone"}`} {
+		if w := start(body); w.Code/100 != 4 {
+			t.Errorf("Expected a client error for %s, got %d", body, w.Code)
+		}
+	}
+	if stop() != http.StatusNotFound {
+		t.Error("Expected 404 stopping without an audio cast")
+	}
+
+	w := start(`{"usn": "uuid:lr", "codec": "aac", "bitrate": "256k", "latency": 50}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d %s", w.Code, w.Body)
+	}
+	var job Job
+	json.NewDecoder(w.Body).Decode(&job)
+	eventually(t, "the audio cast", func() bool { return h.jobs.get(job.ID).State == JobDone })
+	var args []byte
+	eventually(t, "ffmpeg to start", func() bool {
+		args, _ = os.ReadFile(ffmpeg + ".args")
+		return len(args) > 0
+	})
+	if got := string(args); !strings.Contains(got, "-flush_packets 1 -ac 2 -ar 44100 -b:a 256k -c:a aac -f adts pipe:1") {
+		t.Errorf("Unexpected ffmpeg arguments %s", got)
+	}
+	sent := soap.lastLoaded(t)
+	if sent.URI != "http://agent.test:8072/stream/audio.aac" || !strings.Contains(sent.Metadata, "audio/aac") {
+		t.Errorf("Expected the AAC stream to be cast, got %+v", sent)
+	}
+
+	if code := stop(); code != http.StatusOK {
+		t.Errorf("Expected 200 stopping, got %d", code)
+	}
+	if actions := soap.actions(); actions[len(actions)-1] != "Stop" {
+		t.Errorf("Expected the speaker to be stopped, got %v", actions)
+	}
+	if stop() != http.StatusNotFound {
+		t.Error("Expected 404 stopping twice")
+	}
+}
+
+func TestReloadMediaRoots(t *testing.T) {
+	dav := httptest.NewServer(http.NotFoundHandler())
+	defer dav.Close()
+	st, _ := store.Open("")
+	h := NewHandler(dlna.NewDiscoveryService("", time.Second), "", st)
+	roots := map[string]string{"films": t.TempDir(), "nas": "dav://" + dav.Listener.Addr().String() + "/media"}
+	nas := func() *share.Share {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		return h.shares["nas"].share
+	}
+	// serving reports whether the loopback server of sh still answers
+	serving := func(sh *share.Share) bool {
+		resp, err := http.Get(sh.Input("a.mp4"))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}
+
+	h.SetMediaRoots(roots)
+	first := nas()
+	if first == nil || !serving(first) {
+		t.Fatalf("Expected the share to be open, got %v", first)
+	}
+	// A reload with the same roots keeps the share and its streams
+	h.SetMediaRoots(maps.Clone(roots))
+	if nas() != first || !serving(first) {
+		t.Error("Expected an unchanged share to stay open")
+	}
+	// Another root leaves it alone too
+	roots["music"] = t.TempDir()
+	h.SetMediaRoots(roots)
+	if nas() != first || !serving(first) {
+		t.Error("Expected adding a root to keep the share open")
+	}
+	// New credentials reopen it
+	h.SetShareOptions(map[string]share.Options{"127.0.0.1": {User: "kodi", Password: "secret"}})
+	h.SetMediaRoots(roots)
+	second := nas()
+	if second == first || serving(first) || !serving(second) {
+		t.Error("Expected the share to be reopened with the new options")
+	}
+	delete(roots, "nas")
+	h.SetMediaRoots(roots)
+	if nas() != nil || serving(second) {
+		t.Error("Expected the removed share to be closed")
+	}
+}
+
+func TestQuirkLoads(t *testing.T) {
+	h := onlineHandler(t, livingRoomTV())
+	tv := h.discovery.GetDevice("uuid:lr")
+	soap := &playingSOAP{}
+	h.SetSOAPClient(soap)
+	h.settings.m[tv.USN] = DeviceSettings{SeekMode: seekNone, Quirks: dlna.Quirks{dlna.QuirkNoMetadata: true, dlna.QuirkStopBeforeSet: true}}
+	h.history.add(HistoryEntry{ID: "1", URL: "http://x/film.mp4", Title: "Film", Device: tv.USN, Position: "0:10:00"})
+
+	// Every way of loading media stops the paused film first and leaves
+	// out the metadata
+	loads := map[string]func() error{
+		"resume": func() error {
+			w := httptest.NewRecorder()
+			h.ResumeHandler(w, httptest.NewRequest("POST", "/api/resume", strings.NewReader(`{"usn": "uuid:lr"}`)))
+			var job Job
+			json.NewDecoder(w.Body).Decode(&job)
+			eventually(t, "the resume", func() bool { s := h.jobs.get(job.ID).State; return s == JobDone || s == JobFailed })
+			if job := h.jobs.get(job.ID); job.State != JobDone {
+				return errors.New(job.Error)
+			}
+			return nil
+		},
+		"replay": func() error {
+			return h.replay(context.Background(), tv, HistoryEntry{URL: "http://x/film.mp4", Title: "Film", Device: tv.USN})
+		},
+		"image": func() error { return h.castImage(context.Background(), tv, "http://x/photo.jpg", "photo.jpg", "") },
+	}
+	for name, load := range loads {
+		soap.mu.Lock()
+		soap.state, soap.calls = "PAUSED_PLAYBACK", nil
+		soap.mu.Unlock()
+		if err := load(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		actions := soap.actions()
+		set := slices.Index(actions, "SetAVTransportURI")
+		if set < 0 || !slices.Contains(actions[:set], "Stop") {
+			t.Errorf("%s: expected Stop before SetAVTransportURI, got %v", name, actions)
+		}
+		for _, l := range soap.loaded(t) {
+			if l.Metadata != "" {
+				t.Errorf("%s: expected no metadata, got %s", name, l.Metadata)
+			}
+		}
+	}
+
+	// dlna_flags goes into the metadata built for the renderer
+	h.settings.m[tv.USN] = DeviceSettings{Quirks: dlna.Quirks{dlna.QuirkDLNAFlags: true}}
+	soap.mu.Lock()
+	soap.calls = nil
+	soap.mu.Unlock()
+	if err := h.castImage(context.Background(), tv, "http://x/photo.jpg", "photo.jpg", ""); err != nil {
+		t.Fatal(err)
+	}
+	if sent := soap.lastLoaded(t); !strings.Contains(sent.Metadata, "DLNA.ORG_FLAGS") {
+		t.Errorf("Expected DLNA flags in the metadata, got %s", sent.Metadata)
+	}
+}
+
+func TestConfigHandlers(t *testing.T) {
+	h := newTestHandler()
+	discovery := h.discovery
+	tokens, err := ParseTokens([]config.Token{{Name: "admin", Token: "admin-secret-0123"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetTokens(tokens)
+	patch := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.PatchConfigHandler(w, httptest.NewRequest("PATCH", "/api/config", strings.NewReader(body)))
+		return w
+	}
+	get := func() (runtimeConfig, string) {
+		w := httptest.NewRecorder()
+		h.GetConfigHandler(w, httptest.NewRequest("GET", "/api/config", nil))
+		var cfg runtimeConfig
+		json.Unmarshal(w.Body.Bytes(), &cfg)
+		return cfg, w.Body.String()
+	}
+
+	cfg, body := get()
+	if cfg.Discovery.CleanupInterval != "1m0s" || cfg.Discovery.SearchMX != 1 {
+		t.Errorf("Expected the default tuning, got %+v", cfg.Discovery)
+	}
+	// Only the runtime settings are served: no token or other secret
+	if strings.Contains(body, "admin-secret-0123") || strings.Contains(body, "token") {
+		t.Errorf("Expected no secrets in the config, got %s", body)
+	}
+
+	// A patch changes the fields it has and keeps the others
+	if w := patch(`{"discovery": {"search_mx": 3, "device_expiry": "10m"}}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", w.Code, w.Body)
+	}
+	tuning := discovery.Tuning()
+	if tuning.SearchMX != 3 || tuning.DeviceExpiry != 10*time.Minute || tuning.CleanupInterval != time.Minute {
+		t.Errorf("Unexpected tuning after the patch %+v", tuning)
+	}
+	if cfg, _ := get(); cfg.Discovery.SearchMX != 3 || cfg.Discovery.DeviceExpiry != "10m0s" {
+		t.Errorf("Expected the patched config, got %+v", cfg.Discovery)
+	}
+
+	// An invalid field fails the whole patch
+	for _, body := range []string{
+		`{"discovery": {"search_mx": 9, "hop_limit": 4}}`,
+		`{"discovery": {"cleanup_interval": "soon", "hop_limit": 4}}`,
+		`{"discovery": {"hop_limit": "four"}}`,
+	} {
+		if w := patch(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+	if discovery.Tuning() != tuning {
+		t.Errorf("Expected rejected patches to change nothing, got %+v", discovery.Tuning())
+	}
+}
+
+func TestResume(t *testing.T) {
+	h := onlineHandler(t, livingRoomTV())
+	soap := &fakeSOAP{}
+	h.SetSOAPClient(soap)
+	history := func() []HistoryEntry {
+		w := httptest.NewRecorder()
+		h.HistoryHandler(w, httptest.NewRequest("GET", "/api/history", nil))
+		var list []HistoryEntry
+		json.NewDecoder(w.Body).Decode(&list)
+		return list
+	}
+	resume := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ResumeHandler(w, httptest.NewRequest("POST", "/api/resume", strings.NewReader(body)))
+		return w
+	}
+
+	if w := resume(`{}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 with no history, got %d", w.Code)
+	}
+
+	// The history keeps the latest historyLimit casts, newest first
+	for i := range historyLimit + 5 {
+		h.history.add(HistoryEntry{ID: fmt.Sprint(i), URL: fmt.Sprintf("http://x/%d.mp4", i), Device: "uuid:lr"})
+	}
+	h.history.add(HistoryEntry{ID: "film", URL: "http://x/film.mp4", Title: "Film", Device: "uuid:lr", Position: "0:42:00"})
+	list := history()
+	if len(list) != historyLimit || list[0].ID != "film" || list[1].ID != fmt.Sprint(historyLimit+4) || list[len(list)-1].ID != "6" {
+		t.Fatalf("Unexpected history of %d entries, from %s to %s", len(list), list[0].ID, list[len(list)-1].ID)
+	}
+
+	if w := resume(`{"usn": "uuid:bed"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a device without history, got %d", w.Code)
+	}
+
+	// Resuming casts the latest entry again and seeks to its position
+	w := resume(`{"usn": "uuid:lr"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d %s", w.Code, w.Body)
+	}
+	var job Job
+	json.NewDecoder(w.Body).Decode(&job)
+	eventually(t, "the resume", func() bool { s := h.jobs.get(job.ID).State; return s == JobDone || s == JobFailed })
+	if j := h.jobs.get(job.ID); j.State != JobDone {
+		t.Fatalf("Expected the resume to succeed, got %+v", j)
+	}
+	if sent := soap.lastLoaded(t); sent.URI != "http://x/film.mp4" {
+		t.Errorf("Expected the film to be cast, got %+v", sent)
+	}
+	var seek struct {
+		Target string `xml:"Target"`
+	}
+	soap.mu.Lock()
+	for _, c := range soap.calls {
+		if _, body, ok := strings.Cut(c, " Seek "); ok {
+			xml.Unmarshal([]byte(body), &seek)
+		}
+	}
+	soap.mu.Unlock()
+	if seek.Target != "0:42:00" {
+		t.Errorf("Expected a seek to 0:42:00, got %q", seek.Target)
+	}
+	if e := history()[0]; e.ID == "film" || e.URL != "http://x/film.mp4" || e.Position != "0:42:00" {
+		t.Errorf("Expected the resume to be recorded with its position, got %+v", e)
+	}
+}
+
+func TestIdleOff(t *testing.T) {
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+	progressInterval = 10 * time.Millisecond
+	h := newTestHandler()
+	soap := &playingSOAP{state: "PLAYING", uri: "http://x/film.mp4", plays: 2}
+	h.SetSOAPClient(soap)
+	tv := &dlna.Device{USN: "uuid:lr", FriendlyName: "Living Room TV", Services: map[string]dlna.Service{"urn:schemas-upnp-org:service:AVTransport:1": {ControlURL: "http://tv.test/avt"}}, Online: true}
+	armed := func() bool {
+		h.idle.mu.Lock()
+		defer h.idle.mu.Unlock()
+		return h.idle.m[tv.USN] != nil
+	}
+	count := func(action string) int {
+		n := 0
+		for _, a := range soap.actions() {
+			if a == action {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Without idle_off nothing is armed
+	h.startIdleOff(tv)
+	if armed() {
+		t.Fatal("Expected no idle timer without idle_off")
+	}
+
+	// Once the cast has stopped, the renderer is stopped again after
+	// idle_off (and switched off, had it a TV adapter)
+	h.settings.m[tv.USN] = DeviceSettings{IdleOff: "50ms"}
+	h.startCheckpoints(tv, "http://x/film.mp4", "Film", "", "")
+	eventually(t, "the idle timer", armed)
+	if count("Stop") != 0 {
+		t.Fatal("Expected no Stop before idle_off")
+	}
+	eventually(t, "the idle stop", func() bool { return count("Stop") == 1 })
+	if armed() {
+		t.Error("Expected the timer to be done")
+	}
+
+	// A new cast cancels the timer
+	h.startIdleOff(tv)
+	h.cancelIdleOff(tv.USN)
+	time.Sleep(150 * time.Millisecond)
+	if n := count("Stop"); n != 1 {
+		t.Errorf("Expected a cancelled timer not to stop the renderer, got %d stops", n)
+	}
+
+	// A renderer playing again when the timer fires is left alone
+	soap.mu.Lock()
+	soap.state, soap.plays = "PLAYING", 1000
+	soap.mu.Unlock()
+	polls := count("GetTransportInfo")
+	h.startIdleOff(tv)
+	eventually(t, "the idle check", func() bool { return count("GetTransportInfo") > polls })
+	time.Sleep(50 * time.Millisecond)
+	if n := count("Stop"); n != 1 {
+		t.Errorf("Expected a playing renderer not to be stopped, got %d stops", n)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	h := newTestHandler()
+	server := httptest.NewServer(http.HandlerFunc(h.EventsHandler))
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without an upgrade, got %v", err)
+	}
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: agent\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != websocket.Accept(key) {
+		t.Fatalf("Unexpected handshake: %v, %+v", err, resp)
+	}
+
+	// Client frames other than close are ignored
+	eventually(t, "the subscription", func() bool {
+		h.events.mu.Lock()
+		defer h.events.mu.Unlock()
+		return len(h.events.subs) == 1
+	})
+	if err := websocket.WriteFrame(conn, websocket.OpPing, []byte("ping"), true); err != nil {
+		t.Fatal(err)
+	}
+	h.events.publish("progress", map[string]string{"device": "uuid:lr"})
+	fin, opcode, payload, err := websocket.ReadFrame(r, 1<<20)
+	var ev Event
+	if err != nil || !fin || opcode != websocket.OpText || json.Unmarshal(payload, &ev) != nil || ev.Type != "progress" {
+		t.Fatalf("Unexpected frame %d %q: %v", opcode, payload, err)
+	}
+
+	// A close frame ends the subscription
+	websocket.WriteFrame(conn, websocket.OpClose, nil, true)
+	eventually(t, "the unsubscription", func() bool {
+		h.events.mu.Lock()
+		defer h.events.mu.Unlock()
+		return len(h.events.subs) == 0
+	})
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"dlna/store"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	historyKey   = "history"
+	historyLimit = 100
+)
+
+// HistoryEntry records a past cast.
+type HistoryEntry struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Title      string    `json:"title,omitempty"`
+	Metadata   string    `json:"metadata,omitempty"` // Raw DIDL-Lite, for casts from a MediaServer
+	Device     string    `json:"device"`             // USN
+	DeviceName string    `json:"device_name"`
+	CastAt     time.Time `json:"cast_at"`
+	Position   string    `json:"position,omitempty"` // Last known RelTime (H:MM:SS)
+}
+
+// history keeps the most recent casts, newest first.
+type history struct {
+	mu      sync.Mutex
+	store   store.Store
+	entries []HistoryEntry
+}
+
+func newHistory(st store.Store) *history {
+	h := &history{store: st}
+	if _, err := st.Get(historyKey, &h.entries); err != nil {
+		log.Printf("Failed to load history: %v", err)
+	}
+	return h
+}
+
+func (h *history) add(e HistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append([]HistoryEntry{e}, h.entries...)
+	if len(h.entries) > historyLimit {
+		h.entries = h.entries[:historyLimit]
+	}
+	h.saveLocked()
+}
+
+// updatePosition sets the position of the latest entry for device if it is
+// still playing url. An empty url matches the latest entry: checkpoint
+// passes the renderer's TrackURI, which some renderers leave empty.
+func (h *history) updatePosition(device, url, position string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range h.entries {
+		if h.entries[i].Device != device {
+			continue
+		}
+		if (url == "" || h.entries[i].URL == url) && h.entries[i].Position != position {
+			h.entries[i].Position = position
+			h.saveLocked()
+		}
+		return
+	}
+}
+
+// last returns the latest entry for device, or the latest overall if device
+// is empty.
+func (h *history) last(device string) *HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, e := range h.entries {
+		if device == "" || e.Device == device {
+			return &e
+		}
+	}
+	return nil
+}
+
+func (h *history) list() []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]HistoryEntry{}, h.entries...)
+}
+
+func (h *history) saveLocked() {
+	if err := h.store.Set(historyKey, h.entries); err != nil {
+		log.Printf("Failed to save history: %v", err)
+	}
+}
+
+// checkpoint records the renderer's current position into the history
+// entry it is playing, if any.
+func (h *Handler) checkpoint(device *dlna.Device) {
+	info, err := h.avTransport(device).GetPositionInfo()
+	if err != nil || !validPosition(info.RelTime) {
+		return
+	}
+	h.history.updatePosition(device.USN, info.TrackURI, info.RelTime)
+}
+
+// validPosition reports whether a RelTime is worth seeking to.
+func validPosition(position string) bool {
+	switch position {
+	case "", "0:00:00", "00:00:00", "NOT_IMPLEMENTED":
+		return false
+	}
+	return true
+}
+
+func (h *Handler) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.history.list())
+}
+
+// ResumeHandler re-casts the last history entry (for usn, if given) and
+// seeks to where it stopped.
+func (h *Handler) ResumeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		USN string `json:"usn"` // Optional
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry := h.history.last(req.USN)
+	if entry == nil {
+		http.Error(w, "Nothing to resume", http.StatusNotFound)
+		return
+	}
+
+	device := h.selectDevice(w, r, entry.Device)
+	if device == nil {
+		return
+	}
+	seekMode := h.settings.get(device.USN).SeekMode
+	actions := []string{"SetAVTransportURI", "Play", "Seek"}
+	if seekMode == seekNone {
+		actions = actions[:2]
+	}
+	if !requireActions(w, device, actions...) {
+		return
+	}
+
+	job := h.jobs.create(device.USN, entry.URL, entry.Title)
+	h.runJob(job, func(ctx context.Context) error {
+		if err := h.wake(device); err != nil {
+			return err
+		}
+
+		// The renderer may still be paused on the item; take its position
+		// over the stored one.
+		h.checkpoint(device)
+		if e := h.history.last(device.USN); e != nil && e.URL == entry.URL {
+			entry = e
+		}
+
+		metaData := entry.Metadata
+		if metaData == "" {
+			var err error
+			if metaData, err = h.metadataFor(device, dlna.Metadata{Title: entry.Title}).DIDL(entry.URL); err != nil {
+				return err
+			}
+		}
+		avt := h.avTransport(device)
+		if err := h.load(ctx, device, avt, entry.URL, metaData); err != nil {
+			return fmt.Errorf("failed to cast: %w", err)
+		}
+		h.recordCast(device, entry.URL, entry.Title, entry.Metadata, entry.Position)
+
+		if validPosition(entry.Position) && seekMode != seekNone {
+			if err := seekWhenReady(avt, seekMode, entry.Position); err != nil {
+				return err
+			}
+		}
+		log.Printf("Resumed %s on %s at %s", entry.URL, device.FriendlyName, entry.Position)
+		return nil
+	})
+
+	writeJob(w, r, job)
+}
+
+// recordCast adds a successful cast to the history, opens its session and
+// starts recording its position while it plays.
+func (h *Handler) recordCast(device *dlna.Device, url, title, metadata, position string) {
+	entry := HistoryEntry{
+		ID:         newID(),
+		URL:        url,
+		Title:      title,
+		Metadata:   metadata,
+		Device:     device.USN,
+		DeviceName: device.FriendlyName,
+		CastAt:     time.Now(),
+		Position:   position,
+	}
+	h.history.add(entry)
+	h.cancelIdleOff(device.USN)
+	session := h.startSession(device, url, title)
+	h.notify(EventCastStarted, entry)
+	h.startCheckpoints(device, url, title, metadata, session.ID)
+}
+
+// metadataDuration is the duration of the media described by DIDL-Lite
+// metadata, or 0.
+func metadataDuration(metadata string) time.Duration {
+	if metadata == "" {
+		return 0
+	}
+	doc, err := didl.Unmarshal([]byte(metadata))
+	if err != nil || len(doc.Items) == 0 {
+		return 0
+	}
+	for _, res := range doc.Items[0].Resources {
+		if d, err := didl.ParseDuration(res.Duration); err == nil && d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// seekWhenReady retries Seek while the renderer is still loading the media.
+// mode is a DeviceSettings.SeekMode.
+func seekWhenReady(avt *dlna.AVTransport, mode, target string) error {
+	unit := "REL_TIME"
+	if mode == seekAbsTime {
+		unit = "ABS_TIME"
+	}
+	var err error
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Second)
+		if err = avt.Seek(unit, target); err == nil {
+			return nil
+		}
+	}
+	return err
+}
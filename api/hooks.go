@@ -0,0 +1,147 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"dlna/config"
+	"dlna/dlna"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Cast events, alongside the dlna.DeviceEvent types.
+const (
+	EventCastStarted  = "cast-started"
+	EventCastFinished = "cast-finished"
+	EventCastFailed   = "cast-failed"
+)
+
+const defaultHookTimeout = 10 * time.Second
+
+// hookEvents are the event types hooks can subscribe to.
+var hookEvents = map[string]bool{
+	string(dlna.DeviceAdded):   true,
+	string(dlna.DeviceOnline):  true,
+	string(dlna.DeviceOffline): true,
+	string(dlna.DeviceRemoved): true,
+	EventCastStarted:           true,
+	EventCastFinished:          true,
+	EventCastFailed:            true,
+	EventSessionFailed:         true,
+	EventCastStalled:           true,
+}
+
+// Hook delivers events to a webhook URL (POSTed as JSON) or a command (the
+// JSON on stdin, the event type in $DLNA_EVENT).
+type Hook struct {
+	events  map[string]bool // Empty is all
+	url     string
+	command []string
+	timeout time.Duration
+}
+
+// ParseHooks validates the hooks of the config file.
+func ParseHooks(cfg []config.Hook) ([]Hook, error) {
+	hooks := make([]Hook, 0, len(cfg))
+	for i, c := range cfg {
+		hk := Hook{events: make(map[string]bool), url: c.URL, command: c.Command, timeout: defaultHookTimeout}
+		if (c.URL == "") == (len(c.Command) == 0) {
+			return nil, fmt.Errorf("hook %d needs either a url or a command", i)
+		}
+		if c.URL != "" {
+			if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("hook %d: invalid url %q", i, c.URL)
+			}
+		}
+		for _, ev := range c.Events {
+			if !hookEvents[ev] {
+				return nil, fmt.Errorf("hook %d: unknown event %q", i, ev)
+			}
+			hk.events[ev] = true
+		}
+		if c.Timeout != "" {
+			d, err := time.ParseDuration(c.Timeout)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("hook %d: invalid timeout %q", i, c.Timeout)
+			}
+			hk.timeout = d
+		}
+		hooks = append(hooks, hk)
+	}
+	return hooks, nil
+}
+
+// SetHooks replaces the event hooks.
+func (h *Handler) SetHooks(hooks []Hook) {
+	h.mu.Lock()
+	h.hooks = hooks
+	h.mu.Unlock()
+}
+
+// notify publishes an event to WebSocket subscribers and fires the hooks
+// and push notifications subscribed to it, each in the background.
+func (h *Handler) notify(typ string, data interface{}) {
+	ev := Event{Type: typ, Time: time.Now(), Data: data}
+	h.events.publish(typ, data)
+	h.pushNotifications(typ, data)
+
+	h.mu.RLock()
+	hooks := h.hooks
+	h.mu.RUnlock()
+	if len(hooks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", typ, err)
+		return
+	}
+	for _, hk := range hooks {
+		if len(hk.events) == 0 || hk.events[typ] {
+			go hk.fire(typ, payload)
+		}
+	}
+}
+
+func (hk Hook) fire(typ string, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), hk.timeout)
+	defer cancel()
+
+	if hk.url != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hk.url, bytes.NewReader(payload))
+		if err != nil {
+			log.Printf("Hook %s failed: %v", hk.url, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("Hook %s failed for %s: %v", hk.url, typ, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Hook %s returned %s for %s", hk.url, resp.Status, typ)
+		}
+		return
+	}
+
+	cmd := exec.CommandContext(ctx, hk.command[0], hk.command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "DLNA_EVENT="+typ)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Hook %s failed for %s: %v %s", hk.command[0], typ, err, bytes.TrimSpace(out))
+	}
+}
+
+// deviceChanged is the discovery device hook.
+func (h *Handler) deviceChanged(ev dlna.DeviceEvent, d dlna.Device) {
+	h.notify(string(ev), d)
+	h.saveDevices()
+}
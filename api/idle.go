@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"dlna/dlna"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errNoStandby is returned by standby for renderers without a way to be
+// switched off remotely.
+var errNoStandby = errors.New("no standby support")
+
+// idleTimers holds the pending idle power-offs, one per device.
+type idleTimers struct {
+	mu sync.Mutex
+	m  map[string]*time.Timer
+}
+
+func newIdleTimers() *idleTimers {
+	return &idleTimers{m: make(map[string]*time.Timer)}
+}
+
+// startIdleOff arms the device's idle_off setting after its playback has
+// stopped. A new cast cancels it.
+func (h *Handler) startIdleOff(device *dlna.Device) {
+	after, err := time.ParseDuration(h.settings.get(device.USN).IdleOff)
+	if err != nil || after <= 0 {
+		return
+	}
+	h.idle.mu.Lock()
+	defer h.idle.mu.Unlock()
+	if prev, ok := h.idle.m[device.USN]; ok {
+		prev.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(after, func() {
+		h.idle.mu.Lock()
+		current := h.idle.m[device.USN] == t
+		if current {
+			delete(h.idle.m, device.USN)
+		}
+		h.idle.mu.Unlock()
+		if current {
+			h.idleOff(device, after)
+		}
+	})
+	h.idle.m[device.USN] = t
+}
+
+func (h *Handler) cancelIdleOff(usn string) {
+	h.idle.mu.Lock()
+	if t, ok := h.idle.m[usn]; ok {
+		t.Stop()
+		delete(h.idle.m, usn)
+	}
+	h.idle.mu.Unlock()
+}
+
+// idleOff releases a renderer that is still stopped with Stop, and puts it
+// in standby where that is supported.
+func (h *Handler) idleOff(device *dlna.Device, idle time.Duration) {
+	avt := h.avTransport(device)
+	info, err := avt.GetTransportInfo()
+	if err != nil {
+		return // Already off
+	}
+	if info.CurrentTransportState != "STOPPED" && info.CurrentTransportState != "NO_MEDIA_PRESENT" {
+		return // Someone else is using it
+	}
+	if err := avt.Stop(); err != nil {
+		log.Printf("Idle stop failed on %s: %v", device.FriendlyName, err)
+	}
+	switch err := h.standby(device); err {
+	case nil:
+		log.Printf("%s idle for %s, switched to standby", device.FriendlyName, idle)
+	case errNoStandby:
+		log.Printf("%s idle for %s, stopped (no standby support)", device.FriendlyName, idle)
+	default:
+		log.Printf("Standby failed on %s: %v", device.FriendlyName, err)
+	}
+}
+
+// standby switches device off. UPnP has no standard action for it, so it
+// needs a vendor adapter.
+func (h *Handler) standby(device *dlna.Device) error {
+	ctl, _ := h.tvFor(device)
+	if ctl == nil {
+		return errNoStandby
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tvTimeout)
+	defer cancel()
+	return ctl.PowerOff(ctx)
+}
@@ -0,0 +1,351 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// interruptMaxWait bounds an interruption of unknown length, e.g. MP3
+	// from a TTS service.
+	interruptMaxWait = 2 * time.Minute
+	// interruptMaxPending bounds the clips waiting to interrupt one device.
+	interruptMaxPending = 5
+)
+
+// Tests shorten these.
+var (
+	// interruptPoll is how often the renderer is asked whether an
+	// interruption finished.
+	interruptPoll = time.Second
+	// interruptMargin is waited beyond the length of an interruption, for
+	// renderers that buffer before playing.
+	interruptMargin = 3 * time.Second
+)
+
+var errInterruptBusy = errors.New("too many interruptions waiting")
+
+// Interruption is what a device played before clips were played over it,
+// restored once the last of them finishes. Clips that interrupt a device
+// that is already interrupted wait their turn instead of taking the first
+// clip for the media to restore.
+type Interruption struct {
+	Device    string    `json:"device"` // USN
+	URI       string    `json:"uri,omitempty"`
+	Position  string    `json:"position,omitempty"`
+	State     string    `json:"state,omitempty"` // AVTransport state before
+	Playing   string    `json:"playing"`         // Title of the clip playing
+	Pending   int       `json:"pending"`         // Clips playing or waiting
+	StartedAt time.Time `json:"started_at"`
+
+	metadata string
+	turn     sync.Mutex // Held by the clip playing
+}
+
+// interrupts holds the interruption of each device.
+type interrupts struct {
+	mu sync.Mutex
+	m  map[string]*Interruption
+}
+
+func newInterrupts() *interrupts {
+	return &interrupts{m: make(map[string]*Interruption)}
+}
+
+// begin joins the device's interruption, starting one if there is none,
+// and waits for the turn of the clip. first reports whether the caller
+// started it and must capture what to restore.
+func (s *interrupts) begin(usn string) (it *Interruption, first bool, err error) {
+	s.mu.Lock()
+	it = s.m[usn]
+	if it == nil {
+		it = &Interruption{Device: usn, StartedAt: time.Now()}
+		it.turn.Lock()
+		it.Pending = 1
+		s.m[usn] = it
+		s.mu.Unlock()
+		return it, true, nil
+	}
+	if it.Pending >= interruptMaxPending {
+		s.mu.Unlock()
+		return nil, false, errInterruptBusy
+	}
+	it.Pending++
+	s.mu.Unlock()
+	it.turn.Lock()
+	return it, false, nil
+}
+
+// end gives up the turn, reporting whether the caller was the last clip
+// and must restore what played before, then call finish.
+func (s *interrupts) end(it *Interruption) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it.Pending--
+	if it.Pending > 0 {
+		it.turn.Unlock()
+		return false
+	}
+	return true
+}
+
+// finish ends the interruption once the last clip restored, reporting
+// false if another clip joined meanwhile, which restores in turn.
+func (s *interrupts) finish(it *Interruption) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	done := it.Pending == 0
+	if done {
+		delete(s.m, it.Device)
+	}
+	it.turn.Unlock()
+	return done
+}
+
+// pending is the number of clips interrupting the device.
+func (s *interrupts) pending(usn string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if it := s.m[usn]; it != nil {
+		return it.Pending
+	}
+	return 0
+}
+
+func (s *interrupts) list() []Interruption {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Interruption, 0, len(s.m))
+	for _, it := range s.m {
+		list = append(list, Interruption{
+			Device:    it.Device,
+			URI:       it.URI,
+			Position:  it.Position,
+			State:     it.State,
+			Playing:   it.Playing,
+			Pending:   it.Pending,
+			StartedAt: it.StartedAt,
+		})
+	}
+	return list
+}
+
+// ListInterruptionsHandler lists the devices clips are played over.
+func (h *Handler) ListInterruptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.interrupts.list())
+}
+
+// InterruptHandler plays a URL over what a device plays, e.g. a doorbell
+// camera clip, and resumes the device afterwards; see playOver.
+func (h *Handler) InterruptHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		USN      string `json:"usn"` // Optional, USN or friendly name
+		URL      string `json:"url"`
+		Title    string `json:"title"`     // Optional
+		MimeType string `json:"mime_type"` // Optional, e.g. "audio/mpeg"
+		// Duration is how long the clip plays, "0:00:12" or "12s".
+		// Without it, the device is resumed once it stops, within 2
+		// minutes.
+		Duration string `json:"duration"`
+		Volume   int    `json:"volume"` // Optional, 1-100 while interrupting
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	if v.required("url", req.URL) {
+		v.url("url", req.URL)
+	}
+	v.text("title", req.Title, maxTextLength)
+	v.text("mime_type", req.MimeType, maxNameLength)
+	duration, err := parseMediaDuration(req.Duration)
+	if err != nil {
+		v.fail("duration", "must be H:MM:SS or a duration such as 12s")
+	}
+	if req.Volume < 0 || req.Volume > 100 {
+		v.fail("volume", "must be 0-100")
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	var length time.Duration
+	if duration != "" {
+		length, _ = didl.ParseDuration(duration)
+	}
+
+	device := h.selectDevice(w, r, h.deviceByName(req.USN))
+	if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+		return
+	}
+	if h.interrupts.pending(device.USN) >= interruptMaxPending {
+		http.Error(w, fmt.Sprintf("%s: %v", device.FriendlyName, errInterruptBusy), http.StatusConflict)
+		return
+	}
+
+	title := req.Title
+	if title == "" {
+		title = req.URL
+	}
+	job := h.jobs.create(device.USN, req.URL, req.Title)
+	h.runJob(job, func(ctx context.Context) error {
+		url, err := h.resolveURL(req.URL)
+		if err != nil {
+			return err
+		}
+		meta := dlna.Metadata{Title: title, MimeType: req.MimeType, Duration: duration}
+		return h.playOver(ctx, device, url, meta, length, req.Volume)
+	})
+	writeJob(w, r, job)
+}
+
+// playOver plays a short clip on device, e.g. an announcement or a chime,
+// and then restores what the device played before: the same media at the
+// same position, paused again if it was. volume, if not 0, is set for the
+// clip. length 0 waits for the renderer to stop, up to interruptMaxWait.
+// Clips played over a device that is already interrupted wait their turn
+// and the last of them restores.
+func (h *Handler) playOver(ctx context.Context, device *dlna.Device, url string, meta dlna.Metadata, length time.Duration, volume int) error {
+	if err := h.wake(device); err != nil {
+		return err
+	}
+	it, first, err := h.interrupts.begin(device.USN)
+	if err != nil {
+		return err
+	}
+	avt := h.avTransport(device)
+	if first {
+		var uri, metadata, state, position string
+		if info, err := avt.GetMediaInfo(); err == nil {
+			uri, metadata = info.CurrentURI, info.CurrentURIMetaData
+		}
+		if info, err := avt.GetTransportInfo(); err == nil {
+			state = info.CurrentTransportState
+		}
+		if info, err := avt.GetPositionInfo(); err == nil && validPosition(info.RelTime) {
+			position = info.RelTime
+		}
+		h.interrupts.mu.Lock()
+		it.URI, it.metadata, it.State, it.Position = uri, metadata, state, position
+		h.interrupts.mu.Unlock()
+		h.checkpoints.setInterrupted(device.USN, true)
+		h.events.publish("interrupt", map[string]string{"device": device.USN, "state": "started", "uri": uri})
+	}
+	h.interrupts.mu.Lock()
+	it.Playing = meta.Title
+	h.interrupts.mu.Unlock()
+
+	playErr := h.playClip(ctx, device, avt, url, meta, length, volume)
+	if !h.interrupts.end(it) {
+		return playErr
+	}
+	err = h.restore(device, avt, it, url)
+	if h.interrupts.finish(it) {
+		h.checkpoints.setInterrupted(device.USN, false)
+		h.events.publish("interrupt", map[string]string{"device": device.USN, "state": "resumed", "uri": it.URI})
+	}
+	if err != nil {
+		return err
+	}
+	return playErr
+}
+
+// playClip plays one clip of an interruption to its end.
+func (h *Handler) playClip(ctx context.Context, device *dlna.Device, avt *dlna.AVTransport, url string, meta dlna.Metadata, length time.Duration, volume int) error {
+	if volume > 0 {
+		if rc, err := h.renderingControl(device); err == nil {
+			if prev, err := rc.GetVolume(); err == nil {
+				h.cancelFade(device.USN)
+				if err := rc.SetVolume(h.capVolume(device, volume)); err == nil {
+					defer rc.SetVolume(prev)
+				}
+			}
+		}
+	}
+
+	metaData, err := h.metadataFor(device, meta).DIDL(url)
+	if err != nil {
+		return err
+	}
+	if err := h.load(ctx, device, avt, url, metaData); err != nil {
+		return fmt.Errorf("failed to play %s: %w", meta.Title, err)
+	}
+	log.Printf("Playing %s over what %s played", meta.Title, device.FriendlyName)
+	waitPlayed(avt, length)
+	return nil
+}
+
+// restore loads what played before the interruption it, unless it was
+// idle or something other than the last clip, url, was cast meanwhile.
+func (h *Handler) restore(device *dlna.Device, avt *dlna.AVTransport, it *Interruption, url string) error {
+	switch it.State {
+	case "PLAYING", "PAUSED_PLAYBACK", "TRANSITIONING":
+	default:
+		return nil
+	}
+	if it.URI == "" {
+		return nil
+	}
+	if info, err := avt.GetMediaInfo(); err == nil && info.CurrentURI != "" && info.CurrentURI != url {
+		log.Printf("Not resuming %s on %s, which was cast %s meanwhile", it.URI, device.FriendlyName, info.CurrentURI)
+		return nil
+	}
+	if err := h.load(context.Background(), device, avt, it.URI, it.metadata); err != nil {
+		return fmt.Errorf("failed to resume %s: %w", it.URI, err)
+	}
+	if mode := h.settings.get(device.USN).SeekMode; it.Position != "" && mode != seekNone {
+		if err := seekWhenReady(avt, mode, it.Position); err != nil {
+			log.Printf("Failed to seek %s back to %s: %v", device.FriendlyName, it.Position, err)
+		}
+	}
+	if it.State == "PAUSED_PLAYBACK" {
+		if err := avt.Pause(); err != nil {
+			return fmt.Errorf("failed to pause %s again: %w", it.URI, err)
+		}
+	}
+	log.Printf("Resumed %s on %s at %s", it.URI, device.FriendlyName, it.Position)
+	return nil
+}
+
+// waitPlayed returns once the renderer played a clip of length to the end:
+// it stopped after playing, or length and interruptMargin passed.
+func waitPlayed(avt *dlna.AVTransport, length time.Duration) {
+	wait := interruptMaxWait
+	if length > 0 {
+		wait = length + interruptMargin
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	ticker := time.NewTicker(interruptPoll)
+	defer ticker.Stop()
+	played := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := avt.GetTransportInfo()
+		if err != nil {
+			continue
+		}
+		switch info.CurrentTransportState {
+		case "PLAYING":
+			played = true
+		case "STOPPED", "NO_MEDIA_PRESENT":
+			if played {
+				return
+			}
+		}
+	}
+}
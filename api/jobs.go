@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"dlna/dlna"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	JobPending = "pending"
+	JobQueued  = "queued" // Waiting for the renderer's session to finish
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+
+	// jobRetention is how long finished jobs stay queryable.
+	jobRetention = 1 * time.Hour
+)
+
+// jobTimeout is how long a job may run before it is failed. It covers the
+// slowest casts: waking a TV, resolving a page, waiting for a torrent to
+// buffer. Tests shorten it.
+var jobTimeout = 10 * time.Minute
+
+// errJobTimeout fails jobs that ran out of time.
+var errJobTimeout = errors.New("timed out")
+
+// Job tracks an asynchronous cast.
+type Job struct {
+	ID        string    `json:"id"`
+	State     string    `json:"state"`
+	Device    string    `json:"device"` // USN
+	URL       string    `json:"url"`
+	Title     string    `json:"title,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type jobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+func newJobStore() *jobStore {
+	return &jobStore{jobs: make(map[string]*Job)}
+}
+
+func (s *jobStore) create(device, url, title string) *Job {
+	now := time.Now()
+	job := &Job{
+		ID:        newID(),
+		State:     JobPending,
+		Device:    device,
+		URL:       url,
+		Title:     title,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		if now.Sub(j.UpdatedAt) > jobRetention && (j.State == JobDone || j.State == JobFailed) {
+			delete(s.jobs, id)
+		}
+	}
+	s.jobs[job.ID] = job
+	snapshot := *job
+	return &snapshot
+}
+
+// update changes a job's state and returns a snapshot of it.
+func (s *jobStore) update(id, state string, err error) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	job.State = state
+	job.UpdatedAt = time.Now()
+	if err != nil {
+		job.Error = err.Error()
+	}
+	snapshot := *job
+	return &snapshot
+}
+
+func (s *jobStore) get(id string) *Job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	snapshot := *job
+	return &snapshot
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// runJob executes fn in the background, publishing a "job" event on each
+// state change. Jobs still running after jobTimeout fail. fn is left to
+// finish on its own, but its ctx is then done: the SOAP calls it makes
+// through load are abandoned, and media is no longer loaded (see load), so
+// a failed job does not start playing later.
+func (h *Handler) runJob(job *Job, fn func(ctx context.Context) error) {
+	h.events.publish("job", job)
+	go func() {
+		h.events.publish("job", h.jobs.update(job.ID, JobRunning, nil))
+		ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+		defer cancel()
+		done := make(chan error, 1)
+		go func() { done <- fn(ctx) }()
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = fmt.Errorf("%w after %s", errJobTimeout, jobTimeout)
+		}
+		if err != nil {
+			log.Printf("Job %s failed: %v", job.ID, err)
+			failed := h.jobs.update(job.ID, JobFailed, err)
+			h.events.publish("job", failed)
+			h.notify(EventCastFailed, failed)
+			h.audit.finishJob(job.ID, err)
+			return
+		}
+		h.events.publish("job", h.jobs.update(job.ID, JobDone, nil))
+		h.audit.finishJob(job.ID, nil)
+	}()
+}
+
+// contextClient makes SOAP calls with ctx instead of the caller's, e.g.
+// to bind them to a job.
+type contextClient struct {
+	ctx    context.Context
+	client dlna.SOAPClient // nil is dlna.HTTPSOAPClient
+}
+
+func (c contextClient) Call(_ context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	client := c.client
+	if client == nil {
+		client = dlna.HTTPSOAPClient{}
+	}
+	return client.Call(c.ctx, controlURL, serviceType, action, body)
+}
+
+// writeJob responds 202 Accepted with the job as JSON.
+func writeJob(w http.ResponseWriter, r *http.Request, job *Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", basePath(r)+"/api/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (h *Handler) JobHandler(w http.ResponseWriter, r *http.Request) {
+	job := h.jobs.get(r.PathValue("id"))
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
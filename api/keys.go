@@ -0,0 +1,235 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"dlna/store"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keysKey = "api_keys"
+	// keyPrefix starts every generated API key, so leaked keys are easy to
+	// search for.
+	keyPrefix = "dlk_"
+	// defaultKeyBurst is the burst of a rate-limited key without one.
+	defaultKeyBurst = 10
+)
+
+// APIKey is a named API key created through /api/keys. Only a hash of its
+// secret is kept, so the secret is shown once, when the key is created.
+type APIKey struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes,omitempty"`  // Empty is all
+	Devices []string  `json:"devices,omitempty"` // USNs or friendly names; empty is all
+	Rate    float64   `json:"rate,omitempty"`    // API requests per second; 0 is unlimited
+	Burst   int       `json:"burst,omitempty"`   // Requests at once, with rate
+	Created time.Time `json:"created"`
+}
+
+// storedKey is an API key as persisted.
+type storedKey struct {
+	APIKey
+	Hash string `json:"hash"` // Hex SHA-256 of the secret
+}
+
+type apiKey struct {
+	storedKey
+	hash  [sha256.Size]byte
+	token *Token
+}
+
+type apiKeys struct {
+	mu    sync.Mutex
+	store store.Store
+	m     map[string]*apiKey // ID -> key
+}
+
+func newAPIKeys(st store.Store) *apiKeys {
+	k := &apiKeys{store: st, m: make(map[string]*apiKey)}
+
+	var list []storedKey
+	if _, err := st.Get(keysKey, &list); err != nil {
+		log.Printf("Failed to load API keys: %v", err)
+	}
+	for _, sk := range list {
+		key, err := newAPIKey(sk)
+		if err != nil {
+			log.Printf("Skipping API key %s: %v", sk.Name, err)
+			continue
+		}
+		k.m[sk.ID] = key
+	}
+	return k
+}
+
+// newAPIKey builds the token that authenticates requests with sk.
+func newAPIKey(sk storedKey) (*apiKey, error) {
+	scopes, err := parseScopes(sk.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	key := &apiKey{storedKey: sk, token: &Token{name: sk.Name, scopes: scopes, devices: sk.Devices}}
+	if _, err := hex.Decode(key.hash[:], []byte(sk.Hash)); err != nil {
+		return nil, err
+	}
+	if sk.Rate > 0 {
+		key.token.limiter = newRateLimiter(sk.Rate, sk.Burst)
+	}
+	return key, nil
+}
+
+// saveLocked persists all keys. Callers must hold k.mu.
+func (k *apiKeys) saveLocked() {
+	list := make([]storedKey, 0, len(k.m))
+	for _, key := range k.m {
+		list = append(list, key.storedKey)
+	}
+	slices.SortFunc(list, func(a, b storedKey) int { return a.Created.Compare(b.Created) })
+	if err := k.store.Set(keysKey, list); err != nil {
+		log.Printf("Failed to save API keys: %v", err)
+	}
+}
+
+func (k *apiKeys) empty() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.m) == 0
+}
+
+// find returns the token of the key with secret, or nil.
+func (k *apiKeys) find(secret string) *Token {
+	if !strings.HasPrefix(secret, keyPrefix) {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(secret))
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range k.m {
+		if subtle.ConstantTimeCompare(key.hash[:], hash[:]) == 1 {
+			return key.token
+		}
+	}
+	return nil
+}
+
+func (k *apiKeys) list() []APIKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	list := make([]APIKey, 0, len(k.m))
+	for _, key := range k.m {
+		list = append(list, key.APIKey)
+	}
+	slices.SortFunc(list, func(a, b APIKey) int { return a.Created.Compare(b.Created) })
+	return list
+}
+
+// ListKeysHandler lists the API keys, without their secrets.
+func (h *Handler) ListKeysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.keys.list())
+}
+
+// CreateKeyHandler creates an API key and answers its secret, which cannot
+// be shown again.
+func (h *Handler) CreateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name    string   `json:"name"`
+		Scopes  []string `json:"scopes"`
+		Devices []string `json:"devices"`
+		Rate    float64  `json:"rate"`
+		Burst   int      `json:"burst"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	var v validator
+	if v.required("name", req.Name) {
+		v.text("name", req.Name, maxNameLength)
+	}
+	if _, err := parseScopes(req.Scopes); err != nil {
+		v.fail("scopes", "%v", err)
+	}
+	for _, d := range req.Devices {
+		v.text("devices", d, maxNameLength)
+	}
+	if req.Rate < 0 {
+		v.fail("rate", "must not be negative")
+	}
+	if req.Burst < 0 {
+		v.fail("burst", "must not be negative")
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if req.Rate > 0 && req.Burst == 0 {
+		req.Burst = defaultKeyBurst
+	}
+
+	b := make([]byte, 24)
+	rand.Read(b)
+	secret := keyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	hash := sha256.Sum256([]byte(secret))
+	key, err := newAPIKey(storedKey{
+		APIKey: APIKey{
+			ID:      newID(),
+			Name:    req.Name,
+			Scopes:  req.Scopes,
+			Devices: req.Devices,
+			Rate:    req.Rate,
+			Burst:   req.Burst,
+			Created: time.Now(),
+		},
+		Hash: hex.EncodeToString(hash[:]),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.keys.mu.Lock()
+	h.keys.m[key.ID] = key
+	h.keys.saveLocked()
+	h.keys.mu.Unlock()
+
+	log.Printf("API key created: %s (%s)", key.Name, key.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		APIKey
+		Key string `json:"key"`
+	}{key.APIKey, secret})
+}
+
+// RevokeKeyHandler deletes an API key; requests with it fail at once.
+func (h *Handler) RevokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	h.keys.mu.Lock()
+	key, ok := h.keys.m[id]
+	if ok {
+		delete(h.keys.m, id)
+		h.keys.saveLocked()
+	}
+	h.keys.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("API key revoked: %s (%s)", key.Name, id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,377 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"dlna/library"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// coverTimeout bounds extracting one embedded cover.
+const coverTimeout = 15 * time.Second
+
+// libraryItem is a library item with the paths renderers fetch it and its
+// thumbnail at, under the base path of the request.
+type libraryItem struct {
+	library.Item
+	MediaPath string `json:"media_path"`           // /media/{root}/{path}
+	ThumbPath string `json:"thumb_path,omitempty"` // /thumb/{id}
+}
+
+func libraryItems(base string, items []library.Item) []libraryItem {
+	out := make([]libraryItem, len(items))
+	for i, it := range items {
+		out[i] = libraryItem{Item: it, MediaPath: mediaURL(base, it.Root, it.Path)}
+		if hasThumbnail(it) {
+			out[i].ThumbPath = base + "/thumb/" + it.ID
+		}
+	}
+	return out
+}
+
+// hasThumbnail reports whether a thumbnail can be made of it.
+func hasThumbnail(it library.Item) bool {
+	return it.Type != library.TypeAudio || it.Cover
+}
+
+// thumbnailURL is the thumbnail URL under base of the file at name in root,
+// or "" if it is not in the library.
+func (h *Handler) thumbnailURL(base, root, name string) string {
+	it, ok := h.library.Get(root, name)
+	if !ok || !hasThumbnail(it) {
+		return ""
+	}
+	return base + "/thumb/" + it.ID
+}
+
+// SetThumbnailCache sets the folder thumbnails are cached in; "" keeps
+// them in memory.
+func (h *Handler) SetThumbnailCache(dir string) {
+	h.mu.Lock()
+	h.thumbs = library.NewThumbnails(dir)
+	h.mu.Unlock()
+}
+
+// scanLibrary updates the library index from the media roots. A scan that
+// is already running is left to finish.
+func (h *Handler) scanLibrary() {
+	h.mu.RLock()
+	roots := h.mediaRoots
+	h.mu.RUnlock()
+	if err := h.library.Scan(context.Background(), roots); err != nil && !errors.Is(err, library.ErrScanning) {
+		log.Printf("Library scan failed: %v", err)
+	}
+}
+
+// SetLibraryWatch sets how the media roots are watched for changes. It
+// takes effect with the next SetMediaRoots.
+func (h *Handler) SetLibraryWatch(cfg library.WatchConfig) {
+	h.mu.Lock()
+	h.libraryWatch = cfg
+	h.mu.Unlock()
+}
+
+// LibraryHandler returns the size and scan state of the library.
+func (h *Handler) LibraryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.library.Status())
+}
+
+// ScanLibraryHandler starts a rescan of the media roots. Only new and
+// changed files are probed.
+func (h *Handler) ScanLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	if h.library.Status().Scanning {
+		http.Error(w, library.ErrScanning.Error(), http.StatusConflict)
+		return
+	}
+	go h.scanLibrary()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SearchLibraryHandler searches the library by text (q: title, artist,
+// album or path), type, root, offset and limit. X-Total-Count is the number
+// of matches before paging.
+func (h *Handler) SearchLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := library.Query{Text: q.Get("q"), Type: q.Get("type"), Root: q.Get("root")}
+	var v validator
+	v.text("q", query.Text, maxTextLength)
+	v.text("root", query.Root, maxNameLength)
+	switch query.Type {
+	case "", library.TypeVideo, library.TypeAudio, library.TypeImage:
+	default:
+		v.fail("type", "must be video, audio or image")
+	}
+	for name, dst := range map[string]*int{"offset": &query.Offset, "limit": &query.Limit} {
+		if s := q.Get(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				v.fail(name, "must be a non-negative number")
+			}
+			*dst = n
+		}
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	items, total := h.library.Search(query)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	json.NewEncoder(w).Encode(libraryItems(basePath(r), items))
+}
+
+// BrowseLibraryHandler lists the subfolders and items of a folder (path)
+// in a media root.
+func (h *Handler) BrowseLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	root, dir := r.URL.Query().Get("root"), r.URL.Query().Get("path")
+	var v validator
+	if v.required("root", root) {
+		v.text("root", root, maxNameLength)
+	}
+	v.text("path", dir, maxURLLength)
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if h.mediaRoot(root) == nil {
+		http.Error(w, "Media root not found", http.StatusNotFound)
+		return
+	}
+
+	folders, items := h.library.Browse(root, dir)
+	if folders == nil {
+		folders = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"folders": folders, "items": libraryItems(basePath(r), items)})
+}
+
+// ThumbnailHandler serves the JPEG thumbnail of a library item, for
+// renderers showing album art; it is made on first request.
+func (h *Handler) ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	it, ok := h.library.ByID(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	h.mu.RLock()
+	root, ok := h.mediaRoots[it.Root]
+	ffmpeg, thumbs := h.ffmpeg, h.thumbs
+	h.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), coverTimeout)
+	defer cancel()
+	img, err := thumbs.Get(ctx, ffmpeg, it, root.Input(it.Path))
+	if errors.Is(err, library.ErrNoThumbnail) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	w.Write(img)
+}
+
+// CastLibraryHandler casts a library item by ID with its tags, duration and
+// thumbnail as metadata.
+func (h *Handler) CastLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID  string `json:"id"`
+		USN string `json:"usn"` // Optional
+		// Optional stream indexes from /api/library/{id}/tracks: the audio
+		// to play and the embedded subtitles to burn in. Either transcodes.
+		AudioTrack    *int `json:"audio_track"`
+		SubtitleTrack *int `json:"subtitle_track"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	if v.required("id", req.ID) {
+		v.text("id", req.ID, maxNameLength)
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	it, ok := h.library.ByID(req.ID)
+	if !ok {
+		http.Error(w, "Library item not found", http.StatusNotFound)
+		return
+	}
+	var opts castOptions
+	if req.AudioTrack != nil || req.SubtitleTrack != nil {
+		tracks, err := h.itemTracks(r.Context(), it)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if opts, err = trackOptions(tracks, req.AudioTrack, req.SubtitleTrack); err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+	}
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+		return
+	}
+	base, err := h.agentURL(device)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	url := mediaURL(base, it.Root, it.Path)
+	meta := libraryMetadata(it)
+	if hasThumbnail(it) {
+		meta.AlbumArtURL = base + "/thumb/" + it.ID
+	}
+	job := h.jobs.create(device.USN, url, it.Title)
+	h.runJob(job, func(ctx context.Context) error {
+		return h.loadURL(ctx, device, dlna.CastRequest{URL: url, Metadata: meta}, nil, true, opts)
+	})
+	writeJob(w, r, job)
+}
+
+// itemTracks probes the audio and subtitle tracks of a library item.
+func (h *Handler) itemTracks(ctx context.Context, it library.Item) ([]library.Track, error) {
+	h.mu.RLock()
+	root, ok := h.mediaRoots[it.Root]
+	probe := h.prober
+	h.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("Media root not found")
+	}
+	ctx, cancel := context.WithTimeout(ctx, mediaProbeTimeout)
+	defer cancel()
+	m, err := probe(ctx, root.Input(it.Path))
+	if err != nil {
+		return nil, err
+	}
+	return m.Tracks, nil
+}
+
+// trackOptions checks the audio and subtitle tracks a cast picks, by
+// stream index, against the tracks of the media. nil picks none.
+func trackOptions(tracks []library.Track, audio, subtitle *int) (castOptions, error) {
+	var v validator
+	opts := castOptions{audioTrack: audio}
+	if audio != nil && !slices.ContainsFunc(tracks, func(t library.Track) bool { return t.Type == "audio" && t.Index == *audio }) {
+		v.fail("audio_track", "no audio stream %d", *audio)
+	}
+	if subtitle != nil {
+		n := 0 // Position among the subtitle streams
+		for _, t := range tracks {
+			if t.Type != "subtitle" {
+				continue
+			}
+			if t.Index == *subtitle {
+				if t.Bitmap {
+					v.fail("subtitle_track", "%s subtitles are images and cannot be burnt in", t.Codec)
+				}
+				opts.subtitleTrack = &n
+				break
+			}
+			n++
+		}
+		if opts.subtitleTrack == nil {
+			v.fail("subtitle_track", "no subtitle stream %d", *subtitle)
+		}
+	}
+	return opts, v.err()
+}
+
+// LibraryTracksHandler lists the audio and subtitle tracks of a library
+// item, probed from the file, for picking them when casting it.
+func (h *Handler) LibraryTracksHandler(w http.ResponseWriter, r *http.Request) {
+	it, ok := h.library.ByID(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Library item not found", http.StatusNotFound)
+		return
+	}
+	tracks, err := h.itemTracks(r.Context(), it)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	out := struct {
+		Audio     []library.Track `json:"audio"`
+		Subtitles []library.Track `json:"subtitles"`
+	}{[]library.Track{}, []library.Track{}}
+	for _, t := range tracks {
+		if t.Type == "audio" {
+			out.Audio = append(out.Audio, t)
+		} else {
+			out.Subtitles = append(out.Subtitles, t)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// libraryMetadata describes it for the renderer.
+func libraryMetadata(it library.Item) dlna.Metadata {
+	meta := dlna.Metadata{
+		Title:    it.Title,
+		Artist:   it.Artist,
+		Album:    it.Album,
+		Duration: it.Duration,
+		MimeType: it.MIME,
+	}
+	switch it.Type {
+	case library.TypeAudio:
+		meta.Class = didl.ClassMusicTrack
+	case library.TypeImage:
+		meta.Class, meta.Duration = didl.ClassPhoto, ""
+	default:
+		meta.Class = didl.ClassVideoItem
+	}
+	return meta
+}
+
+// LibraryCoverHandler serves the embedded cover of a library item.
+func (h *Handler) LibraryCoverHandler(w http.ResponseWriter, r *http.Request) {
+	root, name := r.URL.Query().Get("root"), r.URL.Query().Get("path")
+	it, ok := h.library.Get(root, name)
+	if !ok || !it.Cover {
+		http.Error(w, "No cover for this item", http.StatusNotFound)
+		return
+	}
+	h.mu.RLock()
+	mr, found := h.mediaRoots[root]
+	ffmpeg := h.ffmpeg
+	h.mu.RUnlock()
+	if !found {
+		http.Error(w, "Media root not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), coverTimeout)
+	defer cancel()
+	img, err := library.Cover(ctx, ffmpeg, mr.Input(it.Path), it.CoverStream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(img))
+	w.Header().Set("Cache-Control", "max-age=86400")
+	w.Write(img)
+}
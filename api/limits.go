@@ -0,0 +1,250 @@
+package api
+
+import (
+	"dlna/config"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for config.Limits fields left at zero.
+const (
+	defaultMaxBodyBytes = 1 << 20
+	defaultCastRate     = 1 // per second
+	defaultCastBurst    = 5
+
+	limiterSweepInterval = time.Minute
+
+	// throttleChunk is the most written at once to a throttled stream.
+	throttleChunk = 32 * 1024
+	// throttleBurst is how far a throttled stream may catch up after a
+	// stall, e.g. a paused renderer.
+	throttleBurst = time.Second
+	// streamRetryAfter is suggested to renderers turned away by max_streams.
+	streamRetryAfter = 10 * time.Second
+)
+
+// rateLimiter is a token bucket per client IP.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// allow takes a token for client. If none is left it reports how long until
+// the next one.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= limiterSweepInterval {
+		l.lastSweep = now
+		for c, b := range l.buckets {
+			if now.Sub(b.last) >= limiterSweepInterval {
+				delete(l.buckets, c)
+			}
+		}
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// SetLimits configures request body and rate limits; see config.Limits.
+func (h *Handler) SetLimits(l config.Limits) {
+	if l.MaxBodyBytes <= 0 {
+		l.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if l.CastRate <= 0 {
+		l.CastRate = defaultCastRate
+	}
+	if l.CastBurst <= 0 {
+		l.CastBurst = defaultCastBurst
+	}
+	h.mu.Lock()
+	h.maxBody = l.MaxBodyBytes
+	h.castLimiter = newRateLimiter(l.CastRate, l.CastBurst)
+	h.maxStreams = max(l.MaxStreams, 0)
+	h.streamRate = max(l.StreamMbps, 0) * 1e6 / 8
+	h.mu.Unlock()
+}
+
+// isStream reports whether r fetches media for a renderer.
+func isStream(r *http.Request) bool {
+	p := r.URL.Path
+	return r.Method == http.MethodGet &&
+		(strings.HasPrefix(p, "/media/") || strings.HasPrefix(p, "/stream/") || strings.HasPrefix(p, "/torrent/"))
+}
+
+// acquireStream takes one of limit stream slots, reporting false if all are
+// in use. limit 0 is unlimited.
+func (h *Handler) acquireStream(limit int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if limit > 0 && h.activeStreams >= limit {
+		return false
+	}
+	h.activeStreams++
+	return true
+}
+
+func (h *Handler) releaseStream() {
+	h.mu.Lock()
+	h.activeStreams--
+	h.mu.Unlock()
+}
+
+// throttledWriter caps the rate of a response body, in bytes per second.
+type throttledWriter struct {
+	http.ResponseWriter
+	r     *http.Request
+	rate  float64
+	start time.Time
+	sent  int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m, err := t.ResponseWriter.Write(p[:min(len(p), throttleChunk)])
+		n += m
+		t.sent += int64(m)
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+
+		due := time.Duration(float64(t.sent) / t.rate * float64(time.Second))
+		if credit := time.Since(t.start) - due; credit > throttleBurst {
+			t.start = t.start.Add(credit - throttleBurst)
+		}
+		if wait := due - time.Since(t.start); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.r.Context().Done():
+				timer.Stop()
+				return n, t.r.Context().Err()
+			}
+		}
+	}
+	return n, nil
+}
+
+func (t *throttledWriter) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// deviceReads are the paths of controlsDevice whose GET only reports state,
+// such as the volume.
+var deviceReads = map[string]bool{"/api/volume": true, "/api/playmode": true, "/api/timer": true, "/api/frame": true, "/api/interrupt": true}
+
+// controlsDevice reports whether r makes the agent send commands to a
+// renderer, and so falls under the cast rate limit, the control scope and
+// session locks. Only the GETs of deviceReads are exempt, so any other
+// method of a casting route counts.
+func controlsDevice(r *http.Request) bool {
+	p := r.URL.Path
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && deviceReads[p] {
+		return false
+	}
+	return strings.HasPrefix(p, "/api/cast") || p == "/api/smartcast" || p == "/api/resume" || strings.HasPrefix(p, "/api/volume") ||
+		p == "/api/next" || p == "/api/previous" || p == "/api/playmode" || p == "/api/seek" ||
+		p == "/api/timer" || p == "/api/tv/cast" || p == "/api/announce" || p == "/api/chime" || p == "/api/interrupt" || p == "/api/screen" || p == "/api/audio" || p == "/api/frame" || p == "/api/library/cast" ||
+		(strings.HasPrefix(p, "/api/presets/") && strings.HasSuffix(p, "/play")) ||
+		(strings.HasPrefix(p, "/api/devices/") && (strings.HasSuffix(p, "/power") || strings.HasSuffix(p, "/input"))) ||
+		(strings.HasPrefix(p, "/api/sessions") && r.Method != http.MethodGet)
+}
+
+// clientIP is the remote address without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Limit wraps the API with the configured limits: request bodies larger
+// than MaxBodyBytes are rejected with 413, and clients exceeding the cast
+// rate get 429 with Retry-After. Media beyond MaxStreams at once gets 503,
+// and /media responses are held to StreamMbps; live streams run at their
+// encoder's rate.
+func (h *Handler) Limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStream(r) {
+			h.mu.RLock()
+			maxStreams, rate := h.maxStreams, h.streamRate
+			h.mu.RUnlock()
+			if !h.acquireStream(maxStreams) {
+				log.Printf("Refused %s to %s: %d streams running", r.URL.Path, clientIP(r), maxStreams)
+				w.Header().Set("Retry-After", strconv.Itoa(int(streamRetryAfter.Seconds())))
+				http.Error(w, "Too many streams", http.StatusServiceUnavailable)
+				return
+			}
+			defer h.releaseStream()
+			if rate > 0 && strings.HasPrefix(r.URL.Path, "/media/") {
+				w = &throttledWriter{ResponseWriter: w, r: r, rate: rate, start: time.Now()}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.mu.RLock()
+		maxBody, limiter := h.maxBody, h.castLimiter
+		h.mu.RUnlock()
+
+		if maxBody > 0 {
+			if r.ContentLength > maxBody {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		}
+		if limiter != nil && controlsDevice(r) {
+			if ok, wait := limiter.allow(clientIP(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
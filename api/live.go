@@ -0,0 +1,308 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"dlna/library"
+	"dlna/stream"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SetFFmpeg sets the ffmpeg binary used for live streams.
+func (h *Handler) SetFFmpeg(path string) {
+	probe := library.FFprobe(library.FFprobeFor(path))
+	h.mu.Lock()
+	h.streams = stream.NewManager(path)
+	h.ffmpeg = path
+	h.prober = probe
+	h.mu.Unlock()
+	h.library.SetProber(probe)
+}
+
+// SetBaseURL sets how renderers reach the agent. With an empty baseURL it
+// is derived from the local address facing each renderer and the port of
+// listenAddr.
+func (h *Handler) SetBaseURL(baseURL, listenAddr string) {
+	h.mu.Lock()
+	h.baseURL = strings.TrimRight(baseURL, "/")
+	h.listenAddr = listenAddr
+	h.mu.Unlock()
+}
+
+// AgentURLs override the base URL renderers reach the agent at, by USN or
+// by the subnet they are on.
+type AgentURLs struct {
+	byUSN   map[string]string
+	subnets []subnetURL // Longest prefix first
+}
+
+type subnetURL struct {
+	prefix netip.Prefix
+	url    string
+}
+
+// ParseAgentURLs validates the agent_urls of the config file, which map
+// USNs, IP addresses or CIDR ranges of renderers to base URLs.
+func ParseAgentURLs(m map[string]string) (AgentURLs, error) {
+	a := AgentURLs{byUSN: make(map[string]string)}
+	for key, raw := range m {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return a, fmt.Errorf("%s: %q is not an http(s) URL", key, raw)
+		}
+		base := strings.TrimRight(raw, "/")
+		if strings.HasPrefix(key, "uuid:") {
+			a.byUSN[key] = base
+			continue
+		}
+		prefix, err := netip.ParsePrefix(key)
+		if err != nil {
+			addr, err := netip.ParseAddr(key)
+			if err != nil {
+				return a, fmt.Errorf("%q is neither a USN, an IP address nor a CIDR range", key)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		a.subnets = append(a.subnets, subnetURL{prefix.Masked(), base})
+	}
+	slices.SortFunc(a.subnets, func(x, y subnetURL) int { return y.prefix.Bits() - x.prefix.Bits() })
+	return a, nil
+}
+
+// find returns the override for the renderer with usn at host.
+func (a AgentURLs) find(usn, host string) (string, bool) {
+	if u, ok := a.byUSN[usn]; ok {
+		return u, true
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", false
+	}
+	for _, s := range a.subnets {
+		if s.prefix.Contains(addr.Unmap()) {
+			return s.url, true
+		}
+	}
+	return "", false
+}
+
+// SetAgentURLs replaces the base URL overrides of agent_urls.
+func (h *Handler) SetAgentURLs(a AgentURLs) {
+	h.mu.Lock()
+	h.agentURLs = a
+	h.mu.Unlock()
+}
+
+// agentURL returns the base URL at which device can reach this agent: its
+// override in agent_urls, else -b, else the address of the local interface
+// on the device's subnet, or failing that the one routing to it.
+func (h *Handler) agentURL(device *dlna.Device) (string, error) {
+	h.mu.RLock()
+	base, listen, overrides := h.baseURL, h.listenAddr, h.agentURLs
+	h.mu.RUnlock()
+
+	u, err := url.Parse(device.Location)
+	if err != nil {
+		return "", err
+	}
+	if o, ok := overrides.find(device.USN, u.Hostname()); ok {
+		return o, nil
+	}
+	if base != "" {
+		return base, nil
+	}
+
+	local, ok := subnetAddr(u.Hostname())
+	if !ok {
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		// UDP "dial" sends nothing; it just picks the outgoing interface
+		conn, err := net.Dial("udp", host)
+		if err != nil {
+			return "", fmt.Errorf("no route to %s: %w", device.FriendlyName, err)
+		}
+		defer conn.Close()
+		local = conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+	}
+
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil || port == "" {
+		port = "8072"
+	}
+	return "http://" + net.JoinHostPort(local.String(), port), nil
+}
+
+// subnetAddr returns the address of the local interface whose subnet
+// holds host, so that multi-homed hosts hand renderers an address on their
+// own network even when the default route points elsewhere.
+func subnetAddr(host string) (netip.Addr, bool) {
+	target, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	target = target.Unmap()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			local, ok := netip.AddrFromSlice(ipnet.IP)
+			if !ok {
+				continue
+			}
+			ones, bits := ipnet.Mask.Size()
+			if local.Is4In6() && bits == 128 {
+				ones -= 96
+			}
+			if prefix := netip.PrefixFrom(local.Unmap(), ones); prefix.Contains(target) {
+				return local.Unmap(), true
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
+
+const (
+	// relayIdle is how long a relayed multicast or camera keeps running
+	// without the renderer reading it.
+	relayIdle     = 30 * time.Second
+	relayMimeType = "video/mp2t"
+)
+
+// relay replaces a udp://, rtp:// or rtsp:// source in req, which
+// renderers can't play, with the live stream of the agent relaying it.
+// Each device has one relay, replaced by its next one. Multicasts are
+// joined directly; RTSP is remuxed by ffmpeg, with less delay if
+// lowLatency. Other URLs are left alone, and relay reports false.
+func (h *Handler) relay(device *dlna.Device, req *dlna.CastRequest, lowLatency bool) (bool, error) {
+	var prefix string
+	switch {
+	case stream.IsUDP(req.URL):
+		prefix = "udp"
+	case stream.IsRTSP(req.URL):
+		prefix = "rtsp"
+	default:
+		return false, nil
+	}
+	base, err := h.agentURL(device)
+	if err != nil {
+		return false, err
+	}
+	id := fmt.Sprintf("%s-%08x", prefix, crc32.ChecksumIEEE([]byte(device.USN)))
+	if prefix == "udp" {
+		src, err := stream.OpenUDP(req.URL)
+		if err != nil {
+			return false, err
+		}
+		h.liveStreams().StartSource(id, relayMimeType, src, relayIdle)
+	} else {
+		l, err := h.liveStreams().Start(id, relayMimeType, stream.RTSPArgs(req.URL, lowLatency))
+		if err != nil {
+			return false, err
+		}
+		h.liveStreams().StopWhenIdle(l, relayIdle)
+	}
+	h.mu.Lock()
+	h.liveDevices[id] = device.USN
+	h.mu.Unlock()
+	if u, err := url.Parse(req.URL); err == nil {
+		log.Printf("Relaying %s to %s as stream %s", u.Redacted(), device.FriendlyName, id)
+	}
+
+	req.URL = base + "/stream/" + id + ".ts"
+	if req.Metadata.Class == "" {
+		req.Metadata.Class = didl.ClassVideoBroadcast
+	}
+	if req.ProtocolInfo == "" {
+		// Live content that can't be seeked
+		req.ProtocolInfo = "http-get:*:" + relayMimeType + ":" + didl.ContentFeatures("00", didl.FlagsStreaming)
+	}
+	return true, nil
+}
+
+func (h *Handler) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	h.liveStreams().ServeHTTP(w, r)
+}
+
+func (h *Handler) liveStreams() *stream.Manager {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.streams
+}
+
+// castLive starts a live stream with args and casts it to device as a job.
+func (h *Handler) castLive(w http.ResponseWriter, r *http.Request, device *dlna.Device, id, ext string, meta dlna.Metadata, args []string) {
+	base, err := h.agentURL(device)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := h.liveStreams().Start(id, meta.MimeType, args); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.mu.Lock()
+	h.liveDevices[id] = device.USN
+	h.mu.Unlock()
+
+	streamURL := base + "/stream/" + id + ext
+	job := h.jobs.create(device.USN, streamURL, meta.Title)
+	h.runJob(job, func(ctx context.Context) error {
+		// Encoded for renderers already
+		if err := h.loadURL(ctx, device, dlna.CastRequest{URL: streamURL, Metadata: meta}, nil, true, castOptions{profile: noProfile}); err != nil {
+			h.stopLive(id)
+			return err
+		}
+		return nil
+	})
+	writeJob(w, r, job)
+}
+
+// checkLive is checkDevice for the renderer playing a live stream.
+func (h *Handler) checkLive(w http.ResponseWriter, r *http.Request, id string) bool {
+	h.mu.RLock()
+	usn := h.liveDevices[id]
+	h.mu.RUnlock()
+	return h.checkDeviceUSN(w, r, usn)
+}
+
+// stopLive stops the stream and the renderer playing it. It reports whether
+// the stream was running.
+func (h *Handler) stopLive(id string) bool {
+	h.mu.Lock()
+	usn := h.liveDevices[id]
+	delete(h.liveDevices, id)
+	h.mu.Unlock()
+
+	if !h.liveStreams().Stop(id) {
+		return false
+	}
+	if device := h.discovery.GetDevice(usn); device != nil {
+		h.expectStop(usn)
+		if err := h.avTransport(device).Stop(); err != nil {
+			log.Printf("Failed to stop %s: %v", device.FriendlyName, err)
+		}
+	}
+	return true
+}
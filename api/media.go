@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/library"
+	"dlna/share"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mediaShare is a share media root and what it was opened with.
+type mediaShare struct {
+	url   string
+	opts  share.Options
+	share *share.Share
+}
+
+// SetMediaRoots sets the media roots served to renderers under
+// /media/{root}/, by name: local folders, or SMB, NFS, WebDAV and S3
+// share URLs read directly over the network. It updates the library index from
+// them in the background, then watches them for changes. Shares whose URL
+// and options are unchanged stay open, so a reload does not break the
+// streams reading them; those of removed roots are closed. The library is
+// only rescanned if the roots changed.
+func (h *Handler) SetMediaRoots(roots map[string]string) {
+	h.mu.RLock()
+	opts, prevDirs, prevShares, prevWatch, watch := h.shareOpts, h.mediaDirs, h.shares, h.watching, h.libraryWatch
+	first := h.stopWatch == nil
+	h.mu.RUnlock()
+	changed := first || len(roots) != len(prevDirs)
+	m := make(map[string]library.Root, len(roots))
+	shares := make(map[string]mediaShare)
+	for name, dir := range roots {
+		if d, ok := prevDirs[name]; !ok || d != dir {
+			changed = true
+		}
+		if !share.IsShare(dir) {
+			m[name] = library.DirRoot(dir)
+			continue
+		}
+		o := shareOptions(opts, dir)
+		s, ok := prevShares[name]
+		if !ok || s.url != dir || s.opts != o {
+			changed = true
+			sh, err := share.Open(dir, o)
+			if err != nil {
+				log.Printf("Media root %s: %v", name, err)
+				continue
+			}
+			s = mediaShare{url: dir, opts: o, share: sh}
+		}
+		shares[name] = s
+		m[name] = library.Root{FS: s.share, Input: s.share.Input}
+	}
+	if !changed && watch == prevWatch {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.mu.Lock()
+	h.mediaRoots = m
+	h.mediaDirs = maps.Clone(roots)
+	h.shares = shares
+	h.watching = watch
+	if h.stopWatch != nil {
+		h.stopWatch()
+	}
+	h.stopWatch = cancel
+	h.mu.Unlock()
+	for name, s := range prevShares {
+		if shares[name] != s {
+			s.share.Close()
+		}
+	}
+
+	go func() {
+		if changed {
+			h.scanLibrary()
+		}
+		h.library.Watch(ctx, m, watch)
+	}()
+}
+
+// SetShareOptions sets the credentials and options of share media roots,
+// by host as in their URLs. It takes effect with the next SetMediaRoots.
+func (h *Handler) SetShareOptions(opts map[string]share.Options) {
+	h.mu.Lock()
+	h.shareOpts = opts
+	h.mu.Unlock()
+}
+
+// shareOptions returns the options of the host of a share URL; NFS calls
+// default to nobody.
+func shareOptions(opts map[string]share.Options, rawURL string) share.Options {
+	if u, err := url.Parse(rawURL); err == nil {
+		if o, ok := opts[u.Hostname()]; ok {
+			return o
+		}
+	}
+	return share.Options{UID: share.Nobody, GID: share.Nobody}
+}
+
+func (h *Handler) mediaRoot(name string) fs.FS {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.mediaRoots[name].FS
+}
+
+// DLNA request and response headers of the media server
+const (
+	headerTransferMode    = "transferMode.dlna.org"
+	headerContentFeatures = "contentFeatures.dlna.org"
+	headerTimeSeekRange   = "TimeSeekRange.dlna.org"
+)
+
+// timeSeekExts are the formats that can be decoded from any byte offset,
+// so a time can be mapped to a byte position in proportion.
+var timeSeekExts = map[string]bool{".ts": true, ".m2ts": true, ".mpg": true, ".mpeg": true}
+
+// MediaHandler serves files from the media roots so renderers can fetch
+// local media. Paths escaping the root are rejected. Range requests and
+// the DLNA transfer mode and content features headers are supported, and
+// TimeSeekRange.dlna.org for MPEG streams of known duration. Files of S3
+// roots are redirected to a URL presigned for each request, so renderers
+// coming back late in a long film get one that has not expired.
+func (h *Handler) MediaHandler(w http.ResponseWriter, r *http.Request) {
+	root := r.PathValue("root")
+	fsys := h.mediaRoot(root)
+	name := r.PathValue("path")
+	if fsys == nil || !fs.ValidPath(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	flags, mode := didl.FlagsStreaming, "Streaming"
+	if library.MediaType(name) == library.TypeImage {
+		flags, mode = didl.FlagsInteractive, "Interactive"
+	}
+	switch m := r.Header.Get(headerTransferMode); m {
+	case "":
+	case "Streaming", "Interactive", "Background":
+		mode = m
+	default:
+		http.Error(w, "Unsupported transfer mode", http.StatusBadRequest)
+		return
+	}
+
+	var duration time.Duration
+	if it, ok := h.library.Get(root, name); ok && timeSeekExts[strings.ToLower(path.Ext(name))] {
+		duration, _ = didl.ParseDuration(it.Duration)
+	}
+	op := "01"
+	if duration > 0 {
+		op = "11"
+	}
+	w.Header().Set(headerTransferMode, mode)
+	w.Header().Set(headerContentFeatures, didl.ContentFeatures(op, flags))
+
+	seek := r.Header.Get(headerTimeSeekRange)
+	if sh, ok := fsys.(*share.Share); ok && seek == "" {
+		if u, ok := sh.SignedURL(name); ok {
+			http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+			return
+		}
+	}
+	if seek != "" {
+		if duration <= 0 {
+			http.Error(w, "Time seeking is not supported for this file", http.StatusNotAcceptable)
+			return
+		}
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		byteRange, header, err := timeSeekRange(seek, duration, info.Size())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		r.Header.Set("Range", byteRange)
+		w.Header().Set(headerTimeSeekRange, header)
+	}
+	http.ServeFileFS(w, r, fsys, name)
+}
+
+// timeSeekRange maps a TimeSeekRange.dlna.org request ("npt=START-[END]")
+// onto the bytes of a file of the given duration and size in proportion,
+// returning the Range request header and the TimeSeekRange.dlna.org
+// response header.
+func timeSeekRange(seek string, duration time.Duration, size int64) (string, string, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(seek), "npt=")
+	startStr, endStr, found := strings.Cut(spec, "-")
+	if !ok || !found {
+		return "", "", fmt.Errorf("invalid TimeSeekRange %q", seek)
+	}
+	start, err := parseNPT(startStr)
+	if err != nil || start >= duration {
+		return "", "", fmt.Errorf("invalid TimeSeekRange %q", seek)
+	}
+	end := duration
+	if endStr != "" {
+		if end, err = parseNPT(endStr); err != nil || end <= start {
+			return "", "", fmt.Errorf("invalid TimeSeekRange %q", seek)
+		}
+		end = min(end, duration)
+	}
+
+	first := int64(float64(size) * (float64(start) / float64(duration)))
+	last := int64(float64(size)*(float64(end)/float64(duration))) - 1
+	last = max(first, min(last, size-1))
+	header := fmt.Sprintf("npt=%s-%s/%s bytes=%d-%d/%d", formatNPT(start), formatNPT(end), formatNPT(duration), first, last, size)
+	return fmt.Sprintf("bytes=%d-%d", first, last), header, nil
+}
+
+// parseNPT parses an npt-time: seconds ("90.5") or H:MM:SS[.F].
+func parseNPT(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		return didl.ParseDuration(s)
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || secs < 0 {
+		return 0, fmt.Errorf("invalid npt time %q", s)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// formatNPT formats d as H:MM:SS.mmm.
+func formatNPT(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// mediaURL is the URL of a file in a media root under base.
+func mediaURL(base, root, name string) string {
+	parts := strings.Split(path.Clean(name), "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return base + "/media/" + url.PathEscape(root) + "/" + strings.Join(parts, "/")
+}
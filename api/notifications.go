@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"dlna/config"
+	"dlna/dlna"
+	"dlna/push"
+	"fmt"
+	"log"
+	"time"
+)
+
+const notificationTimeout = 15 * time.Second
+
+// defaultNotifyEvents are sent when a notification lists no events: the
+// ones worth interrupting someone for.
+var defaultNotifyEvents = []string{EventCastFinished, EventCastFailed, EventSessionFailed, string(dlna.DeviceOffline)}
+
+// Notification pushes messages for some event types to one service.
+type Notification struct {
+	events   map[string]bool
+	notifier push.Notifier
+}
+
+// ParseNotifications validates the notifications of the config file.
+func ParseNotifications(cfg []config.Notification) ([]Notification, error) {
+	out := make([]Notification, 0, len(cfg))
+	for i, c := range cfg {
+		var n push.Notifier
+		switch c.Type {
+		case "ntfy":
+			if c.URL == "" {
+				return nil, fmt.Errorf("notification %d: ntfy needs a url", i)
+			}
+			n = &push.Ntfy{URL: c.URL, Token: c.Token}
+		case "telegram":
+			if c.Token == "" || c.ChatID == "" {
+				return nil, fmt.Errorf("notification %d: telegram needs a token and chat_id", i)
+			}
+			n = &push.Telegram{Token: c.Token, ChatID: c.ChatID}
+		case "pushover":
+			if c.Token == "" || c.User == "" {
+				return nil, fmt.Errorf("notification %d: pushover needs a token and user", i)
+			}
+			n = &push.Pushover{Token: c.Token, User: c.User}
+		default:
+			return nil, fmt.Errorf("notification %d: unknown type %q", i, c.Type)
+		}
+
+		events := c.Events
+		if len(events) == 0 {
+			events = defaultNotifyEvents
+		}
+		nt := Notification{events: make(map[string]bool), notifier: n}
+		for _, ev := range events {
+			if !hookEvents[ev] {
+				return nil, fmt.Errorf("notification %d: unknown event %q", i, ev)
+			}
+			nt.events[ev] = true
+		}
+		out = append(out, nt)
+	}
+	return out, nil
+}
+
+// SetNotifications replaces the push notifications.
+func (h *Handler) SetNotifications(n []Notification) {
+	h.mu.Lock()
+	h.notifications = n
+	h.mu.Unlock()
+}
+
+// pushNotifications sends the message for an event to the notifications
+// subscribed to it, each in the background.
+func (h *Handler) pushNotifications(typ string, data interface{}) {
+	h.mu.RLock()
+	notifications := h.notifications
+	h.mu.RUnlock()
+
+	var m push.Message
+	var ok bool
+	for _, n := range notifications {
+		if !n.events[typ] {
+			continue
+		}
+		if !ok {
+			if m, ok = notificationMessage(typ, data); !ok {
+				return
+			}
+		}
+		go func(n push.Notifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+			defer cancel()
+			if err := n.Send(ctx, m); err != nil {
+				log.Printf("Failed to send %s notification via %s: %v", typ, n.Name(), err)
+			}
+		}(n.notifier)
+	}
+}
+
+// notificationMessage words an event for a phone. It reports false for
+// events not worth a message, such as a cast replaced by the next one.
+func notificationMessage(typ string, data interface{}) (push.Message, bool) {
+	switch d := data.(type) {
+	case dlna.Device:
+		titles := map[string]string{
+			string(dlna.DeviceAdded):   "New device",
+			string(dlna.DeviceOnline):  "Device online",
+			string(dlna.DeviceOffline): "Device offline",
+			string(dlna.DeviceRemoved): "Device removed",
+		}
+		return push.Message{Title: titles[typ], Body: d.FriendlyName}, true
+	case HistoryEntry:
+		return push.Message{Title: "Casting", Body: fmt.Sprintf("%s on %s", displayTitle(d.Title, d.URL), d.DeviceName)}, true
+	case CastFinished:
+		body := fmt.Sprintf("%s on %s", displayTitle(d.Title, d.URL), d.DeviceName)
+		switch d.Reason {
+		case finishStopped:
+			return push.Message{Title: "Playback finished", Body: body}, true
+		case finishUnreachable:
+			if d.Position != "" {
+				body += " at " + d.Position
+			}
+			return push.Message{Title: "Playback interrupted", Body: body + ": the renderer stopped responding"}, true
+		}
+	case SessionFailed:
+		body := fmt.Sprintf("%s on %s", displayTitle(d.Title, d.URL), d.DeviceName)
+		if d.Position != "" {
+			body += " at " + d.Position
+		}
+		return push.Message{Title: "Playback dropped", Body: body + fmt.Sprintf(": %d attempts to play it again failed", d.Retries)}, true
+	case CastStalled:
+		body := fmt.Sprintf("%s on %s at %s", displayTitle(d.Title, d.URL), d.DeviceName, d.Position)
+		if d.Restart > 0 {
+			body += ", restarting"
+		}
+		return push.Message{Title: "Playback stalled", Body: body}, true
+	case *Job:
+		return push.Message{Title: "Cast failed", Body: fmt.Sprintf("%s: %s", displayTitle(d.Title, d.URL), d.Error)}, true
+	}
+	return push.Message{}, false
+}
+
+func displayTitle(title, url string) string {
+	if title != "" {
+		return title
+	}
+	return url
+}
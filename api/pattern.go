@@ -0,0 +1,138 @@
+package api
+
+import (
+	"dlna/dlna"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DevicePattern picks the default device when none is set: a substring of
+// the USN, friendly name or manufacturer and model, "regex:" and a regular
+// expression, or "glob:" and a shell pattern such as "*Kitchen*" that must
+// match one of them whole. Names match ignoring case, accents and width
+// (see dlna.FoldName); regular expressions are case-sensitive unless they
+// start with (?i).
+type DevicePattern struct {
+	raw  string
+	re   *regexp.Regexp // For regex: and glob:
+	glob bool
+}
+
+func (p DevicePattern) String() string { return p.raw }
+
+// ParseDevicePattern parses one pattern.
+func ParseDevicePattern(s string) (DevicePattern, error) {
+	p := DevicePattern{raw: s}
+	var err error
+	if expr, ok := strings.CutPrefix(s, "regex:"); ok {
+		if p.re, err = regexp.Compile(expr); err != nil {
+			return p, fmt.Errorf("invalid pattern %q: %w", s, err)
+		}
+	} else if glob, ok := strings.CutPrefix(s, "glob:"); ok {
+		p.glob = true
+		if p.re, err = regexp.Compile(globRegexp(dlna.FoldName(glob))); err != nil {
+			return p, fmt.Errorf("invalid pattern %q: %w", s, err)
+		}
+	} else if strings.TrimSpace(s) == "" {
+		return p, fmt.Errorf("empty pattern")
+	}
+	return p, nil
+}
+
+// ParseDevicePatterns parses patterns separated by ";", tried in order.
+func ParseDevicePatterns(s string) ([]DevicePattern, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var patterns []DevicePattern
+	for _, raw := range strings.Split(s, ";") {
+		p, err := ParseDevicePattern(raw)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// globRegexp translates a shell pattern into an anchored regular
+// expression: * is any text, ? one character and [...] a class.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			if j := strings.IndexByte(glob[i+1:], ']'); j > 0 {
+				class := glob[i+1 : i+1+j]
+				if class[0] == '!' {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+				i += j + 1
+				continue
+			}
+			b.WriteString(`\[`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// Matches reports whether the device matches the pattern.
+func (p DevicePattern) Matches(d *dlna.Device) bool {
+	model := strings.TrimSpace(d.Manufacturer + " " + d.ModelName)
+	switch {
+	case p.glob:
+		return p.re.MatchString(d.USN) || p.re.MatchString(dlna.FoldName(d.FriendlyName)) ||
+			p.re.MatchString(dlna.FoldName(d.ModelName)) || p.re.MatchString(dlna.FoldName(model))
+	case p.re != nil:
+		return p.re.MatchString(d.USN) || p.re.MatchString(d.FriendlyName) ||
+			p.re.MatchString(d.ModelName) || p.re.MatchString(model)
+	}
+	return strings.Contains(d.USN, p.raw) || dlna.NameContains(d.FriendlyName, p.raw) ||
+		(model != "" && dlna.NameContains(model, p.raw))
+}
+
+// matchDevice returns the device matching the first pattern any device
+// matches, by friendly name if several do.
+func matchDevice(patterns []DevicePattern, devices []*dlna.Device) *dlna.Device {
+	devices = sortDevices(devices)
+	for _, p := range patterns {
+		for _, d := range devices {
+			if p.Matches(d) {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+// sortDevices returns a copy of devices sorted by friendly name, ignoring
+// case and accents, then USN.
+func sortDevices(devices []*dlna.Device) []*dlna.Device {
+	devices = slices.Clone(devices)
+	slices.SortFunc(devices, func(a, b *dlna.Device) int {
+		if c := strings.Compare(dlna.FoldName(a.FriendlyName), dlna.FoldName(b.FriendlyName)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.USN, b.USN)
+	})
+	return devices
+}
+
+// SetDefaultPatterns replaces the patterns of -p, e.g. with those of the
+// config file. nil restores the ones of -p.
+func (h *Handler) SetDefaultPatterns(patterns []DevicePattern) {
+	h.mu.Lock()
+	h.configPatterns = patterns
+	h.mu.Unlock()
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// playModes are the AVTransport play modes. Which ones a renderer
+// supports is up to it; it answers 712 to the others.
+var playModes = []string{"NORMAL", "SHUFFLE", "REPEAT_ONE", "REPEAT_ALL", "RANDOM", "DIRECT_1", "INTRO"}
+
+// GetPlayModeHandler returns the play mode of the renderer's own playlist.
+func (h *Handler) GetPlayModeHandler(w http.ResponseWriter, r *http.Request) {
+	device := h.selectDevice(w, r, r.URL.Query().Get("usn"))
+	if device == nil {
+		return
+	}
+	settings, err := h.avTransport(device).GetTransportSettings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"mode": settings.PlayMode})
+}
+
+// SetPlayModeHandler passes a play mode through to the renderer, for
+// renderers that keep playlists of their own. It does not apply to the
+// casts queued by the agent.
+func (h *Handler) SetPlayModeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		USN  string `json:"usn"` // Optional
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	if v.required("mode", req.Mode) && !slices.Contains(playModes, req.Mode) {
+		v.fail("mode", "must be one of %s", strings.Join(playModes, ", "))
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil {
+		return
+	}
+	if !requireActions(w, device, "SetPlayMode") {
+		return
+	}
+	if err := h.avTransport(device).SetPlayMode(req.Mode); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to set play mode: %v", err), http.StatusBadGateway)
+		return
+	}
+	log.Printf("Play mode of %s set to %s", device.FriendlyName, req.Mode)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"mode": req.Mode})
+}
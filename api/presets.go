@@ -0,0 +1,175 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"dlna/store"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const presetsKey = "presets"
+
+// Preset is a named stream URL, e.g. an internet radio station.
+type Preset struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Title string `json:"title,omitempty"` // Shown on the renderer, defaults to Name
+	Video bool   `json:"video,omitempty"` // Announce as video instead of audio
+}
+
+type presets struct {
+	mu    sync.Mutex
+	store store.Store
+	m     map[string]Preset // lower-cased name -> preset
+}
+
+func newPresets(st store.Store) *presets {
+	p := &presets{store: st, m: make(map[string]Preset)}
+
+	var list []Preset
+	if _, err := st.Get(presetsKey, &list); err != nil {
+		log.Printf("Failed to load presets: %v", err)
+	}
+	for _, pr := range list {
+		p.m[strings.ToLower(pr.Name)] = pr
+	}
+	return p
+}
+
+// saveLocked persists all presets. Callers must hold p.mu.
+func (p *presets) saveLocked() {
+	if err := p.store.Set(presetsKey, p.listLocked()); err != nil {
+		log.Printf("Failed to save presets: %v", err)
+	}
+}
+
+func (p *presets) listLocked() []Preset {
+	list := make([]Preset, 0, len(p.m))
+	for _, pr := range p.m {
+		list = append(list, pr)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (p *presets) get(name string) (Preset, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr, ok := p.m[strings.ToLower(name)]
+	return pr, ok
+}
+
+func (h *Handler) ListPresetsHandler(w http.ResponseWriter, r *http.Request) {
+	h.presets.mu.Lock()
+	list := h.presets.listLocked()
+	h.presets.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// SavePresetHandler creates a preset or replaces the one with the same name.
+func (h *Handler) SavePresetHandler(w http.ResponseWriter, r *http.Request) {
+	var pr Preset
+	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pr.Name = strings.TrimSpace(pr.Name)
+	var v validator
+	if v.required("name", pr.Name) {
+		v.text("name", pr.Name, maxNameLength)
+	}
+	if v.required("url", pr.URL) {
+		v.mediaURL("url", pr.URL)
+	}
+	v.text("title", pr.Title, maxTextLength)
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	h.presets.mu.Lock()
+	h.presets.m[strings.ToLower(pr.Name)] = pr
+	h.presets.saveLocked()
+	h.presets.mu.Unlock()
+
+	log.Printf("Preset saved: %s (%s)", pr.Name, pr.URL)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pr)
+}
+
+func (h *Handler) DeletePresetHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	h.presets.mu.Lock()
+	_, ok := h.presets.m[strings.ToLower(name)]
+	if ok {
+		delete(h.presets.m, strings.ToLower(name))
+		h.presets.saveLocked()
+	}
+	h.presets.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "Preset not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Preset %s deleted", name)
+}
+
+// PlayPresetHandler casts a preset. ?device= takes a USN or friendly name
+// and defaults to the default device, so it works as a bodyless POST from a
+// button or a curl one-liner.
+func (h *Handler) PlayPresetHandler(w http.ResponseWriter, r *http.Request) {
+	pr, ok := h.presets.get(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Preset not found", http.StatusNotFound)
+		return
+	}
+
+	device := h.selectDevice(w, r, h.deviceByName(r.URL.Query().Get("device")))
+	if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+		return
+	}
+
+	meta := presetMetadata(pr)
+	job := h.jobs.create(device.USN, pr.URL, meta.Title)
+	h.runJob(job, func(ctx context.Context) error {
+		return h.castURL(ctx, device, dlna.CastRequest{URL: pr.URL, Metadata: meta}, nil)
+	})
+	writeJob(w, r, job)
+}
+
+// presetMetadata announces a preset as a broadcast titled after it.
+func presetMetadata(pr Preset) dlna.Metadata {
+	meta := dlna.Metadata{Title: pr.Title, Class: didl.ClassAudioBroadcast}
+	if meta.Title == "" {
+		meta.Title = pr.Name
+	}
+	if pr.Video {
+		meta.Class = didl.ClassVideoBroadcast
+	}
+	return meta
+}
+
+// deviceByName maps a friendly name (see dlna.NameEqual) to its USN. Anything
+// else, including USNs, is returned unchanged.
+func (h *Handler) deviceByName(name string) string {
+	if name == "" || h.discovery.GetDevice(name) != nil {
+		return name
+	}
+	for _, d := range h.discovery.GetDevices() {
+		if dlna.NameEqual(d.FriendlyName, name) {
+			return d.USN
+		}
+	}
+	return name
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// mediaProbeTimeout bounds probing a URL before casting it.
+const mediaProbeTimeout = 15 * time.Second
+
+// containerTypes maps ffprobe format names to MIME types, for media
+// served without a useful Content-Type.
+var containerTypes = map[string]string{
+	"mov,mp4,m4a,3gp,3g2,mj2": "video/mp4",
+	"matroska,webm":           "video/x-matroska",
+	"mpegts":                  "video/mp2t",
+	"avi":                     "video/x-msvideo",
+	"mp3":                     "audio/mpeg",
+	"flac":                    "audio/flac",
+	"ogg":                     "audio/ogg",
+	"wav":                     "audio/wav",
+}
+
+// probeMedia fills in the duration, size and type of the media of req
+// that its metadata lacks, from a HEAD request and ffprobe, so renderers
+// that report no duration themselves still show one and can seek. Probe
+// failures only leave the metadata as it was.
+func (h *Handler) probeMedia(req *dlna.CastRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), mediaProbeTimeout)
+	defer cancel()
+	m := &req.Metadata
+
+	if u, err := url.Parse(req.URL); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		head, err := http.NewRequestWithContext(ctx, http.MethodHead, req.URL, nil)
+		if err != nil {
+			return
+		}
+		if resp, err := http.DefaultClient.Do(head); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				if m.Size == 0 && resp.ContentLength > 0 {
+					m.Size = resp.ContentLength
+				}
+				ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+				if m.MimeType == "" && (strings.HasPrefix(ct, "video/") || strings.HasPrefix(ct, "audio/")) {
+					m.MimeType = ct
+				}
+			}
+		}
+	}
+
+	h.mu.RLock()
+	probe := h.prober
+	h.mu.RUnlock()
+	info, err := probe(ctx, req.URL)
+	if err != nil {
+		log.Printf("Failed to probe %s: %v", req.URL, err)
+		return
+	}
+	if m.Duration == "" && info.Duration > 0 {
+		m.Duration = didl.FormatDuration(info.Duration)
+	}
+	if m.MimeType == "" {
+		m.MimeType = containerTypes[info.Format]
+		if info.VideoCodec == "" && strings.HasPrefix(m.MimeType, "video/") {
+			m.MimeType = "audio/" + strings.TrimPrefix(m.MimeType, "video/")
+		}
+	}
+	if m.Class == "" && info.VideoCodec == "" && info.AudioCodec != "" {
+		m.Class = didl.ClassAudioItem
+	}
+	log.Printf("Probed %s: %s, duration %s, %d bytes", req.URL, info.Format, m.Duration, m.Size)
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"dlna/config"
+	"dlna/didl"
+	"dlna/dlna"
+	"dlna/stream"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// noProfile casts media as is, overriding a device's profile setting.
+const noProfile = "none"
+
+// transcodeIdle is how long a transcode keeps running without the renderer
+// reading it.
+const transcodeIdle = 30 * time.Second
+
+var validBitrate = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kKmM]?$`)
+
+// Profile is a named casting preset: "tv-4k" may cast media as is, while
+// "old-tv" transcodes it to 1080p H.264 and AAC for a renderer that plays
+// little else. Casts pick one with "profile", else the device's profile
+// setting applies.
+type Profile struct {
+	Name string `json:"name"`
+	config.Profile
+}
+
+// ParseProfiles validates the profiles of the config file.
+func ParseProfiles(cfg map[string]config.Profile) (map[string]Profile, error) {
+	profiles := make(map[string]Profile, len(cfg))
+	for name, c := range cfg {
+		if !validName.MatchString(name) {
+			return nil, fmt.Errorf("profile %q: names are letters, digits, '.', '_' and '-'", name)
+		}
+		if name == noProfile {
+			return nil, fmt.Errorf("profile %q is reserved for casting as is", name)
+		}
+		switch c.VideoCodec {
+		case "", "h264", "hevc":
+		case "copy":
+			if c.MaxHeight > 0 {
+				return nil, fmt.Errorf("profile %s: max_height needs the video transcoded, not copied", name)
+			}
+		default:
+			return nil, fmt.Errorf("profile %s: unknown video_codec %q", name, c.VideoCodec)
+		}
+		switch c.AudioCodec {
+		case "", "aac", "ac3", "mp3", "copy":
+		default:
+			return nil, fmt.Errorf("profile %s: unknown audio_codec %q", name, c.AudioCodec)
+		}
+		if c.MaxHeight < 0 {
+			return nil, fmt.Errorf("profile %s: invalid max_height %d", name, c.MaxHeight)
+		}
+		for field, rate := range map[string]string{"video_bitrate": c.VideoBitrate, "audio_bitrate": c.AudioBitrate} {
+			if rate != "" && !validBitrate.MatchString(rate) {
+				return nil, fmt.Errorf("profile %s: invalid %s %q", name, field, rate)
+			}
+		}
+		profiles[name] = Profile{Name: name, Profile: c}
+	}
+	return profiles, nil
+}
+
+// SetProfiles replaces the casting profiles.
+func (h *Handler) SetProfiles(profiles map[string]Profile) {
+	h.mu.Lock()
+	h.profiles = profiles
+	h.mu.Unlock()
+}
+
+// profile returns the profile a cast to device uses: name, or without it
+// the device's profile setting. ok is false for an unknown name; no
+// profile at all, or "none", is the zero Profile. A profile setting that
+// is no longer configured is ignored.
+func (h *Handler) profile(device *dlna.Device, name string) (Profile, bool) {
+	setting := name == ""
+	if setting {
+		name = h.settings.get(device.USN).Profile
+	}
+	if name == "" || name == noProfile {
+		return Profile{}, true
+	}
+	h.mu.RLock()
+	p, ok := h.profiles[name]
+	h.mu.RUnlock()
+	if !ok && setting {
+		log.Printf("Casting to %s as is: its profile %s is not configured", device.FriendlyName, name)
+		return Profile{}, true
+	}
+	return p, ok
+}
+
+// hasProfile reports whether casts can use the profile name.
+func (h *Handler) hasProfile(name string) bool {
+	if name == noProfile {
+		return true
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.profiles[name]
+	return ok
+}
+
+// ListProfilesHandler lists the casting profiles by name.
+func (h *Handler) ListProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	list := make([]Profile, 0, len(h.profiles))
+	for _, p := range h.profiles {
+		list = append(list, p)
+	}
+	h.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// SetTranscoding selects the video encoder of transcodes: software, or
+// hw on the GPU, with device the VAAPI render node.
+func (h *Handler) SetTranscoding(hw stream.HWAccel, device string) {
+	h.mu.Lock()
+	h.hwAccel, h.hwDevice = hw, device
+	h.mu.Unlock()
+}
+
+// transcodeSource is the media a transcode reads.
+type transcodeSource struct {
+	url       string
+	subtitles string // URL of a subtitle file to burn in
+	audio     *int   // Stream index of the audio, default the first
+	subtitle  *int   // Embedded subtitles to burn in, by position among the subtitle streams
+}
+
+// transcodeArgs builds the ffmpeg command line that transcodes src per the
+// profile to MPEG-TS on stdout: the first video stream and the chosen or
+// first audio stream, video with the chosen subtitles burnt in, scaled
+// down to MaxHeight and encoded with hw.
+func (p Profile) transcodeArgs(src transcodeSource, hw stream.HWAccel, device string) []string {
+	if p.VideoCodec == "copy" {
+		hw = stream.HWNone // Nothing to encode
+	}
+	input, filter := stream.HWArgs(hw, device)
+	audio := "0:a:0?"
+	if src.audio != nil {
+		audio = "0:" + strconv.Itoa(*src.audio)
+	}
+	args := append(input, "-i", src.url, "-map", "0:v:0?", "-map", audio)
+	if p.VideoCodec == "copy" {
+		args = append(args, "-c:v", "copy")
+	} else {
+		codec := p.VideoCodec
+		if codec == "" {
+			codec = "h264"
+		}
+		args = append(args, "-c:v", stream.VideoEncoder(codec, hw))
+		if hw == stream.HWNone {
+			args = append(args, "-preset", "veryfast")
+		}
+		if p.MaxHeight > 0 {
+			filter = "scale=-2:'min(" + strconv.Itoa(p.MaxHeight) + ",ih)'," + filter
+		}
+		// Before scaling, so that the subtitles keep their layout
+		if src.subtitles != "" {
+			filter = "subtitles=" + filterEscape(src.subtitles) + "," + filter
+		} else if src.subtitle != nil {
+			filter = "subtitles=" + filterEscape(src.url) + ":si=" + strconv.Itoa(*src.subtitle) + "," + filter
+		}
+		args = append(args, "-vf", filter)
+	}
+	if p.VideoBitrate != "" {
+		args = append(args, "-b:v", p.VideoBitrate, "-maxrate", p.VideoBitrate, "-bufsize", p.VideoBitrate)
+	}
+	switch p.AudioCodec {
+	case "copy":
+		args = append(args, "-c:a", "copy")
+	case "ac3":
+		args = append(args, "-c:a", "ac3", "-ac", "2")
+	case "mp3":
+		args = append(args, "-c:a", "libmp3lame", "-ac", "2")
+	default:
+		args = append(args, "-c:a", "aac", "-ac", "2")
+	}
+	if p.AudioBitrate != "" {
+		args = append(args, "-b:a", p.AudioBitrate)
+	}
+	return append(args, "-f", "mpegts", "pipe:1")
+}
+
+// filterEscape escapes s as an option value in an ffmpeg filtergraph: once
+// for the filter's options, once for the graph.
+func filterEscape(s string) string {
+	for _, special := range []string{`\':`, `\'[],;`} {
+		var b strings.Builder
+		for _, r := range s {
+			if strings.ContainsRune(special, r) {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		s = b.String()
+	}
+	return s
+}
+
+// transcode replaces the media of req, src, with the live stream of the
+// agent transcoding it per p, like relay. Each device has one transcode,
+// replaced by its next one. The stream cannot be sought.
+func (h *Handler) transcode(device *dlna.Device, req *dlna.CastRequest, p Profile, src transcodeSource) error {
+	base, err := h.agentURL(device)
+	if err != nil {
+		return err
+	}
+	h.mu.RLock()
+	hw, hwDevice := h.hwAccel, h.hwDevice
+	h.mu.RUnlock()
+	id := fmt.Sprintf("transcode-%08x", crc32.ChecksumIEEE([]byte(device.USN)))
+	l, err := h.liveStreams().Start(id, relayMimeType, p.transcodeArgs(src, hw, hwDevice))
+	if err != nil {
+		return err
+	}
+	h.liveStreams().StopWhenIdle(l, transcodeIdle)
+	h.mu.Lock()
+	h.liveDevices[id] = device.USN
+	h.mu.Unlock()
+	log.Printf("Transcoding for %s with profile %s as stream %s (encoder %s)", device.FriendlyName, cmp.Or(p.Name, noProfile), id, cmp.Or(string(hw), "software"))
+	if src.subtitles != "" {
+		log.Printf("Burning %s into stream %s", src.subtitles, id)
+	}
+
+	req.URL = base + "/stream/" + id + ".ts"
+	req.Metadata.MimeType, req.Metadata.Size = relayMimeType, 0
+	req.ProtocolInfo = "http-get:*:" + relayMimeType + ":" + didl.ContentFeatures("00", didl.FlagsStreaming)
+	return nil
+}
+
+// encoderProbeTimeout bounds the encoder probe, test encodes included.
+const encoderProbeTimeout = 30 * time.Second
+
+// EncodersResponse is the reply of EncodersHandler.
+type EncodersResponse struct {
+	HWAccel  stream.HWAccel   `json:"hwaccel"` // Configured, "" for software
+	Encoders []stream.Encoder `json:"encoders"`
+}
+
+// EncodersHandler reports which H.264 and HEVC encoders, software and
+// hardware, ffmpeg has and which of them work on this host.
+func (h *Handler) EncodersHandler(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	ffmpeg, hw, device := h.ffmpeg, h.hwAccel, h.hwDevice
+	h.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(r.Context(), encoderProbeTimeout)
+	defer cancel()
+	encoders, err := stream.ProbeEncoders(ctx, ffmpeg, device)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to run ffmpeg: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EncodersResponse{HWAccel: hw, Encoders: encoders})
+}
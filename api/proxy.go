@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"dlna/config"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// ProxyConfig describes the reverse proxy in front of the agent.
+type ProxyConfig struct {
+	// Trusted are the proxies whose X-Forwarded-For and X-Forwarded-Prefix
+	// headers are believed.
+	Trusted []netip.Prefix
+	// BasePath is the path the agent is served under, e.g. "/dlna", or "".
+	BasePath string
+}
+
+type basePathContextKey struct{}
+
+// ParseProxy validates the proxy section of the config file.
+func ParseProxy(c config.Proxy) (ProxyConfig, error) {
+	var p ProxyConfig
+	for _, s := range c.Trusted {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return p, fmt.Errorf("trusted: %q is neither an IP address nor a CIDR range", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		p.Trusted = append(p.Trusted, prefix.Masked())
+	}
+	if c.BasePath != "" {
+		base, err := cleanBasePath(c.BasePath)
+		if err != nil {
+			return p, fmt.Errorf("base_path: %w", err)
+		}
+		p.BasePath = base
+	}
+	return p, nil
+}
+
+// cleanBasePath returns base with a leading slash and no trailing one.
+func cleanBasePath(base string) (string, error) {
+	base = "/" + strings.Trim(base, "/")
+	if base == "/" {
+		return "", nil
+	}
+	if u, err := url.Parse(base); err != nil || u.Path != base || strings.Contains(base, "//") {
+		return "", fmt.Errorf("invalid path %q", base)
+	}
+	return base, nil
+}
+
+// SetProxy configures the reverse proxy in front of the agent.
+func (h *Handler) SetProxy(p ProxyConfig) {
+	h.mu.Lock()
+	h.proxy = p
+	h.mu.Unlock()
+}
+
+// trusted reports whether addr is one of the proxies.
+func (p *ProxyConfig) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.Trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the client of a request the trusted proxy at peer
+// forwarded: the last address of X-Forwarded-For that is not itself a
+// trusted proxy.
+func (p *ProxyConfig) forwardedFor(r *http.Request, peer netip.Addr) netip.Addr {
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr
+		if !p.trusted(addr) {
+			break
+		}
+	}
+	return client
+}
+
+// Proxied makes the agent work behind the reverse proxies of
+// SetProxy. Requests from a trusted proxy take their client address from
+// X-Forwarded-For, for logs, rate limits, sessions and the audit log. The
+// base path is stripped from request paths, so the agent answers both
+// under it, through the proxy, and at the root, for renderers reaching it
+// directly. Paths handed to API clients, e.g. in Location headers, get
+// the base path the request came with, or X-Forwarded-Prefix from a
+// proxy that stripped it. It must run outside everything else.
+func (h *Handler) Proxied(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.RLock()
+		p := h.proxy
+		h.mu.RUnlock()
+		if len(p.Trusted) == 0 && p.BasePath == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		prefix := ""
+		if peer, err := netip.ParseAddr(clientIP(r)); err == nil && p.trusted(peer) {
+			if client := p.forwardedFor(r, peer); client != peer {
+				r2.RemoteAddr = net.JoinHostPort(client.String(), "0")
+			}
+			if fp := r.Header.Get("X-Forwarded-Prefix"); fp != "" {
+				prefix, _ = cleanBasePath(fp)
+			}
+		}
+		if rest, ok := strings.CutPrefix(r.URL.Path, p.BasePath); p.BasePath != "" && ok && (rest == "" || rest[0] == '/') {
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = "/" + strings.TrimPrefix(rest, "/")
+			r2.URL.RawPath = ""
+			if raw, ok := strings.CutPrefix(r.URL.RawPath, p.BasePath); ok {
+				r2.URL.RawPath = "/" + strings.TrimPrefix(raw, "/")
+			}
+			prefix = p.BasePath
+		}
+		if prefix != "" {
+			r2 = r2.WithContext(context.WithValue(r.Context(), basePathContextKey{}, prefix))
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// basePath is the prefix of paths handed to the API client of r, "" unless
+// it came through a proxy under a base path.
+func basePath(r *http.Request) string {
+	base, _ := r.Context().Value(basePathContextKey{}).(string)
+	return base
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// reconcileMaxRetries bounds the recoveries of a session in a row; a
+	// session that plays reconcileStable after one starts over.
+	reconcileMaxRetries = 3
+	reconcileStable     = time.Minute
+	// reconcileEndMargin is how close to its end media that stops is taken
+	// to have finished rather than dropped.
+	reconcileEndMargin = 15 * time.Second
+)
+
+// EventSessionFailed is sent when a session dropped by its renderer could
+// not be recovered; see SessionFailed.
+const EventSessionFailed = "session-failed"
+
+// finishDropped is the CastFinished reason of such a session.
+const finishDropped = "dropped"
+
+// SessionFailed is the payload of session-failed events.
+type SessionFailed struct {
+	Session    string `json:"session"`
+	Device     string `json:"device"` // USN
+	DeviceName string `json:"device_name"`
+	URL        string `json:"url"`
+	Title      string `json:"title,omitempty"`
+	Position   string `json:"position,omitempty"` // Last known RelTime
+	Retries    int    `json:"retries"`
+	Error      string `json:"error,omitempty"` // Of the last retry
+}
+
+// expectStop notes that the agent itself stops the session on usn, e.g.
+// for a sleep timer, so that it is not taken for dropped.
+func (h *Handler) expectStop(usn string) {
+	h.sessions.mu.Lock()
+	if s := h.sessions.m[usn]; s != nil {
+		s.stopping = true
+	}
+	h.sessions.mu.Unlock()
+}
+
+// dropped reports whether the renderer stopped the session with id on
+// device although it should still play: the device has the reconcile
+// setting, the session is still open and not being stopped by the agent,
+// and the media had not reached its end.
+func (h *Handler) dropped(device *dlna.Device, id string, p Progress) bool {
+	if !h.settings.get(device.USN).Reconcile {
+		return false
+	}
+	h.sessions.mu.Lock()
+	s := h.sessions.m[device.USN]
+	open := s != nil && s.ID == id && !s.stopping
+	h.sessions.mu.Unlock()
+	if !open {
+		return false
+	}
+	pos, err := didl.ParseDuration(p.Position)
+	if err != nil {
+		return true
+	}
+	dur, err := didl.ParseDuration(p.Duration)
+	return err != nil || dur <= 0 || pos < dur-reconcileEndMargin
+}
+
+// recoverCast plays url on device again at position: Play if the renderer
+// still has it loaded, otherwise SetAVTransportURI with metadata first.
+func (h *Handler) recoverCast(device *dlna.Device, avt *dlna.AVTransport, url, metadata, position string) error {
+	if info, err := avt.GetMediaInfo(); err == nil && info.CurrentURI == url {
+		if err := avt.Play(); err != nil {
+			return fmt.Errorf("failed to play %s again: %w", url, err)
+		}
+	} else {
+		if err := h.load(context.Background(), device, avt, url, metadata); err != nil {
+			return fmt.Errorf("failed to load %s again: %w", url, err)
+		}
+	}
+	if mode := h.settings.get(device.USN).SeekMode; validPosition(position) && mode != seekNone {
+		if err := seekWhenReady(avt, mode, position); err != nil {
+			log.Printf("Failed to seek %s back to %s: %v", device.FriendlyName, position, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+	"context"
+	"dlna/cron"
+	"dlna/dlna"
+	"dlna/store"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const schedulesKey = "schedules"
+
+// Schedule is a recurring cast, e.g. a radio stream to the kitchen speaker
+// at 7am on weekdays ("0 7 * * mon-fri").
+type Schedule struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Cron    string    `json:"cron"`
+	URL     string    `json:"url"`
+	Title   string    `json:"title,omitempty"`
+	USN     string    `json:"usn,omitempty"`     // Empty uses the default device
+	Preset  string    `json:"preset,omitempty"`  // Casts this preset instead of URL
+	Volume  int       `json:"volume,omitempty"`  // Sets this volume first; 0 leaves it
+	FadeIn  string    `json:"fade_in,omitempty"` // Fades from 0 up to Volume over this long
+	Enabled bool      `json:"enabled"`
+	LastRun time.Time `json:"last_run"`
+	NextRun time.Time `json:"next_run"` // Computed on read
+
+	spec *cron.Spec
+}
+
+type schedules struct {
+	mu    sync.Mutex
+	store store.Store
+	m     map[string]*Schedule
+}
+
+func newSchedules(st store.Store) *schedules {
+	s := &schedules{store: st, m: make(map[string]*Schedule)}
+
+	var list []*Schedule
+	if _, err := st.Get(schedulesKey, &list); err != nil {
+		log.Printf("Failed to load schedules: %v", err)
+	}
+	for _, sc := range list {
+		spec, err := cron.Parse(sc.Cron)
+		if err != nil {
+			log.Printf("Skipping schedule %s: %v", sc.Name, err)
+			continue
+		}
+		sc.spec = spec
+		s.m[sc.ID] = sc
+	}
+	return s
+}
+
+// saveLocked persists all schedules. Callers must hold s.mu.
+func (s *schedules) saveLocked() {
+	list := make([]*Schedule, 0, len(s.m))
+	for _, sc := range s.m {
+		list = append(list, sc)
+	}
+	if err := s.store.Set(schedulesKey, list); err != nil {
+		log.Printf("Failed to save schedules: %v", err)
+	}
+}
+
+// snapshotLocked copies sc with NextRun filled in. Callers must hold s.mu.
+func snapshotLocked(sc *Schedule) Schedule {
+	out := *sc
+	out.NextRun = time.Time{}
+	if sc.Enabled {
+		out.NextRun = sc.spec.Next(time.Now())
+	}
+	return out
+}
+
+// scheduleLoop wakes at every minute boundary and runs due schedules.
+func (h *Handler) scheduleLoop() {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+
+		h.schedules.mu.Lock()
+		var due []Schedule
+		for _, sc := range h.schedules.m {
+			if sc.Enabled && sc.spec.Matches(next) {
+				sc.LastRun = next
+				due = append(due, *sc)
+			}
+		}
+		if len(due) > 0 {
+			h.schedules.saveLocked()
+		}
+		h.schedules.mu.Unlock()
+
+		for _, sc := range due {
+			go h.runSchedule(sc)
+		}
+	}
+}
+
+func (h *Handler) runSchedule(sc Schedule) {
+	device, err := h.resolveDevice(sc.USN)
+	if err != nil {
+		log.Printf("Schedule %s: %v", sc.Name, err)
+		return
+	}
+
+	url, meta := sc.URL, dlna.Metadata{Title: sc.Title}
+	if sc.Preset != "" {
+		pr, ok := h.presets.get(sc.Preset)
+		if !ok {
+			log.Printf("Schedule %s: preset %q not found", sc.Name, sc.Preset)
+			return
+		}
+		url, meta = pr.URL, presetMetadata(pr)
+	}
+	fadeIn, _ := time.ParseDuration(sc.FadeIn) // Validated in decodeSchedule
+
+	job := h.jobs.create(device.USN, url, meta.Title)
+	log.Printf("Schedule %s: casting to %s (job %s)", sc.Name, device.FriendlyName, job.ID)
+	h.runJob(job, func(ctx context.Context) error {
+		if sc.Volume == 0 {
+			return h.castURL(ctx, device, dlna.CastRequest{URL: url, Metadata: meta}, nil)
+		}
+
+		// Wake first so the volume can be set before anything plays
+		if err := h.wake(device); err != nil {
+			return err
+		}
+		rc, err := h.renderingControl(device)
+		if err != nil {
+			return err
+		}
+		start := sc.Volume
+		if fadeIn > 0 {
+			start = 0
+		}
+		if err := rc.SetVolume(h.capVolume(device, start)); err != nil {
+			return err
+		}
+		if err := h.castURL(ctx, device, dlna.CastRequest{URL: url, Metadata: meta}, nil); err != nil {
+			return err
+		}
+		if fadeIn > 0 {
+			go func() {
+				if err := h.fadeVolume(device, 0, sc.Volume, fadeIn); err != nil && err != errFadeCancelled {
+					log.Printf("Schedule %s: fade-in failed: %v", sc.Name, err)
+				}
+			}()
+		}
+		return nil
+	})
+}
+
+// decodeSchedule reads and validates a schedule from the request body.
+func (h *Handler) decodeSchedule(w http.ResponseWriter, r *http.Request) *Schedule {
+	sc := &Schedule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(sc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := h.validateSchedule(sc); err != nil {
+		writeBadRequest(w, err)
+		return nil
+	}
+	return sc
+}
+
+// validateSchedule checks sc and parses its cron expression.
+func (h *Handler) validateSchedule(sc *Schedule) error {
+	var v validator
+	v.text("name", sc.Name, maxNameLength)
+	v.mediaURL("url", sc.URL)
+	v.text("title", sc.Title, maxTextLength)
+	v.text("usn", sc.USN, maxUSNLength) // May be a friendly name
+	v.text("preset", sc.Preset, maxNameLength)
+	if err := v.err(); err != nil {
+		return err
+	}
+	if sc.URL == "" && sc.Preset == "" {
+		return fmt.Errorf("Schedule needs a url or preset")
+	}
+	if sc.Preset != "" {
+		if _, ok := h.presets.get(sc.Preset); !ok {
+			return fmt.Errorf("Preset %q not found", sc.Preset)
+		}
+	}
+	if sc.Volume < 0 || sc.Volume > 100 {
+		return fmt.Errorf("Invalid volume %d", sc.Volume)
+	}
+	if sc.FadeIn != "" {
+		if d, err := time.ParseDuration(sc.FadeIn); err != nil || d <= 0 || sc.Volume == 0 {
+			return fmt.Errorf("Invalid fade_in %q (needs a volume to fade to)", sc.FadeIn)
+		}
+	}
+	spec, err := cron.Parse(sc.Cron)
+	if err != nil {
+		return err
+	}
+	sc.spec = spec
+	sc.LastRun = time.Time{}
+	return nil
+}
+
+func (h *Handler) ListSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	h.schedules.mu.Lock()
+	list := make([]Schedule, 0, len(h.schedules.m))
+	for _, sc := range h.schedules.m {
+		list = append(list, snapshotLocked(sc))
+	}
+	h.schedules.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (h *Handler) CreateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	sc := h.decodeSchedule(w, r)
+	if sc == nil {
+		return
+	}
+	h.createSchedule(w, sc)
+}
+
+// createSchedule stores a validated schedule and writes it with 201 Created.
+func (h *Handler) createSchedule(w http.ResponseWriter, sc *Schedule) {
+	sc.ID = newID()
+
+	h.schedules.mu.Lock()
+	h.schedules.m[sc.ID] = sc
+	h.schedules.saveLocked()
+	out := snapshotLocked(sc)
+	h.schedules.mu.Unlock()
+
+	log.Printf("Schedule created: %s (%s)", sc.Name, sc.Cron)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(out)
+}
+
+func (h *Handler) GetScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	h.schedules.mu.Lock()
+	sc, ok := h.schedules.m[r.PathValue("id")]
+	var out Schedule
+	if ok {
+		out = snapshotLocked(sc)
+	}
+	h.schedules.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func (h *Handler) UpdateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	sc := h.decodeSchedule(w, r)
+	if sc == nil {
+		return
+	}
+	sc.ID = id
+
+	h.schedules.mu.Lock()
+	prev, ok := h.schedules.m[id]
+	var out Schedule
+	if ok {
+		sc.LastRun = prev.LastRun
+		h.schedules.m[id] = sc
+		h.schedules.saveLocked()
+		out = snapshotLocked(sc)
+	}
+	h.schedules.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func (h *Handler) DeleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	h.schedules.mu.Lock()
+	_, ok := h.schedules.m[id]
+	if ok {
+		delete(h.schedules.m, id)
+		h.schedules.saveLocked()
+	}
+	h.schedules.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Schedule %s deleted", id)
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"dlna/didl"
+	"dlna/dlna"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+)
+
+const screenStream = "screen"
+
+// screenArgs builds the ffmpeg command line that captures the display and
+// encodes it as low-latency H.264 in MPEG-TS on stdout.
+func screenArgs(display string, framerate int, size, bitrate string) []string {
+	fps := strconv.Itoa(framerate)
+	var args []string
+	switch runtime.GOOS {
+	case "windows":
+		if display == "" {
+			display = "desktop"
+		}
+		args = []string{"-f", "gdigrab", "-framerate", fps, "-i", display}
+	case "darwin":
+		if display == "" {
+			display = "1:none"
+		}
+		args = []string{"-f", "avfoundation", "-framerate", fps, "-i", display}
+	default:
+		if display == "" {
+			display = ":0.0"
+		}
+		args = []string{"-f", "x11grab", "-framerate", fps, "-i", display}
+	}
+	if size != "" {
+		args = append(args, "-s", size)
+	}
+	return append(args,
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency",
+		"-pix_fmt", "yuv420p", "-g", strconv.Itoa(framerate*2), "-b:v", bitrate,
+		"-f", "mpegts", "pipe:1",
+	)
+}
+
+// StartScreenHandler captures the host's display and casts it to a renderer.
+func (h *Handler) StartScreenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		USN       string `json:"usn"`       // Optional
+		Display   string `json:"display"`   // Optional ffmpeg input, e.g. ":0.0" or "desktop"
+		Framerate int    `json:"framerate"` // Optional, default 25
+		Size      string `json:"size"`      // Optional output size, e.g. "1280x720"
+		Bitrate   string `json:"bitrate"`   // Optional, default "4M"
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	v.text("display", req.Display, maxNameLength)
+	v.text("size", req.Size, maxNameLength)
+	v.text("bitrate", req.Bitrate, maxNameLength)
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if req.Framerate == 0 {
+		req.Framerate = 25
+	}
+	if req.Framerate < 1 || req.Framerate > 60 {
+		http.Error(w, fmt.Sprintf("Invalid framerate %d", req.Framerate), http.StatusBadRequest)
+		return
+	}
+	if req.Bitrate == "" {
+		req.Bitrate = "4M"
+	}
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+		return
+	}
+
+	args := screenArgs(req.Display, req.Framerate, req.Size, req.Bitrate)
+	meta := dlna.Metadata{Title: "Screen", Class: didl.ClassVideoBroadcast, MimeType: "video/mp2t"}
+	h.castLive(w, r, device, screenStream, ".ts", meta, args)
+}
+
+func (h *Handler) StopScreenHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.checkLive(w, r, screenStream) {
+		return
+	}
+	if !h.stopLive(screenStream) {
+		http.Error(w, "Screen cast is not running", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "Screen cast stopped")
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"dlna/didl"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SeekHandler moves playback on a device to a position: "H:MM:SS", a Go
+// duration such as "90s", or a percentage such as "50%". Percentages need
+// the duration, from the renderer or, for renderers that report none, from
+// the cast's metadata (see DeviceSettings.Probe).
+func (h *Handler) SeekHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		USN      string `json:"usn"` // Optional
+		Position string `json:"position"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	var percent float64
+	var target time.Duration
+	if v.required("position", req.Position) {
+		if p, ok := strings.CutSuffix(req.Position, "%"); ok {
+			var err error
+			if percent, err = strconv.ParseFloat(p, 64); err != nil || percent < 0 || percent > 100 {
+				v.fail("position", "percentage must be 0-100")
+			}
+		} else if d, err := time.ParseDuration(req.Position); err == nil && d >= 0 {
+			target = d
+		} else if d, err := didl.ParseDuration(req.Position); err == nil && d >= 0 {
+			target = d
+		} else {
+			v.fail("position", "must be H:MM:SS, a duration such as 90s, or a percentage")
+		}
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil {
+		return
+	}
+	mode := h.settings.get(device.USN).SeekMode
+	if mode == seekNone {
+		http.Error(w, fmt.Sprintf("%s is set not to seek", device.FriendlyName), http.StatusConflict)
+		return
+	}
+	if !requireActions(w, device, "Seek") {
+		return
+	}
+	avt := h.avTransport(device)
+
+	if strings.HasSuffix(req.Position, "%") {
+		h.checkpoints.mu.Lock()
+		p := h.checkpoints.progress[device.USN]
+		h.checkpoints.mu.Unlock()
+		dur, err := didl.ParseDuration(p.Duration)
+		if err != nil || dur <= 0 {
+			if info, err := avt.GetPositionInfo(); err == nil {
+				dur, _ = didl.ParseDuration(info.TrackDuration)
+			}
+		}
+		if dur <= 0 {
+			http.Error(w, fmt.Sprintf("The duration of what %s plays is unknown", device.FriendlyName), http.StatusConflict)
+			return
+		}
+		target = time.Duration(float64(dur) * percent / 100).Round(time.Second)
+	}
+
+	unit := "REL_TIME"
+	if mode == seekAbsTime {
+		unit = "ABS_TIME"
+	}
+	position := didl.FormatDuration(target)
+	if err := avt.Seek(unit, position); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to seek: %v", err), http.StatusBadGateway)
+		return
+	}
+	log.Printf("Seeked %s to %s", device.FriendlyName, position)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"position": position})
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func (h *Handler) ListServersHandler(w http.ResponseWriter, r *http.Request) {
+	servers := h.discovery.GetServers()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(servers)
+}
+
+// BrowseServerHandler proxies a ContentDirectory Browse call:
+// GET /api/servers/{usn}/browse?objectID=0&start=0&count=100&flag=BrowseDirectChildren
+func (h *Handler) BrowseServerHandler(w http.ResponseWriter, r *http.Request) {
+	server := h.discovery.GetServer(r.PathValue("usn"))
+	if server == nil {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	objectID := q.Get("objectID")
+	if objectID == "" {
+		objectID = "0"
+	}
+	flag := q.Get("flag")
+	if flag == "" {
+		flag = "BrowseDirectChildren"
+	}
+	start, _ := strconv.Atoi(q.Get("start"))
+	count, err := strconv.Atoi(q.Get("count"))
+	if err != nil || count <= 0 {
+		count = 100
+	}
+
+	result, err := h.contentDirectory(server).Browse(objectID, flag, start, count)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to browse: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// CastFromServerHandler implements the UPnP three-box model: the item's
+// resource URL and DIDL-Lite metadata are read from a MediaServer and pushed
+// to a renderer.
+func (h *Handler) CastFromServerHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Server   string `json:"server"`    // MediaServer USN
+		ObjectID string `json:"object_id"` // ContentDirectory item ID
+		USN      string `json:"usn"`       // Renderer, optional
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	if v.required("server", req.Server) {
+		v.usn("server", req.Server)
+	}
+	v.text("object_id", req.ObjectID, maxTextLength)
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	server := h.discovery.GetServer(req.Server)
+	if server == nil {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	}
+
+	result, err := h.contentDirectory(server).Browse(req.ObjectID, "BrowseMetadata", 0, 1)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to browse: %v", err), http.StatusBadGateway)
+		return
+	}
+	if len(result.Items) == 0 || len(result.Items[0].Resources) == 0 {
+		http.Error(w, "Item has no playable resource", http.StatusNotFound)
+		return
+	}
+	item := result.Items[0]
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+		return
+	}
+
+	mediaURL := item.Resources[0].URL
+	job := h.jobs.create(device.USN, mediaURL, item.Title)
+	h.runJob(job, func(ctx context.Context) error {
+		if err := h.wake(device); err != nil {
+			return err
+		}
+		h.checkpoint(device)
+		// The server's DIDL-Lite is sent as is, its protocolInfo included:
+		// dlna_flags only applies to metadata built here
+		if err := h.load(ctx, device, h.avTransport(device), mediaURL, result.DIDL); err != nil {
+			return fmt.Errorf("failed to cast: %w", err)
+		}
+		h.recordCast(device, mediaURL, item.Title, result.DIDL, "")
+		log.Printf("Casting %s from %s to %s", item.Title, server.FriendlyName, device.FriendlyName)
+		return nil
+	})
+
+	writeJob(w, r, job)
+}
@@ -0,0 +1,432 @@
+package api
+
+import (
+	"context"
+	"dlna/dlna"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is a cast in progress on a renderer, from the cast until it
+// finishes (see CastFinished). A renderer has at most one.
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"` // USN
+	DeviceName string    `json:"device_name"`
+	URL        string    `json:"url"`
+	Title      string    `json:"title,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	// LockedBy is the client (token name or IP) that may control the
+	// device exclusively until the lock is released or the session ends.
+	LockedBy string      `json:"locked_by,omitempty"`
+	State    string      `json:"state,omitempty"`    // Latest AVTransport state
+	Position string      `json:"position,omitempty"` // H:MM:SS
+	Timer    *SleepTimer `json:"timer,omitempty"`    // Set for this session only
+	Queued   int         `json:"queued,omitempty"`   // Casts waiting for it to finish
+
+	timer    *SleepTimer
+	stopping bool // The agent stops it, see expectStop
+}
+
+// Cast conflict policies: what a cast does to a renderer with a session
+const (
+	policyPreempt = "preempt" // Replace it (default)
+	policyReject  = "reject"  // Fail with 409
+	policyQueue   = "queue"   // Play once it has finished
+)
+
+// sessions holds the active session of each device, and the casts queued
+// behind it.
+type sessions struct {
+	mu    sync.Mutex
+	m     map[string]*Session      // USN -> session
+	queue map[string][]*queuedCast // USN -> casts, first to play first
+	// played lists, per USN, the casts that have played from the queue so
+	// far, last played last, for Previous.
+	played map[string][]HistoryEntry
+}
+
+type queuedCast struct {
+	job *Job
+	fn  func(context.Context) error
+}
+
+func newSessions() *sessions {
+	return &sessions{m: make(map[string]*Session), queue: make(map[string][]*queuedCast), played: make(map[string][]HistoryEntry)}
+}
+
+// startSession opens a session for a cast on device, replacing the
+// previous one. A lock is kept: whoever cast got past it.
+func (h *Handler) startSession(device *dlna.Device, url, title string) *Session {
+	s := &Session{
+		ID:         newID(),
+		Device:     device.USN,
+		DeviceName: device.FriendlyName,
+		URL:        url,
+		Title:      title,
+		StartedAt:  time.Now(),
+	}
+	h.sessions.mu.Lock()
+	prev := h.sessions.m[device.USN]
+	if prev != nil {
+		s.LockedBy = prev.LockedBy
+	}
+	h.sessions.m[device.USN] = s
+	h.sessions.mu.Unlock()
+	if prev != nil {
+		h.cancelSessionTimer(prev)
+	}
+	return s
+}
+
+// endSession closes the session with id on usn, unless another has
+// replaced it.
+func (h *Handler) endSession(usn, id string) {
+	h.sessions.mu.Lock()
+	s := h.sessions.m[usn]
+	if s == nil || s.ID != id {
+		h.sessions.mu.Unlock()
+		return
+	}
+	delete(h.sessions.m, usn)
+	if len(h.sessions.queue[usn]) > 0 {
+		h.sessions.played[usn] = append(h.sessions.played[usn], h.playedEntry(s))
+	} else {
+		delete(h.sessions.played, usn)
+	}
+	h.sessions.mu.Unlock()
+	h.cancelSessionTimer(s)
+	h.nextQueued(usn)
+}
+
+// activeSession returns a snapshot of the session on usn, or nil.
+func (h *Handler) activeSession(usn string) *Session {
+	for _, s := range h.listSessions() {
+		if s.Device == usn {
+			return &s
+		}
+	}
+	return nil
+}
+
+// queueCast runs job (fn) once the session on usn has finished, or now if
+// there is none. Casts queued on a device play one after another.
+func (h *Handler) queueCast(usn string, job *Job, fn func(context.Context) error) *Job {
+	run := func(ctx context.Context) error {
+		err := fn(ctx)
+		if err != nil {
+			h.nextQueued(usn) // No session started to wait for
+		}
+		return err
+	}
+
+	h.sessions.mu.Lock()
+	if h.sessions.m[usn] == nil && len(h.sessions.queue[usn]) == 0 {
+		h.sessions.mu.Unlock()
+		h.runJob(job, run)
+		return job
+	}
+	queued := h.jobs.update(job.ID, JobQueued, nil)
+	h.sessions.queue[usn] = append(h.sessions.queue[usn], &queuedCast{job: queued, fn: run})
+	h.sessions.mu.Unlock()
+	h.events.publish("job", queued)
+	return queued
+}
+
+// nextQueued starts the next cast queued on usn unless a session is
+// playing there.
+func (h *Handler) nextQueued(usn string) {
+	h.sessions.mu.Lock()
+	q := h.sessions.queue[usn]
+	if h.sessions.m[usn] != nil || len(q) == 0 {
+		h.sessions.mu.Unlock()
+		return
+	}
+	next := q[0]
+	if len(q) == 1 {
+		delete(h.sessions.queue, usn)
+	} else {
+		h.sessions.queue[usn] = q[1:]
+	}
+	h.sessions.mu.Unlock()
+	h.runJob(next.job, next.fn)
+}
+
+// clearQueue fails the casts queued on usn, e.g. when it is stopped.
+func (h *Handler) clearQueue(usn string) {
+	h.sessions.mu.Lock()
+	q := h.sessions.queue[usn]
+	delete(h.sessions.queue, usn)
+	delete(h.sessions.played, usn)
+	h.sessions.mu.Unlock()
+	for _, c := range q {
+		failed := h.jobs.update(c.job.ID, JobFailed, errors.New("cancelled: the device was stopped"))
+		h.events.publish("job", failed)
+		h.audit.finishJob(c.job.ID, errors.New("cancelled"))
+	}
+}
+
+// cancelSessionTimer cancels the timer set for s if it is still pending.
+func (h *Handler) cancelSessionTimer(s *Session) {
+	h.sessions.mu.Lock()
+	t := s.timer
+	s.timer = nil
+	h.sessions.mu.Unlock()
+	if t == nil {
+		return
+	}
+	h.timers.mu.Lock()
+	if h.timers.m[s.Device] == t {
+		t.timer.Stop()
+		delete(h.timers.m, s.Device)
+	}
+	h.timers.mu.Unlock()
+}
+
+// session returns a snapshot of the session with id, with its playback
+// state, or nil.
+func (h *Handler) session(id string) *Session {
+	for _, s := range h.listSessions() {
+		if s.ID == id {
+			return &s
+		}
+	}
+	return nil
+}
+
+// listSessions returns snapshots of all sessions, oldest first.
+func (h *Handler) listSessions() []Session {
+	h.sessions.mu.Lock()
+	list := make([]Session, 0, len(h.sessions.m))
+	for _, s := range h.sessions.m {
+		c := *s
+		c.Timer = s.timer
+		c.Queued = len(h.sessions.queue[s.Device])
+		list = append(list, c)
+	}
+	h.sessions.mu.Unlock()
+
+	h.checkpoints.mu.Lock()
+	for i, s := range list {
+		if p, ok := h.checkpoints.progress[s.Device]; ok && p.URL == s.URL {
+			list[i].State, list[i].Position = p.State, p.Position
+		}
+	}
+	h.checkpoints.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// requester identifies the client of r for session locks: its token name,
+// or its IP on an open API.
+func requester(r *http.Request) string {
+	if t := requestTokenOf(r); t != nil {
+		return t.name
+	}
+	return clientIP(r)
+}
+
+// checkSession rejects a control request with 409 if another client has
+// locked the session on device. Reads always pass.
+func (h *Handler) checkSession(w http.ResponseWriter, r *http.Request, device *dlna.Device) bool {
+	if !controlsDevice(r) {
+		return true
+	}
+	h.sessions.mu.Lock()
+	s := h.sessions.m[device.USN]
+	var owner string
+	if s != nil {
+		owner = s.LockedBy
+	}
+	h.sessions.mu.Unlock()
+	if owner != "" && owner != requester(r) {
+		http.Error(w, fmt.Sprintf("%s is locked by %s", device.FriendlyName, owner), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// selectSession looks up the session of the {id} path value and the device
+// playing it, writing the error if either is gone or may not be used.
+func (h *Handler) selectSession(w http.ResponseWriter, r *http.Request) (*Session, *dlna.Device) {
+	s := h.session(r.PathValue("id"))
+	if s == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return nil, nil
+	}
+	device := h.discovery.GetDevice(s.Device)
+	if device == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return nil, nil
+	}
+	if !checkDevice(w, r, device) || !h.checkSession(w, r, device) {
+		return nil, nil
+	}
+	return s, device
+}
+
+// ListSessionsHandler returns the active sessions. Tokens limited to some
+// devices only see theirs.
+func (h *Handler) ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	t := requestTokenOf(r)
+	list := []Session{}
+	for _, s := range h.listSessions() {
+		if device := h.discovery.GetDevice(s.Device); device == nil || t.allows(device) {
+			list = append(list, s)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (h *Handler) GetSessionHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := h.selectSession(w, r)
+	if s == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// StopSessionHandler stops the renderer playing a session and drops the
+// casts queued behind it.
+func (h *Handler) StopSessionHandler(w http.ResponseWriter, r *http.Request) {
+	s, device := h.selectSession(w, r)
+	if s == nil {
+		return
+	}
+	if err := h.avTransport(device).Stop(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to stop: %v", err), http.StatusBadGateway)
+		return
+	}
+	h.clearQueue(s.Device)
+	h.endSession(s.Device, s.ID)
+	log.Printf("Session %s stopped on %s", s.ID, device.FriendlyName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StopAllSessionsHandler stops every session the client may control.
+// Sessions of devices it may not use, or locked by others, are skipped
+// and listed in the response with the reason.
+func (h *Handler) StopAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	type result struct {
+		ID     string `json:"id"`
+		Device string `json:"device"`
+		Error  string `json:"error,omitempty"`
+	}
+	results := []result{}
+	for _, s := range h.listSessions() {
+		res := result{ID: s.ID, Device: s.Device}
+		device := h.discovery.GetDevice(s.Device)
+		switch {
+		case device == nil:
+			res.Error = "device not found"
+		case !requestTokenOf(r).allows(device):
+			res.Error = "not allowed for this token"
+		case s.LockedBy != "" && s.LockedBy != requester(r):
+			res.Error = "locked by " + s.LockedBy
+		default:
+			auditDevice(r, device)
+			if err := h.avTransport(device).Stop(); err != nil {
+				res.Error = err.Error()
+			} else {
+				h.clearQueue(s.Device)
+				h.endSession(s.Device, s.ID)
+			}
+		}
+		results = append(results, res)
+	}
+	log.Printf("Stop all: %d sessions", len(results))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// SessionTimerHandler sets a sleep timer that only applies to this session:
+// it is dropped if another cast replaces the session first.
+func (h *Handler) SessionTimerHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		After  string `json:"after"`  // Go duration, e.g. "45m"
+		Action string `json:"action"` // "stop" (default) or "pause"
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after, err := time.ParseDuration(req.After)
+	if err != nil || after <= 0 {
+		http.Error(w, fmt.Sprintf("Invalid duration %q", req.After), http.StatusBadRequest)
+		return
+	}
+	if req.Action == "" {
+		req.Action = "stop"
+	}
+	if req.Action != "stop" && req.Action != "pause" {
+		http.Error(w, "Action must be stop or pause", http.StatusBadRequest)
+		return
+	}
+
+	s, device := h.selectSession(w, r)
+	if s == nil {
+		return
+	}
+	t := h.setTimer(device, after, req.Action, 0)
+	h.sessions.mu.Lock()
+	if cur := h.sessions.m[s.Device]; cur != nil && cur.ID == s.ID {
+		cur.timer = t
+	}
+	h.sessions.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// LockSessionHandler gives the client exclusive control of the session's
+// device: casts and controls from other clients get 409 until it unlocks
+// or the device stops playing.
+func (h *Handler) LockSessionHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := h.selectSession(w, r)
+	if s == nil {
+		return
+	}
+	h.setSessionLock(s, requester(r))
+	s.LockedBy = requester(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// UnlockSessionHandler releases a lock. Other clients than its holder need
+// ?force=1.
+func (h *Handler) UnlockSessionHandler(w http.ResponseWriter, r *http.Request) {
+	s := h.session(r.PathValue("id"))
+	if s == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if !h.checkDeviceUSN(w, r, s.Device) {
+		return
+	}
+	if s.LockedBy != "" && s.LockedBy != requester(r) && r.URL.Query().Get("force") != "1" {
+		http.Error(w, "Locked by "+s.LockedBy+"; use force=1 to take it over", http.StatusConflict)
+		return
+	}
+	if s.LockedBy != "" && s.LockedBy != requester(r) {
+		log.Printf("Session %s: lock of %s broken by %s", s.ID, s.LockedBy, requester(r))
+	}
+	h.setSessionLock(s, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) setSessionLock(s *Session, owner string) {
+	h.sessions.mu.Lock()
+	if cur := h.sessions.m[s.Device]; cur != nil && cur.ID == s.ID {
+		cur.LockedBy = owner
+	}
+	h.sessions.mu.Unlock()
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"dlna/dlna"
+	"dlna/store"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const deviceSettingsKey = "device_settings"
+
+// Seek modes for DeviceSettings.SeekMode.
+const (
+	seekRelTime = "rel_time"
+	seekAbsTime = "abs_time"
+	seekNone    = "none"
+)
+
+// DeviceSettings are per-renderer preferences that casts consult. The zero
+// value means defaults everywhere.
+type DeviceSettings struct {
+	Profile   string `json:"profile,omitempty"`    // Default casting profile, see Profile
+	MaxVolume int    `json:"max_volume,omitempty"` // Volume cap 1-100; 0 is no cap
+	// SeekMode is how resume seeks: "rel_time" (default), "abs_time" for
+	// renderers that reject REL_TIME, or "none" for ones that break on Seek.
+	SeekMode  string `json:"seek_mode,omitempty"`
+	Subtitles bool   `json:"subtitles,omitempty"` // Renderer shows external subtitle files
+	// Probe fetches the duration, size and type of media before casting
+	// it, for renderers that show no duration or cannot seek without.
+	Probe bool `json:"probe,omitempty"`
+	// StopBeforeSet is whether casts stop the current media first: "auto"
+	// (default, only when the renderer rejects the new URI), "always" or
+	// "never". Models with the stop_before_set quirk default to "always".
+	StopBeforeSet dlna.StopMode `json:"stop_before_set,omitempty"`
+	// IdleOff, e.g. "30m", stops the renderer and switches it to standby
+	// (where supported) once it has been stopped this long after a cast.
+	IdleOff string `json:"idle_off,omitempty"`
+	// Reconcile plays casts again that the renderer drops before their
+	// end, e.g. TVs on flaky Wi-Fi, at most 3 times in a row.
+	Reconcile bool `json:"reconcile,omitempty"`
+	// RestartStalled restarts casts whose position stands still while
+	// playing, at most 3 times, at the position they stalled at.
+	RestartStalled bool `json:"restart_stalled,omitempty"`
+
+	// Quirks overrides the built-in workarounds for the device's model:
+	// true enables a quirk, false disables a built-in one.
+	Quirks dlna.Quirks `json:"quirks,omitempty"`
+}
+
+func (s DeviceSettings) isZero() bool {
+	return s.Profile == "" && s.MaxVolume == 0 && s.SeekMode == "" && !s.Subtitles && !s.Probe &&
+		s.StopBeforeSet == "" && s.IdleOff == "" && !s.Reconcile && !s.RestartStalled && len(s.Quirks) == 0
+}
+
+func (s DeviceSettings) validate() error {
+	switch s.SeekMode {
+	case "", seekRelTime, seekAbsTime, seekNone:
+	default:
+		return fmt.Errorf("Invalid seek_mode %q", s.SeekMode)
+	}
+	switch s.StopBeforeSet {
+	case "", dlna.StopAuto, dlna.StopAlways, dlna.StopNever:
+	default:
+		return fmt.Errorf("Invalid stop_before_set %q", s.StopBeforeSet)
+	}
+	if s.IdleOff != "" {
+		if d, err := time.ParseDuration(s.IdleOff); err != nil || d < time.Minute {
+			return fmt.Errorf("Invalid idle_off %q (at least 1m)", s.IdleOff)
+		}
+	}
+	if s.MaxVolume < 0 || s.MaxVolume > 100 {
+		return fmt.Errorf("Invalid max_volume %d", s.MaxVolume)
+	}
+	return dlna.ValidateQuirks(s.Quirks)
+}
+
+type deviceSettings struct {
+	mu    sync.Mutex
+	store store.Store
+	m     map[string]DeviceSettings // USN -> settings
+}
+
+func newDeviceSettings(st store.Store) *deviceSettings {
+	s := &deviceSettings{store: st, m: make(map[string]DeviceSettings)}
+	if _, err := st.Get(deviceSettingsKey, &s.m); err != nil {
+		log.Printf("Failed to load device settings: %v", err)
+	}
+	if s.m == nil {
+		s.m = make(map[string]DeviceSettings)
+	}
+	return s
+}
+
+// saveLocked persists all settings. Callers must hold s.mu.
+func (s *deviceSettings) saveLocked() {
+	if err := s.store.Set(deviceSettingsKey, s.m); err != nil {
+		log.Printf("Failed to save device settings: %v", err)
+	}
+}
+
+// get returns the settings for usn, or the zero value.
+func (s *deviceSettings) get(usn string) DeviceSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[usn]
+}
+
+// quirks returns the workarounds in effect for device: the built-in ones
+// for its model with the user's overrides applied.
+func (h *Handler) quirks(device *dlna.Device) dlna.Quirks {
+	return device.Quirks.With(h.settings.get(device.USN).Quirks)
+}
+
+// stopMode picks how a cast replaces the current media on device.
+func (h *Handler) stopMode(device *dlna.Device, quirks dlna.Quirks) dlna.StopMode {
+	if mode := h.settings.get(device.USN).StopBeforeSet; mode != "" {
+		return mode
+	}
+	if quirks.Has(dlna.QuirkStopBeforeSet) {
+		return dlna.StopAlways
+	}
+	return dlna.StopAuto
+}
+
+// load replaces the media on device with url and plays it, working around
+// the device's quirks: metaData is left out for no_metadata, and the
+// current media stopped as stopMode says. dlna_flags goes into the
+// metadata, so callers that build it set Metadata.DLNAFlags themselves,
+// see metadataFor. Nothing is loaded once ctx is done, e.g. when the job
+// casting timed out, and the SOAP calls of the load are bound to ctx.
+func (h *Handler) load(ctx context.Context, device *dlna.Device, avt *dlna.AVTransport, url, metaData string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	quirks := h.quirks(device)
+	if quirks.Has(dlna.QuirkNoMetadata) {
+		metaData = ""
+	}
+	bound := *avt
+	bound.Client = contextClient{ctx: ctx, client: avt.Client}
+	return bound.Load(url, metaData, h.stopMode(device, quirks))
+}
+
+// metadataFor sets DLNAFlags on meta if device needs the dlna_flags quirk.
+func (h *Handler) metadataFor(device *dlna.Device, meta dlna.Metadata) dlna.Metadata {
+	meta.DLNAFlags = meta.DLNAFlags || h.quirks(device).Has(dlna.QuirkDLNAFlags)
+	return meta
+}
+
+func (h *Handler) GetDeviceSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	usn := r.PathValue("usn")
+	if h.discovery.GetDevice(usn) == nil {
+		http.Error(w, errDeviceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.settings.get(usn))
+}
+
+// PutDeviceSettingsHandler replaces the settings of a device. Fields left
+// out are reset to their defaults.
+func (h *Handler) PutDeviceSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	usn := r.PathValue("usn")
+	if h.discovery.GetDevice(usn) == nil {
+		http.Error(w, errDeviceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	var s DeviceSettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	if v.text("profile", s.Profile, maxNameLength) && s.Profile != "" && !h.hasProfile(s.Profile) {
+		v.fail("profile", "unknown profile %q", s.Profile)
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if err := s.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.settings.mu.Lock()
+	if s.isZero() {
+		delete(h.settings.m, usn)
+	} else {
+		h.settings.m[usn] = s
+	}
+	h.settings.saveLocked()
+	h.settings.mu.Unlock()
+
+	log.Printf("Device settings saved for %s: %+v", usn, s)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"dlna/dlna"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// playedEntry is the history entry of the cast of session s, for the list
+// of casts played from the queue.
+func (h *Handler) playedEntry(s *Session) HistoryEntry {
+	if e := h.history.last(s.Device); e != nil && e.URL == s.URL {
+		return *e
+	}
+	return HistoryEntry{URL: s.URL, Title: s.Title, Device: s.Device, DeviceName: s.DeviceName}
+}
+
+// replay casts a history entry again from the start.
+func (h *Handler) replay(ctx context.Context, device *dlna.Device, entry HistoryEntry) error {
+	if err := h.wake(device); err != nil {
+		return err
+	}
+	metaData := entry.Metadata
+	if metaData == "" {
+		var err error
+		if metaData, err = h.metadataFor(device, dlna.Metadata{Title: entry.Title}).DIDL(entry.URL); err != nil {
+			return err
+		}
+	}
+	h.checkpoint(device)
+	if err := h.load(ctx, device, h.avTransport(device), entry.URL, metaData); err != nil {
+		return fmt.Errorf("failed to cast: %w", err)
+	}
+	h.recordCast(device, entry.URL, entry.Title, entry.Metadata, "")
+	log.Printf("Casting to %s again: URL=%s, Title=%s", device.FriendlyName, entry.URL, entry.Title)
+	return nil
+}
+
+// replayQueued replays entry as a cast of the queue: if it fails, the
+// next queued cast plays instead.
+func (h *Handler) replayQueued(device *dlna.Device, entry HistoryEntry) func(context.Context) error {
+	return func(ctx context.Context) error {
+		err := h.replay(ctx, device, entry)
+		if err != nil {
+			h.nextQueued(device.USN)
+		}
+		return err
+	}
+}
+
+// decodeSkip reads the optional {"usn": ...} body of /api/next and
+// /api/previous and selects the device.
+func (h *Handler) decodeSkip(w http.ResponseWriter, r *http.Request) *dlna.Device {
+	var req struct {
+		USN string `json:"usn"` // Optional
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	return h.selectDevice(w, r, req.USN)
+}
+
+// NextHandler skips to the next cast queued on the device, or, with
+// nothing queued, sends AVTransport Next for the renderer's own playlist.
+func (h *Handler) NextHandler(w http.ResponseWriter, r *http.Request) {
+	device := h.decodeSkip(w, r)
+	if device == nil {
+		return
+	}
+
+	h.sessions.mu.Lock()
+	s := h.sessions.m[device.USN]
+	var next *Job
+	if q := h.sessions.queue[device.USN]; s != nil && len(q) > 0 {
+		next = q[0].job
+	}
+	h.sessions.mu.Unlock()
+	if next != nil {
+		// Ending the session starts the next cast, which replaces the
+		// current one on the renderer.
+		h.endSession(device.USN, s.ID)
+		log.Printf("Skipped to the next queued cast on %s", device.FriendlyName)
+		writeJob(w, r, h.jobs.get(next.ID))
+		return
+	}
+
+	if !requireActions(w, device, "Next") {
+		return
+	}
+	if err := h.avTransport(device).Next(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to skip: %v", err), http.StatusBadGateway)
+		return
+	}
+	log.Printf("Next track on %s", device.FriendlyName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PreviousHandler casts again what played before the current cast from
+// the queue, putting the current one back at the head of the queue. With
+// no such cast it sends AVTransport Previous for the renderer's own
+// playlist.
+func (h *Handler) PreviousHandler(w http.ResponseWriter, r *http.Request) {
+	device := h.decodeSkip(w, r)
+	if device == nil {
+		return
+	}
+
+	h.sessions.mu.Lock()
+	s := h.sessions.m[device.USN]
+	played := h.sessions.played[device.USN]
+	var prev HistoryEntry
+	var requeued *Job
+	if s != nil && len(played) > 0 {
+		prev = played[len(played)-1]
+		h.sessions.played[device.USN] = played[:len(played)-1]
+		cur := h.playedEntry(s)
+		requeued = h.jobs.update(h.jobs.create(device.USN, cur.URL, cur.Title).ID, JobQueued, nil)
+		c := &queuedCast{job: requeued, fn: h.replayQueued(device, cur)}
+		h.sessions.queue[device.USN] = append([]*queuedCast{c}, h.sessions.queue[device.USN]...)
+	}
+	h.sessions.mu.Unlock()
+	if requeued != nil {
+		h.events.publish("job", requeued)
+		job := h.jobs.create(device.USN, prev.URL, prev.Title)
+		h.runJob(job, h.replayQueued(device, prev))
+		log.Printf("Back to the previous cast on %s", device.FriendlyName)
+		writeJob(w, r, job)
+		return
+	}
+
+	if !requireActions(w, device, "Previous") {
+		return
+	}
+	if err := h.avTransport(device).Previous(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to go back: %v", err), http.StatusBadGateway)
+		return
+	}
+	log.Printf("Previous track on %s", device.FriendlyName)
+	w.WriteHeader(http.StatusNoContent)
+}
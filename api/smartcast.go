@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"dlna/dlna"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SmartCastHandler runs a whole scene in one call, for home automation:
+// wake the device and wait for it to be discovered, switch a TV's input,
+// set the volume, cast the URL and optionally schedule a stop. The steps
+// run as a job; a failing step fails the job.
+func (h *Handler) SmartCastHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL         string `json:"url"`
+		USN         string `json:"usn"`           // Optional
+		Title       string `json:"title"`         // Optional
+		Artist      string `json:"artist"`        // Optional
+		Album       string `json:"album"`         // Optional
+		AlbumArtURL string `json:"album_art_url"` // Optional
+		Duration    string `json:"duration"`      // Optional, "1:23:45" or "83m"
+		Input       string `json:"input"`         // Optional, overrides the TV's configured input
+		Volume      *int   `json:"volume"`        // Optional, 0-100
+		StopAfter   string `json:"stop_after"`    // Optional sleep timer, e.g. "45m"
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	if v.required("url", req.URL) {
+		v.url("url", req.URL)
+	}
+	v.text("title", req.Title, maxTextLength)
+	v.text("artist", req.Artist, maxTextLength)
+	v.text("album", req.Album, maxTextLength)
+	v.url("album_art_url", req.AlbumArtURL)
+	v.text("input", req.Input, maxNameLength)
+	if req.Volume != nil && (*req.Volume < 0 || *req.Volume > 100) {
+		v.fail("volume", "must be 0-100")
+	}
+	var stopAfter time.Duration
+	if req.StopAfter != "" {
+		d, err := time.ParseDuration(req.StopAfter)
+		if err != nil || d <= 0 {
+			v.fail("stop_after", "must be a positive duration")
+		}
+		stopAfter = d
+	}
+	duration, err := parseMediaDuration(req.Duration)
+	if err != nil {
+		v.fail("duration", "must be H:MM:SS or a duration such as 83m")
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if !checkUSN(w, req.USN) {
+		return
+	}
+	meta := dlna.Metadata{
+		Title:       req.Title,
+		Artist:      req.Artist,
+		Album:       req.Album,
+		AlbumArtURL: req.AlbumArtURL,
+		Duration:    duration,
+	}
+
+	// A TV that was off when the agent started has never been discovered;
+	// with a host configured, its vendor adapter can still switch it on.
+	device, err := h.resolveDevice(req.USN)
+	if err == errDeviceNotFound && h.tvHost(req.USN) != "" {
+		device = &dlna.Device{USN: req.USN, FriendlyName: req.USN}
+		err = nil
+	}
+	switch err {
+	case nil:
+	case errNoDevice:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !checkDevice(w, r, device) {
+		return
+	}
+
+	job := h.jobs.create(device.USN, req.URL, req.Title)
+	h.runJob(job, func(ctx context.Context) error {
+		if device.Location != "" {
+			if err := h.wake(device); err != nil {
+				return err
+			}
+		}
+		h.prepareTV(device, req.Input)
+		device, err := h.waitOnline(device.USN, wakeTimeout)
+		if err != nil {
+			return err
+		}
+		if !device.Supports("SetAVTransportURI") || !device.Supports("Play") {
+			return fmt.Errorf("%s cannot play casts", device.FriendlyName)
+		}
+
+		if req.Volume != nil {
+			rc, err := h.renderingControl(device)
+			if err != nil {
+				return err
+			}
+			h.cancelFade(device.USN)
+			if err := rc.SetVolume(h.capVolume(device, *req.Volume)); err != nil {
+				return fmt.Errorf("failed to set volume: %w", err)
+			}
+		}
+		if err := h.loadURL(ctx, device, dlna.CastRequest{URL: req.URL, Metadata: meta}, nil, false, castOptions{}); err != nil {
+			return err
+		}
+		if stopAfter > 0 {
+			h.setTimer(device, stopAfter, "stop", 0)
+		}
+		return nil
+	})
+
+	writeJob(w, r, job)
+}
+
+// waitOnline waits until discovery has seen the device online, e.g. after
+// a TV was switched on.
+func (h *Handler) waitOnline(usn string, timeout time.Duration) (*dlna.Device, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if d := h.discovery.GetDevice(usn); d != nil && d.Online {
+			return d, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("device %s did not come online within %s", usn, timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
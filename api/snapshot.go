@@ -0,0 +1,62 @@
+package api
+
+import (
+	"dlna/dlna"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+const devicesKey = "devices"
+
+// saveDevices persists the device table for RestoreDevices.
+func (h *Handler) saveDevices() {
+	if err := h.store.Set(devicesKey, h.discovery.Snapshot()); err != nil {
+		log.Printf("Failed to save devices: %v", err)
+	}
+}
+
+// RestoreDevices adds the devices saved at the last run, so renderers can
+// be cast to before they announce themselves again.
+func (h *Handler) RestoreDevices() {
+	var snap dlna.Snapshot
+	ok, err := h.store.Get(devicesKey, &snap)
+	if err != nil {
+		log.Printf("Failed to load devices: %v", err)
+	}
+	if ok {
+		h.discovery.Restore(snap)
+	}
+}
+
+// ExportDevicesHandler returns the device table with descriptions and
+// capabilities, for POST /api/devices/snapshot on another agent or later.
+func (h *Handler) ExportDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	snap := h.discovery.Snapshot()
+	if t := requestTokenOf(r); t != nil {
+		allowed := snap.Devices[:0]
+		for i := range snap.Devices {
+			if t.allows(&snap.Devices[i]) {
+				allowed = append(allowed, snap.Devices[i])
+			}
+		}
+		snap.Devices = allowed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="devices.json"`)
+	json.NewEncoder(w).Encode(snap)
+}
+
+// ImportDevicesHandler adds the unknown devices of a snapshot. Known ones
+// are left as discovered.
+func (h *Handler) ImportDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	var snap dlna.Snapshot
+	if err := json.NewDecoder(r.Body).Decode(&snap); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	added := h.discovery.Restore(snap)
+	h.saveDevices()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"added": added})
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"dlna/dlna"
+	"fmt"
+	"log"
+	"time"
+)
+
+// stallTimeout is how long the position of a playing cast may stand still
+// before it counts as stalled. Tests shorten it.
+var stallTimeout = 30 * time.Second
+
+// stallMaxRestarts bounds the restarts of a stalled cast.
+const stallMaxRestarts = 3
+
+// EventCastStalled is sent when a cast stalls; see CastStalled.
+const EventCastStalled = "cast-stalled"
+
+// CastStalled is the payload of cast-stalled events.
+type CastStalled struct {
+	Device     string `json:"device"` // USN
+	DeviceName string `json:"device_name"`
+	URL        string `json:"url"`
+	Title      string `json:"title,omitempty"`
+	Position   string `json:"position"` // Where it stands still
+	// Restart is the restart attempt that follows, 0 if none does.
+	Restart int `json:"restart,omitempty"`
+}
+
+// stallDetector watches the position of a cast for standing still while
+// the renderer says PLAYING, e.g. when it ran out of buffer.
+type stallDetector struct {
+	position string    // Last position seen playing
+	since    time.Time // When it was first seen
+	moved    bool      // The position advanced during the cast
+	stalled  bool      // The stall was reported
+}
+
+// update records a poll and reports whether the cast just stalled. Casts
+// whose position never advanced are not watched: some renderers report a
+// fixed position for live streams.
+func (s *stallDetector) update(state, position string, now time.Time) bool {
+	if state != "PLAYING" || !validPosition(position) {
+		s.reset()
+		return false
+	}
+	if position != s.position {
+		s.moved = s.moved || s.position != ""
+		s.position, s.since, s.stalled = position, now, false
+		return false
+	}
+	if !s.moved || s.stalled || now.Sub(s.since) < stallTimeout {
+		return false
+	}
+	s.stalled = true
+	return true
+}
+
+// reset forgets the position, e.g. after the cast was loaded again.
+func (s *stallDetector) reset() {
+	s.position, s.stalled = "", false
+}
+
+// restartStalled loads url on device again (Stop, SetAVTransportURI,
+// Play) and seeks back to position.
+func (h *Handler) restartStalled(device *dlna.Device, avt *dlna.AVTransport, url, metadata, position string) error {
+	if h.quirks(device).Has(dlna.QuirkNoMetadata) {
+		metadata = ""
+	}
+	if err := avt.Load(url, metadata, dlna.StopAlways); err != nil {
+		return fmt.Errorf("failed to restart %s: %w", url, err)
+	}
+	if mode := h.settings.get(device.USN).SeekMode; mode != seekNone {
+		if err := seekWhenReady(avt, mode, position); err != nil {
+			log.Printf("Failed to seek %s back to %s: %v", device.FriendlyName, position, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"dlna/dlna"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SleepTimer stops or pauses a renderer at FiresAt.
+type SleepTimer struct {
+	Device  string    `json:"device"` // USN
+	Action  string    `json:"action"` // "stop" or "pause"
+	FiresAt time.Time `json:"fires_at"`
+	// Fade, if set, fades the volume out over this long before FiresAt;
+	// the volume is restored after the stop.
+	Fade string `json:"fade,omitempty"`
+
+	timer *time.Timer
+}
+
+// timers holds at most one sleep timer per device.
+type timers struct {
+	mu sync.Mutex
+	m  map[string]*SleepTimer
+}
+
+func newTimers() *timers {
+	return &timers{m: make(map[string]*SleepTimer)}
+}
+
+// setTimer schedules action on device after d, replacing an existing timer.
+// A non-zero fade (at most d) fades the volume out before the action.
+func (h *Handler) setTimer(device *dlna.Device, d time.Duration, action string, fade time.Duration) *SleepTimer {
+	t := &SleepTimer{Device: device.USN, Action: action, FiresAt: time.Now().Add(d)}
+	if fade > 0 {
+		t.Fade = fade.String()
+	}
+
+	h.timers.mu.Lock()
+	if prev, ok := h.timers.m[device.USN]; ok {
+		prev.timer.Stop()
+	}
+	h.timers.m[device.USN] = t
+	t.timer = time.AfterFunc(d-fade, func() { h.fireTimer(t, fade) })
+	h.timers.mu.Unlock()
+
+	log.Printf("Sleep timer: %s %s at %s", action, device.FriendlyName, t.FiresAt.Format(time.Kitchen))
+	return t
+}
+
+func (h *Handler) fireTimer(t *SleepTimer, fade time.Duration) {
+	h.timers.mu.Lock()
+	if h.timers.m[t.Device] != t {
+		h.timers.mu.Unlock()
+		return
+	}
+	delete(h.timers.m, t.Device)
+	h.timers.mu.Unlock()
+
+	device := h.discovery.GetDevice(t.Device)
+	if device == nil {
+		log.Printf("Sleep timer: device %s not found", t.Device)
+		return
+	}
+
+	// Fade out, act, then restore the volume for the next cast
+	restore := -1
+	if fade > 0 {
+		if rc, err := h.renderingControl(device); err == nil {
+			if v, err := rc.GetVolume(); err == nil {
+				restore = v
+			}
+			if err := h.fadeVolume(device, restore, 0, fade); err == errFadeCancelled {
+				log.Printf("Sleep timer on %s: fade cancelled, not stopping", device.FriendlyName)
+				return
+			} else if err != nil {
+				log.Printf("Sleep timer fade failed on %s: %v", device.FriendlyName, err)
+			}
+		}
+	}
+
+	var err error
+	if t.Action == "pause" {
+		err = h.avTransport(device).Pause()
+	} else {
+		h.expectStop(device.USN)
+		err = h.avTransport(device).Stop()
+	}
+	if restore >= 0 {
+		if rc, rerr := h.renderingControl(device); rerr == nil {
+			rc.SetVolume(restore)
+		}
+	}
+	if err != nil {
+		log.Printf("Sleep timer failed on %s: %v", device.FriendlyName, err)
+		return
+	}
+	log.Printf("Sleep timer fired: %s %s", t.Action, device.FriendlyName)
+	h.events.publish("timer", t)
+}
+
+func (h *Handler) cancelTimer(usn string) bool {
+	h.timers.mu.Lock()
+	defer h.timers.mu.Unlock()
+	t, ok := h.timers.m[usn]
+	if ok {
+		t.timer.Stop()
+		delete(h.timers.m, usn)
+	}
+	return ok
+}
+
+func (h *Handler) ListTimersHandler(w http.ResponseWriter, r *http.Request) {
+	h.timers.mu.Lock()
+	list := make([]*SleepTimer, 0, len(h.timers.m))
+	for _, t := range h.timers.m {
+		list = append(list, t)
+	}
+	h.timers.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (h *Handler) SetTimerHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		USN    string `json:"usn"`    // Optional
+		After  string `json:"after"`  // Go duration, e.g. "45m"
+		Action string `json:"action"` // "stop" (default) or "pause"
+		Fade   string `json:"fade"`   // Optional fade-out before the action, e.g. "30s"
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	after, err := time.ParseDuration(req.After)
+	if err != nil || after <= 0 {
+		http.Error(w, fmt.Sprintf("Invalid duration %q", req.After), http.StatusBadRequest)
+		return
+	}
+	var fade time.Duration
+	if req.Fade != "" {
+		if fade, err = time.ParseDuration(req.Fade); err != nil || fade <= 0 || fade > after {
+			http.Error(w, fmt.Sprintf("Invalid fade %q", req.Fade), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Action == "" {
+		req.Action = "stop"
+	}
+	if req.Action != "stop" && req.Action != "pause" {
+		http.Error(w, "Action must be stop or pause", http.StatusBadRequest)
+		return
+	}
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil {
+		return
+	}
+	action := "Stop"
+	if req.Action == "pause" {
+		action = "Pause"
+	}
+	if !requireActions(w, device, action) {
+		return
+	}
+
+	t := h.setTimer(device, after, req.Action, fade)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+func (h *Handler) CancelTimerHandler(w http.ResponseWriter, r *http.Request) {
+	usn := r.URL.Query().Get("usn")
+	if !h.checkDeviceUSN(w, r, usn) {
+		return
+	}
+	if !h.cancelTimer(usn) {
+		http.Error(w, "No timer for device", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Timer cancelled for %s", usn)
+}
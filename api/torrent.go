@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"dlna/library"
+	"dlna/torrent"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// torrentWait bounds fetching a magnet link's metadata and buffering
+	// the start of its film before casting.
+	torrentWait = 5 * time.Minute
+	// defaultTorrentBuffer is downloaded before a torrent is cast.
+	defaultTorrentBuffer = 16 << 20
+)
+
+// SetTorrentConfig configures how magnet links are streamed; buffer is
+// how much of a film is downloaded before casting it, with 0 for the
+// default.
+func (h *Handler) SetTorrentConfig(cfg torrent.Config, buffer int64) {
+	if buffer <= 0 {
+		buffer = defaultTorrentBuffer
+	}
+	h.torrents.SetConfig(cfg)
+	h.mu.Lock()
+	h.torrentBuffer = buffer
+	h.mu.Unlock()
+}
+
+// streamTorrent replaces the magnet link of req with the URL of the
+// largest video file of the torrent, served by the agent while it
+// downloads. It returns once the start and end of the file are in.
+func (h *Handler) streamTorrent(device *dlna.Device, req *dlna.CastRequest) error {
+	m, err := torrent.ParseMagnet(req.URL)
+	if err != nil {
+		return err
+	}
+	base, err := h.agentURL(device)
+	if err != nil {
+		return err
+	}
+	t, err := h.torrents.Add(m)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), torrentWait)
+	defer cancel()
+	if err := t.WaitInfo(ctx); err != nil {
+		return fmt.Errorf("failed to fetch the torrent's metadata: %w", err)
+	}
+	f, ok := largestVideo(t.Files())
+	if !ok {
+		return errors.New("the torrent has no video file")
+	}
+	t.Select(f)
+	h.mu.RLock()
+	buffer := h.torrentBuffer
+	h.mu.RUnlock()
+	log.Printf("Buffering %s from torrent %s", f.Path, t.InfoHash())
+	if err := t.WaitBuffered(ctx, buffer); err != nil {
+		return fmt.Errorf("failed to buffer the torrent: %w", err)
+	}
+
+	req.URL = torrentURL(base, t.InfoHash(), f.Path)
+	if req.Metadata.Title == "" {
+		name := path.Base(f.Path)
+		req.Metadata.Title = name[:len(name)-len(path.Ext(name))]
+	}
+	if req.Metadata.Class == "" {
+		req.Metadata.Class = didl.ClassVideoItem
+	}
+	if req.Metadata.MimeType == "" {
+		req.Metadata.MimeType = mime.TypeByExtension(path.Ext(f.Path))
+	}
+	return nil
+}
+
+// largestVideo picks the film of a torrent, skipping samples and extras.
+func largestVideo(files []torrent.File) (torrent.File, bool) {
+	var best torrent.File
+	found := false
+	for _, f := range files {
+		if library.MediaType(f.Path) == library.TypeVideo && (!found || f.Length > best.Length) {
+			best, found = f, true
+		}
+	}
+	return best, found
+}
+
+// torrentURL is the URL of a file of a torrent under base.
+func torrentURL(base, infoHash, name string) string {
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return base + "/torrent/" + infoHash + "/" + strings.Join(parts, "/")
+}
+
+// TorrentHandler serves a file of a torrent to renderers while it
+// downloads, with Range support. Reads wait for the pieces they need, and
+// a seek moves the download to where the renderer reads.
+func (h *Handler) TorrentHandler(w http.ResponseWriter, r *http.Request) {
+	t := h.torrents.Get(r.PathValue("hash"))
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	f, ok := t.File(r.PathValue("path"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set(headerTransferMode, "Streaming")
+	w.Header().Set(headerContentFeatures, didl.ContentFeatures("01", didl.FlagsStreaming))
+	rd := t.NewReader(r.Context(), f)
+	defer rd.Close()
+	http.ServeContent(w, r, path.Base(f.Path), time.Time{}, rd)
+}
+
+// ListTorrentsHandler lists the torrents being streamed with their
+// progress.
+func (h *Handler) ListTorrentsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.torrents.List())
+}
+
+// DropTorrentHandler stops a torrent and deletes what it downloaded.
+func (h *Handler) DropTorrentHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.torrents.Drop(r.PathValue("hash")) {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
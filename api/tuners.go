@@ -0,0 +1,205 @@
+package api
+
+import (
+	"context"
+	"dlna/didl"
+	"dlna/dlna"
+	"dlna/hdhomerun"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tunerCacheTTL is how long the channels of the tuners are reused.
+	tunerCacheTTL = 5 * time.Minute
+	// tunerTimeout bounds finding the tuners and fetching their lineups.
+	tunerTimeout = 15 * time.Second
+	// tunerDiscoverWait is how long tuners have to answer a broadcast.
+	tunerDiscoverWait = 2 * time.Second
+)
+
+// TVChannel is a channel of an HDHomeRun tuner.
+type TVChannel struct {
+	Tuner     string `json:"tuner"` // Device ID
+	TunerName string `json:"tuner_name"`
+	Number    string `json:"number"` // Guide number, e.g. "5.1"
+	Name      string `json:"name"`
+	HD        bool   `json:"hd,omitempty"`
+	Favorite  bool   `json:"favorite,omitempty"`
+	DRM       bool   `json:"drm,omitempty"` // Copy-protected, which renderers cannot play
+	URL       string `json:"url"`
+}
+
+// tuners caches the channels of the HDHomeRun tuners.
+type tuners struct {
+	mu       sync.Mutex
+	hosts    []string // Configured tuners; empty discovers them by broadcast
+	channels []TVChannel
+	fetched  time.Time
+}
+
+// SetTuners sets the addresses of the HDHomeRun tuners. Without any,
+// tuners are discovered by broadcast.
+func (h *Handler) SetTuners(hosts []string) {
+	h.tuners.mu.Lock()
+	h.tuners.hosts = hosts
+	h.tuners.channels, h.tuners.fetched = nil, time.Time{}
+	h.tuners.mu.Unlock()
+}
+
+// list returns the channels of every tuner, fetched again once stale or
+// with refresh.
+func (t *tuners) list(ctx context.Context, refresh bool) ([]TVChannel, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !refresh && t.channels != nil && time.Since(t.fetched) < tunerCacheTTL {
+		return t.channels, nil
+	}
+
+	hosts := t.hosts
+	if len(hosts) == 0 {
+		var err error
+		if hosts, err = hdhomerun.Discover(ctx, tunerDiscoverWait); err != nil && len(hosts) == 0 {
+			return nil, fmt.Errorf("failed to discover tuners: %w", err)
+		}
+	}
+	var channels []TVChannel
+	var errs []error
+	for _, host := range hosts {
+		tuner, err := hdhomerun.Lookup(ctx, host)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		lineup, err := tuner.Lineup(ctx)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, c := range lineup {
+			channels = append(channels, TVChannel{
+				Tuner:     tuner.ID,
+				TunerName: tuner.Name,
+				Number:    c.Number,
+				Name:      c.Name,
+				HD:        c.HD != 0,
+				Favorite:  c.Favorite != 0,
+				DRM:       c.DRM != 0,
+				URL:       c.URL,
+			})
+		}
+	}
+	if len(channels) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	for _, err := range errs {
+		log.Printf("Tuner unavailable: %v", err)
+	}
+	slices.SortStableFunc(channels, func(a, b TVChannel) int {
+		if c := strings.Compare(a.Tuner, b.Tuner); c != 0 {
+			return c
+		}
+		return hdhomerun.CompareNumbers(a.Number, b.Number)
+	})
+	if channels == nil {
+		channels = []TVChannel{}
+	}
+	t.channels, t.fetched = channels, time.Now()
+	return channels, nil
+}
+
+// ListTVChannelsHandler lists the channels of the HDHomeRun tuners, only
+// those of one with ?tuner= (device ID), only favorites with
+// ?favorites=true, and fetched anew with ?refresh=true.
+func (h *Handler) ListTVChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ctx, cancel := context.WithTimeout(r.Context(), tunerTimeout)
+	defer cancel()
+	channels, err := h.tuners.list(ctx, q.Get("refresh") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	tuner, favorites := q.Get("tuner"), q.Get("favorites") == "true"
+	out := make([]TVChannel, 0, len(channels))
+	for _, c := range channels {
+		if (tuner == "" || strings.EqualFold(c.Tuner, tuner)) && (!favorites || c.Favorite) {
+			out = append(out, c)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// CastTVHandler casts a live channel of an HDHomeRun tuner, by guide
+// number or name. Renderers fetch the MPEG-TS stream from the tuner.
+func (h *Handler) CastTVHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		USN     string `json:"usn"` // Optional
+		Channel string `json:"channel"`
+		Tuner   string `json:"tuner"` // Optional device ID
+		// Transcode is a profile of tuners that transcode (EXTEND
+		// models), e.g. "mobile", for renderers without MPEG-2 or AC-3.
+		Transcode string `json:"transcode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	v.required("channel", req.Channel)
+	switch req.Transcode {
+	case "", "heavy", "mobile", "internet540", "internet480", "internet360", "internet240":
+	default:
+		v.fail("transcode", "must be heavy, mobile or internet540/480/360/240")
+	}
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), tunerTimeout)
+	defer cancel()
+	channels, err := h.tuners.list(ctx, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	i := slices.IndexFunc(channels, func(c TVChannel) bool {
+		return (req.Tuner == "" || strings.EqualFold(c.Tuner, req.Tuner)) &&
+			(c.Number == req.Channel || strings.EqualFold(c.Name, req.Channel))
+	})
+	if i < 0 {
+		http.Error(w, fmt.Sprintf("Channel %q not found", req.Channel), http.StatusNotFound)
+		return
+	}
+	ch := channels[i]
+	if ch.DRM {
+		http.Error(w, fmt.Sprintf("Channel %s %s is copy-protected", ch.Number, ch.Name), http.StatusBadRequest)
+		return
+	}
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil || !requireActions(w, device, "SetAVTransportURI", "Play") {
+		return
+	}
+
+	streamURL := ch.URL
+	if req.Transcode != "" {
+		streamURL += "?transcode=" + url.QueryEscape(req.Transcode)
+	}
+	meta := dlna.Metadata{Title: ch.Number + " " + ch.Name, Class: didl.ClassVideoBroadcast, MimeType: relayMimeType}
+	job := h.jobs.create(device.USN, streamURL, meta.Title)
+	h.runJob(job, func(ctx context.Context) error {
+		return h.castURL(ctx, device, dlna.CastRequest{URL: streamURL, Metadata: meta}, nil)
+	})
+	writeJob(w, r, job)
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"context"
+	"dlna/config"
+	"dlna/dlna"
+	"dlna/store"
+	"dlna/tv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tvTimeout bounds one vendor API call, leaving time to accept a pairing
+// prompt on the TV.
+const tvTimeout = 30 * time.Second
+
+const tvKeysKey = "tv_keys"
+
+// Capabilities of devices with a vendor adapter, for ?capability=.
+const (
+	capabilityPower = "power"
+	capabilityInput = "input"
+)
+
+// TV is a vendor adapter for a renderer that is a smart TV.
+type TV struct {
+	usn   string
+	typ   string // "webos" or "tizen"
+	host  string // Empty means the host of the device location
+	key   string
+	input string // Switched to before casting, if set
+}
+
+// ParseTVs validates the tvs of the config file.
+func ParseTVs(cfg []config.TV) ([]TV, error) {
+	out := make([]TV, 0, len(cfg))
+	for i, c := range cfg {
+		if c.USN == "" {
+			return nil, fmt.Errorf("tv %d: usn is required", i)
+		}
+		switch c.Type {
+		case "webos":
+		case "tizen":
+			if c.Input != "" && !strings.HasPrefix(c.Input, "KEY_") {
+				return nil, fmt.Errorf("tv %d: tizen inputs are remote keys such as KEY_HDMI1", i)
+			}
+		default:
+			return nil, fmt.Errorf("tv %d: unknown type %q", i, c.Type)
+		}
+		out = append(out, TV{usn: c.USN, typ: c.Type, host: c.Host, key: c.Key, input: c.Input})
+	}
+	return out, nil
+}
+
+// SetTVs replaces the vendor adapters.
+func (h *Handler) SetTVs(tvs []TV) {
+	m := make(map[string]TV, len(tvs))
+	for _, t := range tvs {
+		m[t.usn] = t
+	}
+	h.mu.Lock()
+	h.tvs = m
+	h.mu.Unlock()
+}
+
+// tvKeys persists the pairing keys TVs hand out, so the prompt on the TV
+// only shows once.
+type tvKeys struct {
+	mu    sync.Mutex
+	store store.Store
+	m     map[string]string // USN -> key
+}
+
+func newTVKeys(st store.Store) *tvKeys {
+	k := &tvKeys{store: st, m: make(map[string]string)}
+	if _, err := st.Get(tvKeysKey, &k.m); err != nil {
+		log.Printf("Failed to load TV keys: %v", err)
+	}
+	return k
+}
+
+func (k *tvKeys) get(usn string) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.m[usn]
+}
+
+func (k *tvKeys) set(usn, key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.m[usn] = key
+	if err := k.store.Set(tvKeysKey, k.m); err != nil {
+		log.Printf("Failed to save TV keys: %v", err)
+	}
+}
+
+// tvFor returns the vendor adapter of device and the input to switch to,
+// or nil if it has none.
+func (h *Handler) tvFor(device *dlna.Device) (tv.Controller, string) {
+	h.mu.RLock()
+	t, ok := h.tvs[device.USN]
+	h.mu.RUnlock()
+	if !ok {
+		return nil, ""
+	}
+
+	host := t.host
+	if host == "" {
+		if u, err := url.Parse(device.Location); err == nil {
+			host = u.Hostname()
+		}
+	}
+	key := h.tvKeys.get(device.USN)
+	if key == "" {
+		key = t.key
+	}
+	onKey := func(key string) {
+		log.Printf("Paired with %s", device.FriendlyName)
+		h.tvKeys.set(device.USN, key)
+	}
+	switch t.typ {
+	case "tizen":
+		return &tv.Tizen{Host: host, Key: key, OnKey: onKey}, t.input
+	default:
+		return &tv.WebOS{Host: host, Key: key, OnKey: onKey}, t.input
+	}
+}
+
+// tvHost is the configured host of usn's vendor adapter, if any.
+func (h *Handler) tvHost(usn string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.tvs[usn].host
+}
+
+// prepareTV turns a TV with a vendor adapter on and switches it to input,
+// by default its configured one, before a cast. Failures are logged only:
+// the cast itself tells whether the TV is usable.
+func (h *Handler) prepareTV(device *dlna.Device, input string) {
+	ctl, configured := h.tvFor(device)
+	if ctl == nil {
+		return
+	}
+	if input == "" {
+		input = configured
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tvTimeout)
+	defer cancel()
+
+	err := ctl.PowerOn(ctx)
+	if errors.Is(err, tv.ErrStandby) && device.MAC != "" {
+		err = h.discovery.WakeDevice(device.USN, wakeTimeout)
+	}
+	if err != nil {
+		log.Printf("Failed to power on %s: %v", device.FriendlyName, err)
+		return
+	}
+	if input != "" {
+		if err := ctl.SetInput(ctx, input); err != nil {
+			log.Printf("Failed to switch %s to %s: %v", device.FriendlyName, input, err)
+		}
+	}
+}
+
+// PowerHandler turns a TV with a vendor adapter on or off.
+func (h *Handler) PowerHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		On bool `json:"on"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	device, ctl := h.selectTV(w, r, r.PathValue("usn"))
+	if device == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), tvTimeout)
+	defer cancel()
+	var err error
+	if req.On {
+		if err = ctl.PowerOn(ctx); errors.Is(err, tv.ErrStandby) && device.MAC != "" {
+			err = h.discovery.WakeDevice(device.USN, wakeTimeout)
+		}
+	} else {
+		err = ctl.PowerOff(ctx)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to switch power: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// InputHandler switches a TV with a vendor adapter to an input, by default
+// its configured one.
+func (h *Handler) InputHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Input string `json:"input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var v validator
+	v.text("input", req.Input, maxNameLength)
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	device, ctl := h.selectTV(w, r, r.PathValue("usn"))
+	if device == nil {
+		return
+	}
+	input := req.Input
+	if input == "" {
+		_, input = h.tvFor(device)
+	}
+	if input == "" {
+		http.Error(w, "Please specify an input.", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), tvTimeout)
+	defer cancel()
+	if err := ctl.SetInput(ctx, input); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to switch input: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// selectTV looks up a device with a vendor adapter. On failure it writes
+// the HTTP error and returns nil.
+func (h *Handler) selectTV(w http.ResponseWriter, r *http.Request, usn string) (*dlna.Device, tv.Controller) {
+	if !checkUSN(w, usn) {
+		return nil, nil
+	}
+	device := h.discovery.GetDevice(usn)
+	if device == nil {
+		http.Error(w, errDeviceNotFound.Error(), http.StatusNotFound)
+		return nil, nil
+	}
+	if !checkDevice(w, r, device) {
+		return nil, nil
+	}
+	ctl, _ := h.tvFor(device)
+	if ctl == nil {
+		http.Error(w, fmt.Sprintf("%s has no vendor adapter configured", device.FriendlyName), http.StatusNotImplemented)
+		return nil, nil
+	}
+	return device, ctl
+}
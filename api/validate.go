@@ -0,0 +1,157 @@
+package api
+
+import (
+	"dlna/stream"
+	"dlna/torrent"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Field length limits for API payloads.
+const (
+	maxURLLength  = 8192
+	maxUSNLength  = 256
+	maxNameLength = 128
+	maxTextLength = 1024 // Titles, artists and other free text
+)
+
+// FieldError describes one invalid field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid field of a request. It is answered
+// with 400 and a JSON body: {"error": "...", "fields": [...]}.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "Invalid request: " + strings.Join(msgs, "; ")
+}
+
+// validator collects field errors so a client sees all of them at once.
+type validator struct {
+	fields []FieldError
+}
+
+func (v *validator) fail(field, format string, args ...any) {
+	v.fields = append(v.fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// required checks that value is not blank.
+func (v *validator) required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.fail(field, "is required")
+		return false
+	}
+	return true
+}
+
+// text checks that value is valid UTF-8 without control characters and at
+// most max bytes long.
+func (v *validator) text(field, value string, max int) bool {
+	switch {
+	case len(value) > max:
+		v.fail(field, "must be at most %d bytes", max)
+	case !utf8.ValidString(value):
+		v.fail(field, "must be valid UTF-8")
+	case strings.IndexFunc(value, unicode.IsControl) >= 0:
+		v.fail(field, "must not contain control characters")
+	default:
+		return true
+	}
+	return false
+}
+
+// url checks that value, if set, is an absolute http or https URL.
+func (v *validator) url(field, value string) {
+	if value == "" || !v.text(field, value, maxURLLength) {
+		return
+	}
+	u, err := url.Parse(value)
+	switch {
+	case err != nil:
+		v.fail(field, "is not a valid URL")
+	case u.Scheme != "http" && u.Scheme != "https":
+		v.fail(field, "must be an http or https URL")
+	case u.Host == "":
+		v.fail(field, "must include a host")
+	}
+}
+
+// mediaURL is url, but also accepts the udp:// and rtp:// multicasts and
+// rtsp:// cameras that the agent relays over HTTP, and the magnet links it
+// streams.
+func (v *validator) mediaURL(field, value string) {
+	switch {
+	case torrent.IsMagnet(value):
+		if v.text(field, value, maxURLLength) {
+			if _, err := torrent.ParseMagnet(value); err != nil {
+				v.fail(field, "%v", err)
+			}
+		}
+	case stream.IsUDP(value), stream.IsRTSP(value):
+		v.text(field, value, maxURLLength)
+	default:
+		v.url(field, value)
+	}
+}
+
+// usn checks that value, if set, looks like a USN: "uuid:..." from SSDP or
+// the location-derived IDs of manually added devices. Both are printable
+// without spaces or XML markup.
+func (v *validator) usn(field, value string) {
+	if value == "" || !v.text(field, value, maxUSNLength) {
+		return
+	}
+	if strings.ContainsAny(value, " \t<>&\"'") {
+		v.fail(field, "is not a valid USN")
+	}
+}
+
+// err returns the collected errors as a *ValidationError, or nil.
+func (v *validator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: v.fields}
+}
+
+// writeBadRequest answers 400 with err, as JSON for a *ValidationError.
+func writeBadRequest(w http.ResponseWriter, err error) {
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Error  string       `json:"error"`
+		Fields []FieldError `json:"fields"`
+	}{"Invalid request", verr.Fields})
+}
+
+// checkUSN validates the optional usn field common to most requests,
+// answering 400 if it is malformed.
+func checkUSN(w http.ResponseWriter, usn string) bool {
+	var v validator
+	v.usn("usn", usn)
+	if err := v.err(); err != nil {
+		writeBadRequest(w, err)
+		return false
+	}
+	return true
+}
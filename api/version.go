@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// APIVersion is the current version of the HTTP API. Its routes are served
+// under /api/v1/... and, for existing clients, unversioned under /api/....
+// A breaking change gets a new version and keeps this one aliased.
+const APIVersion = "v1"
+
+const versionPrefix = "/api/" + APIVersion
+
+// Versioned maps /api/v1/... requests onto the unversioned routes
+// registered on next.
+func Versioned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rest, ok := strings.CutPrefix(r.URL.Path, versionPrefix); ok && (rest == "" || rest[0] == '/') {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = "/api" + rest
+			r2.URL.RawPath = ""
+			if raw, ok := strings.CutPrefix(r.URL.RawPath, versionPrefix); ok {
+				r2.URL.RawPath = "/api" + raw
+			}
+			r = r2
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("API-Version", APIVersion)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
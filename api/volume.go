@@ -0,0 +1,255 @@
+package api
+
+import (
+	"dlna/dlna"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// fadeStepInterval is the shortest time between two SetVolume calls of a
+// fade, so renderers are not flooded.
+const fadeStepInterval = 250 * time.Millisecond
+
+// Fade ramps a renderer's volume from From to To over Duration.
+type Fade struct {
+	Device    string    `json:"device"` // USN
+	From      int       `json:"from"`
+	To        int       `json:"to"`
+	Duration  string    `json:"duration"`
+	StartedAt time.Time `json:"started_at"`
+
+	stop chan struct{}
+}
+
+// fades holds at most one running fade per device.
+type fades struct {
+	mu sync.Mutex
+	m  map[string]*Fade
+}
+
+func newFades() *fades {
+	return &fades{m: make(map[string]*Fade)}
+}
+
+var errFadeCancelled = errors.New("fade cancelled")
+
+// renderingControl returns the RenderingControl client for device, or an
+// error if it has none.
+func (h *Handler) renderingControl(device *dlna.Device) (*dlna.RenderingControl, error) {
+	if device.RenderingControlURL() == "" {
+		return nil, fmt.Errorf("%s has no RenderingControl service", device.FriendlyName)
+	}
+	rc := dlna.NewRenderingControl(device.RenderingControlURL())
+	rc.Client = h.soap
+	return rc, nil
+}
+
+// capVolume limits volume to the device's max_volume setting.
+func (h *Handler) capVolume(device *dlna.Device, volume int) int {
+	if max := h.settings.get(device.USN).MaxVolume; max > 0 && volume > max {
+		return max
+	}
+	return volume
+}
+
+// fadeVolume ramps device's volume to `to` over d, replacing a running
+// fade. from < 0 starts at the current volume. It blocks until the fade
+// finishes or is cancelled (errFadeCancelled).
+func (h *Handler) fadeVolume(device *dlna.Device, from, to int, d time.Duration) error {
+	rc, err := h.renderingControl(device)
+	if err != nil {
+		return err
+	}
+	if from < 0 {
+		if from, err = rc.GetVolume(); err != nil {
+			return err
+		}
+	}
+	to = h.capVolume(device, to)
+	from = h.capVolume(device, from)
+
+	f := &Fade{Device: device.USN, From: from, To: to, Duration: d.String(), StartedAt: time.Now(), stop: make(chan struct{})}
+	h.fades.mu.Lock()
+	if prev, ok := h.fades.m[device.USN]; ok {
+		close(prev.stop)
+	}
+	h.fades.m[device.USN] = f
+	h.fades.mu.Unlock()
+	defer func() {
+		h.fades.mu.Lock()
+		if h.fades.m[device.USN] == f {
+			delete(h.fades.m, device.USN)
+		}
+		h.fades.mu.Unlock()
+	}()
+
+	log.Printf("Fading volume on %s from %d to %d over %s", device.FriendlyName, from, to, d)
+	h.events.publish("fade", f)
+
+	// One step per volume unit, but no faster than fadeStepInterval
+	steps := to - from
+	if steps < 0 {
+		steps = -steps
+	}
+	if max := int(d / fadeStepInterval); steps > max {
+		steps = max
+	}
+	if steps < 1 {
+		steps = 1
+	}
+	interval := d / time.Duration(steps)
+
+	if err := rc.SetVolume(from); err != nil {
+		return err
+	}
+	for i := 1; i <= steps; i++ {
+		select {
+		case <-f.stop:
+			return errFadeCancelled
+		case <-time.After(interval):
+		}
+		if err := rc.SetVolume(from + (to-from)*i/steps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) cancelFade(usn string) bool {
+	h.fades.mu.Lock()
+	defer h.fades.mu.Unlock()
+	f, ok := h.fades.m[usn]
+	if ok {
+		close(f.stop)
+		delete(h.fades.m, usn)
+	}
+	return ok
+}
+
+// GetVolumeHandler returns the Master volume of ?usn= (or the default
+// device).
+func (h *Handler) GetVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	device := h.selectDevice(w, r, r.URL.Query().Get("usn"))
+	if device == nil {
+		return
+	}
+	rc, err := h.renderingControl(device)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	volume, err := rc.GetVolume()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"volume": volume})
+}
+
+func (h *Handler) SetVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		USN    string `json:"usn"` // Optional
+		Volume *int   `json:"volume"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Volume == nil || *req.Volume < 0 || *req.Volume > 100 {
+		http.Error(w, "Volume must be 0-100", http.StatusBadRequest)
+		return
+	}
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil {
+		return
+	}
+	rc, err := h.renderingControl(device)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	h.cancelFade(device.USN)
+	volume := h.capVolume(device, *req.Volume)
+	if err := rc.SetVolume(volume); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"volume": volume})
+}
+
+// FadeVolumeHandler starts a fade in the background and returns it with
+// 202 Accepted.
+func (h *Handler) FadeVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		USN      string `json:"usn"`      // Optional
+		From     *int   `json:"from"`     // Optional, defaults to the current volume
+		To       *int   `json:"to"`       // Target volume
+		Duration string `json:"duration"` // Go duration, e.g. "30s"
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.To == nil || *req.To < 0 || *req.To > 100 || (req.From != nil && (*req.From < 0 || *req.From > 100)) {
+		http.Error(w, "Volumes must be 0-100", http.StatusBadRequest)
+		return
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		http.Error(w, fmt.Sprintf("Invalid duration %q", req.Duration), http.StatusBadRequest)
+		return
+	}
+
+	device := h.selectDevice(w, r, req.USN)
+	if device == nil {
+		return
+	}
+	rc, err := h.renderingControl(device)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	var from int
+	if req.From != nil {
+		from = *req.From
+	} else if from, err = rc.GetVolume(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	go func() {
+		if err := h.fadeVolume(device, from, *req.To, d); err != nil && err != errFadeCancelled {
+			log.Printf("Volume fade failed on %s: %v", device.FriendlyName, err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(Fade{
+		Device:    device.USN,
+		From:      h.capVolume(device, from),
+		To:        h.capVolume(device, *req.To),
+		Duration:  d.String(),
+		StartedAt: time.Now(),
+	})
+}
+
+func (h *Handler) CancelFadeHandler(w http.ResponseWriter, r *http.Request) {
+	usn := r.URL.Query().Get("usn")
+	if !h.checkDeviceUSN(w, r, usn) {
+		return
+	}
+	if !h.cancelFade(usn) {
+		http.Error(w, "No fade for device", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Fade cancelled for %s", usn)
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"bufio"
+	"dlna/internal/websocket"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// wsMaxFrame bounds the frames clients may send; they have no reason to
+// send more than pings and a close.
+const wsMaxFrame = 64 << 10
+
+// EventsHandler upgrades to a WebSocket and streams events as JSON text
+// frames. Only the server-to-client direction is used; client frames other
+// than close are ignored.
+func (h *Handler) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "Expected WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocket.Accept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	events := h.events.subscribe()
+	defer h.events.unsubscribe(events)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		wsDrain(rw.Reader)
+	}()
+
+	for {
+		select {
+		case ev := <-events:
+			payload, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if err := websocket.WriteFrame(conn, websocket.OpText, payload, false); err != nil {
+				log.Printf("WebSocket write failed: %v", err)
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// wsDrain reads and discards client frames until a close frame or error.
+func wsDrain(r *bufio.Reader) {
+	for {
+		_, opcode, _, err := websocket.ReadFrame(r, wsMaxFrame)
+		if err != nil || opcode == websocket.OpClose {
+			return
+		}
+	}
+}
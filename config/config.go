@@ -0,0 +1,449 @@
+package config
+
+import (
+	"dlna/dlna"
+	"dlna/library"
+	"dlna/share"
+	"dlna/torrent"
+	"dlna/tts"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the optional JSON configuration file passed with -c.
+type Config struct {
+	StaticDevices []StaticDevice `json:"static_devices"`
+
+	// Storage selects how state is persisted in the -d directory: "file"
+	// (default, one state.json) or "dir" (one file per key). It is read
+	// at startup only.
+	Storage string `json:"storage"`
+
+	// DeviceTypes limits SSDP discovery to these UPnP deviceTypes. Nil
+	// means MediaRenderers only; an empty list accepts everything with an
+	// AVTransport service.
+	DeviceTypes []string `json:"device_types"`
+
+	// DefaultPlayer lists the patterns that pick the device casts without
+	// one go to, tried in order, replacing -p; see api.DevicePattern.
+	DefaultPlayer []string `json:"default_player"`
+
+	// Failover sends casts without a device elsewhere when the default
+	// device is gone or offline and cannot be woken.
+	Failover Failover `json:"failover"`
+
+	// Groups names sets of devices, given as patterns (see
+	// api.DevicePattern), so that "idle:<name>" casts to whichever of them
+	// is stopped.
+	Groups map[string][]string `json:"groups"`
+
+	// Profiles are named casting presets, chosen per cast or as a device's
+	// default profile setting; see api.Profile.
+	Profiles map[string]Profile `json:"profiles"`
+
+	// Transcoding selects how profiles that transcode encode video.
+	Transcoding Transcoding `json:"transcoding"`
+
+	// DeviceFilter drops discovered devices by USN or friendlyName, e.g. a
+	// neighbour's TV leaking through the network.
+	DeviceFilter dlna.DeviceFilter `json:"device_filter"`
+
+	// MACAddresses maps device USNs to MAC addresses for Wake-on-LAN,
+	// for devices whose MAC is not in the ARP table.
+	MACAddresses map[string]string `json:"mac_addresses"`
+
+	// UnicastSearch lists addresses (usually subnet broadcast addresses,
+	// optionally with a port) that get a unicast M-SEARCH, for containers
+	// and networks where multicast does not reach the agent.
+	UnicastSearch []string `json:"unicast_search"`
+
+	// Sweep discovers devices by unicast on whole subnets, for networks
+	// that filter multicast entirely.
+	Sweep Sweep `json:"sweep"`
+
+	// Discovery tunes SSDP timing and sockets; see dlna.Tuning.
+	Discovery Discovery `json:"discovery"`
+
+	// Resolvers convert page URLs into direct media URLs before casting,
+	// tried in order.
+	Resolvers []Resolver `json:"resolvers"`
+
+	// MediaRoots maps names to local folders the agent serves to
+	// renderers at /media/{name}/, e.g. {"photos": "/srv/photos"}, or to
+	// SMB and NFS shares read over the network, e.g.
+	// {"films": "smb://nas/media/films"}.
+	MediaRoots map[string]string `json:"media_roots"`
+
+	// Shares holds the credentials and options of share media roots, by
+	// host as in their URLs.
+	Shares map[string]Share `json:"shares"`
+
+	// Library configures how the media roots are watched for changes.
+	Library Library `json:"library"`
+
+	// Torrent configures streaming magnet links.
+	Torrent Torrent `json:"torrent"`
+
+	// Hooks run a webhook or command on device and cast events.
+	Hooks []Hook `json:"hooks"`
+
+	// Notifications push alerts such as "playback finished" to phones.
+	Notifications []Notification `json:"notifications"`
+
+	// TVs configures vendor APIs of smart TVs for power and input control.
+	TVs []TV `json:"tvs"`
+
+	// HDHomeRun lists the addresses of HDHomeRun tuners whose channels
+	// can be cast. Empty discovers them by broadcast.
+	HDHomeRun []string `json:"hdhomerun"`
+
+	// TTS synthesizes the speech of announcements.
+	TTS TTS `json:"tts"`
+
+	// Tokens, once set, are required for the API; each may be limited to
+	// some scopes and devices.
+	Tokens []Token `json:"tokens"`
+
+	// Limits protects the API and renderers from runaway clients.
+	Limits Limits `json:"limits"`
+
+	// AgentURLs overrides the base URL renderers reach the agent at, by
+	// renderer USN, IP address or CIDR range, e.g.
+	// {"192.168.20.0/24": "http://192.168.20.2:8072"}, for hosts with
+	// several networks. The most specific entry wins over -b.
+	AgentURLs map[string]string `json:"agent_urls"`
+
+	// Proxy describes the reverse proxy, e.g. nginx or Traefik, the API
+	// is reached through.
+	Proxy Proxy `json:"proxy"`
+
+	// Renderer, if set, makes the agent advertise itself as a
+	// MediaRenderer that plays casts with a local player.
+	Renderer *Renderer `json:"renderer"`
+}
+
+// Discovery holds the dlna.Tuning knobs in JSON form. Zero values keep the
+// defaults.
+type Discovery struct {
+	CleanupInterval  string `json:"cleanup_interval,omitempty"`  // e.g. "1m"
+	DeviceExpiry     string `json:"device_expiry,omitempty"`     // e.g. "5m", when CACHE-CONTROL is missing
+	HopLimit         int    `json:"hop_limit,omitempty"`         // Multicast TTL/hop limit, 1-255
+	ReadBuffer       int    `json:"read_buffer,omitempty"`       // SSDP receive buffer in bytes
+	SearchMX         int    `json:"search_mx,omitempty"`         // M-SEARCH MX in seconds, 1-5
+	OfflineRetention string `json:"offline_retention,omitempty"` // e.g. "168h", how long offline devices are kept
+}
+
+// Tuning validates d and converts it to a dlna.Tuning.
+func (d Discovery) Tuning() (dlna.Tuning, error) {
+	var t dlna.Tuning
+	var err error
+	if d.CleanupInterval != "" {
+		if t.CleanupInterval, err = time.ParseDuration(d.CleanupInterval); err != nil || t.CleanupInterval < time.Second {
+			return t, fmt.Errorf("invalid cleanup_interval %q", d.CleanupInterval)
+		}
+	}
+	if d.DeviceExpiry != "" {
+		if t.DeviceExpiry, err = time.ParseDuration(d.DeviceExpiry); err != nil || t.DeviceExpiry < time.Second {
+			return t, fmt.Errorf("invalid device_expiry %q", d.DeviceExpiry)
+		}
+	}
+	if d.OfflineRetention != "" {
+		if t.OfflineRetention, err = time.ParseDuration(d.OfflineRetention); err != nil || t.OfflineRetention < time.Minute {
+			return t, fmt.Errorf("invalid offline_retention %q", d.OfflineRetention)
+		}
+	}
+	if d.HopLimit < 0 || d.HopLimit > 255 {
+		return t, fmt.Errorf("invalid hop_limit %d", d.HopLimit)
+	}
+	if d.ReadBuffer != 0 && (d.ReadBuffer < 512 || d.ReadBuffer > 1<<20) {
+		return t, fmt.Errorf("invalid read_buffer %d", d.ReadBuffer)
+	}
+	if d.SearchMX < 0 || d.SearchMX > 5 {
+		return t, fmt.Errorf("invalid search_mx %d", d.SearchMX)
+	}
+	t.HopLimit = d.HopLimit
+	t.ReadBuffer = d.ReadBuffer
+	t.SearchMX = d.SearchMX
+	return t, nil
+}
+
+// DiscoveryOf is the inverse of Discovery.Tuning.
+func DiscoveryOf(t dlna.Tuning) Discovery {
+	return Discovery{
+		CleanupInterval:  t.CleanupInterval.String(),
+		DeviceExpiry:     t.DeviceExpiry.String(),
+		HopLimit:         t.HopLimit,
+		ReadBuffer:       t.ReadBuffer,
+		SearchMX:         t.SearchMX,
+		OfflineRetention: t.OfflineRetention.String(),
+	}
+}
+
+// Sweep configures subnet sweep discovery; see dlna.Sweep.
+type Sweep struct {
+	Networks   []string `json:"networks"`              // CIDRs, e.g. "10.0.3.0/24"
+	Interval   string   `json:"interval,omitempty"`    // Default "10m"
+	ProbePorts []int    `json:"probe_ports,omitempty"` // Also request descriptions on these ports
+	ProbePaths []string `json:"probe_paths,omitempty"` // Default ["/description.xml"]
+}
+
+// Parse validates c and converts it to a dlna.Sweep.
+func (c Sweep) Parse() (dlna.Sweep, error) {
+	var sw dlna.Sweep
+	var err error
+	if sw.Networks, err = dlna.ParseSweepNetworks(c.Networks); err != nil {
+		return sw, err
+	}
+	if c.Interval != "" {
+		if sw.Interval, err = time.ParseDuration(c.Interval); err != nil || sw.Interval < time.Minute {
+			return sw, fmt.Errorf("invalid interval %q (at least 1m)", c.Interval)
+		}
+	}
+	for _, p := range c.ProbePorts {
+		if p < 1 || p > 65535 {
+			return sw, fmt.Errorf("invalid probe port %d", p)
+		}
+	}
+	for _, p := range c.ProbePaths {
+		if !strings.HasPrefix(p, "/") {
+			return sw, fmt.Errorf("invalid probe path %q", p)
+		}
+	}
+	sw.ProbePorts = c.ProbePorts
+	sw.ProbePaths = c.ProbePaths
+	return sw, nil
+}
+
+// Library configures watching the media roots; see library.WatchConfig.
+type Library struct {
+	Watch        string `json:"watch,omitempty"`         // "auto" (default), "poll" or "off"
+	PollInterval string `json:"poll_interval,omitempty"` // Default "1m"
+}
+
+// Parse validates c and converts it to a library.WatchConfig.
+func (c Library) Parse() (library.WatchConfig, error) {
+	var w library.WatchConfig
+	switch c.Watch {
+	case "", library.WatchAuto, library.WatchPoll, library.WatchOff:
+		w.Mode = c.Watch
+	default:
+		return w, fmt.Errorf("invalid watch %q (auto, poll or off)", c.Watch)
+	}
+	if c.PollInterval != "" {
+		var err error
+		if w.PollInterval, err = time.ParseDuration(c.PollInterval); err != nil || w.PollInterval < time.Second {
+			return w, fmt.Errorf("invalid poll_interval %q (at least 1s)", c.PollInterval)
+		}
+	}
+	return w, nil
+}
+
+// Torrent configures streaming magnet links; see torrent.Config.
+type Torrent struct {
+	Dir      string   `json:"dir"`       // Downloads, default a folder in the system's temporary folder
+	Trackers []string `json:"trackers"`  // Announced to for every magnet link
+	Idle     string   `json:"idle"`      // How long an unwatched torrent is kept, default "10m"
+	BufferMB int      `json:"buffer_mb"` // Downloaded before casting, default 16
+}
+
+// Parse validates c and converts it to a torrent.Config.
+func (c Torrent) Parse() (torrent.Config, error) {
+	cfg := torrent.Config{Dir: c.Dir, Trackers: c.Trackers}
+	for _, tr := range c.Trackers {
+		if !strings.HasPrefix(tr, "http://") && !strings.HasPrefix(tr, "https://") && !strings.HasPrefix(tr, "udp://") {
+			return cfg, fmt.Errorf("invalid tracker %q (http, https or udp)", tr)
+		}
+	}
+	if c.Idle != "" {
+		var err error
+		if cfg.Idle, err = time.ParseDuration(c.Idle); err != nil || cfg.Idle < time.Minute {
+			return cfg, fmt.Errorf("invalid idle %q (at least 1m)", c.Idle)
+		}
+	}
+	if c.BufferMB < 0 || c.BufferMB > 1024 {
+		return cfg, fmt.Errorf("invalid buffer_mb %d", c.BufferMB)
+	}
+	return cfg, nil
+}
+
+// Share configures access to a network share; see share.Options.
+type Share struct {
+	User      string  `json:"user"`       // SMB and WebDAV; empty signs in anonymously
+	Password  string  `json:"password"`   // SMB and WebDAV
+	Domain    string  `json:"domain"`     // Optional SMB domain or workgroup
+	UID       *uint32 `json:"uid"`        // NFS, default 65534 (nobody)
+	GID       *uint32 `json:"gid"`        // NFS, default 65534 (nobody)
+	ListCache string  `json:"list_cache"` // WebDAV, e.g. "5m"; empty lists afresh
+	Region    string  `json:"region"`     // S3, default from the endpoint or us-east-1
+	Proxy     bool    `json:"proxy"`      // S3: stream through the agent, not presigned URLs
+}
+
+// Parse validates s and converts it to share.Options.
+func (s Share) Parse() (share.Options, error) {
+	o := share.Options{User: s.User, Password: s.Password, Domain: s.Domain, UID: share.Nobody, GID: share.Nobody,
+		Region: s.Region, Proxy: s.Proxy}
+	if s.UID != nil {
+		o.UID = *s.UID
+	}
+	if s.GID != nil {
+		o.GID = *s.GID
+	}
+	if s.ListCache != "" {
+		var err error
+		if o.ListCache, err = time.ParseDuration(s.ListCache); err != nil || o.ListCache < 0 {
+			return o, fmt.Errorf("invalid list_cache %q", s.ListCache)
+		}
+	}
+	return o, nil
+}
+
+// Hook is a webhook or command fired on events; see api.Hook.
+type Hook struct {
+	Events  []string `json:"events"`  // e.g. ["device-added", "cast-finished"]; empty means all
+	URL     string   `json:"url"`     // POSTed the event as JSON, or
+	Command []string `json:"command"` // run with the event JSON on stdin
+	Timeout string   `json:"timeout"` // Optional, default "10s"
+}
+
+// Notification configures one push notification service; see
+// api.Notification.
+type Notification struct {
+	Type   string   `json:"type"`    // "ntfy", "telegram" or "pushover"
+	Events []string `json:"events"`  // Default cast-finished, cast-failed and device-offline
+	URL    string   `json:"url"`     // ntfy topic URL
+	Token  string   `json:"token"`   // ntfy access token, Telegram bot token or Pushover app token
+	ChatID string   `json:"chat_id"` // Telegram
+	User   string   `json:"user"`    // Pushover user or group key
+}
+
+// TV configures the vendor adapter of a smart TV; see api.TV.
+type TV struct {
+	USN   string `json:"usn"`
+	Type  string `json:"type"`  // "webos" (LG) or "tizen" (Samsung)
+	Host  string `json:"host"`  // Optional, defaults to the host of the device location
+	Key   string `json:"key"`   // Optional pairing key; keys handed out on pairing are saved with -d
+	Input string `json:"input"` // Optional input switched to before casting, e.g. "HDMI_1" or "KEY_HDMI1"
+}
+
+// TTS configures text-to-speech: a local engine run as Command, or a
+// service at URL; see tts.Command and tts.HTTP.
+type TTS struct {
+	Command []string          `json:"command"` // e.g. ["espeak-ng", "-v", "{lang}", "-w", "{file}", "{text}"]
+	URL     string            `json:"url"`     // e.g. "http://marytts:59125/process?INPUT_TEXT={text}&LOCALE={lang}&INPUT_TYPE=TEXT&OUTPUT_TYPE=AUDIO&AUDIO=WAVE"
+	Body    string            `json:"body"`    // Optional, POSTed to URL
+	Headers map[string]string `json:"headers"` // Optional, e.g. {"Authorization": "Bearer ..."}
+	Lang    string            `json:"lang"`    // Default language, e.g. "en"
+	Timeout string            `json:"timeout"` // Optional, default "30s"
+}
+
+// Parse validates c and converts it to a tts.Engine, nil if none is
+// configured.
+func (c TTS) Parse() (tts.Engine, error) {
+	var timeout time.Duration
+	if c.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(c.Timeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", c.Timeout)
+		}
+	}
+	switch {
+	case len(c.Command) > 0 && c.URL != "":
+		return nil, fmt.Errorf("command and url are exclusive")
+	case len(c.Command) > 0:
+		return &tts.Command{Args: c.Command, Timeout: timeout}, nil
+	case c.URL != "":
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			return nil, fmt.Errorf("invalid url %q", c.URL)
+		}
+		return &tts.HTTP{URL: c.URL, Body: c.Body, Headers: c.Headers, Timeout: timeout}, nil
+	}
+	return nil, nil
+}
+
+// Token is an API token; see api.Token.
+type Token struct {
+	Name    string   `json:"name"`    // Shown in logs, e.g. "guest"
+	Token   string   `json:"token"`   // The secret, at least 16 characters
+	Scopes  []string `json:"scopes"`  // "read", "control" and/or "admin"; empty means all
+	Devices []string `json:"devices"` // USNs or friendly names it may use; empty means all
+}
+
+// Limits bounds API requests. Zero values keep the defaults.
+type Limits struct {
+	MaxBodyBytes int64   `json:"max_body_bytes,omitempty"` // Default 1 MiB
+	CastRate     float64 `json:"cast_rate,omitempty"`      // Device control requests per second per client, default 1
+	CastBurst    int     `json:"cast_burst,omitempty"`     // Requests allowed at once before cast_rate applies, default 5
+	MaxStreams   int     `json:"max_streams,omitempty"`    // Concurrent /media and /stream responses, default unlimited
+	StreamMbps   float64 `json:"stream_mbps,omitempty"`    // Bandwidth cap of each /media response, default unlimited
+}
+
+// Failover configures default device failover; see api.Handler.SetFailover.
+type Failover struct {
+	Enabled bool     `json:"enabled"`
+	Devices []string `json:"devices"` // USNs or friendly names in priority order; empty uses the default player patterns
+}
+
+// Profile is a casting preset. Without Transcode the media is cast as is.
+type Profile struct {
+	Transcode    bool   `json:"transcode"`               // Transcode with ffmpeg to MPEG-TS
+	MaxHeight    int    `json:"max_height,omitempty"`    // Scale taller video down, e.g. 1080
+	VideoCodec   string `json:"video_codec,omitempty"`   // "h264" (default), "hevc" or "copy"
+	AudioCodec   string `json:"audio_codec,omitempty"`   // "aac" (default), "ac3", "mp3" or "copy"
+	VideoBitrate string `json:"video_bitrate,omitempty"` // e.g. "8M", default ffmpeg's
+	AudioBitrate string `json:"audio_bitrate,omitempty"` // e.g. "192k", default ffmpeg's
+}
+
+// Transcoding configures the video encoder of transcodes.
+type Transcoding struct {
+	HWAccel string `json:"hwaccel,omitempty"` // "vaapi", "nvenc" or "qsv", default software
+	Device  string `json:"device,omitempty"`  // VAAPI render node, default /dev/dri/renderD128
+}
+
+// Proxy describes a reverse proxy in front of the agent; see api.ProxyConfig.
+type Proxy struct {
+	Trusted  []string `json:"trusted"`   // Proxy IPs or CIDR ranges whose X-Forwarded-For is believed
+	BasePath string   `json:"base_path"` // Path the agent is served under, e.g. "/dlna"
+}
+
+// Renderer configures MediaRenderer emulation.
+type Renderer struct {
+	Name    string   `json:"name"`    // Optional, defaults to the hostname
+	Command []string `json:"command"` // e.g. ["mpv", "--fs", "{url}"]
+}
+
+// Resolver runs Command for URLs matching the Match regular expression; see
+// resolver.Command.
+type Resolver struct {
+	Name    string   `json:"name"`
+	Match   string   `json:"match"`
+	Command []string `json:"command"` // e.g. ["yt-dlp", "-g", "-f", "best", "{url}"]
+	Timeout string   `json:"timeout"` // Optional, e.g. "1m"
+}
+
+// StaticDevice is a renderer that is not discovered via SSDP, e.g. on a
+// VLAN-segmented network where multicast does not reach the agent.
+type StaticDevice struct {
+	Name     string `json:"name"`     // Optional, overrides the description friendlyName
+	Location string `json:"location"` // Description URL
+	MAC      string `json:"mac"`      // Optional, for Wake-on-LAN
+}
+
+// Load reads the config file at path. An empty path yields an empty config.
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	if cfg, err := Load(""); err != nil || len(cfg.StaticDevices) != 0 {
+		t.Errorf("Expected an empty config without a path, got %+v %v", cfg, err)
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"static_devices": [
+		{"name": "Bedroom TV", "location": "http://10.0.3.20:9197/dmr", "mac": "00:11:22:aa:bb:cc"},
+		{"location": "http://10.0.3.21:1400/xml/device_description.xml"}
+	]}`), 0o600)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StaticDevice{
+		{Name: "Bedroom TV", Location: "http://10.0.3.20:9197/dmr", MAC: "00:11:22:aa:bb:cc"},
+		{Location: "http://10.0.3.21:1400/xml/device_description.xml"},
+	}
+	if len(cfg.StaticDevices) != len(want) {
+		t.Fatalf("Expected %d static devices, got %+v", len(want), cfg.StaticDevices)
+	}
+	for i, d := range cfg.StaticDevices {
+		if d != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], d)
+		}
+	}
+
+	os.WriteFile(path, []byte(`{"static_devices": {"name": "Bedroom TV"}}`), 0o600)
+	if _, err := Load(path); err == nil {
+		t.Error("Expected an error for a malformed static_devices")
+	}
+}
+
+func TestDiscoveryTuning(t *testing.T) {
+	d := Discovery{CleanupInterval: "30s", OfflineRetention: "72h"}
+	tuning, err := d.Tuning()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tuning.CleanupInterval != 30*time.Second || tuning.OfflineRetention != 72*time.Hour {
+		t.Errorf("Unexpected tuning %+v", tuning)
+	}
+	if got := DiscoveryOf(tuning); got.OfflineRetention != "72h0m0s" {
+		t.Errorf("Expected offline_retention to round-trip, got %+v", got)
+	}
+	for _, retention := range []string{"a week", "30s", "-1h"} {
+		if _, err := (Discovery{OfflineRetention: retention}).Tuning(); err == nil {
+			t.Errorf("Expected offline_retention %q to be rejected", retention)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAndNext(t *testing.T) {
+	// Wednesday 2024-01-03 06:30
+	now := time.Date(2024, 1, 3, 6, 30, 0, 0, time.UTC)
+
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"0 7 * * mon-fri", time.Date(2024, 1, 3, 7, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 3, 6, 45, 0, 0, time.UTC)},
+		{"0 9 * * sat,sun", time.Date(2024, 1, 6, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2024, 1, 7, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 feb *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		spec, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", c.expr, err)
+		}
+		if got := spec.Next(now); !got.Equal(c.want) {
+			t.Errorf("Next(%q) = %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * * * funday", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Expected Parse(%q) to fail", expr)
+		}
+	}
+}
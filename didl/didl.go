@@ -0,0 +1,300 @@
+// Package didl encodes and decodes DIDL-Lite, the metadata format used by
+// UPnP AV for Browse results and AVTransport URI metadata.
+package didl
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nsDIDL = "urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"
+	nsDC   = "http://purl.org/dc/elements/1.1/"
+	nsUPnP = "urn:schemas-upnp-org:metadata-1-0/upnp/"
+	nsDLNA = "urn:schemas-dlna-org:metadata-1-0/"
+	nsSEC  = "http://www.sec.co.kr/" // Samsung's, for sec:CaptionInfoEx
+)
+
+// Class is a upnp:class value such as object.item.videoItem.
+type Class string
+
+const (
+	ClassItem              Class = "object.item"
+	ClassImageItem         Class = "object.item.imageItem"
+	ClassPhoto             Class = "object.item.imageItem.photo"
+	ClassAudioItem         Class = "object.item.audioItem"
+	ClassMusicTrack        Class = "object.item.audioItem.musicTrack"
+	ClassAudioBroadcast    Class = "object.item.audioItem.audioBroadcast"
+	ClassVideoItem         Class = "object.item.videoItem"
+	ClassMovie             Class = "object.item.videoItem.movie"
+	ClassVideoBroadcast    Class = "object.item.videoItem.videoBroadcast"
+	ClassContainer         Class = "object.container"
+	ClassStorageFolder     Class = "object.container.storageFolder"
+	ClassMusicAlbum        Class = "object.container.album.musicAlbum"
+	ClassPlaylistContainer Class = "object.container.playlistContainer"
+)
+
+// IsA reports whether c is parent or derived from it, so a musicTrack IsA
+// ClassAudioItem.
+func (c Class) IsA(parent Class) bool {
+	return c == parent || strings.HasPrefix(string(c), string(parent)+".")
+}
+
+// IsContainer reports whether c is a container class.
+func (c Class) IsContainer() bool {
+	return c.IsA(ClassContainer)
+}
+
+// ProtocolInfo is the four-field protocolInfo of a resource, e.g.
+// http-get:*:video/mp4:DLNA.ORG_PN=AVC_MP4_BL_CIF15_AAC_520.
+type ProtocolInfo struct {
+	Protocol       string
+	Network        string
+	ContentFormat  string
+	AdditionalInfo string
+}
+
+// DLNAFlagsSeekable is the protocolInfo fourth field for a plain HTTP file
+// with byte-range seeking and streaming transfer.
+const DLNAFlagsSeekable = "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+
+// DLNA.ORG_FLAGS of plain files: DLNA 1.5 with background transfer and
+// connection stalling, in streaming (audio and video) or interactive
+// (images) transfer mode.
+const (
+	FlagsStreaming   = "01700000000000000000000000000000"
+	FlagsInteractive = "00D00000000000000000000000000000"
+)
+
+// ContentFeatures is a protocolInfo fourth field, also sent as the
+// contentFeatures.dlna.org header. op is DLNA.ORG_OP: "01" for byte
+// ranges, "10" for time seeks, "11" for both and "00" for neither.
+func ContentFeatures(op, flags string) string {
+	return "DLNA.ORG_OP=" + op + ";DLNA.ORG_CI=0;DLNA.ORG_FLAGS=" + flags
+}
+
+// HTTPGet returns the protocolInfo for serving mimeType over HTTP with no
+// DLNA profile.
+func HTTPGet(mimeType string) ProtocolInfo {
+	if mimeType == "" {
+		mimeType = "*"
+	}
+	return ProtocolInfo{Protocol: "http-get", Network: "*", ContentFormat: mimeType, AdditionalInfo: "*"}
+}
+
+// ParseProtocolInfo parses a protocolInfo string. Missing fields are left
+// empty.
+func ParseProtocolInfo(s string) ProtocolInfo {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 4)
+	for len(parts) < 4 {
+		parts = append(parts, "")
+	}
+	return ProtocolInfo{Protocol: parts[0], Network: parts[1], ContentFormat: parts[2], AdditionalInfo: parts[3]}
+}
+
+func (p ProtocolInfo) String() string {
+	if p == (ProtocolInfo{}) {
+		return ""
+	}
+	return p.Protocol + ":" + p.Network + ":" + p.ContentFormat + ":" + p.AdditionalInfo
+}
+
+func (p ProtocolInfo) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *ProtocolInfo) UnmarshalText(b []byte) error {
+	*p = ParseProtocolInfo(string(b))
+	return nil
+}
+
+// FormatDuration formats d as H:MM:SS for res@duration.
+func FormatDuration(d time.Duration) string {
+	secs := int64(d.Round(time.Second) / time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+}
+
+// ParseDuration parses an H:MM:SS[.F] duration as used by res@duration and
+// GetPositionInfo. It fails on "NOT_IMPLEMENTED" and other non-times.
+func ParseDuration(s string) (time.Duration, error) {
+	var h, m int
+	var sec float64
+	if n, _ := fmt.Sscanf(s, "%d:%d:%f", &h, &m, &sec); n != 3 || h < 0 || m < 0 || m > 59 || sec < 0 || sec >= 60 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec*float64(time.Second)), nil
+}
+
+// Resource is a <res> element: one way to fetch the object's content.
+type Resource struct {
+	URL          string       `xml:",chardata" json:"url"`
+	ProtocolInfo ProtocolInfo `xml:"protocolInfo,attr" json:"protocol_info"`
+	Duration     string       `xml:"duration,attr,omitempty" json:"duration,omitempty"`
+	Size         string       `xml:"size,attr,omitempty" json:"size,omitempty"`
+	Bitrate      string       `xml:"bitrate,attr,omitempty" json:"bitrate,omitempty"`
+	Resolution   string       `xml:"resolution,attr,omitempty" json:"resolution,omitempty"`
+}
+
+// Object is a DIDL-Lite item or container.
+type Object struct {
+	ID          string     `xml:"id,attr" json:"id"`
+	ParentID    string     `xml:"parentID,attr" json:"parent_id"`
+	Restricted  bool       `xml:"restricted,attr" json:"restricted,omitempty"`
+	ChildCount  int        `xml:"childCount,attr" json:"child_count,omitempty"`
+	Title       string     `xml:"title" json:"title"`
+	Creator     string     `xml:"creator" json:"creator,omitempty"`
+	Artist      string     `xml:"artist" json:"artist,omitempty"`
+	Album       string     `xml:"album" json:"album,omitempty"`
+	Genre       string     `xml:"genre" json:"genre,omitempty"`
+	Date        string     `xml:"date" json:"date,omitempty"`
+	AlbumArtURI string     `xml:"albumArtURI" json:"album_art_uri,omitempty"`
+	Class       Class      `xml:"class" json:"class"`
+	Resources   []Resource `xml:"res" json:"resources,omitempty"`
+	// CaptionURL is an external subtitle file, as sec:CaptionInfoEx. Most
+	// renderers that show subtitles read it there, some from a text <res>.
+	CaptionURL string `xml:"CaptionInfoEx" json:"caption_url,omitempty"`
+}
+
+// Document is a DIDL-Lite document.
+type Document struct {
+	Containers []Object `xml:"container"`
+	Items      []Object `xml:"item"`
+}
+
+// Unmarshal decodes a DIDL-Lite document, such as a Browse Result.
+func Unmarshal(data []byte) (*Document, error) {
+	var doc Document
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Marshal encodes doc as DIDL-Lite with the conventional dc/upnp prefixes,
+// which many renderers require literally.
+func Marshal(doc *Document) ([]byte, error) {
+	var buf bytes.Buffer
+	e := xml.NewEncoder(&buf)
+
+	root := xml.StartElement{
+		Name: xml.Name{Local: "DIDL-Lite"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "xmlns"}, Value: nsDIDL},
+			{Name: xml.Name{Local: "xmlns:dc"}, Value: nsDC},
+			{Name: xml.Name{Local: "xmlns:upnp"}, Value: nsUPnP},
+			{Name: xml.Name{Local: "xmlns:dlna"}, Value: nsDLNA},
+		},
+	}
+	if hasCaptions(doc.Containers) || hasCaptions(doc.Items) {
+		root.Attr = append(root.Attr, xml.Attr{Name: xml.Name{Local: "xmlns:sec"}, Value: nsSEC})
+	}
+	if err := e.EncodeToken(root); err != nil {
+		return nil, err
+	}
+	for i := range doc.Containers {
+		if err := encodeObject(e, "container", &doc.Containers[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range doc.Items {
+		if err := encodeObject(e, "item", &doc.Items[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.EncodeToken(root.End()); err != nil {
+		return nil, err
+	}
+	if err := e.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalItem is a shortcut for a document with a single item.
+func MarshalItem(item Object) (string, error) {
+	b, err := Marshal(&Document{Items: []Object{item}})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func encodeObject(e *xml.Encoder, tag string, o *Object) error {
+	restricted := "0"
+	if o.Restricted {
+		restricted = "1"
+	}
+	start := xml.StartElement{
+		Name: xml.Name{Local: tag},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "id"}, Value: o.ID},
+			{Name: xml.Name{Local: "parentID"}, Value: o.ParentID},
+			{Name: xml.Name{Local: "restricted"}, Value: restricted},
+		},
+	}
+	if o.Class.IsContainer() {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "childCount"}, Value: strconv.Itoa(o.ChildCount)})
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	fields := []struct{ name, value string }{
+		{"dc:title", o.Title},
+		{"dc:creator", o.Creator},
+		{"upnp:artist", o.Artist},
+		{"upnp:album", o.Album},
+		{"upnp:genre", o.Genre},
+		{"dc:date", o.Date},
+		{"upnp:albumArtURI", o.AlbumArtURI},
+		{"upnp:class", string(o.Class)},
+	}
+	for _, f := range fields {
+		// dc:title and upnp:class are required
+		if f.value == "" && f.name != "dc:title" && f.name != "upnp:class" {
+			continue
+		}
+		if err := e.EncodeElement(f.value, xml.StartElement{Name: xml.Name{Local: f.name}}); err != nil {
+			return fmt.Errorf("encoding %s: %w", f.name, err)
+		}
+	}
+	for _, res := range o.Resources {
+		if err := e.EncodeElement(res, xml.StartElement{Name: xml.Name{Local: "res"}}); err != nil {
+			return err
+		}
+	}
+	if o.CaptionURL != "" {
+		caption := xml.StartElement{
+			Name: xml.Name{Local: "sec:CaptionInfoEx"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "sec:type"}, Value: captionType(o.CaptionURL)}},
+		}
+		if err := e.EncodeElement(o.CaptionURL, caption); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func hasCaptions(objects []Object) bool {
+	for _, o := range objects {
+		if o.CaptionURL != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// captionType is the sec:type of a subtitle file: its extension, e.g. srt.
+func captionType(url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		url = url[:i]
+	}
+	if i := strings.LastIndexByte(url, '.'); i >= 0 && !strings.Contains(url[i:], "/") {
+		return strings.ToLower(url[i+1:])
+	}
+	return "srt"
+}
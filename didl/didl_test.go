@@ -0,0 +1,87 @@
+package didl
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	in := Object{
+		ID:         "1",
+		ParentID:   "0",
+		Restricted: true,
+		Title:      "Tom & Jerry <HD>",
+		Artist:     "Hanna-Barbera",
+		Class:      ClassVideoItem,
+		Resources: []Resource{{
+			URL:          "http://x/v.mp4?a=1&b=2",
+			ProtocolInfo: HTTPGet("video/mp4"),
+			Duration:     "0:07:00",
+		}},
+	}
+	s, err := MarshalItem(in)
+	if err != nil {
+		t.Fatalf("MarshalItem failed: %v", err)
+	}
+	for _, want := range []string{`xmlns:dc="http://purl.org/dc/elements/1.1/"`, "<dc:title>Tom &amp; Jerry &lt;HD&gt;</dc:title>", "<upnp:class>object.item.videoItem</upnp:class>", `protocolInfo="http-get:*:video/mp4:*"`} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Expected %s in %s", want, s)
+		}
+	}
+
+	doc, err := Unmarshal([]byte(s))
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(doc.Items) != 1 {
+		t.Fatalf("Expected 1 item, got %d", len(doc.Items))
+	}
+	out := doc.Items[0]
+	if out.Title != in.Title || out.Artist != in.Artist || out.Class != in.Class || !out.Restricted {
+		t.Errorf("Unexpected item %+v", out)
+	}
+	if len(out.Resources) != 1 || out.Resources[0] != in.Resources[0] {
+		t.Errorf("Unexpected resources %+v", out.Resources)
+	}
+}
+
+func TestProtocolInfo(t *testing.T) {
+	p := ParseProtocolInfo("http-get:*:audio/mpeg:DLNA.ORG_PN=MP3")
+	if p.ContentFormat != "audio/mpeg" || p.AdditionalInfo != "DLNA.ORG_PN=MP3" {
+		t.Errorf("Unexpected protocolInfo %+v", p)
+	}
+	if p.String() != "http-get:*:audio/mpeg:DLNA.ORG_PN=MP3" {
+		t.Errorf("Unexpected string %s", p)
+	}
+}
+
+func TestClassIsA(t *testing.T) {
+	if !ClassMusicTrack.IsA(ClassAudioItem) || !ClassMusicTrack.IsA(ClassItem) {
+		t.Error("musicTrack should be an audioItem")
+	}
+	if Class("object.itemX").IsA(ClassItem) || ClassVideoItem.IsContainer() {
+		t.Error("Unexpected class match")
+	}
+	if !ClassStorageFolder.IsContainer() {
+		t.Error("storageFolder should be a container")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"1:23:45":     time.Hour + 23*time.Minute + 45*time.Second,
+		"0:00:12.500": 12500 * time.Millisecond,
+		"00:03:00":    3 * time.Minute,
+	}
+	for in, want := range tests {
+		if got, err := ParseDuration(in); err != nil || got != want {
+			t.Errorf("ParseDuration(%q) = %s, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"", "NOT_IMPLEMENTED", "1:75:00"} {
+		if _, err := ParseDuration(in); err == nil {
+			t.Errorf("Expected an error for %q", in)
+		}
+	}
+}
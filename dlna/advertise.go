@@ -0,0 +1,243 @@
+package dlna
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// advertiseMaxAge is the CACHE-CONTROL max-age of our announcements; alive
+// NOTIFYs are repeated well within it.
+const advertiseMaxAge = 30 * time.Minute
+
+// Advertiser announces a local UPnP device over SSDP for its lifetime:
+// ssdp:alive on start and periodically, answers to M-SEARCH, and
+// ssdp:byebye on Stop. It is reusable for any emulated device.
+type Advertiser struct {
+	bindIP   string
+	uuid     string
+	targets  []string // NT/ST values: upnp:rootdevice, the UUID, device and service types
+	location func(ip net.IP) string
+	server   string
+
+	// bootID changes on every start so control points notice reboots,
+	// configID whenever the advertised device or services change (UDA 1.1).
+	bootID   int64
+	configID uint32
+
+	// HopLimit is the multicast TTL/hop limit of NOTIFYs; 0 is the OS
+	// default. Set it before Start.
+	HopLimit int
+
+	mu    sync.Mutex
+	conns []*net.UDPConn
+	stop  chan struct{}
+}
+
+// NewAdvertiser creates an advertiser for the root device uuid. location
+// builds the description URL as seen from the local address ip.
+func NewAdvertiser(bindIP, uuid, deviceType string, serviceTypes []string, location func(ip net.IP) string) *Advertiser {
+	targets := append([]string{"upnp:rootdevice", uuid, deviceType}, serviceTypes...)
+
+	// CONFIGID must stay below 2^24 and only change with the description
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(targets, "\n")))
+
+	return &Advertiser{
+		bindIP:   bindIP,
+		uuid:     uuid,
+		targets:  targets,
+		location: location,
+		server:   "Linux/1.0 UPnP/1.1 dlnagent/1.0",
+		configID: h.Sum32() & 0xFFFFFF,
+	}
+}
+
+// usn is the USN for target, following UDA 1.0 section 1.1.2.
+func (a *Advertiser) usn(target string) string {
+	if target == a.uuid {
+		return a.uuid
+	}
+	return a.uuid + "::" + target
+}
+
+// Start begins advertising. A byebye is sent first so control points drop
+// anything cached from a previous run.
+func (a *Advertiser) Start() {
+	a.mu.Lock()
+	a.bootID = time.Now().Unix()
+	a.stop = make(chan struct{})
+	stop := a.stop
+	a.mu.Unlock()
+
+	a.notifyAll("ssdp:byebye")
+	go a.aliveLoop(stop)
+	go a.listen("udp4", ssdpMulticastAddrV4)
+	go a.listen("udp6", ssdpMulticastAddrV6)
+	go a.listen("udp6", ssdpMulticastAddrV6Site)
+}
+
+// Stop sends ssdp:byebye for every target and stops answering searches.
+func (a *Advertiser) Stop() {
+	a.mu.Lock()
+	if a.stop == nil {
+		a.mu.Unlock()
+		return
+	}
+	close(a.stop)
+	a.stop = nil
+	for _, c := range a.conns {
+		c.Close()
+	}
+	a.conns = nil
+	a.mu.Unlock()
+
+	a.notifyAll("ssdp:byebye")
+}
+
+func (a *Advertiser) aliveLoop(stop chan struct{}) {
+	for {
+		a.notifyAll("ssdp:alive")
+		select {
+		case <-stop:
+			return
+		case <-time.After(advertiseMaxAge / 3):
+		}
+	}
+}
+
+// message builds a NOTIFY (nts set, host is the group) or a search response
+// (nts empty) for target.
+func (a *Advertiser) message(nts, host, target, location string) string {
+	var b strings.Builder
+	if nts != "" {
+		b.WriteString("NOTIFY * HTTP/1.1\r\n")
+		b.WriteString("HOST: " + host + "\r\n")
+		b.WriteString("NT: " + target + "\r\n")
+		b.WriteString("NTS: " + nts + "\r\n")
+	} else {
+		b.WriteString("HTTP/1.1 200 OK\r\n")
+		b.WriteString("DATE: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n")
+		b.WriteString("EXT:\r\n")
+		b.WriteString("ST: " + target + "\r\n")
+	}
+	if nts != "ssdp:byebye" {
+		b.WriteString("CACHE-CONTROL: max-age=" + strconv.Itoa(int(advertiseMaxAge.Seconds())) + "\r\n")
+		b.WriteString("LOCATION: " + location + "\r\n")
+		b.WriteString("SERVER: " + a.server + "\r\n")
+	}
+	b.WriteString("USN: " + a.usn(target) + "\r\n")
+	b.WriteString("BOOTID.UPNP.ORG: " + strconv.FormatInt(a.bootID, 10) + "\r\n")
+	b.WriteString("CONFIGID.UPNP.ORG: " + strconv.FormatUint(uint64(a.configID), 10) + "\r\n")
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// notifyAll sends a NOTIFY for every target from every bind address.
+func (a *Advertiser) notifyAll(nts string) {
+	ips, err := bindIPs(a.bindIP)
+	if err != nil {
+		log.Printf("Advertiser: %v", err)
+		return
+	}
+	for _, ip := range ips {
+		network, groups := multicastGroups(ip)
+		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+		if err != nil {
+			continue
+		}
+		if a.HopLimit > 0 {
+			setMulticastHops(conn, a.HopLimit)
+		}
+		location := a.location(ip)
+		for _, group := range groups {
+			addr, err := net.ResolveUDPAddr(network, group)
+			if err != nil {
+				continue
+			}
+			for _, target := range a.targets {
+				conn.WriteTo([]byte(a.message(nts, group, target, location)), addr)
+			}
+		}
+		conn.Close()
+	}
+}
+
+// listen answers M-SEARCH requests arriving on the multicast group.
+func (a *Advertiser) listen(network, group string) {
+	addr, err := net.ResolveUDPAddr(network, group)
+	if err != nil {
+		return
+	}
+	conn, err := net.ListenMulticastUDP(network, nil, addr)
+	if err != nil {
+		log.Printf("Advertiser: error listening multicast %s: %v", network, err)
+		return
+	}
+	a.mu.Lock()
+	if a.stop == nil {
+		a.mu.Unlock()
+		conn.Close()
+		return
+	}
+	a.conns = append(a.conns, conn)
+	a.mu.Unlock()
+
+	buf := make([]byte, 4096)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+			continue
+		}
+		go a.respond(req.Header.Get("ST"), req.Header.Get("MX"), src)
+	}
+}
+
+// respond sends a unicast search response for each matching target after a
+// random delay of up to MX seconds, as UDA requires.
+func (a *Advertiser) respond(st, mx string, src *net.UDPAddr) {
+	var matches []string
+	for _, target := range a.targets {
+		if st == "ssdp:all" || strings.EqualFold(st, target) {
+			matches = append(matches, target)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+
+	delay, _ := strconv.Atoi(mx)
+	if delay > 5 {
+		delay = 5
+	}
+	if delay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(delay) * int64(time.Second))))
+	}
+
+	conn, err := net.DialUDP("udp", nil, src)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	location := a.location(conn.LocalAddr().(*net.UDPAddr).IP)
+
+	for _, target := range matches {
+		conn.Write([]byte(a.message("", "", target, location)))
+	}
+}
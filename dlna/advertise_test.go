@@ -0,0 +1,64 @@
+package dlna
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdvertiserSearchResponse(t *testing.T) {
+	a := NewAdvertiser("127.0.0.1", "uuid:abc", DeviceTypeMediaRenderer, []string{"urn:schemas-upnp-org:service:AVTransport:1"}, func(ip net.IP) string {
+		return "http://" + ip.String() + ":8072/renderer/description.xml"
+	})
+	a.bootID = 42
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	defer conn.Close()
+
+	a.respond("urn:schemas-upnp-org:service:AVTransport:1", "0", conn.LocalAddr().(*net.UDPAddr))
+	a.respond("urn:schemas-upnp-org:service:ContentDirectory:1", "0", conn.LocalAddr().(*net.UDPAddr))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("No search response: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+	if err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if got := resp.Header.Get("USN"); got != "uuid:abc::urn:schemas-upnp-org:service:AVTransport:1" {
+		t.Errorf("Unexpected USN %s", got)
+	}
+	if got := resp.Header.Get("Location"); got != "http://127.0.0.1:8072/renderer/description.xml" {
+		t.Errorf("Unexpected LOCATION %s", got)
+	}
+	if resp.Header.Get("BOOTID.UPNP.ORG") != "42" || resp.Header.Get("CONFIGID.UPNP.ORG") == "" {
+		t.Errorf("Missing BOOTID/CONFIGID: %v", resp.Header)
+	}
+
+	// The unmatched ST must not get an answer
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("Unexpected response for a service we don't offer")
+	}
+}
+
+func TestAdvertiserByebye(t *testing.T) {
+	a := NewAdvertiser("", "uuid:abc", DeviceTypeMediaRenderer, nil, nil)
+	msg := a.message("ssdp:byebye", ssdpMulticastAddrV4, "upnp:rootdevice", "")
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader([]byte(msg))))
+	if err != nil {
+		t.Fatalf("Invalid NOTIFY: %v", err)
+	}
+	if req.Header.Get("NTS") != "ssdp:byebye" || req.Header.Get("USN") != "uuid:abc::upnp:rootdevice" || req.Header.Get("Location") != "" {
+		t.Errorf("Unexpected byebye %v", req.Header)
+	}
+}
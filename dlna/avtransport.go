@@ -0,0 +1,224 @@
+package dlna
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const serviceAVTransport = "urn:schemas-upnp-org:service:AVTransport:1"
+
+// AVTransport is a client for a renderer's AVTransport:1 service.
+type AVTransport struct {
+	ControlURL string
+	InstanceID uint32
+	Client     SOAPClient // nil is HTTPSOAPClient
+}
+
+func NewAVTransport(controlURL string) *AVTransport {
+	return &AVTransport{ControlURL: controlURL}
+}
+
+// Request arguments. Field order matters: UPnP requires arguments in the
+// order declared by the SCPD.
+
+type instanceArgs struct {
+	InstanceID uint32
+}
+
+type setAVTransportURIArgs struct {
+	InstanceID         uint32
+	CurrentURI         string
+	CurrentURIMetaData string
+}
+
+type setNextAVTransportURIArgs struct {
+	InstanceID      uint32
+	NextURI         string
+	NextURIMetaData string
+}
+
+type playArgs struct {
+	InstanceID uint32
+	Speed      string
+}
+
+type seekArgs struct {
+	InstanceID uint32
+	Unit       string
+	Target     string
+}
+
+type setPlayModeArgs struct {
+	InstanceID  uint32
+	NewPlayMode string
+}
+
+// Responses
+
+// MediaInfo is the result of GetMediaInfo.
+type MediaInfo struct {
+	NrTracks           int    `xml:"NrTracks" json:"nr_tracks"`
+	MediaDuration      string `xml:"MediaDuration" json:"media_duration"`
+	CurrentURI         string `xml:"CurrentURI" json:"current_uri"`
+	CurrentURIMetaData string `xml:"CurrentURIMetaData" json:"current_uri_metadata"`
+	NextURI            string `xml:"NextURI" json:"next_uri"`
+	NextURIMetaData    string `xml:"NextURIMetaData" json:"next_uri_metadata"`
+	PlayMedium         string `xml:"PlayMedium" json:"play_medium"`
+	RecordMedium       string `xml:"RecordMedium" json:"record_medium"`
+	WriteStatus        string `xml:"WriteStatus" json:"write_status"`
+}
+
+// TransportInfo is the result of GetTransportInfo.
+type TransportInfo struct {
+	CurrentTransportState  string `xml:"CurrentTransportState" json:"state"`
+	CurrentTransportStatus string `xml:"CurrentTransportStatus" json:"status"`
+	CurrentSpeed           string `xml:"CurrentSpeed" json:"speed"`
+}
+
+// PositionInfo is the result of GetPositionInfo. Times are H:MM:SS strings
+// as reported by the renderer.
+type PositionInfo struct {
+	Track         int    `xml:"Track" json:"track"`
+	TrackDuration string `xml:"TrackDuration" json:"track_duration"`
+	TrackMetaData string `xml:"TrackMetaData" json:"track_metadata,omitempty"`
+	TrackURI      string `xml:"TrackURI" json:"track_uri"`
+	RelTime       string `xml:"RelTime" json:"rel_time"`
+	AbsTime       string `xml:"AbsTime" json:"abs_time"`
+	RelCount      int    `xml:"RelCount" json:"rel_count"`
+	AbsCount      int    `xml:"AbsCount" json:"abs_count"`
+}
+
+// DeviceCapabilities is the result of GetDeviceCapabilities.
+type DeviceCapabilities struct {
+	PlayMedia       string `xml:"PlayMedia" json:"play_media"`
+	RecMedia        string `xml:"RecMedia" json:"rec_media"`
+	RecQualityModes string `xml:"RecQualityModes" json:"rec_quality_modes"`
+}
+
+// TransportSettings is the result of GetTransportSettings.
+type TransportSettings struct {
+	PlayMode       string `xml:"PlayMode" json:"play_mode"`
+	RecQualityMode string `xml:"RecQualityMode" json:"rec_quality_mode"`
+}
+
+// call invokes action with args and decodes the response into out (if not nil).
+func (c *AVTransport) call(action string, args, out interface{}) error {
+	return callAction(c.Client, c.ControlURL, serviceAVTransport, action, args, out)
+}
+
+// callAction is the typed counterpart of Invoke shared by the service
+// clients: args is an argument struct, out a response struct or nil.
+func callAction(client SOAPClient, controlURL, serviceType, action string, args, out interface{}) error {
+	body, err := marshalAction(serviceType, action, args)
+	if err != nil {
+		return err
+	}
+	resp, err := orDefault(client).Call(context.Background(), controlURL, serviceType, action, body)
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", action, err)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := unmarshalResponse(resp, out); err != nil {
+		return fmt.Errorf("invalid %s response: %w", action, err)
+	}
+	return nil
+}
+
+func (c *AVTransport) SetAVTransportURI(uri, metaData string) error {
+	return c.call("SetAVTransportURI", setAVTransportURIArgs{c.InstanceID, uri, metaData}, nil)
+}
+
+func (c *AVTransport) SetNextAVTransportURI(uri, metaData string) error {
+	return c.call("SetNextAVTransportURI", setNextAVTransportURIArgs{c.InstanceID, uri, metaData}, nil)
+}
+
+func (c *AVTransport) Play() error {
+	return c.call("Play", playArgs{c.InstanceID, "1"}, nil)
+}
+
+func (c *AVTransport) Pause() error {
+	return c.call("Pause", instanceArgs{c.InstanceID}, nil)
+}
+
+func (c *AVTransport) Stop() error {
+	return c.call("Stop", instanceArgs{c.InstanceID}, nil)
+}
+
+func (c *AVTransport) Next() error {
+	return c.call("Next", instanceArgs{c.InstanceID}, nil)
+}
+
+func (c *AVTransport) Previous() error {
+	return c.call("Previous", instanceArgs{c.InstanceID}, nil)
+}
+
+// Seek jumps to target in the given unit, e.g. REL_TIME with "0:01:30".
+func (c *AVTransport) Seek(unit, target string) error {
+	return c.call("Seek", seekArgs{c.InstanceID, unit, target}, nil)
+}
+
+// SetPlayMode sets NORMAL, REPEAT_ALL, REPEAT_ONE, SHUFFLE, etc.
+func (c *AVTransport) SetPlayMode(mode string) error {
+	return c.call("SetPlayMode", setPlayModeArgs{c.InstanceID, mode}, nil)
+}
+
+func (c *AVTransport) GetMediaInfo() (*MediaInfo, error) {
+	var out MediaInfo
+	if err := c.call("GetMediaInfo", instanceArgs{c.InstanceID}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *AVTransport) GetTransportInfo() (*TransportInfo, error) {
+	var out TransportInfo
+	if err := c.call("GetTransportInfo", instanceArgs{c.InstanceID}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *AVTransport) GetPositionInfo() (*PositionInfo, error) {
+	var out PositionInfo
+	if err := c.call("GetPositionInfo", instanceArgs{c.InstanceID}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *AVTransport) GetDeviceCapabilities() (*DeviceCapabilities, error) {
+	var out DeviceCapabilities
+	if err := c.call("GetDeviceCapabilities", instanceArgs{c.InstanceID}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *AVTransport) GetTransportSettings() (*TransportSettings, error) {
+	var out TransportSettings
+	if err := c.call("GetTransportSettings", instanceArgs{c.InstanceID}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetCurrentTransportActions returns the actions currently allowed, e.g.
+// [Play Stop Seek].
+func (c *AVTransport) GetCurrentTransportActions() ([]string, error) {
+	var out struct {
+		Actions string `xml:"Actions"`
+	}
+	if err := c.call("GetCurrentTransportActions", instanceArgs{c.InstanceID}, &out); err != nil {
+		return nil, err
+	}
+	var actions []string
+	for _, a := range strings.Split(out.Actions, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			actions = append(actions, a)
+		}
+	}
+	return actions, nil
+}
@@ -0,0 +1,92 @@
+package dlna
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// capturedPacket is one line of an SSDP capture file.
+type capturedPacket struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"src,omitempty"` // host:port, with the IPv6 zone
+	Data   string    `json:"data"`
+}
+
+// packetCapture appends every received SSDP packet to w as JSON lines.
+type packetCapture struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// SetCapture records every received SSDP packet, before any filtering, to
+// w as one JSON object per line; see Replay. A nil w stops recording.
+func (s *DiscoveryService) SetCapture(w io.Writer) {
+	var c *packetCapture
+	if w != nil {
+		c = &packetCapture{enc: json.NewEncoder(w)}
+	}
+	s.mu.Lock()
+	s.capture = c
+	s.mu.Unlock()
+}
+
+func (s *DiscoveryService) capturePacket(data []byte, src *net.UDPAddr) {
+	s.mu.RLock()
+	c := s.capture
+	s.mu.RUnlock()
+	if c == nil {
+		return
+	}
+	p := capturedPacket{Time: time.Now(), Data: string(data)}
+	if src != nil {
+		p.Source = src.String()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enc.Encode(p); err != nil {
+		log.Printf("Error writing SSDP capture: %v", err)
+	}
+}
+
+// Replay feeds the packets of a capture written by SetCapture through
+// packet processing as if they had just arrived. Descriptions are fetched
+// from the captured LOCATIONs as usual, and Replay returns the number of
+// packets once those fetches are done. With realtime set, the original gaps
+// between packets are kept, which matters for duplicate suppression and
+// rate limits.
+func (s *DiscoveryService) Replay(r io.Reader, realtime bool) (int, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	var n int
+	var last time.Time
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var p capturedPacket
+		if err := json.Unmarshal(sc.Bytes(), &p); err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+		var src *net.UDPAddr
+		if p.Source != "" {
+			var err error
+			if src, err = net.ResolveUDPAddr("udp", p.Source); err != nil {
+				return n, fmt.Errorf("line %d: invalid src %q", line, p.Source)
+			}
+		}
+		if realtime && !last.IsZero() && p.Time.After(last) {
+			time.Sleep(p.Time.Sub(last))
+		}
+		last = p.Time
+		s.processPacket([]byte(p.Data), src)
+		n++
+	}
+	s.fetches.Wait()
+	return n, sc.Err()
+}
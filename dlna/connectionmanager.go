@@ -0,0 +1,66 @@
+package dlna
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+const serviceConnectionManager = "urn:schemas-upnp-org:service:ConnectionManager:1"
+
+// Connection is the result of ConnectionManager PrepareForConnection.
+type Connection struct {
+	ConnectionID  int
+	AVTransportID uint32
+	RcsID         int
+}
+
+// ConnectionManager is a client for a renderer's ConnectionManager:1
+// service.
+type ConnectionManager struct {
+	ControlURL string
+	Client     SOAPClient // nil is HTTPSOAPClient
+}
+
+// PrepareForConnection asks a renderer that allocates instances dynamically
+// for a new AVTransport instance able to play protocolInfo
+// (e.g. "http-get:*:video/mp4:*").
+func PrepareForConnection(ctx context.Context, cmURL, protocolInfo string) (*Connection, error) {
+	return (&ConnectionManager{ControlURL: cmURL}).PrepareForConnection(ctx, protocolInfo)
+}
+
+// ConnectionComplete releases a connection made by PrepareForConnection.
+func ConnectionComplete(ctx context.Context, cmURL string, connectionID int) error {
+	return (&ConnectionManager{ControlURL: cmURL}).ConnectionComplete(ctx, connectionID)
+}
+
+func (c *ConnectionManager) PrepareForConnection(ctx context.Context, protocolInfo string) (*Connection, error) {
+	out, err := invoke(ctx, c.Client, c.ControlURL, serviceConnectionManager, "PrepareForConnection", []Arg{
+		{"RemoteProtocolInfo", protocolInfo},
+		{"PeerConnectionManager", ""},
+		{"PeerConnectionID", "-1"},
+		{"Direction", "Input"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &Connection{}
+	if conn.ConnectionID, err = strconv.Atoi(out["ConnectionID"]); err != nil {
+		return nil, fmt.Errorf("invalid ConnectionID %q", out["ConnectionID"])
+	}
+	avt, err := strconv.ParseUint(out["AVTransportID"], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AVTransportID %q", out["AVTransportID"])
+	}
+	conn.AVTransportID = uint32(avt)
+	conn.RcsID, _ = strconv.Atoi(out["RcsID"])
+	return conn, nil
+}
+
+func (c *ConnectionManager) ConnectionComplete(ctx context.Context, connectionID int) error {
+	_, err := invoke(ctx, c.Client, c.ControlURL, serviceConnectionManager, "ConnectionComplete", []Arg{
+		{"ConnectionID", strconv.Itoa(connectionID)},
+	})
+	return err
+}
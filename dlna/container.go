@@ -0,0 +1,56 @@
+package dlna
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// multicastCheckDelay is how long after startup the agent warns if no SSDP
+// multicast packet has arrived.
+const multicastCheckDelay = time.Minute
+
+// inContainer reports whether the agent appears to run in a Docker, Podman
+// or Kubernetes container.
+func inContainer() bool {
+	for _, f := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(f); err == nil {
+			return true
+		}
+	}
+	cgroup, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	for _, marker := range []string{"docker", "kubepods", "containerd", "libpod"} {
+		if strings.Contains(string(cgroup), marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMulticast warns when no multicast SSDP traffic has reached the agent
+// a while after startup, which usually means a container without host
+// networking or a firewall dropping 239.255.255.250/ff02::c.
+func (s *DiscoveryService) checkMulticast() {
+	time.Sleep(multicastCheckDelay)
+	if s.multicastSeen.Load() {
+		return
+	}
+	s.mu.RLock()
+	unicast := len(s.searchTargets) > 0
+	s.mu.RUnlock()
+
+	switch {
+	case unicast:
+		log.Printf("No SSDP multicast packets received; relying on unicast_search")
+	case inContainer():
+		log.Printf("No SSDP multicast packets received and running in a container: " +
+			"use host networking (docker run --network host) or list subnet broadcast addresses in unicast_search")
+	default:
+		log.Printf("No SSDP multicast packets received: check that the firewall allows UDP 1900 multicast, " +
+			"or list subnet broadcast addresses in unicast_search")
+	}
+}
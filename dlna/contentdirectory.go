@@ -0,0 +1,83 @@
+package dlna
+
+import (
+	"context"
+	"dlna/didl"
+	"encoding/xml"
+	"fmt"
+)
+
+const serviceContentDirectory = "urn:schemas-upnp-org:service:ContentDirectory:1"
+
+type browseArgs struct {
+	ObjectID       string
+	BrowseFlag     string
+	Filter         string
+	StartingIndex  int
+	RequestedCount int
+	SortCriteria   string
+}
+
+// BrowseResult is the decoded result of a ContentDirectory Browse call.
+type BrowseResult struct {
+	Containers     []didl.Object `json:"containers"`
+	Items          []didl.Object `json:"items"`
+	NumberReturned int           `json:"number_returned"`
+	TotalMatches   int           `json:"total_matches"`
+
+	// DIDL is the raw DIDL-Lite document, for passing on as renderer metadata.
+	DIDL string `json:"-"`
+}
+
+// ContentDirectory is a client for a server's ContentDirectory:1 service.
+type ContentDirectory struct {
+	ControlURL string
+	Client     SOAPClient // nil is HTTPSOAPClient
+}
+
+// Browse issues a ContentDirectory Browse. browseFlag is BrowseDirectChildren
+// or BrowseMetadata.
+func Browse(controlURL, objectID, browseFlag string, start, count int) (*BrowseResult, error) {
+	return (&ContentDirectory{ControlURL: controlURL}).Browse(objectID, browseFlag, start, count)
+}
+
+func (c *ContentDirectory) Browse(objectID, browseFlag string, start, count int) (*BrowseResult, error) {
+	req, err := marshalAction(serviceContentDirectory, "Browse", browseArgs{
+		ObjectID:       objectID,
+		BrowseFlag:     browseFlag,
+		Filter:         "*",
+		StartingIndex:  start,
+		RequestedCount: count,
+	})
+	if err != nil {
+		return nil, err
+	}
+	body, err := orDefault(c.Client).Call(context.Background(), c.ControlURL, serviceContentDirectory, "Browse", req)
+	if err != nil {
+		return nil, fmt.Errorf("Browse failed: %w", err)
+	}
+
+	var env struct {
+		Result         string `xml:"Body>BrowseResponse>Result"`
+		NumberReturned int    `xml:"Body>BrowseResponse>NumberReturned"`
+		TotalMatches   int    `xml:"Body>BrowseResponse>TotalMatches"`
+	}
+	if err := xml.Unmarshal(body, &env); err != nil {
+		return nil, fmt.Errorf("invalid Browse response: %w", err)
+	}
+
+	doc := &didl.Document{}
+	if env.Result != "" {
+		if doc, err = didl.Unmarshal([]byte(env.Result)); err != nil {
+			return nil, fmt.Errorf("invalid DIDL-Lite in Browse result: %w", err)
+		}
+	}
+
+	return &BrowseResult{
+		Containers:     doc.Containers,
+		Items:          doc.Items,
+		NumberReturned: env.NumberReturned,
+		TotalMatches:   env.TotalMatches,
+		DIDL:           env.Result,
+	}, nil
+}
@@ -0,0 +1,49 @@
+package dlna
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBrowse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("SOAPAction"); got != `"urn:schemas-upnp-org:service:ContentDirectory:1#Browse"` {
+			t.Errorf("Unexpected SOAPAction %s", got)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), "<ObjectID>64&amp;1</ObjectID>") {
+			t.Errorf("Expected escaped ObjectID in request, got %s", body)
+		}
+		w.Write([]byte(`<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Body>
+    <u:BrowseResponse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1">
+      <Result>&lt;DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/"&gt;&lt;container id="1" parentID="64&amp;amp;1" childCount="3"&gt;&lt;dc:title&gt;Movies&lt;/dc:title&gt;&lt;upnp:class&gt;object.container&lt;/upnp:class&gt;&lt;/container&gt;&lt;item id="2" parentID="64&amp;amp;1"&gt;&lt;dc:title&gt;Clip&lt;/dc:title&gt;&lt;upnp:class&gt;object.item.videoItem&lt;/upnp:class&gt;&lt;res protocolInfo="http-get:*:video/mp4:*" duration="0:01:00"&gt;http://nas/clip.mp4&lt;/res&gt;&lt;/item&gt;&lt;/DIDL-Lite&gt;</Result>
+      <NumberReturned>2</NumberReturned>
+      <TotalMatches>2</TotalMatches>
+    </u:BrowseResponse>
+  </s:Body>
+</s:Envelope>`))
+	}))
+	defer srv.Close()
+
+	result, err := Browse(srv.URL, "64&1", "BrowseDirectChildren", 0, 100)
+	if err != nil {
+		t.Fatalf("Browse failed: %v", err)
+	}
+	if len(result.Containers) != 1 || result.Containers[0].Title != "Movies" {
+		t.Errorf("Unexpected containers %+v", result.Containers)
+	}
+	if len(result.Items) != 1 || len(result.Items[0].Resources) != 1 {
+		t.Fatalf("Unexpected items %+v", result.Items)
+	}
+	if res := result.Items[0].Resources[0]; res.URL != "http://nas/clip.mp4" || res.Duration != "0:01:00" {
+		t.Errorf("Unexpected resource %+v", res)
+	}
+	if result.TotalMatches != 2 {
+		t.Errorf("Expected 2 total matches, got %d", result.TotalMatches)
+	}
+}
@@ -2,92 +2,451 @@ package dlna
 
 import (
 	"bytes"
+	"context"
+	"dlna/didl"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
-	"text/template"
+	"strconv"
+	"sync"
+	"time"
 )
 
-const soapEnvelope = `<?xml version="1.0" encoding="utf-8"?>
-<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
-  <s:Body>
-    {{.Body}}
-  </s:Body>
-</s:Envelope>`
+// controlLocks serializes SOAP requests per control URL, since some
+// renderers misbehave on overlapping actions. Different devices still run
+// concurrently.
+var controlLocks sync.Map // controlURL -> chan struct{} of capacity 1
 
-const setAVTransportURIBody = `<u:SetAVTransportURI xmlns:u="urn:schemas-upnp-org:service:AVTransport:1">
-  <InstanceID>0</InstanceID>
-  <CurrentURI>{{.MediaURL}}</CurrentURI>
-  <CurrentURIMetaData>{{.MetaData}}</CurrentURIMetaData>
-</u:SetAVTransportURI>`
+// soapTimeout bounds a SOAP action, waiting for the actions before it on
+// the same control URL included, so that a renderer that never answers
+// does not hold up the others forever. Tests shorten it.
+var soapTimeout = 15 * time.Second
 
-const playBody = `<u:Play xmlns:u="urn:schemas-upnp-org:service:AVTransport:1">
-  <InstanceID>0</InstanceID>
-  <Speed>1</Speed>
-</u:Play>`
+// lockControl waits for the turn of a request to controlURL, giving up
+// when ctx is done.
+func lockControl(ctx context.Context, controlURL string) (func(), error) {
+	m, _ := controlLocks.LoadOrStore(controlURL, make(chan struct{}, 1))
+	sem := m.(chan struct{})
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for %s: %w", controlURL, ctx.Err())
+	}
+}
+
+// The envelope is fixed; only the body varies, and it is always produced by
+// encoding/xml so argument values are escaped.
+const (
+	soapEnvelopeStart = `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`
+	soapEnvelopeEnd = `</s:Body></s:Envelope>`
+)
+
+// Metadata describes the media for the renderer's now-playing screen.
+type Metadata struct {
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtURL string
+	Duration    string // H:MM:SS
+	Size        int64  // Bytes, 0 if unknown
+
+	Class    didl.Class // Default object.item.videoItem
+	MimeType string     // For protocolInfo, default "*"
+
+	// DLNAFlags adds DLNA.ORG_OP/FLAGS to protocolInfo, for renderers that
+	// insist on them (QuirkDLNAFlags).
+	DLNAFlags bool
+}
+
+// DIDL renders m as DIDL-Lite metadata for mediaURL, or "" if m is empty.
+func (m Metadata) DIDL(mediaURL string) (string, error) {
+	if m == (Metadata{}) {
+		return "", nil
+	}
+	return didl.MarshalItem(m.object(mediaURL))
+}
+
+func (m Metadata) object(mediaURL string) didl.Object {
+	class := m.Class
+	if class == "" {
+		class = didl.ClassVideoItem
+	}
+	protocolInfo := didl.HTTPGet(m.MimeType)
+	if m.DLNAFlags {
+		protocolInfo.AdditionalInfo = didl.DLNAFlagsSeekable
+	}
+	var size string
+	if m.Size > 0 {
+		size = strconv.FormatInt(m.Size, 10)
+	}
+	return didl.Object{
+		ID:          "0",
+		ParentID:    "0",
+		Restricted:  true,
+		Title:       m.Title,
+		Artist:      m.Artist,
+		Creator:     m.Artist,
+		Album:       m.Album,
+		AlbumArtURI: m.AlbumArtURL,
+		Class:       class,
+		Resources: []didl.Resource{{
+			URL:          mediaURL,
+			ProtocolInfo: protocolInfo,
+			Duration:     m.Duration,
+			Size:         size,
+		}},
+	}
+}
+
+// CastRequest is what to play on a renderer and how to describe it, from
+// the API down to AVTransport.Cast.
+type CastRequest struct {
+	URL      string
+	Title    string // Shorthand for Metadata.Title
+	Metadata Metadata
+
+	// ProtocolInfo replaces the protocolInfo of the media's <res>, e.g.
+	// "http-get:*:video/mp4:DLNA.ORG_PN=AVC_MP4_HP_HD_AAC" for renderers
+	// that want a DLNA profile.
+	ProtocolInfo string
+
+	// Subtitles is the URL of an external subtitle file (SRT and the like),
+	// announced as sec:CaptionInfoEx and a text <res>.
+	Subtitles string
+}
+
+// DIDL renders the request as DIDL-Lite metadata, or "" if there is nothing
+// to describe.
+func (r CastRequest) DIDL() (string, error) {
+	m := r.Metadata
+	if m.Title == "" {
+		m.Title = r.Title
+	}
+	if m == (Metadata{}) && r.ProtocolInfo == "" && r.Subtitles == "" {
+		return "", nil
+	}
+	obj := m.object(r.URL)
+	if r.ProtocolInfo != "" {
+		obj.Resources[0].ProtocolInfo = didl.ParseProtocolInfo(r.ProtocolInfo)
+	}
+	if r.Subtitles != "" {
+		obj.CaptionURL = r.Subtitles
+		obj.Resources = append(obj.Resources, didl.Resource{URL: r.Subtitles, ProtocolInfo: didl.HTTPGet("text/srt")})
+	}
+	return didl.MarshalItem(obj)
+}
+
+// Cast loads req and starts playback, stopping first per mode.
+func (c *AVTransport) Cast(req CastRequest, mode StopMode) error {
+	metaData, err := req.DIDL()
+	if err != nil {
+		return err
+	}
+	return c.Load(req.URL, metaData, mode)
+}
 
 func Play(controlURL, mediaURL, title string) error {
-	// 1. SetAVTransportURI
-	metaData := ""
-	if title != "" {
-		// Simple DIDL-Lite metadata
-		// We construct the raw XML first, then escape it.
-		metaData = fmt.Sprintf(`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/"><item id="0" parentID="0" restricted="1"><dc:title>%s</dc:title><upnp:class>object.item.videoItem</upnp:class><res protocolInfo="http-get:*:*:*">%s</res></item></DIDL-Lite>`, title, mediaURL)
-
-		// Escape the XML string to be embedded in the SOAP XML
-		var buf bytes.Buffer
-		if err := xml.EscapeText(&buf, []byte(metaData)); err == nil {
-			metaData = buf.String()
+	return NewAVTransport(controlURL).Cast(CastRequest{URL: mediaURL, Title: title}, StopAuto)
+}
+
+// PlayWithMetadata sets the transport URI with raw DIDL-Lite metadata and
+// starts playback.
+func PlayWithMetadata(controlURL, mediaURL, metaData string) error {
+	return NewAVTransport(controlURL).PlayURI(mediaURL, metaData)
+}
+
+// PlayURI sets the transport URI with raw DIDL-Lite metadata and starts
+// playback, stopping the current media only if the renderer requires it.
+func (c *AVTransport) PlayURI(mediaURL, metaData string) error {
+	return c.Load(mediaURL, metaData, StopAuto)
+}
+
+// StopMode controls whether Load stops the current media before
+// SetAVTransportURI, which some TVs reject while PLAYING.
+type StopMode string
+
+const (
+	StopAuto   StopMode = "auto"   // Stop and retry if SetAVTransportURI fails while media is loaded
+	StopAlways StopMode = "always" // Stop first unless already stopped
+	StopNever  StopMode = "never"  // Plain SetAVTransportURI and Play
+)
+
+// stopWait bounds how long Load waits for the renderer to report STOPPED.
+const stopWait = 5 * time.Second
+
+// Load replaces the current media and starts playback: Stop (per mode),
+// SetAVTransportURI, Play.
+func (c *AVTransport) Load(mediaURL, metaData string, mode StopMode) error {
+	// 1. Stop
+	if mode == StopAlways {
+		c.stopAndWait()
+	}
+
+	// 2. SetAVTransportURI
+	err := c.SetAVTransportURI(mediaURL, metaData)
+	if err != nil && mode == StopAuto {
+		if info, ierr := c.GetTransportInfo(); ierr == nil && mediaLoaded(info.CurrentTransportState) {
+			log.Printf("SetAVTransportURI rejected while %s, stopping first: %v", info.CurrentTransportState, err)
+			c.stopAndWait()
+			err = c.SetAVTransportURI(mediaURL, metaData)
 		}
 	}
+	if err != nil {
+		return err
+	}
+
+	// 3. Play
+	return c.Play()
+}
 
-	if err := sendSOAPAction(controlURL, "SetAVTransportURI", setAVTransportURIBody, map[string]string{"MediaURL": mediaURL, "MetaData": metaData}); err != nil {
-		return fmt.Errorf("SetAVTransportURI failed: %w", err)
+// stopAndWait stops the renderer unless GetTransportInfo says it already
+// is, then polls until it reports STOPPED. Renderers without a usable
+// GetTransportInfo just get the Stop. Errors are ignored: whether the
+// following SetAVTransportURI succeeds is what counts.
+func (c *AVTransport) stopAndWait() {
+	if info, err := c.GetTransportInfo(); err == nil && !mediaLoaded(info.CurrentTransportState) {
+		return
+	}
+	if err := c.Stop(); err != nil {
+		return
 	}
+	deadline := time.Now().Add(stopWait)
+	for time.Now().Before(deadline) {
+		info, err := c.GetTransportInfo()
+		if err != nil || !mediaLoaded(info.CurrentTransportState) {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
 
-	// 2. Play
-	if err := sendSOAPAction(controlURL, "Play", playBody, nil); err != nil {
-		return fmt.Errorf("Play failed: %w", err)
+// mediaLoaded reports whether a transport state means media is active, so
+// a new URI may be rejected.
+func mediaLoaded(state string) bool {
+	switch state {
+	case "PLAYING", "PAUSED_PLAYBACK", "TRANSITIONING", "RECORDING", "PAUSED_RECORDING":
+		return true
 	}
+	return false
+}
 
-	return nil
+func Stop(controlURL string) error {
+	return NewAVTransport(controlURL).Stop()
 }
 
-func sendSOAPAction(controlURL, action, bodyTmpl string, data interface{}) error {
-	// Render body
-	t := template.Must(template.New("body").Parse(bodyTmpl))
-	var bodyBytes bytes.Buffer
-	if err := t.Execute(&bodyBytes, data); err != nil {
-		return err
+func Pause(controlURL string) error {
+	return NewAVTransport(controlURL).Pause()
+}
+
+// GetPositionInfo reads the current track position from the renderer.
+func GetPositionInfo(controlURL string) (*PositionInfo, error) {
+	return NewAVTransport(controlURL).GetPositionInfo()
+}
+
+// Seek jumps to target, a relative time in H:MM:SS format.
+func Seek(controlURL, target string) error {
+	return NewAVTransport(controlURL).Seek("REL_TIME", target)
+}
+
+// Arg is a named SOAP input argument. Arguments are sent in slice order,
+// which must match the order declared in the service's SCPD.
+type Arg struct {
+	Name  string
+	Value string
+}
+
+// Invoke calls action on any UPnP service and returns its output arguments
+// by name. Argument values are XML-escaped.
+func Invoke(ctx context.Context, controlURL, serviceType, action string, args []Arg) (map[string]string, error) {
+	return invoke(ctx, nil, controlURL, serviceType, action, args)
+}
+
+func invoke(ctx context.Context, client SOAPClient, controlURL, serviceType, action string, args []Arg) (map[string]string, error) {
+	body, err := marshalAction(serviceType, action, argList(args))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := orDefault(client).Call(ctx, controlURL, serviceType, action, body)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", action, err)
 	}
+	out, err := parseOutputArgs(resp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s response: %w", action, err)
+	}
+	return out, nil
+}
 
-	// Render envelope
-	tEnv := template.Must(template.New("envelope").Parse(soapEnvelope))
-	var envelopeBytes bytes.Buffer
-	if err := tEnv.Execute(&envelopeBytes, map[string]string{"Body": bodyBytes.String()}); err != nil {
+// argList marshals Args as child elements in order.
+type argList []Arg
+
+func (l argList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
 		return err
 	}
+	for _, a := range l {
+		if err := e.EncodeElement(a.Value, xml.StartElement{Name: xml.Name{Local: a.Name}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// parseOutputArgs collects the children of the first element inside the
+// SOAP Body (the <u:ActionResponse>) as name -> text.
+func parseOutputArgs(body []byte) (map[string]string, error) {
+	var env struct {
+		Body struct {
+			Inner []byte `xml:",innerxml"`
+		} `xml:"Body"`
+	}
+	if err := xml.Unmarshal(body, &env); err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Args []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	}
+	if err := xml.Unmarshal(env.Body.Inner, &resp); err != nil {
+		if err == io.EOF {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	out := make(map[string]string, len(resp.Args))
+	for _, a := range resp.Args {
+		out[a.XMLName.Local] = a.Value
+	}
+	return out, nil
+}
+
+// SOAPError is a UPnP fault returned by a device.
+type SOAPError struct {
+	Code        int
+	Description string
+}
+
+func (e *SOAPError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// parseFault extracts the UPnPError detail from a SOAP fault, if any.
+func parseFault(body []byte) *SOAPError {
+	var env struct {
+		Fault struct {
+			Code        int    `xml:"detail>UPnPError>errorCode"`
+			Description string `xml:"detail>UPnPError>errorDescription"`
+		} `xml:"Body>Fault"`
+	}
+	if err := xml.Unmarshal(body, &env); err != nil || env.Fault.Code == 0 {
+		return nil
+	}
+	return &SOAPError{Code: env.Fault.Code, Description: env.Fault.Description}
+}
+
+// soapInvokeContext wraps body in a SOAP envelope, sends it to controlURL
+// and returns the raw response body.
+func soapInvokeContext(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, soapTimeout)
+	defer cancel()
+
+	var envelopeBytes bytes.Buffer
+	envelopeBytes.WriteString(soapEnvelopeStart)
+	envelopeBytes.Write(body)
+	envelopeBytes.WriteString(soapEnvelopeEnd)
 
-	req, err := http.NewRequest("POST", controlURL, &envelopeBytes)
+	req, err := http.NewRequestWithContext(ctx, "POST", controlURL, &envelopeBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "text/xml; charset=\"utf-8\"")
-	req.Header.Set("SOAPAction", fmt.Sprintf("\"urn:schemas-upnp-org:service:AVTransport:1#%s\"", action))
+	req.Header.Set("SOAPAction", fmt.Sprintf("\"%s#%s\"", serviceType, action))
+
+	var trace *SOAPExchange
+	if tracingSOAP(controlURL) {
+		trace = &SOAPExchange{Time: time.Now(), URL: controlURL, Action: action,
+			RequestHeader: req.Header.Clone(), Request: envelopeBytes.String()}
+		defer func() {
+			trace.DurationMs = time.Since(trace.Time).Milliseconds()
+			recordSOAP(*trace)
+		}()
+	}
+
+	unlock, err := lockControl(ctx, controlURL)
+	if err != nil {
+		if trace != nil {
+			trace.Error = err.Error()
+		}
+		return nil, err
+	}
+	defer unlock()
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		if trace != nil {
+			trace.Error = err.Error()
+		}
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	respBody, err := io.ReadAll(resp.Body)
+	if trace != nil {
+		trace.Status, trace.ResponseHeader, trace.Response = resp.StatusCode, resp.Header, string(respBody)
+		if err != nil {
+			trace.Error = err.Error()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("SOAP request failed with status %d: %s", resp.StatusCode, string(respBody))
+		if fault := parseFault(respBody); fault != nil {
+			return nil, fault
+		}
+		return nil, fmt.Errorf("SOAP request failed with status %d: %s", resp.StatusCode, string(respBody))
 	}
 
-	return nil
+	return respBody, nil
+}
+
+// marshalAction encodes args as <u:action xmlns:u="serviceType">. Arguments
+// stay unqualified, as UPnP requires.
+func marshalAction(serviceType, action string, args interface{}) ([]byte, error) {
+	start := xml.StartElement{
+		Name: xml.Name{Local: "u:" + action},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns:u"}, Value: serviceType}},
+	}
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
+	if err := enc.EncodeElement(args, start); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalResponse decodes the first element inside the SOAP Body into out.
+func unmarshalResponse(body []byte, out interface{}) error {
+	var env struct {
+		Body struct {
+			Inner []byte `xml:",innerxml"`
+		} `xml:"Body"`
+	}
+	if err := xml.Unmarshal(body, &env); err != nil {
+		return err
+	}
+	return xml.Unmarshal(env.Body.Inner, out)
 }
@@ -0,0 +1,325 @@
+package dlna
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSOAPSerializedPerDevice(t *testing.T) {
+	var active, overlaps int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+	}))
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := Stop(srv.URL + "/avt"); err != nil {
+				t.Errorf("Stop failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&overlaps); n != 0 {
+		t.Errorf("Expected serialized SOAP requests, got %d overlaps", n)
+	}
+}
+
+func TestSOAPTimeout(t *testing.T) {
+	defer func(d time.Duration) { soapTimeout = d }(soapTimeout)
+	soapTimeout = 100 * time.Millisecond
+	// A renderer that accepts requests but never answers them
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	start := time.Now()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- Stop(srv.URL + "/avt") }()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected a timeout, got %v", err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected both actions to give up, took %s", d)
+	}
+
+	// Waiting for the turn also ends with the caller's context
+	unlock, _ := lockControl(context.Background(), srv.URL+"/held")
+	defer unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := soapInvokeContext(ctx, srv.URL+"/held", serviceAVTransport, "Stop", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the wait to be canceled, got %v", err)
+	}
+}
+
+func TestAVTransportTypedResponse(t *testing.T) {
+	var reqBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		reqBody = string(b)
+		w.Write([]byte(`<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetMediaInfoResponse xmlns:u="urn:schemas-upnp-org:service:AVTransport:1">
+<NrTracks>1</NrTracks><MediaDuration>0:42:00</MediaDuration><CurrentURI>http://x/a.mp4</CurrentURI>
+</u:GetMediaInfoResponse></s:Body></s:Envelope>`))
+	}))
+	defer srv.Close()
+
+	avt := NewAVTransport(srv.URL)
+	avt.InstanceID = 2
+	info, err := avt.GetMediaInfo()
+	if err != nil {
+		t.Fatalf("GetMediaInfo failed: %v", err)
+	}
+	if info.NrTracks != 1 || info.MediaDuration != "0:42:00" || info.CurrentURI != "http://x/a.mp4" {
+		t.Errorf("Unexpected media info: %+v", info)
+	}
+	if !strings.Contains(reqBody, `<u:GetMediaInfo xmlns:u="urn:schemas-upnp-org:service:AVTransport:1"><InstanceID>2</InstanceID></u:GetMediaInfo>`) {
+		t.Errorf("Unexpected request body: %s", reqBody)
+	}
+
+	if err := avt.SetAVTransportURI("http://x/a.mp4", "<DIDL-Lite/>"); err != nil {
+		t.Fatalf("SetAVTransportURI failed: %v", err)
+	}
+	if !strings.Contains(reqBody, "<CurrentURIMetaData>&lt;DIDL-Lite/&gt;</CurrentURIMetaData>") {
+		t.Errorf("Metadata not escaped: %s", reqBody)
+	}
+}
+
+func TestInvokeParsesOutputArgs(t *testing.T) {
+	var reqBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		reqBody = string(b)
+		if strings.Contains(reqBody, "<u:Bad") {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>401</errorCode><errorDescription>Invalid Action</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`))
+			return
+		}
+		w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetVolumeResponse xmlns:u="urn:schemas-upnp-org:service:RenderingControl:1"><CurrentVolume>17</CurrentVolume></u:GetVolumeResponse></s:Body></s:Envelope>`))
+	}))
+	defer srv.Close()
+
+	const rc = "urn:schemas-upnp-org:service:RenderingControl:1"
+	out, err := Invoke(context.Background(), srv.URL, rc, "GetVolume", []Arg{{"InstanceID", "0"}, {"Channel", "Master"}})
+	if err != nil {
+		t.Fatalf("Invoke failed: %v", err)
+	}
+	if out["CurrentVolume"] != "17" {
+		t.Errorf("Expected CurrentVolume 17, got %v", out)
+	}
+	if !strings.Contains(reqBody, "<InstanceID>0</InstanceID><Channel>Master</Channel>") {
+		t.Errorf("Arguments not sent in order: %s", reqBody)
+	}
+
+	_, err = Invoke(context.Background(), srv.URL, rc, "Bad", nil)
+	var fault *SOAPError
+	if !errors.As(err, &fault) || fault.Code != 401 {
+		t.Errorf("Expected UPnP error 401, got %v", err)
+	}
+}
+
+func TestPlayEscapesArguments(t *testing.T) {
+	var got struct {
+		URI      string `xml:"Body>SetAVTransportURI>CurrentURI"`
+		MetaData string `xml:"Body>SetAVTransportURI>CurrentURIMetaData"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if !strings.Contains(r.Header.Get("SOAPAction"), "#SetAVTransportURI") {
+			return
+		}
+		if err := xml.Unmarshal(b, &got); err != nil {
+			t.Errorf("Malformed envelope: %v\n%s", err, b)
+		}
+	}))
+	defer srv.Close()
+
+	const mediaURL = `http://x/v.m3u8?a=1&b="2"`
+	if err := Play(srv.URL, mediaURL, "Tom & Jerry <HD>"); err != nil {
+		t.Fatalf("Play failed: %v", err)
+	}
+	if got.URI != mediaURL {
+		t.Errorf("Expected CurrentURI %q, got %q", mediaURL, got.URI)
+	}
+	var didl struct {
+		Title string `xml:"item>title"`
+		Res   string `xml:"item>res"`
+	}
+	if err := xml.Unmarshal([]byte(got.MetaData), &didl); err != nil {
+		t.Fatalf("Malformed DIDL-Lite: %v\n%s", err, got.MetaData)
+	}
+	if didl.Title != "Tom & Jerry <HD>" || didl.Res != mediaURL {
+		t.Errorf("Unexpected DIDL-Lite: %+v", didl)
+	}
+}
+
+func TestLoadStopsWhenRejected(t *testing.T) {
+	var mu sync.Mutex
+	state := "PLAYING"
+	var actions []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+		action = action[strings.Index(action, "#")+1:]
+		mu.Lock()
+		defer mu.Unlock()
+		actions = append(actions, action)
+		switch action {
+		case "SetAVTransportURI":
+			if state == "PLAYING" {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail><UPnPError><errorCode>701</errorCode><errorDescription>Transition not available</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`))
+				return
+			}
+		case "Stop":
+			state = "STOPPED"
+		case "Play":
+			state = "PLAYING"
+		case "GetTransportInfo":
+			w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetTransportInfoResponse xmlns:u="urn:schemas-upnp-org:service:AVTransport:1"><CurrentTransportState>` + state + `</CurrentTransportState></u:GetTransportInfoResponse></s:Body></s:Envelope>`))
+		}
+	}))
+	defer srv.Close()
+
+	avt := NewAVTransport(srv.URL)
+	if err := avt.Load("http://x/a.mp4", "", StopAuto); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	want := "SetAVTransportURI,GetTransportInfo,GetTransportInfo,Stop,GetTransportInfo,SetAVTransportURI,Play"
+	if got := strings.Join(actions, ","); got != want {
+		t.Errorf("Unexpected actions %s, want %s", got, want)
+	}
+
+	actions = nil
+	if err := avt.Load("http://x/b.mp4", "", StopNever); err == nil {
+		t.Errorf("Expected StopNever to surface the rejection")
+	}
+}
+
+func TestSOAPTrace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Renderer", "test")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail>` +
+			`<UPnPError><errorCode>714</errorCode><errorDescription>Illegal MIME-type</errorDescription></UPnPError>` +
+			`</detail></s:Fault></s:Body></s:Envelope>`))
+	}))
+	defer srv.Close()
+	defer ClearSOAPTraces()
+
+	Stop(srv.URL + "/avt")
+	if n := len(SOAPTraces()); n != 0 {
+		t.Fatalf("Traced %d exchanges with tracing off", n)
+	}
+
+	TraceSOAPHost(strings.TrimPrefix(srv.URL, "http://"), true)
+	defer TraceSOAPHost(strings.TrimPrefix(srv.URL, "http://"), false)
+	Stop(srv.URL + "/avt")
+	traces := SOAPTraces()
+	if len(traces) != 1 {
+		t.Fatalf("Traced %d exchanges, want 1", len(traces))
+	}
+	x := traces[0]
+	if x.Action != "Stop" || x.Status != http.StatusInternalServerError || x.ResponseHeader.Get("X-Renderer") != "test" {
+		t.Errorf("Unexpected exchange: %+v", x)
+	}
+	if !strings.Contains(x.Request, "<u:Stop") || !strings.Contains(x.Response, "714") {
+		t.Errorf("Expected full bodies, got request %q, response %q", x.Request, x.Response)
+	}
+	if !strings.Contains(x.RequestHeader.Get("SOAPAction"), "#Stop") {
+		t.Errorf("SOAPAction header = %q", x.RequestHeader.Get("SOAPAction"))
+	}
+
+	for i := 0; i < DefaultSOAPTraceSize+5; i++ {
+		recordSOAP(SOAPExchange{Action: strconv.Itoa(i)})
+	}
+	traces = SOAPTraces()
+	if len(traces) != DefaultSOAPTraceSize || traces[0].Action != "5" {
+		t.Errorf("Ring buffer kept %d exchanges starting at %q", len(traces), traces[0].Action)
+	}
+}
+
+func TestCastRequestDIDL(t *testing.T) {
+	if meta, err := (CastRequest{URL: "http://x/a.mp4"}).DIDL(); err != nil || meta != "" {
+		t.Errorf("Expected no metadata for a bare URL, got %q, %v", meta, err)
+	}
+
+	meta, err := CastRequest{
+		URL:          "http://x/a.mkv",
+		Title:        "A & B",
+		ProtocolInfo: "http-get:*:video/x-matroska:DLNA.ORG_OP=01",
+		Subtitles:    "http://x/a.srt",
+	}.DIDL()
+	if err != nil {
+		t.Fatalf("DIDL failed: %v", err)
+	}
+	for _, want := range []string{
+		"<dc:title>A &amp; B</dc:title>",
+		`<res protocolInfo="http-get:*:video/x-matroska:DLNA.ORG_OP=01">http://x/a.mkv</res>`,
+		`<res protocolInfo="http-get:*:text/srt:*">http://x/a.srt</res>`,
+		`xmlns:sec="http://www.sec.co.kr/"`,
+		`<sec:CaptionInfoEx sec:type="srt">http://x/a.srt</sec:CaptionInfoEx>`,
+	} {
+		if !strings.Contains(meta, want) {
+			t.Errorf("Expected %s in %s", want, meta)
+		}
+	}
+}
+
+func TestPrepareForConnection(t *testing.T) {
+	var reqBody string
+	avtID := "3"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		reqBody = string(b)
+		w.Write(ResponseEnvelope(serviceConnectionManager, "PrepareForConnection", []Arg{{"ConnectionID", "7"}, {"AVTransportID", avtID}, {"RcsID", "2"}}))
+	}))
+	defer srv.Close()
+
+	conn, err := PrepareForConnection(context.Background(), srv.URL, "http-get:*:video/mp4:*")
+	if err != nil {
+		t.Fatalf("PrepareForConnection failed: %v", err)
+	}
+	if *conn != (Connection{ConnectionID: 7, AVTransportID: 3, RcsID: 2}) {
+		t.Errorf("Unexpected connection %+v", conn)
+	}
+	if !strings.Contains(reqBody, "<RemoteProtocolInfo>http-get:*:video/mp4:*</RemoteProtocolInfo><PeerConnectionManager></PeerConnectionManager><PeerConnectionID>-1</PeerConnectionID><Direction>Input</Direction>") {
+		t.Errorf("Unexpected request body: %s", reqBody)
+	}
+
+	for _, id := range []string{"", "-1", "new"} {
+		avtID = id
+		if _, err := PrepareForConnection(context.Background(), srv.URL, "http-get:*:*:*"); err == nil || !strings.Contains(err.Error(), "AVTransportID") {
+			t.Errorf("Expected an invalid AVTransportID %q to fail, got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package dlna
+
+import (
+	"sync"
+	"time"
+)
+
+// descriptionTTL bounds how long a cached description is trusted when the
+// device does not send BOOTID.UPNP.ORG.
+const descriptionTTL = 1 * time.Hour
+
+// descriptionCache coalesces concurrent description fetches for the same
+// Location and caches the result keyed by Location+BOOTID, so repeated
+// announcements don't hammer the renderer's HTTP server. Expired entries,
+// and those of a Location that has since rebooted, are evicted whenever a
+// description is added, so the cache holds about one entry per device.
+type descriptionCache struct {
+	mu       sync.Mutex
+	inflight map[string]*descriptionCall
+	entries  map[string]descriptionEntry
+}
+
+type descriptionCall struct {
+	done    chan struct{}
+	devices []*Device
+	err     error
+}
+
+type descriptionEntry struct {
+	location string
+	devices  []*Device
+	fetched  time.Time
+}
+
+func newDescriptionCache() *descriptionCache {
+	return &descriptionCache{
+		inflight: make(map[string]*descriptionCall),
+		entries:  make(map[string]descriptionEntry),
+	}
+}
+
+// fetch returns copies of the devices described at location, fetching it at
+// most once per location+bootID at a time.
+func (c *descriptionCache) fetch(location, bootID string) ([]*Device, error) {
+	key := location + "|" + bootID
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && time.Since(e.fetched) < descriptionTTL {
+		c.mu.Unlock()
+		return copyDevices(e.devices), nil
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		return copyDevices(call.devices), nil
+	}
+	call := &descriptionCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.devices, call.err = fetchDevice(location)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil {
+		c.evictLocked(location)
+		c.entries[key] = descriptionEntry{location: location, devices: call.devices, fetched: time.Now()}
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	return copyDevices(call.devices), nil
+}
+
+// evictLocked drops the expired entries and those of location, which is
+// about to be cached under its new BOOTID. Callers must hold c.mu.
+func (c *descriptionCache) evictLocked(location string) {
+	for key, e := range c.entries {
+		if e.location == location || time.Since(e.fetched) >= descriptionTTL {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func copyDevices(devices []*Device) []*Device {
+	out := make([]*Device, len(devices))
+	for i, d := range devices {
+		dev := *d
+		out[i] = &dev
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+package dlna
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// descDevice is a <device> element. Root devices may embed further devices
+// (e.g. a MediaRenderer inside a vendor root device) in <deviceList>.
+type descDevice struct {
+	DeviceType   string `xml:"deviceType"`
+	UDN          string `xml:"UDN"`
+	FriendlyName string `xml:"friendlyName"`
+	Manufacturer string `xml:"manufacturer"`
+	ModelName    string `xml:"modelName"`
+	ServiceList  struct {
+		Service []struct {
+			ServiceType string `xml:"serviceType"`
+			ControlURL  string `xml:"controlURL"`
+			EventSubURL string `xml:"eventSubURL"`
+			SCPDURL     string `xml:"SCPDURL"`
+		} `xml:"service"`
+	} `xml:"serviceList"`
+	DeviceList struct {
+		Device []descDevice `xml:"device"`
+	} `xml:"deviceList"`
+}
+
+// fetchDevice downloads the description XML at location and returns one
+// Device per (sub-)device that exposes AVTransport or ContentDirectory.
+// USN is taken from each device's UDN; UUIDs lists every UDN under the root,
+// so announcements for any of them can be mapped back to these devices.
+func fetchDevice(location string) ([]*Device, error) {
+	resp, err := http.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("description request failed with status %d", resp.StatusCode)
+	}
+
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  descDevice `xml:"device"`
+	}
+
+	dec := xml.NewDecoder(resp.Body)
+	dec.CharsetReader = charsetReader
+	if err := dec.Decode(&desc); err != nil {
+		return nil, err
+	}
+
+	// Relative service URLs resolve against URLBase (UPnP 1.0) if present,
+	// otherwise against the description location.
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if urlBase := strings.TrimSpace(desc.URLBase); urlBase != "" {
+		if u, err := base.Parse(urlBase); err == nil {
+			inheritZone(u, base)
+			base = u
+		}
+	}
+
+	var uuids []string
+	var devices []*Device
+	var walk func(d *descDevice)
+	walk = func(d *descDevice) {
+		if udn := strings.TrimSpace(d.UDN); udn != "" {
+			uuids = append(uuids, udn)
+		}
+		if dev := deviceFromDesc(location, base, d); dev != nil {
+			devices = append(devices, dev)
+		}
+		for i := range d.DeviceList.Device {
+			walk(&d.DeviceList.Device[i])
+		}
+	}
+	walk(&desc.Device)
+
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no AVTransport or ContentDirectory service in %s", location)
+	}
+
+	for _, dev := range devices {
+		dev.UUIDs = uuids
+	}
+	return devices, nil
+}
+
+// deviceFromDesc builds a Device from a single description node, or nil if
+// the node has none of the services the agent uses.
+func deviceFromDesc(location string, base *url.URL, d *descDevice) *Device {
+	services := make(map[string]Service)
+	for _, svc := range d.ServiceList.Service {
+		typ := strings.TrimSpace(svc.ServiceType)
+		if _, dup := services[typ]; dup || typ == "" {
+			continue
+		}
+		services[typ] = Service{
+			ControlURL:  resolveURL(base, svc.ControlURL),
+			EventSubURL: resolveURL(base, svc.EventSubURL),
+			SCPDURL:     resolveURL(base, svc.SCPDURL),
+		}
+	}
+
+	dev := &Device{Services: services}
+	avt, _ := dev.Service("AVTransport")
+	if avt.ControlURL == "" && dev.ContentDirectoryURL() == "" {
+		return nil
+	}
+
+	var actions []string
+	if avt.SCPDURL != "" {
+		// Not fatal: Supports() assumes everything when the list is empty
+		if a, err := fetchActions(avt.SCPDURL); err == nil {
+			actions = a
+		}
+	}
+
+	manufacturer := strings.TrimSpace(d.Manufacturer)
+	model := strings.TrimSpace(d.ModelName)
+	dev.USN = strings.TrimSpace(d.UDN)
+	dev.DeviceType = strings.TrimSpace(d.DeviceType)
+	dev.Location = location
+	dev.FriendlyName = NormalizeName(d.FriendlyName)
+	dev.Manufacturer = manufacturer
+	dev.ModelName = model
+	dev.Quirks = LookupQuirks(manufacturer, model)
+	dev.SupportedActions = actions
+	return dev
+}
+
+// charsetReader decodes descriptions declared as ISO-8859-1. Other
+// declared charsets, e.g. Shift_JIS or EUC-KR, are read as they are:
+// devices declaring them mostly send UTF-8 anyway, and NormalizeName
+// replaces what is not.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso_8859-1", "latin1", "l1":
+		b, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		return strings.NewReader(string(r)), nil
+	}
+	return input, nil
+}
+
+// resolveURL makes a service URL from the description absolute.
+func resolveURL(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	inheritZone(u, base)
+	return u.String()
+}
@@ -1,15 +1,158 @@
 package dlna
 
 import (
+	"encoding/json"
+	"sort"
+	"strings"
 	"time"
 )
 
+// Service is one UPnP service of a device, with its URLs made absolute.
+type Service struct {
+	ControlURL  string `json:"control_url"`
+	EventSubURL string `json:"event_sub_url,omitempty"`
+	SCPDURL     string `json:"scpd_url,omitempty"`
+}
+
 // Device represents a DLNA/UPnP device
 type Device struct {
 	USN          string    `json:"usn"`
+	DeviceType   string    `json:"device_type"`
 	Location     string    `json:"location"`
 	Server       string    `json:"server"`
 	FriendlyName string    `json:"friendly_name"`
+	Manufacturer string    `json:"manufacturer,omitempty"`
+	ModelName    string    `json:"model_name,omitempty"`
+	Online       bool      `json:"online"`
 	LastSeen     time.Time `json:"last_seen"`
-	ControlURL   string    `json:"control_url"` // AVTransport Control URL
+	ExpiresAt    time.Time `json:"expires_at"`    // LastSeen + CACHE-CONTROL max-age
+	Manual       bool      `json:"manual"`        // Registered via AddManualDevice
+	MAC          string    `json:"mac,omitempty"` // For Wake-on-LAN, from config or ARP
+
+	// Services are the services of the description, keyed by service type
+	// (e.g. urn:schemas-upnp-org:service:AVTransport:1); see Service.
+	Services map[string]Service `json:"services,omitempty"`
+
+	// SupportedActions lists the AVTransport actions declared in the SCPD.
+	SupportedActions []string `json:"supported_actions,omitempty"`
+
+	// Quirks are the built-in workarounds for this model; see LookupQuirks.
+	Quirks Quirks `json:"quirks,omitempty"`
+
+	// UUIDs lists every UDN of the physical device (root and embedded
+	// devices), which may each announce themselves separately.
+	UUIDs []string `json:"uuids,omitempty"`
+}
+
+// Service returns the service called name, either a full service type or
+// just its name such as "RenderingControl". The version is ignored; if the
+// device has several versions, the lowest is returned.
+func (d *Device) Service(name string) (Service, bool) {
+	if svc, ok := d.Services[name]; ok {
+		return svc, true
+	}
+	name = serviceName(name)
+	var types []string
+	for typ := range d.Services {
+		if serviceName(typ) == name {
+			types = append(types, typ)
+		}
+	}
+	if len(types) == 0 {
+		return Service{}, false
+	}
+	sort.Strings(types)
+	return d.Services[types[0]], true
+}
+
+// ControlURL returns the control URL of the service called name, or "" if
+// the device has no such service.
+func (d *Device) ControlURL(name string) string {
+	svc, _ := d.Service(name)
+	return svc.ControlURL
+}
+
+// AVTransportURL returns the AVTransport control URL, "" for servers.
+func (d *Device) AVTransportURL() string { return d.ControlURL("AVTransport") }
+
+// RenderingControlURL returns the RenderingControl (volume and mute)
+// control URL.
+func (d *Device) RenderingControlURL() string { return d.ControlURL("RenderingControl") }
+
+// ConnectionManagerURL returns the ConnectionManager control URL, used for
+// PrepareForConnection.
+func (d *Device) ConnectionManagerURL() string { return d.ControlURL("ConnectionManager") }
+
+// ContentDirectoryURL returns the ContentDirectory control URL, set for
+// MediaServers.
+func (d *Device) ContentDirectoryURL() string { return d.ControlURL("ContentDirectory") }
+
+// serviceName is the name of a service type without its domain and
+// version, e.g. "AVTransport".
+func serviceName(typ string) string {
+	typ = stripVersion(strings.TrimSpace(typ))
+	if i := strings.LastIndex(typ, ":"); i != -1 {
+		return typ[i+1:]
+	}
+	return typ
+}
+
+// LegacyURLs are the single control URLs a Device had before Services.
+// They are still part of its JSON, so that clients of the v1 API keep
+// finding control_url, and read from snapshots that have no services.
+type LegacyURLs struct {
+	ControlURL           string `json:"control_url"` // AVTransport
+	ContentDirectoryURL  string `json:"content_directory_url,omitempty"`
+	ConnectionManagerURL string `json:"connection_manager_url,omitempty"`
+	RenderingControlURL  string `json:"rendering_control_url,omitempty"`
+}
+
+// MarshalJSON adds the LegacyURLs to the services.
+func (d Device) MarshalJSON() ([]byte, error) {
+	type device Device
+	return json.Marshal(struct {
+		device
+		LegacyURLs
+	}{device(d), LegacyURLs{
+		ControlURL:           d.AVTransportURL(),
+		ContentDirectoryURL:  d.ContentDirectoryURL(),
+		ConnectionManagerURL: d.ConnectionManagerURL(),
+		RenderingControlURL:  d.RenderingControlURL(),
+	}})
+}
+
+// UnmarshalJSON also reads the LegacyURLs that snapshots of older versions
+// have instead of services.
+func (d *Device) UnmarshalJSON(data []byte) error {
+	type device Device
+	var legacy struct {
+		*device
+		LegacyURLs
+	}
+	legacy.device = (*device)(d)
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	if d.Services != nil {
+		return nil
+	}
+	for typ, url := range map[string]string{
+		serviceAVTransport:       legacy.ControlURL,
+		serviceContentDirectory:  legacy.ContentDirectoryURL,
+		serviceConnectionManager: legacy.ConnectionManagerURL,
+		serviceRenderingControl:  legacy.RenderingControlURL,
+	} {
+		if url != "" {
+			if d.Services == nil {
+				d.Services = make(map[string]Service)
+			}
+			d.Services[typ] = Service{ControlURL: url}
+		}
+	}
+	return nil
+}
+
+// IsServer reports whether the device is a UPnP MediaServer.
+func (d *Device) IsServer() bool {
+	return stripVersion(d.DeviceType) == stripVersion(DeviceTypeMediaServer)
 }
@@ -0,0 +1,48 @@
+package dlna
+
+import "log"
+
+// DeviceEvent is a change of the device list, passed to the device hook.
+type DeviceEvent string
+
+const (
+	DeviceAdded   DeviceEvent = "device-added"   // Seen for the first time
+	DeviceOnline  DeviceEvent = "device-online"  // Back after being offline
+	DeviceOffline DeviceEvent = "device-offline" // ssdp:byebye or expired
+	DeviceRemoved DeviceEvent = "device-removed" // Dropped by the device filter or offline too long
+)
+
+// deviceEventQueue bounds the events waiting for a slow hook; further ones
+// are dropped.
+const deviceEventQueue = 64
+
+type deviceEvent struct {
+	event  DeviceEvent
+	device Device
+}
+
+// SetDeviceHook calls fn for every device list change, in order, from a
+// single goroutine. fn gets a copy of the device.
+func (s *DiscoveryService) SetDeviceHook(fn func(DeviceEvent, Device)) {
+	ch := make(chan deviceEvent, deviceEventQueue)
+	s.mu.Lock()
+	s.deviceEvents = ch
+	s.mu.Unlock()
+	go func() {
+		for ev := range ch {
+			fn(ev.event, ev.device)
+		}
+	}()
+}
+
+// emitLocked queues ev for the device hook. Callers must hold s.mu.
+func (s *DiscoveryService) emitLocked(ev DeviceEvent, d *Device) {
+	if s.deviceEvents == nil {
+		return
+	}
+	select {
+	case s.deviceEvents <- deviceEvent{ev, *d}:
+	default:
+		log.Printf("Device hook is falling behind, dropped %s for %s", ev, d.FriendlyName)
+	}
+}
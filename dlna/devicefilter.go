@@ -0,0 +1,56 @@
+package dlna
+
+import "log"
+
+// DeviceFilter limits which discovered devices are kept, by USN or
+// friendlyName. Patterns are substrings, ignoring case, diacritics and
+// width (see FoldName). Manually added
+// and static devices are not filtered.
+type DeviceFilter struct {
+	Allow []string `json:"allow"` // If set, only devices matching one of these are kept
+	Block []string `json:"block"` // Devices matching one of these are dropped
+}
+
+func matchesAny(patterns []string, values ...string) bool {
+	for _, p := range patterns {
+		for _, v := range values {
+			if v != "" && NameContains(v, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blocksUSN reports whether usn alone rules a device out. It is checked
+// before the description is fetched, when the friendlyName is not known
+// yet, so the allowlist cannot apply.
+func (f DeviceFilter) blocksUSN(usn string) bool {
+	return matchesAny(f.Block, usn)
+}
+
+// allows reports whether a device with the given USN and friendlyName is
+// kept.
+func (f DeviceFilter) allows(usn, name string) bool {
+	if matchesAny(f.Block, usn, name) {
+		return false
+	}
+	return len(f.Allow) == 0 || matchesAny(f.Allow, usn, name)
+}
+
+// SetDeviceFilter replaces the device filter. Known devices that no longer
+// pass are dropped, and previously ignored ones are reconsidered on their
+// next announcement.
+func (s *DiscoveryService) SetDeviceFilter(f DeviceFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deviceFilter = f
+	s.ignored = make(map[string]struct{})
+	for usn, d := range s.devices {
+		if !d.Manual && !f.allows(d.USN, d.FriendlyName) {
+			delete(s.devices, usn)
+			log.Printf("Device removed (filter): %s", d.FriendlyName)
+			s.emitLocked(DeviceRemoved, d)
+		}
+	}
+}
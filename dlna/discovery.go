@@ -3,74 +3,109 @@ package dlna
 import (
 	"bufio"
 	"bytes"
-	"encoding/xml"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	ssdpMulticastAddrV4 = "239.255.255.250:1900"
 	ssdpMulticastAddrV6 = "[ff02::c]:1900"
-	ssdpSearchMsg       = "M-SEARCH * HTTP/1.1\r\n" +
+	// Some bridged multi-segment IPv6 networks only propagate the
+	// site-local group, so it is used alongside the link-local one.
+	ssdpMulticastAddrV6Site = "[ff05::c]:1900"
+	ssdpSearchMsg           = "M-SEARCH * HTTP/1.1\r\n" +
 		"HOST: %s\r\n" +
 		"MAN: \"ssdp:discover\"\r\n" +
-		"MX: 1\r\n" +
+		"MX: %d\r\n" +
 		"ST: ssdp:all\r\n" +
 		"\r\n"
+
+	// defaultMaxAge is the default Tuning.DeviceExpiry.
+	defaultMaxAge = 5 * time.Minute
+
+	DeviceTypeMediaRenderer = "urn:schemas-upnp-org:device:MediaRenderer:1"
+	DeviceTypeMediaServer   = "urn:schemas-upnp-org:device:MediaServer:1"
 )
 
 type DiscoveryService struct {
-	devices  map[string]*Device
-	mu       sync.RWMutex
-	bindIP   string
-	interval time.Duration
+	devices      map[string]*Device
+	manual       map[string]string   // description URL -> name override, for manual/static devices
+	macs         map[string]string   // USN or Location -> MAC, for Wake-on-LAN
+	ignored      map[string]struct{} // USNs filtered out after fetching their description
+	aliases      map[string][]string // any UDN of a physical device -> USNs of its entries
+	types        []string            // Accepted deviceTypes; empty accepts all
+	deviceFilter DeviceFilter
+	filter       *packetFilter
+	descs        *descriptionCache
+	mu           sync.RWMutex
+	bindIP       string
+	interval     time.Duration
+	tuning       Tuning
+
+	searchTargets []*net.UDPAddr // Unicast M-SEARCH targets
+	sweep         Sweep
+	sweepNow      chan struct{}
+	capture       *packetCapture // Set with -debug-ssdp
+	fetches       sync.WaitGroup // Description fetches started by packets
+	deviceEvents  chan deviceEvent
+	multicastSeen atomic.Bool // Set by the first multicast packet not sent by a search
 }
 
 func NewDiscoveryService(bindIP string, interval time.Duration) *DiscoveryService {
 	return &DiscoveryService{
 		devices:  make(map[string]*Device),
+		manual:   make(map[string]string),
+		macs:     make(map[string]string),
+		ignored:  make(map[string]struct{}),
+		aliases:  make(map[string][]string),
+		types:    []string{DeviceTypeMediaRenderer},
+		filter:   newPacketFilter(),
+		descs:    newDescriptionCache(),
 		bindIP:   bindIP,
 		interval: interval,
+		tuning:   DefaultTuning(),
+		sweepNow: make(chan struct{}, 1),
 	}
 }
 
+// SetDeviceTypes configures which renderer deviceTypes SSDP discovery keeps.
+// The version suffix is ignored when matching. An empty list accepts all
+// devices that expose an AVTransport service. MediaServers with a
+// ContentDirectory are always kept and listed separately via GetServers.
+func (s *DiscoveryService) SetDeviceTypes(types []string) {
+	s.mu.Lock()
+	s.types = types
+	s.ignored = make(map[string]struct{})
+	s.mu.Unlock()
+}
+
 func (s *DiscoveryService) Start() {
 	go s.listenMulticast()
 	go s.searchLoop()
-	go s.cleanupLoop()
+	go s.healthLoop()
+	go s.manualLoop()
+	go s.checkMulticast()
+	go s.sweepLoop()
 }
 
 func (s *DiscoveryService) searchLoop() {
 	// Send immediately
 	s.sendSearch()
+	go s.sendUnicastSearch()
 
 	ticker := time.NewTicker(s.interval)
 	defer ticker.Stop()
 
 	for range ticker.C {
 		s.sendSearch()
-	}
-}
-
-func (s *DiscoveryService) cleanupLoop() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		s.mu.Lock()
-		now := time.Now()
-		for usn, dev := range s.devices {
-			if now.Sub(dev.LastSeen) > 5*time.Minute {
-				delete(s.devices, usn)
-				log.Printf("Device removed (timeout): %s", dev.FriendlyName)
-			}
-		}
-		s.mu.Unlock()
+		go s.sendUnicastSearch()
 	}
 }
 
@@ -81,39 +116,48 @@ func (s *DiscoveryService) sendSearch() {
 		return
 	}
 
-	for _, ip := range ips {
-		var addrStr string
-		var network string
+	tuning := s.Tuning()
 
-		if ip.To4() != nil {
-			addrStr = ssdpMulticastAddrV4
-			network = "udp4"
-		} else {
-			addrStr = ssdpMulticastAddrV6
-			network = "udp6"
-		}
-
-		addr, err := net.ResolveUDPAddr(network, addrStr)
-		if err != nil {
-			log.Printf("Error resolving UDP address %s: %v", addrStr, err)
-			continue
-		}
+	for _, ip := range ips {
+		network, groups := multicastGroups(ip)
 
 		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip, Port: 0})
 		if err != nil {
 			continue
 		}
+		if tuning.HopLimit > 0 {
+			if err := setMulticastHops(conn, tuning.HopLimit); err != nil {
+				log.Printf("Error setting multicast hop limit on %s: %v", ip, err)
+			}
+		}
+
+		for _, addrStr := range groups {
+			addr, err := net.ResolveUDPAddr(network, addrStr)
+			if err != nil {
+				log.Printf("Error resolving UDP address %s: %v", addrStr, err)
+				continue
+			}
 
-		// Format message with correct HOST
-		msg := fmt.Sprintf(ssdpSearchMsg, addrStr)
+			// Format message with correct HOST
+			msg := fmt.Sprintf(ssdpSearchMsg, addrStr, tuning.SearchMX)
 
-		if _, err := conn.WriteTo([]byte(msg), addr); err != nil {
-			log.Printf("Error sending M-SEARCH from %s: %v", ip, err)
+			if _, err := conn.WriteTo([]byte(msg), addr); err != nil {
+				log.Printf("Error sending M-SEARCH from %s to %s: %v", ip, addrStr, err)
+			}
 		}
 		conn.Close()
 	}
 }
 
+// multicastGroups returns the network and SSDP groups to send to from the
+// local address ip. IPv6 uses both the link-local and site-local group.
+func multicastGroups(ip net.IP) (string, []string) {
+	if ip.To4() != nil {
+		return "udp4", []string{ssdpMulticastAddrV4}
+	}
+	return "udp6", []string{ssdpMulticastAddrV6, ssdpMulticastAddrV6Site}
+}
+
 func (s *DiscoveryService) listenMulticast() {
 	// Determine which versions to listen on
 	listenV4 := true
@@ -135,6 +179,7 @@ func (s *DiscoveryService) listenMulticast() {
 	}
 	if listenV6 {
 		go s.listenMulticastProto("udp6", ssdpMulticastAddrV6)
+		go s.listenMulticastProto("udp6", ssdpMulticastAddrV6Site)
 	}
 }
 
@@ -164,33 +209,55 @@ func (s *DiscoveryService) listenMulticastProto(network, addrStr string) {
 	}
 	defer conn.Close()
 
-	conn.SetReadBuffer(4096)
-	buf := make([]byte, 4096)
+	size := s.Tuning().ReadBuffer
+	conn.SetReadBuffer(size)
+	buf := make([]byte, size)
 
 	for {
-		n, _, err := conn.ReadFromUDP(buf)
+		if size = s.Tuning().ReadBuffer; size != len(buf) {
+			conn.SetReadBuffer(size)
+			buf = make([]byte, size)
+		}
+		n, src, err := conn.ReadFromUDP(buf)
 		if err != nil {
 			log.Printf("Error reading packet: %v", err)
 			continue
 		}
-		s.processPacket(buf[:n])
+		// Our own M-SEARCH loops back even where nothing else gets through
+		if !bytes.HasPrefix(buf[:n], []byte("M-SEARCH")) {
+			s.multicastSeen.Store(true)
+		}
+		s.processPacket(buf[:n], src)
 	}
 }
 
-func (s *DiscoveryService) processPacket(data []byte) {
+func (s *DiscoveryService) processPacket(data []byte, src *net.UDPAddr) {
+	s.capturePacket(data, src)
+	if src != nil && !s.filter.allowSource(src.IP.String()) {
+		return
+	}
+
+	var header http.Header
+
 	// Try parsing as Request (NOTIFY)
-	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
-	if err == nil {
-		s.handleHeaders(req.Header)
+	if req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data))); err == nil {
+		header = req.Header
+	} else if resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil); err == nil {
+		// Parsed as Response (HTTP/1.1 200 OK)
+		header = resp.Header
+	} else {
 		return
 	}
 
-	// Try parsing as Response (HTTP/1.1 200 OK)
-	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
-	if err == nil {
-		s.handleHeaders(resp.Header)
+	if s.filter.isDuplicate(header) {
 		return
 	}
+	if src != nil {
+		if loc := header.Get("Location"); loc != "" {
+			header.Set("Location", withZone(loc, src.Zone))
+		}
+	}
+	s.handleHeaders(header)
 }
 
 func (s *DiscoveryService) handleHeaders(header http.Header) {
@@ -198,101 +265,207 @@ func (s *DiscoveryService) handleHeaders(header http.Header) {
 	location := header.Get("Location")
 	server := header.Get("Server")
 
-	if usn == "" || location == "" {
+	if usn == "" {
 		return
 	}
 
-	uuid := strings.Split(usn, "::")[0]
-
 	s.mu.RLock()
-	_, exists := s.devices[uuid]
+	blocked := s.deviceFilter.blocksUSN(usn)
 	s.mu.RUnlock()
+	if blocked {
+		return
+	}
+
+	uuid := strings.Split(usn, "::")[0]
 
-	if exists {
+	// byebye announcements carry no Location, so handle them first
+	if strings.EqualFold(header.Get("NTS"), "ssdp:byebye") {
 		s.mu.Lock()
-		if d, ok := s.devices[uuid]; ok {
-			d.LastSeen = time.Now()
+		for _, d := range s.lookupLocked(uuid) {
+			if d.Online {
+				d.Online = false
+				log.Printf("Device offline (byebye): %s", d.FriendlyName)
+				s.emitLocked(DeviceOffline, d)
+			}
 		}
 		s.mu.Unlock()
 		return
 	}
 
-	// New device, fetch description
-	go s.fetchDescription(uuid, location, server)
-}
-
-func (s *DiscoveryService) fetchDescription(uuid, location, server string) {
-	resp, err := http.Get(location)
-	if err != nil {
+	if location == "" {
 		return
 	}
-	defer resp.Body.Close()
 
-	var desc struct {
-		Device struct {
-			FriendlyName string `xml:"friendlyName"`
-			ServiceList  struct {
-				Service []struct {
-					ServiceType string `xml:"serviceType"`
-					ControlURL  string `xml:"controlURL"`
-				} `xml:"service"`
-			} `xml:"serviceList"`
-		} `xml:"device"`
+	maxAge := parseMaxAge(header.Get("Cache-Control"), s.Tuning().DeviceExpiry)
+
+	s.mu.Lock()
+	known := s.lookupLocked(uuid)
+	for _, d := range known {
+		s.markOnline(d, maxAge)
 	}
+	_, ignored := s.ignored[uuid]
+	s.mu.Unlock()
 
-	if err := xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+	if ignored || len(known) > 0 {
 		return
 	}
 
-	controlURL := ""
-	for _, svc := range desc.Device.ServiceList.Service {
-		if strings.Contains(svc.ServiceType, "AVTransport") {
-			controlURL = svc.ControlURL
+	// New device, fetch description
+	s.fetches.Add(1)
+	go func() {
+		defer s.fetches.Done()
+		s.fetchDescription(uuid, location, server, header.Get("BOOTID.UPNP.ORG"), maxAge)
+	}()
+}
+
+// parseMaxAge extracts max-age from a CACHE-CONTROL header value,
+// falling back to fallback when it is missing or invalid.
+func parseMaxAge(value string, fallback time.Duration) time.Duration {
+	for _, part := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "max-age") {
+			continue
+		}
+		secs, err := strconv.Atoi(strings.Trim(strings.TrimSpace(v), "\""))
+		if err != nil || secs <= 0 {
 			break
 		}
+		return time.Duration(secs) * time.Second
 	}
+	return fallback
+}
 
-	if controlURL == "" {
+func (s *DiscoveryService) fetchDescription(uuid, location, server, bootID string, maxAge time.Duration) {
+	devices, err := s.descs.fetch(location, bootID)
+	if err != nil {
 		return
 	}
 
-	// Normalize ControlURL
-	if !strings.HasPrefix(controlURL, "http") {
-		baseURL := location
-		if lastSlash := strings.LastIndex(location, "/"); lastSlash != -1 {
-			baseURL = location[:lastSlash]
+	s.mu.RLock()
+	var accepted []*Device
+	for _, dev := range devices {
+		usn := dev.USN
+		if usn == "" {
+			usn = uuid
 		}
-		if strings.HasPrefix(controlURL, "/") {
-			u, _ := http.NewRequest("GET", location, nil)
-			controlURL = fmt.Sprintf("%s://%s%s", u.URL.Scheme, u.URL.Host, controlURL)
+		if !s.deviceFilter.allows(usn, dev.FriendlyName) {
+			log.Printf("Device ignored (filter): %s", dev.FriendlyName)
+		} else if (dev.IsServer() && dev.ContentDirectoryURL() != "") ||
+			(dev.AVTransportURL() != "" && matchesDeviceType(s.types, dev.DeviceType)) {
+			accepted = append(accepted, dev)
 		} else {
-			controlURL = fmt.Sprintf("%s/%s", baseURL, controlURL)
+			log.Printf("Device ignored (type %s): %s", dev.DeviceType, dev.FriendlyName)
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(accepted) == 0 {
+		s.mu.Lock()
+		s.ignored[uuid] = struct{}{}
+		s.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	for _, dev := range accepted {
+		if dev.USN == "" {
+			dev.USN = uuid
+		}
+		dev.Server = server
+		dev.LastSeen = now
+		dev.ExpiresAt = now.Add(maxAge)
+		dev.Online = true
+	}
+
+	s.addDevices(accepted)
+}
+
+func matchesDeviceType(types []string, deviceType string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		if stripVersion(t) == stripVersion(deviceType) {
+			return true
 		}
 	}
+	return false
+}
 
-	dev := &Device{
-		USN:          uuid,
-		Location:     location,
-		FriendlyName: desc.Device.FriendlyName,
-		Server:       server,
-		LastSeen:     time.Now(),
-		ControlURL:   controlURL,
+// stripVersion turns "urn:...:MediaRenderer:1" into "urn:...:MediaRenderer".
+func stripVersion(urn string) string {
+	if i := strings.LastIndex(urn, ":"); i != -1 {
+		if _, err := strconv.Atoi(urn[i+1:]); err == nil {
+			return urn[:i]
+		}
 	}
+	return urn
+}
 
+// addDevices adds the entries of one physical device and maps all of its
+// UDNs to them.
+func (s *DiscoveryService) addDevices(devices []*Device) {
 	s.mu.Lock()
-	if _, exists := s.devices[uuid]; !exists {
-		s.devices[uuid] = dev
-		log.Printf("Device added: %s (%s)", dev.FriendlyName, dev.Location)
+	defer s.mu.Unlock()
+
+	usns := make([]string, 0, len(devices))
+	for _, dev := range devices {
+		usns = append(usns, dev.USN)
+		if _, exists := s.devices[dev.USN]; !exists {
+			s.resolveMAC(dev)
+			s.devices[dev.USN] = dev
+			log.Printf("Device added: %s (%s)", dev.FriendlyName, dev.Location)
+			s.emitLocked(DeviceAdded, dev)
+		}
+	}
+	for _, dev := range devices {
+		for _, uuid := range dev.UUIDs {
+			s.aliases[uuid] = usns
+		}
 	}
-	s.mu.Unlock()
 }
 
+// lookupLocked returns the known entries for a UDN, following aliases of
+// embedded devices. Callers must hold s.mu.
+func (s *DiscoveryService) lookupLocked(uuid string) []*Device {
+	var found []*Device
+	if usns, ok := s.aliases[uuid]; ok {
+		for _, usn := range usns {
+			if d, ok := s.devices[usn]; ok {
+				found = append(found, d)
+			}
+		}
+		return found
+	}
+	if d, ok := s.devices[uuid]; ok {
+		found = append(found, d)
+	}
+	return found
+}
+
+// markOnline refreshes LastSeen/ExpiresAt. Callers must hold s.mu.
+func (s *DiscoveryService) markOnline(d *Device, maxAge time.Duration) {
+	d.LastSeen = time.Now()
+	d.ExpiresAt = d.LastSeen.Add(maxAge)
+	if d.MAC == "" {
+		s.resolveMAC(d)
+	}
+	if !d.Online {
+		d.Online = true
+		log.Printf("Device online: %s", d.FriendlyName)
+		s.emitLocked(DeviceOnline, d)
+	}
+}
+
+// GetDevices returns the known renderers.
 func (s *DiscoveryService) GetDevices() []*Device {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	devices := make([]*Device, 0, len(s.devices))
 	for _, d := range s.devices {
-		devices = append(devices, d)
+		if !d.IsServer() {
+			devices = append(devices, d)
+		}
 	}
 	return devices
 }
@@ -300,16 +473,47 @@ func (s *DiscoveryService) GetDevices() []*Device {
 func (s *DiscoveryService) GetDevice(usn string) *Device {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.devices[usn]
+	if d := s.devices[usn]; d != nil && !d.IsServer() {
+		return d
+	}
+	return nil
+}
+
+// GetServers returns the known MediaServers.
+func (s *DiscoveryService) GetServers() []*Device {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	servers := make([]*Device, 0)
+	for _, d := range s.devices {
+		if d.IsServer() {
+			servers = append(servers, d)
+		}
+	}
+	return servers
+}
+
+func (s *DiscoveryService) GetServer(usn string) *Device {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if d := s.devices[usn]; d != nil && d.IsServer() {
+		return d
+	}
+	return nil
 }
 
 // Helpers
 
 func (s *DiscoveryService) getBindIPs() ([]net.IP, error) {
-	if s.bindIP != "0.0.0.0" && s.bindIP != "" {
-		ip := net.ParseIP(s.bindIP)
+	return bindIPs(s.bindIP)
+}
+
+// bindIPs returns bindIP, or every non-loopback address of multicast
+// interfaces when it is unset or 0.0.0.0.
+func bindIPs(bindIP string) ([]net.IP, error) {
+	if bindIP != "0.0.0.0" && bindIP != "" {
+		ip := net.ParseIP(bindIP)
 		if ip == nil {
-			return nil, fmt.Errorf("invalid bind IP: %s", s.bindIP)
+			return nil, fmt.Errorf("invalid bind IP: %s", bindIP)
 		}
 		return []net.IP{ip}, nil
 	}
@@ -0,0 +1,855 @@
+package dlna
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseMaxAge(t *testing.T) {
+	cases := map[string]time.Duration{
+		"max-age=1800":         1800 * time.Second,
+		"no-cache, max-age=60": 60 * time.Second,
+		"MAX-AGE = 120":        120 * time.Second,
+		"":                     defaultMaxAge,
+		"max-age=abc":          defaultMaxAge,
+		"max-age=0":            defaultMaxAge,
+	}
+	for in, want := range cases {
+		if got := parseMaxAge(in, defaultMaxAge); got != want {
+			t.Errorf("parseMaxAge(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestByebyeMarksOffline(t *testing.T) {
+	s := NewDiscoveryService("", time.Second)
+	s.devices["uuid:1234"] = &Device{USN: "uuid:1234", FriendlyName: "TV", Online: true}
+
+	s.processPacket([]byte("NOTIFY * HTTP/1.1\r\n"+
+		"HOST: 239.255.255.250:1900\r\n"+
+		"NT: urn:schemas-upnp-org:service:AVTransport:1\r\n"+
+		"NTS: ssdp:byebye\r\n"+
+		"USN: uuid:1234::urn:schemas-upnp-org:service:AVTransport:1\r\n"+
+		"\r\n"), nil)
+
+	d := s.GetDevice("uuid:1234")
+	if d == nil {
+		t.Fatalf("Expected device to be kept after byebye")
+	}
+	if d.Online {
+		t.Errorf("Expected device to be offline after byebye")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	s := NewDiscoveryService("", time.Second)
+	s.devices["uuid:tv"] = &Device{USN: "uuid:tv", FriendlyName: "TV", Online: true,
+		DeviceType: "urn:schemas-upnp-org:device:MediaRenderer:1", Services: map[string]Service{serviceAVTransport: {ControlURL: "http://tv/ctl"}}, UUIDs: []string{"uuid:tv"}}
+	s.devices["uuid:nas"] = &Device{USN: "uuid:nas", FriendlyName: "NAS", Online: true,
+		DeviceType: "urn:schemas-upnp-org:device:MediaServer:1"}
+	snap := s.Snapshot()
+
+	r := NewDiscoveryService("", time.Second)
+	if n := r.Restore(snap); n != 1 {
+		t.Fatalf("Restore added %d devices, want 1 (the server has no ContentDirectory)", n)
+	}
+	d := r.GetDevice("uuid:tv")
+	if d == nil || d.AVTransportURL() != "http://tv/ctl" {
+		t.Fatalf("Restored device = %+v", d)
+	}
+	if d.Online {
+		t.Errorf("Expected a restored device to start offline")
+	}
+	if n := r.Restore(snap); n != 0 {
+		t.Errorf("Restoring again added %d devices, want 0", n)
+	}
+}
+
+func TestMatchesDeviceType(t *testing.T) {
+	types := []string{DeviceTypeMediaRenderer}
+	if !matchesDeviceType(types, "urn:schemas-upnp-org:device:MediaRenderer:2") {
+		t.Errorf("Expected MediaRenderer:2 to match regardless of version")
+	}
+	if matchesDeviceType(types, "urn:schemas-upnp-org:device:InternetGatewayDevice:1") {
+		t.Errorf("Expected router to be filtered out")
+	}
+	if !matchesDeviceType(nil, "urn:schemas-upnp-org:device:MediaServer:1") {
+		t.Errorf("Expected empty type list to accept everything")
+	}
+}
+
+func TestPacketFilter(t *testing.T) {
+	f := newPacketFilter()
+
+	header := http.Header{}
+	header.Set("USN", "uuid:1234::upnp:rootdevice")
+	header.Set("NTS", "ssdp:alive")
+	header.Set("BOOTID.UPNP.ORG", "7")
+
+	if f.isDuplicate(header) {
+		t.Errorf("First announcement must not be a duplicate")
+	}
+	if !f.isDuplicate(header) {
+		t.Errorf("Repeated announcement must be a duplicate")
+	}
+	header.Set("BOOTID.UPNP.ORG", "8")
+	if f.isDuplicate(header) {
+		t.Errorf("Announcement with a new BOOTID must not be a duplicate")
+	}
+
+	for i := 0; i < ipRateLimit; i++ {
+		if !f.allowSource("10.0.0.1") {
+			t.Fatalf("Packet %d should be within the rate limit", i)
+		}
+	}
+	if f.allowSource("10.0.0.1") {
+		t.Errorf("Expected packets above the rate limit to be dropped")
+	}
+	if !f.allowSource("10.0.0.2") {
+		t.Errorf("Rate limit must be per source IP")
+	}
+}
+
+func TestDescriptionCacheCoalesces(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`<root><device><UDN>uuid:1</UDN><friendlyName>TV</friendlyName>` +
+			`<serviceList><service><serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>` +
+			`<controlURL>/ctl</controlURL></service></serviceList></device></root>`))
+	}))
+	defer srv.Close()
+
+	c := newDescriptionCache()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.fetch(srv.URL, "1"); err != nil {
+				t.Errorf("fetch failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := c.fetch(srv.URL, "1"); err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("Expected 1 description request, got %d", n)
+	}
+
+	if _, err := c.fetch(srv.URL, "2"); err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("Expected a new BOOTID to refetch, got %d requests", n)
+	}
+}
+
+func TestDescriptionCacheEvicts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<root><device><UDN>uuid:` + r.URL.Path[1:] + `</UDN><friendlyName>TV</friendlyName>` +
+			`<serviceList><service><serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>` +
+			`<controlURL>/ctl</controlURL></service></serviceList></device></root>`))
+	}))
+	defer srv.Close()
+	c := newDescriptionCache()
+	keys := func() string {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		var keys []string
+		for key := range c.entries {
+			keys = append(keys, strings.TrimPrefix(key, srv.URL))
+		}
+		sort.Strings(keys)
+		return strings.Join(keys, ",")
+	}
+	fetch := func(path, bootID string) {
+		t.Helper()
+		if _, err := c.fetch(srv.URL+path, bootID); err != nil {
+			t.Fatalf("fetch failed: %v", err)
+		}
+	}
+
+	fetch("/tv", "1")
+	fetch("/speaker", "1")
+	// A reboot replaces the entry
+	fetch("/tv", "2")
+	if got := keys(); got != "/speaker|1,/tv|2" {
+		t.Errorf("Expected the rebooted TV's old entry to be evicted, got %s", got)
+	}
+
+	// Expired entries go when another description is cached
+	c.mu.Lock()
+	e := c.entries[srv.URL+"/speaker|1"]
+	e.fetched = time.Now().Add(-descriptionTTL)
+	c.entries[srv.URL+"/speaker|1"] = e
+	c.mu.Unlock()
+	fetch("/nas", "")
+	if got := keys(); got != "/nas|,/tv|2" {
+		t.Errorf("Expected the expired entry to be evicted, got %s", got)
+	}
+}
+
+func TestEmbeddedDevicesGrouped(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<root><device>
+  <deviceType>urn:schemas-upnp-org:device:Basic:1</deviceType>
+  <UDN>uuid:root</UDN>
+  <friendlyName>Vendor Box</friendlyName>
+  <deviceList>
+    <device>
+      <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+      <UDN>uuid:renderer</UDN>
+      <friendlyName>Vendor Box Renderer</friendlyName>
+      <serviceList><service>
+        <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+        <controlURL>/avt</controlURL>
+      </service></serviceList>
+    </device>
+  </deviceList>
+</device></root>`))
+	}))
+	defer srv.Close()
+
+	s := NewDiscoveryService("", time.Second)
+	s.fetchDescription("uuid:root", srv.URL, "", "", time.Minute)
+
+	devices := s.GetDevices()
+	if len(devices) != 1 {
+		t.Fatalf("Expected 1 device, got %d", len(devices))
+	}
+	d := devices[0]
+	if d.USN != "uuid:renderer" || d.AVTransportURL() != srv.URL+"/avt" {
+		t.Errorf("Unexpected device %+v", d)
+	}
+	if len(d.UUIDs) != 2 {
+		t.Errorf("Expected root and embedded UUIDs, got %v", d.UUIDs)
+	}
+
+	// A byebye for the root UUID must reach the embedded renderer
+	s.mu.Lock()
+	found := s.lookupLocked("uuid:root")
+	s.mu.Unlock()
+	if len(found) != 1 || found[0] != d {
+		t.Errorf("Expected root UUID to alias the renderer, got %v", found)
+	}
+}
+
+func TestDeviceServices(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<root><device>
+  <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+  <UDN>uuid:tv</UDN>
+  <serviceList>
+    <service>
+      <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+      <controlURL>/avt/control</controlURL>
+      <eventSubURL>/avt/event</eventSubURL>
+    </service>
+    <service>
+      <serviceType>urn:schemas-upnp-org:service:RenderingControl:2</serviceType>
+      <controlURL>/rc/control</controlURL>
+    </service>
+    <service>
+      <serviceType>urn:schemas-upnp-org:service:ConnectionManager:1</serviceType>
+      <controlURL>/cm/control</controlURL>
+    </service>
+  </serviceList>
+</device></root>`))
+	}))
+	defer srv.Close()
+
+	devices, err := fetchDevice(srv.URL)
+	if err != nil || len(devices) != 1 {
+		t.Fatalf("fetchDevice = %v, %v", devices, err)
+	}
+	d := devices[0]
+	if len(d.Services) != 3 {
+		t.Errorf("Expected 3 services, got %v", d.Services)
+	}
+	avt, ok := d.Service(serviceAVTransport)
+	if !ok || avt.ControlURL != srv.URL+"/avt/control" || avt.EventSubURL != srv.URL+"/avt/event" {
+		t.Errorf("Unexpected AVTransport %+v", avt)
+	}
+	if got := d.RenderingControlURL(); got != srv.URL+"/rc/control" {
+		t.Errorf("Expected RenderingControl:2 by name, got %q", got)
+	}
+	if got := d.ConnectionManagerURL(); got != srv.URL+"/cm/control" {
+		t.Errorf("Unexpected ConnectionManager URL %q", got)
+	}
+	if _, ok := d.Service("ContentDirectory"); ok || d.ContentDirectoryURL() != "" {
+		t.Error("Expected no ContentDirectory on a renderer")
+	}
+
+	// Snapshots of older versions only have the control URLs
+	var old Device
+	if err := json.Unmarshal([]byte(`{"usn": "uuid:tv", "control_url": "http://tv/avt", "rendering_control_url": "http://tv/rc"}`), &old); err != nil {
+		t.Fatal(err)
+	}
+	if old.USN != "uuid:tv" || old.AVTransportURL() != "http://tv/avt" || old.RenderingControlURL() != "http://tv/rc" {
+		t.Errorf("Unexpected legacy device %+v", old)
+	}
+
+	// and clients of the v1 API the control URL
+	var v1 map[string]any
+	b, _ := json.Marshal(d)
+	json.Unmarshal(b, &v1)
+	if v1["control_url"] != srv.URL+"/avt/control" || v1["rendering_control_url"] != srv.URL+"/rc/control" || v1["services"] == nil {
+		t.Errorf("Expected the control URLs next to the services, got %s", b)
+	}
+	var back Device
+	if err := json.Unmarshal(b, &back); err != nil || !reflect.DeepEqual(back.Services, d.Services) {
+		t.Errorf("Expected the services back, got %+v, %v", back.Services, err)
+	}
+}
+
+func TestResolveURL(t *testing.T) {
+	cases := []struct {
+		base, ref, want string
+	}{
+		{"http://10.0.0.5:49152/desc/device.xml", "/upnp/avt", "http://10.0.0.5:49152/upnp/avt"},
+		{"http://10.0.0.5:49152/desc/device.xml", "avt/control", "http://10.0.0.5:49152/desc/avt/control"},
+		{"http://10.0.0.5:49152/desc.xml?token=1", "ctl", "http://10.0.0.5:49152/ctl"},
+		{"http://10.0.0.5:8080/", "AVTransport/ctrl", "http://10.0.0.5:8080/AVTransport/ctrl"},
+		{"http://10.0.0.5/desc.xml", "http://10.0.0.6:1400/ctl", "http://10.0.0.6:1400/ctl"},
+		{"http://[fe80::1%25eth0]:1400/xml/desc.xml", "/MediaRenderer/AVTransport/Control", "http://[fe80::1%25eth0]:1400/MediaRenderer/AVTransport/Control"},
+	}
+	for _, c := range cases {
+		base, err := url.Parse(c.base)
+		if err != nil {
+			t.Fatalf("Invalid base %s: %v", c.base, err)
+		}
+		if got := resolveURL(base, c.ref); got != c.want {
+			t.Errorf("resolveURL(%s, %s) = %s, want %s", c.base, c.ref, got, c.want)
+		}
+	}
+}
+
+func TestSupportedActionsFromSCPD(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<root><device><UDN>uuid:1</UDN><serviceList><service>
+  <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+  <controlURL>/avt</controlURL>
+  <SCPDURL>/avt.xml</SCPDURL>
+</service></serviceList></device></root>`))
+	})
+	mux.HandleFunc("/avt.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<scpd><actionList>
+  <action><name>SetAVTransportURI</name></action>
+  <action><name>Play</name></action>
+  <action><name>Stop</name></action>
+</actionList></scpd>`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	devices, err := fetchDevice(srv.URL + "/desc.xml")
+	if err != nil {
+		t.Fatalf("fetchDevice failed: %v", err)
+	}
+	d := devices[0]
+	if !d.Supports("Play") || !d.Supports("Stop") {
+		t.Errorf("Expected Play and Stop to be supported, got %v", d.SupportedActions)
+	}
+	if d.Supports("Seek") {
+		t.Errorf("Expected Seek to be unsupported")
+	}
+}
+
+func TestWithZone(t *testing.T) {
+	tests := []struct{ in, zone, want string }{
+		{"http://[fe80::1]:49152/desc.xml", "eth0", "http://[fe80::1%25eth0]:49152/desc.xml"},
+		{"http://[fe80::1%25eth1]:49152/desc.xml", "eth0", "http://[fe80::1%25eth1]:49152/desc.xml"},
+		{"http://[2001:db8::1]:49152/desc.xml", "eth0", "http://[2001:db8::1]:49152/desc.xml"},
+		{"http://192.168.1.2:49152/desc.xml", "eth0", "http://192.168.1.2:49152/desc.xml"},
+		{"http://[fe80::1]:49152/desc.xml", "", "http://[fe80::1]:49152/desc.xml"},
+	}
+	for _, tt := range tests {
+		if got := withZone(tt.in, tt.zone); got != tt.want {
+			t.Errorf("withZone(%q, %q) = %q, want %q", tt.in, tt.zone, got, tt.want)
+		}
+	}
+
+	base, _ := url.Parse("http://[fe80::1%25eth0]:49152/desc.xml")
+	u, _ := url.Parse("http://[fe80::1]:49153/")
+	inheritZone(u, base)
+	if u.Host != "[fe80::1%eth0]:49153" {
+		t.Errorf("Expected zone inherited by URLBase, got %s", u.Host)
+	}
+}
+
+func TestMulticastGroups(t *testing.T) {
+	network, groups := multicastGroups(net.ParseIP("fe80::1"))
+	if network != "udp6" || len(groups) != 2 || groups[1] != ssdpMulticastAddrV6Site {
+		t.Errorf("Expected both IPv6 groups, got %s %v", network, groups)
+	}
+	network, groups = multicastGroups(net.ParseIP("192.168.1.2"))
+	if network != "udp4" || len(groups) != 1 {
+		t.Errorf("Expected the IPv4 group only, got %s %v", network, groups)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	if err := setMulticastHops(conn, 4); err != nil {
+		t.Errorf("setMulticastHops: %v", err)
+	}
+}
+
+func TestDeviceFilter(t *testing.T) {
+	f := DeviceFilter{Allow: []string{"living room"}, Block: []string{"uuid:bad"}}
+	if !f.allows("uuid:1", "Living Room TV") {
+		t.Errorf("Expected allowlisted name to pass")
+	}
+	if f.allows("uuid:2", "Kitchen") {
+		t.Errorf("Expected name outside the allowlist to be dropped")
+	}
+	if f.allows("uuid:bad", "Living Room TV") || !f.blocksUSN("uuid:bad::upnp:rootdevice") {
+		t.Errorf("Expected blocked USN to be dropped")
+	}
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer srv.Close()
+
+	s := NewDiscoveryService("", time.Second)
+	s.SetDeviceFilter(f)
+	header := http.Header{}
+	header.Set("USN", "uuid:bad::upnp:rootdevice")
+	header.Set("Location", srv.URL)
+	s.handleHeaders(header)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("Expected no description fetch for a blocked USN, got %d", n)
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"  Te\u0301le\u0301   Salon ", "Télé Salon"},
+		{"Phòng khách Vie\u0323\u0302t", "Phòng khách Việt"},
+		{"\u1100\u1161\u11a8 TV", "각 TV"},   // Hangul jamo
+		{"\u30c6\u30ec\u30d2\u3099", "テレビ"}, // Kana with a separate voicing mark
+		{"Bad\xff name", "Bad\ufffd name"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeName(tt.in); got != tt.want {
+			t.Errorf("NormalizeName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	for _, pair := range [][2]string{
+		{"Télé Salon", "TELE salon"},
+		{"ＢＲＡＶＩＡ ４Ｋ", "bravia 4k"},
+		{"テレビ", "てれび"},
+		{"Straße", "strasse"},
+		{"Te\u0301le\u0301", "télé"},
+	} {
+		if !NameEqual(pair[0], pair[1]) {
+			t.Errorf("Expected %q and %q to match (%q, %q)", pair[0], pair[1], FoldName(pair[0]), FoldName(pair[1]))
+		}
+	}
+	if NameEqual("テレビ", "テレヒ") {
+		t.Error("Expected voiced kana to stay distinct")
+	}
+	if !NameContains("Salle à manger", "A MANGER") {
+		t.Error("Expected an accent-insensitive substring match")
+	}
+	if f := (DeviceFilter{Block: []string{"cuisine"}}); f.allows("uuid:1", "Cuísine") {
+		t.Error("Expected the filter to ignore accents")
+	}
+}
+
+func TestDescriptionCharset(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><root><device><UDN>uuid:tv</UDN><friendlyName>T\xe9l\xe9</friendlyName>" +
+			"<serviceList><service><serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType><controlURL>/avt</controlURL></service></serviceList></device></root>"))
+	}))
+	defer srv.Close()
+	devices, err := fetchDevice(srv.URL)
+	if err != nil || len(devices) != 1 || devices[0].FriendlyName != "Télé" {
+		t.Fatalf("fetchDevice = %v, %v", devices, err)
+	}
+}
+
+func TestLookupQuirks(t *testing.T) {
+	qs := LookupQuirks("Sony Corporation", "KD-55XH9505 BRAVIA")
+	if !qs.Has(QuirkDLNAFlags) || !qs.Has(QuirkStopBeforeSet) {
+		t.Errorf("Expected Sony BRAVIA quirks, got %s", qs)
+	}
+	if qs := LookupQuirks("Sony Corporation", "SRS-X88"); len(qs) != 0 {
+		t.Errorf("Expected no quirks for other Sony models, got %s", qs)
+	}
+
+	qs = LookupQuirks("Samsung Electronics", "UE40").With(Quirks{QuirkDLNAFlags: false, QuirkNoMetadata: true})
+	if qs.Has(QuirkDLNAFlags) || !qs.Has(QuirkNoMetadata) {
+		t.Errorf("Expected overrides to apply, got %s", qs)
+	}
+	if err := ValidateQuirks(Quirks{"bogus": true}); err == nil {
+		t.Errorf("Expected unknown quirk to be rejected")
+	}
+}
+
+func TestUnicastSearch(t *testing.T) {
+	desc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<root><device>
+  <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+  <UDN>uuid:bridged</UDN>
+  <friendlyName>Bridged TV</friendlyName>
+  <serviceList><service>
+    <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+    <controlURL>/avt</controlURL>
+  </service></serviceList>
+</device></root>`))
+	}))
+	defer desc.Close()
+
+	// Fake renderer answering M-SEARCH by unicast
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		_, src, err := responder.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		responder.WriteToUDP([]byte("HTTP/1.1 200 OK\r\n"+
+			"CACHE-CONTROL: max-age=1800\r\n"+
+			"LOCATION: "+desc.URL+"/description.xml\r\n"+
+			"ST: urn:schemas-upnp-org:device:MediaRenderer:1\r\n"+
+			"USN: uuid:bridged::urn:schemas-upnp-org:device:MediaRenderer:1\r\n\r\n"), src)
+	}()
+
+	targets, err := ParseSearchTargets([]string{responder.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewDiscoveryService("", time.Second)
+	s.tuning.SearchMX = 0
+	s.SetSearchTargets(targets)
+	s.sendUnicastSearch()
+
+	if d := s.GetDevice("uuid:bridged"); d == nil || d.FriendlyName != "Bridged TV" {
+		t.Errorf("Expected device found by unicast search, got %+v", d)
+	}
+
+	if _, err := ParseSearchTargets([]string{"192.168.1.255", "[fd00::1]:1901"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := ParseSearchTargets([]string{"not an address"}); err == nil {
+		t.Error("Expected an error for an invalid target")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	nets, err := ParseSweepNetworks([]string{"10.0.3.7/30", "192.168.1.5/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts := sweepHosts(nets[0]); len(hosts) != 2 || hosts[0].String() != "10.0.3.5" || hosts[1].String() != "10.0.3.6" {
+		t.Errorf("Unexpected /30 hosts %v", hosts)
+	}
+	if hosts := sweepHosts(nets[1]); len(hosts) != 1 || hosts[0].String() != "192.168.1.5" {
+		t.Errorf("Unexpected /32 hosts %v", hosts)
+	}
+	if _, err := ParseSweepNetworks([]string{"10.0.0.0/8"}); err == nil {
+		t.Error("Expected a /8 to be rejected")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dmr.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`<root><device>
+  <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+  <UDN>uuid:swept</UDN>
+  <friendlyName>Quiet TV</friendlyName>
+  <serviceList><service>
+    <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+    <controlURL>/avt</controlURL>
+  </service></serviceList>
+</device></root>`))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	s := NewDiscoveryService("", time.Second)
+	s.probeHosts([]netip.Addr{netip.MustParseAddr("127.0.0.1")}, []int{port}, []string{"/description.xml", "/dmr.xml"})
+	if d := s.GetDevice("uuid:swept"); d == nil || d.Manual {
+		t.Errorf("Expected a discovered device from the probe, got %+v", d)
+	}
+}
+
+func TestCaptureReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<root><device>
+  <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+  <UDN>uuid:captured</UDN>
+  <friendlyName>Captured TV</friendlyName>
+  <serviceList><service>
+    <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+    <controlURL>/avt</controlURL>
+  </service></serviceList>
+</device></root>`))
+	}))
+	defer srv.Close()
+
+	var capture bytes.Buffer
+	s := NewDiscoveryService("", time.Second)
+	s.SetCapture(&capture)
+	s.processPacket([]byte("NOTIFY * HTTP/1.1\r\n"+
+		"HOST: 239.255.255.250:1900\r\n"+
+		"CACHE-CONTROL: max-age=1800\r\n"+
+		"LOCATION: "+srv.URL+"/description.xml\r\n"+
+		"NT: urn:schemas-upnp-org:device:MediaRenderer:1\r\n"+
+		"NTS: ssdp:alive\r\n"+
+		"USN: uuid:captured::urn:schemas-upnp-org:device:MediaRenderer:1\r\n\r\n"),
+		&net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 1900})
+	s.SetCapture(nil)
+
+	replayed := NewDiscoveryService("", time.Second)
+	n, err := replayed.Replay(bytes.NewReader(capture.Bytes()), false)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 replayed packet, got %d, %v", n, err)
+	}
+	if d := replayed.GetDevice("uuid:captured"); d == nil || d.FriendlyName != "Captured TV" {
+		t.Errorf("Expected the replayed device, got %+v", d)
+	}
+}
+
+func TestMagicPacket(t *testing.T) {
+	packet, err := magicPacket("00:11:22:aa:bb:cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := []byte{0x00, 0x11, 0x22, 0xaa, 0xbb, 0xcc}
+	want := bytes.Repeat([]byte{0xFF}, 6)
+	for i := 0; i < 16; i++ {
+		want = append(want, mac...)
+	}
+	if len(packet) != 102 || !bytes.Equal(packet, want) {
+		t.Errorf("Unexpected magic packet % x", packet)
+	}
+	if _, err := magicPacket("not-a-mac"); err == nil {
+		t.Error("Expected an invalid MAC to fail")
+	}
+}
+
+func TestParseARP(t *testing.T) {
+	table := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.20     0x1         0x2         a4:5e:60:01:02:03     *        eth0
+192.168.1.21     0x1         0x0         00:00:00:00:00:00     *        eth0
+192.168.1.2      0x1         0x2         b8:27:eb:04:05:06     *        wlan0
+`
+	for ip, want := range map[string]string{
+		"192.168.1.20": "a4:5e:60:01:02:03",
+		"192.168.1.2":  "b8:27:eb:04:05:06", // Not a prefix match of .20 or .21
+		"192.168.1.21": "",                  // Incomplete
+		"192.168.1.99": "",
+	} {
+		if got := parseARP(strings.NewReader(table), ip); got != want {
+			t.Errorf("parseARP(%s) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestStaticDevicePlaceholder(t *testing.T) {
+	var up atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			// Asleep: the connection drops
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`<root><device>
+  <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+  <UDN>uuid:bedroom</UDN>
+  <friendlyName>[TV] Samsung</friendlyName>
+  <serviceList><service>
+    <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+    <controlURL>/avt</controlURL>
+  </service></serviceList>
+</device></root>`))
+	}))
+	defer srv.Close()
+	location := srv.URL + "/dmr.xml"
+
+	s := NewDiscoveryService("", time.Second)
+	s.SetMAC(location, "00:11:22:aa:bb:cc")
+	s.AddStaticDevice("Bedroom TV", location)
+	deadline := time.Now().Add(2 * time.Second)
+	for s.GetDevice(location) == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ph := s.GetDevice(location)
+	if ph == nil || ph.Online || ph.FriendlyName != "Bedroom TV" || ph.MAC != "00:11:22:aa:bb:cc" || ph.Location != location {
+		t.Fatalf("Expected an offline placeholder with the MAC, got %+v", ph)
+	}
+
+	// Health checks see it up before its description is fetched
+	up.Store(true)
+	s.checkHealth()
+	if ph.Online {
+		t.Error("Expected the placeholder to stay offline until fetched")
+	}
+
+	if _, err := s.refreshManual(location, "Bedroom TV"); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetDevice(location) != nil {
+		t.Error("Expected the placeholder to be replaced")
+	}
+	d := s.GetDevice("uuid:bedroom")
+	if d == nil || !d.Online || d.FriendlyName != "Bedroom TV" || d.MAC != "00:11:22:aa:bb:cc" {
+		t.Errorf("Expected the fetched device, got %+v", d)
+	}
+	if ph.USN != "uuid:bedroom" || len(ph.Services) == 0 {
+		t.Errorf("Expected holders of the placeholder to see the device, got %+v", ph)
+	}
+}
+
+func TestStaticDeviceName(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<root><device>
+  <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+  <UDN>uuid:bedroom</UDN>
+  <friendlyName>Samsung</friendlyName>
+  <serviceList><service>
+    <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+    <controlURL>/avt</controlURL>
+  </service></serviceList>
+</device></root>`))
+	}))
+	defer srv.Close()
+	location := srv.URL + "/dmr.xml"
+
+	// Found by SSDP before the config names it
+	s := NewDiscoveryService("", time.Second)
+	devices, err := fetchDevice(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addDevices(devices)
+	if d := s.GetDevice("uuid:bedroom"); d == nil || d.FriendlyName != "Samsung" {
+		t.Fatalf("Expected the description name, got %+v", d)
+	}
+
+	for _, name := range []string{"Bedroom TV", "Guest Room TV"} {
+		if _, err := s.refreshManual(location, name); err != nil {
+			t.Fatal(err)
+		}
+		if d := s.GetDevice("uuid:bedroom"); d.FriendlyName != name {
+			t.Errorf("Expected the known device to be renamed %q, got %q", name, d.FriendlyName)
+		}
+	}
+	if _, err := s.refreshManual(location, ""); err != nil {
+		t.Fatal(err)
+	}
+	if d := s.GetDevice("uuid:bedroom"); d.FriendlyName != "Guest Room TV" {
+		t.Errorf("Expected no name to keep the last one, got %q", d.FriendlyName)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	var up atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+
+	s := NewDiscoveryService("", time.Second)
+	s.SetTuning(Tuning{DeviceExpiry: time.Minute, OfflineRetention: time.Hour})
+	events := make(chan string, 10)
+	s.SetDeviceHook(func(ev DeviceEvent, d Device) { events <- string(ev) + " " + d.USN })
+	// expect checks the next events, in any order
+	expect := func(want ...string) {
+		t.Helper()
+		var got []string
+		for range want {
+			select {
+			case ev := <-events:
+				got = append(got, ev)
+			case <-time.After(time.Second):
+				t.Fatalf("Expected events %q, got %q", want, got)
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("Expected events %q, got %q", want, got)
+		}
+	}
+	long := time.Now().Add(-2 * time.Hour)
+	s.mu.Lock()
+	s.devices["uuid:tv"] = &Device{USN: "uuid:tv", FriendlyName: "TV", Location: srv.URL, LastSeen: long, ExpiresAt: long}
+	s.devices["uuid:static"] = &Device{USN: "uuid:static", FriendlyName: "Static", Location: srv.URL, LastSeen: long, ExpiresAt: long, Manual: true}
+	s.mu.Unlock()
+
+	up.Store(true)
+	s.checkHealth()
+	expect("device-online uuid:static", "device-online uuid:tv")
+	if d := s.GetDevice("uuid:tv"); !d.Online || time.Since(d.LastSeen) > time.Second || time.Until(d.ExpiresAt) < 59*time.Second {
+		t.Errorf("Expected the answering device online for device_expiry, got %+v", d)
+	}
+
+	// Devices that stop answering go offline once they expire
+	up.Store(false)
+	s.checkHealth()
+	if d := s.GetDevice("uuid:tv"); !d.Online {
+		t.Error("Expected the device to stay online until it expires")
+	}
+	s.mu.Lock()
+	for _, d := range s.devices {
+		d.ExpiresAt = time.Now()
+	}
+	s.mu.Unlock()
+	s.checkHealth()
+	expect("device-offline uuid:static", "device-offline uuid:tv")
+	if d := s.GetDevice("uuid:tv"); d == nil || d.Online {
+		t.Errorf("Expected the device to be kept offline, got %+v", d)
+	}
+
+	// and are forgotten after offline_retention, unless static
+	s.mu.Lock()
+	for _, d := range s.devices {
+		d.LastSeen = long
+	}
+	s.mu.Unlock()
+	s.checkHealth()
+	expect("device-removed uuid:tv")
+	if s.GetDevice("uuid:tv") != nil {
+		t.Error("Expected the device to be removed")
+	}
+	if s.GetDevice("uuid:static") == nil {
+		t.Error("Expected the static device to be kept")
+	}
+}
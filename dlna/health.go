@@ -0,0 +1,84 @@
+package dlna
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var probeClient = &http.Client{Timeout: 3 * time.Second}
+
+// healthLoop probes every known device with a HEAD request on its Location.
+// Devices that neither answer the probe nor re-announce before ExpiresAt are
+// marked offline but kept, so clients can still show them with last_seen,
+// until Tuning.OfflineRetention has passed. Manual and static devices are
+// never forgotten. The interval is Tuning.CleanupInterval, re-read after
+// every round.
+func (s *DiscoveryService) healthLoop() {
+	for {
+		time.Sleep(s.Tuning().CleanupInterval)
+		s.checkHealth()
+	}
+}
+
+func (s *DiscoveryService) checkHealth() {
+	s.mu.RLock()
+	locations := make(map[string]string, len(s.devices))
+	for usn, dev := range s.devices {
+		locations[usn] = dev.Location
+	}
+	s.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	alive := make(map[string]bool, len(locations))
+	for usn, location := range locations {
+		wg.Add(1)
+		go func(usn, location string) {
+			defer wg.Done()
+			ok := probe(location)
+			mu.Lock()
+			alive[usn] = ok
+			mu.Unlock()
+		}(usn, location)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for usn, ok := range alive {
+		dev, exists := s.devices[usn]
+		if !exists {
+			continue
+		}
+		if ok && isPlaceholder(dev) {
+			continue // Up, but replaced only when manualLoop fetches it
+		} else if ok {
+			s.markOnline(dev, s.tuning.DeviceExpiry)
+		} else if dev.Online && now.After(dev.ExpiresAt) {
+			dev.Online = false
+			log.Printf("Device offline (timeout): %s", dev.FriendlyName)
+			s.emitLocked(DeviceOffline, dev)
+		}
+	}
+	for usn, dev := range s.devices {
+		if !dev.Online && !dev.Manual && now.Sub(dev.LastSeen) > s.tuning.OfflineRetention {
+			delete(s.devices, usn)
+			log.Printf("Device removed (offline since %s): %s", dev.LastSeen.Format(time.DateTime), dev.FriendlyName)
+			s.emitLocked(DeviceRemoved, dev)
+		}
+	}
+}
+
+// probe reports whether the device answers HTTP at all. Some renderers
+// reject HEAD with 405, which still proves they are up.
+func probe(location string) bool {
+	resp, err := probeClient.Head(location)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
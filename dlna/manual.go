@@ -0,0 +1,199 @@
+package dlna
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AddManualDevice registers a renderer that cannot be reached by multicast
+// (e.g. on another subnet). target is either a description URL or a bare
+// IP/host, in which case the description location is resolved with a
+// unicast M-SEARCH. The device is kept alive by periodic HTTP checks.
+func (s *DiscoveryService) AddManualDevice(target string) (*Device, error) {
+	location := target
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		loc, err := s.resolveLocation(target)
+		if err != nil {
+			return nil, err
+		}
+		location = loc
+	}
+
+	dev, err := s.refreshManual(location, "")
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.manual[location] = ""
+	s.mu.Unlock()
+
+	return dev, nil
+}
+
+// AddStaticDevice registers a renderer from the config file. Unlike
+// AddManualDevice it does not require the device to be reachable yet; it
+// is fetched in the background and re-checked periodically.
+func (s *DiscoveryService) AddStaticDevice(name, location string) {
+	s.mu.Lock()
+	s.manual[location] = name
+	s.mu.Unlock()
+
+	go func() {
+		if _, err := s.refreshManual(location, name); err != nil {
+			log.Printf("Static device %s not reachable yet: %v", location, err)
+			s.addPlaceholder(location, name)
+		}
+	}()
+}
+
+// addPlaceholder registers a static device that could not be fetched, e.g.
+// a TV that is off, as an offline device keyed by its location, so that
+// casts to it find it and wake it. refreshManual replaces it with the
+// devices of the description once the device answers.
+func (s *DiscoveryService) addPlaceholder(location, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		if d.Location == location {
+			return
+		}
+	}
+	if name == "" {
+		name = hostOf(location)
+	}
+	d := &Device{
+		USN:          location,
+		DeviceType:   DeviceTypeMediaRenderer,
+		Location:     location,
+		FriendlyName: NormalizeName(name),
+		Manual:       true,
+	}
+	s.resolveMAC(d)
+	s.devices[d.USN] = d
+	log.Printf("Device added: %s (%s), offline until it answers", d.FriendlyName, location)
+	s.emitLocked(DeviceAdded, d)
+}
+
+// isPlaceholder reports whether d stands in for a static device that was
+// not fetched yet; see addPlaceholder.
+func isPlaceholder(d *Device) bool {
+	return d.Manual && d.USN == d.Location
+}
+
+func (s *DiscoveryService) manualLoop() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.RLock()
+		manual := make(map[string]string, len(s.manual))
+		for loc, name := range s.manual {
+			manual[loc] = name
+		}
+		s.mu.RUnlock()
+
+		for loc, name := range manual {
+			if _, err := s.refreshManual(loc, name); err != nil {
+				log.Printf("Manual device check failed for %s: %v", loc, err)
+			}
+		}
+	}
+}
+
+// refreshManual fetches the description at location and adds its devices,
+// or extends the expiry of already known ones. A non-empty name overrides
+// the friendlyName from the description, of known devices too. The first renderer (or server, if
+// there is none) is returned.
+func (s *DiscoveryService) refreshManual(location, name string) (*Device, error) {
+	devices, err := fetchDevice(location)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := s.Tuning().DeviceExpiry
+	for i, dev := range devices {
+		if dev.USN == "" {
+			dev.USN = fmt.Sprintf("%s#%d", location, i)
+		}
+		if name != "" {
+			dev.FriendlyName = NormalizeName(name)
+		}
+		dev.Manual = true
+		dev.LastSeen = now
+		dev.ExpiresAt = now.Add(expiry)
+		dev.Online = true
+	}
+
+	s.addDevices(devices)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var primary *Device
+	for _, dev := range devices {
+		d := s.devices[dev.USN]
+		if name != "" {
+			// Also for devices found by SSDP first or named before a reload
+			d.FriendlyName = dev.FriendlyName
+		}
+		s.markOnline(d, s.tuning.DeviceExpiry)
+		if primary == nil || (primary.IsServer() && !d.IsServer()) {
+			primary = d
+		}
+	}
+	if ph, ok := s.devices[location]; ok && isPlaceholder(ph) && primary != nil {
+		// Casts holding the placeholder go on with the real device
+		delete(s.devices, location)
+		*ph = *primary
+		log.Printf("Static device %s is %s", location, primary.USN)
+	}
+	return primary, nil
+}
+
+// resolveLocation sends a unicast M-SEARCH to host and returns the
+// Location header of the first response.
+func (s *DiscoveryService) resolveLocation(host string) (string, error) {
+	hostPort := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		hostPort = net.JoinHostPort(strings.Trim(host, "[]"), "1900")
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", hostPort)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	msg := fmt.Sprintf(ssdpSearchMsg, hostPort, s.Tuning().SearchMX)
+	if _, err := conn.WriteTo([]byte(msg), addr); err != nil {
+		return "", err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, s.Tuning().ReadBuffer)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return "", fmt.Errorf("no SSDP response from %s: %w", host, err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		if loc := resp.Header.Get("Location"); loc != "" {
+			return loc, nil
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package dlna
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	composed   map[[2]rune]rune // base, mark -> precomposed
+	decomposed map[rune][2]rune // precomposed -> base, mark
+)
+
+func init() {
+	composed = make(map[[2]rune]rune)
+	decomposed = make(map[rune][2]rune)
+	r := []rune(compositions)
+	for i := 0; i+2 < len(r); i += 3 {
+		composed[[2]rune{r[i], r[i+1]}] = r[i+2]
+		decomposed[r[i+2]] = [2]rune{r[i], r[i+1]}
+	}
+}
+
+// Hangul syllables are composed algorithmically from leading consonant,
+// vowel and optional trailing consonant jamo.
+const (
+	hangulBase  = 0xac00
+	jamoLBase   = 0x1100
+	jamoVBase   = 0x1161
+	jamoTBase   = 0x11a7
+	jamoLCount  = 19
+	jamoVCount  = 21
+	jamoTCount  = 28
+	hangulCount = jamoLCount * jamoVCount * jamoTCount
+)
+
+// compose joins two runes into one precomposed rune, if they make one.
+func compose(a, b rune) (rune, bool) {
+	if l, v := a-jamoLBase, b-jamoVBase; l >= 0 && l < jamoLCount && v >= 0 && v < jamoVCount {
+		return hangulBase + (l*jamoVCount+v)*jamoTCount, true
+	}
+	if s, t := a-hangulBase, b-jamoTBase; s >= 0 && s < hangulCount && s%jamoTCount == 0 && t > 0 && t < jamoTCount {
+		return a + t, true
+	}
+	c, ok := composed[[2]rune{a, b}]
+	return c, ok
+}
+
+// NormalizeName cleans up a friendly name for display and matching:
+// invalid UTF-8 is replaced, letters sent decomposed (a base letter and
+// combining marks, as from macOS or some Korean and Japanese TVs) are
+// composed as in Unicode NFC, and whitespace is trimmed and collapsed.
+func NormalizeName(s string) string {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "�")
+	}
+	out := make([]rune, 0, len(s))
+	starter := -1 // Index in out of the rune marks may compose with
+	space := false
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			space = len(out) > 0
+			starter = -1
+			continue
+		}
+		if space {
+			out = append(out, ' ')
+			space = false
+		}
+		if starter >= 0 && starter == len(out)-1 {
+			if c, ok := compose(out[starter], r); ok {
+				out[starter] = c
+				continue
+			}
+		}
+		if !unicode.Is(unicode.Mn, r) {
+			starter = len(out)
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// foldSpecial transliterates letters without a decomposition.
+var foldSpecial = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'ł': "l", 'đ': "d", 'ð': "d", 'þ': "th", 'ı': "i", 'ħ': "h",
+}
+
+// FoldName reduces a friendly name to a key for matching: normalized,
+// lowercase, without diacritics, full-width Latin letters and digits as
+// ASCII, and katakana as hiragana. "Télé Salon", "TELE salon" and
+// "ＴＥＬＥ Salon" fold alike, as do "テレビ" and "てれび".
+func FoldName(s string) string {
+	var b strings.Builder
+	for _, r := range NormalizeName(s) {
+		switch {
+		case r >= 0xff01 && r <= 0xff5e: // Full-width ASCII
+			r -= 0xfee0
+		case r >= 0x30a1 && r <= 0x30f6: // Katakana
+			r -= 0x60
+		}
+		// Voiced kana are other syllables, not accented ones
+		for r < 0x3040 || r > 0x30ff {
+			d, ok := decomposed[r]
+			if !ok {
+				break
+			}
+			r = d[0]
+		}
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if t, ok := foldSpecial[r]; ok {
+			b.WriteString(t)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// NameContains reports whether the friendly name contains query, ignoring
+// case, diacritics and width; see FoldName.
+func NameContains(name, query string) bool {
+	return strings.Contains(FoldName(name), FoldName(query))
+}
+
+// NameEqual reports whether two friendly names are the same, ignoring
+// case, diacritics and width; see FoldName.
+func NameEqual(a, b string) bool {
+	return FoldName(a) == FoldName(b)
+}
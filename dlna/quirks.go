@@ -0,0 +1,104 @@
+package dlna
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Quirk names a renderer workaround.
+type Quirk string
+
+const (
+	// QuirkDLNAFlags adds DLNA.ORG_OP/FLAGS to the protocolInfo of casts;
+	// some renderers refuse media or seeking without them.
+	QuirkDLNAFlags Quirk = "dlna_flags"
+	// QuirkNoMetadata sends an empty CurrentURIMetaData, for renderers that
+	// fail on the escaped DIDL-Lite document.
+	QuirkNoMetadata Quirk = "no_metadata"
+	// QuirkStopBeforeSet sends Stop before SetAVTransportURI, for renderers
+	// that stay stuck on the old item otherwise.
+	QuirkStopBeforeSet Quirk = "stop_before_set"
+)
+
+var allQuirks = []Quirk{QuirkDLNAFlags, QuirkNoMetadata, QuirkStopBeforeSet}
+
+// Quirks is a set of enabled workarounds.
+type Quirks map[Quirk]bool
+
+// Has reports whether q is enabled.
+func (qs Quirks) Has(q Quirk) bool {
+	return qs[q]
+}
+
+// With returns qs with overrides applied on top; a false override turns a
+// built-in quirk off.
+func (qs Quirks) With(overrides Quirks) Quirks {
+	out := make(Quirks, len(qs)+len(overrides))
+	for q, on := range qs {
+		if on {
+			out[q] = true
+		}
+	}
+	for q, on := range overrides {
+		if on {
+			out[q] = true
+		} else {
+			delete(out, q)
+		}
+	}
+	return out
+}
+
+// ValidateQuirks rejects unknown quirk names.
+func ValidateQuirks(qs Quirks) error {
+	for q := range qs {
+		known := false
+		for _, k := range allQuirks {
+			known = known || q == k
+		}
+		if !known {
+			return fmt.Errorf("unknown quirk %q", q)
+		}
+	}
+	return nil
+}
+
+// String lists the enabled quirks, for logging.
+func (qs Quirks) String() string {
+	var names []string
+	for q, on := range qs {
+		if on {
+			names = append(names, string(q))
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// knownQuirks maps renderer models to workarounds. Manufacturer and model
+// are case-insensitive substrings of the description's manufacturer and
+// modelName; an empty model matches every model of the manufacturer.
+var knownQuirks = []struct {
+	manufacturer string
+	model        string
+	quirks       []Quirk
+}{
+	{"samsung", "", []Quirk{QuirkDLNAFlags}},
+	{"lg electronics", "", []Quirk{QuirkStopBeforeSet}},
+	{"sony", "bravia", []Quirk{QuirkDLNAFlags, QuirkStopBeforeSet}},
+}
+
+// LookupQuirks returns the built-in workarounds for a renderer model.
+func LookupQuirks(manufacturer, model string) Quirks {
+	manufacturer, model = strings.ToLower(manufacturer), strings.ToLower(model)
+	qs := Quirks{}
+	for _, k := range knownQuirks {
+		if strings.Contains(manufacturer, k.manufacturer) && strings.Contains(model, k.model) {
+			for _, q := range k.quirks {
+				qs[q] = true
+			}
+		}
+	}
+	return qs
+}
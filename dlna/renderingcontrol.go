@@ -0,0 +1,69 @@
+package dlna
+
+const serviceRenderingControl = "urn:schemas-upnp-org:service:RenderingControl:1"
+
+// RenderingControl is a client for a renderer's RenderingControl:1 service.
+// Only the Master channel is used.
+type RenderingControl struct {
+	ControlURL string
+	InstanceID uint32
+	Client     SOAPClient // nil is HTTPSOAPClient
+}
+
+func NewRenderingControl(controlURL string) *RenderingControl {
+	return &RenderingControl{ControlURL: controlURL}
+}
+
+type channelArgs struct {
+	InstanceID uint32
+	Channel    string
+}
+
+type setVolumeArgs struct {
+	InstanceID    uint32
+	Channel       string
+	DesiredVolume uint16
+}
+
+type setMuteArgs struct {
+	InstanceID  uint32
+	Channel     string
+	DesiredMute string // "0" or "1"; some renderers reject "true"
+}
+
+func (c *RenderingControl) call(action string, args, out interface{}) error {
+	return callAction(c.Client, c.ControlURL, serviceRenderingControl, action, args, out)
+}
+
+// GetVolume returns the Master volume, usually 0-100.
+func (c *RenderingControl) GetVolume() (int, error) {
+	var out struct {
+		CurrentVolume int `xml:"CurrentVolume"`
+	}
+	if err := c.call("GetVolume", channelArgs{c.InstanceID, "Master"}, &out); err != nil {
+		return 0, err
+	}
+	return out.CurrentVolume, nil
+}
+
+func (c *RenderingControl) SetVolume(volume int) error {
+	return c.call("SetVolume", setVolumeArgs{c.InstanceID, "Master", uint16(volume)}, nil)
+}
+
+func (c *RenderingControl) GetMute() (bool, error) {
+	var out struct {
+		CurrentMute string `xml:"CurrentMute"`
+	}
+	if err := c.call("GetMute", channelArgs{c.InstanceID, "Master"}, &out); err != nil {
+		return false, err
+	}
+	return out.CurrentMute == "1" || out.CurrentMute == "true", nil
+}
+
+func (c *RenderingControl) SetMute(mute bool) error {
+	desired := "0"
+	if mute {
+		desired = "1"
+	}
+	return c.call("SetMute", setMuteArgs{c.InstanceID, "Master", desired}, nil)
+}
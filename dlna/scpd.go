@@ -0,0 +1,53 @@
+package dlna
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// fetchActions downloads a service's SCPD and returns the names of the
+// actions it declares.
+func fetchActions(scpdURL string) ([]string, error) {
+	resp, err := http.Get(scpdURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("SCPD request failed with status %d", resp.StatusCode)
+	}
+
+	var scpd struct {
+		Actions []struct {
+			Name string `xml:"name"`
+		} `xml:"actionList>action"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&scpd); err != nil {
+		return nil, err
+	}
+
+	actions := make([]string, 0, len(scpd.Actions))
+	for _, a := range scpd.Actions {
+		if name := strings.TrimSpace(a.Name); name != "" {
+			actions = append(actions, name)
+		}
+	}
+	return actions, nil
+}
+
+// Supports reports whether the renderer's AVTransport implements action.
+// If the SCPD could not be fetched, every action is assumed supported.
+func (d *Device) Supports(action string) bool {
+	if len(d.SupportedActions) == 0 {
+		return true
+	}
+	for _, a := range d.SupportedActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package dlna
+
+import (
+	"log"
+	"time"
+)
+
+// Snapshot is the device table with everything learnt from the
+// descriptions, so it can be restored after a restart instead of waiting
+// for sleeping renderers to announce themselves again.
+type Snapshot struct {
+	TakenAt time.Time `json:"taken_at"`
+	Devices []Device  `json:"devices"`
+}
+
+// Snapshot returns a copy of the device table, renderers and servers.
+func (s *DiscoveryService) Snapshot() Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snap := Snapshot{TakenAt: time.Now(), Devices: make([]Device, 0, len(s.devices))}
+	for _, d := range s.devices {
+		snap.Devices = append(snap.Devices, *d)
+	}
+	return snap
+}
+
+// Restore adds the devices of snap that are not known yet and pass the
+// device types and filter, and returns how many it added. They start
+// offline until they answer a health probe or announce themselves; casts
+// can reach them (and wake them) meanwhile.
+func (s *DiscoveryService) Restore(snap Snapshot) int {
+	var added []*Device
+	s.mu.Lock()
+	for i := range snap.Devices {
+		dev := snap.Devices[i]
+		if dev.USN == "" || s.devices[dev.USN] != nil || !s.deviceFilter.allows(dev.USN, dev.FriendlyName) {
+			continue
+		}
+		if !(dev.IsServer() && dev.ContentDirectoryURL() != "") && !(dev.AVTransportURL() != "" && matchesDeviceType(s.types, dev.DeviceType)) {
+			continue
+		}
+		dev.Online = false
+		dev.ExpiresAt = time.Now()
+		// From this version's table, which may have changed since
+		dev.Quirks = LookupQuirks(dev.Manufacturer, dev.ModelName)
+		s.devices[dev.USN] = &dev
+		s.emitLocked(DeviceAdded, &dev)
+		added = append(added, &dev)
+	}
+	for _, dev := range added {
+		for _, uuid := range dev.UUIDs {
+			s.aliases[uuid] = append(s.aliases[uuid], dev.USN)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(added) > 0 {
+		log.Printf("Restored %d devices from a snapshot taken %s", len(added), snap.TakenAt.Format(time.RFC3339))
+		go s.checkHealth()
+	}
+	return len(added)
+}
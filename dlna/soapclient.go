@@ -0,0 +1,47 @@
+package dlna
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+)
+
+// SOAPClient sends a SOAP action to a control URL. body is the action
+// element (see marshalAction) and the result the raw response envelope; a
+// UPnP fault is returned as a *SOAPError. The service clients use
+// HTTPSOAPClient unless given another, such as a fake in tests.
+type SOAPClient interface {
+	Call(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error)
+}
+
+// HTTPSOAPClient posts actions over HTTP, one at a time per control URL,
+// and records them in the SOAP trace.
+type HTTPSOAPClient struct{}
+
+func (HTTPSOAPClient) Call(ctx context.Context, controlURL, serviceType, action string, body []byte) ([]byte, error) {
+	return soapInvokeContext(ctx, controlURL, serviceType, action, body)
+}
+
+// orDefault returns c, or HTTPSOAPClient if c is nil.
+func orDefault(c SOAPClient) SOAPClient {
+	if c == nil {
+		return HTTPSOAPClient{}
+	}
+	return c
+}
+
+// ResponseEnvelope builds the envelope a device answers action with, for
+// fake SOAPClients.
+func ResponseEnvelope(serviceType, action string, args []Arg) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(soapEnvelopeStart)
+	buf.WriteString(`<u:` + action + `Response xmlns:u="` + serviceType + `">`)
+	for _, a := range args {
+		buf.WriteString("<" + a.Name + ">")
+		xml.EscapeText(&buf, []byte(a.Value))
+		buf.WriteString("</" + a.Name + ">")
+	}
+	buf.WriteString(`</u:` + action + `Response>`)
+	buf.WriteString(soapEnvelopeEnd)
+	return buf.Bytes()
+}
@@ -0,0 +1,110 @@
+package dlna
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultSOAPTraceSize is how many exchanges the SOAP trace keeps.
+const DefaultSOAPTraceSize = 100
+
+// SOAPExchange is one traced SOAP request with the renderer's response.
+type SOAPExchange struct {
+	Time           time.Time   `json:"time"`
+	URL            string      `json:"url"`
+	Action         string      `json:"action"`
+	RequestHeader  http.Header `json:"request_header"`
+	Request        string      `json:"request"`
+	Status         int         `json:"status,omitempty"` // 0 if no response arrived
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	Response       string      `json:"response,omitempty"`
+	Error          string      `json:"error,omitempty"`
+	DurationMs     int64       `json:"duration_ms"`
+}
+
+// soapTrace keeps the last exchanges in a ring buffer, for every device
+// when all is set or else for the hosts traced one by one.
+var soapTrace = struct {
+	mu      sync.Mutex
+	all     bool
+	hosts   map[string]bool
+	ring    []SOAPExchange
+	next    int
+	wrapped bool
+}{hosts: make(map[string]bool), ring: make([]SOAPExchange, DefaultSOAPTraceSize)}
+
+// SetSOAPTrace turns tracing of every SOAP request on or off. Hosts traced
+// with TraceSOAPHost stay traced.
+func SetSOAPTrace(on bool) {
+	soapTrace.mu.Lock()
+	defer soapTrace.mu.Unlock()
+	soapTrace.all = on
+}
+
+// TraceSOAPHost turns tracing on or off for the SOAP requests to host
+// (host:port of the control URLs), such as one renderer's.
+func TraceSOAPHost(host string, on bool) {
+	soapTrace.mu.Lock()
+	defer soapTrace.mu.Unlock()
+	if on {
+		soapTrace.hosts[host] = true
+	} else {
+		delete(soapTrace.hosts, host)
+	}
+}
+
+// SOAPTraceState reports whether every request is traced, and which hosts
+// are traced on their own.
+func SOAPTraceState() (all bool, hosts []string) {
+	soapTrace.mu.Lock()
+	defer soapTrace.mu.Unlock()
+	for h := range soapTrace.hosts {
+		hosts = append(hosts, h)
+	}
+	return soapTrace.all, hosts
+}
+
+// SOAPTraces returns the traced exchanges, oldest first.
+func SOAPTraces() []SOAPExchange {
+	soapTrace.mu.Lock()
+	defer soapTrace.mu.Unlock()
+	var out []SOAPExchange
+	if soapTrace.wrapped {
+		out = append(out, soapTrace.ring[soapTrace.next:]...)
+	}
+	return append(out, soapTrace.ring[:soapTrace.next]...)
+}
+
+// ClearSOAPTraces drops the traced exchanges.
+func ClearSOAPTraces() {
+	soapTrace.mu.Lock()
+	defer soapTrace.mu.Unlock()
+	clear(soapTrace.ring)
+	soapTrace.next, soapTrace.wrapped = 0, false
+}
+
+// tracingSOAP reports whether requests to controlURL are traced.
+func tracingSOAP(controlURL string) bool {
+	soapTrace.mu.Lock()
+	defer soapTrace.mu.Unlock()
+	if soapTrace.all {
+		return true
+	}
+	if len(soapTrace.hosts) == 0 {
+		return false
+	}
+	u, err := url.Parse(controlURL)
+	return err == nil && soapTrace.hosts[u.Host]
+}
+
+func recordSOAP(x SOAPExchange) {
+	soapTrace.mu.Lock()
+	defer soapTrace.mu.Unlock()
+	soapTrace.ring[soapTrace.next] = x
+	soapTrace.next++
+	if soapTrace.next == len(soapTrace.ring) {
+		soapTrace.next, soapTrace.wrapped = 0, true
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package dlna
+
+import "net"
+
+// setMulticastHops is a no-op here; the OS default TTL/hop limit applies.
+func setMulticastHops(conn *net.UDPConn, hops int) error {
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package dlna
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastHops sets the TTL (IPv4) or hop limit (IPv6) of multicast
+// packets sent on conn.
+func setMulticastHops(conn *net.UDPConn, hops int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, hops)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
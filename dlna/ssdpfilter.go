@@ -0,0 +1,96 @@
+package dlna
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// dedupWindow drops identical announcements (same USN, BOOTID and NTS)
+	// repeated within this window; renderers typically send each NOTIFY 2-3 times.
+	dedupWindow = 3 * time.Second
+
+	// Per source IP: at most ipRateLimit packets per ipRateWindow.
+	ipRateLimit  = 50
+	ipRateWindow = time.Second
+
+	filterSweepInterval = time.Minute
+)
+
+// packetFilter deduplicates SSDP packets and rate limits chatty sources
+// before they reach the device table.
+type packetFilter struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time // dedup key -> last seen
+	rates     map[string]*ipRate   // source IP -> counter
+	lastSweep time.Time
+}
+
+type ipRate struct {
+	windowStart time.Time
+	count       int
+}
+
+func newPacketFilter() *packetFilter {
+	return &packetFilter{
+		seen:      make(map[string]time.Time),
+		rates:     make(map[string]*ipRate),
+		lastSweep: time.Now(),
+	}
+}
+
+// allowSource reports whether another packet from ip is within its rate limit.
+func (f *packetFilter) allowSource(ip string) bool {
+	if ip == "" {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.sweep(now)
+
+	r, ok := f.rates[ip]
+	if !ok || now.Sub(r.windowStart) >= ipRateWindow {
+		f.rates[ip] = &ipRate{windowStart: now, count: 1}
+		return true
+	}
+	r.count++
+	return r.count <= ipRateLimit
+}
+
+// isDuplicate reports whether an identical announcement was already handled
+// within dedupWindow.
+func (f *packetFilter) isDuplicate(header http.Header) bool {
+	key := header.Get("USN") + "|" + header.Get("BOOTID.UPNP.ORG") + "|" + header.Get("NTS")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := f.seen[key]; ok && now.Sub(last) < dedupWindow {
+		return true
+	}
+	f.seen[key] = now
+	return false
+}
+
+// sweep drops stale entries. Callers must hold f.mu.
+func (f *packetFilter) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) < filterSweepInterval {
+		return
+	}
+	f.lastSweep = now
+	for k, t := range f.seen {
+		if now.Sub(t) >= dedupWindow {
+			delete(f.seen, k)
+		}
+	}
+	for ip, r := range f.rates {
+		if now.Sub(r.windowStart) >= ipRateWindow {
+			delete(f.rates, ip)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package dlna
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSweepInterval is the Sweep.Interval used when it is zero.
+	defaultSweepInterval = 10 * time.Minute
+	// maxSweepHostBits bounds a sweep network to 4096 addresses.
+	maxSweepHostBits = 12
+	// sweepPacketInterval paces M-SEARCH packets so a sweep does not
+	// flood the network or overflow renderers' receive queues.
+	sweepPacketInterval = 2 * time.Millisecond
+	sweepProbeTimeout   = time.Second
+)
+
+// Sweep configures subnet sweep discovery, for networks that filter
+// multicast entirely: every address of Networks gets a unicast M-SEARCH,
+// and optionally a description request on each of ProbePorts and
+// ProbePaths, for renderers that do not answer unicast searches.
+type Sweep struct {
+	Networks   []netip.Prefix
+	Interval   time.Duration // Default 10m
+	ProbePorts []int         // e.g. 49152, 49153; none by default
+	ProbePaths []string      // Description paths tried on ProbePorts, default /description.xml
+}
+
+// ParseSweepNetworks parses CIDRs for Sweep.Networks. Networks larger than
+// 4096 addresses are rejected.
+func ParseSweepNetworks(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", c)
+		}
+		if p.Addr().BitLen()-p.Bits() > maxSweepHostBits {
+			return nil, fmt.Errorf("network %q is too large to sweep (at most /%d for IPv4)", c, 32-maxSweepHostBits)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// sweepHosts lists the addresses of p, without the network and broadcast
+// addresses of IPv4 networks larger than /31.
+func sweepHosts(p netip.Prefix) []netip.Addr {
+	var hosts []netip.Addr
+	for a := p.Addr(); a.IsValid() && p.Contains(a); a = a.Next() {
+		hosts = append(hosts, a)
+	}
+	if p.Addr().Is4() && p.Bits() < 31 && len(hosts) > 2 {
+		hosts = hosts[1 : len(hosts)-1]
+	}
+	return hosts
+}
+
+// SetSweep replaces the sweep configuration and starts a sweep right away
+// if it has networks.
+func (s *DiscoveryService) SetSweep(sw Sweep) {
+	if sw.Interval <= 0 {
+		sw.Interval = defaultSweepInterval
+	}
+	if len(sw.ProbePaths) == 0 {
+		sw.ProbePaths = []string{"/description.xml"}
+	}
+	s.mu.Lock()
+	s.sweep = sw
+	s.mu.Unlock()
+	select {
+	case s.sweepNow <- struct{}{}:
+	default:
+	}
+}
+
+func (s *DiscoveryService) sweepLoop() {
+	for {
+		select { // A sweep is starting anyway
+		case <-s.sweepNow:
+		default:
+		}
+		s.mu.RLock()
+		sw := s.sweep
+		s.mu.RUnlock()
+
+		if len(sw.Networks) > 0 {
+			s.runSweep(sw)
+		}
+		interval := sw.Interval
+		if interval <= 0 {
+			interval = defaultSweepInterval
+		}
+		select {
+		case <-time.After(interval):
+		case <-s.sweepNow:
+		}
+	}
+}
+
+// runSweep sends M-SEARCH to every host of the sweep networks from one
+// socket whose responses are read while sending, then probes description
+// URLs.
+func (s *DiscoveryService) runSweep(sw Sweep) {
+	var hosts []netip.Addr
+	for _, p := range sw.Networks {
+		hosts = append(hosts, sweepHosts(p)...)
+	}
+	log.Printf("Sweeping %d addresses for devices", len(hosts))
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Printf("Error opening sweep socket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	mx := s.Tuning().SearchMX
+	go func() {
+		for _, h := range hosts {
+			addr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(h, 1900))
+			msg := fmt.Sprintf(ssdpSearchMsg, addr, mx)
+			conn.WriteTo([]byte(msg), addr) // Errors are expected for unused addresses
+			time.Sleep(sweepPacketInterval)
+		}
+	}()
+	s.readResponses(conn, time.Duration(len(hosts))*sweepPacketInterval+time.Duration(mx+1)*time.Second)
+
+	if len(sw.ProbePorts) > 0 {
+		s.probeHosts(hosts, sw.ProbePorts, sw.ProbePaths)
+	}
+}
+
+// probeHosts requests description URLs on hosts with an open probe port,
+// a few hosts at a time.
+func (s *DiscoveryService) probeHosts(hosts []netip.Addr, ports []int, paths []string) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 32)
+	for _, h := range hosts {
+		for _, port := range ports {
+			hostport := net.JoinHostPort(h.String(), strconv.Itoa(port))
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				conn, err := net.DialTimeout("tcp", hostport, sweepProbeTimeout)
+				if err != nil {
+					return
+				}
+				conn.Close()
+				expiry := s.Tuning().DeviceExpiry
+				for _, p := range paths {
+					location := "http://" + hostport + p
+					s.fetchDescription(location, location, "", "", expiry)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,72 @@
+package dlna
+
+import "time"
+
+// Tuning holds the discovery timing and socket knobs. It can be changed
+// while discovery runs; loops pick up new values on their next iteration.
+type Tuning struct {
+	// CleanupInterval is how often known devices are probed and expired.
+	CleanupInterval time.Duration
+	// DeviceExpiry is how long a device stays online without
+	// re-announcing, when it does not send CACHE-CONTROL.
+	DeviceExpiry time.Duration
+	// HopLimit is the multicast TTL (IPv4) / hop limit (IPv6) of
+	// M-SEARCH requests; 0 keeps the OS default of 1.
+	HopLimit int
+	// ReadBuffer is the size of the SSDP receive buffer in bytes.
+	ReadBuffer int
+	// SearchMX is the MX header of M-SEARCH requests: the maximum number
+	// of seconds devices may wait before answering.
+	SearchMX int
+	// OfflineRetention is how long an offline device is kept, for clients
+	// to show with its last_seen, before it is forgotten.
+	OfflineRetention time.Duration
+}
+
+// DefaultTuning returns the values used when nothing is configured.
+func DefaultTuning() Tuning {
+	return Tuning{
+		CleanupInterval:  time.Minute,
+		DeviceExpiry:     defaultMaxAge,
+		ReadBuffer:       4096,
+		SearchMX:         1,
+		OfflineRetention: 7 * 24 * time.Hour, // A TV unplugged over a holiday is still known
+	}
+}
+
+// withDefaults fills zero fields from DefaultTuning. HopLimit 0 is a valid
+// setting and stays as is.
+func (t Tuning) withDefaults() Tuning {
+	def := DefaultTuning()
+	if t.CleanupInterval <= 0 {
+		t.CleanupInterval = def.CleanupInterval
+	}
+	if t.DeviceExpiry <= 0 {
+		t.DeviceExpiry = def.DeviceExpiry
+	}
+	if t.ReadBuffer <= 0 {
+		t.ReadBuffer = def.ReadBuffer
+	}
+	if t.SearchMX <= 0 {
+		t.SearchMX = def.SearchMX
+	}
+	if t.OfflineRetention <= 0 {
+		t.OfflineRetention = def.OfflineRetention
+	}
+	return t
+}
+
+// Tuning returns the current discovery tuning.
+func (s *DiscoveryService) Tuning() Tuning {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tuning
+}
+
+// SetTuning replaces the discovery tuning. Zero fields fall back to their
+// defaults.
+func (s *DiscoveryService) SetTuning(t Tuning) {
+	s.mu.Lock()
+	s.tuning = t.withDefaults()
+	s.mu.Unlock()
+}
@@ -0,0 +1,82 @@
+package dlna
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const ssdpPort = "1900"
+
+// ParseSearchTargets validates unicast M-SEARCH targets: IP addresses,
+// usually subnet broadcast addresses such as 192.168.1.255, with an
+// optional port (default 1900).
+func ParseSearchTargets(targets []string) ([]*net.UDPAddr, error) {
+	addrs := make([]*net.UDPAddr, 0, len(targets))
+	for _, t := range targets {
+		hostport := t
+		if _, _, err := net.SplitHostPort(t); err != nil {
+			hostport = net.JoinHostPort(strings.Trim(t, "[]"), ssdpPort)
+		}
+		addr, err := net.ResolveUDPAddr("udp", hostport)
+		if err != nil || addr.IP == nil {
+			return nil, fmt.Errorf("invalid search target %q", t)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// SetSearchTargets configures addresses that get a unicast M-SEARCH on
+// every search, for networks where multicast does not reach the agent
+// (e.g. a container without host networking). Broadcast addresses reach a
+// whole subnet. Use ParseSearchTargets to validate them first.
+func (s *DiscoveryService) SetSearchTargets(targets []*net.UDPAddr) {
+	s.mu.Lock()
+	s.searchTargets = targets
+	s.mu.Unlock()
+}
+
+// sendUnicastSearch sends M-SEARCH to every search target from one socket
+// and reads the responses, which come back to it directly, until MX has
+// passed.
+func (s *DiscoveryService) sendUnicastSearch() {
+	s.mu.RLock()
+	targets := s.searchTargets
+	s.mu.RUnlock()
+	if len(targets) == 0 {
+		return
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Printf("Error opening unicast search socket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	tuning := s.Tuning()
+	for _, addr := range targets {
+		msg := fmt.Sprintf(ssdpSearchMsg, addr, tuning.SearchMX)
+		if _, err := conn.WriteTo([]byte(msg), addr); err != nil {
+			log.Printf("Error sending M-SEARCH to %s: %v", addr, err)
+		}
+	}
+	s.readResponses(conn, time.Duration(tuning.SearchMX+1)*time.Second)
+}
+
+// readResponses feeds the packets arriving on conn into processPacket until
+// wait has passed.
+func (s *DiscoveryService) readResponses(conn *net.UDPConn, wait time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, s.Tuning().ReadBuffer)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return // Deadline reached
+		}
+		s.processPacket(buf[:n], src)
+	}
+}
@@ -0,0 +1,153 @@
+package dlna
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// SetMAC configures the MAC address for a device, keyed by USN or
+// description Location. Configured addresses take precedence over ARP.
+func (s *DiscoveryService) SetMAC(key, mac string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.macs[key] = mac
+	for _, d := range s.devices {
+		if d.USN == key || d.Location == key {
+			d.MAC = mac
+		}
+	}
+}
+
+// resolveMAC fills in d.MAC from config or the ARP table. Callers must hold s.mu.
+func (s *DiscoveryService) resolveMAC(d *Device) {
+	if mac, ok := s.macs[d.USN]; ok {
+		d.MAC = mac
+		return
+	}
+	if mac, ok := s.macs[d.Location]; ok {
+		d.MAC = mac
+		return
+	}
+	if d.MAC == "" {
+		d.MAC = arpLookup(hostOf(d.Location))
+	}
+}
+
+// WakeDevice sends a Wake-on-LAN magic packet to an offline device and waits
+// until it answers on its Location again or timeout expires.
+func (s *DiscoveryService) WakeDevice(usn string, timeout time.Duration) error {
+	s.mu.RLock()
+	d, ok := s.devices[usn]
+	var mac, location string
+	if ok {
+		mac, location = d.MAC, d.Location
+	}
+	s.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("device %s not found", usn)
+	}
+	if mac == "" {
+		return fmt.Errorf("no MAC address known for %s", usn)
+	}
+
+	if err := sendMagicPacket(mac); err != nil {
+		return err
+	}
+	log.Printf("Sent Wake-on-LAN to %s (%s)", usn, mac)
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		if probe(location) {
+			s.mu.Lock()
+			d, ok := s.devices[usn]
+			if ok && !isPlaceholder(d) {
+				s.markOnline(d, s.tuning.DeviceExpiry)
+			}
+			name := s.manual[location]
+			s.mu.Unlock()
+			if ok && isPlaceholder(d) {
+				// Its description is only now reachable
+				if _, err := s.refreshManual(location, name); err != nil {
+					continue
+				}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("device %s did not come online within %s", usn, timeout)
+}
+
+func sendMagicPacket(mac string) error {
+	packet, err := magicPacket(mac)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("udp4", "255.255.255.255:9")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(packet)
+	return err
+}
+
+// magicPacket is the Wake-on-LAN payload for mac: 6 x 0xFF followed by
+// the MAC repeated 16 times.
+func magicPacket(mac string) ([]byte, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	packet := bytes.Repeat([]byte{0xFF}, 6)
+	for i := 0; i < 16; i++ {
+		packet = append(packet, hw...)
+	}
+	return packet, nil
+}
+
+func hostOf(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// arpLookup returns the MAC for ip from the Linux ARP table, or "" if unknown.
+func arpLookup(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return parseARP(f, ip)
+}
+
+// parseARP finds the MAC of ip in a table in the format of /proc/net/arp.
+// Incomplete entries (00:00:00:00:00:00) do not count.
+func parseARP(r io.Reader, ip string) string {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && fields[0] == ip && fields[3] != "00:00:00:00:00:00" {
+			return fields[3]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package dlna
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// withZone adds the IPv6 zone of the interface a packet arrived on to a
+// link-local Location host (http://[fe80::1]:80/ becomes
+// http://[fe80::1%eth0]:80/). Without it the URL is not dialable on hosts
+// with more than one interface.
+func withZone(location, zone string) string {
+	if zone == "" {
+		return location
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return location
+	}
+	setZone(u, zone)
+	return u.String()
+}
+
+// setZone sets the zone on u's host, keeping the port.
+func setZone(u *url.URL, zone string) {
+	host, _ := splitZone(u.Hostname())
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(host+"%"+zone, port)
+	} else {
+		u.Host = "[" + host + "%" + zone + "]"
+	}
+}
+
+// inheritZone copies the zone of from's host to u when both are the same
+// link-local address and u lacks one, e.g. for a URLBase in a description
+// fetched from a zoned Location.
+func inheritZone(u, from *url.URL) {
+	zoned, zone := splitZone(from.Hostname())
+	if zone == "" {
+		return
+	}
+	if host, z := splitZone(u.Hostname()); z == "" && host == zoned {
+		setZone(u, zone)
+	}
+}
+
+func splitZone(host string) (string, string) {
+	host, zone, _ := strings.Cut(host, "%")
+	return host, zone
+}
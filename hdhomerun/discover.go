@@ -0,0 +1,133 @@
+package hdhomerun
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"slices"
+	"time"
+)
+
+// The discovery protocol: a broadcast request on UDP port 65001 that
+// tuners answer with their ID and base URL, as tag-length-value fields.
+const (
+	discoverPort = 65001
+
+	typeDiscoverRequest = 0x0002
+	typeDiscoverReply   = 0x0003
+
+	tagDeviceType = 0x01
+	tagDeviceID   = 0x02
+	tagBaseURL    = 0x2a
+
+	deviceTypeTuner    = 0x00000001
+	deviceTypeWildcard = 0xffffffff
+	deviceIDWildcard   = 0xffffffff
+)
+
+// Discover broadcasts a discovery request and returns the base URLs of the
+// tuners that answer within timeout.
+func Discover(ctx context.Context, timeout time.Duration) ([]string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	req := discoverRequest()
+	if _, err := conn.WriteToUDP(req, &net.UDPAddr{IP: net.IPv4bcast, Port: discoverPort}); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	var urls []string
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return urls, ctx.Err()
+			}
+			return urls, err
+		}
+		base, ok := parseDiscoverReply(buf[:n])
+		if !ok {
+			continue
+		}
+		if base == "" {
+			// Old firmware has no HTTP base URL tag
+			base = "http://" + from.IP.String()
+		}
+		if !slices.Contains(urls, base) {
+			urls = append(urls, base)
+		}
+	}
+}
+
+// discoverRequest asks every tuner to answer.
+func discoverRequest() []byte {
+	var payload []byte
+	payload = appendTLV(payload, tagDeviceType, binary.BigEndian.AppendUint32(nil, deviceTypeWildcard))
+	payload = appendTLV(payload, tagDeviceID, binary.BigEndian.AppendUint32(nil, deviceIDWildcard))
+	return appendPacket(nil, typeDiscoverRequest, payload)
+}
+
+// appendPacket frames payload with its type, length and CRC.
+func appendPacket(b []byte, typ uint16, payload []byte) []byte {
+	start := len(b)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	b = append(b, payload...)
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:]))
+}
+
+// appendTLV appends a field; lengths over 127 take two bytes.
+func appendTLV(b []byte, tag byte, value []byte) []byte {
+	b = append(b, tag)
+	if n := len(value); n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		b = append(b, byte(n)|0x80, byte(n>>7))
+	}
+	return append(b, value...)
+}
+
+// parseDiscoverReply returns the base URL in a discovery reply from a
+// tuner, reporting false for anything else.
+func parseDiscoverReply(b []byte) (string, bool) {
+	if len(b) < 8 || binary.LittleEndian.Uint32(b[len(b)-4:]) != crc32.ChecksumIEEE(b[:len(b)-4]) {
+		return "", false
+	}
+	if binary.BigEndian.Uint16(b) != typeDiscoverReply || int(binary.BigEndian.Uint16(b[2:])) != len(b)-8 {
+		return "", false
+	}
+	payload := b[4 : len(b)-4]
+	tuner := false
+	var base string
+	for len(payload) >= 2 {
+		tag, n, hdr := payload[0], int(payload[1]), 2
+		if n&0x80 != 0 {
+			if len(payload) < 3 {
+				return "", false
+			}
+			n, hdr = n&0x7f|int(payload[2])<<7, 3
+		}
+		if len(payload) < hdr+n {
+			return "", false
+		}
+		value := payload[hdr : hdr+n]
+		switch tag {
+		case tagDeviceType:
+			tuner = n == 4 && binary.BigEndian.Uint32(value) == deviceTypeTuner
+		case tagBaseURL:
+			base = string(bytes.TrimRight(value, "\x00"))
+		}
+		payload = payload[hdr+n:]
+	}
+	return base, tuner
+}
@@ -0,0 +1,108 @@
+// Package hdhomerun finds SiliconDust HDHomeRun network tuners by
+// broadcast and lists their channels through their HTTP API. Channels are
+// MPEG-TS streams renderers can play.
+package hdhomerun
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Tuner is an HDHomeRun, as described by its /discover.json.
+type Tuner struct {
+	ID         string `json:"DeviceID"`
+	Name       string `json:"FriendlyName"`
+	Model      string `json:"ModelNumber"`
+	BaseURL    string `json:"BaseURL"`
+	LineupURL  string `json:"LineupURL"`
+	TunerCount int    `json:"TunerCount"`
+}
+
+// Channel is an entry of a tuner's lineup.
+type Channel struct {
+	Number     string `json:"GuideNumber"` // e.g. "5.1"
+	Name       string `json:"GuideName"`
+	URL        string `json:"URL"`
+	HD         int    `json:"HD"`
+	Favorite   int    `json:"Favorite"`
+	DRM        int    `json:"DRM"`
+	VideoCodec string `json:"VideoCodec"`
+	AudioCodec string `json:"AudioCodec"`
+}
+
+// Lookup fetches the description of the tuner at host, an address or
+// URL.
+func Lookup(ctx context.Context, host string) (*Tuner, error) {
+	base := host
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid tuner address %q", host)
+	}
+	var t Tuner
+	if err := getJSON(ctx, u.Scheme+"://"+u.Host+"/discover.json", &t); err != nil {
+		return nil, err
+	}
+	if t.BaseURL == "" {
+		t.BaseURL = u.Scheme + "://" + u.Host
+	}
+	if t.LineupURL == "" {
+		t.LineupURL = t.BaseURL + "/lineup.json"
+	}
+	return &t, nil
+}
+
+// Lineup fetches the channels of the tuner, in its order.
+func (t *Tuner) Lineup(ctx context.Context) ([]Channel, error) {
+	var channels []Channel
+	if err := getJSON(ctx, t.LineupURL, &channels); err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", url, err)
+	}
+	return nil
+}
+
+// CompareNumbers orders guide numbers numerically, "5.1" before "5.2"
+// before "12".
+func CompareNumbers(a, b string) int {
+	ap, bp := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		an, aerr := strconv.Atoi(ap[i])
+		bn, berr := strconv.Atoi(bp[i])
+		switch {
+		case aerr != nil || berr != nil:
+			if c := strings.Compare(ap[i], bp[i]); c != 0 {
+				return c
+			}
+		case an != bn:
+			return cmp.Compare(an, bn)
+		}
+	}
+	return len(ap) - len(bp)
+}
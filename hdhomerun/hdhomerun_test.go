@@ -0,0 +1,78 @@
+package hdhomerun
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/discover.json":
+			fmt.Fprintf(w, `{"FriendlyName": "HDHomeRun CONNECT", "ModelNumber": "HDHR5-2US", "DeviceID": "1050A1B2", "TunerCount": 2, "BaseURL": %q, "LineupURL": %q}`, srv.URL, srv.URL+"/lineup.json")
+		case "/lineup.json":
+			fmt.Fprintf(w, `[{"GuideNumber": "5.1", "GuideName": "KPIX", "URL": "%s:5004/auto/v5.1", "HD": 1}, {"GuideNumber": "9.2", "GuideName": "KQED", "URL": "%s:5004/auto/v9.2", "DRM": 1}]`, srv.URL, srv.URL)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tuner, err := Lookup(context.Background(), srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if tuner.ID != "1050A1B2" || tuner.TunerCount != 2 || tuner.BaseURL != srv.URL {
+		t.Errorf("Unexpected tuner %+v", tuner)
+	}
+	channels, err := tuner.Lineup(context.Background())
+	if err != nil {
+		t.Fatalf("Lineup failed: %v", err)
+	}
+	if len(channels) != 2 || channels[0].Name != "KPIX" || channels[0].HD != 1 || channels[1].DRM != 1 {
+		t.Errorf("Unexpected lineup %+v", channels)
+	}
+	if _, err := Lookup(context.Background(), "http://"+srv.Listener.Addr().String()+"/nothing"); err != nil {
+		t.Errorf("Expected the path of a URL to be ignored, got %v", err)
+	}
+}
+
+func TestDiscoverPackets(t *testing.T) {
+	req := discoverRequest()
+	if binary.BigEndian.Uint16(req) != typeDiscoverRequest || len(req) != 4+12+4 {
+		t.Errorf("Unexpected request % x", req)
+	}
+
+	payload := appendTLV(nil, tagDeviceType, binary.BigEndian.AppendUint32(nil, deviceTypeTuner))
+	payload = appendTLV(payload, tagDeviceID, binary.BigEndian.AppendUint32(nil, 0x1050a1b2))
+	payload = appendTLV(payload, tagBaseURL, []byte("http://192.168.1.50:80"))
+	reply := appendPacket(nil, typeDiscoverReply, payload)
+	if base, ok := parseDiscoverReply(reply); !ok || base != "http://192.168.1.50:80" {
+		t.Errorf("Expected the base URL, got %q, %v", base, ok)
+	}
+	reply[len(reply)-1] ^= 0xff
+	if _, ok := parseDiscoverReply(reply); ok {
+		t.Error("Expected a CRC mismatch to fail")
+	}
+	if _, ok := parseDiscoverReply(req); ok {
+		t.Error("Expected a request not to parse as a reply")
+	}
+	long := appendTLV(nil, tagBaseURL, make([]byte, 200))
+	if long[1] != 200&0x7f|0x80 || long[2] != 1 || len(long) != 203 {
+		t.Errorf("Unexpected long field header % x", long[:3])
+	}
+}
+
+func TestCompareNumbers(t *testing.T) {
+	numbers := []string{"12", "5.2", "5.10", "5.1", "2"}
+	slices.SortFunc(numbers, CompareNumbers)
+	if want := []string{"2", "5.1", "5.2", "5.10", "12"}; !slices.Equal(numbers, want) {
+		t.Errorf("Expected %v, got %v", want, numbers)
+	}
+}
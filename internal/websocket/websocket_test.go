@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestAccept(t *testing.T) {
+	// The example of RFC 6455, section 1.3
+	if got := Accept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept key %q", got)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		for _, masked := range []bool{false, true} {
+			payload := bytes.Repeat([]byte{'x'}, n)
+			var buf bytes.Buffer
+			if err := WriteFrame(&buf, OpText, payload, masked); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.Bytes()[1]&0x80 != 0; got != masked {
+				t.Errorf("%d bytes: expected masked %v, got %v", n, masked, got)
+			}
+			fin, opcode, got, err := ReadFrame(bufio.NewReader(&buf), 1<<20)
+			if err != nil || !fin || opcode != OpText || !bytes.Equal(got, payload) {
+				t.Errorf("%d bytes, masked %v: got fin %v, opcode %d, %d bytes, %v", n, masked, fin, opcode, len(got), err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	WriteFrame(&buf, OpText, make([]byte, 200), true)
+	if _, _, _, err := ReadFrame(bufio.NewReader(&buf), 100); err == nil {
+		t.Error("Expected a frame over the limit to fail")
+	}
+	buf.Reset()
+	WriteFrame(&buf, OpPing, []byte("ping"), false)
+	buf.Truncate(buf.Len() - 1)
+	if _, _, _, err := ReadFrame(bufio.NewReader(&buf), 100); err == nil {
+		t.Error("Expected a truncated frame to fail")
+	}
+}
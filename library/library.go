@@ -0,0 +1,496 @@
+// Package library indexes the media roots: it scans them, extracts
+// duration, resolution, codecs, tags and covers with ffprobe, and answers
+// searches and folder listings from the index.
+package library
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"dlna/didl"
+	"dlna/store"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	storeKey = "library"
+
+	// probeTimeout bounds ffprobe on one file.
+	probeTimeout = 30 * time.Second
+)
+
+// Media types of items
+const (
+	TypeVideo = "video"
+	TypeAudio = "audio"
+	TypeImage = "image"
+)
+
+var extTypes = map[string]string{
+	".mp4": TypeVideo, ".m4v": TypeVideo, ".mkv": TypeVideo, ".webm": TypeVideo, ".avi": TypeVideo,
+	".mov": TypeVideo, ".ts": TypeVideo, ".mpg": TypeVideo, ".mpeg": TypeVideo, ".wmv": TypeVideo,
+	".mp3": TypeAudio, ".flac": TypeAudio, ".m4a": TypeAudio, ".aac": TypeAudio, ".ogg": TypeAudio,
+	".opus": TypeAudio, ".wav": TypeAudio, ".wma": TypeAudio,
+	".jpg": TypeImage, ".jpeg": TypeImage, ".png": TypeImage, ".gif": TypeImage, ".bmp": TypeImage, ".webp": TypeImage,
+}
+
+// ErrScanning is returned by Scan while another scan runs.
+var ErrScanning = errors.New("a library scan is already running")
+
+// Item is an indexed media file.
+type Item struct {
+	ID          string    `json:"id"` // Stable across scans, from root and path
+	Root        string    `json:"root"`
+	Path        string    `json:"path"` // Slash-separated, relative to the root
+	Type        string    `json:"type"` // video, audio or image
+	MIME        string    `json:"mime,omitempty"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	Title       string    `json:"title"` // From the tags, or the file name
+	Artist      string    `json:"artist,omitempty"`
+	Album       string    `json:"album,omitempty"`
+	Genre       string    `json:"genre,omitempty"`
+	Date        string    `json:"date,omitempty"`
+	Duration    string    `json:"duration,omitempty"` // H:MM:SS
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Format      string    `json:"format,omitempty"`
+	VideoCodec  string    `json:"video_codec,omitempty"`
+	AudioCodec  string    `json:"audio_codec,omitempty"`
+	Cover       bool      `json:"cover"`                  // Has an embedded cover
+	CoverStream int       `json:"cover_stream,omitempty"` // Its stream index
+}
+
+// Status summarizes the index.
+type Status struct {
+	Items    int       `json:"items"`
+	Scanning bool      `json:"scanning"`
+	LastScan time.Time `json:"last_scan,omitempty"`
+	// UpdateID goes up whenever items are added, changed or removed, like
+	// the SystemUpdateID of a UPnP ContentDirectory. It restarts at 0.
+	UpdateID uint32 `json:"update_id"`
+}
+
+// Index is the media library.
+type Index struct {
+	store store.Store
+
+	mu       sync.RWMutex
+	probe    Prober
+	items    map[string]Item   // root + "/" + path -> item
+	ids      map[string]string // Item ID -> key in items
+	scanning bool
+	lastScan time.Time
+	updateID uint32
+}
+
+// New loads the index kept in st. probe extracts metadata of new and
+// changed files.
+func New(st store.Store, probe Prober) *Index {
+	x := &Index{probe: probe, store: st, items: make(map[string]Item), ids: make(map[string]string)}
+	var items []Item
+	if _, err := st.Get(storeKey, &items); err != nil {
+		log.Printf("Failed to load library: %v", err)
+	}
+	for _, it := range items {
+		it.ID = ItemID(it.Root, it.Path)
+		x.setLocked(it)
+	}
+	return x
+}
+
+func itemKey(root, p string) string {
+	return root + "/" + p
+}
+
+// ItemID is the ID of the item at path p in root.
+func ItemID(root, p string) string {
+	sum := sha1.Sum([]byte(itemKey(root, p)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// setLocked adds or replaces an item. Callers must hold x.mu.
+func (x *Index) setLocked(it Item) {
+	key := itemKey(it.Root, it.Path)
+	x.items[key] = it
+	x.ids[it.ID] = key
+}
+
+// deleteLocked removes the item at key. Callers must hold x.mu.
+func (x *Index) deleteLocked(key string) {
+	delete(x.ids, x.items[key].ID)
+	delete(x.items, key)
+}
+
+// SetProber replaces the metadata extractor, e.g. for another ffprobe.
+func (x *Index) SetProber(p Prober) {
+	x.mu.Lock()
+	x.probe = p
+	x.mu.Unlock()
+}
+
+// MediaType is the item type of a file name, or "" for other files.
+func MediaType(name string) string {
+	return extTypes[strings.ToLower(path.Ext(name))]
+}
+
+// Root is a media root: a local folder or a network share.
+type Root struct {
+	FS fs.FS
+	// Dir is the local folder FS reads, watched with inotify; "" for a
+	// share, which is polled.
+	Dir string
+	// Input is what ffprobe and ffmpeg open for the file at rel
+	// (slash-separated): its path, or a URL serving it.
+	Input func(rel string) string
+}
+
+// DirRoot is the Root of a local folder.
+func DirRoot(dir string) Root {
+	return Root{
+		FS:  os.DirFS(dir),
+		Dir: dir,
+		Input: func(rel string) string {
+			return filepath.Join(dir, filepath.FromSlash(rel))
+		},
+	}
+}
+
+// Scan brings the index in line with roots (by name): new and changed
+// files are probed, unchanged ones kept and vanished ones dropped.
+func (x *Index) Scan(ctx context.Context, roots map[string]Root) error {
+	x.mu.Lock()
+	if x.scanning {
+		x.mu.Unlock()
+		return ErrScanning
+	}
+	x.scanning = true
+	x.mu.Unlock()
+	defer func() {
+		x.mu.Lock()
+		x.scanning = false
+		x.mu.Unlock()
+	}()
+
+	start := time.Now()
+	seen := make(map[string]bool)
+	probed := 0
+	for root, r := range roots {
+		err := fs.WalkDir(r.FS, ".", func(rel string, d fs.DirEntry, err error) error {
+			if err != nil {
+				log.Printf("Library scan: %s: %v", root, err)
+				return nil // Skip unreadable folders
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if d.IsDir() || MediaType(rel) == "" {
+				return nil
+			}
+			seen[itemKey(root, rel)] = true
+			changed, err := x.update(ctx, root, r, rel)
+			if err != nil {
+				log.Printf("Library scan: %v", err)
+			}
+			if changed {
+				probed++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	x.mu.Lock()
+	removed := 0
+	for key := range x.items {
+		if !seen[key] {
+			x.deleteLocked(key)
+			removed++
+		}
+	}
+	x.lastScan = time.Now()
+	total := len(x.items)
+	if probed+removed > 0 {
+		x.updateID++
+	}
+	x.saveLocked()
+	x.mu.Unlock()
+
+	log.Printf("Library scan: %d items, %d probed, %d removed in %s", total, probed, removed, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// update indexes one file of root unless it is unchanged since the last
+// scan, reporting whether it was probed. Files ffprobe cannot read are
+// still indexed by name. The caller saves the index.
+func (x *Index) update(ctx context.Context, root string, r Root, rel string) (bool, error) {
+	info, err := fs.Stat(r.FS, rel)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", root, err)
+	}
+
+	key := itemKey(root, rel)
+	x.mu.RLock()
+	old, ok := x.items[key]
+	x.mu.RUnlock()
+	if ok && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) {
+		return false, nil
+	}
+
+	it := Item{
+		ID:      ItemID(root, rel),
+		Root:    root,
+		Path:    rel,
+		Type:    MediaType(rel),
+		MIME:    mime.TypeByExtension(path.Ext(rel)),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Title:   strings.TrimSuffix(path.Base(rel), path.Ext(rel)),
+	}
+	x.mu.RLock()
+	probe := x.probe
+	x.mu.RUnlock()
+	pctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	meta, perr := probe(pctx, r.Input(rel))
+	cancel()
+	if perr == nil {
+		it.apply(meta)
+	} else {
+		perr = fmt.Errorf("%s/%s: %w", root, rel, perr)
+	}
+
+	x.mu.Lock()
+	x.setLocked(it)
+	x.mu.Unlock()
+	return true, perr
+}
+
+// RefreshDir updates the index for folder rel of root (slash-separated, ""
+// is the top) after a change in it: files directly in the folder are
+// updated and items of vanished files and subfolders dropped. With deep,
+// the whole subtree is refreshed, e.g. for a folder moved in.
+func (x *Index) RefreshDir(ctx context.Context, root string, r Root, rel string, deep bool) {
+	prefix, full := "", "."
+	if rel != "" {
+		prefix, full = rel+"/", rel
+	}
+	seen := make(map[string]bool)
+	subdirs := make(map[string]bool)
+	probed := 0
+	visit := func(p string) {
+		seen[p] = true
+		changed, err := x.update(ctx, root, r, p)
+		if err != nil {
+			log.Printf("Library: %v", err)
+		}
+		if changed {
+			probed++
+		}
+	}
+
+	if deep {
+		fs.WalkDir(r.FS, full, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || ctx.Err() != nil {
+				return nil
+			}
+			if !d.IsDir() && MediaType(p) != "" {
+				visit(p)
+			}
+			return nil
+		})
+	} else {
+		entries, err := fs.ReadDir(r.FS, full)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Library: %v", err)
+			return // Keep the items of a folder that cannot be read
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				subdirs[e.Name()] = true
+			} else if MediaType(e.Name()) != "" {
+				visit(prefix + e.Name())
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	removed := 0
+	for key, it := range x.items {
+		if it.Root != root || !strings.HasPrefix(it.Path, prefix) || seen[it.Path] {
+			continue
+		}
+		rest := strings.TrimPrefix(it.Path, prefix)
+		if sub, _, nested := strings.Cut(rest, "/"); nested && !deep && subdirs[sub] {
+			continue // Subfolders report their own changes
+		}
+		x.deleteLocked(key)
+		removed++
+	}
+	if probed+removed > 0 {
+		x.updateID++
+		x.saveLocked()
+		log.Printf("Library: %s/%s: %d probed, %d removed", root, rel, probed, removed)
+	}
+}
+
+func (it *Item) apply(m *Metadata) {
+	if t := m.Tags["title"]; t != "" {
+		it.Title = t
+	}
+	it.Artist = m.Tags["artist"]
+	if it.Artist == "" {
+		it.Artist = m.Tags["album_artist"]
+	}
+	it.Album = m.Tags["album"]
+	it.Genre = m.Tags["genre"]
+	it.Date = m.Tags["date"]
+	if m.Duration > 0 && it.Type != TypeImage {
+		it.Duration = didl.FormatDuration(m.Duration)
+	}
+	it.Format = m.Format
+	it.VideoCodec, it.AudioCodec = m.VideoCodec, m.AudioCodec
+	it.Width, it.Height = m.Width, m.Height
+	if m.CoverIndex >= 0 {
+		it.Cover, it.CoverStream = true, m.CoverIndex
+	}
+}
+
+// saveLocked persists the index. Callers must hold x.mu.
+func (x *Index) saveLocked() {
+	items := make([]Item, 0, len(x.items))
+	for _, it := range x.items {
+		items = append(items, it)
+	}
+	sortItems(items)
+	if err := x.store.Set(storeKey, items); err != nil {
+		log.Printf("Failed to save library: %v", err)
+	}
+}
+
+func sortItems(items []Item) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Root != items[j].Root {
+			return items[i].Root < items[j].Root
+		}
+		return items[i].Path < items[j].Path
+	})
+}
+
+// Status returns the size and scan state of the index.
+func (x *Index) Status() Status {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return Status{Items: len(x.items), Scanning: x.scanning, LastScan: x.lastScan, UpdateID: x.updateID}
+}
+
+// Get returns the item at path in root.
+func (x *Index) Get(root, p string) (Item, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	it, ok := x.items[itemKey(root, p)]
+	return it, ok
+}
+
+// ByID returns the item with the given ID.
+func (x *Index) ByID(id string) (Item, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	it, ok := x.items[x.ids[id]]
+	return it, ok
+}
+
+// Query is a library search. Zero fields match everything.
+type Query struct {
+	Text   string // Case-insensitive substring of title, artist, album or path
+	Type   string // video, audio or image
+	Root   string
+	Offset int
+	Limit  int // 0 is no limit
+}
+
+// Search returns a page of the items matching q, sorted by root and path,
+// and the number of matches before paging.
+func (x *Index) Search(q Query) ([]Item, int) {
+	text := strings.ToLower(q.Text)
+	x.mu.RLock()
+	var matched []Item
+	for _, it := range x.items {
+		if q.Type != "" && it.Type != q.Type || q.Root != "" && it.Root != q.Root {
+			continue
+		}
+		if text != "" && !strings.Contains(strings.ToLower(it.Title+"\x00"+it.Artist+"\x00"+it.Album+"\x00"+it.Path), text) {
+			continue
+		}
+		matched = append(matched, it)
+	}
+	x.mu.RUnlock()
+
+	sortItems(matched)
+	total := len(matched)
+	matched = matched[min(q.Offset, total):]
+	if q.Limit > 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+	return matched, total
+}
+
+// Browse lists the subfolders and items directly in folder dir of root
+// ("" is the top).
+func (x *Index) Browse(root, dir string) (folders []string, items []Item) {
+	prefix := ""
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		prefix = dir + "/"
+	}
+	seen := make(map[string]bool)
+	x.mu.RLock()
+	for _, it := range x.items {
+		if it.Root != root || !strings.HasPrefix(it.Path, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(it.Path, prefix)
+		if sub, _, nested := strings.Cut(rest, "/"); nested {
+			if !seen[sub] {
+				seen[sub] = true
+				folders = append(folders, sub)
+			}
+			continue
+		}
+		items = append(items, it)
+	}
+	x.mu.RUnlock()
+
+	sort.Strings(folders)
+	sortItems(items)
+	return folders, items
+}
+
+// Cover extracts the embedded cover of a file with ffmpeg.
+func Cover(ctx context.Context, ffmpeg, file string, stream int) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, ffmpeg, "-v", "quiet", "-i", file,
+		"-map", fmt.Sprintf("0:%d", stream), "-frames:v", "1", "-c", "copy", "-f", "image2pipe", "-")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w", err)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,195 @@
+package library
+
+import (
+	"context"
+	"dlna/store"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const sampleProbe = `{
+  "streams": [
+    {"index": 0, "codec_type": "audio", "codec_name": "flac", "tags": {"ARTIST": "Stream Artist"}},
+    {"index": 1, "codec_type": "video", "codec_name": "mjpeg", "width": 500, "height": 500, "disposition": {"attached_pic": 1}}
+  ],
+  "format": {"format_name": "flac", "duration": "245.493", "tags": {"TITLE": "So What", "ALBUM": "Kind of Blue"}}
+}`
+
+func TestParseProbe(t *testing.T) {
+	m, err := parseProbe([]byte(sampleProbe))
+	if err != nil {
+		t.Fatalf("parseProbe failed: %v", err)
+	}
+	if m.Duration != 245*time.Second || m.AudioCodec != "flac" || m.VideoCodec != "" || m.CoverIndex != 1 {
+		t.Errorf("Unexpected metadata %+v", m)
+	}
+	if m.Tags["title"] != "So What" || m.Tags["artist"] != "Stream Artist" {
+		t.Errorf("Unexpected tags %v", m.Tags)
+	}
+	if len(m.Tracks) != 1 || m.Tracks[0] != (Track{Index: 0, Type: "audio", Codec: "flac"}) {
+		t.Errorf("Unexpected tracks %+v", m.Tracks)
+	}
+
+	film, err := parseProbe([]byte(`{"streams": [
+    {"index": 0, "codec_type": "video", "codec_name": "h264"},
+    {"index": 1, "codec_type": "audio", "codec_name": "eac3", "channels": 6, "tags": {"language": "eng"}, "disposition": {"default": 1}},
+    {"index": 2, "codec_type": "audio", "codec_name": "aac", "channels": 2, "tags": {"language": "fre", "title": "Stereo"}},
+    {"index": 3, "codec_type": "subtitle", "codec_name": "subrip", "tags": {"LANGUAGE": "fre"}, "disposition": {"forced": 1}},
+    {"index": 4, "codec_type": "subtitle", "codec_name": "hdmv_pgs_subtitle"}
+  ], "format": {"format_name": "matroska,webm"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Track{
+		{Index: 1, Type: "audio", Codec: "eac3", Language: "eng", Channels: 6, Default: true},
+		{Index: 2, Type: "audio", Codec: "aac", Language: "fre", Title: "Stereo", Channels: 2},
+		{Index: 3, Type: "subtitle", Codec: "subrip", Language: "fre", Forced: true},
+		{Index: 4, Type: "subtitle", Codec: "hdmv_pgs_subtitle", Bitmap: true},
+	}
+	if !slices.Equal(film.Tracks, want) {
+		t.Errorf("Unexpected tracks %+v", film.Tracks)
+	}
+	if got := FFprobeFor("/opt/ffmpeg/bin/ffmpeg.exe"); got != "/opt/ffmpeg/bin/ffprobe.exe" {
+		t.Errorf("Unexpected ffprobe path %s", got)
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"jazz/so-what.flac", "jazz/live/set.mp3", "films/movie.mkv", "notes.txt"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755)
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644)
+	}
+	probes := 0
+	probe := func(ctx context.Context, path string) (*Metadata, error) {
+		probes++
+		if filepath.Base(path) == "so-what.flac" {
+			return parseProbe([]byte(sampleProbe))
+		}
+		return &Metadata{Tags: map[string]string{}, CoverIndex: -1, Width: 1920, Height: 1080}, nil
+	}
+	st, _ := store.Open("")
+	x := New(st, probe)
+	roots := map[string]Root{"music": DirRoot(dir)}
+
+	if err := x.Scan(context.Background(), roots); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if probes != 3 || x.Status().Items != 3 {
+		t.Fatalf("Expected 3 probed items, got %d probes, %+v", probes, x.Status())
+	}
+	it, ok := x.Get("music", "jazz/so-what.flac")
+	if !ok || it.Title != "So What" || it.Duration != "0:04:05" || !it.Cover || it.Type != TypeAudio {
+		t.Errorf("Unexpected item %+v", it)
+	}
+	if byID, ok := x.ByID(ItemID("music", "jazz/so-what.flac")); !ok || byID.Path != it.Path {
+		t.Errorf("Expected the item by its ID, got %+v", byID)
+	}
+
+	items, total := x.Search(Query{Text: "kind of", Type: TypeAudio})
+	if total != 1 || items[0].Path != "jazz/so-what.flac" {
+		t.Errorf("Unexpected search result %+v", items)
+	}
+	folders, items := x.Browse("music", "jazz")
+	if len(folders) != 1 || folders[0] != "live" || len(items) != 1 {
+		t.Errorf("Unexpected browse result %v %+v", folders, items)
+	}
+
+	// Unchanged files are not probed again; removed ones drop out
+	os.Remove(filepath.Join(dir, "films/movie.mkv"))
+	if err := x.Scan(context.Background(), roots); err != nil {
+		t.Fatalf("Rescan failed: %v", err)
+	}
+	if probes != 3 || x.Status().Items != 2 {
+		t.Errorf("Expected no new probes and 2 items, got %d probes, %+v", probes, x.Status())
+	}
+
+	if reloaded := New(st, probe); reloaded.Status().Items != 2 {
+		t.Errorf("Expected the index to be persisted, got %+v", reloaded.Status())
+	}
+}
+
+func TestRefreshDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"jazz/so-what.flac", "jazz/live/set.mp3", "rock/song.mp3"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755)
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644)
+	}
+	probe := func(ctx context.Context, path string) (*Metadata, error) {
+		return &Metadata{Tags: map[string]string{}, CoverIndex: -1}, nil
+	}
+	st, _ := store.Open("")
+	x := New(st, probe)
+	roots := map[string]Root{"music": DirRoot(dir)}
+	x.Scan(context.Background(), roots)
+	id := x.Status().UpdateID
+
+	// A new file is added; subfolders are left alone
+	os.WriteFile(filepath.Join(dir, "jazz/blue.flac"), []byte("blue"), 0o644)
+	x.RefreshDir(context.Background(), "music", roots["music"], "jazz", false)
+	if _, ok := x.Get("music", "jazz/blue.flac"); !ok || x.Status().Items != 4 {
+		t.Errorf("Expected the new file to be indexed, got %+v", x.Status())
+	}
+	if x.Status().UpdateID != id+1 {
+		t.Errorf("Expected update ID %d, got %d", id+1, x.Status().UpdateID)
+	}
+
+	// A removed subfolder drops its items
+	os.RemoveAll(filepath.Join(dir, "jazz/live"))
+	x.RefreshDir(context.Background(), "music", roots["music"], "jazz", false)
+	if _, ok := x.Get("music", "jazz/live/set.mp3"); ok {
+		t.Error("Expected the removed folder's items to be dropped")
+	}
+
+	// Nothing changed: the update ID stays
+	id = x.Status().UpdateID
+	x.RefreshDir(context.Background(), "music", roots["music"], "", true)
+	if s := x.Status(); s.UpdateID != id || s.Items != 3 {
+		t.Errorf("Expected no change, got %+v", s)
+	}
+}
+
+func TestPollDirs(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := pollDirs(ctx, map[string]Root{"music": DirRoot(dir)}, 10*time.Millisecond)
+
+	os.Mkdir(filepath.Join(dir, "new"), 0o755)
+	select {
+	case c := <-changes:
+		if c.root != "music" || c.dir != "" && c.dir != "new" {
+			t.Errorf("Unexpected change %+v", c)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a change for the new folder")
+	}
+}
+
+func TestThumbnails(t *testing.T) {
+	dir := t.TempDir()
+	thumbs := NewThumbnails(dir)
+	it := Item{ID: ItemID("films", "movie.mkv"), Type: TypeVideo, ModTime: time.Unix(1700000000, 0)}
+
+	// Cached thumbnails are served without running ffmpeg
+	thumbs.put(it.ID+"-"+strconv.FormatInt(it.ModTime.Unix(), 36)+".jpg", []byte("jpeg"))
+	if img, err := thumbs.Get(context.Background(), "/nonexistent/ffmpeg", it, "movie.mkv"); err != nil || string(img) != "jpeg" {
+		t.Errorf("Expected the cached thumbnail, got %q, %v", img, err)
+	}
+
+	// A changed file is not served the old thumbnail
+	it.ModTime = it.ModTime.Add(time.Hour)
+	if _, err := thumbs.Get(context.Background(), "/nonexistent/ffmpeg", it, "movie.mkv"); err == nil {
+		t.Error("Expected ffmpeg to be run for a changed file")
+	}
+
+	song := Item{ID: ItemID("music", "song.mp3"), Type: TypeAudio}
+	if _, err := thumbs.Get(context.Background(), "/nonexistent/ffmpeg", song, "song.mp3"); !errors.Is(err, ErrNoThumbnail) {
+		t.Errorf("Expected ErrNoThumbnail for audio without a cover, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package library
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata is what ffprobe reports about a file.
+type Metadata struct {
+	Duration   time.Duration
+	Format     string // Container, e.g. "matroska,webm"
+	VideoCodec string
+	AudioCodec string
+	Width      int
+	Height     int
+	Tags       map[string]string // Lower-cased tag names: title, artist, album...
+	CoverIndex int               // Stream index of an embedded cover, or -1
+	Tracks     []Track           // Audio and subtitle streams
+}
+
+// Track is an audio or subtitle stream of a file, for casting another one
+// than the renderer would pick.
+type Track struct {
+	Index    int    `json:"index"` // Stream index, as in ffmpeg's -map 0:<index>
+	Type     string `json:"type"`  // "audio" or "subtitle"
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"` // e.g. "eng"
+	Title    string `json:"title,omitempty"`
+	Channels int    `json:"channels,omitempty"` // Of audio
+	Default  bool   `json:"default"`
+	Forced   bool   `json:"forced,omitempty"`
+	// Bitmap subtitles (PGS, VobSub, DVB) cannot be burnt in.
+	Bitmap bool `json:"bitmap,omitempty"`
+}
+
+// bitmapSubtitles are the subtitle codecs that are images, not text.
+var bitmapSubtitles = []string{"hdmv_pgs_subtitle", "dvd_subtitle", "dvb_subtitle", "xsub"}
+
+// Prober extracts metadata from a media file.
+type Prober func(ctx context.Context, path string) (*Metadata, error)
+
+// FFprobe returns a Prober running the ffprobe binary at path.
+func FFprobe(path string) Prober {
+	return func(ctx context.Context, file string) (*Metadata, error) {
+		cmd := exec.CommandContext(ctx, path, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", file)
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("ffprobe: %w", err)
+		}
+		return parseProbe(out.Bytes())
+	}
+}
+
+// FFprobeFor is the ffprobe next to an ffmpeg binary, e.g.
+// /opt/ffmpeg/bin/ffprobe for /opt/ffmpeg/bin/ffmpeg.
+func FFprobeFor(ffmpeg string) string {
+	dir, name := filepath.Split(ffmpeg)
+	ext := filepath.Ext(name)
+	if strings.TrimSuffix(name, ext) != "ffmpeg" {
+		return "ffprobe"
+	}
+	return dir + "ffprobe" + ext
+}
+
+// parseProbe reads the JSON output of ffprobe -show_format -show_streams.
+func parseProbe(data []byte) (*Metadata, error) {
+	var probe struct {
+		Format struct {
+			FormatName string            `json:"format_name"`
+			Duration   string            `json:"duration"`
+			Tags       map[string]string `json:"tags"`
+		} `json:"format"`
+		Streams []struct {
+			Index       int               `json:"index"`
+			CodecType   string            `json:"codec_type"`
+			CodecName   string            `json:"codec_name"`
+			Width       int               `json:"width"`
+			Height      int               `json:"height"`
+			Channels    int               `json:"channels"`
+			Tags        map[string]string `json:"tags"`
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+				Default     int `json:"default"`
+				Forced      int `json:"forced"`
+			} `json:"disposition"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, fmt.Errorf("ffprobe output: %w", err)
+	}
+
+	m := &Metadata{Format: probe.Format.FormatName, Tags: make(map[string]string), CoverIndex: -1}
+	if secs, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		m.Duration = time.Duration(secs * float64(time.Second)).Round(time.Second)
+	}
+	// Tag names vary in case between containers (TITLE in Matroska, title
+	// in MP4). Ogg and Opus keep them on the audio stream instead.
+	for k, v := range probe.Format.Tags {
+		m.Tags[strings.ToLower(k)] = v
+	}
+	for _, s := range probe.Streams {
+		if s.CodecType != "audio" {
+			continue
+		}
+		for k, v := range s.Tags {
+			if k = strings.ToLower(k); m.Tags[k] == "" {
+				m.Tags[k] = v
+			}
+		}
+		break
+	}
+	for _, s := range probe.Streams {
+		switch {
+		case s.CodecType == "video" && s.Disposition.AttachedPic == 1:
+			if m.CoverIndex < 0 {
+				m.CoverIndex = s.Index
+			}
+		case s.CodecType == "video" && m.VideoCodec == "":
+			m.VideoCodec, m.Width, m.Height = s.CodecName, s.Width, s.Height
+		case s.CodecType == "audio" && m.AudioCodec == "":
+			m.AudioCodec = s.CodecName
+		}
+		if s.CodecType == "audio" || s.CodecType == "subtitle" {
+			t := Track{Index: s.Index, Type: s.CodecType, Codec: s.CodecName, Default: s.Disposition.Default == 1, Forced: s.Disposition.Forced == 1}
+			for k, v := range s.Tags {
+				switch strings.ToLower(k) {
+				case "language":
+					t.Language = v
+				case "title":
+					t.Title = v
+				}
+			}
+			if t.Type == "audio" {
+				t.Channels = s.Channels
+			} else {
+				t.Bitmap = slices.Contains(bitmapSubtitles, t.Codec)
+			}
+			m.Tracks = append(m.Tracks, t)
+		}
+	}
+	return m, nil
+}
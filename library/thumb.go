@@ -0,0 +1,130 @@
+package library
+
+import (
+	"bytes"
+	"context"
+	"dlna/didl"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// ThumbnailSize bounds both sides of thumbnails, the limit of the DLNA
+	// JPEG_TN profile that TVs expect for album art.
+	ThumbnailSize = 160
+
+	// thumbMemoryLimit is how many thumbnails are kept without a cache
+	// folder.
+	thumbMemoryLimit = 512
+)
+
+// ErrNoThumbnail is returned for items without a picture, such as audio
+// files without an embedded cover.
+var ErrNoThumbnail = errors.New("item has no picture")
+
+// Thumbnails generates JPEG thumbnails of items and caches them, by item
+// and modification time, in a folder or else in memory.
+type Thumbnails struct {
+	dir string
+
+	mu     sync.Mutex
+	memory map[string][]byte
+}
+
+// NewThumbnails caches in dir, which is created on first use; "" keeps a
+// bounded number in memory.
+func NewThumbnails(dir string) *Thumbnails {
+	return &Thumbnails{dir: dir, memory: make(map[string][]byte)}
+}
+
+// Get returns the thumbnail of it, whose file is at file, generating it
+// with ffmpeg if it is not cached.
+func (t *Thumbnails) Get(ctx context.Context, ffmpeg string, it Item, file string) ([]byte, error) {
+	if it.Type == TypeAudio && !it.Cover {
+		return nil, ErrNoThumbnail
+	}
+	key := it.ID + "-" + strconv.FormatInt(it.ModTime.Unix(), 36) + ".jpg"
+	if img := t.cached(key); img != nil {
+		return img, nil
+	}
+
+	img, err := thumbnail(ctx, ffmpeg, it, file)
+	if err != nil {
+		return nil, err
+	}
+	t.put(key, img)
+	return img, nil
+}
+
+func (t *Thumbnails) cached(key string) []byte {
+	if t.dir == "" {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.memory[key]
+	}
+	img, err := os.ReadFile(filepath.Join(t.dir, key))
+	if err != nil {
+		return nil
+	}
+	return img
+}
+
+func (t *Thumbnails) put(key string, img []byte) {
+	if t.dir == "" {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if len(t.memory) >= thumbMemoryLimit {
+			for k := range t.memory {
+				delete(t.memory, k)
+				break
+			}
+		}
+		t.memory[key] = img
+		return
+	}
+	if err := os.MkdirAll(t.dir, 0o755); err != nil {
+		log.Printf("Failed to cache thumbnail: %v", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(t.dir, key), img, 0o644); err != nil {
+		log.Printf("Failed to cache thumbnail: %v", err)
+	}
+}
+
+// thumbnail grabs a frame a tenth into a video (at most five minutes), the
+// cover of an audio file or the image itself, scaled to ThumbnailSize.
+func thumbnail(ctx context.Context, ffmpeg string, it Item, file string) ([]byte, error) {
+	var input []string
+	switch it.Type {
+	case TypeVideo:
+		if d, err := didl.ParseDuration(it.Duration); err == nil && d > 0 {
+			input = append(input, "-ss", strconv.FormatFloat(min(d/10, 5*time.Minute).Seconds(), 'f', 1, 64))
+		}
+		input = append(input, "-i", file)
+	case TypeAudio:
+		input = []string{"-i", file, "-map", fmt.Sprintf("0:%d", it.CoverStream)}
+	default:
+		input = []string{"-i", file}
+	}
+	scale := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", ThumbnailSize, ThumbnailSize)
+	args := append([]string{"-v", "quiet"}, input...)
+	args = append(args, "-frames:v", "1", "-vf", scale, "-c:v", "mjpeg", "-q:v", "5", "-f", "image2pipe", "-")
+
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w", err)
+	}
+	if out.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg: no frame in %s", file)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,171 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"time"
+)
+
+// Watch modes
+const (
+	WatchAuto = "auto" // inotify for local folders on Linux, polling elsewhere
+	WatchPoll = "poll" // For mounted network shares, which inotify does not see into
+	WatchOff  = "off"
+)
+
+const (
+	// DefaultPollInterval is how often polling looks for changed folders.
+	DefaultPollInterval = time.Minute
+
+	// watchSettle batches the changes of a copy or move in progress into
+	// one refresh.
+	watchSettle = 2 * time.Second
+)
+
+// WatchConfig selects how media roots are watched for changes.
+type WatchConfig struct {
+	Mode         string // One of the Watch modes; "" is WatchAuto
+	PollInterval time.Duration
+}
+
+// errNoNotify is returned by notifyDirs where inotify does not exist.
+var errNoNotify = errors.New("file notifications are not supported on this system")
+
+// dirChange is a folder whose entries changed.
+type dirChange struct {
+	root string
+	dir  string // Slash-separated, relative to the root; "" is the root
+	deep bool   // Refresh the whole subtree
+}
+
+// Watch keeps the index in line with roots (by name) until ctx is done,
+// refreshing only the folders that change. Roots without a local Dir are
+// always polled. Polling notices added, removed and renamed files by the
+// folder's modification time; files rewritten in place are picked up by
+// the next scan.
+func (x *Index) Watch(ctx context.Context, roots map[string]Root, cfg WatchConfig) {
+	if cfg.Mode == WatchOff {
+		return
+	}
+	local := make(map[string]string)
+	polled := make(map[string]Root)
+	for name, r := range roots {
+		if r.Dir != "" && cfg.Mode != WatchPoll {
+			local[name] = r.Dir
+		} else {
+			polled[name] = r
+		}
+	}
+	var notified, changes <-chan dirChange
+	if len(local) > 0 {
+		var err error
+		if notified, err = notifyDirs(ctx, local); err != nil {
+			if !errors.Is(err, errNoNotify) {
+				log.Printf("Library watch: %v; polling instead", err)
+			}
+			for name := range local {
+				polled[name] = roots[name]
+			}
+		}
+	}
+	if len(polled) > 0 {
+		interval := cfg.PollInterval
+		if interval <= 0 {
+			interval = DefaultPollInterval
+		}
+		changes = pollDirs(ctx, polled, interval)
+	}
+
+	pending := make(map[dirChange]bool)
+	settle := time.NewTimer(watchSettle)
+	settle.Stop()
+	defer settle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c, ok := <-notified:
+			if !ok {
+				notified = nil
+				continue
+			}
+			pending[c] = true
+			settle.Reset(watchSettle)
+		case c, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			pending[c] = true
+			settle.Reset(watchSettle)
+		case <-settle.C:
+			for c := range pending {
+				x.RefreshDir(ctx, c.root, roots[c.root], c.dir, c.deep)
+			}
+			clear(pending)
+		}
+	}
+}
+
+// pollDirs reports folders of roots whose modification time changed, and
+// new folders, every interval.
+func pollDirs(ctx context.Context, roots map[string]Root, interval time.Duration) <-chan dirChange {
+	ch := make(chan dirChange)
+	last := dirTimes(roots)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := dirTimes(roots)
+			for c, t := range now {
+				if old, ok := last[c]; ok && old.Equal(t) {
+					continue
+				}
+				select {
+				case ch <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+			last = now
+		}
+	}()
+	return ch
+}
+
+// dirTimes returns the modification time of every folder in roots.
+func dirTimes(roots map[string]Root) map[dirChange]time.Time {
+	times := make(map[dirChange]time.Time)
+	for root, r := range roots {
+		walkDirs(r.FS, func(rel string, info fs.FileInfo) {
+			times[dirChange{root: root, dir: rel}] = info.ModTime()
+		})
+	}
+	return times
+}
+
+// walkDirs calls fn with every readable folder of fsys, by its
+// slash-separated path ("" is the top).
+func walkDirs(fsys fs.FS, fn func(rel string, info fs.FileInfo)) {
+	fs.WalkDir(fsys, ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if rel == "." {
+			rel = ""
+		}
+		fn(rel, info)
+		return nil
+	})
+}
@@ -0,0 +1,138 @@
+//go:build linux
+
+package library
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+// inotify watches every folder of the roots; new folders are added as they
+// appear.
+type inotify struct {
+	fd   int
+	file *os.File
+
+	mu   sync.Mutex
+	dirs map[int32]dirChange // Watch descriptor -> folder
+}
+
+// notifyDirs reports the folders of roots that change, using inotify.
+func notifyDirs(ctx context.Context, roots map[string]string) (<-chan dirChange, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	// A non-blocking descriptor goes through the runtime poller, so closing
+	// the file ends a pending Read.
+	w := &inotify{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), dirs: make(map[int32]dirChange)}
+	for root, dir := range roots {
+		if err := w.addTree(root, dir, ""); err != nil {
+			w.file.Close()
+			return nil, err
+		}
+	}
+
+	ch := make(chan dirChange)
+	go func() {
+		<-ctx.Done()
+		w.file.Close()
+	}()
+	go w.read(ctx, roots, ch)
+	return ch, nil
+}
+
+// addTree watches folder rel of root and everything below it. Running out
+// of watches fails; unreadable folders are skipped.
+func (w *inotify) addTree(root, dir, rel string) error {
+	var err error
+	walkDirs(os.DirFS(filepath.Join(dir, filepath.FromSlash(rel))), func(sub string, _ fs.FileInfo) {
+		if err != nil {
+			return
+		}
+		p := path.Join(rel, sub)
+		wd, aerr := syscall.InotifyAddWatch(w.fd, filepath.Join(dir, filepath.FromSlash(p)), inotifyMask)
+		if aerr == syscall.ENOSPC {
+			err = errors.New("inotify: out of watches (raise fs.inotify.max_user_watches)")
+			return
+		}
+		if aerr == nil {
+			w.mu.Lock()
+			w.dirs[int32(wd)] = dirChange{root: root, dir: p}
+			w.mu.Unlock()
+		}
+	})
+	return err
+}
+
+func (w *inotify) read(ctx context.Context, roots map[string]string, ch chan<- dirChange) {
+	send := func(c dirChange) bool {
+		select {
+		case ch <- c:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			size := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			name := string(bytes.TrimRight(buf[off+syscall.SizeofInotifyEvent:off+syscall.SizeofInotifyEvent+size], "\x00"))
+			off += syscall.SizeofInotifyEvent + size
+
+			if mask&syscall.IN_Q_OVERFLOW != 0 {
+				// Events were lost; refresh everything
+				for root := range roots {
+					if !send(dirChange{root: root, deep: true}) {
+						return
+					}
+				}
+				continue
+			}
+			w.mu.Lock()
+			c, ok := w.dirs[wd]
+			if mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, wd)
+			}
+			w.mu.Unlock()
+			if !ok || mask&syscall.IN_IGNORED != 0 {
+				continue
+			}
+
+			if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				// A folder moved in arrives with its content
+				sub := path.Join(c.dir, name)
+				w.addTree(c.root, roots[c.root], sub)
+				if !send(dirChange{root: c.root, dir: sub, deep: true}) {
+					return
+				}
+			}
+			if mask&syscall.IN_DELETE_SELF != 0 {
+				continue // The parent reports the removal
+			}
+			if !send(c) {
+				return
+			}
+		}
+	}
+}
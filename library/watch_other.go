@@ -0,0 +1,10 @@
+//go:build !linux
+
+package library
+
+import "context"
+
+// notifyDirs is only implemented with inotify; Watch polls instead.
+func notifyDirs(ctx context.Context, roots map[string]string) (<-chan dirChange, error) {
+	return nil, errNoNotify
+}
@@ -19,6 +19,11 @@
     const containerId = 'm3u8-caster-container';
     const CAST_API_URL = 'https://172.16.1.5/api/cast';
     const DEVICES_API_URL = 'https://172.16.1.5/api/devices';
+    const JOBS_API_URL = 'https://172.16.1.5/api/jobs/';
+    const SESSIONS_API_URL = 'https://172.16.1.5/api/sessions';
+    // Set when the agent requires API tokens
+    const API_TOKEN = '';
+    const AUTH_HEADERS = API_TOKEN ? { "Authorization": "Bearer " + API_TOKEN } : {};
 
     // UI Styles
     function addStyle(css) {
@@ -165,6 +170,7 @@
         GM_xmlhttpRequest({
             method: "GET",
             url: DEVICES_API_URL,
+            headers: AUTH_HEADERS,
             onload: function(response) {
                 if (refreshBtn) {
                     refreshBtn.disabled = false;
@@ -192,6 +198,7 @@
                             option.text = device.friendly_name;
                             select.add(option);
                         });
+                        markSessions(select);
                     } catch (e) {
                         console.error("Error parsing devices:", e);
                         select.innerHTML = '<option>Error parsing devices</option>';
@@ -212,6 +219,30 @@
         });
     }
 
+    // Mark devices that are playing something, and by whom if locked
+    function markSessions(select) {
+        GM_xmlhttpRequest({
+            method: "GET",
+            url: SESSIONS_API_URL,
+            headers: AUTH_HEADERS,
+            onload: function(response) {
+                if (response.status !== 200) return;
+                try {
+                    const sessions = JSON.parse(response.responseText);
+                    sessions.forEach(session => {
+                        const option = Array.from(select.options).find(o => o.value === session.device);
+                        if (!option) return;
+                        let label = ` \u25B6 ${session.title || session.url.split('?')[0].split('/').pop()}`;
+                        if (session.locked_by) label += ` (locked by ${session.locked_by})`;
+                        option.text += label;
+                    });
+                } catch (e) {
+                    console.error("Error parsing sessions:", e);
+                }
+            }
+        });
+    }
+
     // Navigation functions
     function prevVideo() {
         if (currentIndex > 0) {
@@ -340,6 +371,41 @@
         updateUI();
     }
 
+    // Poll an async cast job until it finishes
+    function pollJob(jobId, btn, attempts) {
+        attempts = attempts || 0;
+        GM_xmlhttpRequest({
+            method: "GET",
+            url: JOBS_API_URL + jobId,
+            headers: AUTH_HEADERS,
+            onload: function(response) {
+                const job = response.status === 200 ? JSON.parse(response.responseText) : null;
+                if (job && (job.state === 'pending' || job.state === 'running') && attempts < 60) {
+                    setTimeout(() => pollJob(jobId, btn, attempts + 1), 1000);
+                    return;
+                }
+
+                btn.disabled = false;
+                btn.setAttribute('data-state', 'result');
+                if (job && job.state === 'done') {
+                    btn.textContent = 'Casting Started!';
+                    btn.style.background = '#2E7D32'; // Dark Green
+                } else {
+                    btn.textContent = 'Failed';
+                    btn.style.background = '#F44336'; // Red
+                    showError(job ? (job.error || 'Cast timed out') : 'Status ' + response.status + ': ' + response.responseText);
+                }
+            },
+            onerror: function() {
+                btn.disabled = false;
+                btn.setAttribute('data-state', 'result');
+                btn.textContent = 'Error';
+                btn.style.background = '#F44336'; // Red
+                showError('Connection error');
+            }
+        });
+    }
+
     // Cast function
     function castVideo() {
         if (detectedUrls.length === 0) return;
@@ -366,9 +432,9 @@
         GM_xmlhttpRequest({
             method: "POST",
             url: CAST_API_URL,
-            headers: {
+            headers: Object.assign({
                 "Content-Type": "application/json"
-            },
+            }, AUTH_HEADERS),
             data: JSON.stringify({
                 url: detectedUrl,
                 usn: selectedUSN,
@@ -376,9 +442,17 @@
             }),
             onload: function(response) {
                 console.log("Cast response:", response.responseText);
+
+                if (response.status === 202) {
+                    // Cast runs asynchronously; poll the job for the result
+                    const job = JSON.parse(response.responseText);
+                    pollJob(job.id, btn);
+                    return;
+                }
+
                 btn.disabled = false; // Enable to allow click-to-restore
                 btn.setAttribute('data-state', 'result');
-                
+
                 if (response.status === 200) {
                     btn.textContent = 'Casting Started!';
                     btn.style.background = '#2E7D32'; // Dark Green
@@ -2,36 +2,501 @@ package main
 
 import (
 	"dlna/api"
+	"dlna/config"
 	"dlna/dlna"
+	"dlna/renderer"
+	"dlna/resolver"
+	"dlna/share"
+	"dlna/store"
+	"dlna/stream"
+	"dlna/systemd"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mockrenderer" {
+		mockRenderer(os.Args[2:])
+		return
+	}
 	addr := flag.String("h", ":8072", "HTTP server address")
 	udpIP := flag.String("u", "0.0.0.0", "UDP IP to bind to (default: 0.0.0.0)")
 	seconds := flag.Int("s", 10, "SSDP search interval in seconds")
-	player := flag.String("p", "UnPlay", "Default player pattern (USN or FriendlyName match)")
+	player := flag.String("p", "UnPlay", "Default player patterns, separated by ; (USN, FriendlyName or model match, or regex:... or glob:...)")
 	showTime := flag.Bool("t", false, "Enable log timestamps")
+	configPath := flag.String("c", "", "Path to JSON config file (optional)")
+	ffmpeg := flag.String("f", "ffmpeg", "Path to ffmpeg, for screen and audio casting")
+	baseURL := flag.String("b", "", "Base URL renderers use to reach this agent (default: detected per renderer)")
+	dataDir := flag.String("d", "", "Directory for persisted state such as cast history (default: in-memory only)")
+	debugSSDP := flag.String("debug-ssdp", "", "Append every received SSDP packet to this file, for debugging discovery")
+	debugSOAP := flag.Bool("debug-soap", false, "Trace every SOAP request and response, see GET /api/debug/soap")
+	replaySSDP := flag.String("replay-ssdp", "", "Replay a -debug-ssdp capture, print the devices found and exit")
 	flag.Parse()
 
 	if !*showTime {
 		log.SetFlags(0)
 	}
 
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	if _, err := api.ParseDevicePatterns(*player); err != nil {
+		log.Fatalf("Invalid -p: %v", err)
+	}
+
 	discovery := dlna.NewDiscoveryService(*udpIP, time.Duration(*seconds)*time.Second)
+
+	st, err := store.OpenBackend(cfg.Storage, *dataDir)
+	if err != nil {
+		log.Fatalf("Failed to open state store: %v", err)
+	}
+
+	handler := api.NewHandler(discovery, *player, st)
+	handler.SetFFmpeg(*ffmpeg)
+	if *dataDir != "" {
+		handler.SetThumbnailCache(filepath.Join(*dataDir, "thumbs"))
+	}
+	handler.SetBaseURL(*baseURL, *addr)
+	if err := applyConfig(cfg, discovery, handler); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if *replaySSDP != "" {
+		replay(discovery, *replaySSDP)
+		return
+	}
+	if *debugSSDP != "" {
+		f, err := os.OpenFile(*debugSSDP, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Fatalf("Failed to open SSDP capture: %v", err)
+		}
+		discovery.SetCapture(f)
+		log.Printf("Recording SSDP packets to %s", *debugSSDP)
+	}
+	handler.RestoreDevices()
+	if *debugSOAP {
+		dlna.SetSOAPTrace(true)
+		log.Printf("Tracing SOAP requests")
+	}
 	discovery.Start()
 
-	handler := api.NewHandler(discovery, *player)
+	reload := reloader(*configPath, discovery, handler)
+	handler.SetReloader(reload)
+
+	http.HandleFunc("GET /api/devices", handler.ListDevicesHandler)
+	http.HandleFunc("POST /api/devices/manual", handler.AddManualDeviceHandler)
+	http.HandleFunc("GET /api/devices/snapshot", handler.ExportDevicesHandler)
+	http.HandleFunc("POST /api/devices/snapshot", handler.ImportDevicesHandler)
+	http.HandleFunc("GET /api/devices/{usn}/settings", handler.GetDeviceSettingsHandler)
+	http.HandleFunc("PUT /api/devices/{usn}/settings", handler.PutDeviceSettingsHandler)
+	http.HandleFunc("POST /api/devices/{usn}/power", handler.PowerHandler)
+	http.HandleFunc("POST /api/devices/{usn}/input", handler.InputHandler)
+	http.HandleFunc("POST /api/device/default", handler.SetDefaultDeviceHandler)
+	http.HandleFunc("GET /api/groups", handler.ListGroupsHandler)
+	http.HandleFunc("GET /api/profiles", handler.ListProfilesHandler)
+	http.HandleFunc("GET /api/transcoding/encoders", handler.EncodersHandler)
+	http.HandleFunc("POST /api/cast", handler.CastHandler)
+	http.HandleFunc("POST /api/cast/from-server", handler.CastFromServerHandler)
+	http.HandleFunc("POST /api/smartcast", handler.SmartCastHandler)
+	http.HandleFunc("GET /api/jobs/{id}", handler.JobHandler)
+	http.HandleFunc("GET /api/history", handler.HistoryHandler)
+	http.HandleFunc("POST /api/resume", handler.ResumeHandler)
+	http.HandleFunc("POST /api/next", handler.NextHandler)
+	http.HandleFunc("POST /api/previous", handler.PreviousHandler)
+	http.HandleFunc("POST /api/seek", handler.SeekHandler)
+	http.HandleFunc("GET /api/playmode", handler.GetPlayModeHandler)
+	http.HandleFunc("PUT /api/playmode", handler.SetPlayModeHandler)
+	http.HandleFunc("GET /api/status", handler.StatusHandler)
+	http.HandleFunc("GET /api/audit", handler.AuditHandler)
+	http.HandleFunc("GET /api/keys", handler.ListKeysHandler)
+	http.HandleFunc("POST /api/keys", handler.CreateKeyHandler)
+	http.HandleFunc("DELETE /api/keys/{id}", handler.RevokeKeyHandler)
+	http.HandleFunc("GET /api/debug/soap", handler.GetSOAPTraceHandler)
+	http.HandleFunc("PUT /api/debug/soap", handler.SetSOAPTraceHandler)
+	http.HandleFunc("DELETE /api/debug/soap", handler.ClearSOAPTraceHandler)
+	http.HandleFunc("GET /api/schedules", handler.ListSchedulesHandler)
+	http.HandleFunc("POST /api/schedules", handler.CreateScheduleHandler)
+	http.HandleFunc("GET /api/schedules/{id}", handler.GetScheduleHandler)
+	http.HandleFunc("PUT /api/schedules/{id}", handler.UpdateScheduleHandler)
+	http.HandleFunc("DELETE /api/schedules/{id}", handler.DeleteScheduleHandler)
+	http.HandleFunc("POST /api/alarms", handler.CreateAlarmHandler)
+	http.HandleFunc("GET /api/presets", handler.ListPresetsHandler)
+	http.HandleFunc("POST /api/presets", handler.SavePresetHandler)
+	http.HandleFunc("DELETE /api/presets/{name}", handler.DeletePresetHandler)
+	http.HandleFunc("POST /api/presets/{name}/play", handler.PlayPresetHandler)
+	http.HandleFunc("GET /api/timer", handler.ListTimersHandler)
+	http.HandleFunc("POST /api/timer", handler.SetTimerHandler)
+	http.HandleFunc("DELETE /api/timer", handler.CancelTimerHandler)
+	http.HandleFunc("GET /api/volume", handler.GetVolumeHandler)
+	http.HandleFunc("POST /api/volume", handler.SetVolumeHandler)
+	http.HandleFunc("POST /api/volume/fade", handler.FadeVolumeHandler)
+	http.HandleFunc("DELETE /api/volume/fade", handler.CancelFadeHandler)
+	http.HandleFunc("POST /api/screen", handler.StartScreenHandler)
+	http.HandleFunc("DELETE /api/screen", handler.StopScreenHandler)
+	http.HandleFunc("POST /api/audio", handler.StartAudioHandler)
+	http.HandleFunc("DELETE /api/audio", handler.StopAudioHandler)
+	http.HandleFunc("GET /api/frame", handler.ListFramesHandler)
+	http.HandleFunc("POST /api/frame", handler.StartFrameHandler)
+	http.HandleFunc("DELETE /api/frame", handler.StopFrameHandler)
+	http.HandleFunc("GET /api/tv/channels", handler.ListTVChannelsHandler)
+	http.HandleFunc("POST /api/tv/cast", handler.CastTVHandler)
+	http.HandleFunc("POST /api/announce", handler.AnnounceHandler)
+	http.HandleFunc("GET /announce/{id}", handler.AnnouncementHandler)
+	http.HandleFunc("GET /api/interrupt", handler.ListInterruptionsHandler)
+	http.HandleFunc("POST /api/interrupt", handler.InterruptHandler)
+	http.HandleFunc("GET /api/chimes", handler.ListChimesHandler)
+	http.HandleFunc("POST /api/chime", handler.ChimeHandler)
+	http.HandleFunc("GET /chimes/{name}", handler.ChimeFileHandler)
+	http.HandleFunc("GET /stream/{id}", handler.StreamHandler)
+	http.HandleFunc("GET /torrent/{hash}/{path...}", handler.TorrentHandler)
+	http.HandleFunc("GET /api/torrents", handler.ListTorrentsHandler)
+	http.HandleFunc("DELETE /api/torrents/{hash}", handler.DropTorrentHandler)
+	http.HandleFunc("GET /media/{root}/{path...}", handler.MediaHandler)
+	http.HandleFunc("GET /api/library", handler.LibraryHandler)
+	http.HandleFunc("POST /api/library/scan", handler.ScanLibraryHandler)
+	http.HandleFunc("GET /api/library/search", handler.SearchLibraryHandler)
+	http.HandleFunc("GET /api/library/browse", handler.BrowseLibraryHandler)
+	http.HandleFunc("GET /api/library/cover", handler.LibraryCoverHandler)
+	http.HandleFunc("POST /api/library/cast", handler.CastLibraryHandler)
+	http.HandleFunc("GET /api/library/{id}/tracks", handler.LibraryTracksHandler)
+	http.HandleFunc("GET /thumb/{id}", handler.ThumbnailHandler)
+	http.HandleFunc("POST /api/download", handler.StartDownloadHandler)
+	http.HandleFunc("GET /api/downloads", handler.ListDownloadsHandler)
+	http.HandleFunc("GET /api/downloads/{id}", handler.GetDownloadHandler)
+	http.HandleFunc("DELETE /api/downloads/{id}", handler.CancelDownloadHandler)
+	http.HandleFunc("GET /api/sessions", handler.ListSessionsHandler)
+	http.HandleFunc("DELETE /api/sessions", handler.StopAllSessionsHandler)
+	http.HandleFunc("GET /api/sessions/{id}", handler.GetSessionHandler)
+	http.HandleFunc("DELETE /api/sessions/{id}", handler.StopSessionHandler)
+	http.HandleFunc("POST /api/sessions/{id}/timer", handler.SessionTimerHandler)
+	http.HandleFunc("PUT /api/sessions/{id}/lock", handler.LockSessionHandler)
+	http.HandleFunc("DELETE /api/sessions/{id}/lock", handler.UnlockSessionHandler)
+	http.HandleFunc("GET /api/config", handler.GetConfigHandler)
+	http.HandleFunc("PATCH /api/config", handler.PatchConfigHandler)
+	http.HandleFunc("POST /api/reload", handler.ReloadHandler)
+	http.HandleFunc("GET /api/ws", handler.EventsHandler)
+	http.HandleFunc("GET /api/servers", handler.ListServersHandler)
+	http.HandleFunc("GET /api/servers/{usn}/browse", handler.BrowseServerHandler)
+
+	var advertisers []*dlna.Advertiser
+	if rc := cfg.Renderer; rc != nil && len(rc.Command) > 0 {
+		advertisers = append(advertisers, startRenderer(rc, *udpIP, *addr, *baseURL, discovery.Tuning().HopLimit))
+	}
+
+	// SIGHUP reloads the config file. On shutdown, say ssdp:byebye so
+	// control points drop us immediately.
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				systemd.Notify("RELOADING=1")
+				if err := reload(); err != nil {
+					log.Printf("Config reload failed: %v", err)
+				}
+				systemd.Notify("READY=1")
+				continue
+			}
+			systemd.Notify("STOPPING=1")
+			for _, a := range advertisers {
+				a.Stop()
+			}
+			os.Exit(0)
+		}
+	}()
 
-	http.HandleFunc("/api/devices", handler.ListDevicesHandler)
-	http.HandleFunc("/api/device/default", handler.SetDefaultDeviceHandler)
-	http.HandleFunc("/api/cast", handler.CastHandler)
+	// Under systemd socket activation the HTTP socket is passed in. -h
+	// should still name its port, which URLs handed to renderers use.
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		log.Fatalf("Socket activation failed: %v", err)
+	}
+	var ln net.Listener
+	if len(listeners) > 0 {
+		ln = listeners[0]
+		log.Printf("Using socket-activated listener %s", ln.Addr())
+	} else if ln, err = net.Listen("tcp", *addr); err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Starting DLNA service on %s with UDP IP %s", *addr, *udpIP)
-	if err := http.ListenAndServe(*addr, nil); err != nil {
+	log.Printf("Starting DLNA service on %s with UDP IP %s", ln.Addr(), *udpIP)
+	systemd.Notify("READY=1")
+	// Discovery takes its lock on every SSDP packet, so a wedged service
+	// stops the pings and systemd restarts it.
+	go systemd.Watchdog(func() bool {
+		discovery.GetDevices()
+		return true
+	})
+	if err := http.Serve(ln, handler.Proxied(api.Versioned(handler.Limit(handler.Authenticate(handler.Audit(http.DefaultServeMux)))))); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// applyConfig applies the parts of cfg that can change at runtime: discovery
+// settings and filters, resolvers, hooks and notifications, TV adapters and
+// tuners, API tokens, limits and the reverse proxy, agent URLs, media roots
+// and how they are watched, and torrent streaming. Everything is validated
+// before anything is applied, so a bad reload leaves the running config
+// intact. Static devices are only ever added; removing one takes a
+// restart.
+func applyConfig(cfg *config.Config, discovery *dlna.DiscoveryService, handler *api.Handler) error {
+	tuning, err := cfg.Discovery.Tuning()
+	if err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+
+	searchTargets, err := dlna.ParseSearchTargets(cfg.UnicastSearch)
+	if err != nil {
+		return fmt.Errorf("unicast_search: %w", err)
+	}
+
+	sweep, err := cfg.Sweep.Parse()
+	if err != nil {
+		return fmt.Errorf("sweep: %w", err)
+	}
+
+	libraryWatch, err := cfg.Library.Parse()
+	if err != nil {
+		return fmt.Errorf("library: %w", err)
+	}
+
+	torrentCfg, err := cfg.Torrent.Parse()
+	if err != nil {
+		return fmt.Errorf("torrent: %w", err)
+	}
+
+	for name, root := range cfg.MediaRoots {
+		if share.IsShare(root) {
+			if err := share.Check(root); err != nil {
+				return fmt.Errorf("media root %s: %w", name, err)
+			}
+		}
+	}
+	shareOpts := make(map[string]share.Options, len(cfg.Shares))
+	for host, s := range cfg.Shares {
+		if shareOpts[host], err = s.Parse(); err != nil {
+			return fmt.Errorf("shares: %s: %w", host, err)
+		}
+	}
+
+	hooks, err := api.ParseHooks(cfg.Hooks)
+	if err != nil {
+		return err
+	}
+
+	notifications, err := api.ParseNotifications(cfg.Notifications)
+	if err != nil {
+		return err
+	}
+
+	tvs, err := api.ParseTVs(cfg.TVs)
+	if err != nil {
+		return err
+	}
+
+	speech, err := cfg.TTS.Parse()
+	if err != nil {
+		return fmt.Errorf("tts: %w", err)
+	}
+
+	tokens, err := api.ParseTokens(cfg.Tokens)
+	if err != nil {
+		return fmt.Errorf("tokens: %w", err)
+	}
+
+	proxy, err := api.ParseProxy(cfg.Proxy)
+	if err != nil {
+		return fmt.Errorf("proxy: %w", err)
+	}
+
+	var patterns []api.DevicePattern
+	for _, s := range cfg.DefaultPlayer {
+		p, err := api.ParseDevicePattern(s)
+		if err != nil {
+			return fmt.Errorf("default_player: %w", err)
+		}
+		patterns = append(patterns, p)
+	}
+
+	groups, err := api.ParseGroups(cfg.Groups)
+	if err != nil {
+		return fmt.Errorf("groups: %w", err)
+	}
+
+	profiles, err := api.ParseProfiles(cfg.Profiles)
+	if err != nil {
+		return fmt.Errorf("profiles: %w", err)
+	}
+
+	hwAccel, err := stream.ParseHWAccel(cfg.Transcoding.HWAccel)
+	if err != nil {
+		return fmt.Errorf("transcoding: %w", err)
+	}
+
+	agentURLs, err := api.ParseAgentURLs(cfg.AgentURLs)
+	if err != nil {
+		return fmt.Errorf("agent_urls: %w", err)
+	}
+
+	var resolvers resolver.Chain
+	for _, rc := range cfg.Resolvers {
+		var timeout time.Duration
+		if rc.Timeout != "" {
+			if timeout, err = time.ParseDuration(rc.Timeout); err != nil {
+				return fmt.Errorf("invalid timeout for resolver %s: %w", rc.Name, err)
+			}
+		}
+		r, err := resolver.NewCommand(rc.Name, rc.Match, rc.Command, timeout)
+		if err != nil {
+			return fmt.Errorf("invalid resolver: %w", err)
+		}
+		resolvers = append(resolvers, r)
+	}
+
+	discovery.SetTuning(tuning)
+	deviceTypes := cfg.DeviceTypes
+	if deviceTypes == nil {
+		deviceTypes = []string{dlna.DeviceTypeMediaRenderer}
+	}
+	discovery.SetDeviceTypes(deviceTypes)
+	discovery.SetDeviceFilter(cfg.DeviceFilter)
+	discovery.SetSearchTargets(searchTargets)
+	discovery.SetSweep(sweep)
+	for usn, mac := range cfg.MACAddresses {
+		discovery.SetMAC(usn, mac)
+	}
+	for _, sd := range cfg.StaticDevices {
+		if sd.MAC != "" {
+			discovery.SetMAC(sd.Location, sd.MAC)
+		}
+		discovery.AddStaticDevice(sd.Name, sd.Location)
+	}
+
+	handler.SetResolvers(resolvers)
+	handler.SetLimits(cfg.Limits)
+	handler.SetTokens(tokens)
+	handler.SetProxy(proxy)
+	handler.SetAgentURLs(agentURLs)
+	handler.SetDefaultPatterns(patterns)
+	handler.SetFailover(cfg.Failover)
+	handler.SetGroups(groups)
+	handler.SetProfiles(profiles)
+	handler.SetTranscoding(hwAccel, cfg.Transcoding.Device)
+	handler.SetHooks(hooks)
+	handler.SetNotifications(notifications)
+	handler.SetTVs(tvs)
+	handler.SetTuners(cfg.HDHomeRun)
+	handler.SetTTS(speech, cfg.TTS.Lang)
+	handler.SetLibraryWatch(libraryWatch)
+	handler.SetTorrentConfig(torrentCfg, int64(cfg.Torrent.BufferMB)<<20)
+	handler.SetShareOptions(shareOpts)
+	handler.SetMediaRoots(cfg.MediaRoots)
+	return nil
+}
+
+// reloader returns the function that re-reads the config file at path and
+// applies it, for SIGHUP and POST /api/reload.
+func reloader(path string, discovery *dlna.DiscoveryService, handler *api.Handler) func() error {
+	return func() error {
+		cfg, err := config.Load(path)
+		if err != nil {
+			return err
+		}
+		if err := applyConfig(cfg, discovery, handler); err != nil {
+			return err
+		}
+		log.Printf("Config reloaded")
+		return nil
+	}
+}
+
+// replay feeds an SSDP capture through discovery, with the config's device
+// types and filters applied, and prints the resulting devices as JSON.
+func replay(discovery *dlna.DiscoveryService, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open SSDP capture: %v", err)
+	}
+	defer f.Close()
+	n, err := discovery.Replay(f, false)
+	if err != nil {
+		log.Fatalf("Replay failed after %d packets: %v", n, err)
+	}
+	log.Printf("Replayed %d packets", n)
+
+	devices := append(discovery.GetDevices(), discovery.GetServers()...)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(devices)
+}
+
+// startRenderer registers the emulated MediaRenderer's routes and
+// advertises it over SSDP.
+func startRenderer(rc *config.Renderer, udpIP, addr, baseURL string, hopLimit int) *dlna.Advertiser {
+	name := rc.Name
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	rend := renderer.New(name, rc.Command)
+	rend.Register(http.DefaultServeMux)
+	adv := advertiseRenderer(rend, udpIP, addr, baseURL, hopLimit)
+	log.Printf("Renderer emulation enabled as %q (%s)", name, rend.UUID)
+	return adv
+}
+
+// advertiseRenderer announces rend, served at addr (or baseURL), over SSDP.
+func advertiseRenderer(rend *renderer.Renderer, udpIP, addr, baseURL string, hopLimit int) *dlna.Advertiser {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "" {
+		port = "80"
+	}
+	location := func(ip net.IP) string {
+		if baseURL != "" {
+			return strings.TrimRight(baseURL, "/") + "/renderer/description.xml"
+		}
+		return "http://" + net.JoinHostPort(ip.String(), port) + "/renderer/description.xml"
+	}
+	adv := dlna.NewAdvertiser(udpIP, rend.UUID, dlna.DeviceTypeMediaRenderer, renderer.ServiceTypes(), location)
+	adv.HopLimit = hopLimit
+	adv.Start()
+	return adv
+}
+
+// mockRenderer runs `dlnagent mockrenderer`: a pretend TV that logs every
+// action it receives, to check discovery and casting without a real one.
+func mockRenderer(args []string) {
+	fs := flag.NewFlagSet("mockrenderer", flag.ExitOnError)
+	name := fs.String("name", "dlnagent mock renderer", "Friendly name to announce")
+	addr := fs.String("h", ":8073", "HTTP server address")
+	udpIP := fs.String("u", "0.0.0.0", "UDP IP to bind to")
+	fs.Parse(args)
+
+	rend := renderer.NewMock(*name)
+	mux := http.NewServeMux()
+	rend.Register(mux)
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	adv := advertiseRenderer(rend, *udpIP, *addr, "", 0)
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		adv.Stop()
+		os.Exit(0)
+	}()
+	log.Printf("Mock renderer %q (%s) listening on %s; cast to it from the agent or any control point", *name, rend.UUID, ln.Addr())
+	log.Fatal(http.Serve(ln, mux))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"dlna/api"
+	"dlna/dlna"
+	"dlna/store"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(cfg string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(cfg), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, _ := store.Open("")
+	discovery := dlna.NewDiscoveryService("", time.Second)
+	handler := api.NewHandler(discovery, "", st)
+	handler.SetReloader(reloader(path, discovery, handler))
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/reload", handler.ReloadHandler)
+	mux.HandleFunc("GET /api/devices", handler.ListDevicesHandler)
+	server := handler.Authenticate(mux)
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+	const token = "admin-secret-0123"
+
+	// A reload applies the discovery tuning and the tokens
+	write(`{"discovery": {"cleanup_interval": "2m", "offline_retention": "48h"}, "tokens": [{"name": "admin", "token": "` + token + `"}]}`)
+	w := request("POST", "/api/reload", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", w.Code, w.Body)
+	}
+	var got struct {
+		Discovery struct {
+			CleanupInterval  string `json:"cleanup_interval"`
+			OfflineRetention string `json:"offline_retention"`
+		} `json:"discovery"`
+	}
+	json.NewDecoder(w.Body).Decode(&got)
+	if got.Discovery.CleanupInterval != "2m0s" || got.Discovery.OfflineRetention != "48h0m0s" {
+		t.Errorf("Expected the reloaded discovery settings, got %+v", got.Discovery)
+	}
+	if tuning := discovery.Tuning(); tuning.CleanupInterval != 2*time.Minute {
+		t.Errorf("Expected the tuning to be applied, got %+v", tuning)
+	}
+	if w := request("GET", "/api/devices", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the reloaded tokens to be required, got %d", w.Code)
+	}
+	if w := request("GET", "/api/devices", token); w.Code != http.StatusOK {
+		t.Errorf("Expected the reloaded token to work, got %d", w.Code)
+	}
+
+	// An invalid config is rejected as a whole, even the valid parts
+	for name, cfg := range map[string]string{
+		"tuning":  `{"discovery": {"cleanup_interval": "1ms"}, "tokens": [{"token": "other-secret-0123"}]}`,
+		"token":   `{"discovery": {"cleanup_interval": "5m"}, "tokens": [{"token": "short"}]}`,
+		"profile": `{"discovery": {"cleanup_interval": "5m"}, "profiles": {"tv": {"video_codec": "vp9000"}}}`,
+		"json":    `{"discovery": `,
+	} {
+		write(cfg)
+		if w := request("POST", "/api/reload", token); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d %s", name, w.Code, w.Body)
+		}
+		if tuning := discovery.Tuning(); tuning.CleanupInterval != 2*time.Minute {
+			t.Errorf("%s: expected the tuning to be kept, got %+v", name, tuning)
+		}
+		if w := request("GET", "/api/devices", token); w.Code != http.StatusOK {
+			t.Errorf("%s: expected the running token to be kept, got %d", name, w.Code)
+		}
+	}
+
+	// A missing file fails the reload too
+	os.Remove(path)
+	if w := request("POST", "/api/reload", token); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a missing config, got %d", w.Code)
+	}
+}
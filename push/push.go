@@ -0,0 +1,114 @@
+// Package push sends short notifications to phones through ntfy, Telegram
+// or Pushover.
+package push
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Message is one notification.
+type Message struct {
+	Title string
+	Body  string
+}
+
+// Notifier delivers messages to one service.
+type Notifier interface {
+	Name() string
+	Send(ctx context.Context, m Message) error
+}
+
+// Ntfy publishes to an ntfy topic URL such as https://ntfy.sh/living-room.
+type Ntfy struct {
+	URL   string
+	Token string // Optional access token
+}
+
+func (n *Ntfy) Name() string { return "ntfy" }
+
+func (n *Ntfy) Send(ctx context.Context, m Message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, strings.NewReader(m.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", m.Title)
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	return do(req)
+}
+
+// TelegramAPI is the Bot API base URL.
+const TelegramAPI = "https://api.telegram.org"
+
+// Telegram sends messages from a bot to a chat.
+type Telegram struct {
+	Token  string // Bot token from @BotFather
+	ChatID string
+	API    string // Default TelegramAPI
+}
+
+func (t *Telegram) Name() string { return "telegram" }
+
+func (t *Telegram) Send(ctx context.Context, m Message) error {
+	api := t.API
+	if api == "" {
+		api = TelegramAPI
+	}
+	return postForm(ctx, api+"/bot"+t.Token+"/sendMessage", url.Values{
+		"chat_id": {t.ChatID},
+		"text":    {m.Title + "\n" + m.Body},
+	})
+}
+
+// PushoverAPI is the Pushover messages endpoint.
+const PushoverAPI = "https://api.pushover.net/1/messages.json"
+
+// Pushover sends messages with an application token to a user or group key.
+type Pushover struct {
+	Token string
+	User  string
+	API   string // Default PushoverAPI
+}
+
+func (p *Pushover) Name() string { return "pushover" }
+
+func (p *Pushover) Send(ctx context.Context, m Message) error {
+	api := p.API
+	if api == "" {
+		api = PushoverAPI
+	}
+	return postForm(ctx, api, url.Values{
+		"token":   {p.Token},
+		"user":    {p.User},
+		"title":   {m.Title},
+		"message": {m.Body},
+	})
+}
+
+func postForm(ctx context.Context, endpoint string, form url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return do(req)
+}
+
+func do(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
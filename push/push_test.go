@@ -0,0 +1,51 @@
+package push
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	var got *http.Request
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got, body = r, string(b)
+		r.ParseForm()
+	}))
+	defer srv.Close()
+
+	m := Message{Title: "Playback finished", Body: "Radio on Kitchen"}
+
+	if err := (&Ntfy{URL: srv.URL + "/kitchen"}).Send(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.Path != "/kitchen" || got.Header.Get("Title") != m.Title || body != m.Body {
+		t.Errorf("Unexpected ntfy request %s %v %q", got.URL, got.Header, body)
+	}
+
+	if err := (&Telegram{Token: "123:abc", ChatID: "42", API: srv.URL}).Send(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.Path != "/bot123:abc/sendMessage" || body != "chat_id=42&text=Playback+finished%0ARadio+on+Kitchen" {
+		t.Errorf("Unexpected Telegram request %s %q", got.URL, body)
+	}
+
+	if err := (&Pushover{Token: "app", User: "me", API: srv.URL}).Send(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if body != "message=Radio+on+Kitchen&title=Playback+finished&token=app&user=me" {
+		t.Errorf("Unexpected Pushover request %q", body)
+	}
+
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+	}))
+	defer fail.Close()
+	if err := (&Pushover{API: fail.URL}).Send(context.Background(), m); err == nil {
+		t.Error("Expected an error for a rejected message")
+	}
+}
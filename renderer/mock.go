@@ -0,0 +1,78 @@
+package renderer
+
+import (
+	"crypto/sha1"
+	"dlna/didl"
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"time"
+)
+
+// Call is a SOAP action received by a mock renderer.
+type Call struct {
+	Time    time.Time         `json:"time"`
+	Service string            `json:"service"` // AVTransport, RenderingControl or ConnectionManager
+	Action  string            `json:"action"`
+	Args    map[string]string `json:"args"`
+}
+
+// NewMock creates a renderer that plays nothing: it accepts casts like a
+// TV would, reports itself playing until the track's duration (from the
+// DIDL-Lite metadata) has elapsed, and records every action it receives.
+// It is used by tests and by `dlnagent mockrenderer` to check a setup
+// without a real TV.
+func NewMock(name string) *Renderer {
+	sum := sha1.Sum([]byte("mock/" + name))
+	uuid := fmt.Sprintf("uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+	return &Renderer{Name: name, UUID: uuid, state: stateNoMedia, volume: 100, playMode: "NORMAL"}
+}
+
+// Calls returns the actions received so far, oldest first.
+func (r *Renderer) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+// Finish ends the current track as if it had played to the end.
+func (r *Renderer) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state == statePlaying {
+		r.stopLocked()
+	}
+}
+
+func (r *Renderer) record(service, action string, args map[string]string) {
+	switch {
+	case strings.HasPrefix(action, "Get"):
+		// Control points poll; only changes are logged
+	case args["CurrentURI"] != "":
+		log.Printf("Mock renderer: %s %s", action, args["CurrentURI"])
+	default:
+		log.Printf("Mock renderer: %s", action)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, Call{Time: time.Now(), Service: service, Action: action, Args: maps.Clone(args)})
+}
+
+// mockPlayLocked starts the pretend playback of the current URI.
+func (r *Renderer) mockPlayLocked() {
+	r.state = statePlaying
+	r.started = time.Now()
+	if d, err := didl.ParseDuration(r.durationLocked()); err == nil && d > 0 {
+		var end *time.Timer
+		end = time.AfterFunc(d, func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.end == end {
+				r.end = nil
+				r.state = stateStopped
+			}
+		})
+		r.end = end
+	}
+}
@@ -0,0 +1,339 @@
+// Package renderer emulates a UPnP MediaRenderer, so phone apps such as
+// BubbleUPnP can cast to the agent. Media is handed to a local player
+// command (e.g. mpv).
+package renderer
+
+import (
+	"crypto/sha1"
+	"dlna/didl"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport states reported by GetTransportInfo
+const (
+	stateNoMedia = "NO_MEDIA_PRESENT"
+	stateStopped = "STOPPED"
+	statePlaying = "PLAYING"
+)
+
+// sinkProtocols is what GetProtocolInfo advertises; the player decides what
+// actually works.
+const sinkProtocols = "http-get:*:video/*:*,http-get:*:audio/*:*,http-get:*:image/*:*,http-get:*:application/vnd.apple.mpegurl:*,http-get:*:application/x-mpegURL:*"
+
+// Renderer is an emulated MediaRenderer driving a local player.
+type Renderer struct {
+	Name string
+	UUID string // uuid:...
+
+	command []string // nil for a mock, see NewMock
+
+	mu       sync.Mutex
+	uri      string
+	metadata string
+	state    string
+	cmd      *exec.Cmd
+	started  time.Time
+	volume   int
+	mute     bool
+	playMode string
+	calls    []Call      // Mock only
+	end      *time.Timer // Mock only: the track ending
+}
+
+// New creates a renderer named name that plays with command, where "{url}"
+// is replaced by the media URL (or the URL is appended). The UUID is
+// derived from the host and name so it is stable across restarts.
+func New(name string, command []string) *Renderer {
+	host, _ := os.Hostname()
+	sum := sha1.Sum([]byte(host + "/" + name))
+	uuid := fmt.Sprintf("uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+	return &Renderer{Name: name, UUID: uuid, command: command, state: stateNoMedia, volume: 100, playMode: "NORMAL"}
+}
+
+// Register adds the renderer's routes under /renderer/ to mux.
+func (r *Renderer) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /renderer/description.xml", r.DescriptionHandler)
+	mux.HandleFunc("GET /renderer/{service}/scpd.xml", r.SCPDHandler)
+	mux.HandleFunc("POST /renderer/{service}/control", r.ControlHandler)
+	mux.HandleFunc("/renderer/{service}/event", r.EventHandler)
+}
+
+// ServiceTypes lists the emulated services, for SSDP advertisement.
+func ServiceTypes() []string {
+	types := make([]string, len(services))
+	for i, s := range services {
+		types[i] = s.typ
+	}
+	return types
+}
+
+// DescriptionHandler serves the device description at
+// /renderer/description.xml.
+func (r *Renderer) DescriptionHandler(w http.ResponseWriter, req *http.Request) {
+	type xmlService struct {
+		ServiceType string `xml:"serviceType"`
+		ServiceID   string `xml:"serviceId"`
+		SCPDURL     string `xml:"SCPDURL"`
+		ControlURL  string `xml:"controlURL"`
+		EventSubURL string `xml:"eventSubURL"`
+	}
+	var doc struct {
+		XMLName      xml.Name     `xml:"urn:schemas-upnp-org:device-1-0 root"`
+		Major        int          `xml:"specVersion>major"`
+		Minor        int          `xml:"specVersion>minor"`
+		DeviceType   string       `xml:"device>deviceType"`
+		FriendlyName string       `xml:"device>friendlyName"`
+		Manufacturer string       `xml:"device>manufacturer"`
+		ModelName    string       `xml:"device>modelName"`
+		UDN          string       `xml:"device>UDN"`
+		Services     []xmlService `xml:"device>serviceList>service"`
+	}
+	doc.Major = 1
+	doc.DeviceType = "urn:schemas-upnp-org:device:MediaRenderer:1"
+	doc.FriendlyName = r.Name
+	doc.Manufacturer = "dlnagent"
+	doc.ModelName = "dlnagent renderer"
+	if r.command == nil {
+		doc.ModelName = "dlnagent mock renderer"
+	}
+	doc.UDN = r.UUID
+	for _, s := range services {
+		doc.Services = append(doc.Services, xmlService{
+			ServiceType: s.typ,
+			ServiceID:   s.id,
+			SCPDURL:     "/renderer/" + s.path + "/scpd.xml",
+			ControlURL:  "/renderer/" + s.path + "/control",
+			// Eventing is not implemented; the handler answers 501
+			EventSubURL: "/renderer/" + s.path + "/event",
+		})
+	}
+
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(doc)
+}
+
+// SCPDHandler serves /renderer/{service}/scpd.xml.
+func (r *Renderer) SCPDHandler(w http.ResponseWriter, req *http.Request) {
+	s := serviceByPath(req.PathValue("service"))
+	if s == nil {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Write(s.scpd())
+}
+
+// EventHandler rejects GENA subscriptions; control points fall back to
+// polling.
+func (r *Renderer) EventHandler(w http.ResponseWriter, req *http.Request) {
+	http.Error(w, "Eventing not supported", http.StatusNotImplemented)
+}
+
+// ControlHandler dispatches SOAP actions posted to
+// /renderer/{service}/control.
+func (r *Renderer) ControlHandler(w http.ResponseWriter, req *http.Request) {
+	s := serviceByPath(req.PathValue("service"))
+	if s == nil {
+		http.NotFound(w, req)
+		return
+	}
+	name, args, err := readAction(req)
+	if err != nil {
+		writeFault(w, 402, "Invalid Args")
+		return
+	}
+	a := s.action(name)
+	if a == nil {
+		writeFault(w, 401, "Invalid Action")
+		return
+	}
+
+	if r.command == nil {
+		r.record(s.path, name, args)
+	}
+	out, code := r.invoke(s.typ, name, args)
+	if code != 0 {
+		writeFault(w, code, faultDescriptions[code])
+		return
+	}
+	writeResponse(w, s.typ, a, out)
+}
+
+// invoke runs an action and returns its output arguments, or a UPnP error
+// code.
+func (r *Renderer) invoke(serviceType, name string, args map[string]string) (map[string]string, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch name {
+	case "SetAVTransportURI":
+		r.uri = args["CurrentURI"]
+		r.metadata = args["CurrentURIMetaData"]
+		if r.state == statePlaying {
+			return nil, r.playLocked()
+		}
+		r.stopLocked()
+		return nil, 0
+	case "Play":
+		if r.uri == "" {
+			return nil, 701 // Transition not available
+		}
+		return nil, r.playLocked()
+	case "Stop":
+		r.stopLocked()
+		return nil, 0
+	case "GetTransportInfo":
+		return map[string]string{"CurrentTransportState": r.state, "CurrentTransportStatus": "OK", "CurrentSpeed": "1"}, 0
+	case "GetPositionInfo":
+		rel := "0:00:00"
+		if r.state == statePlaying {
+			rel = didl.FormatDuration(time.Since(r.started))
+		}
+		track := "0"
+		if r.uri != "" {
+			track = "1"
+		}
+		return map[string]string{
+			"Track": track, "TrackDuration": r.durationLocked(), "TrackMetaData": r.metadata, "TrackURI": r.uri,
+			"RelTime": rel, "AbsTime": rel, "RelCount": "2147483647", "AbsCount": "2147483647",
+		}, 0
+	case "GetMediaInfo":
+		return map[string]string{
+			"NrTracks": "1", "MediaDuration": r.durationLocked(), "CurrentURI": r.uri, "CurrentURIMetaData": r.metadata,
+			"PlayMedium": "NETWORK", "RecordMedium": "NOT_IMPLEMENTED", "WriteStatus": "NOT_IMPLEMENTED",
+		}, 0
+	case "GetTransportSettings":
+		return map[string]string{"PlayMode": r.playMode, "RecQualityMode": "NOT_IMPLEMENTED"}, 0
+	case "SetPlayMode":
+		// One track at a time: the mode is remembered, not applied
+		switch mode := args["NewPlayMode"]; mode {
+		case "NORMAL", "REPEAT_ONE", "REPEAT_ALL":
+			r.playMode = mode
+			return nil, 0
+		}
+		return nil, 712 // Play mode not supported
+	case "GetDeviceCapabilities":
+		return map[string]string{"PlayMedia": "NETWORK", "RecMedia": "NOT_IMPLEMENTED", "RecQualityModes": "NOT_IMPLEMENTED"}, 0
+	case "GetCurrentTransportActions":
+		if r.state == statePlaying {
+			return map[string]string{"Actions": "Stop"}, 0
+		}
+		return map[string]string{"Actions": "Play"}, 0
+
+	// The volume is remembered for control points but not applied to the
+	// player.
+	case "GetVolume":
+		return map[string]string{"CurrentVolume": strconv.Itoa(r.volume)}, 0
+	case "SetVolume":
+		v, err := strconv.Atoi(args["DesiredVolume"])
+		if err != nil || v < 0 || v > 100 {
+			return nil, 402
+		}
+		r.volume = v
+		return nil, 0
+	case "GetMute":
+		return map[string]string{"CurrentMute": boolArg(r.mute)}, 0
+	case "SetMute":
+		r.mute = args["DesiredMute"] == "1" || args["DesiredMute"] == "true"
+		return nil, 0
+
+	case "GetProtocolInfo":
+		return map[string]string{"Source": "", "Sink": sinkProtocols}, 0
+	case "GetCurrentConnectionIDs":
+		return map[string]string{"ConnectionIDs": "0"}, 0
+	case "GetCurrentConnectionInfo":
+		return map[string]string{
+			"RcsID": "0", "AVTransportID": "0", "ProtocolInfo": "", "PeerConnectionManager": "",
+			"PeerConnectionID": "-1", "Direction": "Input", "Status": "OK",
+		}, 0
+	}
+	return nil, 401
+}
+
+// durationLocked reads the duration from the DIDL-Lite metadata, if any.
+func (r *Renderer) durationLocked() string {
+	if doc, err := didl.Unmarshal([]byte(r.metadata)); err == nil && len(doc.Items) > 0 {
+		for _, res := range doc.Items[0].Resources {
+			if res.Duration != "" {
+				return res.Duration
+			}
+		}
+	}
+	return "0:00:00"
+}
+
+// playLocked (re)starts the player on the current URI.
+func (r *Renderer) playLocked() int {
+	r.stopLocked()
+	if r.command == nil {
+		r.mockPlayLocked()
+		return 0
+	}
+
+	args := make([]string, 0, len(r.command)+1)
+	replaced := false
+	for _, a := range r.command {
+		if strings.Contains(a, "{url}") {
+			a = strings.ReplaceAll(a, "{url}", r.uri)
+			replaced = true
+		}
+		args = append(args, a)
+	}
+	if !replaced {
+		args = append(args, r.uri)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	if err := cmd.Start(); err != nil {
+		log.Printf("Renderer: failed to start %s: %v", args[0], err)
+		return 704 // Playing failed
+	}
+	r.cmd = cmd
+	r.state = statePlaying
+	r.started = time.Now()
+	log.Printf("Renderer: playing %s", r.uri)
+
+	go func() {
+		cmd.Wait()
+		r.mu.Lock()
+		if r.cmd == cmd {
+			r.cmd = nil
+			r.state = stateStopped
+		}
+		r.mu.Unlock()
+	}()
+	return 0
+}
+
+func (r *Renderer) stopLocked() {
+	if r.end != nil {
+		r.end.Stop()
+		r.end = nil
+	}
+	if r.cmd != nil {
+		r.cmd.Process.Kill()
+		r.cmd = nil
+	}
+	if r.uri == "" {
+		r.state = stateNoMedia
+	} else {
+		r.state = stateStopped
+	}
+}
+
+func boolArg(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
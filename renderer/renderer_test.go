@@ -0,0 +1,102 @@
+package renderer
+
+import (
+	"dlna/dlna"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRendererControl(t *testing.T) {
+	r := New("Test Box", []string{"sh", "-c", "sleep 5"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /renderer/description.xml", r.DescriptionHandler)
+	mux.HandleFunc("GET /renderer/{service}/scpd.xml", r.SCPDHandler)
+	mux.HandleFunc("POST /renderer/{service}/control", r.ControlHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// The agent's own discovery must understand the emulated device
+	discovery := dlna.NewDiscoveryService("", time.Second)
+	device, err := discovery.AddManualDevice(srv.URL + "/renderer/description.xml")
+	if err != nil {
+		t.Fatalf("AddManualDevice failed: %v", err)
+	}
+	if device.FriendlyName != "Test Box" || device.USN != r.UUID || !device.Supports("SetAVTransportURI") || device.Supports("Pause") {
+		t.Fatalf("Unexpected device %+v", device)
+	}
+
+	avt := dlna.NewAVTransport(device.AVTransportURL())
+	if err := dlna.Play(device.AVTransportURL(), "http://x/a.mp4", "Clip"); err != nil {
+		t.Fatalf("Play failed: %v", err)
+	}
+	info, err := avt.GetTransportInfo()
+	if err != nil || info.CurrentTransportState != "PLAYING" {
+		t.Errorf("Expected PLAYING, got %+v, %v", info, err)
+	}
+	pos, err := avt.GetPositionInfo()
+	if err != nil || pos.TrackURI != "http://x/a.mp4" {
+		t.Errorf("Unexpected position %+v, %v", pos, err)
+	}
+
+	if err := avt.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if info, _ := avt.GetTransportInfo(); info == nil || info.CurrentTransportState != "STOPPED" {
+		t.Errorf("Expected STOPPED, got %+v", info)
+	}
+
+	if err := avt.Pause(); err == nil {
+		t.Error("Pause should fail with Invalid Action")
+	}
+}
+
+func TestMockRenderer(t *testing.T) {
+	r := NewMock("Mock TV")
+	mux := http.NewServeMux()
+	r.Register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	discovery := dlna.NewDiscoveryService("", time.Second)
+	device, err := discovery.AddManualDevice(srv.URL + "/renderer/description.xml")
+	if err != nil {
+		t.Fatalf("AddManualDevice failed: %v", err)
+	}
+	if device.ModelName != "dlnagent mock renderer" || device.USN != r.UUID {
+		t.Fatalf("Unexpected device %+v", device)
+	}
+
+	meta := `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">` +
+		`<item id="0" parentID="-1" restricted="1"><dc:title>Clip</dc:title><upnp:class>object.item.videoItem</upnp:class>` +
+		`<res protocolInfo="http-get:*:video/mp4:*" duration="0:00:00.100">http://x/a.mp4</res></item></DIDL-Lite>`
+	if err := dlna.PlayWithMetadata(device.AVTransportURL(), "http://x/a.mp4", meta); err != nil {
+		t.Fatalf("Play failed: %v", err)
+	}
+	avt := dlna.NewAVTransport(device.AVTransportURL())
+	if info, err := avt.GetTransportInfo(); err != nil || info.CurrentTransportState != "PLAYING" {
+		t.Errorf("Expected PLAYING, got %+v, %v", info, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if info, err := avt.GetTransportInfo(); err != nil || info.CurrentTransportState != "STOPPED" {
+		t.Errorf("Expected STOPPED once the track ended, got %+v, %v", info, err)
+	}
+
+	var actions []string
+	for _, c := range r.Calls() {
+		actions = append(actions, c.Action)
+	}
+	if len(actions) < 2 || actions[0] != "SetAVTransportURI" || actions[1] != "Play" {
+		t.Errorf("Recorded actions %v", actions)
+	}
+	if c := r.Calls()[0]; c.Service != "AVTransport" || c.Args["CurrentURI"] != "http://x/a.mp4" {
+		t.Errorf("Recorded call %+v", c)
+	}
+
+	dlna.Play(device.AVTransportURL(), "http://x/b.mp4", "Live")
+	r.Finish()
+	if info, _ := avt.GetTransportInfo(); info == nil || info.CurrentTransportState != "STOPPED" {
+		t.Errorf("Expected STOPPED after Finish, got %+v", info)
+	}
+}
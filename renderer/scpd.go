@@ -0,0 +1,155 @@
+package renderer
+
+import (
+	"bytes"
+	"encoding/xml"
+	"sort"
+)
+
+const (
+	serviceAVTransport       = "urn:schemas-upnp-org:service:AVTransport:1"
+	serviceRenderingControl  = "urn:schemas-upnp-org:service:RenderingControl:1"
+	serviceConnectionManager = "urn:schemas-upnp-org:service:ConnectionManager:1"
+)
+
+// action declares the arguments of a SOAP action, in SCPD order.
+type action struct {
+	name string
+	in   []string
+	out  []string
+}
+
+// service is one of the emulated UPnP services. path is its URL segment
+// under /renderer/.
+type service struct {
+	typ     string
+	id      string
+	path    string
+	actions []action
+}
+
+var services = []service{
+	{
+		typ:  serviceAVTransport,
+		id:   "urn:upnp-org:serviceId:AVTransport",
+		path: "AVTransport",
+		actions: []action{
+			{"SetAVTransportURI", []string{"InstanceID", "CurrentURI", "CurrentURIMetaData"}, nil},
+			{"Play", []string{"InstanceID", "Speed"}, nil},
+			{"Stop", []string{"InstanceID"}, nil},
+			{"GetTransportInfo", []string{"InstanceID"}, []string{"CurrentTransportState", "CurrentTransportStatus", "CurrentSpeed"}},
+			{"GetPositionInfo", []string{"InstanceID"}, []string{"Track", "TrackDuration", "TrackMetaData", "TrackURI", "RelTime", "AbsTime", "RelCount", "AbsCount"}},
+			{"GetMediaInfo", []string{"InstanceID"}, []string{"NrTracks", "MediaDuration", "CurrentURI", "CurrentURIMetaData", "NextURI", "NextURIMetaData", "PlayMedium", "RecordMedium", "WriteStatus"}},
+			{"GetTransportSettings", []string{"InstanceID"}, []string{"PlayMode", "RecQualityMode"}},
+			{"SetPlayMode", []string{"InstanceID", "NewPlayMode"}, nil},
+			{"GetDeviceCapabilities", []string{"InstanceID"}, []string{"PlayMedia", "RecMedia", "RecQualityModes"}},
+			{"GetCurrentTransportActions", []string{"InstanceID"}, []string{"Actions"}},
+		},
+	},
+	{
+		typ:  serviceRenderingControl,
+		id:   "urn:upnp-org:serviceId:RenderingControl",
+		path: "RenderingControl",
+		actions: []action{
+			{"GetVolume", []string{"InstanceID", "Channel"}, []string{"CurrentVolume"}},
+			{"SetVolume", []string{"InstanceID", "Channel", "DesiredVolume"}, nil},
+			{"GetMute", []string{"InstanceID", "Channel"}, []string{"CurrentMute"}},
+			{"SetMute", []string{"InstanceID", "Channel", "DesiredMute"}, nil},
+		},
+	},
+	{
+		typ:  serviceConnectionManager,
+		id:   "urn:upnp-org:serviceId:ConnectionManager",
+		path: "ConnectionManager",
+		actions: []action{
+			{"GetProtocolInfo", nil, []string{"Source", "Sink"}},
+			{"GetCurrentConnectionIDs", nil, []string{"ConnectionIDs"}},
+			{"GetCurrentConnectionInfo", []string{"ConnectionID"}, []string{"RcsID", "AVTransportID", "ProtocolInfo", "PeerConnectionManager", "PeerConnectionID", "Direction", "Status"}},
+		},
+	},
+}
+
+func serviceByPath(path string) *service {
+	for i := range services {
+		if services[i].path == path {
+			return &services[i]
+		}
+	}
+	return nil
+}
+
+func (s *service) action(name string) *action {
+	for i := range s.actions {
+		if s.actions[i].name == name {
+			return &s.actions[i]
+		}
+	}
+	return nil
+}
+
+// argType is the SCPD dataType of an argument's state variable.
+func argType(name string) string {
+	switch name {
+	case "InstanceID", "Track", "NrTracks", "CurrentVolume", "DesiredVolume":
+		return "ui4"
+	case "RelCount", "AbsCount", "ConnectionID", "RcsID", "AVTransportID", "PeerConnectionID":
+		return "i4"
+	case "CurrentMute", "DesiredMute":
+		return "boolean"
+	}
+	return "string"
+}
+
+// scpd renders the service description. Each argument gets its own
+// A_ARG_TYPE_ state variable, which is all control points look at.
+func (s *service) scpd() []byte {
+	type argument struct {
+		Name      string `xml:"name"`
+		Direction string `xml:"direction"`
+		Related   string `xml:"relatedStateVariable"`
+	}
+	type xmlAction struct {
+		Name      string     `xml:"name"`
+		Arguments []argument `xml:"argumentList>argument,omitempty"`
+	}
+	type stateVariable struct {
+		SendEvents string `xml:"sendEvents,attr"`
+		Name       string `xml:"name"`
+		DataType   string `xml:"dataType"`
+	}
+	var doc struct {
+		XMLName xml.Name        `xml:"urn:schemas-upnp-org:service-1-0 scpd"`
+		Major   int             `xml:"specVersion>major"`
+		Minor   int             `xml:"specVersion>minor"`
+		Actions []xmlAction     `xml:"actionList>action"`
+		Vars    []stateVariable `xml:"serviceStateTable>stateVariable"`
+	}
+	doc.Major = 1
+
+	vars := map[string]bool{}
+	for _, a := range s.actions {
+		xa := xmlAction{Name: a.name}
+		for _, n := range a.in {
+			xa.Arguments = append(xa.Arguments, argument{n, "in", "A_ARG_TYPE_" + n})
+			vars[n] = true
+		}
+		for _, n := range a.out {
+			xa.Arguments = append(xa.Arguments, argument{n, "out", "A_ARG_TYPE_" + n})
+			vars[n] = true
+		}
+		doc.Actions = append(doc.Actions, xa)
+	}
+	names := make([]string, 0, len(vars))
+	for n := range vars {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		doc.Vars = append(doc.Vars, stateVariable{"no", "A_ARG_TYPE_" + n, argType(n)})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	xml.NewEncoder(&buf).Encode(doc)
+	return buf.Bytes()
+}
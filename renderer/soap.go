@@ -0,0 +1,82 @@
+package renderer
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxSOAPBody bounds incoming SOAP requests.
+const maxSOAPBody = 1 << 20
+
+var faultDescriptions = map[int]string{
+	401: "Invalid Action",
+	402: "Invalid Args",
+	701: "Transition not available",
+	704: "Playing failed",
+}
+
+// readAction decodes the action name and its arguments from a SOAP request.
+func readAction(req *http.Request) (string, map[string]string, error) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSOAPBody))
+	if err != nil {
+		return "", nil, err
+	}
+	var env struct {
+		Body struct {
+			Action struct {
+				XMLName xml.Name
+				Args    []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	if err := xml.Unmarshal(body, &env); err != nil {
+		return "", nil, err
+	}
+	if env.Body.Action.XMLName.Local == "" {
+		return "", nil, fmt.Errorf("no action in SOAP body")
+	}
+	args := make(map[string]string, len(env.Body.Action.Args))
+	for _, a := range env.Body.Action.Args {
+		args[a.XMLName.Local] = a.Value
+	}
+	return env.Body.Action.XMLName.Local, args, nil
+}
+
+const (
+	envelopeStart = `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`
+	envelopeEnd = `</s:Body></s:Envelope>`
+)
+
+// writeResponse writes <u:ActionResponse> with a's output arguments in
+// declared order.
+func writeResponse(w http.ResponseWriter, serviceType string, a *action, out map[string]string) {
+	var buf bytes.Buffer
+	buf.WriteString(envelopeStart)
+	fmt.Fprintf(&buf, `<u:%sResponse xmlns:u="%s">`, a.name, serviceType)
+	for _, name := range a.out {
+		fmt.Fprintf(&buf, "<%s>", name)
+		xml.EscapeText(&buf, []byte(out[name]))
+		fmt.Fprintf(&buf, "</%s>", name)
+	}
+	fmt.Fprintf(&buf, "</u:%sResponse>", a.name)
+	buf.WriteString(envelopeEnd)
+
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	w.Write(buf.Bytes())
+}
+
+// writeFault writes a UPnP error as a SOAP fault.
+func writeFault(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `%s<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault>%s`,
+		envelopeStart, code, description, envelopeEnd)
+}
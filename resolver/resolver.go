@@ -0,0 +1,108 @@
+// Package resolver turns page URLs (e.g. YouTube links) into direct media
+// URLs a renderer can play, before they are cast.
+package resolver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultTimeout bounds a resolver command without a configured timeout.
+const defaultTimeout = 30 * time.Second
+
+// Resolver converts url into a direct media URL. ok is false when the
+// resolver does not handle url.
+type Resolver interface {
+	Resolve(ctx context.Context, url string) (resolved string, ok bool, err error)
+}
+
+// Chain tries resolvers in order; the first that handles a URL wins.
+type Chain []Resolver
+
+// Resolve returns url unchanged if no resolver handles it.
+func (c Chain) Resolve(ctx context.Context, url string) (string, error) {
+	for _, r := range c {
+		resolved, ok, err := r.Resolve(ctx, url)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return resolved, nil
+		}
+	}
+	return url, nil
+}
+
+// Command resolves URLs matching Match by running an external command, such
+// as yt-dlp -g. A "{url}" argument is replaced with the URL; without one the
+// URL is appended. The first non-empty line of stdout is the media URL.
+type Command struct {
+	Name    string
+	Match   *regexp.Regexp
+	Args    []string
+	Timeout time.Duration
+}
+
+// NewCommand builds a Command; match is a regular expression on the URL.
+func NewCommand(name, match string, args []string, timeout time.Duration) (*Command, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("resolver %s: empty command", name)
+	}
+	re, err := regexp.Compile(match)
+	if err != nil {
+		return nil, fmt.Errorf("resolver %s: %w", name, err)
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Command{Name: name, Match: re, Args: args, Timeout: timeout}, nil
+}
+
+func (c *Command) Resolve(ctx context.Context, url string) (string, bool, error) {
+	if !c.Match.MatchString(url) {
+		return "", false, nil
+	}
+
+	args := make([]string, 0, len(c.Args)+1)
+	replaced := false
+	for _, a := range c.Args {
+		if strings.Contains(a, "{url}") {
+			a = strings.ReplaceAll(a, "{url}", url)
+			replaced = true
+		}
+		args = append(args, a)
+	}
+	if !replaced {
+		args = append(args, url)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", false, fmt.Errorf("resolver %s: %s", c.Name, msg)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			return line, true, nil
+		}
+	}
+	return "", false, errors.New("resolver " + c.Name + ": no URL in output")
+}
@@ -0,0 +1,29 @@
+package resolver
+
+import (
+	"context"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	echo, err := NewCommand("echo", `^https://video\.example/`, []string{"sh", "-c", "echo; echo http://cdn.example/$0.mp4", "{url}"}, 0)
+	if err != nil {
+		t.Fatalf("NewCommand failed: %v", err)
+	}
+	fail, _ := NewCommand("fail", `^https://broken\.example/`, []string{"sh", "-c", "echo nope >&2; exit 1"}, 0)
+	chain := Chain{echo, fail}
+
+	got, err := chain.Resolve(context.Background(), "https://video.example/x")
+	if err != nil || got != "http://cdn.example/https://video.example/x.mp4" {
+		t.Errorf("Unexpected resolution %q, %v", got, err)
+	}
+
+	got, err = chain.Resolve(context.Background(), "http://plain.example/a.m3u8")
+	if err != nil || got != "http://plain.example/a.m3u8" {
+		t.Errorf("Unmatched URL should pass through, got %q, %v", got, err)
+	}
+
+	if _, err := chain.Resolve(context.Background(), "https://broken.example/y"); err == nil || err.Error() != "resolver fail: nope" {
+		t.Errorf("Expected stderr in error, got %v", err)
+	}
+}
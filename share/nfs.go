@@ -0,0 +1,634 @@
+package share
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ONC RPC (RFC 5531) programs and constants
+const (
+	progPortmap = 100000
+	progMount   = 100005
+	progNFS     = 100003
+
+	rpcCall  = 0
+	rpcReply = 1
+	authNone = 0
+	authSys  = 1
+
+	portmapGetPort = 3
+	mountMnt       = 1
+
+	// NFSv3 procedures (RFC 1813)
+	nfsGetAttr     = 1
+	nfsLookup      = 3
+	nfsRead        = 6
+	nfsReadDirPlus = 17
+
+	nfsPort = "2049"
+
+	// nfsReadSize is asked of each READ; servers send less if their
+	// rtmax is smaller.
+	nfsReadSize = 256 << 10
+	// maxRecord bounds an RPC reply.
+	maxRecord = 4 << 20
+	// maxDirHandles bounds the cache of folder handles.
+	maxDirHandles = 10000
+)
+
+var errShortXDR = errors.New("rpc: truncated reply")
+
+// xdr encodes the XDR (RFC 4506) of RPC calls.
+type xdr struct {
+	b []byte
+}
+
+func (x *xdr) u32(v uint32) { x.b = binary.BigEndian.AppendUint32(x.b, v) }
+func (x *xdr) u64(v uint64) { x.b = binary.BigEndian.AppendUint64(x.b, v) }
+func (x *xdr) str(s string) { x.opaque([]byte(s)) }
+
+func (x *xdr) opaque(p []byte) {
+	x.u32(uint32(len(p)))
+	x.b = append(x.b, p...)
+	x.b = append(x.b, make([]byte, xdrPad(len(p)))...)
+}
+
+func xdrPad(n int) int {
+	return (4 - n%4) % 4
+}
+
+// xdrReader decodes an RPC reply. The first shortfall sticks in err and
+// zeroes everything read after it.
+type xdrReader struct {
+	b   []byte
+	err error
+}
+
+func (r *xdrReader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.b) < n {
+		r.err = errShortXDR
+		return nil
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *xdrReader) u32() uint32 {
+	if p := r.next(4); p != nil {
+		return binary.BigEndian.Uint32(p)
+	}
+	return 0
+}
+
+func (r *xdrReader) u64() uint64 {
+	if p := r.next(8); p != nil {
+		return binary.BigEndian.Uint64(p)
+	}
+	return 0
+}
+
+func (r *xdrReader) bool() bool { return r.u32() != 0 }
+
+func (r *xdrReader) fixed(n int) []byte {
+	p := r.next(n)
+	r.next(xdrPad(n))
+	return p
+}
+
+func (r *xdrReader) opaque() []byte {
+	return r.fixed(int(r.u32()))
+}
+
+// rpcConn is an RPC client of one program over TCP, with record marking.
+// Calls are not concurrent.
+type rpcConn struct {
+	conn       net.Conn
+	prog, vers uint32
+	cred       []byte
+	xid        uint32
+}
+
+// dialRPC connects to a program at addr. Linux exports are "secure" by
+// default: they only accept calls from ports below 1024, which need root,
+// so a few of those are tried first.
+func dialRPC(addr string, prog, vers uint32, cred []byte) (*rpcConn, error) {
+	d := net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	for range 8 {
+		d.LocalAddr = &net.TCPAddr{Port: 600 + rand.IntN(424)}
+		conn, err = d.Dial("tcp", addr)
+		if !isBindError(err) || errors.Is(err, fs.ErrPermission) {
+			break
+		}
+	}
+	if isBindError(err) {
+		d.LocalAddr = nil
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rpcConn{conn: conn, prog: prog, vers: vers, cred: cred, xid: rand.Uint32()}, nil
+}
+
+func isBindError(err error) bool {
+	var se *os.SyscallError
+	return errors.As(err, &se) && se.Syscall == "bind"
+}
+
+// authSysCred is the AUTH_SYS credential of uid and gid.
+func authSysCred(uid, gid uint32) []byte {
+	host, _ := os.Hostname()
+	var body xdr
+	body.u32(uint32(time.Now().Unix()))
+	body.str(host[:min(len(host), 255)])
+	body.u32(uid)
+	body.u32(gid)
+	body.u32(0) // No supplementary groups
+	var x xdr
+	x.u32(authSys)
+	x.opaque(body.b)
+	return x.b
+}
+
+var authNoneCred = []byte{0, 0, 0, authNone, 0, 0, 0, 0}
+
+func (c *rpcConn) close() error {
+	return c.conn.Close()
+}
+
+// call runs procedure proc with the encoded args and returns the decoder
+// of its results.
+func (c *rpcConn) call(proc uint32, args []byte) (*xdrReader, error) {
+	c.xid++
+	x := xdr{b: make([]byte, 4, 64+len(args))} // Record mark, set below
+	x.u32(c.xid)
+	x.u32(rpcCall)
+	x.u32(2)
+	x.u32(c.prog)
+	x.u32(c.vers)
+	x.u32(proc)
+	x.b = append(x.b, c.cred...)
+	x.b = append(x.b, authNoneCred...) // Verifier
+	x.b = append(x.b, args...)
+	binary.BigEndian.PutUint32(x.b, 1<<31|uint32(len(x.b)-4))
+
+	c.conn.SetDeadline(time.Now().Add(callTimeout))
+	if _, err := c.conn.Write(x.b); err != nil {
+		return nil, err
+	}
+	for {
+		rec, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		r := &xdrReader{b: rec}
+		if r.u32() != c.xid {
+			continue // A late reply to a call that timed out
+		}
+		if r.u32() != rpcReply {
+			return nil, errors.New("rpc: not a reply")
+		}
+		if r.u32() != 0 { // MSG_DENIED
+			if r.u32() == 1 {
+				return nil, &remoteError{msg: fmt.Sprintf("rpc: authentication failed (%d)", r.u32()), err: fs.ErrPermission}
+			}
+			return nil, &remoteError{msg: "rpc: version mismatch"}
+		}
+		r.u32() // Verifier
+		r.opaque()
+		if stat := r.u32(); r.err != nil || stat != 0 {
+			if r.err != nil {
+				return nil, r.err
+			}
+			return nil, &remoteError{msg: fmt.Sprintf("rpc: program %d version %d: call not accepted (%d)", c.prog, c.vers, stat)}
+		}
+		return r, nil
+	}
+}
+
+func (c *rpcConn) readRecord() ([]byte, error) {
+	var rec []byte
+	for {
+		var mark [4]byte
+		if _, err := io.ReadFull(c.conn, mark[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(mark[:])
+		size := int(n &^ (1 << 31))
+		if len(rec)+size > maxRecord {
+			return nil, errors.New("rpc: reply too large")
+		}
+		rec = append(rec, make([]byte, size)...)
+		if _, err := io.ReadFull(c.conn, rec[len(rec)-size:]); err != nil {
+			return nil, err
+		}
+		if n&(1<<31) != 0 {
+			return rec, nil
+		}
+	}
+}
+
+// nfsClient reads an NFSv3 export.
+type nfsClient struct {
+	host    string
+	portmap string
+	port    string // Of the NFS service; "" asks the portmapper
+	export  string // Mounted as a whole, so it may be a folder of an export
+	cred    []byte
+	display string
+
+	mu   sync.Mutex
+	rpc  *rpcConn
+	root []byte
+	dirs map[string][]byte // Handles of looked-up folders
+}
+
+func newNFS(u *url.URL, opts Options) (*nfsClient, error) {
+	export := path.Clean("/" + u.Path)
+	if export == "/" {
+		return nil, fmt.Errorf("no export path in %s", u.Redacted())
+	}
+	return &nfsClient{
+		host:    u.Hostname(),
+		portmap: "111",
+		port:    u.Port(),
+		export:  export,
+		cred:    authSysCred(opts.UID, opts.GID),
+		display: u.Host + export,
+	}, nil
+}
+
+// nfsError is the error of an NFSv3 status.
+func nfsError(status uint32) error {
+	switch status {
+	case 2:
+		return &remoteError{msg: "no such file or directory", err: fs.ErrNotExist}
+	case 1, 13:
+		return &remoteError{msg: "permission denied", err: fs.ErrPermission}
+	case 20:
+		return &remoteError{msg: "not a directory"}
+	case 21:
+		return &remoteError{msg: "is a directory"}
+	case 70:
+		// The server forgot a handle, e.g. after the export changed; the
+		// call is retried with fresh handles.
+		return errors.New("nfs: stale file handle")
+	}
+	return &remoteError{msg: fmt.Sprintf("nfs: error %d", status)}
+}
+
+// connect mounts the export and connects to the NFS service.
+func (c *nfsClient) connect() error {
+	pm, err := dialRPC(net.JoinHostPort(c.host, c.portmap), progPortmap, 2, authNoneCred)
+	if err != nil {
+		return fmt.Errorf("nfs %s: portmapper: %w", c.display, err)
+	}
+	defer pm.close()
+	getPort := func(prog, vers uint32) (uint32, error) {
+		var x xdr
+		x.u32(prog)
+		x.u32(vers)
+		x.u32(6) // TCP
+		x.u32(0)
+		r, err := pm.call(portmapGetPort, x.b)
+		if err != nil {
+			return 0, err
+		}
+		return r.u32(), r.err
+	}
+	mountPort, err := getPort(progMount, 3)
+	if err == nil && mountPort == 0 {
+		err = errors.New("mountd is not registered")
+	}
+	if err != nil {
+		return fmt.Errorf("nfs %s: portmapper: %w", c.display, err)
+	}
+	port := c.port
+	if port == "" {
+		port = nfsPort
+		if p, err := getPort(progNFS, 3); err == nil && p != 0 {
+			port = fmt.Sprint(p)
+		}
+	}
+
+	m, err := dialRPC(net.JoinHostPort(c.host, fmt.Sprint(mountPort)), progMount, 3, c.cred)
+	if err != nil {
+		return fmt.Errorf("nfs %s: mount: %w", c.display, err)
+	}
+	defer m.close()
+	var x xdr
+	x.str(c.export)
+	r, err := m.call(mountMnt, x.b)
+	if err != nil {
+		return fmt.Errorf("nfs %s: mount: %w", c.display, err)
+	}
+	if status := r.u32(); status != 0 {
+		if status == 13 || status == 1 {
+			return &remoteError{msg: fmt.Sprintf("nfs %s: mount refused; is this host allowed by the export (or does it need the insecure option)?", c.display), err: fs.ErrPermission}
+		}
+		return &remoteError{msg: fmt.Sprintf("nfs %s: mount failed (%d)", c.display, status)}
+	}
+	root := r.opaque()
+	if r.err != nil {
+		return r.err
+	}
+
+	conn, err := dialRPC(net.JoinHostPort(c.host, port), progNFS, 3, c.cred)
+	if err != nil {
+		return fmt.Errorf("nfs %s: %w", c.display, err)
+	}
+	c.rpc, c.root, c.dirs = conn, root, map[string][]byte{".": root}
+	return nil
+}
+
+// do runs fn on the connection, connecting first if needed. A call that
+// breaks the connection is tried once more on a new one.
+func (c *nfsClient) do(fn func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for range 2 {
+		if c.rpc == nil {
+			if err = c.connect(); err != nil {
+				return err
+			}
+		}
+		if err = fn(); !retryable(err) {
+			return err
+		}
+		c.rpc.close()
+		c.rpc = nil
+	}
+	return err
+}
+
+func (c *nfsClient) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rpc == nil {
+		return nil
+	}
+	err := c.rpc.close()
+	c.rpc = nil
+	return err
+}
+
+// readAttr decodes an fattr3.
+func readAttr(r *xdrReader) *fileInfo {
+	typ := r.u32()
+	mode := r.u32()
+	r.next(12) // nlink, uid, gid
+	info := &fileInfo{size: int64(r.u64()), mode: fs.FileMode(mode & 0o777)}
+	r.next(32) // used, rdev, fsid, fileid
+	r.next(8)  // atime
+	sec, nsec := r.u32(), r.u32()
+	r.next(8) // ctime
+	info.modTime = time.Unix(int64(sec), int64(nsec))
+	switch typ {
+	case 1:
+	case 2:
+		info.mode |= fs.ModeDir
+	case 5:
+		info.mode |= fs.ModeSymlink // Not followed
+	default:
+		info.mode |= fs.ModeIrregular
+	}
+	return info
+}
+
+// readPostOpAttr decodes a post_op_attr, which may be empty.
+func readPostOpAttr(r *xdrReader) *fileInfo {
+	if r.bool() {
+		return readAttr(r)
+	}
+	return nil
+}
+
+func (c *nfsClient) getAttr(fh []byte) (*fileInfo, error) {
+	var x xdr
+	x.opaque(fh)
+	r, err := c.rpc.call(nfsGetAttr, x.b)
+	if err != nil {
+		return nil, err
+	}
+	if status := r.u32(); status != 0 {
+		return nil, nfsError(status)
+	}
+	info := readAttr(r)
+	return info, r.err
+}
+
+func (c *nfsClient) lookup(dir []byte, name string) ([]byte, *fileInfo, error) {
+	var x xdr
+	x.opaque(dir)
+	x.str(name)
+	r, err := c.rpc.call(nfsLookup, x.b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if status := r.u32(); status != 0 {
+		return nil, nil, nfsError(status)
+	}
+	fh := r.opaque()
+	info := readPostOpAttr(r)
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	if info == nil {
+		if info, err = c.getAttr(fh); err != nil {
+			return nil, nil, err
+		}
+	}
+	return fh, info, nil
+}
+
+// handle returns the file handle and attributes of name, looking up the
+// folders on the way unless their handles are cached.
+func (c *nfsClient) handle(name string) ([]byte, *fileInfo, error) {
+	if name == "." {
+		info, err := c.getAttr(c.root)
+		return c.root, info, err
+	}
+	dir, err := c.dirHandle(path.Dir(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	fh, info, err := c.lookup(dir, path.Base(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		c.cacheDir(name, fh)
+	}
+	return fh, info, nil
+}
+
+func (c *nfsClient) dirHandle(name string) ([]byte, error) {
+	if fh, ok := c.dirs[name]; ok {
+		return fh, nil
+	}
+	dir, err := c.dirHandle(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	fh, info, err := c.lookup(dir, path.Base(name))
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, nfsError(20)
+	}
+	c.cacheDir(name, fh)
+	return fh, nil
+}
+
+func (c *nfsClient) cacheDir(name string, fh []byte) {
+	if len(c.dirs) >= maxDirHandles {
+		clear(c.dirs)
+		c.dirs["."] = c.root
+	}
+	c.dirs[name] = fh
+}
+
+func (c *nfsClient) stat(name string) (*fileInfo, error) {
+	var info *fileInfo
+	err := c.do(func() error {
+		var err error
+		_, info, err = c.handle(name)
+		return err
+	})
+	return info, err
+}
+
+func (c *nfsClient) readDir(name string) ([]*fileInfo, error) {
+	var infos []*fileInfo
+	err := c.do(func() error {
+		infos = nil
+		fh, err := c.dirHandle(name)
+		if err != nil {
+			return err
+		}
+		var cookie uint64
+		verf := make([]byte, 8)
+		for {
+			var x xdr
+			x.opaque(fh)
+			x.u64(cookie)
+			x.b = append(x.b, verf...)
+			x.u32(32 << 10) // dircount
+			x.u32(64 << 10) // maxcount
+			r, err := c.rpc.call(nfsReadDirPlus, x.b)
+			if err != nil {
+				return err
+			}
+			if status := r.u32(); status != 0 {
+				return nfsError(status)
+			}
+			readPostOpAttr(r)
+			verf = r.next(8)
+			for r.bool() {
+				r.u64() // fileid
+				entry := string(r.opaque())
+				cookie = r.u64()
+				info := readPostOpAttr(r)
+				var efh []byte
+				if r.bool() {
+					efh = r.opaque()
+				}
+				if r.err != nil || entry == "." || entry == ".." {
+					continue
+				}
+				if info == nil {
+					if _, info, err = c.lookup(fh, entry); err != nil {
+						return err
+					}
+				}
+				info.name = entry
+				if info.IsDir() && efh != nil {
+					c.cacheDir(path.Join(name, entry), efh)
+				}
+				infos = append(infos, info)
+			}
+			eof := r.bool()
+			if r.err != nil {
+				return r.err
+			}
+			if eof {
+				return nil
+			}
+		}
+	})
+	return infos, err
+}
+
+func (c *nfsClient) open(name string) (remoteFile, *fileInfo, error) {
+	var fh []byte
+	var info *fileInfo
+	err := c.do(func() error {
+		var err error
+		fh, info, err = c.handle(name)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &nfsFile{c: c, fh: fh}, info, nil
+}
+
+// nfsFile reads a file by its handle, which outlives connections.
+type nfsFile struct {
+	c  *nfsClient
+	fh []byte
+}
+
+func (f *nfsFile) Close() error { return nil }
+
+func (f *nfsFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		var data []byte
+		var eof bool
+		err := f.c.do(func() error {
+			var x xdr
+			x.opaque(f.fh)
+			x.u64(uint64(off) + uint64(n))
+			x.u32(uint32(min(len(p)-n, nfsReadSize)))
+			r, err := f.c.rpc.call(nfsRead, x.b)
+			if err != nil {
+				return err
+			}
+			if status := r.u32(); status != 0 {
+				return nfsError(status)
+			}
+			readPostOpAttr(r)
+			r.u32() // count
+			eof = r.bool()
+			data = r.opaque()
+			return r.err
+		})
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data)
+		if eof || len(data) == 0 {
+			if n < len(p) {
+				return n, io.EOF
+			}
+			break
+		}
+	}
+	return n, nil
+}
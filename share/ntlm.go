@@ -0,0 +1,336 @@
+package share
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// NTLM negotiate flags (MS-NLMP 2.2.2.5)
+const (
+	ntlmUnicode          = 0x00000001
+	ntlmRequestTarget    = 0x00000004
+	ntlmSign             = 0x00000010
+	ntlmNTLM             = 0x00000200
+	ntlmAnonymous        = 0x00000800
+	ntlmAlwaysSign       = 0x00008000
+	ntlmExtendedSecurity = 0x00080000
+	ntlmTargetInfo       = 0x00800000
+	ntlm128              = 0x20000000
+	ntlm56               = 0x80000000
+
+	ntlmFlags = ntlmUnicode | ntlmRequestTarget | ntlmSign | ntlmNTLM | ntlmAlwaysSign |
+		ntlmExtendedSecurity | ntlmTargetInfo | ntlm128 | ntlm56
+
+	avEOL       = 0
+	avTimestamp = 7
+)
+
+var (
+	oidSPNEGO  = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	oidNTLMSSP = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}
+
+	ntlmSignature = []byte("NTLMSSP\x00")
+)
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+func fromUTF16le(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// ntlmNegotiate is the NEGOTIATE_MESSAGE that starts a sign-in.
+func ntlmNegotiate() []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], ntlmFlags)
+	return b
+}
+
+// ntlmChallenge is the part of a CHALLENGE_MESSAGE the answer needs.
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+func parseChallenge(b []byte) (*ntlmChallenge, error) {
+	if len(b) < 48 || !bytes.HasPrefix(b, ntlmSignature) || binary.LittleEndian.Uint32(b[8:]) != 2 {
+		return nil, errors.New("ntlm: not a challenge message")
+	}
+	c := &ntlmChallenge{flags: binary.LittleEndian.Uint32(b[20:]), challenge: b[24:32]}
+	n, off := int(binary.LittleEndian.Uint16(b[40:])), int(binary.LittleEndian.Uint32(b[44:]))
+	if off+n > len(b) {
+		return nil, errors.New("ntlm: truncated challenge message")
+	}
+	c.targetInfo = b[off : off+n]
+	return c, nil
+}
+
+// timestamp returns the MsvAvTimestamp of the target info, if any.
+func (c *ntlmChallenge) timestamp() ([]byte, bool) {
+	for info := c.targetInfo; len(info) >= 4; {
+		id, n := binary.LittleEndian.Uint16(info), int(binary.LittleEndian.Uint16(info[2:]))
+		if id == avEOL || len(info) < 4+n {
+			break
+		}
+		if id == avTimestamp && n == 8 {
+			return info[4:12], true
+		}
+		info = info[4+n:]
+	}
+	return nil, false
+}
+
+// ntowfv2 is the NTLMv2 key of a user (MS-NLMP 3.3.2).
+func ntowfv2(user, password, domain string) []byte {
+	hash := md4(utf16le(password))
+	mac := hmac.New(md5.New, hash)
+	mac.Write(utf16le(strings.ToUpper(user) + domain))
+	return mac.Sum(nil)
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// ntlmv2Response computes the NTLMv2 response to a server challenge and
+// the session base key it yields.
+func ntlmv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (nt, sessionKey []byte) {
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+	proof := hmacMD5(key, serverChallenge, temp)
+	return append(proof, temp...), hmacMD5(key, proof)
+}
+
+// ntlmAuthenticate answers a challenge with an AUTHENTICATE_MESSAGE,
+// returning the session key for signing (nil when anonymous).
+func ntlmAuthenticate(challenge []byte, opts Options) (msg, sessionKey []byte, err error) {
+	c, err := parseChallenge(challenge)
+	if err != nil {
+		return nil, nil, err
+	}
+	flags := c.flags&ntlmFlags | ntlmUnicode
+	var lm, nt []byte
+	if opts.User == "" {
+		flags |= ntlmAnonymous
+		lm = []byte{0}
+	} else {
+		key := ntowfv2(opts.User, opts.Password, opts.Domain)
+		clientChallenge := make([]byte, 8)
+		rand.Read(clientChallenge)
+		timestamp, ok := c.timestamp()
+		if ok {
+			lm = make([]byte, 24) // MS-NLMP 3.1.5.1.2: no LMv2 with a server timestamp
+		} else {
+			ft := uint64(time.Now().UnixNano()/100) + filetimeEpoch
+			timestamp = binary.LittleEndian.AppendUint64(nil, ft)
+			lm = append(hmacMD5(key, c.challenge, clientChallenge), clientChallenge...)
+		}
+		nt, sessionKey = ntlmv2Response(key, c.challenge, clientChallenge, timestamp, c.targetInfo)
+	}
+
+	const header = 64
+	b := make([]byte, header)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	field := func(at int, data []byte) {
+		binary.LittleEndian.PutUint16(b[at:], uint16(len(data)))
+		binary.LittleEndian.PutUint16(b[at+2:], uint16(len(data)))
+		binary.LittleEndian.PutUint32(b[at+4:], uint32(len(b)))
+		b = append(b, data...)
+	}
+	field(12, lm)
+	field(20, nt)
+	field(28, utf16le(opts.Domain))
+	field(36, utf16le(opts.User))
+	field(44, nil) // Workstation
+	field(52, nil) // No key exchange: the session key is the base key
+	binary.LittleEndian.PutUint32(b[60:], flags)
+	return b, sessionKey, nil
+}
+
+// spnegoInit wraps an NTLM NEGOTIATE_MESSAGE in a SPNEGO NegTokenInit
+// (RFC 4178), as SMB servers expect.
+func spnegoInit(token []byte) []byte {
+	init, _ := asn1.Marshal(struct {
+		MechTypes []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+		MechToken []byte                  `asn1:"explicit,tag:2"`
+	}{[]asn1.ObjectIdentifier{oidNTLMSSP}, token})
+	neg, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: init})
+	oid, _ := asn1.Marshal(oidSPNEGO)
+	b, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: append(oid, neg...)})
+	return b
+}
+
+// spnegoResp wraps an NTLM AUTHENTICATE_MESSAGE in a NegTokenResp.
+func spnegoResp(token []byte) []byte {
+	resp, _ := asn1.Marshal(struct {
+		ResponseToken []byte `asn1:"explicit,tag:2"`
+	}{token})
+	b, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: resp})
+	return b
+}
+
+// spnegoToken extracts the NTLM message of a server's NegTokenResp. Bare
+// NTLM messages are returned as they are.
+func spnegoToken(blob []byte) ([]byte, error) {
+	if bytes.HasPrefix(blob, ntlmSignature) {
+		return blob, nil
+	}
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(blob, &raw); err != nil {
+		return nil, err
+	}
+	if raw.Class != asn1.ClassContextSpecific || raw.Tag != 1 {
+		return nil, errors.New("spnego: not a NegTokenResp")
+	}
+	var resp struct {
+		State         asn1.Enumerated       `asn1:"explicit,optional,tag:0"`
+		SupportedMech asn1.ObjectIdentifier `asn1:"explicit,optional,tag:1"`
+		ResponseToken []byte                `asn1:"explicit,optional,tag:2"`
+		MechListMIC   []byte                `asn1:"explicit,optional,tag:3"`
+	}
+	if _, err := asn1.Unmarshal(raw.Bytes, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.ResponseToken) == 0 {
+		return nil, errors.New("spnego: no NTLM challenge")
+	}
+	return resp.ResponseToken, nil
+}
+
+// md4 is MD4 (RFC 1320), which NTLM hashes passwords with and the standard
+// library does not have.
+func md4(msg []byte) []byte {
+	s := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	n := len(msg)
+	msg = append(msg[:n:n], 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(n)*8)
+
+	var x [16]uint32
+	for ; len(msg) > 0; msg = msg[64:] {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(msg[4*i:])
+		}
+		a, b, c, d := s[0], s[1], s[2], s[3]
+		for i := range 16 {
+			k := i
+			f := b&c | ^b&d
+			a, b, c, d = d, bits.RotateLeft32(a+f+x[k], []int{3, 7, 11, 19}[i%4]), b, c
+		}
+		for i := range 16 {
+			k := i%4*4 + i/4
+			f := b&c | b&d | c&d
+			a, b, c, d = d, bits.RotateLeft32(a+f+x[k]+0x5a827999, []int{3, 5, 9, 13}[i%4]), b, c
+		}
+		for i := range 16 {
+			k := []int{0, 8, 4, 12, 2, 10, 6, 14, 1, 9, 5, 13, 3, 11, 7, 15}[i]
+			f := b ^ c ^ d
+			a, b, c, d = d, bits.RotateLeft32(a+f+x[k]+0x6ed9eba1, []int{3, 9, 11, 15}[i%4]), b, c
+		}
+		s[0] += a
+		s[1] += b
+		s[2] += c
+		s[3] += d
+	}
+	out := make([]byte, 0, 16)
+	for _, v := range s {
+		out = binary.LittleEndian.AppendUint32(out, v)
+	}
+	return out
+}
+
+// cmac is AES-CMAC (RFC 4493), which signs SMB 3 messages.
+func cmac(key, msg []byte) []byte {
+	c, _ := aes.NewCipher(key)
+	shift := func(b []byte) []byte {
+		out := make([]byte, 16)
+		for i := range 15 {
+			out[i] = b[i]<<1 | b[i+1]>>7
+		}
+		out[15] = b[15] << 1
+		if b[0]&0x80 != 0 {
+			out[15] ^= 0x87
+		}
+		return out
+	}
+	l := make([]byte, 16)
+	c.Encrypt(l, l)
+	k1 := shift(l)
+	k2 := shift(k1)
+
+	last := make([]byte, 16)
+	if n := len(msg); n > 0 && n%16 == 0 {
+		copy(last, msg[n-16:])
+		msg = msg[:n-16]
+		for i := range last {
+			last[i] ^= k1[i]
+		}
+	} else {
+		rest := msg[n-n%16:]
+		msg = msg[:n-n%16]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		for i := range last {
+			last[i] ^= k2[i]
+		}
+	}
+	mac := make([]byte, 16)
+	for ; len(msg) > 0; msg = msg[16:] {
+		for i := range mac {
+			mac[i] ^= msg[i]
+		}
+		c.Encrypt(mac, mac)
+	}
+	for i := range mac {
+		mac[i] ^= last[i]
+	}
+	c.Encrypt(mac, mac)
+	return mac
+}
+
+// smb3Key derives an SMB 3.0 key from the session key (SP800-108 in
+// counter mode with HMAC-SHA256, MS-SMB2 3.1.4.2).
+func smb3Key(sessionKey []byte, label, context string) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte{0, 0, 0, 1})
+	mac.Write([]byte(label))
+	mac.Write([]byte{0})
+	mac.Write([]byte(context))
+	mac.Write([]byte{0, 0, 0, 128})
+	return mac.Sum(nil)[:16]
+}
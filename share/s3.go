@@ -0,0 +1,400 @@
+package share
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// emptySHA256 is the payload hash of requests without a body.
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// presignExpiry is how long presigned URLs are valid. Renderers are
+	// redirected to a new one on every request, so this only needs to
+	// cover those that keep reusing the first for a whole film.
+	presignExpiry = 12 * time.Hour
+
+	// maxListResult bounds a ListObjectsV2 response of 1000 keys.
+	maxListResult = 4 << 20
+)
+
+// sigV4 signs S3 requests with AWS Signature Version 4.
+type sigV4 struct {
+	accessKey string
+	secretKey string
+	region    string
+}
+
+// s3Escape escapes s as SigV4 canonical requests do: all but unreserved
+// characters, and slashes too unless keepSlash.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' && keepSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery is q sorted and escaped for a canonical request.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+func (s sigV4) scope(date string) string {
+	return date[:8] + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request made at date (20060102T150405Z).
+func (s sigV4) signature(date, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + s.scope(date) + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date[:8])
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+// sign adds the Authorization header of req, bodiless, signing its Host,
+// Range and x-amz-* headers.
+func (s sigV4) sign(req *http.Request, now time.Time) {
+	date := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), canonicalQuery(req.URL.Query()))
+	for _, k := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", k, headers[k])
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, emptySHA256)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, s.scope(date), signed, s.signature(date, canonical.String())))
+}
+
+// presign returns the query that lets anyone GET escapedPath of host
+// until expiry.
+func (s sigV4) presign(host, escapedPath string, now time.Time, expiry time.Duration) url.Values {
+	date := now.UTC().Format("20060102T150405Z")
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.accessKey + "/" + s.scope(date)},
+		"X-Amz-Date":          {date},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonical := "GET\n" + escapedPath + "\n" + canonicalQuery(q) + "\nhost:" + host + "\n\nhost\nUNSIGNED-PAYLOAD"
+	q.Set("X-Amz-Signature", s.signature(date, canonical))
+	return q
+}
+
+// listResult is the body of a ListObjectsV2 response.
+type listResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		Size         int64  `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// s3Client reads the objects of an S3 bucket under a key prefix, as
+// folders split at slashes. Requests are path-style, which AWS and
+// S3-compatible stores such as MinIO all accept.
+type s3Client struct {
+	scheme  string
+	host    string
+	bucket  string
+	prefix  string // Key prefix of the root: empty or ending in /
+	sig     sigV4  // Zero for public buckets
+	proxy   bool
+	client  *http.Client
+	display string
+}
+
+func newS3(u *url.URL, opts Options) (*s3Client, error) {
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("no bucket in %s", u.Redacted())
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	scheme := "https"
+	if u.Scheme == "s3+http" {
+		scheme = "http"
+	}
+	region := opts.Region
+	if region == "" {
+		region = "us-east-1"
+		// s3.eu-west-1.amazonaws.com
+		if r, ok := strings.CutSuffix(strings.TrimPrefix(u.Hostname(), "s3."), ".amazonaws.com"); ok && r != "s3" {
+			region = r
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = callTimeout
+	return &s3Client{
+		scheme: scheme,
+		host:   u.Host,
+		bucket: bucket,
+		prefix: prefix,
+		sig:    sigV4{accessKey: opts.User, secretKey: opts.Password, region: region},
+		proxy:  opts.Proxy,
+		// No timeout: file bodies stream for as long as a cast plays
+		client:  &http.Client{Transport: transport},
+		display: "s3 " + u.Host + "/" + bucket + "/" + prefix,
+	}, nil
+}
+
+// key is the object key of name.
+func (c *s3Client) key(name string) string {
+	if name == "." {
+		return c.prefix
+	}
+	return c.prefix + name
+}
+
+// objectPath is the escaped request path of key.
+func (c *s3Client) objectPath(key string) string {
+	return "/" + s3Escape(c.bucket, false) + "/" + s3Escape(key, true)
+}
+
+// request is a signed request of escapedPath, from byte off.
+func (c *s3Client) request(ctx context.Context, method, escapedPath string, q url.Values, off int64) (*http.Request, error) {
+	u := c.scheme + "://" + c.host + escapedPath
+	if len(q) > 0 {
+		u += "?" + canonicalQuery(q)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRange(req, off)
+	if c.sig.accessKey != "" {
+		c.sig.sign(req, time.Now())
+	}
+	return req, nil
+}
+
+func (c *s3Client) do(ctx context.Context, method, escapedPath string, q url.Values) (*http.Response, error) {
+	req, err := c.request(ctx, method, escapedPath, q, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.display, err)
+	}
+	return resp, nil
+}
+
+// s3Error is the error of an unexpected response.
+func (c *s3Client) s3Error(resp *http.Response) error {
+	var body struct {
+		Code string `xml:"Code"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+	switch {
+	case resp.StatusCode == http.StatusNotFound && body.Code != "NoSuchBucket":
+		return &remoteError{msg: "no such file or directory", err: fs.ErrNotExist}
+	case body.Code == "SignatureDoesNotMatch" || body.Code == "InvalidAccessKeyId":
+		return &remoteError{msg: fmt.Sprintf("%s: wrong access key or secret", c.display), err: fs.ErrPermission}
+	case resp.StatusCode == http.StatusForbidden:
+		return &remoteError{msg: "access denied", err: fs.ErrPermission}
+	case body.Code != "":
+		return &remoteError{msg: fmt.Sprintf("%s: %s", c.display, body.Code)}
+	}
+	return &remoteError{msg: fmt.Sprintf("%s: %s", c.display, resp.Status)}
+}
+
+// list lists the keys under prefix, folded into folders at the next
+// slash, calling fn with every page.
+func (c *s3Client) list(prefix string, maxKeys int, fn func(*listResult)) error {
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	if maxKeys > 0 {
+		q.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+		resp, err := c.do(ctx, http.MethodGet, "/"+s3Escape(c.bucket, false), q)
+		if err != nil {
+			cancel()
+			return err
+		}
+		var res listResult
+		if resp.StatusCode != http.StatusOK {
+			err = c.s3Error(resp)
+		} else if err = xml.NewDecoder(io.LimitReader(resp.Body, maxListResult)).Decode(&res); err != nil {
+			err = fmt.Errorf("%s: %w", c.display, err)
+		}
+		resp.Body.Close()
+		cancel()
+		if err != nil {
+			return err
+		}
+		fn(&res)
+		if !res.IsTruncated || res.NextContinuationToken == "" || maxKeys > 0 {
+			return nil
+		}
+		q.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+func (c *s3Client) readDir(name string) ([]*fileInfo, error) {
+	prefix := c.key(name)
+	if name != "." {
+		prefix += "/"
+	}
+	var infos []*fileInfo
+	err := c.list(prefix, 0, func(res *listResult) {
+		for _, o := range res.Contents {
+			rel := strings.TrimPrefix(o.Key, prefix)
+			if rel == "" { // A folder marker
+				continue
+			}
+			modTime, _ := time.Parse(time.RFC3339, o.LastModified)
+			infos = append(infos, &fileInfo{name: rel, size: o.Size, mode: 0o444, modTime: modTime})
+		}
+		for _, p := range res.CommonPrefixes {
+			if rel := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"); rel != "" {
+				infos = append(infos, &fileInfo{name: rel, mode: fs.ModeDir | 0o555})
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 && name != "." {
+		// S3 lists missing folders as empty
+		info, err := c.stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, &remoteError{msg: "not a directory"}
+		}
+	}
+	return infos, nil
+}
+
+// stat heads the object of name, or lists a key under it for a folder,
+// which S3 only has as key prefixes.
+func (c *s3Client) stat(name string) (*fileInfo, error) {
+	if name == "." {
+		return &fileInfo{name: ".", mode: fs.ModeDir | 0o555}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	resp, err := c.do(ctx, http.MethodHead, c.objectPath(c.key(name)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &fileInfo{name: path.Base(name), size: resp.ContentLength, mode: 0o444, modTime: modTime}, nil
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		// HEAD responses have no body to tell why
+		return nil, c.s3Error(resp)
+	}
+	found := false
+	err = c.list(c.key(name)+"/", 1, func(res *listResult) {
+		found = found || len(res.Contents) > 0 || len(res.CommonPrefixes) > 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &remoteError{msg: "no such file or directory", err: fs.ErrNotExist}
+	}
+	return &fileInfo{name: path.Base(name), mode: fs.ModeDir | 0o555}, nil
+}
+
+func (c *s3Client) open(name string) (remoteFile, *fileInfo, error) {
+	info, err := c.stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := &httpFile{
+		client:  c.client,
+		size:    info.size,
+		display: c.display,
+		request: func(off int64) (*http.Request, error) {
+			return c.request(context.Background(), http.MethodGet, c.objectPath(c.key(name)), nil, off)
+		},
+		fail: c.s3Error,
+	}
+	return f, info, nil
+}
+
+// presign returns a URL renderers can GET name from for presignExpiry,
+// or the plain object URL of a public bucket.
+func (c *s3Client) presign(name string) (string, bool) {
+	if c.proxy {
+		return "", false
+	}
+	p := c.objectPath(c.key(name))
+	u := c.scheme + "://" + c.host + p
+	if c.sig.accessKey == "" {
+		return u, true
+	}
+	return u + "?" + canonicalQuery(c.sig.presign(c.host, p, time.Now(), presignExpiry)), true
+}
+
+func (c *s3Client) close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,369 @@
+// Package share reads SMB, NFS, WebDAV and S3 shares directly, without
+// mounting them, so media roots can live on a NAS or in the cloud. A
+// Share is an fs.FS for the library and the media server, and serves its
+// files on a loopback URL for ffprobe and ffmpeg.
+package share
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	dialTimeout = 10 * time.Second
+	// callTimeout bounds one request and its response.
+	callTimeout = 30 * time.Second
+
+	// Nobody is the NFS user and group ID of shares whose config does
+	// not set them.
+	Nobody = 65534
+)
+
+// Options configure access to a share.
+type Options struct {
+	// User and Password sign in to SMB and WebDAV shares, and are the
+	// access key and secret of S3 buckets; without a user the agent signs
+	// in to SMB anonymously, which guest shares accept, and reads public
+	// buckets.
+	User     string
+	Password string
+	Domain   string // Optional SMB domain or workgroup
+
+	// UID and GID are sent with NFS calls (AUTH_SYS), and checked by the
+	// server against the permissions of the files.
+	UID, GID uint32
+
+	// ListCache is how long WebDAV folder listings are reused before
+	// asking again; 0 asks every time.
+	ListCache time.Duration
+
+	// Region of S3 buckets, by default from AWS endpoints such as
+	// s3.eu-west-1.amazonaws.com, else us-east-1.
+	Region string
+
+	// Proxy streams S3 files to renderers through the agent rather than
+	// redirecting them to presigned URLs; see Share.SignedURL.
+	Proxy bool
+}
+
+// IsShare reports whether rawURL names a network share, such as
+// smb://host/share, nfs://host/export, davs://host/path or
+// s3://host/bucket, rather than a local folder.
+func IsShare(rawURL string) bool {
+	for _, scheme := range []string{"smb://", "nfs://", "dav://", "davs://", "s3://", "s3+http://"} {
+		if strings.HasPrefix(rawURL, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// backend is the protocol client of a share. Names are slash-separated
+// paths valid for fs.ValidPath.
+type backend interface {
+	stat(name string) (*fileInfo, error)
+	readDir(name string) ([]*fileInfo, error)
+	// open opens a file or folder; folders are listed with readDir.
+	open(name string) (remoteFile, *fileInfo, error)
+	close() error
+}
+
+type remoteFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// remoteError is an error answered by the server, as opposed to a broken
+// connection, after which a call is retried on a new one.
+type remoteError struct {
+	msg string
+	err error // fs.ErrNotExist or fs.ErrPermission, if it is one of those
+}
+
+func (e *remoteError) Error() string { return e.msg }
+func (e *remoteError) Unwrap() error { return e.err }
+
+// retryable reports whether a call that failed with err should be tried
+// again on a new connection.
+func retryable(err error) bool {
+	var re *remoteError
+	return err != nil && !errors.As(err, &re)
+}
+
+// Share is an opened network share.
+type Share struct {
+	url   string // Without the password, for logs
+	b     backend
+	ln    net.Listener
+	token string // Path prefix of the loopback URLs
+	srv   *http.Server
+}
+
+// Check validates a share URL without connecting.
+func Check(rawURL string) error {
+	_, err := newBackend(rawURL, Options{})
+	return err
+}
+
+func newBackend(rawURL string, opts Options) (backend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("invalid share URL") // The error would show the password
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %s", u.Redacted())
+	}
+	if u.User != nil {
+		opts.User = u.User.Username()
+		opts.Password, _ = u.User.Password()
+		// smb://DOMAIN;user@host/share, as Samba's tools write it
+		if domain, user, ok := strings.Cut(opts.User, ";"); ok {
+			opts.Domain, opts.User = domain, user
+		}
+	}
+	switch u.Scheme {
+	case "smb":
+		return newSMB(u, opts)
+	case "nfs":
+		return newNFS(u, opts)
+	case "dav", "davs":
+		return newWebDAV(u, opts)
+	case "s3", "s3+http":
+		return newS3(u, opts)
+	}
+	return nil, fmt.Errorf("not an smb://, nfs://, davs:// or s3:// URL: %s", u.Redacted())
+}
+
+// Open opens the share at rawURL: smb://[user[:password]@]host/share[/folder],
+// nfs://host[:port]/export[/folder], or a WebDAV folder as
+// davs://[user[:password]@]host[:port]/path (dav:// for plain HTTP), or
+// objects of an S3 bucket as s3://[key[:secret]@]endpoint/bucket[/prefix]
+// (s3+http:// for plain HTTP). Credentials in the URL take precedence over
+// those of opts. The connection is made on first use, and made again
+// whenever it breaks.
+func Open(rawURL string, opts Options) (*Share, error) {
+	b, err := newBackend(rawURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(rawURL)
+	return newShare(b, u.Redacted())
+}
+
+func newShare(b backend, display string) (*Share, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+	var token [16]byte
+	rand.Read(token[:])
+	s := &Share{url: display, b: b, ln: ln, token: hex.EncodeToString(token[:])}
+	s.srv = &http.Server{Handler: http.HandlerFunc(s.serveInput), ReadHeaderTimeout: callTimeout}
+	go s.srv.Serve(ln)
+	return s, nil
+}
+
+// String is the URL of the share, without the password.
+func (s *Share) String() string {
+	return s.url
+}
+
+// Close closes the connection and the loopback listener.
+func (s *Share) Close() error {
+	s.srv.Close()
+	return s.b.close()
+}
+
+// Input is the loopback URL of file rel for ffprobe and ffmpeg, which read
+// it with Range requests like any HTTP input. The random prefix keeps
+// other local users out.
+func (s *Share) Input(rel string) string {
+	parts := strings.Split(rel, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return "http://" + s.ln.Addr().String() + "/" + s.token + "/" + strings.Join(parts, "/")
+}
+
+// presigner is a backend whose files renderers can fetch without the
+// agent.
+type presigner interface {
+	presign(name string) (string, bool)
+}
+
+// SignedURL returns a URL renderers can fetch file name from directly,
+// such as a presigned S3 URL valid for some hours. ok is false for shares
+// only the agent can read.
+func (s *Share) SignedURL(name string) (u string, ok bool) {
+	if p, isPresigner := s.b.(presigner); isPresigner && fs.ValidPath(name) {
+		return p.presign(name)
+	}
+	return "", false
+}
+
+func (s *Share) serveInput(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutPrefix(r.URL.Path, "/"+s.token+"/")
+	if !ok || !fs.ValidPath(name) {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFileFS(w, r, s, name)
+}
+
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Open implements fs.FS.
+func (s *Share) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("open", name, fs.ErrInvalid)
+	}
+	f, info, err := s.b.open(name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	info.name = path.Base(name)
+	if info.IsDir() {
+		f.Close()
+		return &dir{s: s, name: name, info: info}, nil
+	}
+	return &file{f: f, info: info}, nil
+}
+
+// Stat implements fs.StatFS, without opening the file.
+func (s *Share) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("stat", name, fs.ErrInvalid)
+	}
+	info, err := s.b.stat(name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	info.name = path.Base(name)
+	return info, nil
+}
+
+// ReadDir implements fs.ReadDirFS, with the entries sorted by name.
+func (s *Share) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError("readdir", name, fs.ErrInvalid)
+	}
+	infos, err := s.b.readDir(name)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// fileInfo describes a file of a share.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *fileInfo) Sys() any           { return nil }
+
+// file is an open file of a share. It seeks, so it can be served with
+// http.ServeContent.
+type file struct {
+	f    remoteFile
+	info *fileInfo
+	off  int64
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Close() error               { return f.f.Close() }
+
+func (f *file) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := f.f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	return f.f.ReadAt(p, off)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, pathError("seek", f.info.name, fs.ErrInvalid)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// dir is an open folder of a share, listed on the first ReadDir.
+type dir struct {
+	s       *Share
+	name    string
+	info    *fileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, pathError("read", d.name, errors.New("is a directory"))
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.s.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
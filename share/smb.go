@@ -0,0 +1,572 @@
+package share
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMB2 commands (MS-SMB2 2.2.1)
+const (
+	smbNegotiate      = 0x00
+	smbSessionSetup   = 0x01
+	smbTreeConnect    = 0x03
+	smbCreate         = 0x05
+	smbClose          = 0x06
+	smbRead           = 0x08
+	smbQueryDirectory = 0x0e
+)
+
+// NT status codes
+const (
+	statusSuccess            = 0x00000000
+	statusPending            = 0x00000103
+	statusNoMoreFiles        = 0x80000006
+	statusInvalidHandle      = 0xc0000008
+	statusNoSuchFile         = 0xc000000f
+	statusEndOfFile          = 0xc0000011
+	statusMoreProcessing     = 0xc0000016
+	statusAccessDenied       = 0xc0000022
+	statusNameNotFound       = 0xc0000034
+	statusPathNotFound       = 0xc000003a
+	statusLogonFailure       = 0xc000006d
+	statusNotSupported       = 0xc00000bb
+	statusNetworkNameDeleted = 0xc00000c9
+	statusBadNetworkName     = 0xc00000cc
+	statusFileClosed         = 0xc0000128
+	statusSessionDeleted     = 0xc0000203
+	statusSessionExpired     = 0xc000035c
+)
+
+const (
+	smbPort = "445"
+
+	smbFlagResponse = 0x00000001
+	smbFlagAsync    = 0x00000002
+	smbFlagSigned   = 0x00000008
+
+	smbSigningRequired = 0x0002
+	smbSessionGuest    = 0x0001
+	smbSessionNull     = 0x0002
+	smbShareEncrypt    = 0x00008000
+	smbAttrDirectory   = 0x00000010
+
+	// smbChunk is the most read or listed at once, the largest a
+	// single-credit request may ask for.
+	smbChunk = 64 << 10
+
+	// filetimeEpoch is 1970 in Windows FILETIME, 100ns since 1601.
+	filetimeEpoch = 116444736000000000
+)
+
+// errEOF ends a read, without reconnecting like io.EOF from the connection.
+var errEOF = &remoteError{msg: "end of file"}
+
+// smbDialects are the dialects offered. SMB 3.1.1, which needs pre-auth
+// integrity, is not, nor encryption: shares that demand it fail to connect.
+var smbDialects = []uint16{0x0202, 0x0210, 0x0300, 0x0302}
+
+// smbClient reads an SMB2/3 share.
+type smbClient struct {
+	addr    string
+	host    string
+	share   string
+	prefix  string // Folder of the share the root starts at, with backslashes
+	opts    Options
+	display string
+
+	mu        sync.Mutex
+	conn      net.Conn
+	gen       int // Bumped per connection: file IDs of older ones are void
+	messageID uint64
+	sessionID uint64
+	treeID    uint32
+	dialect   uint16
+	maxRead   int
+	signKey   []byte // Without signing, nil
+}
+
+func newSMB(u *url.URL, opts Options) (*smbClient, error) {
+	share, folder, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if share == "" {
+		return nil, fmt.Errorf("no share name in %s", u.Redacted())
+	}
+	port := u.Port()
+	if port == "" {
+		port = smbPort
+	}
+	return &smbClient{
+		addr:    net.JoinHostPort(u.Hostname(), port),
+		host:    u.Hostname(),
+		share:   share,
+		prefix:  strings.ReplaceAll(strings.Trim(folder, "/"), "/", `\`),
+		opts:    opts,
+		display: u.Host + "/" + share,
+	}, nil
+}
+
+// smbError is the error of an NT status. Those that mean the session or
+// tree is gone are not remote errors, so the call reconnects.
+func (c *smbClient) smbError(op string, status uint32) error {
+	switch status {
+	case statusNoSuchFile, statusNameNotFound, statusPathNotFound:
+		return &remoteError{msg: "no such file or directory", err: fs.ErrNotExist}
+	case statusAccessDenied:
+		return &remoteError{msg: "access denied", err: fs.ErrPermission}
+	case statusLogonFailure:
+		return &remoteError{msg: fmt.Sprintf("smb %s: logon failure (wrong user or password)", c.display), err: fs.ErrPermission}
+	case statusBadNetworkName:
+		return &remoteError{msg: fmt.Sprintf("smb %s: no such share", c.display), err: fs.ErrNotExist}
+	case statusNetworkNameDeleted, statusSessionDeleted, statusSessionExpired, statusFileClosed, statusInvalidHandle:
+		return fmt.Errorf("smb %s: %s: session lost (0x%08x)", c.display, op, status)
+	}
+	return &remoteError{msg: fmt.Sprintf("smb %s: %s failed (0x%08x)", c.display, op, status)}
+}
+
+// request sends an SMB2 command and returns the whole response message,
+// header included, and its status.
+func (c *smbClient) request(cmd uint16, body []byte) ([]byte, uint32, error) {
+	msg := make([]byte, 64, 64+len(body))
+	copy(msg, "\xfeSMB")
+	binary.LittleEndian.PutUint16(msg[4:], 64)
+	if c.dialect > 0x0202 {
+		binary.LittleEndian.PutUint16(msg[6:], 1) // Credit charge
+	}
+	binary.LittleEndian.PutUint16(msg[12:], cmd)
+	binary.LittleEndian.PutUint16(msg[14:], 32) // Credits asked for
+	id := c.messageID
+	c.messageID++
+	binary.LittleEndian.PutUint64(msg[24:], id)
+	binary.LittleEndian.PutUint32(msg[36:], c.treeID)
+	binary.LittleEndian.PutUint64(msg[40:], c.sessionID)
+	msg = append(msg, body...)
+	if c.signKey != nil {
+		binary.LittleEndian.PutUint32(msg[16:], smbFlagSigned)
+		copy(msg[48:], c.sign(msg))
+	}
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(msg)))
+	c.conn.SetDeadline(time.Now().Add(callTimeout))
+	if _, err := c.conn.Write(append(frame, msg...)); err != nil {
+		return nil, 0, err
+	}
+	for {
+		var head [4]byte
+		if _, err := io.ReadFull(c.conn, head[:]); err != nil {
+			return nil, 0, err
+		}
+		n := binary.BigEndian.Uint32(head[:]) & 0xffffff
+		resp := make([]byte, n)
+		if _, err := io.ReadFull(c.conn, resp); err != nil {
+			return nil, 0, err
+		}
+		if len(resp) < 64 || string(resp[:4]) != "\xfeSMB" {
+			if len(resp) >= 4 && string(resp[:4]) == "\xfdSMB" {
+				return nil, 0, &remoteError{msg: fmt.Sprintf("smb %s: the server encrypts, which is not supported", c.display)}
+			}
+			return nil, 0, errors.New("smb: not an SMB2 message")
+		}
+		flags := binary.LittleEndian.Uint32(resp[16:])
+		if flags&smbFlagResponse == 0 || binary.LittleEndian.Uint64(resp[24:]) != id {
+			continue // e.g. an oplock break
+		}
+		status := binary.LittleEndian.Uint32(resp[8:])
+		if status == statusPending && flags&smbFlagAsync != 0 {
+			continue // The final response follows
+		}
+		return resp, status, nil
+	}
+}
+
+// sign computes the signature of msg, whose signature field is zero.
+func (c *smbClient) sign(msg []byte) []byte {
+	if c.dialect >= 0x0300 {
+		return cmac(c.signKey, msg)
+	}
+	mac := hmac.New(sha256.New, c.signKey)
+	mac.Write(msg)
+	return mac.Sum(nil)[:16]
+}
+
+// smbBuffer returns the part of msg at a header-relative offset and length, as
+// SMB2 responses point to their buffers.
+func smbBuffer(msg []byte, off, n int) ([]byte, error) {
+	if off < 64 || off+n > len(msg) {
+		return nil, errors.New("smb: truncated response")
+	}
+	return msg[off : off+n], nil
+}
+
+// connect negotiates a dialect, signs in and connects to the share.
+func (c *smbClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, dialTimeout)
+	if err != nil {
+		return fmt.Errorf("smb %s: %w", c.display, err)
+	}
+	c.conn, c.messageID, c.sessionID, c.treeID, c.dialect, c.signKey = conn, 0, 0, 0, 0, nil
+	if err := c.handshake(); err != nil {
+		conn.Close()
+		c.conn = nil
+		return err
+	}
+	c.gen++
+	return nil
+}
+
+func (c *smbClient) handshake() error {
+	req := make([]byte, 36)
+	binary.LittleEndian.PutUint16(req[0:], 36)
+	binary.LittleEndian.PutUint16(req[2:], uint16(len(smbDialects)))
+	binary.LittleEndian.PutUint16(req[4:], 1) // Signing enabled
+	rand.Read(req[12:28])                     // Client GUID
+	for _, d := range smbDialects {
+		req = binary.LittleEndian.AppendUint16(req, d)
+	}
+	msg, status, err := c.request(smbNegotiate, req)
+	if err != nil {
+		return fmt.Errorf("smb %s: negotiate: %w", c.display, err)
+	}
+	if status == statusNotSupported {
+		return &remoteError{msg: fmt.Sprintf("smb %s: the server speaks none of SMB 2.0.2 to 3.0.2", c.display)}
+	}
+	if status != statusSuccess || len(msg) < 64+64 {
+		return c.smbError("negotiate", status)
+	}
+	c.dialect = binary.LittleEndian.Uint16(msg[68:])
+	if !slices.Contains(smbDialects, c.dialect) {
+		return &remoteError{msg: fmt.Sprintf("smb %s: unexpected dialect 0x%04x", c.display, c.dialect)}
+	}
+	signing := binary.LittleEndian.Uint16(msg[66:])&smbSigningRequired != 0
+	c.maxRead = min(smbChunk, int(binary.LittleEndian.Uint32(msg[64+28:])), int(binary.LittleEndian.Uint32(msg[64+32:])))
+
+	// NTLM in SPNEGO, in two round trips
+	sessionSetup := func(token []byte) ([]byte, uint32, error) {
+		req := make([]byte, 24)
+		binary.LittleEndian.PutUint16(req[0:], 25)
+		req[3] = 1 // Signing enabled
+		binary.LittleEndian.PutUint16(req[12:], 64+24)
+		binary.LittleEndian.PutUint16(req[14:], uint16(len(token)))
+		return c.request(smbSessionSetup, append(req, token...))
+	}
+	msg, status, err = sessionSetup(spnegoInit(ntlmNegotiate()))
+	if err != nil {
+		return fmt.Errorf("smb %s: session setup: %w", c.display, err)
+	}
+	if status != statusMoreProcessing || len(msg) < 64+8 {
+		return c.smbError("session setup", status)
+	}
+	c.sessionID = binary.LittleEndian.Uint64(msg[40:])
+	blob, err := smbBuffer(msg, int(binary.LittleEndian.Uint16(msg[68:])), int(binary.LittleEndian.Uint16(msg[70:])))
+	if err != nil {
+		return err
+	}
+	challenge, err := spnegoToken(blob)
+	if err != nil {
+		return fmt.Errorf("smb %s: %w", c.display, err)
+	}
+	auth, sessionKey, err := ntlmAuthenticate(challenge, c.opts)
+	if err != nil {
+		return fmt.Errorf("smb %s: %w", c.display, err)
+	}
+	msg, status, err = sessionSetup(spnegoResp(auth))
+	if err != nil {
+		return fmt.Errorf("smb %s: session setup: %w", c.display, err)
+	}
+	if status != statusSuccess {
+		return c.smbError("session setup", status)
+	}
+	guest := binary.LittleEndian.Uint16(msg[66:])&(smbSessionGuest|smbSessionNull) != 0
+	if signing && !guest && sessionKey != nil {
+		c.signKey = sessionKey
+		if c.dialect >= 0x0300 {
+			c.signKey = smb3Key(sessionKey, "SMB2AESCMAC\x00", "SmbSign\x00")
+		}
+	}
+
+	path := utf16le(`\\` + c.host + `\` + c.share)
+	req = make([]byte, 8)
+	binary.LittleEndian.PutUint16(req[0:], 9)
+	binary.LittleEndian.PutUint16(req[4:], 64+8)
+	binary.LittleEndian.PutUint16(req[6:], uint16(len(path)))
+	msg, status, err = c.request(smbTreeConnect, append(req, path...))
+	if err != nil {
+		return fmt.Errorf("smb %s: tree connect: %w", c.display, err)
+	}
+	if status != statusSuccess || len(msg) < 64+16 {
+		return c.smbError("tree connect", status)
+	}
+	if binary.LittleEndian.Uint32(msg[68:])&smbShareEncrypt != 0 {
+		return &remoteError{msg: fmt.Sprintf("smb %s: the share requires encryption, which is not supported", c.display)}
+	}
+	c.treeID = binary.LittleEndian.Uint32(msg[36:])
+	return nil
+}
+
+// do runs fn on the connection, connecting first if needed. A call that
+// breaks the connection, or finds the session gone, is tried once more on
+// a new one.
+func (c *smbClient) do(fn func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for range 2 {
+		if c.conn == nil {
+			if err = c.connect(); err != nil {
+				return err
+			}
+		}
+		if err = fn(); !retryable(err) {
+			return err
+		}
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+func (c *smbClient) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// path is the name of a file in the share.
+func (c *smbClient) path(name string) string {
+	if name == "." {
+		return c.prefix
+	}
+	name = strings.ReplaceAll(name, "/", `\`)
+	if c.prefix == "" {
+		return name
+	}
+	return c.prefix + `\` + name
+}
+
+func filetime(ft uint64) time.Time {
+	if ft < filetimeEpoch {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ft-filetimeEpoch)*100)
+}
+
+func smbInfo(attrs uint32, size, mtime uint64) *fileInfo {
+	info := &fileInfo{size: int64(size), mode: 0o444, modTime: filetime(mtime)}
+	if attrs&smbAttrDirectory != 0 {
+		info.mode = fs.ModeDir | 0o555
+	}
+	return info
+}
+
+// create opens a file or folder for reading.
+func (c *smbClient) create(name string, dir bool) ([16]byte, *fileInfo, error) {
+	var id [16]byte
+	if strings.Contains(name, `\`) {
+		// A separator to SMB, but part of the name to fs.FS
+		return id, nil, &remoteError{msg: "no such file or directory", err: fs.ErrNotExist}
+	}
+	req := make([]byte, 56)
+	binary.LittleEndian.PutUint16(req[0:], 57)
+	binary.LittleEndian.PutUint32(req[4:], 2)           // Impersonation
+	binary.LittleEndian.PutUint32(req[24:], 0x00120089) // Read data, attributes and EAs, synchronize
+	binary.LittleEndian.PutUint32(req[32:], 7)          // Share read, write and delete
+	binary.LittleEndian.PutUint32(req[36:], 1)          // FILE_OPEN
+	if dir {
+		binary.LittleEndian.PutUint32(req[40:], 1) // FILE_DIRECTORY_FILE
+	}
+	p := utf16le(c.path(name))
+	binary.LittleEndian.PutUint16(req[44:], 64+56)
+	binary.LittleEndian.PutUint16(req[46:], uint16(len(p)))
+	req = append(req, p...)
+	if len(p) == 0 {
+		req = append(req, 0) // The buffer may not be empty
+	}
+	msg, status, err := c.request(smbCreate, req)
+	if err != nil {
+		return id, nil, err
+	}
+	if status != statusSuccess || len(msg) < 64+88 {
+		return id, nil, c.smbError("open", status)
+	}
+	b := msg[64:]
+	copy(id[:], b[64:80])
+	info := smbInfo(binary.LittleEndian.Uint32(b[56:]), binary.LittleEndian.Uint64(b[48:]), binary.LittleEndian.Uint64(b[24:]))
+	return id, info, nil
+}
+
+func (c *smbClient) closeFile(id [16]byte) error {
+	req := make([]byte, 24)
+	binary.LittleEndian.PutUint16(req[0:], 24)
+	copy(req[8:], id[:])
+	_, status, err := c.request(smbClose, req)
+	if err == nil && status != statusSuccess {
+		err = c.smbError("close", status)
+	}
+	return err
+}
+
+func (c *smbClient) stat(name string) (*fileInfo, error) {
+	var info *fileInfo
+	err := c.do(func() error {
+		id, i, err := c.create(name, false)
+		if err != nil {
+			return err
+		}
+		info = i
+		return c.closeFile(id)
+	})
+	return info, err
+}
+
+func (c *smbClient) readDir(name string) ([]*fileInfo, error) {
+	var infos []*fileInfo
+	err := c.do(func() error {
+		infos = nil
+		id, _, err := c.create(name, true)
+		if err != nil {
+			return err
+		}
+		defer c.closeFile(id)
+		pattern := utf16le("*")
+		for first := true; ; first = false {
+			req := make([]byte, 32)
+			binary.LittleEndian.PutUint16(req[0:], 33)
+			req[2] = 0x01 // FileDirectoryInformation
+			if first {
+				req[3] = 0x01 // Restart the scan
+			}
+			copy(req[8:], id[:])
+			binary.LittleEndian.PutUint16(req[24:], 64+32)
+			binary.LittleEndian.PutUint16(req[26:], uint16(len(pattern)))
+			binary.LittleEndian.PutUint32(req[28:], uint32(c.maxRead))
+			msg, status, err := c.request(smbQueryDirectory, append(req, pattern...))
+			if err != nil {
+				return err
+			}
+			if status == statusNoMoreFiles {
+				return nil
+			}
+			if status != statusSuccess || len(msg) < 64+8 {
+				return c.smbError("list", status)
+			}
+			buf, err := smbBuffer(msg, int(binary.LittleEndian.Uint16(msg[66:])), int(binary.LittleEndian.Uint32(msg[68:])))
+			if err != nil {
+				return err
+			}
+			for len(buf) >= 64 {
+				next := int(binary.LittleEndian.Uint32(buf))
+				n := int(binary.LittleEndian.Uint32(buf[60:]))
+				if 64+n > len(buf) {
+					return errors.New("smb: truncated directory entry")
+				}
+				entry := fromUTF16le(buf[64 : 64+n])
+				if entry != "." && entry != ".." {
+					info := smbInfo(binary.LittleEndian.Uint32(buf[56:]), binary.LittleEndian.Uint64(buf[40:]), binary.LittleEndian.Uint64(buf[24:]))
+					info.name = entry
+					infos = append(infos, info)
+				}
+				if next == 0 || next > len(buf) {
+					break
+				}
+				buf = buf[next:]
+			}
+		}
+	})
+	return infos, err
+}
+
+func (c *smbClient) open(name string) (remoteFile, *fileInfo, error) {
+	f := &smbFile{c: c, name: name}
+	var info *fileInfo
+	err := c.do(func() error {
+		var err error
+		f.id, info, err = c.create(name, false)
+		f.gen = c.gen
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	f.size = info.size
+	return f, info, nil
+}
+
+// smbFile is an open file. After a reconnection it is opened again by
+// name, as its file ID went with the old session.
+type smbFile struct {
+	c    *smbClient
+	name string
+	id   [16]byte
+	gen  int
+	size int64
+}
+
+func (f *smbFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off+int64(n) >= f.size {
+			return n, io.EOF
+		}
+		var data []byte
+		err := f.c.do(func() error {
+			if f.gen != f.c.gen {
+				id, _, err := f.c.create(f.name, false)
+				if err != nil {
+					return err
+				}
+				f.id, f.gen = id, f.c.gen
+			}
+			req := make([]byte, 49)
+			binary.LittleEndian.PutUint16(req[0:], 49)
+			req[2] = 64 + 16 // Where the data goes in the response
+			binary.LittleEndian.PutUint32(req[4:], uint32(min(len(p)-n, f.c.maxRead)))
+			binary.LittleEndian.PutUint64(req[8:], uint64(off)+uint64(n))
+			copy(req[16:], f.id[:])
+			msg, status, err := f.c.request(smbRead, req)
+			if err != nil {
+				return err
+			}
+			if status == statusEndOfFile {
+				return errEOF
+			}
+			if status != statusSuccess || len(msg) < 64+16 {
+				return f.c.smbError("read", status)
+			}
+			data, err = smbBuffer(msg, int(msg[66]), int(binary.LittleEndian.Uint32(msg[68:])))
+			return err
+		})
+		if err == errEOF || err == nil && len(data) == 0 {
+			return n, io.EOF
+		}
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data)
+	}
+	return n, nil
+}
+
+func (f *smbFile) Close() error {
+	c := f.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil || f.gen != c.gen {
+		return nil
+	}
+	return c.closeFile(f.id)
+}
@@ -0,0 +1,332 @@
+package share
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	propfindBody = `<?xml version="1.0" encoding="utf-8"?>` +
+		`<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+	// maxMultistatus bounds a PROPFIND response, a few thousand entries.
+	maxMultistatus = 16 << 20
+)
+
+// multistatus is the body of a PROPFIND response (RFC 4918 14.16).
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				Length   string `xml:"getcontentlength"`
+				Modified string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// davClient reads a WebDAV folder, such as a Nextcloud's
+// /remote.php/dav/files/{user}/.
+type davClient struct {
+	base     url.URL // Of the folder, ending in /
+	user     string
+	password string
+	cache    time.Duration
+	client   *http.Client
+	display  string
+
+	mu       sync.Mutex
+	listings map[string]davListing
+}
+
+type davListing struct {
+	infos []*fileInfo
+	at    time.Time
+}
+
+func newWebDAV(u *url.URL, opts Options) (*davClient, error) {
+	base := *u
+	base.Scheme = "https"
+	if u.Scheme == "dav" {
+		base.Scheme = "http"
+	}
+	base.User, base.RawPath, base.RawQuery, base.Fragment = nil, "", "", ""
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = callTimeout
+	return &davClient{
+		base:     base,
+		user:     opts.User,
+		password: opts.Password,
+		cache:    opts.ListCache,
+		// No timeout: file bodies stream for as long as a cast plays
+		client:   &http.Client{Transport: transport},
+		display:  u.Host + base.Path,
+		listings: make(map[string]davListing),
+	}, nil
+}
+
+func (c *davClient) url(name string) *url.URL {
+	u := c.base
+	if name != "." {
+		u.Path += name
+	}
+	return &u
+}
+
+func (c *davClient) request(ctx context.Context, method, name string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(name).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	return req, nil
+}
+
+// davError is the error of an unexpected response.
+func (c *davClient) davError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return &remoteError{msg: "no such file or directory", err: fs.ErrNotExist}
+	case http.StatusUnauthorized:
+		return &remoteError{msg: fmt.Sprintf("webdav %s: wrong user or password", c.display), err: fs.ErrPermission}
+	case http.StatusForbidden:
+		return &remoteError{msg: "access denied", err: fs.ErrPermission}
+	}
+	return &remoteError{msg: fmt.Sprintf("webdav %s: %s", c.display, resp.Status)}
+}
+
+// propfind returns the entries of name with depth "0" (itself) or "1"
+// (also its children), by their unescaped paths on the server.
+func (c *davClient) propfind(name, depth string) (map[string]*fileInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	req, err := c.request(ctx, "PROPFIND", name, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("webdav %s: %w", c.display, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, c.davError(resp)
+	}
+	var ms multistatus
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxMultistatus)).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdav %s: %w", c.display, err)
+	}
+
+	entries := make(map[string]*fileInfo, len(ms.Responses))
+	for _, r := range ms.Responses {
+		href, err := req.URL.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			info := &fileInfo{mode: 0o444}
+			if ps.Prop.ResourceType.Collection != nil {
+				info.mode = fs.ModeDir | 0o555
+			}
+			info.size, _ = strconv.ParseInt(ps.Prop.Length, 10, 64)
+			info.modTime, _ = http.ParseTime(ps.Prop.Modified)
+			p := strings.TrimSuffix(href.Path, "/")
+			info.name = path.Base(p)
+			entries[p] = info
+			break
+		}
+	}
+	return entries, nil
+}
+
+// serverPath is the unescaped path of name on the server, as PROPFIND
+// entries are keyed.
+func (c *davClient) serverPath(name string) string {
+	return strings.TrimSuffix(c.url(name).Path, "/")
+}
+
+func (c *davClient) readDir(name string) ([]*fileInfo, error) {
+	if c.cache > 0 {
+		c.mu.Lock()
+		l, ok := c.listings[name]
+		c.mu.Unlock()
+		if ok && time.Since(l.at) < c.cache {
+			return l.infos, nil
+		}
+	}
+	entries, err := c.propfind(name, "1")
+	if err != nil {
+		return nil, err
+	}
+	self := c.serverPath(name)
+	if info, ok := entries[self]; ok && !info.IsDir() {
+		return nil, &remoteError{msg: "not a directory"}
+	}
+	infos := make([]*fileInfo, 0, len(entries))
+	for p, info := range entries {
+		if p != self {
+			infos = append(infos, info)
+		}
+	}
+	if c.cache > 0 {
+		c.mu.Lock()
+		c.listings[name] = davListing{infos: infos, at: time.Now()}
+		c.mu.Unlock()
+	}
+	return infos, nil
+}
+
+func (c *davClient) stat(name string) (*fileInfo, error) {
+	if c.cache > 0 && name != "." {
+		c.mu.Lock()
+		l, ok := c.listings[path.Dir(name)]
+		c.mu.Unlock()
+		if ok && time.Since(l.at) < c.cache {
+			for _, info := range l.infos {
+				if info.name == path.Base(name) {
+					i := *info
+					return &i, nil
+				}
+			}
+			return nil, &remoteError{msg: "no such file or directory", err: fs.ErrNotExist}
+		}
+	}
+	entries, err := c.propfind(name, "0")
+	if err != nil {
+		return nil, err
+	}
+	info, ok := entries[c.serverPath(name)]
+	if !ok {
+		return nil, &remoteError{msg: "no such file or directory", err: fs.ErrNotExist}
+	}
+	return info, nil
+}
+
+func (c *davClient) open(name string) (remoteFile, *fileInfo, error) {
+	info, err := c.stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := &httpFile{
+		client:  c.client,
+		size:    info.size,
+		display: "webdav " + c.display,
+		request: func(off int64) (*http.Request, error) {
+			req, err := c.request(context.Background(), http.MethodGet, name, nil)
+			if err == nil {
+				setRange(req, off)
+			}
+			return req, err
+		},
+		fail: c.davError,
+	}
+	return f, info, nil
+}
+
+func (c *davClient) close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// httpFile reads a file with one GET from wherever it was last read, so
+// sequential reads stream; reading elsewhere starts a new ranged GET.
+type httpFile struct {
+	client  *http.Client
+	size    int64
+	display string
+	request func(off int64) (*http.Request, error) // GET from off; see setRange
+	fail    func(*http.Response) error             // Error of an unexpected response
+
+	mu   sync.Mutex
+	body io.ReadCloser
+	pos  int64 // Offset of body
+}
+
+func (f *httpFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if f.body == nil || off != f.pos {
+		if err := f.get(off); err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(f.body, p)
+	f.pos += int64(n)
+	if err != nil {
+		f.body.Close()
+		f.body = nil
+		if f.pos >= f.size {
+			return n, io.EOF
+		}
+		return n, fmt.Errorf("%s: %w", f.display, err)
+	}
+	return n, nil
+}
+
+func (f *httpFile) get(off int64) error {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	req, err := f.request(off)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.display, err)
+	}
+	if off > 0 && resp.StatusCode == http.StatusOK {
+		resp.Body.Close()
+		return &remoteError{msg: fmt.Sprintf("%s: the server does not support ranges", f.display)}
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return f.fail(resp)
+	}
+	f.body, f.pos = resp.Body, off
+	return nil
+}
+
+// setRange asks req for the bytes from off to the end of the file.
+func setRange(req *http.Request, off int64) {
+	if off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+}
+
+func (f *httpFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Dir persists each key in its own file, dir/state/<key>.json, so that a
+// busy key such as the history does not rewrite everything else, and each
+// one can be inspected with jq on its own.
+type Dir struct {
+	dir  string
+	mu   sync.Mutex
+	data map[string]json.RawMessage
+}
+
+// OpenDir loads dir/state/, creating it if needed. A dir/state.json of the
+// file backend is imported on first use. An empty dir yields an in-memory
+// store.
+func OpenDir(dir string) (*Dir, error) {
+	s := &Dir{data: make(map[string]json.RawMessage)}
+	if dir == "" {
+		return s, nil
+	}
+	s.dir = filepath.Join(dir, "state")
+
+	_, err := os.Stat(s.dir)
+	fresh := os.IsNotExist(err)
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		key, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(s.dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s.data[key] = raw
+	}
+
+	if fresh {
+		if err := s.importFile(dir); err != nil {
+			// So that the next start imports again
+			os.RemoveAll(s.dir)
+			return nil, fmt.Errorf("importing state.json: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// importFile copies the keys of a file backend in dir. A key that is not
+// a valid file name fails the import, as Set would.
+func (s *Dir) importFile(dir string) error {
+	f, err := Open(dir)
+	if err != nil {
+		return err
+	}
+	for key, raw := range f.data {
+		if !validKey(key) {
+			return fmt.Errorf("invalid store key %q", key)
+		}
+		if err := s.write(key, raw); err != nil {
+			return err
+		}
+		s.data[key] = raw
+	}
+	return nil
+}
+
+func (s *Dir) Get(key string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	raw, ok := s.data[key]
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Set stores v under key and writes its file.
+func (s *Dir) Set(key string, v interface{}) error {
+	if !validKey(key) {
+		return fmt.Errorf("invalid store key %q", key)
+	}
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = raw
+	return s.write(key, raw)
+}
+
+func (s *Dir) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.data), nil
+}
+
+func (s *Dir) write(key string, raw []byte) error {
+	if s.dir == "" {
+		return nil
+	}
+	return writeAtomic(filepath.Join(s.dir, key+".json"), raw)
+}
+
+// validKey keeps keys usable as file names.
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
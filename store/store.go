@@ -0,0 +1,139 @@
+// Package store persists the agent's state (history, presets, schedules,
+// settings...) as named JSON values.
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Store persists named JSON values.
+type Store interface {
+	// Get decodes the value stored under key into v. It reports false if
+	// the key does not exist.
+	Get(key string, v interface{}) (bool, error)
+	// Set stores v under key.
+	Set(key string, v interface{}) error
+	// List returns the stored keys, sorted.
+	List() ([]string, error)
+}
+
+// Backends accepted by OpenBackend. There is no SQLite backend, which
+// would need a driver outside the standard library: "sqlite" is rejected
+// with an error saying so rather than falling back to another backend.
+const (
+	BackendFile = "file" // One state.json, the default
+	BackendDir  = "dir"  // One JSON file per key
+)
+
+// OpenBackend opens the named backend in dir. An empty backend is
+// BackendFile; an empty dir yields an in-memory store.
+func OpenBackend(backend, dir string) (Store, error) {
+	switch backend {
+	case "", BackendFile:
+		return Open(dir)
+	case BackendDir:
+		return OpenDir(dir)
+	case "sqlite":
+		return nil, fmt.Errorf("the sqlite backend needs a SQLite driver, which this build does not include; use %q or %q", BackendFile, BackendDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// File persists named JSON values in a single state file. With an empty
+// directory it keeps everything in memory only.
+type File struct {
+	path string
+	mu   sync.Mutex
+	data map[string]json.RawMessage
+}
+
+// Open loads dir/state.json, creating dir if needed. An empty dir yields an
+// in-memory store.
+func Open(dir string) (*File, error) {
+	s := &File{data: make(map[string]json.RawMessage)}
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s.path = filepath.Join(dir, "state.json")
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *File) Get(key string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	raw, ok := s.data[key]
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Set stores v under key and writes the state file.
+func (s *File) Set(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = raw
+	return s.save()
+}
+
+func (s *File) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.data), nil
+}
+
+// save writes the state file atomically. Callers must hold s.mu.
+func (s *File) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(s.path, data)
+}
+
+// writeAtomic replaces path with data via a temporary file.
+func writeAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
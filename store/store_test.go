@@ -0,0 +1,62 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackends(t *testing.T) {
+	dir := t.TempDir()
+	file, err := OpenBackend("", dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := file.Set("presets", []string{"Radio"}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// The dir backend imports the state file on first use
+	d, err := OpenBackend(BackendDir, dir)
+	if err != nil {
+		t.Fatalf("OpenDir failed: %v", err)
+	}
+	var presets []string
+	if ok, err := d.Get("presets", &presets); !ok || err != nil || len(presets) != 1 {
+		t.Fatalf("Expected the imported presets, got %v, %v, %v", presets, ok, err)
+	}
+	if err := d.Set("history", map[string]int{"n": 1}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := d.Set("../escape", 1); err == nil {
+		t.Error("Expected an error for a key that is not a file name")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "state", "history.json")); err != nil {
+		t.Errorf("Expected a file per key: %v", err)
+	}
+
+	reopened, err := OpenDir(dir)
+	if err != nil {
+		t.Fatalf("OpenDir failed: %v", err)
+	}
+	if keys, _ := reopened.List(); strings.Join(keys, ",") != "history,presets" {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+
+	if _, err := OpenBackend("sqlite", dir); err == nil {
+		t.Error("Expected an error for the sqlite backend")
+	}
+
+	// Keys of the state file that are not file names are not imported
+	bad := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bad, "state.json"), []byte(`{"../escape": 1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDir(bad); err == nil {
+		t.Error("Expected an error importing an invalid key")
+	}
+	if _, err := os.Stat(filepath.Join(bad, "escape.json")); err == nil {
+		t.Error("Expected the invalid key not to be written outside state/")
+	}
+}
@@ -0,0 +1,128 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// HWAccel selects hardware video encoding for transcodes.
+type HWAccel string
+
+const (
+	HWNone  HWAccel = ""      // Software, libx264 and libx265
+	HWVAAPI HWAccel = "vaapi" // Intel and AMD GPUs on Linux
+	HWNVENC HWAccel = "nvenc" // NVIDIA GPUs
+	HWQSV   HWAccel = "qsv"   // Intel Quick Sync
+)
+
+// DefaultVAAPIDevice is the render node VAAPI uses unless configured.
+const DefaultVAAPIDevice = "/dev/dri/renderD128"
+
+// ParseHWAccel validates a hardware acceleration name.
+func ParseHWAccel(s string) (HWAccel, error) {
+	switch hw := HWAccel(s); hw {
+	case HWNone, HWVAAPI, HWNVENC, HWQSV:
+		return hw, nil
+	}
+	return "", fmt.Errorf("unknown hardware acceleration %q (vaapi, nvenc or qsv)", s)
+}
+
+// VideoEncoder returns the ffmpeg encoder of codec, "h264" or "hevc", for
+// hw.
+func VideoEncoder(codec string, hw HWAccel) string {
+	if hw == HWNone {
+		if codec == "hevc" {
+			return "libx265"
+		}
+		return "libx264"
+	}
+	return codec + "_" + string(hw)
+}
+
+// HWArgs returns the ffmpeg arguments that set up hw: those that go before
+// the input, which also decode on the GPU where ffmpeg can, and the filter
+// that hands frames to the encoder in a format it takes. device is the
+// VAAPI render node, default DefaultVAAPIDevice.
+func HWArgs(hw HWAccel, device string) (input []string, filter string) {
+	if device == "" {
+		device = DefaultVAAPIDevice
+	}
+	switch hw {
+	case HWVAAPI:
+		return []string{"-hwaccel", "vaapi", "-hwaccel_device", device, "-vaapi_device", device}, "format=nv12,hwupload"
+	case HWNVENC:
+		return []string{"-hwaccel", "cuda"}, "format=yuv420p"
+	case HWQSV:
+		return []string{"-init_hw_device", "qsv=hw", "-filter_hw_device", "hw"}, "format=nv12,hwupload=extra_hw_frames=64"
+	}
+	return nil, "format=yuv420p"
+}
+
+// Encoder is an H.264 or HEVC encoder of ffmpeg and whether it works here.
+type Encoder struct {
+	Name    string  `json:"name"` // e.g. "h264_vaapi"
+	Codec   string  `json:"codec"`
+	HWAccel HWAccel `json:"hwaccel,omitempty"`
+	Built   bool    `json:"built"` // ffmpeg has it
+	Works   bool    `json:"works"` // It encoded a test frame
+	Error   string  `json:"error,omitempty"`
+}
+
+// ProbeEncoders lists the software and hardware H.264 and HEVC encoders
+// of the ffmpeg at path and encodes a test frame with each one it has, as
+// a build with an encoder may still lack the GPU or driver for it.
+func ProbeEncoders(ctx context.Context, ffmpeg, device string) ([]Encoder, error) {
+	out, err := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s -encoders: %w", ffmpeg, err)
+	}
+	built := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		if f := strings.Fields(line); len(f) >= 2 && strings.HasPrefix(f[0], "V") {
+			built[f[1]] = true
+		}
+	}
+
+	var encoders []Encoder
+	for _, hw := range []HWAccel{HWNone, HWVAAPI, HWNVENC, HWQSV} {
+		for _, codec := range []string{"h264", "hevc"} {
+			name := VideoEncoder(codec, hw)
+			encoders = append(encoders, Encoder{Name: name, Codec: codec, HWAccel: hw, Built: built[name]})
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range encoders {
+		if !encoders[i].Built {
+			continue
+		}
+		wg.Add(1)
+		go func(e *Encoder) {
+			defer wg.Done()
+			input, filter := HWArgs(e.HWAccel, device)
+			args := append([]string{"-hide_banner", "-v", "error"}, input...)
+			args = append(args, "-f", "lavfi", "-i", "color=black:s=320x240:d=0.1", "-frames:v", "1", "-vf", filter, "-c:v", e.Name, "-f", "null", "-")
+			var stderr bytes.Buffer
+			cmd := exec.CommandContext(ctx, ffmpeg, args...)
+			cmd.Stderr = &stderr
+			if err := cmd.Run(); err != nil {
+				e.Error = strings.TrimSpace(firstLine(stderr.String()))
+				if e.Error == "" {
+					e.Error = err.Error()
+				}
+				return
+			}
+			e.Works = true
+		}(&encoders[i])
+	}
+	wg.Wait()
+	return encoders, nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -0,0 +1,27 @@
+package stream
+
+import "net/url"
+
+// IsRTSP reports whether rawURL is an rtsp:// or rtsps:// source, such as
+// an IP camera.
+func IsRTSP(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "rtsp" || u.Scheme == "rtsps") && u.Host != ""
+}
+
+// RTSPArgs builds the ffmpeg command line that remuxes an RTSP source to
+// MPEG-TS on stdout. The video is copied as is; the audio, often G.711 on
+// cameras, which MPEG-TS can't carry, is made AAC. lowLatency trades
+// robustness against jitter for a shorter delay: ffmpeg neither buffers
+// the input nor holds back the output.
+func RTSPArgs(source string, lowLatency bool) []string {
+	args := []string{"-rtsp_transport", "tcp"}
+	if lowLatency {
+		args = append(args, "-fflags", "nobuffer", "-flags", "low_delay", "-probesize", "32768", "-analyzeduration", "0")
+	}
+	args = append(args, "-i", source, "-map", "0:v:0?", "-map", "0:a:0?", "-c:v", "copy", "-c:a", "aac")
+	if lowLatency {
+		args = append(args, "-flush_packets", "1", "-muxdelay", "0", "-muxpreload", "0")
+	}
+	return append(args, "-f", "mpegts", "pipe:1")
+}
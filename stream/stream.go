@@ -0,0 +1,311 @@
+// Package stream runs live encoders (ffmpeg) and fans their output out to
+// HTTP clients, so renderers can play sources that are not files, such as
+// the host's screen or audio output, or an IPTV multicast.
+package stream
+
+import (
+	"bytes"
+	"dlna/didl"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	chunkSize = 32 * 1024
+	// subscriberBuffer is how many chunks a slow client may lag before it
+	// is dropped; a live stream can't wait for it.
+	subscriberBuffer = 64
+)
+
+// Live is a running encoder process.
+type Live struct {
+	ID          string `json:"id"`
+	ContentType string `json:"content_type"`
+	Device      string `json:"device,omitempty"` // USN of the renderer playing it
+
+	kill   func() // Ends the encoder or closes the source
+	mu     sync.Mutex
+	subs   map[chan []byte]struct{}
+	done   chan struct{}
+	active time.Time // Last time a client was reading
+}
+
+// Manager owns the live streams, keyed by ID.
+type Manager struct {
+	command string
+	mu      sync.Mutex
+	streams map[string]*Live
+}
+
+// NewManager creates a manager that runs command (usually "ffmpeg").
+func NewManager(command string) *Manager {
+	return &Manager{command: command, streams: make(map[string]*Live)}
+}
+
+// Start runs the encoder with args, which must write the stream to stdout.
+// An existing stream with the same id is stopped first.
+func (m *Manager) Start(id, contentType string, args []string) (*Live, error) {
+	m.Stop(id)
+
+	cmd := exec.Command(m.command, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", m.command, err)
+	}
+
+	l := m.add(id, contentType, func() { cmd.Process.Kill() })
+	go func() {
+		l.broadcast(stdout)
+		if err := cmd.Wait(); err != nil && stderr.String() != "" {
+			log.Printf("Stream %s ended: %v: %s", id, err, stderr.String())
+		}
+		m.remove(id, l)
+	}()
+
+	log.Printf("Stream %s started: %s %s", id, m.command, strings.Join(redact(args), " "))
+	return l, nil
+}
+
+// StartSource streams what src yields, such as a multicast joined with
+// OpenUDP, rather than an encoder's output. Stop closes src, and so does
+// the stream itself once no client has read it for idle. An existing
+// stream with the same id is stopped first.
+func (m *Manager) StartSource(id, contentType string, src io.ReadCloser, idle time.Duration) *Live {
+	m.Stop(id)
+
+	l := m.add(id, contentType, func() { src.Close() })
+	go func() {
+		l.broadcast(src)
+		m.remove(id, l)
+	}()
+	m.StopWhenIdle(l, idle)
+	return l
+}
+
+// StopWhenIdle stops l once no client has read it for idle, so relays of
+// cameras and multicasts do not run on after the renderer has moved on.
+func (m *Manager) StopWhenIdle(l *Live, idle time.Duration) {
+	go func() {
+		ticker := time.NewTicker(idle / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-ticker.C:
+				if l.idleFor() > idle {
+					log.Printf("Stream %s stopped: no client for %s", l.ID, idle)
+					m.remove(l.ID, l)
+					l.kill()
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (m *Manager) add(id, contentType string, kill func()) *Live {
+	l := &Live{
+		ID:          id,
+		ContentType: contentType,
+		kill:        kill,
+		subs:        make(map[chan []byte]struct{}),
+		done:        make(chan struct{}),
+		active:      time.Now(),
+	}
+	m.mu.Lock()
+	m.streams[id] = l
+	m.mu.Unlock()
+	return l
+}
+
+func (m *Manager) remove(id string, l *Live) {
+	m.mu.Lock()
+	if m.streams[id] == l {
+		delete(m.streams, id)
+	}
+	m.mu.Unlock()
+}
+
+// Stop kills the stream's encoder. It reports whether the stream existed.
+func (m *Manager) Stop(id string) bool {
+	m.mu.Lock()
+	l, ok := m.streams[id]
+	delete(m.streams, id)
+	m.mu.Unlock()
+	if !ok {
+		return false
+	}
+	l.kill()
+	<-l.done
+	return true
+}
+
+// Get returns the running stream with id, or nil.
+func (m *Manager) Get(id string) *Live {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+// ServeHTTP serves the stream named by the {id} path value to a renderer.
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if i := strings.LastIndexByte(id, '.'); i > 0 {
+		id = id[:i] // Renderers like an extension: /stream/screen.ts
+	}
+	l := m.Get(id)
+	if l == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", l.ContentType)
+	w.Header().Set("transferMode.dlna.org", "Streaming")
+	// Not seekable, live content
+	w.Header().Set("contentFeatures.dlna.org", didl.ContentFeatures("00", didl.FlagsStreaming))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	ch := l.subscribe()
+	defer l.unsubscribe(ch)
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case chunk, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (l *Live) subscribe() chan []byte {
+	ch := make(chan []byte, subscriberBuffer)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.done:
+		close(ch)
+	default:
+		l.subs[ch] = struct{}{}
+	}
+	return ch
+}
+
+// idleFor is how long no client has been reading, 0 while one is.
+func (l *Live) idleFor() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.subs) > 0 {
+		return 0
+	}
+	return time.Since(l.active)
+}
+
+func (l *Live) unsubscribe(ch chan []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.subs[ch]; ok {
+		delete(l.subs, ch)
+		close(ch)
+	}
+	l.active = time.Now()
+}
+
+// broadcast copies the encoder output to every subscriber until EOF.
+func (l *Live) broadcast(r io.Reader) {
+	defer func() {
+		l.mu.Lock()
+		for ch := range l.subs {
+			close(ch)
+		}
+		l.subs = nil
+		close(l.done)
+		l.mu.Unlock()
+	}()
+
+	for {
+		buf := make([]byte, chunkSize)
+		n, err := r.Read(buf)
+		if n > 0 {
+			l.mu.Lock()
+			if len(l.subs) > 0 {
+				l.active = time.Now()
+			}
+			for ch := range l.subs {
+				select {
+				case ch <- buf[:n]:
+				default:
+					// Too slow; drop it rather than stall everyone
+					delete(l.subs, ch)
+					close(ch)
+				}
+			}
+			l.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// redact hides the passwords of URL arguments, such as a camera's, for
+// logs.
+func redact(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = arg
+		if u, err := url.Parse(arg); err == nil && u.User != nil {
+			out[i] = u.Redacted()
+		}
+	}
+	return out
+}
+
+// tailBuffer keeps the last few KB of encoder stderr for error logs.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf.Write(p)
+	if t.buf.Len() > 4096 {
+		t.buf.Next(t.buf.Len() - 4096)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := strings.TrimSpace(t.buf.String())
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		s = s[i+1:]
+	}
+	return s
+}
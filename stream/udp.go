@@ -0,0 +1,155 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	// defaultUDPPort is VLC's, for udp://@239.0.0.1 without a port.
+	defaultUDPPort = "1234"
+	// udpGather is how long Read waits for more datagrams once it has
+	// one, so clients get chunks of a few KB rather than one per packet.
+	udpGather  = 20 * time.Millisecond
+	tsSyncByte = 0x47
+)
+
+// IsUDP reports whether rawURL is a udp:// or rtp:// source, as IPTV
+// multicasts are given to VLC.
+func IsUDP(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "udp" || u.Scheme == "rtp")
+}
+
+// udpSource reads an MPEG-TS carried in UDP datagrams, directly or in RTP.
+type udpSource struct {
+	conn    *net.UDPConn
+	rtp     bool
+	buf     []byte
+	pending []byte // Payload of a datagram that did not fit the last Read
+}
+
+// OpenUDP receives the MPEG-TS of a udp:// or rtp:// URL such as
+// udp://@239.0.0.1:1234, joining the multicast group if the host is one
+// (on the interface named by ?iface=, else the system's default). Without
+// a host, or with a local address, it listens for unicast on the port.
+// The payload of udp:// datagrams that turn out to be RTP is unwrapped too.
+func OpenUDP(rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" && u.Scheme != "rtp" {
+		return nil, fmt.Errorf("not a udp:// or rtp:// URL: %s", rawURL)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultUDPPort
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *net.UDPConn
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if name := u.Query().Get("iface"); name != "" {
+			if ifi, err = net.InterfaceByName(name); err != nil {
+				return nil, err
+			}
+		}
+		network := "udp4"
+		if addr.IP.To4() == nil {
+			network = "udp6"
+		}
+		conn, err = net.ListenMulticastUDP(network, ifi, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive %s: %w", rawURL, err)
+	}
+	// A burst of an HD channel easily overflows the default buffer
+	conn.SetReadBuffer(4 << 20)
+	return &udpSource{conn: conn, rtp: u.Scheme == "rtp", buf: make([]byte, 64*1024)}, nil
+}
+
+// Read returns the TS payload of one or more datagrams.
+func (s *udpSource) Read(p []byte) (int, error) {
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	if len(s.pending) > 0 {
+		return n, nil
+	}
+
+	s.conn.SetReadDeadline(time.Time{})
+	for n < len(p) {
+		if n > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(udpGather))
+		}
+		size, err := s.conn.Read(s.buf)
+		if err != nil {
+			if n > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+				return n, nil
+			}
+			return n, err
+		}
+		payload := s.payload(s.buf[:size])
+		copied := copy(p[n:], payload)
+		n += copied
+		if copied < len(payload) {
+			s.pending = append(s.pending[:0], payload[copied:]...)
+			break
+		}
+	}
+	return n, nil
+}
+
+// payload strips the RTP header of rtp:// datagrams, and of udp:// ones
+// that do not start with a TS packet but carry one in RTP.
+func (s *udpSource) payload(b []byte) []byte {
+	if s.rtp {
+		p, _ := rtpPayload(b)
+		return p
+	}
+	if len(b) > 0 && b[0] != tsSyncByte {
+		if p, ok := rtpPayload(b); ok && len(p) > 0 && p[0] == tsSyncByte {
+			return p
+		}
+	}
+	return b
+}
+
+func (s *udpSource) Close() error {
+	return s.conn.Close()
+}
+
+// rtpPayload returns the payload of an RTP packet (RFC 3550), skipping
+// the CSRCs, header extension and padding.
+func rtpPayload(b []byte) ([]byte, bool) {
+	if len(b) < 12 || b[0]>>6 != 2 {
+		return nil, false
+	}
+	start := 12 + int(b[0]&0x0f)*4
+	if b[0]&0x10 != 0 {
+		if len(b) < start+4 {
+			return nil, false
+		}
+		start += 4 + int(binary.BigEndian.Uint16(b[start+2:]))*4
+	}
+	end := len(b)
+	if b[0]&0x20 != 0 {
+		end -= int(b[end-1])
+	}
+	if start > end {
+		return nil, false
+	}
+	return b[start:end], true
+}
@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+var errBencode = errors.New("invalid bencoding")
+
+// maxBencodeDepth bounds the nesting of decoded values.
+const maxBencodeDepth = 32
+
+// decode parses the bencoded value at the start of b, returning it as an
+// int64, string, []any or map[string]any, and the bytes after it.
+func decode(b []byte) (any, []byte, error) {
+	return decodeValue(b, 0)
+}
+
+func decodeValue(b []byte, depth int) (any, []byte, error) {
+	if len(b) == 0 || depth > maxBencodeDepth {
+		return nil, nil, errBencode
+	}
+	switch c := b[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(b, 'e')
+		if end < 0 {
+			return nil, nil, errBencode
+		}
+		n, err := strconv.ParseInt(string(b[1:end]), 10, 64)
+		if err != nil {
+			return nil, nil, errBencode
+		}
+		return n, b[end+1:], nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b, ':')
+		if colon < 0 {
+			return nil, nil, errBencode
+		}
+		n, err := strconv.Atoi(string(b[:colon]))
+		if err != nil || n < 0 || n > len(b)-colon-1 {
+			return nil, nil, errBencode
+		}
+		return string(b[colon+1 : colon+1+n]), b[colon+1+n:], nil
+	case c == 'l':
+		list := []any{}
+		b = b[1:]
+		for len(b) > 0 && b[0] != 'e' {
+			v, rest, err := decodeValue(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			list, b = append(list, v), rest
+		}
+		if len(b) == 0 {
+			return nil, nil, errBencode
+		}
+		return list, b[1:], nil
+	case c == 'd':
+		dict := map[string]any{}
+		b = b[1:]
+		for len(b) > 0 && b[0] != 'e' {
+			k, rest, err := decodeValue(b, depth+1)
+			key, ok := k.(string)
+			if err != nil || !ok {
+				return nil, nil, errBencode
+			}
+			v, rest, err := decodeValue(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			dict[key], b = v, rest
+		}
+		if len(b) == 0 {
+			return nil, nil, errBencode
+		}
+		return dict, b[1:], nil
+	}
+	return nil, nil, errBencode
+}
+
+// encode bencodes v, made of ints, strings, []any and map[string]any.
+func encode(v any) []byte {
+	var b []byte
+	switch v := v.(type) {
+	case int:
+		b = fmt.Appendf(b, "i%de", v)
+	case int64:
+		b = fmt.Appendf(b, "i%de", v)
+	case string:
+		b = fmt.Appendf(b, "%d:%s", len(v), v)
+	case []any:
+		b = append(b, 'l')
+		for _, e := range v {
+			b = append(b, encode(e)...)
+		}
+		b = append(b, 'e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		b = append(b, 'd')
+		for _, k := range keys {
+			b = append(b, encode(k)...)
+			b = append(b, encode(v[k])...)
+		}
+		b = append(b, 'e')
+	default:
+		panic(fmt.Sprintf("torrent: can't bencode %T", v))
+	}
+	return b
+}
+
+// dictInt and dictString read typed values of a decoded dictionary.
+func dictInt(d map[string]any, key string) (int64, bool) {
+	n, ok := d[key].(int64)
+	return n, ok
+}
+
+func dictString(d map[string]any, key string) (string, bool) {
+	s, ok := d[key].(string)
+	return s, ok
+}
@@ -0,0 +1,154 @@
+// Package torrent streams files of magnet links: it fetches the metadata
+// from peers (BEP 9) found through HTTP and UDP trackers, then downloads
+// pieces in the order they are read. There is no DHT, so magnet links
+// need trackers, in the link or configured, and nothing is uploaded.
+package torrent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultIdle is how long a torrent is kept without readers.
+const DefaultIdle = 10 * time.Minute
+
+// Config configures a Client.
+type Config struct {
+	// Dir holds the downloads, one sparse file per torrent deleted with
+	// it. The default is dlnagent-torrents in the temporary folder.
+	Dir string
+	// Trackers are announced to as well as those of each magnet link.
+	Trackers []string
+	// Idle is how long a torrent is kept without readers, DefaultIdle
+	// if zero.
+	Idle time.Duration
+}
+
+// Client downloads torrents, one per info hash.
+type Client struct {
+	peerID [20]byte
+
+	mu       sync.Mutex
+	cfg      Config
+	torrents map[string]*Torrent // By hex info hash
+	janitor  bool
+}
+
+// NewClient returns a client with no torrents.
+func NewClient(cfg Config) *Client {
+	c := &Client{torrents: make(map[string]*Torrent)}
+	copy(c.peerID[:], "-DA0001-")
+	rand.Read(c.peerID[8:])
+	c.SetConfig(cfg)
+	return c
+}
+
+// SetConfig replaces the configuration. Torrents already added keep their
+// folder and trackers.
+func (c *Client) SetConfig(cfg Config) {
+	if cfg.Dir == "" {
+		cfg.Dir = filepath.Join(os.TempDir(), "dlnagent-torrents")
+	}
+	if cfg.Idle <= 0 {
+		cfg.Idle = DefaultIdle
+	}
+	c.mu.Lock()
+	c.cfg = cfg
+	c.mu.Unlock()
+}
+
+// Add starts downloading the torrent of m, or returns the one already
+// running for its info hash.
+func (c *Client) Add(m Magnet) (*Torrent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hash := hex.EncodeToString(m.InfoHash[:])
+	if t := c.torrents[hash]; t != nil {
+		t.mu.Lock()
+		t.lastUsed = time.Now()
+		t.mu.Unlock()
+		return t, nil
+	}
+	trackers := slices.Clone(m.Trackers)
+	for _, tr := range c.cfg.Trackers {
+		if !slices.Contains(trackers, tr) {
+			trackers = append(trackers, tr)
+		}
+	}
+	if len(trackers) == 0 {
+		return nil, errors.New("magnet link has no trackers, and none are configured (DHT is not supported)")
+	}
+	t := newTorrent(c, m, trackers)
+	c.torrents[hash] = t
+	if !c.janitor {
+		c.janitor = true
+		go c.dropIdle()
+	}
+	log.Printf("Torrent %s: added %q with %d trackers", hash, m.Name, len(trackers))
+	return t, nil
+}
+
+// Get returns the torrent with the hex info hash, or nil.
+func (c *Client) Get(hash string) *Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.torrents[strings.ToLower(hash)]
+}
+
+// List returns the progress of every torrent.
+func (c *Client) List() []Stats {
+	c.mu.Lock()
+	torrents := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+	c.mu.Unlock()
+	stats := make([]Stats, len(torrents))
+	for i, t := range torrents {
+		stats[i] = t.Stats()
+	}
+	slices.SortFunc(stats, func(a, b Stats) int { return strings.Compare(a.Name, b.Name) })
+	return stats
+}
+
+// Drop stops the torrent with the hex info hash and deletes its data,
+// reporting whether it was running. Its readers fail.
+func (c *Client) Drop(hash string) bool {
+	hash = strings.ToLower(hash)
+	c.mu.Lock()
+	t := c.torrents[hash]
+	delete(c.torrents, hash)
+	c.mu.Unlock()
+	if t == nil {
+		return false
+	}
+	t.close()
+	log.Printf("Torrent %s: dropped", hash)
+	return true
+}
+
+// dropIdle drops torrents that have had no readers for the idle time.
+func (c *Client) dropIdle() {
+	for range time.Tick(time.Minute) {
+		c.mu.Lock()
+		idle := c.cfg.Idle
+		var hashes []string
+		for hash, t := range c.torrents {
+			if since, ok := t.idleSince(); ok && time.Since(since) > idle {
+				hashes = append(hashes, hash)
+			}
+		}
+		c.mu.Unlock()
+		for _, hash := range hashes {
+			c.Drop(hash)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Magnet is a parsed magnet link.
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string   // Display name, if given
+	Trackers []string // http(s):// and udp:// announce URLs
+}
+
+// IsMagnet reports whether s is a magnet link.
+func IsMagnet(s string) bool {
+	return strings.HasPrefix(s, "magnet:?")
+}
+
+// ParseMagnet parses a magnet link with a BitTorrent v1 info hash
+// (xt=urn:btih:, in hex or base32).
+func ParseMagnet(s string) (Magnet, error) {
+	var m Magnet
+	rawQuery, ok := strings.CutPrefix(s, "magnet:?")
+	if !ok {
+		return m, errors.New("not a magnet link")
+	}
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return m, errors.New("invalid magnet link")
+	}
+	found := false
+	for _, xt := range q["xt"] {
+		h, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		var hash []byte
+		switch len(h) {
+		case 40:
+			hash, err = hex.DecodeString(h)
+		case 32:
+			hash, err = base32.StdEncoding.DecodeString(strings.ToUpper(h))
+		default:
+			err = errors.New("bad length")
+		}
+		if err != nil {
+			return m, errors.New("invalid info hash in magnet link")
+		}
+		copy(m.InfoHash[:], hash)
+		found = true
+		break
+	}
+	if !found {
+		return m, errors.New("magnet link has no BitTorrent info hash (xt=urn:btih:)")
+	}
+	m.Name = q.Get("dn")
+	for _, tr := range q["tr"] {
+		if strings.HasPrefix(tr, "http://") || strings.HasPrefix(tr, "https://") || strings.HasPrefix(tr, "udp://") {
+			m.Trackers = append(m.Trackers, tr)
+		}
+	}
+	return m, nil
+}
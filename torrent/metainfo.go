@@ -0,0 +1,118 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"path"
+	"strings"
+)
+
+// File is a file of a torrent.
+type File struct {
+	Path   string // Slash-separated, within the torrent
+	Length int64
+	offset int64 // Of its first byte in the concatenated files
+}
+
+// info is the info dictionary of a torrent, which magnet links leave to be
+// fetched from peers.
+type info struct {
+	name        string
+	pieceLength int64
+	pieces      [][20]byte
+	files       []File
+	length      int64 // Of all files
+}
+
+// maxPieceLength bounds the pieces of torrents, which are buffered whole.
+const maxPieceLength = 32 << 20
+
+// parseInfo parses the bencoded info dictionary b, checking it against
+// infoHash.
+func parseInfo(b []byte, infoHash [20]byte) (*info, error) {
+	if sha1.Sum(b) != infoHash {
+		return nil, errors.New("metadata does not match the info hash")
+	}
+	v, rest, err := decode(b)
+	d, ok := v.(map[string]any)
+	if err != nil || !ok || len(rest) > 0 {
+		return nil, errors.New("invalid metadata")
+	}
+	in := &info{}
+	in.name, _ = dictString(d, "name")
+	in.pieceLength, _ = dictInt(d, "piece length")
+	if in.pieceLength <= 0 || in.pieceLength > maxPieceLength {
+		return nil, errors.New("invalid piece length")
+	}
+	hashes, _ := dictString(d, "pieces")
+	if len(hashes) == 0 || len(hashes)%20 != 0 {
+		return nil, errors.New("invalid piece hashes")
+	}
+	for i := 0; i < len(hashes); i += 20 {
+		in.pieces = append(in.pieces, [20]byte([]byte(hashes[i:i+20])))
+	}
+
+	if length, ok := dictInt(d, "length"); ok {
+		in.files = []File{{Path: cleanPath([]string{in.name}), Length: length}}
+	} else {
+		list, _ := d["files"].([]any)
+		for _, e := range list {
+			fd, _ := e.(map[string]any)
+			length, ok := dictInt(fd, "length")
+			parts, _ := fd["path"].([]any)
+			var elems []string
+			for _, p := range parts {
+				if s, ok := p.(string); ok {
+					elems = append(elems, s)
+				}
+			}
+			if !ok || len(elems) == 0 {
+				return nil, errors.New("invalid file list")
+			}
+			in.files = append(in.files, File{Path: cleanPath(append([]string{in.name}, elems...)), Length: length})
+		}
+	}
+	for i := range in.files {
+		if in.files[i].Length < 0 {
+			return nil, errors.New("invalid file length")
+		}
+		in.files[i].offset = in.length
+		in.length += in.files[i].Length
+	}
+	if n := (in.length + in.pieceLength - 1) / in.pieceLength; n != int64(len(in.pieces)) {
+		return nil, errors.New("piece count does not match the file sizes")
+	}
+	return in, nil
+}
+
+// cleanPath joins path elements from a torrent, dropping empty, "." and
+// ".." elements so a file can't escape the torrent.
+func cleanPath(elems []string) string {
+	var out []string
+	for _, e := range elems {
+		e = strings.ReplaceAll(e, "/", "_")
+		if e != "" && e != "." && e != ".." {
+			out = append(out, e)
+		}
+	}
+	if len(out) == 0 {
+		return "unnamed"
+	}
+	return path.Join(out...)
+}
+
+// pieceSize is the length of piece i, the last one being shorter.
+func (in *info) pieceSize(i int) int64 {
+	if i == len(in.pieces)-1 {
+		return in.length - int64(i)*in.pieceLength
+	}
+	return in.pieceLength
+}
+
+// pieceSpan is the first and last piece holding bytes of f.
+func (in *info) pieceSpan(f File) (int, int) {
+	n := len(in.pieces) - 1
+	first := int(f.offset / in.pieceLength)
+	last := int((f.offset + max(f.Length, 1) - 1) / in.pieceLength)
+	return min(first, n), min(last, n)
+}
@@ -0,0 +1,461 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const protocolName = "BitTorrent protocol"
+
+// Peer wire message IDs (BEP 3, BEP 10).
+const (
+	msgChoke      = 0
+	msgUnchoke    = 1
+	msgInterested = 2
+	msgHave       = 4
+	msgBitfield   = 5
+	msgRequest    = 6
+	msgPiece      = 7
+	msgExtended   = 20
+)
+
+const (
+	// blockSize is how much is requested from a peer at once.
+	blockSize = 16 << 10
+	// maxPending bounds the block requests outstanding with one peer.
+	maxPending = 32
+	// maxMessage bounds a peer wire message; the largest are pieces of one
+	// block and metadata pieces.
+	maxMessage = 1<<17 + 64
+	// maxMetadataSize bounds the info dictionary fetched from peers.
+	maxMetadataSize = 8 << 20
+	// metadataPieceSize is the unit of ut_metadata transfers (BEP 9).
+	metadataPieceSize = 16 << 10
+
+	dialTimeout = 10 * time.Second
+	// peerReadTimeout drops peers that don't even send keep-alives.
+	peerReadTimeout = 3 * time.Minute
+	// keepAlive is how often an otherwise silent connection sends one.
+	keepAlive = time.Minute
+	// snubTimeout drops peers that stop sending the blocks they were
+	// asked for.
+	snubTimeout = time.Minute
+	// maxBadPieces drops peers sending pieces that fail verification.
+	maxBadPieces = 3
+
+	// extMetadata is our extended message ID for ut_metadata.
+	extMetadata = 1
+)
+
+// message is a peer wire message; a nil one is a keep-alive.
+type message struct {
+	id      byte
+	payload []byte
+}
+
+// handshake exchanges the BitTorrent handshake on conn, announcing the
+// extension protocol, and reports whether the peer speaks it too.
+func handshake(conn net.Conn, infoHash, peerID [20]byte) (bool, error) {
+	var reserved [8]byte
+	reserved[5] |= 0x10 // BEP 10 extension protocol
+	hs := append([]byte{byte(len(protocolName))}, protocolName...)
+	hs = append(hs, reserved[:]...)
+	hs = append(hs, infoHash[:]...)
+	hs = append(hs, peerID[:]...)
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(hs); err != nil {
+		return false, err
+	}
+	resp := make([]byte, len(hs))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(resp[:20], hs[:20]) {
+		return false, errors.New("not a BitTorrent peer")
+	}
+	if [20]byte(resp[28:48]) != infoHash {
+		return false, errors.New("peer has another torrent")
+	}
+	return resp[25]&0x10 != 0, nil
+}
+
+func readMessage(r io.Reader) (*message, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n == 0 {
+		return nil, nil
+	}
+	if n > maxMessage {
+		return nil, fmt.Errorf("peer sent a %d byte message", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return &message{id: b[0], payload: b[1:]}, nil
+}
+
+// appendMessage appends the framed message id with payload to b.
+func appendMessage(b []byte, id byte, payload ...[]byte) []byte {
+	n := 1
+	for _, p := range payload {
+		n += len(p)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(n))
+	b = append(b, id)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// appendRequest appends a request for length bytes at begin of piece.
+func appendRequest(b []byte, piece, begin, length int) []byte {
+	var p [12]byte
+	binary.BigEndian.PutUint32(p[0:], uint32(piece))
+	binary.BigEndian.PutUint32(p[4:], uint32(begin))
+	binary.BigEndian.PutUint32(p[8:], uint32(length))
+	return appendMessage(b, msgRequest, p[:])
+}
+
+// appendExtended appends a BEP 10 message with the bencoded dict d.
+func appendExtended(b []byte, ext byte, d map[string]any) []byte {
+	return appendMessage(b, msgExtended, []byte{ext}, encode(d))
+}
+
+// peer is a connection to another client, and what the torrent asked of
+// it. Its fields belong to the torrent's lock, except conn, which only the
+// peer's goroutine writes to.
+type peer struct {
+	addr netip.AddrPort
+	conn net.Conn
+	wake chan struct{}
+
+	has        []bool // Pieces the peer announced
+	choked     bool   // Whether the peer refuses our requests
+	utMetadata byte   // The peer's ut_metadata ID, 0 if it has none
+	metaAsked  bool
+
+	// The piece being downloaded from the peer, or -1
+	piece    int
+	buf      []byte
+	got      []bool // By block
+	received int    // Blocks in got
+	next     int    // Block to request next
+	pending  int    // Requests outstanding
+	lastData time.Time
+	bad      int // Pieces failing verification
+}
+
+func (p *peer) hasPiece(i int) bool {
+	return i < len(p.has) && p.has[i]
+}
+
+func (p *peer) setHas(i int) {
+	if i < 0 || i >= 1<<20 {
+		return
+	}
+	for len(p.has) <= i {
+		p.has = append(p.has, false)
+	}
+	p.has[i] = true
+}
+
+// notify makes the peer's goroutine look for work, e.g. once the
+// metadata is in or a reader moved.
+func (p *peer) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// connect dials addr and exchanges messages with it until it fails or the
+// torrent is dropped.
+func (t *Torrent) connect(addr netip.AddrPort) {
+	defer func() {
+		t.mu.Lock()
+		t.dialing--
+		t.mu.Unlock()
+	}()
+	conn, err := net.DialTimeout("tcp", addr.String(), dialTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	ext, err := handshake(conn, t.infoHash, t.client.peerID)
+	if err != nil {
+		return
+	}
+
+	p := &peer{addr: addr, conn: conn, wake: make(chan struct{}, 1), choked: true, piece: -1}
+	t.mu.Lock()
+	if t.peers == nil {
+		t.mu.Unlock()
+		return
+	}
+	t.peers[p] = true
+	t.mu.Unlock()
+	defer t.removePeer(p)
+
+	var out []byte
+	if ext {
+		out = appendExtended(out, 0, map[string]any{
+			"m": map[string]any{"ut_metadata": extMetadata},
+			"v": "dlnagent",
+		})
+	}
+	out = appendMessage(out, msgInterested)
+	if _, err := conn.Write(out); err != nil {
+		return
+	}
+
+	msgs := make(chan *message)
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			conn.SetReadDeadline(time.Now().Add(peerReadTimeout))
+			m, err := readMessage(conn)
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case msgs <- m:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	tick := time.NewTicker(keepAlive)
+	defer tick.Stop()
+	for {
+		out = out[:0]
+		select {
+		case m := <-msgs:
+			if err := t.handleMessage(p, m); err != nil {
+				return
+			}
+		case <-p.wake:
+		case <-tick.C:
+			t.mu.Lock()
+			snubbed := p.piece >= 0 && !p.choked && time.Since(p.lastData) > snubTimeout
+			t.mu.Unlock()
+			if snubbed {
+				return
+			}
+			out = binary.BigEndian.AppendUint32(out, 0)
+		case <-errc:
+			return
+		case <-t.ctx.Done():
+			return
+		}
+		finished := t.service(p, &out)
+		if len(out) > 0 {
+			conn.SetWriteDeadline(time.Now().Add(peerReadTimeout))
+			if _, err := conn.Write(out); err != nil {
+				return
+			}
+		}
+		if finished && !t.finishPiece(p) {
+			return
+		}
+	}
+}
+
+// handleMessage applies a message from p.
+func (t *Torrent) handleMessage(p *peer, m *message) error {
+	if m == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch m.id {
+	case msgChoke:
+		p.choked = true
+		t.releaseLocked(p)
+	case msgUnchoke:
+		p.choked = false
+	case msgHave:
+		if len(m.payload) == 4 {
+			p.setHas(int(binary.BigEndian.Uint32(m.payload)))
+		}
+	case msgBitfield:
+		for i := range len(m.payload) * 8 {
+			if m.payload[i/8]&(0x80>>(i%8)) != 0 {
+				p.setHas(i)
+			}
+		}
+	case msgPiece:
+		if len(m.payload) < 8 {
+			return errors.New("short piece message")
+		}
+		t.blockLocked(p, int(binary.BigEndian.Uint32(m.payload)), int(binary.BigEndian.Uint32(m.payload[4:])), m.payload[8:])
+	case msgExtended:
+		if len(m.payload) == 0 {
+			return errors.New("short extended message")
+		}
+		v, rest, err := decode(m.payload[1:])
+		d, ok := v.(map[string]any)
+		if err != nil || !ok {
+			return errors.New("invalid extended message")
+		}
+		switch m.payload[0] {
+		case 0:
+			exts, _ := d["m"].(map[string]any)
+			id, _ := dictInt(exts, "ut_metadata")
+			if id > 0 && id < 256 {
+				p.utMetadata = byte(id)
+			}
+			if size, ok := dictInt(d, "metadata_size"); ok && t.metaSize == 0 && size > 0 && size <= maxMetadataSize {
+				t.metaSize = int(size)
+				t.metaHave = make([]bool, (t.metaSize+metadataPieceSize-1)/metadataPieceSize)
+				t.meta = make([]byte, t.metaSize)
+			}
+		case extMetadata:
+			t.metadataLocked(d, rest)
+		}
+	}
+	return nil
+}
+
+// blockLocked stores a block of p's piece.
+func (t *Torrent) blockLocked(p *peer, index, begin int, data []byte) {
+	if index != p.piece || begin%blockSize != 0 || begin/blockSize >= len(p.got) {
+		return // Late, after a choke or for a piece given up
+	}
+	b := begin / blockSize
+	if len(data) != min(blockSize, len(p.buf)-begin) {
+		return
+	}
+	p.lastData = time.Now()
+	p.pending = max(p.pending-1, 0)
+	t.downloaded += int64(len(data))
+	if !p.got[b] {
+		copy(p.buf[begin:], data)
+		p.got[b] = true
+		p.received++
+	}
+}
+
+// metadataLocked stores a ut_metadata piece.
+func (t *Torrent) metadataLocked(d map[string]any, data []byte) {
+	msgType, _ := dictInt(d, "msg_type")
+	piece, _ := dictInt(d, "piece")
+	total, _ := dictInt(d, "total_size")
+	if msgType != 1 || t.info != nil || t.metaSize == 0 || int(total) != t.metaSize ||
+		piece < 0 || int(piece) >= len(t.metaHave) || t.metaHave[piece] {
+		return
+	}
+	off := int(piece) * metadataPieceSize
+	if len(data) != min(metadataPieceSize, t.metaSize-off) {
+		return
+	}
+	copy(t.meta[off:], data)
+	t.metaHave[piece] = true
+	for _, ok := range t.metaHave {
+		if !ok {
+			return
+		}
+	}
+	in, err := parseInfo(t.meta, t.infoHash)
+	if err != nil {
+		// Start over, maybe with the size another peer gives
+		t.metaSize, t.meta, t.metaHave = 0, nil, nil
+		return
+	}
+	t.setInfoLocked(in)
+}
+
+// service queues what p should be sent next into out: metadata requests
+// until the info dictionary is in, then block requests for a piece. It
+// reports whether all blocks of p's piece are in.
+func (t *Torrent) service(p *peer, out *[]byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.info == nil {
+		if p.utMetadata != 0 && t.metaSize > 0 && !p.metaAsked {
+			for i, ok := range t.metaHave {
+				if !ok {
+					*out = appendExtended(*out, p.utMetadata, map[string]any{"msg_type": 0, "piece": i})
+				}
+			}
+			p.metaAsked = true
+		}
+		return false
+	}
+	if p.piece >= 0 && p.received == len(p.got) {
+		return true
+	}
+	if p.choked {
+		return false
+	}
+	if p.piece < 0 {
+		i := t.pickLocked(p)
+		if i < 0 {
+			return false
+		}
+		size := int(t.info.pieceSize(i))
+		p.piece, p.buf = i, make([]byte, size)
+		p.got = make([]bool, (size+blockSize-1)/blockSize)
+		p.received, p.next, p.pending = 0, 0, 0
+		p.lastData = time.Now()
+		t.busyLocked(i, 1)
+	}
+	for ; p.next < len(p.got) && p.pending < maxPending; p.next++ {
+		if !p.got[p.next] {
+			begin := p.next * blockSize
+			*out = appendRequest(*out, p.piece, begin, min(blockSize, len(p.buf)-begin))
+			p.pending++
+		}
+	}
+	return false
+}
+
+// finishPiece verifies and stores p's completed piece, reporting false if
+// p should be dropped for sending too many bad pieces.
+func (t *Torrent) finishPiece(p *peer) bool {
+	t.mu.Lock()
+	i, buf := p.piece, p.buf
+	t.releaseLocked(p)
+	done := t.have[i]
+	t.mu.Unlock()
+	if done {
+		return true // Another peer was quicker
+	}
+
+	if sha1.Sum(buf) != t.info.pieces[i] {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		p.bad++
+		p.notify() // Nothing else makes it ask for the next piece
+		return p.bad < maxBadPieces
+	}
+	if err := t.writePiece(i, buf); err != nil {
+		t.fail(err)
+		return false
+	}
+	t.mu.Lock()
+	if !t.have[i] {
+		t.have[i] = true
+		t.completed += int64(len(buf))
+	}
+	t.cond.Broadcast()
+	t.mu.Unlock()
+	p.notify()
+	return true
+}
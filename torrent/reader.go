@@ -0,0 +1,109 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"time"
+)
+
+// Reader reads a file of a torrent while it downloads. Reads wait for the
+// pieces they need, which are fetched before all others.
+type Reader struct {
+	t    *Torrent
+	file File
+	ctx  context.Context
+	stop func() bool
+	pos  int64 // Guarded by the torrent's lock
+}
+
+// NewReader opens f for reading until ctx is done, or Close. The torrent
+// must have its metadata.
+func (t *Torrent) NewReader(ctx context.Context, f File) *Reader {
+	r := &Reader{t: t, file: f, ctx: ctx}
+	r.stop = context.AfterFunc(ctx, t.wakeReaders)
+	t.mu.Lock()
+	t.readers = append(t.readers, r)
+	t.lastUsed = time.Now()
+	for p := range t.peers {
+		p.notify()
+	}
+	t.mu.Unlock()
+	return r
+}
+
+// pieceLocked is the piece at the reader's position.
+func (r *Reader) pieceLocked() int {
+	pos := min(r.pos, max(r.file.Length-1, 0))
+	first, last := r.t.info.pieceSpan(r.file)
+	return min(max(int((r.file.offset+pos)/r.t.info.pieceLength), first), last)
+}
+
+func (r *Reader) Read(b []byte) (int, error) {
+	t := r.t
+	t.mu.Lock()
+	pos := r.pos
+	if pos >= r.file.Length {
+		t.mu.Unlock()
+		return 0, io.EOF
+	}
+	i := r.pieceLocked()
+	if !t.have[i] {
+		// Let idle peers pick up the piece
+		for p := range t.peers {
+			p.notify()
+		}
+	}
+	for !t.have[i] {
+		if err := r.ctx.Err(); err != nil {
+			t.mu.Unlock()
+			return 0, err
+		}
+		if t.ctx.Err() != nil {
+			t.mu.Unlock()
+			return 0, t.stopErr()
+		}
+		t.cond.Wait()
+	}
+	data := t.data
+	t.lastUsed = time.Now()
+	t.mu.Unlock()
+
+	off := r.file.offset + pos
+	end := min(int64(i)*t.info.pieceLength+t.info.pieceSize(i), r.file.offset+r.file.Length)
+	n, err := data.ReadAt(b[:min(int64(len(b)), end-off)], off)
+	t.mu.Lock()
+	r.pos += int64(n)
+	t.mu.Unlock()
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.file.Length
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close stops the reader, which no longer steers the download.
+func (r *Reader) Close() error {
+	r.stop()
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	r.t.readers = slices.DeleteFunc(r.t.readers, func(o *Reader) bool { return o == r })
+	r.t.lastUsed = time.Now()
+	return nil
+}
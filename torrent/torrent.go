@@ -0,0 +1,488 @@
+package torrent
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPeers bounds the connections of one torrent.
+	maxPeers = 40
+	// redialAfter is how long a peer that failed or left is left alone.
+	redialAfter = 2 * time.Minute
+	// announceRetry is how long to wait after a tracker failed.
+	announceRetry = 2 * time.Minute
+	// minAnnounce and maxAnnounce bound the re-announce intervals trackers
+	// ask for.
+	minAnnounce = time.Minute
+	maxAnnounce = 30 * time.Minute
+	// stallTimeout is how long the piece a reader waits for may be with
+	// one peer before others may fetch it too.
+	stallTimeout = 10 * time.Second
+	// announcePort is reported to trackers. Nothing listens on it: the
+	// agent only connects out to peers.
+	announcePort = 6881
+)
+
+var errDropped = errors.New("torrent was dropped")
+
+// Torrent is a torrent being fetched from a magnet link. Pieces are
+// downloaded in order from the positions of its readers, then from the
+// start of the selected file, into a sparse file of the client's folder.
+type Torrent struct {
+	client   *Client
+	infoHash [20]byte
+	magnet   Magnet
+	trackers []string
+	path     string // Of the data file
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	infoReady chan struct{} // Closed once info is set
+
+	mu         sync.Mutex
+	cond       *sync.Cond // Broadcast when a piece is stored or on drop
+	info       *info
+	metaSize   int
+	meta       []byte
+	metaHave   []bool
+	data       *os.File
+	err        error // Of the data file, which stops the torrent
+	have       []bool
+	completed  int64 // Bytes of verified pieces
+	downloaded int64 // Bytes received
+	busy       map[int]*busyPiece
+	selected   *File
+	readers    []*Reader // Newest last
+	peers      map[*peer]bool
+	known      map[netip.AddrPort]time.Time // Peer addresses, by last dial
+	dialing    int
+	lastUsed   time.Time
+}
+
+// busyPiece is a piece being downloaded, by one peer or, if stalled or at
+// the end, by several.
+type busyPiece struct {
+	peers int
+	since time.Time
+}
+
+func newTorrent(c *Client, m Magnet, trackers []string) *Torrent {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Torrent{
+		client:    c,
+		infoHash:  m.InfoHash,
+		magnet:    m,
+		trackers:  trackers,
+		path:      filepath.Join(c.cfg.Dir, hex.EncodeToString(m.InfoHash[:])),
+		ctx:       ctx,
+		cancel:    cancel,
+		infoReady: make(chan struct{}),
+		busy:      make(map[int]*busyPiece),
+		peers:     make(map[*peer]bool),
+		known:     make(map[netip.AddrPort]time.Time),
+		lastUsed:  time.Now(),
+	}
+	t.cond = sync.NewCond(&t.mu)
+	for _, tr := range trackers {
+		go t.announceLoop(tr)
+	}
+	go t.dialLoop()
+	return t
+}
+
+// InfoHash is the hex info hash of the torrent.
+func (t *Torrent) InfoHash() string {
+	return hex.EncodeToString(t.infoHash[:])
+}
+
+// Name is the torrent's name, or the magnet link's until the metadata is in.
+func (t *Torrent) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.info != nil {
+		return t.info.name
+	}
+	return t.magnet.Name
+}
+
+// announceLoop asks tracker for peers until the torrent is dropped.
+func (t *Torrent) announceLoop(tracker string) {
+	started := true
+	for {
+		t.mu.Lock()
+		left := int64(1) // Unknown, but not a seed
+		if t.info != nil {
+			left = t.info.length - t.completed
+		}
+		t.mu.Unlock()
+		peers, interval, err := announce(t.ctx, tracker, announceRequest{
+			infoHash: t.infoHash,
+			peerID:   t.client.peerID,
+			port:     announcePort,
+			left:     left,
+			started:  started,
+		})
+		if t.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Torrent %s: tracker %s: %v", t.InfoHash(), tracker, err)
+			interval = announceRetry
+		} else {
+			started = false
+			interval = min(max(interval, minAnnounce), maxAnnounce)
+			t.mu.Lock()
+			for _, addr := range peers {
+				if _, ok := t.known[addr]; !ok {
+					t.known[addr] = time.Time{}
+				}
+			}
+			t.mu.Unlock()
+		}
+		select {
+		case <-time.After(interval):
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// dialLoop keeps up to maxPeers connections, to peers not tried yet first.
+func (t *Torrent) dialLoop() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-t.ctx.Done():
+			return
+		}
+		t.mu.Lock()
+		var addrs []netip.AddrPort
+		for addr, tried := range t.known {
+			if time.Since(tried) > redialAfter {
+				addrs = append(addrs, addr)
+			}
+		}
+		slices.SortFunc(addrs, func(a, b netip.AddrPort) int {
+			return t.known[a].Compare(t.known[b])
+		})
+		connected := make(map[netip.AddrPort]bool, len(t.peers))
+		for p := range t.peers {
+			connected[p.addr] = true
+		}
+		for _, addr := range addrs {
+			if len(t.peers)+t.dialing >= maxPeers {
+				break
+			}
+			if connected[addr] {
+				continue
+			}
+			t.known[addr] = time.Now()
+			t.dialing++
+			go t.connect(addr)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// removePeer forgets p, giving up its piece.
+func (t *Torrent) removePeer(p *peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.releaseLocked(p)
+	delete(t.peers, p)
+	if p.bad >= maxBadPieces {
+		t.known[p.addr] = time.Now().Add(24 * time.Hour)
+	}
+}
+
+// setInfoLocked makes the metadata fetched from peers the torrent's.
+func (t *Torrent) setInfoLocked(in *info) {
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		t.failLocked(err)
+		return
+	}
+	f, err := os.OpenFile(t.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.failLocked(err)
+		return
+	}
+	t.info, t.data = in, f
+	t.have = make([]bool, len(in.pieces))
+	t.meta, t.metaHave = nil, nil
+	close(t.infoReady)
+	for p := range t.peers {
+		p.notify()
+	}
+	log.Printf("Torrent %s: got metadata of %q (%d files, %d pieces)", t.InfoHash(), in.name, len(in.files), len(in.pieces))
+}
+
+// fail stops the torrent on a storage error.
+func (t *Torrent) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failLocked(err)
+}
+
+func (t *Torrent) failLocked(err error) {
+	if t.ctx.Err() != nil {
+		return // Dropped, and the data file with it
+	}
+	if t.err == nil {
+		t.err = err
+		log.Printf("Torrent %s: %v", t.InfoHash(), err)
+	}
+	t.cancel()
+	t.cond.Broadcast()
+}
+
+func (t *Torrent) writePiece(i int, buf []byte) error {
+	t.mu.Lock()
+	data := t.data
+	t.mu.Unlock()
+	_, err := data.WriteAt(buf, int64(i)*t.info.pieceLength)
+	return err
+}
+
+// pickLocked chooses the next piece to fetch from p, or returns -1. First
+// come the pieces readers are about to need, newest reader first, then
+// the last piece of the selected file, where many containers keep their
+// index, then the rest of the file in order. A piece another peer is
+// slow with may be fetched twice if a reader waits for it, and so may
+// any piece once all are underway.
+func (t *Torrent) pickLocked(p *peer) int {
+	f := t.selected
+	if f == nil {
+		return -1
+	}
+	first, last := t.info.pieceSpan(*f)
+	free := func(i int) bool {
+		return !t.have[i] && p.hasPiece(i) && t.busy[i] == nil
+	}
+	for _, r := range slices.Backward(t.readers) {
+		_, end := t.info.pieceSpan(r.file)
+		waited := false // The first missing piece is the one r waits for
+		for i := r.pieceLocked(); i <= end; i++ {
+			if t.have[i] {
+				continue
+			}
+			if b := t.busy[i]; b != nil && !waited && p.hasPiece(i) && time.Since(b.since) > stallTimeout {
+				return i
+			}
+			if free(i) {
+				return i
+			}
+			waited = true
+		}
+	}
+	if free(last) {
+		return last
+	}
+	for i := first; i <= last; i++ {
+		if free(i) {
+			return i
+		}
+	}
+	for i := first; i <= last; i++ {
+		if !t.have[i] && p.hasPiece(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+// busyLocked counts a peer more (n = 1) or less (n = -1) on piece i.
+func (t *Torrent) busyLocked(i, n int) {
+	b := t.busy[i]
+	if b == nil {
+		b = &busyPiece{since: time.Now()}
+		t.busy[i] = b
+	}
+	if b.peers += n; b.peers <= 0 {
+		delete(t.busy, i)
+	}
+}
+
+// releaseLocked drops p's piece.
+func (t *Torrent) releaseLocked(p *peer) {
+	if p.piece < 0 {
+		return
+	}
+	t.busyLocked(p.piece, -1)
+	p.piece, p.buf, p.got = -1, nil, nil
+	p.received, p.next, p.pending = 0, 0, 0
+}
+
+// WaitInfo waits until the metadata of the torrent has been fetched from
+// peers.
+func (t *Torrent) WaitInfo(ctx context.Context) error {
+	select {
+	case <-t.infoReady:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.ctx.Done():
+		return t.stopErr()
+	}
+}
+
+func (t *Torrent) stopErr() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	return errDropped
+}
+
+// Files lists the files of the torrent, once WaitInfo returned.
+func (t *Torrent) Files() []File {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.info == nil {
+		return nil
+	}
+	return slices.Clone(t.info.files)
+}
+
+// File returns the file at path.
+func (t *Torrent) File(path string) (File, bool) {
+	for _, f := range t.Files() {
+		if f.Path == path {
+			return f, true
+		}
+	}
+	return File{}, false
+}
+
+// Select makes f the file downloaded. Other files are only fetched where
+// they share pieces with it.
+func (t *Torrent) Select(f File) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.selected = &f
+	t.lastUsed = time.Now()
+	for p := range t.peers {
+		p.notify()
+	}
+}
+
+// WaitBuffered waits until the first n bytes and the last piece of the
+// selected file are stored.
+func (t *Torrent) WaitBuffered(ctx context.Context, n int64) error {
+	stop := context.AfterFunc(ctx, t.wakeReaders)
+	defer stop()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.selected
+	if f == nil || t.info == nil {
+		return errors.New("no file selected")
+	}
+	first, last := t.info.pieceSpan(*f)
+	end, _ := t.info.pieceSpan(File{offset: f.offset + min(max(n, 1), f.Length) - 1})
+	for {
+		ready := t.have[last]
+		for i := first; ready && i <= end; i++ {
+			ready = t.have[i]
+		}
+		switch {
+		case ready:
+			return nil
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case t.ctx.Err() != nil:
+			if t.err != nil {
+				return t.err
+			}
+			return errDropped
+		}
+		t.cond.Wait()
+	}
+}
+
+// wakeReaders makes everyone waiting for pieces look at their context.
+func (t *Torrent) wakeReaders() {
+	t.mu.Lock()
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// Stats describes a torrent's progress.
+type Stats struct {
+	InfoHash   string `json:"info_hash"`
+	Name       string `json:"name"`
+	File       string `json:"file,omitempty"` // The selected file
+	Size       int64  `json:"size"`           // Of the selected file
+	Completed  int64  `json:"completed"`      // Bytes of it stored
+	Downloaded int64  `json:"downloaded"`     // Bytes received in all
+	Peers      int    `json:"peers"`
+	KnownPeers int    `json:"known_peers"`
+	Readers    int    `json:"readers"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Stats returns the progress of the torrent.
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Stats{
+		InfoHash:   t.InfoHash(),
+		Name:       t.magnet.Name,
+		Downloaded: t.downloaded,
+		Peers:      len(t.peers),
+		KnownPeers: len(t.known),
+		Readers:    len(t.readers),
+	}
+	if t.err != nil {
+		s.Error = t.err.Error()
+	}
+	if t.info != nil {
+		s.Name = t.info.name
+	}
+	if f := t.selected; f != nil {
+		s.File, s.Size = f.Path, f.Length
+		first, last := t.info.pieceSpan(*f)
+		for i := first; i <= last; i++ {
+			if !t.have[i] {
+				continue
+			}
+			start := int64(i) * t.info.pieceLength
+			end := start + t.info.pieceSize(i)
+			s.Completed += max(min(end, f.offset+f.Length)-max(start, f.offset), 0)
+		}
+	}
+	return s
+}
+
+// idleSince reports since when the torrent has had no readers.
+func (t *Torrent) idleSince() (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastUsed, len(t.readers) == 0
+}
+
+// close stops the torrent and deletes its data. Peers hang up as they
+// notice.
+func (t *Torrent) close() {
+	t.cancel()
+	t.mu.Lock()
+	t.peers = nil
+	data := t.data
+	t.data = nil
+	t.cond.Broadcast()
+	t.mu.Unlock()
+	if data != nil {
+		data.Close()
+	}
+	os.Remove(t.path)
+}
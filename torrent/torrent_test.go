@@ -0,0 +1,617 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBencode(t *testing.T) {
+	v := map[string]any{"b": []any{int64(-3), "x"}, "a": "hello"}
+	b := encode(v)
+	if string(b) != "d1:a5:hello1:bli-3e1:xee" {
+		t.Errorf("Unexpected encoding %q", b)
+	}
+	got, rest, err := decode(append(b, "tail"...))
+	if err != nil || string(rest) != "tail" {
+		t.Fatalf("decode failed: %v, rest %q", err, rest)
+	}
+	if d := got.(map[string]any); d["a"] != "hello" || d["b"].([]any)[0] != int64(-3) {
+		t.Errorf("Unexpected value %v", got)
+	}
+	for _, bad := range []string{"", "i12", "5:abc", "l1:a", "di1e1:ae", "x"} {
+		if _, _, err := decode([]byte(bad)); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	hash := "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+	m, err := ParseMagnet("magnet:?xt=urn:btih:" + hash + "&dn=Big+Buck+Bunny&tr=udp%3A%2F%2Ftracker.example%3A1337&tr=wss%3A%2F%2Fws.example")
+	if err != nil {
+		t.Fatalf("ParseMagnet failed: %v", err)
+	}
+	if hex.EncodeToString(m.InfoHash[:]) != hash || m.Name != "Big Buck Bunny" {
+		t.Errorf("Unexpected magnet %+v", m)
+	}
+	if len(m.Trackers) != 1 || m.Trackers[0] != "udp://tracker.example:1337" {
+		t.Errorf("Expected only the UDP tracker, got %v", m.Trackers)
+	}
+	b32, err := ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil || b32.InfoHash != m.InfoHash {
+		t.Errorf("Base32 hash: %v, %x", err, b32.InfoHash)
+	}
+	for _, bad := range []string{"http://example.com", "magnet:?dn=x", "magnet:?xt=urn:btih:1234"} {
+		if _, err := ParseMagnet(bad); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
+
+// makeInfo bencodes the info dictionary of files, returning it and their
+// concatenated contents.
+func makeInfo(pieceLength int, files map[string][]byte, order []string) ([]byte, []byte) {
+	var data []byte
+	var list []any
+	for _, name := range order {
+		data = append(data, files[name]...)
+		var elems []any
+		for _, e := range strings.Split(name, "/") {
+			elems = append(elems, e)
+		}
+		list = append(list, map[string]any{"length": len(files[name]), "path": elems})
+	}
+	var hashes []byte
+	for off := 0; off < len(data); off += pieceLength {
+		h := sha1.Sum(data[off:min(off+pieceLength, len(data))])
+		hashes = append(hashes, h[:]...)
+	}
+	return encode(map[string]any{
+		"name":         "Film",
+		"piece length": pieceLength,
+		"pieces":       string(hashes),
+		"files":        list,
+	}), data
+}
+
+func TestParseInfo(t *testing.T) {
+	b, _ := makeInfo(1024, map[string][]byte{"../../etc/passwd": make([]byte, 1500)}, []string{"../../etc/passwd"})
+	in, err := parseInfo(b, sha1.Sum(b))
+	if err != nil {
+		t.Fatalf("parseInfo failed: %v", err)
+	}
+	if len(in.files) != 1 || in.files[0].Path != "Film/etc/passwd" || len(in.pieces) != 2 || in.pieceSize(1) != 476 {
+		t.Errorf("Unexpected info %+v", in)
+	}
+	if _, err := parseInfo(b, [20]byte{}); err == nil {
+		t.Error("Expected a hash mismatch")
+	}
+}
+
+// seed serves the torrent of meta and data to every connection on ln, like
+// a seeder that has everything. A corrupt seeder flips a byte of every
+// block it sends.
+func seed(ln net.Listener, meta, data []byte, pieceLength int, corrupt bool) {
+	infoHash := sha1.Sum(meta)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			hs := make([]byte, 68)
+			if _, err := io.ReadFull(conn, hs); err != nil || [20]byte(hs[28:48]) != infoHash {
+				return
+			}
+			copy(hs[48:], "-XX0000-seederseeder")
+			var out []byte
+			out = append(out, hs...)
+			out = appendExtended(out, 0, map[string]any{"m": map[string]any{"ut_metadata": 3}, "metadata_size": len(meta)})
+			bitfield := make([]byte, (len(data)/pieceLength+8)/8)
+			for i := range bitfield {
+				bitfield[i] = 0xff
+			}
+			out = appendMessage(out, msgBitfield, bitfield)
+			out = appendMessage(out, msgUnchoke)
+			conn.Write(out)
+			var ourExt byte
+			for {
+				m, err := readMessage(conn)
+				if err != nil {
+					return
+				}
+				switch {
+				case m == nil:
+				case m.id == msgExtended && m.payload[0] == 0:
+					v, _, _ := decode(m.payload[1:])
+					id, _ := dictInt(v.(map[string]any)["m"].(map[string]any), "ut_metadata")
+					ourExt = byte(id)
+				case m.id == msgExtended && m.payload[0] == 3:
+					v, _, _ := decode(m.payload[1:])
+					piece, _ := dictInt(v.(map[string]any), "piece")
+					off := int(piece) * metadataPieceSize
+					resp := encode(map[string]any{"msg_type": 1, "piece": piece, "total_size": len(meta)})
+					conn.Write(appendMessage(nil, msgExtended, []byte{ourExt}, resp, meta[off:min(off+metadataPieceSize, len(meta))]))
+				case m.id == msgRequest:
+					index := int(binary.BigEndian.Uint32(m.payload))
+					begin := int(binary.BigEndian.Uint32(m.payload[4:]))
+					length := int(binary.BigEndian.Uint32(m.payload[8:]))
+					off := index*pieceLength + begin
+					block := bytes.Clone(data[off : off+length])
+					if corrupt {
+						block[0] ^= 0xff
+					}
+					conn.Write(appendMessage(nil, msgPiece, m.payload[:8], block))
+				}
+			}
+		}()
+	}
+}
+
+func TestStream(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	film := make([]byte, 300_000)
+	rng.Read(film)
+	files := map[string][]byte{"sample.txt": []byte("not the film"), "film.mkv": film}
+	const pieceLength = 32 << 10
+	meta, data := makeInfo(pieceLength, files, []string{"sample.txt", "film.mkv"})
+	infoHash := sha1.Sum(meta)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go seed(ln, meta, data, pieceLength, false)
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("info_hash") != string(infoHash[:]) {
+			w.Write(encode(map[string]any{"failure reason": "unknown torrent"}))
+			return
+		}
+		peer := append([]byte{127, 0, 0, 1}, byte(port>>8), byte(port))
+		w.Write(encode(map[string]any{"interval": 1800, "peers": string(peer)}))
+	}))
+	defer tracker.Close()
+
+	c := NewClient(Config{Dir: t.TempDir()})
+	m, err := ParseMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%x&tr=%s", infoHash, url.QueryEscape(tracker.URL+"/announce")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, err := c.Add(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Drop(tor.InfoHash())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tor.WaitInfo(ctx); err != nil {
+		t.Fatalf("WaitInfo failed: %v", err)
+	}
+	f, ok := tor.File("Film/film.mkv")
+	if !ok || f.Length != int64(len(film)) {
+		t.Fatalf("Unexpected files %+v", tor.Files())
+	}
+	tor.Select(f)
+	if err := tor.WaitBuffered(ctx, 64<<10); err != nil {
+		t.Fatalf("WaitBuffered failed: %v", err)
+	}
+
+	r := tor.NewReader(ctx, f)
+	defer r.Close()
+	if _, err := r.Seek(200_000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(tail, film[200_000:]) {
+		t.Fatalf("Read from 200000 failed: %v (%d bytes)", err, len(tail))
+	}
+	r.Seek(0, io.SeekStart)
+	all, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(all, film) {
+		t.Fatalf("Read failed: %v (%d bytes)", err, len(all))
+	}
+	if s := tor.Stats(); s.Completed != int64(len(film)) || s.Peers != 1 || s.Name != "Film" {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+
+	if !c.Drop(tor.InfoHash()) || c.Get(tor.InfoHash()) != nil {
+		t.Error("Expected the torrent to be dropped")
+	}
+	if _, err := r.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected reads of a dropped torrent to fail")
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	m, err := readMessage(bytes.NewReader(appendMessage(nil, msgHave, []byte{0, 0, 0, 7})))
+	if err != nil || m.id != msgHave || !bytes.Equal(m.payload, []byte{0, 0, 0, 7}) {
+		t.Errorf("Unexpected message %+v, %v", m, err)
+	}
+	if m, err := readMessage(bytes.NewReader([]byte{0, 0, 0, 0})); m != nil || err != nil {
+		t.Errorf("Expected a keep-alive, got %+v, %v", m, err)
+	}
+	if _, err := readMessage(bytes.NewReader(binary.BigEndian.AppendUint32(nil, maxMessage+1))); err == nil {
+		t.Error("Expected an oversized message to fail")
+	}
+	if _, err := readMessage(bytes.NewReader([]byte{0, 0, 0, 5, msgHave, 0})); err == nil {
+		t.Error("Expected a truncated message to fail")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	// answer runs handshake against a peer replying with resp, edited
+	// from ours.
+	answer := func(edit func(resp []byte)) (bool, error) {
+		ours, theirs := net.Pipe()
+		defer ours.Close()
+		go func() {
+			defer theirs.Close()
+			resp := make([]byte, 68)
+			if _, err := io.ReadFull(theirs, resp); err != nil {
+				return
+			}
+			edit(resp)
+			theirs.Write(resp)
+		}()
+		return handshake(ours, infoHash, [20]byte{})
+	}
+
+	if ext, err := answer(func([]byte) {}); err != nil || !ext {
+		t.Errorf("Expected the extension protocol, got %v, %v", ext, err)
+	}
+	if ext, err := answer(func(resp []byte) { resp[25] = 0 }); err != nil || ext {
+		t.Errorf("Expected no extension protocol, got %v, %v", ext, err)
+	}
+	if _, err := answer(func(resp []byte) { copy(resp[1:], "HTTP/1.1 400 Bad Req") }); err == nil || err.Error() != "not a BitTorrent peer" {
+		t.Errorf("Expected another protocol to fail, got %v", err)
+	}
+	if _, err := answer(func(resp []byte) { resp[28] ^= 0xff }); err == nil || err.Error() != "peer has another torrent" {
+		t.Errorf("Expected another info hash to fail, got %v", err)
+	}
+}
+
+// newTestTorrent returns a torrent of data whose metadata is in, with the
+// file selected, and a peer that has every piece but still chokes us.
+func newTestTorrent(t *testing.T, pieceLength int, data []byte) (*Torrent, *peer) {
+	t.Helper()
+	meta, _ := makeInfo(pieceLength, map[string][]byte{"film.mkv": data}, []string{"film.mkv"})
+	in, err := parseInfo(meta, sha1.Sum(meta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor := newTorrent(NewClient(Config{Dir: t.TempDir()}), Magnet{InfoHash: sha1.Sum(meta)}, nil)
+	t.Cleanup(tor.close)
+	p := &peer{addr: netip.MustParseAddrPort("192.0.2.1:6881"), wake: make(chan struct{}, 1), choked: true, piece: -1}
+	tor.mu.Lock()
+	tor.setInfoLocked(in)
+	tor.selected = &in.files[0]
+	tor.peers[p] = true
+	for i := range in.pieces {
+		p.setHas(i)
+	}
+	tor.mu.Unlock()
+	if tor.err != nil {
+		t.Fatal(tor.err)
+	}
+	return tor, p
+}
+
+// pieceMessage is the piece message carrying data at begin of piece index.
+func pieceMessage(index, begin int, data []byte) *message {
+	var head [8]byte
+	binary.BigEndian.PutUint32(head[0:], uint32(index))
+	binary.BigEndian.PutUint32(head[4:], uint32(begin))
+	return &message{id: msgPiece, payload: append(head[:], data...)}
+}
+
+// fetch requests p's next piece and answers every request from data,
+// corrupted if corrupt, reporting the piece.
+func fetch(t *testing.T, tor *Torrent, p *peer, data []byte, pieceLength int, corrupt bool) int {
+	t.Helper()
+	var out []byte
+	if tor.service(p, &out) {
+		t.Fatal("Expected a new piece")
+	}
+	for len(out) > 0 {
+		m, err := readMessage(bytes.NewReader(out))
+		if err != nil || m.id != msgRequest {
+			t.Fatalf("Expected a request, got %+v, %v", m, err)
+		}
+		out = out[4+1+len(m.payload):]
+		index := int(binary.BigEndian.Uint32(m.payload))
+		begin := int(binary.BigEndian.Uint32(m.payload[4:]))
+		length := int(binary.BigEndian.Uint32(m.payload[8:]))
+		block := bytes.Clone(data[index*pieceLength+begin:][:length])
+		if corrupt {
+			block[0] ^= 0xff
+		}
+		if err := tor.handleMessage(p, pieceMessage(index, begin, block)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !tor.service(p, &out) {
+		t.Fatalf("Expected all blocks of piece %d, got %d of %d", p.piece, p.received, len(p.got))
+	}
+	return p.piece
+}
+
+func TestPieceVerification(t *testing.T) {
+	const pieceLength = 2 * blockSize
+	data := make([]byte, 3*pieceLength+100)
+	rand.New(rand.NewSource(2)).Read(data)
+	tor, p := newTestTorrent(t, pieceLength, data)
+	tor.mu.Lock()
+	p.choked = false
+	tor.mu.Unlock()
+
+	// Bad pieces are not stored, and are fetched again
+	for bad := 1; bad < maxBadPieces; bad++ {
+		i := fetch(t, tor, p, data, pieceLength, true)
+		if !tor.finishPiece(p) {
+			t.Fatalf("Expected the peer to be kept after %d bad pieces", bad)
+		}
+		if p.bad != bad || tor.have[i] || tor.completed != 0 || p.piece != -1 || tor.busy[i] != nil {
+			t.Fatalf("Unexpected state after bad piece %d: bad %d, have %v, completed %d", i, p.bad, tor.have, tor.completed)
+		}
+	}
+
+	// A good one is stored
+	i := fetch(t, tor, p, data, pieceLength, false)
+	if !tor.finishPiece(p) || !tor.have[i] || tor.completed != int64(tor.info.pieceSize(i)) {
+		t.Fatalf("Expected piece %d to be stored, have %v, completed %d", i, tor.have, tor.completed)
+	}
+	stored := make([]byte, tor.info.pieceSize(i))
+	if _, err := tor.data.ReadAt(stored, int64(i)*pieceLength); err != nil || !bytes.Equal(stored, data[i*pieceLength:][:len(stored)]) {
+		t.Errorf("Unexpected data of piece %d: %v", i, err)
+	}
+
+	// A piece another peer stored first is not counted twice
+	other := &peer{wake: make(chan struct{}, 1), piece: -1}
+	for j := range tor.info.pieces {
+		other.setHas(j)
+	}
+	tor.mu.Lock()
+	tor.peers[other] = true
+	tor.mu.Unlock()
+	j := fetch(t, tor, other, data, pieceLength, false)
+	tor.mu.Lock()
+	tor.have[j] = true
+	tor.mu.Unlock()
+	completed := tor.completed
+	if !tor.finishPiece(other) || tor.completed != completed || other.bad != 0 {
+		t.Errorf("Expected piece %d to be skipped, completed %d, bad %d", j, tor.completed, other.bad)
+	}
+
+	// The last bad piece drops the peer, which is not dialled again
+	fetch(t, tor, p, data, pieceLength, true)
+	if tor.finishPiece(p) {
+		t.Fatal("Expected the peer to be dropped")
+	}
+	tor.removePeer(p)
+	if tor.peers[p] || time.Until(tor.known[p.addr]) < redialAfter {
+		t.Errorf("Expected the peer to be banned, known %v", tor.known[p.addr])
+	}
+}
+
+func TestPeerMessages(t *testing.T) {
+	const pieceLength = 2 * blockSize
+	data := make([]byte, 2*pieceLength)
+	tor, p := newTestTorrent(t, pieceLength, data)
+
+	// Requests wait for an unchoke
+	var out []byte
+	if tor.service(p, &out); len(out) != 0 || p.piece != -1 {
+		t.Fatalf("Expected no requests while choked, got %d bytes", len(out))
+	}
+	if err := tor.handleMessage(p, &message{id: msgUnchoke}); err != nil || p.choked {
+		t.Fatalf("Unchoke failed: %v", err)
+	}
+	tor.service(p, &out)
+	if p.piece < 0 || p.pending != 2 {
+		t.Fatalf("Expected two requests, got piece %d, pending %d", p.piece, p.pending)
+	}
+
+	// Blocks not asked for are ignored
+	block := make([]byte, blockSize)
+	for name, m := range map[string]*message{
+		"other piece": pieceMessage(p.piece+1, 0, block),
+		"misaligned":  pieceMessage(p.piece, 100, block),
+		"past end":    pieceMessage(p.piece, pieceLength, block),
+		"short":       pieceMessage(p.piece, 0, block[:100]),
+		"long":        pieceMessage(p.piece, 0, append(block, 0)),
+	} {
+		if err := tor.handleMessage(p, m); err != nil || p.received != 0 {
+			t.Errorf("%s: expected the block to be ignored, got %v, %d received", name, err, p.received)
+		}
+	}
+	// A block sent twice counts once
+	for range 2 {
+		if err := tor.handleMessage(p, pieceMessage(p.piece, 0, block)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.received != 1 || p.pending != 0 {
+		t.Errorf("Expected one block, got %d received, %d pending", p.received, p.pending)
+	}
+
+	// A choke gives up the piece for other peers
+	i := p.piece
+	if err := tor.handleMessage(p, &message{id: msgChoke}); err != nil || !p.choked || p.piece != -1 || tor.busy[i] != nil {
+		t.Errorf("Expected the piece to be released, got piece %d, busy %v, %v", p.piece, tor.busy, err)
+	}
+
+	// Malformed messages drop the peer
+	for name, m := range map[string]*message{
+		"short piece":    {id: msgPiece, payload: []byte{0, 0, 0, 0}},
+		"empty extended": {id: msgExtended},
+		"bad bencode":    {id: msgExtended, payload: []byte("\x00d1:m")},
+		"not a dict":     {id: msgExtended, payload: []byte("\x00i1e")},
+	} {
+		if err := tor.handleMessage(p, m); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	// Unknown ones are ignored
+	if err := tor.handleMessage(p, &message{id: 99, payload: []byte("?")}); err != nil {
+		t.Errorf("Expected an unknown message to be ignored, got %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	film := make([]byte, 100_000)
+	rand.New(rand.NewSource(3)).Read(film)
+	// Enough files for the info dictionary to span two metadata pieces
+	files := map[string][]byte{"film.mkv": film}
+	order := []string{"film.mkv"}
+	for i := range 600 {
+		name := fmt.Sprintf("extras/%03d.txt", i)
+		files[name] = []byte(name)
+		order = append(order, name)
+	}
+	meta, _ := makeInfo(16<<10, files, order)
+	if len(meta) <= metadataPieceSize {
+		t.Fatalf("Expected over %d bytes of metadata, got %d", metadataPieceSize, len(meta))
+	}
+	tor := newTorrent(NewClient(Config{Dir: t.TempDir()}), Magnet{InfoHash: sha1.Sum(meta)}, nil)
+	defer tor.close()
+	p := &peer{wake: make(chan struct{}, 1), piece: -1}
+
+	handshake := appendExtended(nil, 0, map[string]any{"m": map[string]any{"ut_metadata": 3}, "metadata_size": len(meta)})
+	m, _ := readMessage(bytes.NewReader(handshake))
+	if err := tor.handleMessage(p, m); err != nil || p.utMetadata != 3 || tor.metaSize != len(meta) {
+		t.Fatalf("Unexpected extended handshake: %v, ut_metadata %d, size %d", err, p.utMetadata, tor.metaSize)
+	}
+	// sendPiece answers a request for piece i with data.
+	sendPiece := func(i int, total int, data []byte) {
+		t.Helper()
+		resp := encode(map[string]any{"msg_type": 1, "piece": i, "total_size": total})
+		if err := tor.handleMessage(p, &message{id: msgExtended, payload: append(append([]byte{extMetadata}, resp...), data...)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	half := meta[:metadataPieceSize]
+
+	// Pieces of the wrong size or total are ignored
+	sendPiece(0, len(meta)+1, half)
+	sendPiece(0, len(meta), half[:100])
+	sendPiece(2, len(meta), half)
+	if tor.metaHave[0] || tor.metaHave[1] {
+		t.Fatalf("Expected the pieces to be ignored, have %v", tor.metaHave)
+	}
+
+	// Metadata not matching the info hash is thrown away
+	corrupt := bytes.Clone(meta)
+	corrupt[len(corrupt)-2] ^= 0xff
+	sendPiece(0, len(meta), corrupt[:metadataPieceSize])
+	sendPiece(1, len(meta), corrupt[metadataPieceSize:])
+	if tor.info != nil || tor.metaSize != 0 || tor.meta != nil {
+		t.Fatalf("Expected the metadata to be reset, size %d", tor.metaSize)
+	}
+	// and fetched again once a peer gives the size
+	if err := tor.handleMessage(p, m); err != nil || tor.metaSize != len(meta) {
+		t.Fatalf("Expected the size again, got %d, %v", tor.metaSize, err)
+	}
+	sendPiece(1, len(meta), meta[metadataPieceSize:])
+	sendPiece(0, len(meta), half)
+	if tor.info == nil || len(tor.info.files) != len(order) {
+		t.Fatal("Expected the metadata to be in")
+	}
+	select {
+	case <-tor.infoReady:
+	default:
+		t.Error("Expected WaitInfo to be released")
+	}
+}
+
+func TestBadPeer(t *testing.T) {
+	film := make([]byte, 300_000)
+	rand.New(rand.NewSource(4)).Read(film)
+	const pieceLength = 32 << 10
+	meta, data := makeInfo(pieceLength, map[string][]byte{"film.mkv": film}, []string{"film.mkv"})
+	infoHash := sha1.Sum(meta)
+
+	listen := func(corrupt bool) netip.AddrPort {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go seed(ln, meta, data, pieceLength, corrupt)
+		return ln.Addr().(*net.TCPAddr).AddrPort()
+	}
+	bad, good := listen(true), listen(false)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := append(bad.Addr().AsSlice(), byte(bad.Port()>>8), byte(bad.Port()))
+		w.Write(encode(map[string]any{"interval": 1800, "peers": string(peer)}))
+	}))
+	defer tracker.Close()
+
+	c := NewClient(Config{Dir: t.TempDir()})
+	tor, err := c.Add(Magnet{InfoHash: infoHash, Trackers: []string{tracker.URL + "/announce"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Drop(tor.InfoHash())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tor.WaitInfo(ctx); err != nil {
+		t.Fatalf("WaitInfo failed: %v", err)
+	}
+	f, _ := tor.File("Film/film.mkv")
+	tor.Select(f)
+
+	// The seeder of corrupt blocks is dropped after maxBadPieces of them,
+	// without a piece stored
+	banned := func() bool {
+		tor.mu.Lock()
+		defer tor.mu.Unlock()
+		return len(tor.peers) == 0 && time.Until(tor.known[bad]) > redialAfter
+	}
+	for !banned() {
+		if ctx.Err() != nil {
+			t.Fatalf("Expected the corrupt seeder to be banned, stats %+v", tor.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := tor.Stats(); s.Completed != 0 || s.Downloaded == 0 {
+		t.Errorf("Expected only bad pieces, got %+v", s)
+	}
+
+	// A good seeder still gets the film across
+	tor.mu.Lock()
+	tor.known[good] = time.Time{}
+	tor.mu.Unlock()
+	r := tor.NewReader(ctx, f)
+	defer r.Close()
+	all, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(all, film) {
+		t.Fatalf("Read failed: %v (%d bytes)", err, len(all))
+	}
+	tor.mu.Lock()
+	defer tor.mu.Unlock()
+	for p := range tor.peers {
+		if p.addr == bad {
+			t.Error("Expected the corrupt seeder not to be dialled again")
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// announceTimeout bounds one announce to a tracker.
+	announceTimeout = 20 * time.Second
+	// maxTrackerResponse bounds an HTTP tracker response.
+	maxTrackerResponse = 1 << 20
+
+	udpProtocolID     = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionError    = 3
+	udpEventStarted   = 2
+)
+
+// announceRequest is what the agent tells trackers about itself.
+type announceRequest struct {
+	infoHash [20]byte
+	peerID   [20]byte
+	port     uint16
+	left     int64
+	started  bool // First announce
+}
+
+// announce asks tracker for peers of the torrent, returning them and how
+// long to wait before asking again.
+func announce(ctx context.Context, tracker string, req announceRequest) ([]netip.AddrPort, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, announceTimeout)
+	defer cancel()
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, 0, err
+	}
+	if u.Scheme == "udp" {
+		return announceUDP(ctx, u.Host, req)
+	}
+	return announceHTTP(ctx, u, req)
+}
+
+func announceHTTP(ctx context.Context, u *url.URL, req announceRequest) ([]netip.AddrPort, time.Duration, error) {
+	q := u.Query()
+	q.Set("info_hash", string(req.infoHash[:]))
+	q.Set("peer_id", string(req.peerID[:]))
+	q.Set("port", strconv.Itoa(int(req.port)))
+	q.Set("uploaded", "0")
+	q.Set("downloaded", "0")
+	q.Set("left", strconv.FormatInt(req.left, 10))
+	q.Set("compact", "1")
+	if req.started {
+		q.Set("event", "started")
+	}
+	u.RawQuery = q.Encode()
+
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("tracker answered %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTrackerResponse))
+	if err != nil {
+		return nil, 0, err
+	}
+	v, _, err := decode(body)
+	d, ok := v.(map[string]any)
+	if err != nil || !ok {
+		return nil, 0, errors.New("invalid tracker response")
+	}
+	if reason, ok := dictString(d, "failure reason"); ok {
+		return nil, 0, fmt.Errorf("tracker: %s", reason)
+	}
+	interval, _ := dictInt(d, "interval")
+
+	var peers []netip.AddrPort
+	switch p := d["peers"].(type) {
+	case string:
+		peers = compactPeers([]byte(p), 4)
+	case []any:
+		// The original, non-compact list of dictionaries
+		for _, e := range p {
+			pd, _ := e.(map[string]any)
+			ip, _ := dictString(pd, "ip")
+			port, _ := dictInt(pd, "port")
+			if addr, err := netip.ParseAddr(ip); err == nil && port > 0 && port < 65536 {
+				peers = append(peers, netip.AddrPortFrom(addr, uint16(port)))
+			}
+		}
+	}
+	if p, ok := dictString(d, "peers6"); ok {
+		peers = append(peers, compactPeers([]byte(p), 16)...)
+	}
+	return peers, time.Duration(interval) * time.Second, nil
+}
+
+// compactPeers parses addresses of ipLen bytes, each followed by a port.
+func compactPeers(b []byte, ipLen int) []netip.AddrPort {
+	var peers []netip.AddrPort
+	for ; len(b) >= ipLen+2; b = b[ipLen+2:] {
+		addr, _ := netip.AddrFromSlice(b[:ipLen])
+		port := binary.BigEndian.Uint16(b[ipLen:])
+		if port != 0 {
+			peers = append(peers, netip.AddrPortFrom(addr.Unmap(), port))
+		}
+	}
+	return peers
+}
+
+// announceUDP announces with the UDP tracker protocol (BEP 15).
+func announceUDP(ctx context.Context, host string, req announceRequest) ([]netip.AddrPort, time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	ipLen := 4
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipLen = 16
+	}
+
+	connect := binary.BigEndian.AppendUint64(nil, udpProtocolID)
+	connect = binary.BigEndian.AppendUint32(connect, udpActionConnect)
+	resp, err := udpTransact(conn, connect, 16, deadline)
+	if err != nil {
+		return nil, 0, err
+	}
+	connID := binary.BigEndian.Uint64(resp[8:])
+
+	var key [4]byte
+	rand.Read(key[:])
+	msg := binary.BigEndian.AppendUint64(nil, connID)
+	msg = binary.BigEndian.AppendUint32(msg, udpActionAnnounce)
+	msg = append(msg, req.infoHash[:]...)
+	msg = append(msg, req.peerID[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, 0) // Downloaded
+	msg = binary.BigEndian.AppendUint64(msg, uint64(req.left))
+	msg = binary.BigEndian.AppendUint64(msg, 0) // Uploaded
+	event := uint32(0)
+	if req.started {
+		event = udpEventStarted
+	}
+	msg = binary.BigEndian.AppendUint32(msg, event)
+	msg = binary.BigEndian.AppendUint32(msg, 0) // Our IP, as seen
+	msg = append(msg, key[:]...)
+	msg = binary.BigEndian.AppendUint32(msg, 0xffffffff) // As many peers as it likes
+	msg = binary.BigEndian.AppendUint16(msg, req.port)
+	resp, err = udpTransact(conn, msg, 20, deadline)
+	if err != nil {
+		return nil, 0, err
+	}
+	interval := time.Duration(binary.BigEndian.Uint32(resp[8:])) * time.Second
+	return compactPeers(resp[20:], ipLen), interval, nil
+}
+
+// udpTransact sends msg, with a transaction ID written after the
+// connection ID and action, and returns a reply to it of at least minLen
+// bytes. It sends again after 5s without a reply, until deadline.
+func udpTransact(conn net.Conn, msg []byte, minLen int, deadline time.Time) ([]byte, error) {
+	var txID [4]byte
+	rand.Read(txID[:])
+	msg = append(msg[:12:12], append(txID[:], msg[12:]...)...)
+	action := binary.BigEndian.Uint32(msg[8:])
+	buf := make([]byte, 64<<10)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		retry := time.Now().Add(5 * time.Second)
+		if retry.After(deadline) {
+			retry = deadline
+		}
+		for time.Now().Before(retry) {
+			conn.SetReadDeadline(retry)
+			n, err := conn.Read(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if n < 8 || [4]byte(buf[4:8]) != txID {
+				continue
+			}
+			switch got := binary.BigEndian.Uint32(buf); {
+			case got == udpActionError:
+				return nil, fmt.Errorf("tracker: %s", buf[8:n])
+			case got != action || n < minLen:
+				return nil, errors.New("invalid tracker response")
+			}
+			return buf[:n], nil
+		}
+	}
+	return nil, errors.New("tracker did not answer")
+}
@@ -0,0 +1,186 @@
+// Package tts turns text into speech for announcements, with a local
+// engine such as espeak-ng, pico2wave or piper run as a command, or a TTS
+// service reached over HTTP.
+package tts
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds one synthesis without a configured timeout.
+const DefaultTimeout = 30 * time.Second
+
+// maxAudio caps the audio read from an engine.
+const maxAudio = 32 << 20
+
+// Engine synthesizes speech. lang is a language or voice hint, e.g. "en",
+// and may be empty.
+type Engine interface {
+	Speak(ctx context.Context, text, lang string) (audio []byte, mimeType string, err error)
+}
+
+// Command runs a local engine. "{text}" and "{lang}" in Args are replaced
+// with the text and language; without "{text}" the text is written to
+// stdin. The engine writes WAV to "{file}" if an argument has it, or else
+// to stdout.
+type Command struct {
+	Args    []string
+	Timeout time.Duration
+}
+
+func (c *Command) Speak(ctx context.Context, text, lang string) ([]byte, string, error) {
+	if len(c.Args) == 0 {
+		return nil, "", errors.New("tts: empty command")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout(c.Timeout))
+	defer cancel()
+
+	var file string
+	stdin := true
+	for _, a := range c.Args {
+		if strings.Contains(a, "{file}") && file == "" {
+			dir, err := os.MkdirTemp("", "dlnagent-tts")
+			if err != nil {
+				return nil, "", err
+			}
+			defer os.RemoveAll(dir)
+			file = filepath.Join(dir, "speech.wav")
+		}
+		if strings.Contains(a, "{text}") {
+			stdin = false
+		}
+	}
+	r := strings.NewReplacer("{text}", text, "{lang}", lang, "{file}", file)
+	args := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		args[i] = r.Replace(a)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if stdin {
+		cmd.Stdin = strings.NewReader(text)
+	}
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, "", fmt.Errorf("tts %s: %s", filepath.Base(args[0]), msg)
+	}
+	audio := stdout.Bytes()
+	if file != "" {
+		var err error
+		if audio, err = os.ReadFile(file); err != nil {
+			return nil, "", fmt.Errorf("tts %s: %w", filepath.Base(args[0]), err)
+		}
+	}
+	if len(audio) == 0 {
+		return nil, "", fmt.Errorf("tts %s: no audio", filepath.Base(args[0]))
+	}
+	return audio, "audio/wav", nil
+}
+
+// HTTP fetches speech from a service, e.g. MaryTTS or a Home Assistant TTS
+// proxy. "{text}" and "{lang}" in URL are replaced, query-escaped. With a
+// Body, a POST sends it with the same replacements, JSON-escaped; else it
+// is a GET. The response's Content-Type is the audio's.
+type HTTP struct {
+	URL     string
+	Body    string
+	Headers map[string]string
+	Timeout time.Duration
+}
+
+func (c *HTTP) Speak(ctx context.Context, text, lang string) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout(c.Timeout))
+	defer cancel()
+
+	u := strings.NewReplacer("{text}", url.QueryEscape(text), "{lang}", url.QueryEscape(lang)).Replace(c.URL)
+	method, body := http.MethodGet, io.Reader(nil)
+	if c.Body != "" {
+		method = http.MethodPost
+		body = strings.NewReader(strings.NewReplacer("{text}", jsonEscape(text), "{lang}", jsonEscape(lang)).Replace(c.Body))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, "", fmt.Errorf("tts: %w", err)
+	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("tts: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("tts: %s", resp.Status)
+	}
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mimeType, "audio/") {
+		return nil, "", fmt.Errorf("tts: expected audio, got %q", resp.Header.Get("Content-Type"))
+	}
+	audio, err := io.ReadAll(io.LimitReader(resp.Body, maxAudio))
+	if err != nil {
+		return nil, "", fmt.Errorf("tts: %w", err)
+	}
+	return audio, mimeType, nil
+}
+
+func timeout(d time.Duration) time.Duration {
+	if d <= 0 {
+		return DefaultTimeout
+	}
+	return d
+}
+
+// jsonEscape escapes s for use inside a JSON string.
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
+// WAVDuration is the length of a PCM WAV file, or 0 if it is not one.
+func WAVDuration(b []byte) time.Duration {
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WAVE" {
+		return 0
+	}
+	var byteRate uint32
+	for p := 12; p+8 <= len(b); {
+		id, size := string(b[p:p+4]), int(binary.LittleEndian.Uint32(b[p+4:]))
+		p += 8
+		switch id {
+		case "fmt ":
+			if p+12 <= len(b) {
+				byteRate = binary.LittleEndian.Uint32(b[p+8:])
+			}
+		case "data":
+			// Streamed WAV has an unknown (0 or max) size
+			if size <= 0 || p+size > len(b) {
+				size = len(b) - p
+			}
+			if byteRate == 0 {
+				return 0
+			}
+			return time.Duration(float64(size) / float64(byteRate) * float64(time.Second))
+		}
+		p += size + size&1
+	}
+	return 0
+}
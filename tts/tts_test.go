@@ -0,0 +1,75 @@
+package tts
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// wav is a PCM WAV header and d of silence at 8 kHz, 8-bit mono.
+func wav(d time.Duration) []byte {
+	n := int(d.Seconds() * 8000)
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+n))
+	b.WriteString("WAVEfmt ")
+	for _, v := range []any{uint32(16), uint16(1), uint16(1), uint32(8000), uint32(8000), uint16(1), uint16(8)} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(n))
+	b.Write(make([]byte, n))
+	return b.Bytes()
+}
+
+func TestWAVDuration(t *testing.T) {
+	if d := WAVDuration(wav(1500 * time.Millisecond)); d != 1500*time.Millisecond {
+		t.Errorf("Expected 1.5s, got %v", d)
+	}
+	if d := WAVDuration([]byte("ID3 not a wav")); d != 0 {
+		t.Errorf("Expected 0 for MP3, got %v", d)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	file := &Command{Args: []string{"sh", "-c", `printf '%s/%s' "$1" "$2" > "$0"`, "{file}", "{text}", "{lang}"}}
+	audio, mimeType, err := file.Speak(context.Background(), "Dinner is {lang} ready", "en")
+	if err != nil || string(audio) != "Dinner is {lang} ready/en" || mimeType != "audio/wav" {
+		t.Errorf("Unexpected speech %q, %s, %v", audio, mimeType, err)
+	}
+	stdin := &Command{Args: []string{"cat"}}
+	if audio, _, err := stdin.Speak(context.Background(), "hello", ""); err != nil || string(audio) != "hello" {
+		t.Errorf("Expected the text on stdin, got %q, %v", audio, err)
+	}
+	fail := &Command{Args: []string{"sh", "-c", "echo no voice >&2; exit 1"}}
+	if _, _, err := fail.Speak(context.Background(), "x", ""); err == nil || err.Error() != "tts sh: no voice" {
+		t.Errorf("Expected stderr in the error, got %v", err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Query().Get("voice") != "de" || string(body) != `{"message": "Tür \"auf\""}` || r.Header.Get("Authorization") != "Bearer x" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte("mp3"))
+	}))
+	defer srv.Close()
+
+	c := &HTTP{URL: srv.URL + "/tts?voice={lang}", Body: `{"message": "{text}"}`, Headers: map[string]string{"Authorization": "Bearer x"}}
+	audio, mimeType, err := c.Speak(context.Background(), `Tür "auf"`, "de")
+	if err != nil || string(audio) != "mp3" || mimeType != "audio/mpeg" {
+		t.Errorf("Unexpected speech %q, %s, %v", audio, mimeType, err)
+	}
+	if _, _, err := c.Speak(context.Background(), "x", "en"); err == nil {
+		t.Error("Expected an error status to fail")
+	}
+}
@@ -0,0 +1,34 @@
+// Package tv controls smart TVs through their vendor APIs, for what UPnP
+// does not cover: switching the TV on and off and selecting its input.
+package tv
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrStandby is returned by PowerOn for a TV whose vendor API cannot wake
+// it from its current standby mode; Wake-on-LAN may.
+var ErrStandby = errors.New("TV is in standby")
+
+// Controller drives one TV.
+type Controller interface {
+	Name() string
+	// PowerOn turns the TV (or its screen) on. It is a no-op for a TV
+	// that is already on.
+	PowerOn(ctx context.Context) error
+	// PowerOff puts the TV in standby.
+	PowerOff(ctx context.Context) error
+	// SetInput switches to an input in the vendor's naming, e.g. HDMI_1 on
+	// webOS or KEY_HDMI1 on Tizen.
+	SetInput(ctx context.Context, input string) error
+}
+
+// withPort adds port to host unless it has one.
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
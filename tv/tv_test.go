@@ -0,0 +1,177 @@
+package tv
+
+import (
+	"bufio"
+	"context"
+	"dlna/internal/websocket"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTV serves a WebSocket whose messages are answered by respond, and
+// records the messages it receives.
+type fakeTV struct {
+	mu       sync.Mutex
+	received []map[string]interface{}
+	// greeting is sent right after the handshake, if set
+	greeting interface{}
+	respond  func(msg map[string]interface{}) []interface{}
+}
+
+func (f *fakeTV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocket.Accept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	rw.Flush()
+
+	send := func(v interface{}) {
+		payload, _ := json.Marshal(v)
+		websocket.WriteFrame(conn, websocket.OpText, payload, false)
+	}
+	if f.greeting != nil {
+		send(f.greeting)
+	}
+	r2 := bufio.NewReader(rw)
+	for {
+		_, opcode, payload, err := websocket.ReadFrame(r2, maxMessage)
+		if err != nil || opcode == websocket.OpClose {
+			return
+		}
+		var msg map[string]interface{}
+		json.Unmarshal(payload, &msg)
+		f.mu.Lock()
+		f.received = append(f.received, msg)
+		f.mu.Unlock()
+		if f.respond != nil {
+			for _, reply := range f.respond(msg) {
+				send(reply)
+			}
+		}
+	}
+}
+
+func (f *fakeTV) uris() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []string
+	for _, m := range f.received {
+		if uri, ok := m["uri"].(string); ok {
+			out = append(out, uri)
+		}
+	}
+	return out
+}
+
+func TestWebOS(t *testing.T) {
+	fake := &fakeTV{respond: func(msg map[string]interface{}) []interface{} {
+		id := msg["id"]
+		switch msg["type"] {
+		case "register":
+			if p, _ := msg["payload"].(map[string]interface{}); p["client-key"] != nil {
+				return []interface{}{map[string]interface{}{"type": "registered", "id": id, "payload": map[string]string{"client-key": p["client-key"].(string)}}}
+			}
+			return []interface{}{
+				map[string]interface{}{"type": "response", "id": id, "payload": map[string]string{"pairingType": "PROMPT"}},
+				map[string]interface{}{"type": "registered", "id": id, "payload": map[string]string{"client-key": "k123"}},
+			}
+		case "request":
+			if msg["uri"] == "ssap://com.webos.service.tvpower/power/getPowerState" {
+				return []interface{}{map[string]interface{}{"type": "response", "id": id, "payload": map[string]interface{}{"returnValue": true, "state": "Screen Off"}}}
+			}
+			if msg["uri"] == "ssap://tv/switchInput" {
+				return []interface{}{map[string]interface{}{"type": "response", "id": id, "payload": map[string]interface{}{"returnValue": false, "errorText": "no such input"}}}
+			}
+			return []interface{}{map[string]interface{}{"type": "response", "id": id, "payload": map[string]interface{}{"returnValue": true}}}
+		}
+		return nil
+	}}
+	srv := httptest.NewTLSServer(fake)
+	defer srv.Close()
+
+	var paired string
+	tv := &WebOS{Host: strings.TrimPrefix(srv.URL, "https://"), OnKey: func(key string) { paired = key }}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := tv.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn failed: %v", err)
+	}
+	if paired != "k123" || tv.Key != "k123" {
+		t.Errorf("Expected client-key k123, got %q", paired)
+	}
+	if err := tv.SetInput(ctx, "HDMI_9"); err == nil || !strings.Contains(err.Error(), "no such input") {
+		t.Errorf("Expected the TV's error, got %v", err)
+	}
+	if err := tv.PowerOff(ctx); err != nil {
+		t.Fatalf("PowerOff failed: %v", err)
+	}
+	want := []string{
+		"ssap://com.webos.service.tvpower/power/getPowerState",
+		"ssap://com.webos.service.tvpower/power/turnOnScreen",
+		"ssap://tv/switchInput",
+		"ssap://system/turnOff",
+	}
+	if got := fake.uris(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Unexpected requests %v", got)
+	}
+}
+
+func TestTizen(t *testing.T) {
+	fake := &fakeTV{greeting: map[string]interface{}{"event": "ms.channel.connect", "data": map[string]string{"token": "t42"}}}
+	srv := httptest.NewTLSServer(fake)
+	defer srv.Close()
+	state := "standby"
+	info := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"device": map[string]string{"PowerState": state}})
+	}))
+	defer info.Close()
+
+	tv := &Tizen{Host: strings.TrimPrefix(srv.URL, "https://"), InfoURL: info.URL}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := tv.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn failed: %v", err)
+	}
+	if tv.Key != "t42" {
+		t.Errorf("Expected token t42, got %q", tv.Key)
+	}
+	state = "on"
+	if err := tv.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn failed: %v", err)
+	}
+	if err := tv.SetInput(ctx, "KEY_HDMI1"); err != nil {
+		t.Fatalf("SetInput failed: %v", err)
+	}
+
+	// Keys are fire-and-forget; wait for the fake to read the last one
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fake.mu.Lock()
+		n := len(fake.received)
+		fake.mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	var keys []string
+	for _, m := range fake.received {
+		p, _ := m["params"].(map[string]interface{})
+		keys = append(keys, p["DataOfCmd"].(string))
+	}
+	if strings.Join(keys, " ") != "KEY_POWER KEY_HDMI1" {
+		t.Errorf("Expected KEY_POWER then KEY_HDMI1, got %v", keys)
+	}
+}
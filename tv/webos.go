@@ -0,0 +1,167 @@
+package tv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// webOSPermissions are requested when pairing; the TV shows them on the
+// pairing prompt.
+var webOSPermissions = []string{"CONTROL_POWER", "READ_POWER_STATE", "CONTROL_INPUT_TV", "READ_INPUT_DEVICE_LIST"}
+
+// WebOS controls LG TVs over the SSAP WebSocket API on port 3001.
+type WebOS struct {
+	Host string // Address, optionally with a port
+	// Key is the client-key of an earlier pairing. Without one, the TV
+	// asks to accept the agent on screen.
+	Key   string
+	OnKey func(key string) // Optional, called with a new client-key
+}
+
+func (t *WebOS) Name() string { return "webos" }
+
+// PowerOn turns the screen on. A TV in full standby only answers
+// Wake-on-LAN, so ErrStandby is returned for it.
+func (t *WebOS) PowerOn(ctx context.Context) error {
+	return t.session(ctx, func(s *ssap) error {
+		var power struct {
+			State string `json:"state"`
+		}
+		if err := s.request("ssap://com.webos.service.tvpower/power/getPowerState", nil, &power); err != nil {
+			return err
+		}
+		switch power.State {
+		case "Active", "":
+			return nil
+		case "Screen Off", "Screen Saver":
+			return s.request("ssap://com.webos.service.tvpower/power/turnOnScreen", nil, nil)
+		default:
+			return ErrStandby
+		}
+	})
+}
+
+func (t *WebOS) PowerOff(ctx context.Context) error {
+	return t.session(ctx, func(s *ssap) error {
+		return s.request("ssap://system/turnOff", nil, nil)
+	})
+}
+
+func (t *WebOS) SetInput(ctx context.Context, input string) error {
+	return t.session(ctx, func(s *ssap) error {
+		return s.request("ssap://tv/switchInput", map[string]string{"inputId": input}, nil)
+	})
+}
+
+// ssapMessage is the envelope of every SSAP message.
+type ssapMessage struct {
+	Type    string          `json:"type"` // register, request, response, registered or error
+	ID      string          `json:"id"`
+	URI     string          `json:"uri,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// ssap is a registered connection to a webOS TV.
+type ssap struct {
+	ws     *wsConn
+	nextID int
+}
+
+// session connects, registers (pairing if needed) and runs fn.
+func (t *WebOS) session(ctx context.Context, fn func(s *ssap) error) error {
+	ws, err := dialWebSocket(ctx, "wss://"+withPort(t.Host, "3001")+"/")
+	if err != nil {
+		return fmt.Errorf("webos: %w", err)
+	}
+	defer ws.Close()
+	s := &ssap{ws: ws}
+
+	register := map[string]interface{}{
+		"forcePairing": false,
+		"pairingType":  "PROMPT",
+		"manifest": map[string]interface{}{
+			"manifestVersion": 1,
+			"appId":           "dlnagent",
+			"permissions":     webOSPermissions,
+		},
+	}
+	if t.Key != "" {
+		register["client-key"] = t.Key
+	}
+	payload, _ := json.Marshal(register)
+	if err := ws.writeJSON(ssapMessage{Type: "register", ID: "register", Payload: payload}); err != nil {
+		return fmt.Errorf("webos: %w", err)
+	}
+	// The TV answers "response" while the pairing prompt is shown, then
+	// "registered"
+	for {
+		var msg ssapMessage
+		if err := ws.readJSON(&msg); err != nil {
+			return fmt.Errorf("webos: registration: %w", err)
+		}
+		if msg.ID != "register" {
+			continue
+		}
+		if msg.Type == "error" {
+			return fmt.Errorf("webos: registration rejected: %s", msg.Error)
+		}
+		if msg.Type == "registered" {
+			var reg struct {
+				ClientKey string `json:"client-key"`
+			}
+			json.Unmarshal(msg.Payload, &reg)
+			if reg.ClientKey != "" && reg.ClientKey != t.Key {
+				t.Key = reg.ClientKey
+				if t.OnKey != nil {
+					t.OnKey(reg.ClientKey)
+				}
+			}
+			break
+		}
+	}
+
+	if err := fn(s); err != nil {
+		return fmt.Errorf("webos: %w", err)
+	}
+	return nil
+}
+
+// request calls uri and decodes the response payload into out, if not nil.
+func (s *ssap) request(uri string, in, out interface{}) error {
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	msg := ssapMessage{Type: "request", ID: id, URI: uri}
+	if in != nil {
+		msg.Payload, _ = json.Marshal(in)
+	}
+	if err := s.ws.writeJSON(msg); err != nil {
+		return err
+	}
+	for {
+		var resp ssapMessage
+		if err := s.ws.readJSON(&resp); err != nil {
+			return err
+		}
+		if resp.ID != id {
+			continue
+		}
+		if resp.Type == "error" {
+			return fmt.Errorf("%s: %s", uri, resp.Error)
+		}
+		var result struct {
+			ReturnValue *bool  `json:"returnValue"`
+			ErrorText   string `json:"errorText"`
+		}
+		json.Unmarshal(resp.Payload, &result)
+		if result.ReturnValue != nil && !*result.ReturnValue {
+			return fmt.Errorf("%s: %s", uri, result.ErrorText)
+		}
+		if out != nil {
+			return json.Unmarshal(resp.Payload, out)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,126 @@
+package tv
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"dlna/internal/websocket"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxMessage bounds a message read from a TV.
+const maxMessage = 1 << 20
+
+var errClosed = errors.New("connection closed by TV")
+
+// wsConn is a minimal WebSocket client for the JSON APIs of TVs: text
+// messages only, without extensions.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialWebSocket connects to a ws:// or wss:// URL. TVs use self-signed
+// certificates, so wss certificates are not verified. The context deadline
+// applies to the whole connection.
+func dialWebSocket(ctx context.Context, rawURL string) (*wsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = d.DialContext(ctx, "tcp", u.Host)
+	case "wss":
+		td := &tls.Dialer{NetDialer: &d, Config: &tls.Config{InsecureSkipVerify: true}}
+		conn, err = td.DialContext(ctx, "tcp", u.Host)
+	default:
+		return nil, fmt.Errorf("unsupported WebSocket scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	_, err = io.WriteString(conn, "GET "+u.RequestURI()+" HTTP/1.1\r\n"+
+		"Host: "+u.Host+"\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: "+key+"\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != websocket.Accept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake failed: %s", resp.Status)
+	}
+	return &wsConn{conn: conn, r: r}, nil
+}
+
+func (c *wsConn) writeJSON(v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return websocket.WriteFrame(c.conn, websocket.OpText, payload, true)
+}
+
+// readJSON decodes the next text message, answering pings on the way.
+func (c *wsConn) readJSON(v interface{}) error {
+	var msg []byte
+	for {
+		fin, opcode, payload, err := websocket.ReadFrame(c.r, maxMessage)
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case websocket.OpPing:
+			if err := websocket.WriteFrame(c.conn, websocket.OpPong, payload, true); err != nil {
+				return err
+			}
+			continue
+		case websocket.OpPong:
+			continue
+		case websocket.OpClose:
+			return errClosed
+		}
+		if msg = append(msg, payload...); len(msg) > maxMessage {
+			return errors.New("message from TV too large")
+		}
+		if fin {
+			return json.Unmarshal(msg, v)
+		}
+	}
+}
+
+func (c *wsConn) Close() error {
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	websocket.WriteFrame(c.conn, websocket.OpClose, nil, true)
+	return c.conn.Close()
+}